@@ -3,9 +3,15 @@ package main
 import (
 	"fmt"
 	fs "github.com/ipdcode/containerfs/fs"
+	"github.com/ipdcode/containerfs/libcfs"
 	"github.com/ipdcode/containerfs/logger"
+	"github.com/ipdcode/containerfs/utils"
 	"github.com/lxmgo/config"
+	"io"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func main() {
@@ -15,11 +21,12 @@ func main() {
 		fmt.Println("NewConfig err")
 		os.Exit(1)
 	}
+	utils.ConfigEnv(c)
 
 	fs.VolMgrAddr = c.String("volmgr::host")
 	fs.MetaNodePeers = c.Strings("metanode::host")
 	fs.MetaNodeAddr = fs.MetaNodePeers[0]
-	fs.BufferSize = 1024 * 1024
+	fs.BufferSize.Set(1024 * 1024)
 
 	logger.SetConsole(true)
 	logger.SetRollingFile(c.String("logger::log"), "fuse.log", 10, 100, logger.MB) //each 100M rolling
@@ -33,16 +40,25 @@ func main() {
 	default:
 		logger.SetLevel(logger.ERROR)
 	}
+	faultSeed, _ := c.Int("faults::seed")
+	if err := utils.SetFaults(c.String("faults::rules"), int64(faultSeed)); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
 	switch os.Args[2] {
 
 	case "createvol":
 		argNum := len(os.Args)
-		if argNum != 5 {
-			fmt.Println("createvol [volname] [space GB]")
+		if argNum != 5 && argNum != 6 {
+			fmt.Println("createvol [volname] [space GB] [ssd|hdd|auto]")
 			os.Exit(1)
 		}
-		ret := fs.CreateVol(os.Args[3], os.Args[4])
+		var class string
+		if argNum == 6 {
+			class = os.Args[5]
+		}
+		ret := fs.CreateVol(os.Args[3], os.Args[4], class)
 		if ret != 0 {
 			fmt.Println("failed")
 		}
@@ -67,6 +83,213 @@ func main() {
 		if ret != 0 {
 			fmt.Println("failed")
 		}
+	case "restorevol":
+		argNum := len(os.Args)
+		if argNum != 4 {
+			fmt.Println("restorevol [voluuid]")
+			os.Exit(1)
+		}
+		ret := fs.RestoreVol(os.Args[3])
+		if ret == 2 {
+			fmt.Println("volume is not pending purge")
+		} else if ret != 0 {
+			fmt.Println("failed")
+		}
+	case "replicavol", "promotevol":
+		argNum := len(os.Args)
+		if argNum != 4 {
+			fmt.Printf("%s [voluuid]\n", os.Args[2])
+			os.Exit(1)
+		}
+		ret := fs.SetVolReplica(os.Args[3], os.Args[2] == "replicavol")
+		if ret == 2 {
+			fmt.Println("no such volume")
+		} else if ret != 0 {
+			fmt.Println("failed")
+		}
+	case "setvolclass":
+		argNum := len(os.Args)
+		if argNum != 5 {
+			fmt.Println("setvolclass [voluuid] [ssd|hdd|auto|any]")
+			os.Exit(1)
+		}
+		class := os.Args[4]
+		if class == "any" {
+			class = ""
+		}
+		ret := fs.SetVolStorageClass(os.Args[3], class)
+		if ret == 2 {
+			fmt.Println("no such volume")
+		} else if ret == 22 {
+			fmt.Println("setvolclass [voluuid] [ssd|hdd|auto|any]")
+		} else if ret != 0 {
+			fmt.Println("failed")
+		}
+	case "setcapacity":
+		argNum := len(os.Args)
+		if argNum != 6 {
+			fmt.Println("setcapacity [voluuid] [soft percent] [hard percent], 0 for none")
+			os.Exit(1)
+		}
+		soft, err1 := strconv.Atoi(os.Args[4])
+		hard, err2 := strconv.Atoi(os.Args[5])
+		if err1 != nil || err2 != nil {
+			fmt.Println("setcapacity [voluuid] [soft percent] [hard percent], 0 for none")
+			os.Exit(1)
+		}
+		ret := fs.SetVolCapacityLimits(os.Args[3], int32(soft), int32(hard))
+		if ret == 2 {
+			fmt.Println("no such volume")
+		} else if ret == 22 {
+			fmt.Println("the limits are percents, the soft one at most the hard one")
+		} else if ret != 0 {
+			fmt.Println("failed")
+		}
+	case "setpolicy":
+		argNum := len(os.Args)
+		if argNum != 6 {
+			fmt.Println("setpolicy [voluuid] [path] [replicas=N,tier=ssd|hdd|none]")
+			os.Exit(1)
+		}
+		ret := fs.SetPolicy(os.Args[3], os.Args[4], os.Args[5])
+		if ret == 2 {
+			fmt.Println("no such file or directory")
+		} else if ret == 22 {
+			fmt.Println("setpolicy [voluuid] [path] [replicas=N,tier=ssd|hdd|none]")
+		} else if ret == 95 {
+			fmt.Println("erasure coding is not supported")
+		} else if ret != 0 {
+			fmt.Println("failed")
+		}
+	case "getpolicy":
+		argNum := len(os.Args)
+		if argNum != 5 {
+			fmt.Println("getpolicy [voluuid] [path]")
+			os.Exit(1)
+		}
+		ret, policy := fs.GetPolicy(os.Args[3], os.Args[4])
+		if ret == 2 {
+			fmt.Println("no such file or directory")
+		} else if ret != 0 {
+			fmt.Println("failed")
+		} else if policy == "" {
+			fmt.Println("none")
+		} else {
+			fmt.Println(policy)
+		}
+	case "setaccessmode":
+		argNum := len(os.Args)
+		if argNum != 5 {
+			fmt.Println("setaccessmode [voluuid] [RWO|ROX|RWX]")
+			os.Exit(1)
+		}
+		ret := fs.SetVolAccessMode(os.Args[3], strings.ToUpper(os.Args[4]))
+		if ret == 2 {
+			fmt.Println("no such volume")
+		} else if ret == 22 {
+			fmt.Println("setaccessmode [voluuid] [RWO|ROX|RWX]")
+		} else if ret == 16 {
+			fmt.Println("the volume is mounted read-write against the mode, unmount first")
+		} else if ret != 0 {
+			fmt.Println("failed")
+		}
+	case "setwritequorum":
+		argNum := len(os.Args)
+		if argNum != 5 {
+			fmt.Println("setwritequorum [voluuid] [one|quorum|all|async]")
+			os.Exit(1)
+		}
+		quorum, ok := fs.ParseWriteQuorum(os.Args[4])
+		if !ok {
+			fmt.Println("setwritequorum [voluuid] [one|quorum|all|async]")
+			os.Exit(1)
+		}
+		ret := fs.SetVolWriteQuorum(os.Args[3], quorum)
+		if ret == 2 {
+			fmt.Println("no such volume")
+		} else if ret != 0 {
+			fmt.Println("failed")
+		}
+	case "migratevol":
+		argNum := len(os.Args)
+		if argNum != 5 {
+			fmt.Println("migratevol [voluuid] [metanode addr of the target cluster]")
+			os.Exit(1)
+		}
+		ret := fs.MigrateVol(os.Args[3], os.Args[4])
+		if ret == 2 {
+			fmt.Println("no such volume")
+		} else if ret == 17 {
+			fmt.Println("the volume is already there")
+		} else if ret != 0 {
+			fmt.Printf("migratevol failed , ret :%d\n", ret)
+		}
+	case "freezevol", "thawvol":
+		argNum := len(os.Args)
+		if argNum != 4 {
+			fmt.Printf("%s [voluuid]\n", os.Args[2])
+			os.Exit(1)
+		}
+		ret := fs.FreezeVol(os.Args[3], os.Args[2] == "freezevol", "")
+		if ret != 0 {
+			fmt.Println("failed")
+		}
+	case "shards":
+		argNum := len(os.Args)
+		if argNum != 4 {
+			fmt.Println("shards [voluuid]")
+			os.Exit(1)
+		}
+		for i := int32(0); i < fs.ShardCount(os.Args[3]); i++ {
+			ret, info := fs.ShardInfo(os.Args[3], i)
+			if ret != 0 && ret != 22 {
+				fmt.Printf("shard %d: failed , ret :%d\n", i, ret)
+				continue
+			}
+			fmt.Printf("shard %d: dirs:%d ops:%d\n", i, info.Dirs, info.Ops)
+		}
+	case "splitshard":
+		argNum := len(os.Args)
+		if argNum != 5 && argNum != 6 {
+			fmt.Println("splitshard [voluuid] [shard | hot [min ops/s]]")
+			os.Exit(1)
+		}
+		var shard int64
+		if os.Args[4] == "hot" {
+			var min float64
+			if argNum == 6 {
+				min, _ = strconv.ParseFloat(os.Args[5], 64)
+			}
+			hot, rate := fs.HotShard(os.Args[3], 10*time.Second)
+			if hot < 0 || rate < min {
+				fmt.Printf("no shard above %v ops/s\n", min)
+				return
+			}
+			fmt.Printf("shard %d: %.1f ops/s\n", hot, rate)
+			shard = int64(hot)
+		} else {
+			var err error
+			if shard, err = strconv.ParseInt(os.Args[4], 10, 32); err != nil {
+				fmt.Println("bad shard")
+				os.Exit(1)
+			}
+		}
+		ret := fs.SplitShard(os.Args[3], int32(shard))
+		if ret == 22 {
+			fmt.Println("too few dirs in the shard to split")
+		} else if ret != 0 {
+			fmt.Printf("splitshard failed , ret :%d\n", ret)
+		}
+	case "purgevol":
+		argNum := len(os.Args)
+		if argNum != 4 {
+			fmt.Println("purgevol [voluuid]")
+			os.Exit(1)
+		}
+		ret := fs.PurgeVol(os.Args[3])
+		if ret != 0 {
+			fmt.Println("failed")
+		}
 	case "snapshootvol":
 		argNum := len(os.Args)
 		if argNum != 4 {
@@ -89,6 +312,277 @@ func main() {
 		} else {
 			fmt.Printf("get volume info failed , ret :%d", ret)
 		}
+	case "getvollatency":
+		argNum := len(os.Args)
+		if argNum != 4 {
+			fmt.Println("getvollatency [volUUID]")
+			os.Exit(1)
+		}
+		ret, vl := fs.GetVolLatency(os.Args[3])
+		if ret == 0 {
+			fmt.Printf("read  ops:%d p50:%dus p99:%dus\n", vl.ReadOps, vl.ReadP50, vl.ReadP99)
+			fmt.Printf("write ops:%d p50:%dus p99:%dus\n", vl.WriteOps, vl.WriteP50, vl.WriteP99)
+		} else {
+			fmt.Printf("get volume latency failed , ret :%d", ret)
+		}
+	case "sessions":
+		argNum := len(os.Args)
+		if argNum != 4 {
+			fmt.Println("sessions [volUUID]")
+			os.Exit(1)
+		}
+		ret, sessions := fs.ListSessions(os.Args[3])
+		if ret != 0 {
+			fmt.Printf("list sessions failed , ret :%d\n", ret)
+			os.Exit(1)
+		}
+		for _, s := range sessions {
+			fmt.Printf("%s host:%s mountpoint:%s opens:%d started:%s last seen:%s\n", s.ClientID, s.Host, s.MountPoint, s.Opens,
+				time.Unix(s.Started, 0).Format(time.RFC3339), time.Unix(s.LastSeen, 0).Format(time.RFC3339))
+		}
+	case "evictclient":
+		argNum := len(os.Args)
+		if argNum != 5 {
+			fmt.Println("evictclient [volUUID] [client id, see sessions]")
+			os.Exit(1)
+		}
+		ret := fs.FenceVol(os.Args[3], os.Args[4], true)
+		if ret == 0 {
+			fmt.Println("ok")
+		} else {
+			fmt.Printf("evict failed , ret :%d\n", ret)
+		}
+	case "fencevol", "unfencevol":
+		argNum := len(os.Args)
+		if argNum != 4 {
+			fmt.Printf("%s [volUUID]\n", os.Args[2])
+			os.Exit(1)
+		}
+		ret := fs.FenceVol(os.Args[3], "", os.Args[2] == "fencevol")
+		if ret == 0 {
+			fmt.Println("ok")
+		} else {
+			fmt.Printf("%s failed , ret :%d\n", os.Args[2], ret)
+		}
+	case "restoretrash":
+		argNum := len(os.Args)
+		if argNum != 6 {
+			fmt.Println("restoretrash [volUUID] [date] [name in .trash/date]")
+			os.Exit(1)
+		}
+		ret := fs.RestoreTrash(os.Args[3], os.Args[4], os.Args[5])
+		if ret == 0 {
+			fmt.Println("ok")
+		} else {
+			fmt.Printf("restore failed , ret :%d\n", ret)
+		}
+	case "purgetrash":
+		argNum := len(os.Args)
+		if argNum != 4 && argNum != 5 {
+			fmt.Println("purgetrash [volUUID] [date]")
+			os.Exit(1)
+		}
+		date := ""
+		if argNum == 5 {
+			date = os.Args[4]
+		}
+		ret := fs.PurgeTrash(os.Args[3], date)
+		if ret == 0 {
+			fmt.Println("ok")
+		} else {
+			fmt.Printf("purge failed , ret :%d\n", ret)
+		}
+	case "setlifecycle":
+		argNum := len(os.Args)
+		if argNum != 6 {
+			fmt.Println("setlifecycle [volUUID] [dir] [delete:30d,archive:7d|none]")
+			os.Exit(1)
+		}
+		ret := fs.SetLifecycle(os.Args[3], os.Args[4], os.Args[5])
+		if ret == 0 {
+			fmt.Println("ok")
+		} else {
+			fmt.Printf("setlifecycle failed , ret :%d\n", ret)
+		}
+	case "getlifecycle":
+		argNum := len(os.Args)
+		if argNum != 5 {
+			fmt.Println("getlifecycle [volUUID] [dir]")
+			os.Exit(1)
+		}
+		ret, rules := fs.GetLifecycle(os.Args[3], os.Args[4])
+		if ret != 0 {
+			fmt.Printf("getlifecycle failed , ret :%d\n", ret)
+		} else if rules == "" {
+			fmt.Println("none")
+		} else {
+			fmt.Println(rules)
+		}
+	case "dedup":
+		argNum := len(os.Args)
+		if argNum != 4 && argNum != 5 && argNum != 6 {
+			fmt.Println("dedup [volUUID] [path] [hours since the last write, default 24]")
+			os.Exit(1)
+		}
+		path := "/"
+		if argNum >= 5 {
+			path = os.Args[4]
+		}
+		minAge := 24 * time.Hour
+		if argNum == 6 {
+			hours, err := strconv.Atoi(os.Args[5])
+			if err != nil || hours < 0 {
+				fmt.Println("bad hours")
+				os.Exit(1)
+			}
+			minAge = time.Duration(hours) * time.Hour
+		}
+		ret, stats := fs.Dedup(os.Args[3], path, minAge)
+		fmt.Println(stats)
+		if ret != 0 {
+			fmt.Printf("dedup failed , ret :%d\n", ret)
+		}
+	case "clone":
+		argNum := len(os.Args)
+		if argNum != 6 {
+			fmt.Println("clone [volUUID] [src file] [dst file]")
+			os.Exit(1)
+		}
+		ret := fs.CloneFile(os.Args[3], os.Args[4], os.Args[5])
+		if ret != 0 {
+			fmt.Printf("clone failed , ret :%d\n", ret)
+		}
+	case "ingesttar":
+		argNum := len(os.Args)
+		if argNum < 6 || argNum > 8 {
+			fmt.Println("ingesttar [volUUID] [dir] [tar file, - for stdin] [whiteouts, to apply those of an image layer] [skipspecial, to skip the symlinks, devices and fifos]")
+			os.Exit(1)
+		}
+		var opt libcfs.TarOptions
+		for _, arg := range os.Args[6:] {
+			switch arg {
+			case "whiteouts":
+				opt.Whiteouts = true
+			case "skipspecial":
+				opt.SkipSpecial = true
+			default:
+				fmt.Printf("ingesttar: unknown option %v\n", arg)
+				os.Exit(1)
+			}
+		}
+		var r io.Reader = os.Stdin
+		if os.Args[5] != "-" {
+			f, err := os.Open(os.Args[5])
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			r = f
+		}
+		vol, err := libcfs.Open(os.Args[3], libcfs.Config{VolMgr: fs.VolMgrAddr, MetaNodes: fs.MetaNodePeers, BufferSize: int32(fs.BufferSize.Get())})
+		if err != nil {
+			fmt.Printf("open volume %v err:%v\n", os.Args[3], err)
+			os.Exit(1)
+		}
+		dir := strings.Trim(os.Args[4], "/")
+		if dir == "" {
+			dir = "."
+		}
+		stats, err := vol.IngestTar(dir, r, opt)
+		fmt.Printf("files %v dirs %v links %v removed %v skipped %v, %vMB\n",
+			stats.Files, stats.Dirs, stats.Links, stats.Removed, stats.Skipped, stats.Bytes>>20)
+		for _, name := range stats.SkippedNames {
+			fmt.Printf("skipped %v\n", name)
+		}
+		if err != nil {
+			fmt.Printf("ingesttar failed , err :%v\n", err)
+			os.Exit(1)
+		}
+	case "copytree":
+		argNum := len(os.Args)
+		if argNum != 6 {
+			fmt.Println("copytree [volUUID] [src] [dst]")
+			os.Exit(1)
+		}
+		ret, files, dirs := fs.CopyTree(os.Args[3], os.Args[4], os.Args[5])
+		fmt.Printf("files %v dirs %v\n", files, dirs)
+		if ret != 0 {
+			fmt.Printf("copytree failed , ret :%d\n", ret)
+		}
+	case "rmtree":
+		argNum := len(os.Args)
+		if argNum != 5 {
+			fmt.Println("rmtree [volUUID] [path]")
+			os.Exit(1)
+		}
+		ret, files, dirs := fs.DeleteTree(os.Args[3], os.Args[4])
+		fmt.Printf("files %v dirs %v\n", files, dirs)
+		if ret != 0 {
+			fmt.Printf("rmtree failed , ret :%d\n", ret)
+		}
+	case "movetree":
+		argNum := len(os.Args)
+		if argNum != 6 {
+			fmt.Println("movetree [volUUID] [src] [dst]")
+			os.Exit(1)
+		}
+		ret := fs.MoveTree(os.Args[3], os.Args[4], os.Args[5])
+		if ret != 0 {
+			fmt.Printf("movetree failed , ret :%d\n", ret)
+		}
+	case "du":
+		argNum := len(os.Args)
+		if argNum != 4 && argNum != 5 {
+			fmt.Println("du [volUUID] [path]")
+			os.Exit(1)
+		}
+		path := "/"
+		if argNum == 5 {
+			path = os.Args[4]
+		}
+		ret, du := fs.DirUsage(os.Args[3], path)
+		if ret == 0 {
+			fmt.Printf("bytes:%d files:%d dirs:%d\n", du.Bytes, du.Files, du.Dirs)
+		} else {
+			fmt.Printf("du failed , ret :%d\n", ret)
+		}
+
+	case "metadump":
+		argNum := len(os.Args)
+		if argNum != 5 && argNum != 6 {
+			fmt.Println("metadump [volUUID] [file] [since, the applied of an earlier dump for an incremental one]")
+			os.Exit(1)
+		}
+		var since uint64
+		if argNum == 6 {
+			var err error
+			if since, err = strconv.ParseUint(os.Args[5], 10, 64); err != nil {
+				fmt.Println("bad since")
+				os.Exit(1)
+			}
+		}
+		ret, applied := fs.DumpMeta(os.Args[3], since, os.Args[4])
+		if ret == 0 {
+			fmt.Printf("applied:%d\n", applied)
+		} else if ret == 34 {
+			fmt.Println("the changes since that dump are gone, take a full dump")
+		} else {
+			fmt.Printf("metadump failed , ret :%d\n", ret)
+		}
+
+	case "metarestore":
+		argNum := len(os.Args)
+		if argNum < 5 {
+			fmt.Println("metarestore [volUUID] [full dump file] [incremental dump files in order]...")
+			os.Exit(1)
+		}
+		ret := fs.RestoreMeta(os.Args[3], os.Args[4:])
+		if ret == 39 {
+			fmt.Println("the volume is not empty")
+		} else if ret != 0 {
+			fmt.Printf("metarestore failed , ret :%d\n", ret)
+		}
 
 	default:
 		fmt.Println("wrong operation")
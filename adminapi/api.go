@@ -0,0 +1,558 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	cfs "github.com/ipdcode/containerfs/fs"
+	"github.com/ipdcode/containerfs/logger"
+	vp "github.com/ipdcode/containerfs/proto/vp"
+	"github.com/ipdcode/containerfs/utils"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// apiHandler the admin operations under /v1:
+//
+//	GET    /v1/volumes                     the volumes
+//	POST   /v1/volumes                     creates one, {"name", "capacity_gb", "storage_class"}
+//	GET    /v1/volumes/<uuid>              its settings
+//	PATCH  /v1/volumes/<uuid>              changes them, any of {"storage_class", "access_mode",
+//	                                       "write_quorum", "soft_limit", "hard_limit"}
+//	DELETE /v1/volumes/<uuid>              deletes it pending purge, ?purge=1 at once
+//	POST   /v1/volumes/<uuid>/restore      brings back a volume pending purge
+//	POST   /v1/volumes/<uuid>/expand       adds {"capacity_gb"} to it
+//	POST   /v1/volumes/<uuid>/snapshot     snapshots its metadata on the metanodes
+//	GET    /v1/volumes/<uuid>/stats        its space and the latency of its clients
+//	GET    /v1/volumes/<uuid>/sessions     the clients mounting it
+//	GET    /v1/datanodes                   the datanodes and their labels
+//	POST   /v1/ensure                      the volume {"name", "capacity_gb", ...} as described,
+//	                                       created or changed to match
+//	POST   /v1/reconcile                   ensures each of a list of them
+//
+// ensure and reconcile take ?dry_run=1 for the changes they would make, the
+// provisioning tools plan with it.
+// The errors are {"error", "ret"}, ret the errno of the operation.
+type apiHandler struct {
+	tokens map[string]string
+}
+
+// apiStatus the status of the errno of an operation
+var apiStatus = map[int32]int{
+	int32(syscall.ENOENT): http.StatusNotFound,
+	int32(syscall.EINVAL): http.StatusBadRequest,
+	int32(syscall.EBUSY):  http.StatusConflict,
+	int32(syscall.EEXIST): http.StatusConflict,
+}
+
+type apiError struct {
+	Error string `json:"error"`
+	Ret   int32  `json:"ret"`
+}
+
+func reply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if v != nil {
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+// fail replies the error of an operation returning ret
+func fail(w http.ResponseWriter, op string, ret int32) {
+	status, ok := apiStatus[ret]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	reply(w, status, &apiError{Error: fmt.Sprintf("%s failed", op), Ret: ret})
+}
+
+func badRequest(w http.ResponseWriter, msg string) {
+	reply(w, http.StatusBadRequest, &apiError{Error: msg, Ret: int32(syscall.EINVAL)})
+}
+
+type volume struct {
+	UUID         string `json:"uuid"`
+	Name         string `json:"name"`
+	MetaDomain   string `json:"metadomain"`
+	CapacityGB   int32  `json:"capacity_gb"`
+	Status       string `json:"status"`
+	PurgeTime    int64  `json:"purge_time,omitempty"`
+	Replica      bool   `json:"replica"`
+	WriteQuorum  string `json:"write_quorum"`
+	StorageClass string `json:"storage_class"`
+	AccessMode   string `json:"access_mode"`
+	SoftLimit    int32  `json:"soft_limit"`
+	HardLimit    int32  `json:"hard_limit"`
+	BlockGroups  int    `json:"block_groups"`
+	Shards       int32  `json:"shards,omitempty"`
+}
+
+// the names of the write quorums of VolInfo
+var quorumNames = map[int32]string{0: "all", 1: "one", 2: "async", 3: "quorum"}
+
+func getVolume(uuid string) (int32, *volume) {
+	ret, ack := cfs.GetVolInfo(uuid)
+	if ret != 0 {
+		return int32(syscall.ENOENT), nil
+	}
+	vi := ack.VolInfo
+	v := &volume{
+		UUID:         vi.VolID,
+		Name:         vi.VolName,
+		MetaDomain:   vi.MetaDomain,
+		CapacityGB:   vi.SpaceQuota,
+		Status:       "ok",
+		Replica:      vi.Replica,
+		WriteQuorum:  quorumNames[vi.WriteQuorum],
+		StorageClass: vi.StorageClass,
+		AccessMode:   vi.AccessMode,
+		SoftLimit:    vi.SoftLimit,
+		HardLimit:    vi.HardLimit,
+		BlockGroups:  len(vi.BlockGroups),
+	}
+	if vi.Status == 1 {
+		v.Status = "pending purge"
+		v.PurgeTime = vi.PurgeTime
+	}
+	return 0, v
+}
+
+func (h *apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch role(h.tokens, r.Header.Get("Authorization")) {
+	case "":
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		reply(w, http.StatusUnauthorized, &apiError{Error: "no token or wrong token", Ret: int32(syscall.EACCES)})
+		return
+	case roleRead:
+		if r.Method != "GET" && r.Method != "HEAD" {
+			reply(w, http.StatusForbidden, &apiError{Error: "read-only token", Ret: int32(syscall.EACCES)})
+			return
+		}
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "v1" {
+		http.NotFound(w, r)
+		return
+	}
+	logger.Debug("adminapi %v %v from %v", r.Method, r.URL.Path, r.RemoteAddr)
+	switch {
+	case parts[1] == "datanodes" && len(parts) == 2:
+		h.dataNodes(w, r)
+	case parts[1] == "ensure" && len(parts) == 2:
+		h.ensure(w, r)
+	case parts[1] == "reconcile" && len(parts) == 2:
+		h.reconcile(w, r)
+	case parts[1] == "volumes" && len(parts) == 2:
+		h.volumes(w, r)
+	case parts[1] == "volumes" && len(parts) == 3:
+		h.volume(w, r, parts[2])
+	case parts[1] == "volumes" && len(parts) == 4:
+		h.volumeOp(w, r, parts[2], parts[3])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func notAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	reply(w, http.StatusMethodNotAllowed, &apiError{Error: "method not allowed", Ret: int32(syscall.EINVAL)})
+}
+
+func (h *apiHandler) volumes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+		ret, ids := cfs.GetVolList()
+		if ret != 0 {
+			fail(w, "list volumes", ret)
+			return
+		}
+		list := make([]*volume, 0, len(ids))
+		for _, id := range ids {
+			if ret, v := getVolume(id.UUID); ret == 0 {
+				v.Shards = id.Shards
+				list = append(list, v)
+			}
+		}
+		reply(w, http.StatusOK, list)
+
+	case "POST":
+		var req struct {
+			Name         string `json:"name"`
+			CapacityGB   int    `json:"capacity_gb"`
+			StorageClass string `json:"storage_class"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" || req.CapacityGB <= 0 {
+			badRequest(w, `want {"name", "capacity_gb", "storage_class"}`)
+			return
+		}
+		ret, uuid := cfs.NewVol(req.Name, strconv.Itoa(req.CapacityGB), req.StorageClass)
+		if ret != 0 {
+			fail(w, "create volume", ret)
+			return
+		}
+		logger.Info("adminapi: volume %v (%v) created", req.Name, uuid)
+		if ret, v := getVolume(uuid); ret == 0 {
+			reply(w, http.StatusCreated, v)
+			return
+		}
+		reply(w, http.StatusCreated, &volume{UUID: uuid, Name: req.Name, CapacityGB: int32(req.CapacityGB)})
+
+	default:
+		notAllowed(w, "GET, HEAD, POST")
+	}
+}
+
+func (h *apiHandler) volume(w http.ResponseWriter, r *http.Request, uuid string) {
+	switch r.Method {
+	case "GET", "HEAD":
+		ret, v := getVolume(uuid)
+		if ret != 0 {
+			fail(w, "get volume", ret)
+			return
+		}
+		reply(w, http.StatusOK, v)
+
+	case "PATCH":
+		var req struct {
+			StorageClass *string `json:"storage_class"`
+			AccessMode   *string `json:"access_mode"`
+			WriteQuorum  *string `json:"write_quorum"`
+			SoftLimit    *int32  `json:"soft_limit"`
+			HardLimit    *int32  `json:"hard_limit"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			badRequest(w, err.Error())
+			return
+		}
+		ret, v := getVolume(uuid)
+		if ret != 0 {
+			fail(w, "get volume", ret)
+			return
+		}
+		if req.StorageClass != nil {
+			class := *req.StorageClass
+			if class == "any" {
+				class = ""
+			}
+			if ret := cfs.SetVolStorageClass(uuid, class); ret != 0 {
+				fail(w, "set storage class", ret)
+				return
+			}
+		}
+		if req.AccessMode != nil {
+			if ret := cfs.SetVolAccessMode(uuid, strings.ToUpper(*req.AccessMode)); ret != 0 {
+				fail(w, "set access mode", ret)
+				return
+			}
+		}
+		if req.WriteQuorum != nil {
+			quorum, ok := cfs.ParseWriteQuorum(*req.WriteQuorum)
+			if !ok {
+				badRequest(w, "write_quorum is one, quorum, all or async")
+				return
+			}
+			if ret := cfs.SetVolWriteQuorum(uuid, quorum); ret != 0 {
+				fail(w, "set write quorum", ret)
+				return
+			}
+		}
+		if req.SoftLimit != nil || req.HardLimit != nil {
+			soft, hard := v.SoftLimit, v.HardLimit
+			if req.SoftLimit != nil {
+				soft = *req.SoftLimit
+			}
+			if req.HardLimit != nil {
+				hard = *req.HardLimit
+			}
+			if ret := cfs.SetVolCapacityLimits(uuid, soft, hard); ret != 0 {
+				fail(w, "set capacity limits", ret)
+				return
+			}
+		}
+		logger.Info("adminapi: volume %v changed", uuid)
+		if ret, v := getVolume(uuid); ret == 0 {
+			reply(w, http.StatusOK, v)
+			return
+		}
+		reply(w, http.StatusNoContent, nil)
+
+	case "DELETE":
+		var ret int32
+		if r.URL.Query().Get("purge") == "1" {
+			ret = cfs.PurgeVol(uuid)
+		} else {
+			ret = cfs.DeleteVol(uuid)
+		}
+		if ret != 0 {
+			fail(w, "delete volume", ret)
+			return
+		}
+		logger.Info("adminapi: volume %v deleted, purge:%v", uuid, r.URL.Query().Get("purge") == "1")
+		reply(w, http.StatusNoContent, nil)
+
+	default:
+		notAllowed(w, "GET, HEAD, PATCH, DELETE")
+	}
+}
+
+type volumeStats struct {
+	TotalBytes uint64 `json:"total_bytes"`
+	FreeBytes  uint64 `json:"free_bytes"`
+	UsedPct    int64  `json:"used_pct"`
+	SoftLimit  int32  `json:"soft_limit"`
+	HardLimit  int32  `json:"hard_limit"`
+	ReadOps    uint64 `json:"read_ops"`
+	ReadP50    int64  `json:"read_p50_us"`
+	ReadP99    int64  `json:"read_p99_us"`
+	WriteOps   uint64 `json:"write_ops"`
+	WriteP50   int64  `json:"write_p50_us"`
+	WriteP99   int64  `json:"write_p99_us"`
+}
+
+type session struct {
+	ClientID   string    `json:"client_id"`
+	Host       string    `json:"host"`
+	MountPoint string    `json:"mountpoint"`
+	Opens      int64     `json:"opens"`
+	Started    time.Time `json:"started"`
+	LastSeen   time.Time `json:"last_seen"`
+}
+
+func (h *apiHandler) volumeOp(w http.ResponseWriter, r *http.Request, uuid string, op string) {
+	switch op {
+	case "stats", "sessions":
+		if r.Method != "GET" && r.Method != "HEAD" {
+			notAllowed(w, "GET, HEAD")
+			return
+		}
+	case "restore", "expand", "snapshot":
+		if r.Method != "POST" {
+			notAllowed(w, "POST")
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	switch op {
+	case "stats":
+		ret, info := cfs.GetFSInfo(uuid)
+		if ret != 0 {
+			fail(w, "get volume space", int32(syscall.ENOENT))
+			return
+		}
+		st := &volumeStats{TotalBytes: info.TotalSpace, FreeBytes: info.FreeSpace, SoftLimit: info.SoftLimit, HardLimit: info.HardLimit}
+		if info.TotalSpace > 0 {
+			st.UsedPct = int64((info.TotalSpace - info.FreeSpace) * 100 / info.TotalSpace)
+		}
+		if ret, vl := cfs.GetVolLatency(uuid); ret == 0 {
+			st.ReadOps, st.ReadP50, st.ReadP99 = vl.ReadOps, vl.ReadP50, vl.ReadP99
+			st.WriteOps, st.WriteP50, st.WriteP99 = vl.WriteOps, vl.WriteP50, vl.WriteP99
+		}
+		reply(w, http.StatusOK, st)
+
+	case "sessions":
+		ret, sessions := cfs.ListSessions(uuid)
+		if ret != 0 {
+			fail(w, "list sessions", ret)
+			return
+		}
+		list := make([]*session, 0, len(sessions))
+		for _, s := range sessions {
+			list = append(list, &session{ClientID: s.ClientID, Host: s.Host, MountPoint: s.MountPoint, Opens: s.Opens,
+				Started: time.Unix(s.Started, 0), LastSeen: time.Unix(s.LastSeen, 0)})
+		}
+		reply(w, http.StatusOK, list)
+
+	case "restore":
+		if ret := cfs.RestoreVol(uuid); ret != 0 {
+			if ret == 2 {
+				reply(w, http.StatusConflict, &apiError{Error: "volume is not pending purge", Ret: ret})
+				return
+			}
+			fail(w, "restore volume", ret)
+			return
+		}
+		logger.Info("adminapi: volume %v restored", uuid)
+		reply(w, http.StatusNoContent, nil)
+
+	case "expand":
+		var req struct {
+			CapacityGB int `json:"capacity_gb"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.CapacityGB <= 0 {
+			badRequest(w, `want {"capacity_gb"}`)
+			return
+		}
+		if ret := cfs.ExpendVol(uuid, strconv.Itoa(req.CapacityGB)); ret != 0 {
+			fail(w, "expand volume", ret)
+			return
+		}
+		logger.Info("adminapi: volume %v expanded by %vGB", uuid, req.CapacityGB)
+		reply(w, http.StatusNoContent, nil)
+
+	case "snapshot":
+		if ret := cfs.SnapShootVol(uuid); ret != 0 {
+			fail(w, "snapshot volume", ret)
+			return
+		}
+		logger.Info("adminapi: volume %v snapshot", uuid)
+		reply(w, http.StatusNoContent, nil)
+	}
+}
+
+type dataNode struct {
+	Addr   string `json:"addr"`
+	Labels string `json:"labels"`
+}
+
+func (h *apiHandler) dataNodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		notAllowed(w, "GET, HEAD")
+		return
+	}
+	ret, nodes := cfs.GetDataNodes()
+	if ret != 0 {
+		fail(w, "list datanodes", ret)
+		return
+	}
+	list := make([]*dataNode, 0, len(nodes))
+	for _, dn := range nodes {
+		list = append(list, &dataNode{Addr: utils.InetNtoa(dn.Ip).String() + ":" + strconv.Itoa(int(dn.Port)), Labels: dn.Labels})
+	}
+	reply(w, http.StatusOK, list)
+}
+
+// volumeSpec a volume as declared, the settings not given take their defaults
+type volumeSpec struct {
+	Name         string `json:"name"`
+	CapacityGB   int32  `json:"capacity_gb"`
+	StorageClass string `json:"storage_class"`
+	WriteQuorum  string `json:"write_quorum"`
+	AccessMode   string `json:"access_mode"`
+	SoftLimit    int32  `json:"soft_limit"`
+	HardLimit    int32  `json:"hard_limit"`
+}
+
+type ensureResult struct {
+	Name    string   `json:"name"`
+	UUID    string   `json:"uuid,omitempty"`
+	Created bool     `json:"created"`
+	Changes []string `json:"changes"`
+	Error   string   `json:"error,omitempty"`
+	Ret     int32    `json:"ret"`
+}
+
+// ensureSpec the volume of spec as declared
+func ensureSpec(spec *volumeSpec, dryRun bool) *ensureResult {
+	res := &ensureResult{Name: spec.Name, Changes: []string{}}
+	quorum := int32(cfs.WriteAll)
+	if spec.WriteQuorum != "" {
+		q, ok := cfs.ParseWriteQuorum(spec.WriteQuorum)
+		if !ok {
+			res.Ret, res.Error = int32(syscall.EINVAL), "write_quorum is one, quorum, all or async"
+			return res
+		}
+		quorum = q
+	}
+	class := spec.StorageClass
+	if class == "any" {
+		class = ""
+	}
+	ret, ack := cfs.EnsureVol(&vp.EnsureVolReq{
+		VolName:      spec.Name,
+		SpaceQuota:   spec.CapacityGB,
+		StorageClass: class,
+		WriteQuorum:  quorum,
+		AccessMode:   strings.ToUpper(spec.AccessMode),
+		SoftLimit:    spec.SoftLimit,
+		HardLimit:    spec.HardLimit,
+		DryRun:       dryRun,
+	})
+	if ack != nil {
+		res.UUID, res.Created = ack.UUID, ack.Created
+		res.Changes = append(res.Changes, ack.Changes...)
+	}
+	if ret != 0 {
+		res.Ret, res.Error = ret, "ensure volume failed"
+		if ret == int32(syscall.EEXIST) {
+			res.Error = "more than one volume has the name"
+		}
+		return res
+	}
+	if len(res.Changes) > 0 && !dryRun {
+		logger.Info("adminapi: volume %v (%v) ensured: %v", spec.Name, res.UUID, res.Changes)
+	}
+	return res
+}
+
+func (h *apiHandler) ensure(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notAllowed(w, "POST")
+		return
+	}
+	var spec volumeSpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil || spec.Name == "" || spec.CapacityGB <= 0 {
+		badRequest(w, `want {"name", "capacity_gb", ...}`)
+		return
+	}
+	res := ensureSpec(&spec, r.URL.Query().Get("dry_run") == "1")
+	if res.Ret != 0 {
+		status, ok := apiStatus[res.Ret]
+		if !ok {
+			status = http.StatusInternalServerError
+		}
+		reply(w, status, res)
+		return
+	}
+	reply(w, http.StatusOK, res)
+}
+
+// reconcile ensures each volume of the list, the others in service are reported
+// as unmanaged but left alone
+func (h *apiHandler) reconcile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		notAllowed(w, "POST")
+		return
+	}
+	var specs []*volumeSpec
+	if err := json.NewDecoder(r.Body).Decode(&specs); err != nil {
+		badRequest(w, `want [{"name", "capacity_gb", ...}, ...]`)
+		return
+	}
+	names := make(map[string]bool, len(specs))
+	for _, spec := range specs {
+		if spec.Name == "" || spec.CapacityGB <= 0 || names[spec.Name] {
+			badRequest(w, fmt.Sprintf("volume %q: a name and a capacity_gb each, once", spec.Name))
+			return
+		}
+		names[spec.Name] = true
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "1"
+	var res struct {
+		Volumes   []*ensureResult `json:"volumes"`
+		Unmanaged []string        `json:"unmanaged"`
+		Failed    int             `json:"failed"`
+	}
+	res.Unmanaged = []string{}
+	for _, spec := range specs {
+		er := ensureSpec(spec, dryRun)
+		if er.Ret != 0 {
+			res.Failed++
+		}
+		res.Volumes = append(res.Volumes, er)
+	}
+	if ret, ids := cfs.GetVolList(); ret == 0 {
+		for _, id := range ids {
+			if ret, v := getVolume(id.UUID); ret == 0 && v.Status == "ok" && !names[v.Name] {
+				res.Unmanaged = append(res.Unmanaged, v.Name)
+			}
+		}
+	}
+	reply(w, http.StatusOK, &res)
+}
@@ -0,0 +1,168 @@
+// Command adminapi serves the admin operations of ContainerFS as JSON over HTTP,
+// for the provisioning systems and portals that have no gRPC client: it calls the
+// volmgr and the metanodes like the CLI does.
+//
+// The requests carry a token of the tokens_file as "Authorization: Bearer <token>",
+// a read token may only GET. It serves https with the cert and key given, plain
+// http only on a loopback host.
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	cfs "github.com/ipdcode/containerfs/fs"
+	"github.com/ipdcode/containerfs/logger"
+	"github.com/ipdcode/containerfs/utils"
+	"github.com/lxmgo/config"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// the roles of the tokens
+const (
+	roleRead  = "read"
+	roleAdmin = "admin"
+)
+
+// loadTokens the token:role lines of the tokens file, which must not be readable
+// by the group or the others
+func loadTokens(path string) (map[string]string, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no tokens_file")
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%v is readable by others, chmod 600 it", path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseTokens(strings.Split(string(data), "\n"))
+}
+
+// parseTokens the token:role entries, one per line, # starting a comment
+func parseTokens(entries []string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, e := range entries {
+		if e = strings.TrimSpace(e); e == "" || strings.HasPrefix(e, "#") {
+			continue
+		}
+		kv := strings.SplitN(e, ":", 2)
+		if len(kv) != 2 || kv[0] == "" || (kv[1] != roleRead && kv[1] != roleAdmin) {
+			return nil, fmt.Errorf("wrong token %v, use token:admin or token:read", e)
+		}
+		tokens[kv[0]] = kv[1]
+	}
+	return tokens, nil
+}
+
+// role the role of the bearer token of an authorization value, empty when none
+func role(tokens map[string]string, auth string) string {
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	token := strings.TrimSpace(auth[len("Bearer "):])
+	var r string
+	for t, tr := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			r = tr
+		}
+	}
+	return r
+}
+
+func main() {
+
+	if len(os.Args) < 2 {
+		fmt.Println("cfs-adminapi [ini]")
+		os.Exit(1)
+	}
+	c, err := config.NewConfig(os.Args[1])
+	if err != nil {
+		fmt.Println("NewConfig err")
+		os.Exit(1)
+	}
+	utils.ConfigEnv(c)
+
+	logger.SetConsole(true)
+	logger.SetRollingFile(c.String("log"), "adminapi.log", 10, 100, logger.MB) //each 100M rolling
+	switch level := c.String("loglevel"); level {
+	case "error":
+		logger.SetLevel(logger.ERROR)
+	case "debug":
+		logger.SetLevel(logger.DEBUG)
+	case "info":
+		logger.SetLevel(logger.INFO)
+	default:
+		logger.SetLevel(logger.ERROR)
+	}
+	if err := logger.Configure(c.String("logformat"), c.String("logoutput"), c.String("logmodules"), "cfs-adminapi"); err != nil {
+		fmt.Println("log config err:", err)
+		os.Exit(1)
+	}
+
+	tokens, err := loadTokens(c.String("tokens_file"))
+	if err != nil || len(tokens) == 0 {
+		fmt.Println("no tokens:", err)
+		os.Exit(1)
+	}
+	host := c.String("host")
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	cert, key := c.String("cert"), c.String("key")
+	if (cert == "") != (key == "") {
+		fmt.Println("cert and key go together")
+		os.Exit(1)
+	}
+	if cert == "" && !loopback(host) {
+		fmt.Println("plain http on", host, "would send the tokens in the clear, set cert and key")
+		os.Exit(1)
+	}
+
+	cfs.VolMgrAddr = c.String("volmgr")
+	cfs.MetaNodePeers = c.Strings("metanode")
+	if len(cfs.MetaNodePeers) == 0 {
+		fmt.Println("no metanode")
+		os.Exit(1)
+	}
+	cfs.MetaNodeAddr = cfs.MetaNodePeers[0]
+
+	if addr := c.String("debug_addr"); addr != "" {
+		if err := utils.ServeDebug(addr, nil); err != nil {
+			logger.Error("debug server err:%v", err)
+		}
+	}
+
+	srv := &http.Server{
+		Addr:      net.JoinHostPort(host, c.String("port")),
+		Handler:   &apiHandler{tokens: tokens},
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+	if cert != "" {
+		err = srv.ListenAndServeTLS(cert, key)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil {
+		logger.Error("http server err:%v", err)
+		os.Exit(1)
+	}
+}
+
+// loopback whether host only takes the connections of the local host
+func loopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,357 @@
+// Command cgofuseclient mounts a ContainerFS volume through cgofuse, on WinFsp
+// on Windows, macFUSE on macOS and libfuse elsewhere, for the developer machines
+// the bazil based fuseclient does not run on:
+//
+//	cfs-cgofuseclient -uuid 623be31a406d9df9803080ff42085ac7 -volmgr 192.168.100.100:10001 \
+//		-metanode 192.168.100.101:9903,192.168.100.102:9913 -mountpoint X:
+//
+// It serves the volume through libcfs, so the files follow its rules: writes
+// append at the end of the file.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/billziss-gh/cgofuse/fuse"
+	cfs "github.com/ipdcode/containerfs/fs"
+	"github.com/ipdcode/containerfs/libcfs"
+	"github.com/ipdcode/containerfs/logger"
+	"github.com/ipdcode/containerfs/utils"
+	"io"
+	iofs "io/fs"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// FS the volume as a cgofuse file system, the handles are the open libcfs files
+type FS struct {
+	fuse.FileSystemBase
+	uuid string
+	fsys *libcfs.FS
+	uid  uint32
+	gid  uint32
+
+	mu     sync.Mutex
+	nextFh uint64
+	files  map[uint64]*libcfs.File
+}
+
+// name the libcfs name of a cgofuse path, "/a/b" -> "a/b", "/" -> "."
+func name(path string) string {
+	n := strings.Trim(path, "/")
+	if n == "" {
+		return "."
+	}
+	return n
+}
+
+// errc the negative fuse error code of err
+func errc(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, iofs.ErrNotExist):
+		return -fuse.ENOENT
+	case errors.Is(err, iofs.ErrExist):
+		return -fuse.EEXIST
+	case errors.Is(err, syscall.ENOTDIR):
+		return -fuse.ENOTDIR
+	case errors.Is(err, syscall.EISDIR):
+		return -fuse.EISDIR
+	case errors.Is(err, syscall.ENOTEMPTY):
+		return -fuse.ENOTEMPTY
+	case errors.Is(err, syscall.ENOSPC):
+		return -fuse.ENOSPC
+	case errors.Is(err, syscall.EPERM):
+		return -fuse.EPERM
+	case errors.Is(err, syscall.EBUSY):
+		return -fuse.EBUSY
+	case errors.Is(err, syscall.EBADF), errors.Is(err, iofs.ErrClosed):
+		return -fuse.EBADF
+	case errors.Is(err, iofs.ErrInvalid), errors.Is(err, libcfs.ErrNotAppend):
+		return -fuse.EINVAL
+	}
+	return -fuse.EIO
+}
+
+// osFlags the os flags of the fuse open flags
+func osFlags(flags int) int {
+	var f int
+	switch flags & fuse.O_ACCMODE {
+	case fuse.O_WRONLY:
+		f = os.O_WRONLY
+	case fuse.O_RDWR:
+		f = os.O_RDWR
+	default:
+		f = os.O_RDONLY
+	}
+	if flags&fuse.O_APPEND != 0 {
+		f |= os.O_APPEND
+	}
+	if flags&fuse.O_EXCL != 0 {
+		f |= os.O_EXCL
+	}
+	if flags&fuse.O_TRUNC != 0 {
+		f |= os.O_TRUNC
+	}
+	return f
+}
+
+func (fs *FS) fill(stat *fuse.Stat_t, fi iofs.FileInfo) {
+	*stat = fuse.Stat_t{}
+	if fi.IsDir() {
+		stat.Mode = fuse.S_IFDIR | 0755
+		stat.Nlink = 2
+	} else {
+		stat.Mode = fuse.S_IFREG | 0644
+		stat.Nlink = 1
+		stat.Size = fi.Size()
+		stat.Blocks = (fi.Size() + 511) / 512
+	}
+	stat.Uid, stat.Gid = fs.uid, fs.gid
+	stat.Blksize = 4 * 1024
+	stat.Mtim = fuse.NewTimespec(fi.ModTime())
+	stat.Atim, stat.Ctim, stat.Birthtim = stat.Mtim, stat.Mtim, stat.Mtim
+}
+
+func (fs *FS) handle(f *libcfs.File) uint64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.nextFh++
+	fs.files[fs.nextFh] = f
+	return fs.nextFh
+}
+
+func (fs *FS) file(fh uint64) *libcfs.File {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.files[fh]
+}
+
+// Statfs ...
+func (fs *FS) Statfs(path string, stat *fuse.Statfs_t) int {
+	ret, info := cfs.GetFSInfo(fs.uuid)
+	if ret != 0 {
+		return -fuse.EIO
+	}
+	stat.Bsize = 4 * 1024
+	stat.Frsize = stat.Bsize
+	stat.Blocks = info.TotalSpace / stat.Bsize
+	stat.Bfree = info.FreeSpace / stat.Bsize
+	stat.Bavail = stat.Bfree
+	stat.Namemax = 255
+	return 0
+}
+
+// Getattr ...
+func (fs *FS) Getattr(path string, stat *fuse.Stat_t, fh uint64) int {
+	fi, err := fs.fsys.Stat(name(path))
+	if err != nil {
+		return errc(err)
+	}
+	fs.fill(stat, fi)
+	return 0
+}
+
+// Mkdir ...
+func (fs *FS) Mkdir(path string, mode uint32) int {
+	return errc(fs.fsys.Mkdir(name(path)))
+}
+
+// Unlink ...
+func (fs *FS) Unlink(path string) int {
+	return errc(fs.fsys.Remove(name(path)))
+}
+
+// Rmdir ...
+func (fs *FS) Rmdir(path string) int {
+	return errc(fs.fsys.Remove(name(path)))
+}
+
+// Rename ...
+func (fs *FS) Rename(oldpath string, newpath string) int {
+	return errc(fs.fsys.Rename(name(oldpath), name(newpath)))
+}
+
+// Truncate through the open file fh when there is one, its writes go first
+func (fs *FS) Truncate(path string, size int64, fh uint64) int {
+	if f := fs.file(fh); f != nil {
+		return errc(f.Truncate(size))
+	}
+	return errc(fs.fsys.Truncate(name(path), size))
+}
+
+// Create ...
+func (fs *FS) Create(path string, flags int, mode uint32) (int, uint64) {
+	f, err := fs.fsys.OpenFile(name(path), osFlags(flags)|os.O_CREATE, os.FileMode(mode))
+	if err != nil {
+		return errc(err), ^uint64(0)
+	}
+	return 0, fs.handle(f)
+}
+
+// Open ...
+func (fs *FS) Open(path string, flags int) (int, uint64) {
+	f, err := fs.fsys.OpenFile(name(path), osFlags(flags), 0)
+	if err != nil {
+		return errc(err), ^uint64(0)
+	}
+	return 0, fs.handle(f)
+}
+
+// Read ...
+func (fs *FS) Read(path string, buff []byte, ofst int64, fh uint64) int {
+	f := fs.file(fh)
+	if f == nil {
+		return -fuse.EBADF
+	}
+	n, err := f.ReadAt(buff, ofst)
+	if err != nil && err != io.EOF {
+		logger.Error("read %v at %v: %v", path, ofst, err)
+		return errc(err)
+	}
+	return n
+}
+
+// Write ...
+func (fs *FS) Write(path string, buff []byte, ofst int64, fh uint64) int {
+	f := fs.file(fh)
+	if f == nil {
+		return -fuse.EBADF
+	}
+	n, err := f.WriteAt(buff, ofst)
+	if err != nil {
+		logger.Error("write %v at %v: %v", path, ofst, err)
+		return errc(err)
+	}
+	return n
+}
+
+// Flush ...
+func (fs *FS) Flush(path string, fh uint64) int {
+	f := fs.file(fh)
+	if f == nil {
+		return -fuse.EBADF
+	}
+	return errc(f.Sync())
+}
+
+// Fsync ...
+func (fs *FS) Fsync(path string, datasync bool, fh uint64) int {
+	return fs.Flush(path, fh)
+}
+
+// Release ...
+func (fs *FS) Release(path string, fh uint64) int {
+	fs.mu.Lock()
+	f := fs.files[fh]
+	delete(fs.files, fh)
+	fs.mu.Unlock()
+	if f == nil {
+		return -fuse.EBADF
+	}
+	return errc(f.Close())
+}
+
+// Opendir ...
+func (fs *FS) Opendir(path string) (int, uint64) {
+	fi, err := fs.fsys.Stat(name(path))
+	if err != nil {
+		return errc(err), ^uint64(0)
+	}
+	if !fi.IsDir() {
+		return -fuse.ENOTDIR, ^uint64(0)
+	}
+	return 0, 0
+}
+
+// Readdir lists the dir at once, the attrs come with the pages
+func (fs *FS) Readdir(path string, fill func(name string, stat *fuse.Stat_t, ofst int64) bool, ofst int64, fh uint64) int {
+	entries, err := fs.fsys.ReadDir(name(path))
+	if err != nil {
+		return errc(err)
+	}
+	fill(".", nil, 0)
+	fill("..", nil, 0)
+	for _, e := range entries {
+		var stat *fuse.Stat_t
+		if fi, err := e.Info(); err == nil {
+			stat = &fuse.Stat_t{}
+			fs.fill(stat, fi)
+		}
+		if !fill(e.Name(), stat, 0) {
+			break
+		}
+	}
+	return 0
+}
+
+var (
+	uuid       = flag.String("uuid", "", "volume to mount")
+	volmgr     = flag.String("volmgr", "", "volmgr address, host:port")
+	metanode   = flag.String("metanode", "", "metanode addresses, comma separated")
+	mountpoint = flag.String("mountpoint", "", "dir to mount the volume on, a drive as X: on Windows")
+	options    = flag.String("o", "", "more mount options of the fuse library, comma separated")
+	logDir     = flag.String("log", "", "log dir, stderr when unset")
+	logLevel   = flag.String("loglevel", "error", "error, info or debug")
+)
+
+func main() {
+	flag.Parse()
+	if err := utils.FlagEnv(flag.CommandLine); err != nil {
+		fmt.Println("env err:", err)
+		os.Exit(2)
+	}
+	if *uuid == "" || *volmgr == "" || *metanode == "" || *mountpoint == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *logDir != "" {
+		logger.SetRollingFile(*logDir, "cgofuse.log", 10, 100, logger.MB)
+	} else {
+		logger.SetOutput("stderr", "cfs-cgofuseclient")
+	}
+	if l, ok := logger.ParseLevel(*logLevel); ok {
+		logger.SetLevel(l)
+	}
+
+	fsys, err := libcfs.Open(*uuid, libcfs.Config{VolMgr: *volmgr, MetaNodes: strings.Split(*metanode, ",")})
+	if err != nil {
+		fmt.Println("open volume err:", err)
+		os.Exit(1)
+	}
+	fs := &FS{uuid: *uuid, fsys: fsys, files: make(map[uint64]*libcfs.File)}
+	if uid := os.Getuid(); uid >= 0 {
+		fs.uid, fs.gid = uint32(uid), uint32(os.Getgid())
+	}
+
+	opts := []string{"-o", "fsname=ContainerFS-" + *uuid}
+	if runtime.GOOS == "darwin" || runtime.GOOS == "windows" {
+		opts = append(opts, "-o", "volname=ContainerFS-"+*uuid)
+	}
+	if runtime.GOOS == "windows" {
+		// the files belong to the mounting user
+		opts = append(opts, "-o", "uid=-1,gid=-1")
+	}
+	if *options != "" {
+		opts = append(opts, "-o", *options)
+	}
+
+	host := fuse.NewFileSystemHost(fs)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		host.Unmount()
+	}()
+	if !host.Mount(*mountpoint, opts) {
+		fmt.Println("mount failed, see the log of the fuse library")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,364 @@
+package archive
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/ipdcode/containerfs/datanode/iosched"
+	"github.com/ipdcode/containerfs/datanode/store"
+	"github.com/ipdcode/containerfs/logger"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// StubSuffix of the file left in place of an archived chunk, chunk-N.s3 holds
+// the key of the object and the size of the chunk
+const StubSuffix = ".s3"
+
+// metaFile in a block dir, the volume and block group of the block, so the
+// replicas of a chunk archive it under the same key
+const metaFile = ".archive"
+
+// touchAge the reads refresh the atime of a chunk older than it, the archiver
+// does not rely on the mount options for it
+const touchAge = 24 * time.Hour
+
+// Archiver moves the chunks neither written nor read for Age to Bucket, leaving
+// a stub in their place, and recalls them on the next access. The replicas of a
+// chunk share the object: the first one uploads it, the others find it there.
+type Archiver struct {
+	Store    *store.Store
+	Sched    *iosched.Scheduler
+	Bucket   *Bucket
+	Age      time.Duration
+	Interval time.Duration
+	Node     string // ip:port, the keys of the blocks written before the archiver
+
+	slots chan struct{}
+
+	mu      sync.Mutex
+	busy    map[string]*chunkLock // by chunk file
+	metaSet map[string]bool       // the block dirs with their meta file
+
+	Archived uint64
+	Recalled uint64
+	Failed   uint64
+}
+
+// New an archiver recalling at most recallSlots chunks at once
+func New(s *store.Store, sched *iosched.Scheduler, b *Bucket, age time.Duration, interval time.Duration, node string, recallSlots int) *Archiver {
+	if recallSlots < 1 {
+		recallSlots = 1
+	}
+	return &Archiver{
+		Store:    s,
+		Sched:    sched,
+		Bucket:   b,
+		Age:      age,
+		Interval: interval,
+		Node:     node,
+		slots:    make(chan struct{}, recallSlots),
+		busy:     make(map[string]*chunkLock),
+		metaSet:  make(map[string]bool),
+	}
+}
+
+type chunkLock struct {
+	sync.RWMutex
+	refs int
+}
+
+// lock the chunk file, shared by the reads and writes, alone by the archiver
+// and the recalls
+func (a *Archiver) lock(chunkFile string, shared bool) func() {
+	a.mu.Lock()
+	l, ok := a.busy[chunkFile]
+	if !ok {
+		l = &chunkLock{}
+		a.busy[chunkFile] = l
+	}
+	l.refs++
+	a.mu.Unlock()
+	if shared {
+		l.RLock()
+	} else {
+		l.Lock()
+	}
+	return func() {
+		if shared {
+			l.RUnlock()
+		} else {
+			l.Unlock()
+		}
+		a.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(a.busy, chunkFile)
+		}
+		a.mu.Unlock()
+	}
+}
+
+// SetBlockMeta records the volume and block group of the block in dir, once
+func (a *Archiver) SetBlockMeta(dir string, volID string, blockGroupID uint32) {
+	a.mu.Lock()
+	done := a.metaSet[dir]
+	a.metaSet[dir] = true
+	a.mu.Unlock()
+	if done || volID == "" {
+		return
+	}
+	if _, err := os.Stat(dir + "/" + metaFile); err == nil {
+		return
+	}
+	meta := volID + " " + strconv.FormatUint(uint64(blockGroupID), 10) + "\n"
+	if err := ioutil.WriteFile(dir+"/"+metaFile, []byte(meta), 0644); err != nil {
+		logger.Error("archive meta of %v err:%v", dir, err)
+	}
+}
+
+// key the object of size bytes of the chunk file, by volume and block group when
+// the block knows them, else by datanode and block. The size keeps a replica
+// behind the others from overwriting their object.
+func (a *Archiver) key(chunkFile string, size int64) string {
+	dir, name := filepath.Split(chunkFile)
+	name += "." + strconv.FormatInt(size, 10)
+	if b, err := ioutil.ReadFile(dir + metaFile); err == nil {
+		if f := strings.Fields(string(b)); len(f) == 2 {
+			return a.Bucket.Key(f[0] + "/" + f[1] + "/" + name)
+		}
+	}
+	return a.Bucket.Key("node-" + a.Node + "/" + filepath.Base(dir) + "/" + name)
+}
+
+// Run archives the cold chunks every Interval
+func (a *Archiver) Run() {
+	for {
+		start := time.Now()
+		a.pass()
+		logger.Info("%v", a.Stats())
+		if d := a.Interval - time.Since(start); d > 0 {
+			time.Sleep(d)
+		}
+	}
+}
+
+func (a *Archiver) pass() {
+	for _, d := range a.Store.Disks {
+		if !d.Mon.Writable() {
+			continue
+		}
+		for _, blockID := range a.Store.Blocks(d) {
+			_, dir := a.Store.Block(blockID, false)
+			fis, err := ioutil.ReadDir(dir)
+			if err != nil {
+				continue
+			}
+			for _, fi := range fis {
+				name := fi.Name()
+				if !strings.HasPrefix(name, "chunk-") || strings.Contains(name, ".") {
+					continue
+				}
+				if fi.Size() == 0 || !a.cold(fi) {
+					continue
+				}
+				if err := a.archive(dir + "/" + name); err != nil {
+					atomic.AddUint64(&a.Failed, 1)
+					logger.Error("archive %v/%v err:%v", dir, name, err)
+				}
+			}
+		}
+	}
+}
+
+// cold neither written nor read for Age
+func (a *Archiver) cold(fi os.FileInfo) bool {
+	if time.Since(fi.ModTime()) < a.Age {
+		return false
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return time.Since(time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec))) >= a.Age
+	}
+	return true
+}
+
+// archive uploads the chunk unless a replica did, then puts the stub in its place
+func (a *Archiver) archive(chunkFile string) error {
+	unlock := a.lock(chunkFile, false)
+	defer unlock()
+
+	fi, err := os.Stat(chunkFile)
+	if err != nil {
+		return err
+	}
+	key := a.key(chunkFile, fi.Size())
+	if size, err := a.Bucket.Head(key); err != nil || size != fi.Size() {
+		f, err := os.Open(chunkFile)
+		if err != nil {
+			return err
+		}
+		a.Sched.Acquire(iosched.Background)
+		err = a.Bucket.Put(key, bufio.NewReader(f), fi.Size())
+		a.Sched.Release()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	stub := chunkFile + StubSuffix
+	if err := ioutil.WriteFile(stub+".tmp", []byte(key+"\n"+strconv.FormatInt(fi.Size(), 10)+"\n"), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(stub+".tmp", stub); err != nil {
+		os.Remove(stub + ".tmp")
+		return err
+	}
+	if err := os.Remove(chunkFile); err != nil {
+		os.Remove(stub)
+		return err
+	}
+	atomic.AddUint64(&a.Archived, 1)
+	return nil
+}
+
+// Archive the chunk now whatever its age, for a lifecycle rule
+func (a *Archiver) Archive(chunkFile string) error {
+	fi, err := os.Stat(chunkFile)
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(chunkFile + StubSuffix); err == nil {
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 {
+		return nil
+	}
+	if err := a.archive(chunkFile); err != nil {
+		atomic.AddUint64(&a.Failed, 1)
+		return err
+	}
+	return nil
+}
+
+// readStub the key and size of an archived chunk
+func readStub(stub string) (string, int64, error) {
+	b, err := ioutil.ReadFile(stub)
+	if err != nil {
+		return "", 0, err
+	}
+	f := strings.Fields(string(b))
+	if len(f) != 2 {
+		return "", 0, fmt.Errorf("bad archive stub %v", stub)
+	}
+	size, err := strconv.ParseInt(f[1], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("bad archive stub %v", stub)
+	}
+	return f[0], size, nil
+}
+
+// Hold the chunk for a read or a write: it is brought back from the bucket when
+// it was archived, and the archiver keeps off it until release is called. The
+// concurrent recalls of a chunk wait for the first one.
+func (a *Archiver) Hold(chunkFile string) (release func(), err error) {
+	if _, err := os.Stat(chunkFile + StubSuffix); err == nil {
+		unlock := a.lock(chunkFile, false)
+		err := a.recall(chunkFile)
+		unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return a.lock(chunkFile, true), nil
+}
+
+func (a *Archiver) recall(chunkFile string) error {
+	stub := chunkFile + StubSuffix
+	key, size, err := readStub(stub)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	a.slots <- struct{}{}
+	defer func() { <-a.slots }()
+
+	body, _, err := a.Bucket.Get(key)
+	if err != nil {
+		atomic.AddUint64(&a.Failed, 1)
+		return fmt.Errorf("recall %v from %v: %v", chunkFile, key, err)
+	}
+	defer body.Close()
+	tmp := chunkFile + ".recall"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, body)
+	if err == nil && n != size {
+		err = fmt.Errorf("recall %v from %v: got %v bytes of %v", chunkFile, key, n, size)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, chunkFile)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		atomic.AddUint64(&a.Failed, 1)
+		return err
+	}
+	os.Remove(stub)
+	atomic.AddUint64(&a.Recalled, 1)
+	return nil
+}
+
+// Delete drops the stub of a deleted chunk and its object, unless keep: the
+// chunk lives on in the other replicas, a moved block for one.
+func (a *Archiver) Delete(chunkFile string, keep bool) {
+	stub := chunkFile + StubSuffix
+	key, _, err := readStub(stub)
+	if err != nil {
+		return
+	}
+	os.Remove(stub)
+	if keep {
+		return
+	}
+	if err := a.Bucket.Delete(key); err != nil {
+		logger.Error("delete archived %v err:%v", key, err)
+	}
+}
+
+// Touch marks the chunk read, the archiver keeps it
+func (a *Archiver) Touch(chunkFile string) {
+	fi, err := os.Stat(chunkFile)
+	if err != nil {
+		return
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok &&
+		time.Since(time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec))) < touchAge {
+		return
+	}
+	os.Chtimes(chunkFile, time.Now(), fi.ModTime())
+}
+
+// Stats ...
+func (a *Archiver) Stats() string {
+	return fmt.Sprintf("archive %v: archived %v recalled %v failed %v",
+		a.Bucket.Endpoint+"/"+a.Bucket.Name, atomic.LoadUint64(&a.Archived),
+		atomic.LoadUint64(&a.Recalled), atomic.LoadUint64(&a.Failed))
+}
@@ -0,0 +1,205 @@
+package archive
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Bucket an S3 compatible bucket addressed by path, as http(s)://host[:port]/bucket[/prefix],
+// the requests are signed with AWS signature v4
+type Bucket struct {
+	Endpoint  string // scheme and host
+	Name      string
+	Prefix    string
+	Region    string
+	AccessKey string
+	SecretKey string
+
+	Client *http.Client
+}
+
+// ParseBucket the bucket of u, the keys from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+func ParseBucket(u string, region string) (*Bucket, error) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	if pu.Scheme != "http" && pu.Scheme != "https" || pu.Host == "" {
+		return nil, fmt.Errorf("archive url %v: want http(s)://host/bucket[/prefix]", u)
+	}
+	parts := strings.SplitN(strings.Trim(pu.Path, "/"), "/", 2)
+	if parts[0] == "" {
+		return nil, fmt.Errorf("archive url %v: no bucket", u)
+	}
+	b := &Bucket{
+		Endpoint:  pu.Scheme + "://" + pu.Host,
+		Name:      parts[0],
+		Region:    region,
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		Client:    &http.Client{Timeout: 10 * time.Minute},
+	}
+	if len(parts) == 2 {
+		b.Prefix = parts[1]
+	}
+	return b, nil
+}
+
+// Key the object name of name under the prefix of the bucket
+func (b *Bucket) Key(name string) string {
+	if b.Prefix == "" {
+		return name
+	}
+	return b.Prefix + "/" + name
+}
+
+// Put uploads size bytes of body as key
+func (b *Bucket) Put(key string, body io.Reader, size int64) error {
+	req, err := b.request("PUT", key, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := b.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Get the object, the caller closes it
+func (b *Bucket) Get(key string) (io.ReadCloser, int64, error) {
+	req, err := b.request("GET", key, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := b.do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// Head the size of the object, os.ErrNotExist when there is none
+func (b *Bucket) Head(key string) (int64, error) {
+	req, err := b.request("HEAD", key, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := b.do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+// Delete the object, a missing one is not an error
+func (b *Bucket) Delete(key string) error {
+	req, err := b.request("DELETE", key, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(req)
+	if err == os.ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (b *Bucket) request(method string, key string, body io.Reader) (*http.Request, error) {
+	path := "/" + uriEncode(b.Name, false) + "/" + uriEncode(key, true)
+	req, err := http.NewRequest(method, b.Endpoint+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.Opaque = path
+	b.sign(req, path, time.Now().UTC())
+	return req, nil
+}
+
+func (b *Bucket) do(req *http.Request) (*http.Response, error) {
+	resp, err := b.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%v %v: %v %s", req.Method, req.URL.Opaque, resp.Status, msg)
+	}
+	return resp, nil
+}
+
+// sign the request with AWS signature v4, the payload left unsigned
+func (b *Bucket) sign(req *http.Request, path string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", "UNSIGNED-PAYLOAD")
+
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		"",
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:UNSIGNED-PAYLOAD",
+		"x-amz-date:" + amzDate,
+		"",
+		signed,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	scope := day + "/" + b.Region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+b.SecretKey), day)
+	key = hmacSHA256(key, b.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+b.AccessKey+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+sig)
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// uriEncode as signature v4 wants it, every byte but the unreserved ones escaped
+func uriEncode(s string, keepSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,145 @@
+package canary
+
+import (
+	"fmt"
+	"github.com/ipdcode/containerfs/logger"
+	dp "github.com/ipdcode/containerfs/proto/dp"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"hash/crc32"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type op struct {
+	write  *dp.WriteChunkReq
+	del    *dp.DeleteChunkReq
+	offset int64
+	crc    uint32
+}
+
+// Mirror shadows the writes of a production datanode to a canary datanode
+// running a new version and compares what the canary persisted.
+// It never blocks or fails the production write: ops are queued and
+// dropped when the canary falls behind.
+type Mirror struct {
+	Addr string
+	Rate float64 // fraction of chunks mirrored
+
+	queue chan *op
+
+	mu     sync.Mutex
+	chunks map[uint64]bool // chunks mirrored from their first write
+
+	dc dp.DataNodeClient
+
+	Matched    uint64
+	Mismatched uint64
+	Failed     uint64
+	Dropped    uint64
+}
+
+// New starts mirroring to the canary at addr
+func New(addr string, rate float64, queueLen int) (*Mirror, error) {
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	m := &Mirror{
+		Addr:   addr,
+		Rate:   rate,
+		queue:  make(chan *op, queueLen),
+		chunks: make(map[uint64]bool),
+		dc:     dp.NewDataNodeClient(conn),
+	}
+	go m.run()
+	return m, nil
+}
+
+// sampled picks whole chunks, a chunk only compares if the canary saw all its writes
+func (m *Mirror) sampled(chunkID uint64) bool {
+	return float64(chunkID%1000) < m.Rate*1000
+}
+
+// Write is called after req was appended locally at offset
+func (m *Mirror) Write(req *dp.WriteChunkReq, offset int64) {
+	m.mu.Lock()
+	if offset == 0 && m.sampled(req.ChunkID) {
+		m.chunks[req.ChunkID] = true
+	}
+	mirrored := m.chunks[req.ChunkID]
+	m.mu.Unlock()
+	if !mirrored {
+		return
+	}
+	o := &op{write: req, offset: offset, crc: crc32.ChecksumIEEE(req.Databuf)}
+	select {
+	case m.queue <- o:
+	default:
+		// the canary misses this write, stop comparing the chunk
+		atomic.AddUint64(&m.Dropped, 1)
+		m.forget(req.ChunkID)
+	}
+}
+
+// Delete ...
+func (m *Mirror) Delete(req *dp.DeleteChunkReq) {
+	select {
+	case m.queue <- &op{del: req}:
+	default:
+		atomic.AddUint64(&m.Dropped, 1)
+	}
+	m.forget(req.ChunkID)
+}
+
+func (m *Mirror) forget(chunkID uint64) {
+	m.mu.Lock()
+	delete(m.chunks, chunkID)
+	m.mu.Unlock()
+}
+
+// run sends the ops one by one, keeping the append order of each chunk
+func (m *Mirror) run() {
+	for o := range m.queue {
+		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+		if o.del != nil {
+			if _, err := m.dc.DeleteChunk(ctx, o.del); err != nil {
+				atomic.AddUint64(&m.Failed, 1)
+			}
+			continue
+		}
+
+		req := &dp.WriteChunkReq{
+			ChunkID:      o.write.ChunkID,
+			BlockID:      o.write.BlockID,
+			Databuf:      o.write.Databuf,
+			VolID:        o.write.VolID,
+			BlockGroupID: o.write.BlockGroupID,
+			Verify:       true,
+			Background:   true,
+		}
+		ack, err := m.dc.WriteChunk(ctx, req)
+		if err != nil || ack.Ret != 0 {
+			atomic.AddUint64(&m.Failed, 1)
+			logger.Error("canary %v write chunk %v failed, err:%v ack:%v", m.Addr, req.ChunkID, err, ack)
+			m.forget(req.ChunkID)
+			continue
+		}
+		if ack.Checksum != o.crc || ack.Offset != o.offset {
+			atomic.AddUint64(&m.Mismatched, 1)
+			logger.Error("canary %v mismatch on block %v chunk %v: offset %v crc %x, canary offset %v crc %x",
+				m.Addr, req.BlockID, req.ChunkID, o.offset, o.crc, ack.Offset, ack.Checksum)
+			m.forget(req.ChunkID)
+			continue
+		}
+		atomic.AddUint64(&m.Matched, 1)
+	}
+}
+
+// Stats ...
+func (m *Mirror) Stats() string {
+	return fmt.Sprintf("canary %v matched:%v mismatched:%v failed:%v dropped:%v", m.Addr,
+		atomic.LoadUint64(&m.Matched), atomic.LoadUint64(&m.Mismatched),
+		atomic.LoadUint64(&m.Failed), atomic.LoadUint64(&m.Dropped))
+}
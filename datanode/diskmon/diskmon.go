@@ -0,0 +1,196 @@
+package diskmon
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ipdcode/containerfs/logger"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// State of the disk, the values are the disk statu volmgr keeps
+type State int32
+
+const (
+	// Healthy serves reads and writes
+	Healthy State = 0
+	// Offline too many IO errors, serves nothing
+	Offline State = 2
+	// ReadOnly failing, serves reads so its chunks can still be copied off
+	ReadOnly State = 3
+)
+
+func (s State) String() string {
+	switch s {
+	case Healthy:
+		return "healthy"
+	case Offline:
+		return "offline"
+	case ReadOnly:
+		return "read-only"
+	}
+	return fmt.Sprintf("state(%d)", int32(s))
+}
+
+// Monitor watches the disk of a datanode: IO errors seen by the requests, a
+// probe of the data path and, with Dev set, the SMART health of the device.
+// A write error or a failed SMART check makes the disk read-only, MaxErrors
+// errors within Window take it offline. Errors age out of the window, so a
+// replaced disk comes back healthy by itself.
+type Monitor struct {
+	Path      string
+	Dev       string // device checked with smartctl, empty to skip SMART
+	MaxErrors int
+	Window    time.Duration
+
+	mu          sync.Mutex
+	readErrs    []time.Time
+	writeErrs   []time.Time
+	smartFailed bool
+	state       State
+}
+
+// New ...
+func New(path string, dev string, maxErrors int) *Monitor {
+	if maxErrors < 1 {
+		maxErrors = 1
+	}
+	return &Monitor{Path: path, Dev: dev, MaxErrors: maxErrors, Window: time.Hour}
+}
+
+// IsIOError true for the errors a failing disk returns, not for a missing chunk
+func IsIOError(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	switch err {
+	case syscall.EIO, syscall.EROFS, syscall.ENXIO, syscall.ENODEV, syscall.EBADMSG:
+		return true
+	}
+	return false
+}
+
+// ReadError records a failed read, errors other than IO errors are ignored
+func (m *Monitor) ReadError(err error) {
+	if m == nil || !IsIOError(err) {
+		return
+	}
+	m.mu.Lock()
+	m.readErrs = append(m.readErrs, time.Now())
+	m.update()
+	m.mu.Unlock()
+}
+
+// WriteError records a failed write, errors other than IO errors are ignored
+func (m *Monitor) WriteError(err error) {
+	if m == nil || !IsIOError(err) {
+		return
+	}
+	m.mu.Lock()
+	m.writeErrs = append(m.writeErrs, time.Now())
+	m.update()
+	m.mu.Unlock()
+}
+
+// update recomputes the state, mu must be held
+func (m *Monitor) update() {
+	since := time.Now().Add(-m.Window)
+	m.readErrs = recent(m.readErrs, since)
+	m.writeErrs = recent(m.writeErrs, since)
+
+	state := Healthy
+	if len(m.writeErrs) > 0 || m.smartFailed {
+		state = ReadOnly
+	}
+	if len(m.readErrs)+len(m.writeErrs) >= m.MaxErrors {
+		state = Offline
+	}
+	if state != m.state {
+		logger.Error("disk %v is now %v, read errors:%v write errors:%v smart failed:%v",
+			m.Path, state, len(m.readErrs), len(m.writeErrs), m.smartFailed)
+		m.state = state
+	}
+}
+
+func recent(ts []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(ts) && ts[i].Before(since) {
+		i++
+	}
+	return ts[i:]
+}
+
+// State ...
+func (m *Monitor) State() State {
+	if m == nil {
+		return Healthy
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// Writable ...
+func (m *Monitor) Writable() bool {
+	return m.State() == Healthy
+}
+
+// Readable ...
+func (m *Monitor) Readable() bool {
+	return m.State() != Offline
+}
+
+// Check probes the data path and the SMART health, call it periodically
+func (m *Monitor) Check() State {
+	probe := m.Path + "/health"
+	if err := ioutil.WriteFile(probe, []byte("ok"), 0666); err != nil {
+		logger.Error("write datanode check health file error:%v", err)
+		m.WriteError(err)
+	} else if _, err := ioutil.ReadFile(probe); err != nil {
+		logger.Error("read datanode check health file error:%v", err)
+		m.ReadError(err)
+	}
+
+	if m.Dev != "" {
+		failed := !smartHealthy(m.Dev)
+		m.mu.Lock()
+		m.smartFailed = failed
+		m.mu.Unlock()
+	}
+
+	m.mu.Lock()
+	m.update()
+	state := m.state
+	m.mu.Unlock()
+	return state
+}
+
+// smartHealthy asks smartctl for the overall health, a missing smartctl counts as healthy
+func smartHealthy(dev string) bool {
+	out, err := exec.Command("smartctl", "-H", dev).CombinedOutput()
+	if bytes.Contains(out, []byte("FAILED")) {
+		logger.Error("smartctl -H %v: %s", dev, out)
+		return false
+	}
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			logger.Error("smartctl -H %v err:%v", dev, err)
+		}
+	}
+	return true
+}
+
+// Stats ...
+func (m *Monitor) Stats() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return fmt.Sprintf("disk %v %v read errors:%v write errors:%v smart failed:%v", m.Path, m.state,
+		len(m.readErrs), len(m.writeErrs), m.smartFailed)
+}
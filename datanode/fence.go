@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/ipdcode/containerfs/logger"
+	dp "github.com/ipdcode/containerfs/proto/dp"
+	"github.com/ipdcode/containerfs/utils"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// A client fenced off a volume on its metanode still has the chunks it was
+// writing: its writes and deletes are refused here too. The metanodes push the
+// fence state of their volumes, it is kept in the fence file of the first data
+// dir so a restart keeps it.
+
+type fenceTable struct {
+	mu   sync.RWMutex
+	file string
+	vols map[string]*dp.SetFenceReq // by volume uuid
+}
+
+// Fences ...
+var Fences = &fenceTable{vols: make(map[string]*dp.SetFenceReq)}
+
+// load the fence file of dir, none is no volume fenced
+func (t *fenceTable) load(dir string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.file = dir + "/fence"
+	b, err := ioutil.ReadFile(t.file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error("read fence file %v err:%v", t.file, err)
+		}
+		return
+	}
+	if err := json.Unmarshal(b, &t.vols); err != nil {
+		logger.Error("bad fence file %v err:%v", t.file, err)
+	}
+}
+
+// set the fence state of a volume and write the file
+func (t *fenceTable) set(in *dp.SetFenceReq) error {
+	uuid, _ := utils.ParseShardVolID(in.VolID)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !in.Fenced && len(in.Revoked) == 0 {
+		delete(t.vols, uuid)
+	} else {
+		t.vols[uuid] = in
+	}
+	b, err := json.Marshal(t.vols)
+	if err != nil {
+		return err
+	}
+	tmp := t.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.file)
+}
+
+// check refuses with codes.PermissionDenied the request of a client fenced off the
+// volume. The forwards of a primary and the repairs send no client id.
+func (t *fenceTable) check(ctx context.Context, volID string) error {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md[utils.ClientIDMetadata]) == 0 {
+		return nil
+	}
+	clientID := md[utils.ClientIDMetadata][0]
+	uuid, _ := utils.ParseShardVolID(volID)
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	f, ok := t.vols[uuid]
+	if !ok {
+		return nil
+	}
+	if f.Fenced {
+		return grpc.Errorf(codes.PermissionDenied, "client %v fenced off %v", clientID, uuid)
+	}
+	for _, id := range f.Revoked {
+		if id == clientID {
+			return grpc.Errorf(codes.PermissionDenied, "client %v fenced off %v", clientID, uuid)
+		}
+	}
+	return nil
+}
+
+// SetFence : the fence state of a volume, from its metanode
+func (s *DataNodeServer) SetFence(ctx context.Context, in *dp.SetFenceReq) (*dp.SetFenceAck, error) {
+	ack := dp.SetFenceAck{}
+	if err := Fences.set(in); err != nil {
+		logger.Error("set fence of vol %v err:%v", in.VolID, err)
+		ack.Ret = -1
+	}
+	return &ack, nil
+}
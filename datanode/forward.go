@@ -0,0 +1,205 @@
+package main
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	dp "github.com/ipdcode/containerfs/proto/dp"
+	vp "github.com/ipdcode/containerfs/proto/vp"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// forwardQueueLen the writes waiting for a replica, over it they are dropped and
+// the replica repaired by the volmgr
+const forwardQueueLen = 256
+
+// forward a write of an async volume the primary acked, for one of the other replicas,
+// or the fsync of the chunks forwarded to it: synced, done once they are
+type forward struct {
+	req    *dp.WriteChunkReq
+	to     *dp.ForwardReplica
+	offset int64
+
+	synced []*forward
+	done   chan struct{}
+}
+
+// forwarder writes the replicas of the async volumes behind the primary, the
+// writes to a datanode go in order through its own queue
+type forwarder struct {
+	mu     sync.Mutex
+	queues map[string]chan *forward
+
+	pending int64
+	failed  int64
+}
+
+// Forwarder ...
+var Forwarder = &forwarder{queues: make(map[string]chan *forward)}
+
+// Forward queues req, appended here at offset, for the replicas of req.Forwards
+func (f *forwarder) Forward(req *dp.WriteChunkReq, offset int64) {
+	for _, to := range req.Forwards {
+		fw := &forward{req: req, to: to, offset: offset}
+		select {
+		case f.queue(to.Addr) <- fw:
+			atomic.AddInt64(&f.pending, 1)
+		default:
+			logger.Error("forward queue of %v full, chunk %v left for repair", to.Addr, req.ChunkID)
+			f.fail(fw)
+		}
+	}
+}
+
+// Sync has the replicas the chunks of in were forwarded to fsync them, after the
+// writes queued for them. A replica failing it is left for repair.
+func (f *forwarder) Sync(in *dp.SyncChunksReq) {
+	byAddr := make(map[string][]*forward)
+	for _, c := range in.Chunks {
+		for _, to := range c.Forwards {
+			byAddr[to.Addr] = append(byAddr[to.Addr], &forward{
+				req: &dp.WriteChunkReq{ChunkID: c.ChunkID, VolID: in.VolID, BlockGroupID: c.BlockGroupID, Inode: in.Inode},
+				to:  to,
+			})
+		}
+	}
+	var dones []chan struct{}
+	for addr, synced := range byAddr {
+		done := make(chan struct{})
+		f.queue(addr) <- &forward{synced: synced, done: done}
+		dones = append(dones, done)
+	}
+	for _, done := range dones {
+		<-done
+	}
+}
+
+func (f *forwarder) queue(addr string) chan *forward {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	q, ok := f.queues[addr]
+	if !ok {
+		q = make(chan *forward, forwardQueueLen)
+		f.queues[addr] = q
+		go f.run(addr, q)
+	}
+	return q
+}
+
+// run sends the writes queued for the datanode at addr one by one
+func (f *forwarder) run(addr string, q chan *forward) {
+	var conn *grpc.ClientConn
+	for fw := range q {
+		if conn == nil {
+			var err error
+			conn, err = grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Second))
+			if err != nil {
+				logger.Error("forward to %v failed, Dial failed:%v", addr, err)
+				f.drop(fw)
+				continue
+			}
+		}
+		if fw.synced != nil {
+			if err := f.sync(conn, addr, fw.synced); err != nil {
+				conn.Close()
+				conn = nil
+			}
+			close(fw.done)
+			continue
+		}
+		req := &dp.WriteChunkReq{
+			ChunkID:      fw.req.ChunkID,
+			BlockID:      fw.to.BlockID,
+			Databuf:      fw.req.Databuf,
+			VolID:        fw.req.VolID,
+			BlockGroupID: fw.req.BlockGroupID,
+			Background:   true,
+			Forwarded:    true,
+			Offset:       fw.offset,
+		}
+		ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+		ack, err := dp.NewDataNodeClient(conn).WriteChunk(ctx, req)
+		if err != nil {
+			conn.Close()
+			conn = nil
+		}
+		if err != nil || ack.Ret != 0 {
+			logger.Error("forward chunk %v to %v failed, err:%v ack:%v", req.ChunkID, addr, err, ack)
+			f.fail(fw)
+		}
+		atomic.AddInt64(&f.pending, -1)
+	}
+}
+
+// sync fsyncs the chunks of synced on the replica at addr, the replicas are failed
+// when it does not
+func (f *forwarder) sync(conn *grpc.ClientConn, addr string, synced []*forward) error {
+	req := &dp.SyncChunksReq{}
+	for _, fw := range synced {
+		req.Chunks = append(req.Chunks, &dp.SyncChunk{ChunkID: fw.req.ChunkID, BlockID: fw.to.BlockID})
+	}
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	ack, err := dp.NewDataNodeClient(conn).SyncChunks(ctx, req)
+	if err != nil || ack.Ret != 0 {
+		logger.Error("sync forwarded chunks on %v failed, err:%v ack:%v", addr, err, ack)
+		for _, fw := range synced {
+			f.fail(fw)
+		}
+	}
+	return err
+}
+
+// drop fails fw, its datanode cannot be reached
+func (f *forwarder) drop(fw *forward) {
+	if fw.synced != nil {
+		for _, s := range fw.synced {
+			f.fail(s)
+		}
+		close(fw.done)
+		return
+	}
+	f.fail(fw)
+	atomic.AddInt64(&f.pending, -1)
+}
+
+// fail has the volmgr repair the replica fw did not reach
+func (f *forwarder) fail(fw *forward) {
+	atomic.AddInt64(&f.failed, 1)
+	host, port, err := net.SplitHostPort(fw.to.Addr)
+	if err != nil {
+		return
+	}
+	p, _ := strconv.Atoi(port)
+
+	conn, err := grpc.Dial(DataNodeServerAddr.VolMgrHost, grpc.WithInsecure())
+	if err != nil {
+		logger.Error("report failed forward of chunk %v : Dial to volmgr failed :%v", fw.req.ChunkID, err)
+		return
+	}
+	defer conn.Close()
+	c := vp.NewVolMgrClient(conn)
+	ctx, _ := context.WithTimeout(context.Background(), 60*time.Second)
+	ack, err := c.UpdateChunkInfo(ctx, &vp.UpdateChunkInfoReq{
+		Ip:           host,
+		Port:         int32(p),
+		VolID:        fw.req.VolID,
+		BlockGroupID: fw.req.BlockGroupID,
+		BlockID:      fw.to.BlockID,
+		ChunkID:      fw.req.ChunkID,
+		Inode:        fw.req.Inode,
+		Position:     fw.to.Position,
+		Status:       1,
+	})
+	if err != nil || ack.Ret != 0 {
+		logger.Error("report failed forward of chunk %v failed, err:%v ack:%v", fw.req.ChunkID, err, ack)
+	}
+}
+
+// stats for the debug server
+func (f *forwarder) stats() (pending int64, failed int64) {
+	return atomic.LoadInt64(&f.pending), atomic.LoadInt64(&f.failed)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"github.com/ipdcode/containerfs/datanode/archive"
+	"github.com/ipdcode/containerfs/datanode/iosched"
+	"github.com/ipdcode/containerfs/datanode/store"
+	"github.com/ipdcode/containerfs/logger"
+	dp "github.com/ipdcode/containerfs/proto/dp"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// deletedSuffix of a chunk file and its checksums deleted less than -gcdelay ago. The
+// gc of volmgr restores the ones a file still references, reapDeleted frees the others.
+const deletedSuffix = ".deleted"
+
+// removeChunk deletes the chunk file and its checksums, with -gcdelay they are kept
+// as deleted for that long
+func removeChunk(chunkFile string) error {
+	if DataNodeServerAddr.GCDelay <= 0 {
+		err := os.Remove(chunkFile)
+		os.Remove(store.ChecksumFile(chunkFile))
+		return err
+	}
+	err := markDeleted(chunkFile)
+	markDeleted(store.ChecksumFile(chunkFile))
+	return err
+}
+
+// markDeleted renames f as deleted, its mtime is the time of the delete
+func markDeleted(f string) error {
+	if err := os.Rename(f, f+deletedSuffix); err != nil {
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(f+deletedSuffix, now, now)
+}
+
+// ListChunks the chunks of a block, for the gc of volmgr. An archived chunk is listed
+// by its stub.
+func (s *DataNodeServer) ListChunks(ctx context.Context, in *dp.ListChunksReq) (*dp.ListChunksAck, error) {
+	ack := dp.ListChunksAck{}
+	_, dir := Store.Block(in.BlockID, false)
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			ack.Ret = 2 // ENOENT
+		} else {
+			ack.Ret = -1
+		}
+		return &ack, nil
+	}
+	for _, fi := range fis {
+		name := fi.Name()
+		if !strings.HasPrefix(name, "chunk-") {
+			continue
+		}
+		id := strings.TrimSuffix(name[len("chunk-"):], archive.StubSuffix)
+		deleted := strings.HasSuffix(id, deletedSuffix)
+		id = strings.TrimSuffix(id, deletedSuffix)
+		chunkID, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			// the checksums
+			continue
+		}
+		ack.Chunks = append(ack.Chunks, &dp.ChunkFile{ChunkID: chunkID, ModTime: fi.ModTime().Unix(), Deleted: deleted})
+	}
+	return &ack, nil
+}
+
+// RestoreChunk puts back a chunk deleted while a file still references it
+func (s *DataNodeServer) RestoreChunk(ctx context.Context, in *dp.RestoreChunkReq) (*dp.RestoreChunkAck, error) {
+	ack := dp.RestoreChunkAck{}
+	_, path := Store.Block(in.BlockID, false)
+	chunkFile := path + "/chunk-" + strconv.FormatUint(in.ChunkID, 10)
+	if err := os.Rename(chunkFile+deletedSuffix, chunkFile); err != nil {
+		logger.Error("restore chunk %v err:%v", chunkFile, err)
+		ack.Ret = 2 // ENOENT
+		return &ack, nil
+	}
+	crc := store.ChecksumFile(chunkFile)
+	os.Rename(crc+deletedSuffix, crc)
+	logger.Error("restored chunk %v, deleted while still referenced", chunkFile)
+	return &ack, nil
+}
+
+// reapDeleted frees the chunks deleted more than -gcdelay ago, it never returns
+func reapDeleted() {
+	interval := DataNodeServerAddr.GCDelay / 4
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+	if interval > time.Hour {
+		interval = time.Hour
+	}
+	for range time.Tick(interval) {
+		var freed int
+		for _, d := range Store.Disks {
+			if !d.Mon.Readable() {
+				continue
+			}
+			for _, blockID := range Store.Blocks(d) {
+				_, dir := Store.Block(blockID, false)
+				fis, err := ioutil.ReadDir(dir)
+				if err != nil {
+					continue
+				}
+				for _, fi := range fis {
+					if !strings.HasSuffix(fi.Name(), deletedSuffix) || time.Since(fi.ModTime()) < DataNodeServerAddr.GCDelay {
+						continue
+					}
+					Sched.Acquire(iosched.Background)
+					err := os.Remove(dir + "/" + fi.Name())
+					Sched.Release()
+					if err != nil {
+						logger.Error("free deleted chunk %v/%v err:%v", dir, fi.Name(), err)
+						continue
+					}
+					freed++
+				}
+			}
+		}
+		if freed > 0 {
+			logger.Info("gc freed %v deleted chunk files", freed)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package iosched
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Class of a datanode request
+type Class int
+
+const (
+	// Foreground client IO, latency matters
+	Foreground Class = iota
+	// Background repair, rebalance, snapshot, trash and other bulk traffic
+	Background
+)
+
+// Scheduler bounds the requests doing disk IO at once and hands the free
+// slots to the queued requests by class: while both classes wait, background
+// gets one slot for every Weight foreground ones, so recovery keeps moving
+// without tanking the latency of live workloads.
+type Scheduler struct {
+	Slots  int
+	Weight int
+
+	mu     sync.Mutex
+	busy   int
+	fgRun  int // foreground grants since the last background one
+	queues [2][]chan struct{}
+
+	granted [2]uint64
+	queued  [2]uint64 // had to wait for a slot
+}
+
+// New ...
+func New(slots int, weight int) *Scheduler {
+	if weight < 1 {
+		weight = 1
+	}
+	return &Scheduler{Slots: slots, Weight: weight}
+}
+
+// Acquire waits for a slot, a nil scheduler never waits
+func (s *Scheduler) Acquire(class Class) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.busy < s.Slots && len(s.queues[Foreground]) == 0 && len(s.queues[Background]) == 0 {
+		s.busy++
+		s.granted[class]++
+		s.mu.Unlock()
+		return
+	}
+	ch := make(chan struct{})
+	s.queues[class] = append(s.queues[class], ch)
+	s.queued[class]++
+	s.mu.Unlock()
+	<-ch
+}
+
+// Release gives the slot to the next waiter
+func (s *Scheduler) Release() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fg, bg := len(s.queues[Foreground]) > 0, len(s.queues[Background]) > 0
+	var next Class
+	switch {
+	case fg && bg:
+		if s.fgRun >= s.Weight {
+			next = Background
+		} else {
+			next = Foreground
+		}
+	case fg:
+		next = Foreground
+	case bg:
+		next = Background
+	default:
+		s.busy--
+		return
+	}
+	if next == Foreground {
+		s.fgRun++
+	} else {
+		s.fgRun = 0
+	}
+	ch := s.queues[next][0]
+	s.queues[next] = s.queues[next][1:]
+	s.granted[next]++
+	close(ch)
+}
+
+// Busy the requests doing disk IO and the ones waiting for a slot
+func (s *Scheduler) Busy() (int, int) {
+	if s == nil {
+		return 0, 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.busy, len(s.queues[Foreground]) + len(s.queues[Background])
+}
+
+// Stats ...
+func (s *Scheduler) Stats() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("iosched slots:%v busy:%v foreground granted:%v queued:%v waiting:%v background granted:%v queued:%v waiting:%v",
+		s.Slots, s.busy, s.granted[Foreground], s.queued[Foreground], len(s.queues[Foreground]),
+		s.granted[Background], s.queued[Background], len(s.queues[Background]))
+}
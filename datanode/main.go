@@ -2,21 +2,34 @@ package main
 
 import (
 	"bufio"
+	"crypto/sha256"
 	"flag"
 	"fmt"
+	"github.com/ipdcode/containerfs/datanode/archive"
+	"github.com/ipdcode/containerfs/datanode/canary"
+	"github.com/ipdcode/containerfs/datanode/diskmon"
+	"github.com/ipdcode/containerfs/datanode/iosched"
+	"github.com/ipdcode/containerfs/datanode/scrub"
+	"github.com/ipdcode/containerfs/datanode/store"
 	"github.com/ipdcode/containerfs/logger"
 	dp "github.com/ipdcode/containerfs/proto/dp"
 	vp "github.com/ipdcode/containerfs/proto/vp"
 	"github.com/ipdcode/containerfs/utils"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/reflection"
+	"hash/crc32"
+	"io"
 	"net"
 	"os"
 	"runtime"
 	"runtime/debug"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -35,21 +48,94 @@ type addr struct {
 	Log   string
 
 	VolMgrHost string
+	Labels     string
+
+	AuditRate float64
+	AuditLog  string
+
+	Canary     string
+	CanaryRate float64
+
+	IOSlots  int
+	BGWeight int
+
+	DebugAddr string // pprof and stats
+
+	ShortCircuit bool // unix socket for the clients of this host
+
+	Media string // ssd or hdd, sent in the labels
+
+	Paths       []string // all the data directories, Path is the first
+	SmartDev    string
+	MaxIOErrors int
+
+	ScrubInterval time.Duration
+	ScrubMBps     int
+
+	GCDelay time.Duration // deleted chunks are kept that long, see removeChunk
+
+	Faults    string // rpcs to fail on purpose, see utils.SetFaults
+	FaultSeed int64
+
+	ArchiveURL      string // http(s)://host/bucket/prefix of the cold chunks
+	ArchiveRegion   string
+	ArchiveDays     int
+	ArchiveInterval time.Duration
+	RecallSlots     int
 }
 
 // DataNodeServerAddr ...
 var DataNodeServerAddr addr
 
+// Archiver moves the cold chunks to object storage, nil without -archiveurl
+var Archiver *archive.Archiver
+
+// Canary mirrors writes to a datanode running a new version, nil without -canary
+var Canary *canary.Mirror
+
+// Auditor samples data-plane requests into the audit log, nil when -auditrate is 0
+var Auditor *utils.Auditor
+
+// Store the data directories and the blocks on each, failing disks stop taking writes
+var Store *store.Store
+
+// Sched orders the disk IO of client and background requests, nil when -ioslots is 0
+var Sched *iosched.Scheduler
+
+func ioClass(background bool) iosched.Class {
+	if background {
+		return iosched.Background
+	}
+	return iosched.Foreground
+}
+
+func clientAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// audit is deferred by the handlers for a sampled request, ret is read when the request is done
+func audit(rec *utils.AuditRecord, start time.Time, ret *int32) {
+	rec.Latency = time.Since(start)
+	rec.Ret = *ret
+	Auditor.Log(rec)
+}
+
 func startDataService() {
 
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", DataNodeServerAddr.Port))
 	if err != nil {
 		panic(fmt.Sprintf("Failed to listen on:%v", DataNodeServerAddr.Port))
 	}
-	s := grpc.NewServer()
+	s := grpc.NewServer(utils.FaultServerOptions()...)
 	dp.RegisterDataNodeServer(s, &DataNodeServer{})
 	reflection.Register(s)
-	if err := s.Serve(lis); err != nil {
+	if DataNodeServerAddr.ShortCircuit {
+		go serveLocal(s)
+	}
+	if err := s.Serve(utils.CountConns(lis)); err != nil {
 		panic("Failed to serve")
 	}
 }
@@ -66,15 +152,20 @@ func registryToVolMgr() {
 	var datanodeRegistryReq vp.DatanodeRegistryReq
 	datanodeRegistryReq.Ip = DataNodeServerAddr.IPInt
 	datanodeRegistryReq.Port = DataNodeServerAddr.Port
-	diskInfo := utils.DiskUsage(DataNodeServerAddr.Path)
-	capacity := int32(float64(diskInfo.All) / float64(1024*1024*1024))
+	var capacity int32
+	for _, p := range DataNodeServerAddr.Paths {
+		diskInfo := utils.DiskUsage(p)
+		capacity += int32(float64(diskInfo.All) / float64(1024*1024*1024))
+	}
 	datanodeRegistryReq.Capacity = capacity
 	datanodeRegistryReq.MountPoint = DataNodeServerAddr.Path
+	datanodeRegistryReq.Labels = DataNodeServerAddr.Labels
 
-	_, err = os.Stat(datanodeRegistryReq.MountPoint)
-	if err != nil {
-		logger.Error("data node statup failed : DataNodeServerAddr.Path not exist !")
-		os.Exit(1)
+	for _, p := range DataNodeServerAddr.Paths {
+		if _, err = os.Stat(p); err != nil {
+			logger.Error("data node statup failed : data path %v not exist !", p)
+			os.Exit(1)
+		}
 	}
 
 	pDatanodeRegistryAck, _ := c.DatanodeRegistry(context.Background(), &datanodeRegistryReq)
@@ -99,33 +190,159 @@ func heartbeatToVolMgr() {
 	defer conn.Close()
 	c := vp.NewVolMgrClient(conn)
 
-	diskInfo := utils.DiskUsage(DataNodeServerAddr.Path)
-	free := int32(float64(diskInfo.Free) / float64(1024*1024*1024))
-	used := int32(float64(diskInfo.Used) / float64(1024*1024*1024))
-
 	var datanodeHeartbeatReq vp.DatanodeHeartbeatReq
 	datanodeHeartbeatReq.Ip = DataNodeServerAddr.IPInt
 	datanodeHeartbeatReq.Port = DataNodeServerAddr.Port
-	datanodeHeartbeatReq.Free = free
-	datanodeHeartbeatReq.Used = used
-	//datanodeHeartbeatReq.Status = 0
 
-	f, err := os.OpenFile(DataNodeServerAddr.Path+"/health", os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0666)
+	// 0 ok, 2 offline, 3 read-only, volmgr re-replicates the blocks of a failed disk.
+	// The node is ok while one disk is, only healthy disks count as free space.
+	status := diskmon.Offline
+	for _, d := range Store.Disks {
+		state := d.Mon.Check()
+		diskInfo := utils.DiskUsage(d.Path)
+		stat := &vp.DiskStat{
+			Path:   d.Path,
+			Total:  int32(float64(diskInfo.All) / float64(1024*1024*1024)),
+			Free:   int32(float64(diskInfo.Free) / float64(1024*1024*1024)),
+			Used:   int32(float64(diskInfo.Used) / float64(1024*1024*1024)),
+			Status: int32(state),
+		}
+		switch state {
+		case diskmon.Healthy:
+			status = diskmon.Healthy
+			datanodeHeartbeatReq.Free += stat.Free
+		case diskmon.ReadOnly:
+			if status == diskmon.Offline {
+				status = diskmon.ReadOnly
+			}
+			stat.Blocks = Store.Blocks(d)
+		default:
+			stat.Blocks = Store.Blocks(d)
+		}
+		datanodeHeartbeatReq.Used += stat.Used
+		datanodeHeartbeatReq.Disks = append(datanodeHeartbeatReq.Disks, stat)
+	}
+	datanodeHeartbeatReq.Status = int32(status)
+	datanodeHeartbeatReq.Labels = DataNodeServerAddr.Labels
+	datanodeHeartbeatReq.Access = Access.take()
+
+	c.DatanodeHeartbeat(context.Background(), &datanodeHeartbeatReq)
+}
+
+// reportCorruptChunk has volmgr repair a chunk the scrubber found rotten from its other replicas
+func reportCorruptChunk(blockID uint32, chunkID uint64) {
+	conn, err := grpc.Dial(DataNodeServerAddr.VolMgrHost, grpc.WithInsecure())
 	if err != nil {
-		logger.Error("Open datanode check health file error:%v", err)
-		datanodeHeartbeatReq.Status = 2
+		logger.Error("report corrupt chunk %v failed : Dial to volmgr failed :%v", chunkID, err)
+		return
 	}
-	defer f.Close()
+	defer conn.Close()
+	c := vp.NewVolMgrClient(conn)
+	ctx, _ := context.WithTimeout(context.Background(), 60*time.Second)
+	ack, err := c.ReportCorruptChunk(ctx, &vp.ReportCorruptChunkReq{
+		Ip:      DataNodeServerAddr.IPInt,
+		Port:    DataNodeServerAddr.Port,
+		BlockID: blockID,
+		ChunkID: chunkID,
+	})
+	if err != nil || ack.Ret != 0 {
+		logger.Error("report corrupt block %v chunk %v failed, err:%v ack:%v", blockID, chunkID, err, ack)
+	}
+}
 
-	_, err = f.WriteString("ok")
+// serveLocal serves s on the unix socket of utils.DataNodeSocket too, the clients
+// of this host find the chunk files through it and read them directly
+func serveLocal(s *grpc.Server) {
+	sock := utils.DataNodeSocket(DataNodeServerAddr.Port)
+	os.MkdirAll(utils.LocalSocketDir, 0755)
+	os.Remove(sock)
+	lis, err := net.Listen("unix", sock)
 	if err != nil {
-		logger.Error("Write datanode check health file error:%v", err)
-		datanodeHeartbeatReq.Status = 2
-	} else {
-		datanodeHeartbeatReq.Status = 0
+		logger.Error("short-circuit reads off, listen on %v err:%v", sock, err)
+		return
 	}
+	// the chunk files are readable by root only, so are their paths
+	os.Chmod(sock, 0600)
+	if err := s.Serve(lis); err != nil {
+		logger.Error("serve %v err:%v", sock, err)
+	}
+}
 
-	c.DatanodeHeartbeat(context.Background(), &datanodeHeartbeatReq)
+// BlockPath : the dir of the chunk files of a block, asked on the unix socket only
+func (s *DataNodeServer) BlockPath(ctx context.Context, in *dp.BlockPathReq) (*dp.BlockPathAck, error) {
+	ack := dp.BlockPathAck{}
+	if p, ok := peer.FromContext(ctx); !ok || p.Addr.Network() != "unix" {
+		ack.Ret = int32(syscall.EPERM)
+		return &ack, nil
+	}
+	disk, path := Store.Block(in.BlockID, false)
+	if !disk.Mon.Readable() {
+		ack.Ret = int32(syscall.EIO)
+		return &ack, nil
+	}
+	ack.Path = path
+	return &ack, nil
+}
+
+// ArchiveChunk : moves the chunk to the archive bucket now, for a lifecycle rule
+func (s *DataNodeServer) ArchiveChunk(ctx context.Context, in *dp.ArchiveChunkReq) (*dp.ArchiveChunkAck, error) {
+	ack := dp.ArchiveChunkAck{}
+	if Archiver == nil {
+		ack.Ret = int32(syscall.ENOTSUP)
+		return &ack, nil
+	}
+	_, path := Store.Block(in.BlockID, false)
+	chunkFileName := path + "/chunk-" + strconv.Itoa(int(in.ChunkID))
+	Archiver.SetBlockMeta(path, in.VolID, in.BlockGroupID)
+	if err := Archiver.Archive(chunkFileName); err != nil {
+		logger.Error("archive chunk %v err:%v", chunkFileName, err)
+		ack.Ret = -1
+	}
+	return &ack, nil
+}
+
+// digestPiece the dedup digest hashes the chunk by pieces of it
+const digestPiece = 128 * 1024
+
+// ChunkDigest : the dedup digest of the chunk, read in the background class
+func (s *DataNodeServer) ChunkDigest(ctx context.Context, in *dp.ChunkDigestReq) (*dp.ChunkDigestAck, error) {
+	ack := dp.ChunkDigestAck{}
+	disk, path := Store.Block(in.BlockID, false)
+	if !disk.Mon.Readable() {
+		ack.Ret = int32(syscall.EIO)
+		return &ack, nil
+	}
+	chunkFileName := path + "/chunk-" + strconv.Itoa(int(in.ChunkID))
+	f, err := os.Open(chunkFileName)
+	if err != nil {
+		// archived ones too, they are not recalled for it
+		ack.Ret = int32(syscall.ENOENT)
+		return &ack, nil
+	}
+	defer f.Close()
+
+	Sched.Acquire(iosched.Background)
+	defer Sched.Release()
+	sum := sha256.New()
+	buf := make([]byte, digestPiece)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			piece := sha256.Sum256(buf[:n])
+			sum.Write(piece[:])
+			ack.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			disk.Mon.ReadError(err)
+			ack.Ret = int32(syscall.EIO)
+			return &ack, nil
+		}
+	}
+	ack.Digest = sum.Sum(nil)
+	return &ack, nil
 }
 
 // DatanodeHealthCheck rpc GetChunks(GetChunksReq) returns (GetChunksAck){};
@@ -135,6 +352,46 @@ func (s *DataNodeServer) DatanodeHealthCheck(ctx context.Context, in *dp.Datanod
 	return &ack, nil
 }
 
+// SyncChunks : fsyncs the chunks and their block dirs, for the fsync of a client file
+// written without Sync. The chunks gone since, deleted or archived, are skipped. The
+// replicas the chunks were forwarded to fsync theirs first.
+func (s *DataNodeServer) SyncChunks(ctx context.Context, in *dp.SyncChunksReq) (*dp.SyncChunksAck, error) {
+	ack := dp.SyncChunksAck{}
+	Forwarder.Sync(in)
+	Sched.Acquire(iosched.Foreground)
+	defer Sched.Release()
+	dirs := make(map[string]bool)
+	for _, c := range in.Chunks {
+		disk, path := Store.Block(c.BlockID, false)
+		chunkFileName := path + "/chunk-" + strconv.Itoa(int(c.ChunkID))
+		err := syncPath(chunkFileName)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == nil && !dirs[path] {
+			dirs[path] = true
+			err = syncPath(path)
+		}
+		if err != nil {
+			logger.Error("fsync chunk %v err:%v", chunkFileName, err)
+			disk.Mon.WriteError(err)
+			ack.Ret = int32(syscall.EIO)
+			return &ack, nil
+		}
+	}
+	return &ack, nil
+}
+
+// syncPath fsyncs the file or dir
+func syncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
 // WriteChunk ...
 func (s *DataNodeServer) WriteChunk(ctx context.Context, in *dp.WriteChunkReq) (*dp.WriteChunkAck, error) {
 	var f *os.File
@@ -143,23 +400,98 @@ func (s *DataNodeServer) WriteChunk(ctx context.Context, in *dp.WriteChunkReq) (
 	ack := dp.WriteChunkAck{}
 	chunkID := in.ChunkID
 	blockID := in.BlockID
+	if err := Fences.check(ctx, in.VolID); err != nil {
+		return nil, err
+	}
+
+	var rec *utils.AuditRecord
+	if Auditor.Sample() {
+		rec = &utils.AuditRecord{Op: "write", VolID: in.VolID, BlockGroupID: in.BlockGroupID, BlockID: blockID, ChunkID: chunkID,
+			Size: int64(len(in.Databuf)), Client: clientAddr(ctx)}
+		defer audit(rec, time.Now(), &ack.Ret)
+	}
 
-	path := DataNodeServerAddr.Path + "/block-" + strconv.Itoa(int(blockID))
-	if ok, err := utils.LocalPathExists(path); !ok && err == nil {
-		os.MkdirAll(path, 0777)
+	disk, path := Store.Block(blockID, true)
+	if !disk.Mon.Writable() {
+		ack.Ret = -1
+		return &ack, nil
 	}
+	Access.touch(blockID)
 
 	chunkFileName := path + "/chunk-" + strconv.Itoa(int(chunkID))
+	if Archiver != nil {
+		release, err := Archiver.Hold(chunkFileName)
+		if err != nil {
+			logger.Error("write chunk %v err:%v", chunkFileName, err)
+			ack.Ret = -1
+			return &ack, nil
+		}
+		defer release()
+		Archiver.SetBlockMeta(path, in.VolID, in.BlockGroupID)
+	}
+
+	Sched.Acquire(ioClass(in.Background))
+	defer Sched.Release()
 
 	f, err = os.OpenFile(chunkFileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0660)
 	defer f.Close()
 	if err != nil {
+		disk.Mon.WriteError(err)
 		ack.Ret = -1
 		return &ack, nil
 	}
+	var offset int64
+	if fi, err := f.Stat(); err == nil {
+		offset = fi.Size()
+	}
+	if in.Forwarded && offset != in.Offset {
+		// a write of the primary overtaken by another one, the chunk is repaired instead
+		logger.Error("forwarded write of chunk %v at %v, the chunk file ends at %v", chunkFileName, in.Offset, offset)
+		ack.Ret = -1
+		return &ack, nil
+	}
+	if rec != nil {
+		rec.Offset = offset
+	}
 	w := bufio.NewWriter(f)
 	w.Write(in.Databuf)
-	w.Flush()
+	if err := w.Flush(); err != nil {
+		logger.Error("write chunk %v err:%v", chunkFileName, err)
+		disk.Mon.WriteError(err)
+		ack.Ret = -1
+		return &ack, nil
+	}
+	if in.Sync {
+		err := f.Sync()
+		if err == nil && offset == 0 {
+			// the chunk file is new, its entry in the block dir too
+			err = syncPath(path)
+		}
+		if err != nil {
+			logger.Error("fsync chunk %v err:%v", chunkFileName, err)
+			disk.Mon.WriteError(err)
+			ack.Ret = -1
+			return &ack, nil
+		}
+	}
+	if err := store.AppendChecksum(chunkFileName, offset, in.Databuf); err != nil {
+		// the data is there, the scrubber just can't vouch for it
+		logger.Error("checksum chunk %v err:%v", chunkFileName, err)
+		disk.Mon.WriteError(err)
+	}
+
+	if in.Verify {
+		buf := make([]byte, len(in.Databuf))
+		n, _ := f.ReadAt(buf, offset)
+		ack.Checksum = crc32.ChecksumIEEE(buf[:n])
+		ack.Offset = offset
+	}
+	if Canary != nil {
+		Canary.Write(in, offset)
+	}
+	if len(in.Forwards) != 0 {
+		Forwarder.Forward(in, offset)
+	}
 
 	ack.Ret = 0
 	return &ack, nil
@@ -234,16 +566,49 @@ func (s *DataNodeServer) ReadChunk(ctx context.Context, in *dp.ReadChunkReq) (*d
 */
 
 // StreamReadChunk ...
-func (s *DataNodeServer) StreamReadChunk(in *dp.StreamReadChunkReq, stream dp.DataNode_StreamReadChunkServer) error {
+func (s *DataNodeServer) StreamReadChunk(in *dp.StreamReadChunkReq, stream dp.DataNode_StreamReadChunkServer) (err error) {
 	chunkID := in.ChunkID
 	blockID := in.BlockID
 	offset := in.Offset
 	readsize := in.Readsize
 
-	chunkFileName := DataNodeServerAddr.Path + "/block-" + strconv.Itoa(int(blockID)) + "/chunk-" + strconv.Itoa(int(chunkID))
+	if Auditor.Sample() {
+		rec := &utils.AuditRecord{Op: "read", VolID: in.VolID, BlockGroupID: in.BlockGroupID, BlockID: blockID, ChunkID: chunkID,
+			Offset: offset, Size: readsize, Client: clientAddr(stream.Context())}
+		var ret int32
+		start := time.Now()
+		defer func() {
+			if err != nil {
+				ret = -1
+			}
+			audit(rec, start, &ret)
+		}()
+	}
+
+	disk, path := Store.Block(blockID, false)
+	if !disk.Mon.Readable() {
+		return fmt.Errorf("disk %v offline", disk.Path)
+	}
+	Access.touch(blockID)
+
+	chunkFileName := path + "/chunk-" + strconv.Itoa(int(chunkID))
+	if Archiver != nil {
+		release, err := Archiver.Hold(chunkFileName)
+		if err != nil {
+			logger.Error("read chunk %v err:%v", chunkFileName, err)
+			return err
+		}
+		defer release()
+		Archiver.Touch(chunkFileName)
+	}
+
+	Sched.Acquire(ioClass(in.Background))
+	defer Sched.Release()
+
 	f, err := os.Open(chunkFileName)
 	defer f.Close()
 	if err != nil {
+		disk.Mon.ReadError(err)
 		return err
 	}
 	_, err = f.Seek(offset, 0)
@@ -259,6 +624,7 @@ func (s *DataNodeServer) StreamReadChunk(in *dp.StreamReadChunkReq, stream dp.Da
 	for {
 		n, err := bfRd.Read(buf)
 		if err != nil {
+			disk.Mon.ReadError(err)
 			return err
 		}
 
@@ -289,10 +655,29 @@ func (s *DataNodeServer) DeleteChunk(ctx context.Context, in *dp.DeleteChunkReq)
 	ack := dp.DeleteChunkAck{}
 	chunkID := in.ChunkID
 	blockID := in.BlockID
+	if err := Fences.check(ctx, in.VolID); err != nil {
+		return nil, err
+	}
 
-	chunkFileName := DataNodeServerAddr.Path + "/block-" + strconv.Itoa(int(blockID)) + "/chunk-" + strconv.Itoa(int(chunkID))
+	if Auditor.Sample() {
+		rec := &utils.AuditRecord{Op: "delete", VolID: in.VolID, BlockGroupID: in.BlockGroupID, BlockID: blockID, ChunkID: chunkID,
+			Client: clientAddr(ctx)}
+		defer audit(rec, time.Now(), &ack.Ret)
+	}
+
+	_, path := Store.Block(blockID, false)
+	chunkFileName := path + "/chunk-" + strconv.Itoa(int(chunkID))
 
-	err = os.Remove(chunkFileName)
+	if Canary != nil {
+		Canary.Delete(in)
+	}
+
+	Sched.Acquire(ioClass(in.Background))
+	err = removeChunk(chunkFileName)
+	Sched.Release()
+	if Archiver != nil {
+		Archiver.Delete(chunkFileName, in.KeepArchive)
+	}
 	if err != nil {
 		ack.Ret = 0
 	} else {
@@ -304,24 +689,59 @@ func (s *DataNodeServer) DeleteChunk(ctx context.Context, in *dp.DeleteChunkReq)
 
 func init() {
 
-	var loglevel string
+	var loglevel, logformat, logoutput, logmodules string
 	var port int
 
 	flag.StringVar(&DataNodeServerAddr.IPStr, "host", "127.0.0.1", "ContainerFS DataNode Host")
 	flag.IntVar(&port, "port", 8000, "ContainerFS DataNode Port")
-	flag.StringVar(&DataNodeServerAddr.Path, "datapath", "/home/containerfs/datanode1/", "ContainerFS DataNode Data Path")
+	flag.StringVar(&DataNodeServerAddr.Path, "datapath", "/home/containerfs/datanode1/", "ContainerFS DataNode Data Paths, comma separated, one per disk")
 	flag.StringVar(&DataNodeServerAddr.VolMgrHost, "volmgr", "127.0.0.1:7000", "ContainerFS VolMgr Host")
 	flag.StringVar(&DataNodeServerAddr.Log, "logpath", "/export/Logs/containerfs/logs/", "ContainerFS Log Path")
 	flag.StringVar(&loglevel, "loglevel", "error", "ContainerFS Log Level")
+	flag.StringVar(&logformat, "logformat", "text", "ContainerFS Log Format, text or json")
+	flag.StringVar(&logoutput, "logoutput", "file", "ContainerFS Log Output, file, stderr, syslog or journald")
+	flag.StringVar(&logmodules, "logmodules", "", "ContainerFS Log Levels per module, e.g. datanode/store=debug,utils=info")
+	flag.StringVar(&DataNodeServerAddr.Labels, "labels", "", "ContainerFS DataNode Labels for placement, e.g. rack=r1,zone=a")
+	flag.Float64Var(&DataNodeServerAddr.AuditRate, "auditrate", 0, "ContainerFS DataNode fraction of requests written to the audit log, 0 disables it")
+	flag.StringVar(&DataNodeServerAddr.Canary, "canary", "", "ContainerFS Canary DataNode Host, writes are mirrored to it and checked")
+	flag.Float64Var(&DataNodeServerAddr.CanaryRate, "canaryrate", 1, "ContainerFS DataNode fraction of chunks mirrored to the canary")
+	flag.StringVar(&DataNodeServerAddr.AuditLog, "auditlog", "", "ContainerFS DataNode Audit Log File, default datanode-audit.log under logpath")
+	flag.StringVar(&DataNodeServerAddr.SmartDev, "smartdev", "", "ContainerFS DataNode devices under the datapaths checked with smartctl, comma separated in datapath order, empty skips SMART")
+	flag.IntVar(&DataNodeServerAddr.MaxIOErrors, "maxioerrors", 10, "ContainerFS DataNode IO errors within an hour that take the disk offline")
+	flag.DurationVar(&DataNodeServerAddr.ScrubInterval, "scrubinterval", 7*24*time.Hour, "ContainerFS DataNode time to read back and verify all the chunks, 0 disables the scrubber")
+	flag.IntVar(&DataNodeServerAddr.ScrubMBps, "scrubmbps", 20, "ContainerFS DataNode scrubber bandwidth cap in MB/s, 0 is uncapped")
+	flag.DurationVar(&DataNodeServerAddr.GCDelay, "gcdelay", 0, "ContainerFS DataNode time a deleted chunk is kept before its space is freed, the volmgr gc restores the ones still referenced meanwhile, 0 frees it at once")
+	flag.IntVar(&DataNodeServerAddr.IOSlots, "ioslots", 16, "ContainerFS DataNode requests doing disk IO at once, 0 disables priority scheduling")
+	flag.IntVar(&DataNodeServerAddr.BGWeight, "bgweight", 4, "ContainerFS DataNode client requests served per background request while both wait")
+	flag.StringVar(&DataNodeServerAddr.DebugAddr, "debugaddr", "", "ContainerFS DataNode address serving /debug/pprof/ and /debug/stats, empty disables it")
+	flag.StringVar(&DataNodeServerAddr.Media, "media", "auto", "ContainerFS DataNode media of its disks for tiered volumes, ssd, hdd or auto to detect it from the first datapath")
+	flag.StringVar(&DataNodeServerAddr.ArchiveURL, "archiveurl", "", "ContainerFS DataNode S3 compatible bucket of the cold chunks, as https://host/bucket/prefix, keys from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, empty disables archival")
+	flag.StringVar(&DataNodeServerAddr.ArchiveRegion, "archiveregion", "us-east-1", "ContainerFS DataNode region of the archive bucket")
+	flag.IntVar(&DataNodeServerAddr.ArchiveDays, "archivedays", 30, "ContainerFS DataNode days without a read or a write before a chunk is archived")
+	flag.DurationVar(&DataNodeServerAddr.ArchiveInterval, "archiveinterval", 24*time.Hour, "ContainerFS DataNode time between two looks for cold chunks")
+	flag.IntVar(&DataNodeServerAddr.RecallSlots, "recallslots", 4, "ContainerFS DataNode archived chunks fetched back at once")
+	flag.StringVar(&DataNodeServerAddr.Faults, "faults", "", "ContainerFS DataNode rpcs failed on purpose for testing, method:drop|delay=<duration>|corrupt:probability comma separated, empty disables it")
+	flag.Int64Var(&DataNodeServerAddr.FaultSeed, "faultseed", 0, "ContainerFS DataNode seed of the faults injected, the same one fails the same calls, 0 takes the time")
+	flag.BoolVar(&DataNodeServerAddr.ShortCircuit, "shortcircuit", true, "ContainerFS DataNode unix socket under "+utils.LocalSocketDir+" for the short-circuit reads of the clients on this host")
 
 	flag.Parse()
+	if err := utils.FlagEnv(flag.CommandLine); err != nil {
+		fmt.Println("flag from the environment:", err)
+		os.Exit(1)
+	}
 
 	DataNodeServerAddr.Port = int32(port)
 	ipnr := net.ParseIP(DataNodeServerAddr.IPStr)
 	DataNodeServerAddr.Ipnr = ipnr
 	ipint := utils.InetAton(ipnr)
 	DataNodeServerAddr.IPInt = ipint
+	DataNodeServerAddr.Paths = strings.Split(DataNodeServerAddr.Path, ",")
+	DataNodeServerAddr.Path = DataNodeServerAddr.Paths[0]
 	DataNodeServerAddr.Flag = DataNodeServerAddr.Path + "/.registryflag"
+	if DataNodeServerAddr.Media == "auto" {
+		DataNodeServerAddr.Media = detectMedia(DataNodeServerAddr.Path)
+	}
+	DataNodeServerAddr.Labels = withMedia(DataNodeServerAddr.Labels, DataNodeServerAddr.Media)
 
 	logger.SetConsole(true)
 	logger.SetRollingFile(DataNodeServerAddr.Log, "datanode.log", 10, 100, logger.MB) //each 100M rolling
@@ -336,6 +756,59 @@ func init() {
 	default:
 		logger.SetLevel(logger.ERROR)
 	}
+	if err := logger.Configure(logformat, logoutput, logmodules, "cfs-datanode"); err != nil {
+		fmt.Println("log config err:", err)
+		os.Exit(1)
+	}
+
+	if err := utils.SetFaults(DataNodeServerAddr.Faults, DataNodeServerAddr.FaultSeed); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if DataNodeServerAddr.Faults != "" {
+		logger.Warn("fault injection on: %v", DataNodeServerAddr.Faults)
+	}
+
+	if DataNodeServerAddr.AuditRate > 0 {
+		if DataNodeServerAddr.AuditLog == "" {
+			DataNodeServerAddr.AuditLog = DataNodeServerAddr.Log + "/datanode-audit.log"
+		}
+		f, err := os.OpenFile(DataNodeServerAddr.AuditLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			logger.Error("open audit log %v err:%v, audit disabled", DataNodeServerAddr.AuditLog, err)
+		} else {
+			Auditor = utils.NewAuditor(f, DataNodeServerAddr.AuditRate)
+		}
+	}
+
+	var smartDevs []string
+	if DataNodeServerAddr.SmartDev != "" {
+		smartDevs = strings.Split(DataNodeServerAddr.SmartDev, ",")
+	}
+	Store = store.Open(DataNodeServerAddr.Paths, smartDevs, DataNodeServerAddr.MaxIOErrors)
+	Fences.load(DataNodeServerAddr.Path)
+
+	if DataNodeServerAddr.IOSlots > 0 {
+		Sched = iosched.New(DataNodeServerAddr.IOSlots, DataNodeServerAddr.BGWeight)
+	}
+
+	if DataNodeServerAddr.ArchiveURL != "" {
+		b, err := archive.ParseBucket(DataNodeServerAddr.ArchiveURL, DataNodeServerAddr.ArchiveRegion)
+		if err != nil {
+			fmt.Println("archive:", err)
+			os.Exit(1)
+		}
+		Archiver = archive.New(Store, Sched, b, time.Duration(DataNodeServerAddr.ArchiveDays)*24*time.Hour,
+			DataNodeServerAddr.ArchiveInterval, DataNodeServerAddr.IPStr+":"+strconv.Itoa(port), DataNodeServerAddr.RecallSlots)
+	}
+
+	if DataNodeServerAddr.Canary != "" {
+		var err error
+		Canary, err = canary.New(DataNodeServerAddr.Canary, DataNodeServerAddr.CanaryRate, 1024)
+		if err != nil {
+			logger.Error("canary %v err:%v, mirroring disabled", DataNodeServerAddr.Canary, err)
+		}
+	}
 
 	if ok, _ := utils.LocalPathExists(DataNodeServerAddr.Flag); !ok {
 		logger.Debug("Start registry to volmgr ...")
@@ -360,10 +833,52 @@ func main() {
 	}()
 
 	heartbeatToVolMgr()
+	if DataNodeServerAddr.DebugAddr != "" {
+		err := utils.ServeDebug(DataNodeServerAddr.DebugAddr, func() map[string]int64 {
+			busy, waiting := Sched.Busy()
+			pending, failed := Forwarder.stats()
+			stats := map[string]int64{"io_busy": int64(busy), "io_waiting": int64(waiting),
+				"forward_pending": pending, "forward_failed": failed}
+			if Archiver != nil {
+				stats["archived"] = int64(atomic.LoadUint64(&Archiver.Archived))
+				stats["recalled"] = int64(atomic.LoadUint64(&Archiver.Recalled))
+				stats["archive_failed"] = int64(atomic.LoadUint64(&Archiver.Failed))
+			}
+			return stats
+		})
+		if err != nil {
+			logger.Error("listen on debug addr %v err:%v", DataNodeServerAddr.DebugAddr, err)
+		}
+	}
+	if DataNodeServerAddr.ScrubInterval > 0 {
+		scrubber := &scrub.Scrubber{
+			Store:       Store,
+			Sched:       Sched,
+			Interval:    DataNodeServerAddr.ScrubInterval,
+			BytesPerSec: int64(DataNodeServerAddr.ScrubMBps) * 1024 * 1024,
+			Report:      reportCorruptChunk,
+		}
+		go scrubber.Run()
+	}
+	if Archiver != nil {
+		go Archiver.Run()
+	}
+	if DataNodeServerAddr.GCDelay > 0 {
+		go reapDeleted()
+	}
 	ticker := time.NewTicker(time.Second * 60)
 	go func() {
 		for range ticker.C {
 			heartbeatToVolMgr()
+			if Canary != nil {
+				logger.Info("%v", Canary.Stats())
+			}
+			if Sched != nil {
+				logger.Info("%v", Sched.Stats())
+			}
+			for _, d := range Store.Disks {
+				logger.Info("%v", d.Mon.Stats())
+			}
 		}
 	}()
 	startDataService()
@@ -0,0 +1,113 @@
+package scrub
+
+import (
+	"fmt"
+	"github.com/ipdcode/containerfs/datanode/iosched"
+	"github.com/ipdcode/containerfs/datanode/store"
+	"github.com/ipdcode/containerfs/logger"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Scrubber reads back every chunk of the datanode once per Interval at no more
+// than BytesPerSec, in the background class of the IO scheduler, and reports
+// the chunks that no longer match their checksums. The parts of the chunks
+// without checksums, written before they were, get theirs on the first pass.
+type Scrubber struct {
+	Store       *store.Store
+	Sched       *iosched.Scheduler
+	Interval    time.Duration
+	BytesPerSec int64
+
+	// Report is called for each corrupt chunk, the replica gets repaired from the others
+	Report func(blockID uint32, chunkID uint64)
+
+	Chunks  uint64
+	Bytes   uint64
+	Corrupt uint64
+	Errors  uint64
+	Seeded  uint64 // chunks that had parts without checksums
+}
+
+// Run scrubs forever, a pass starts Interval after the previous one started
+func (s *Scrubber) Run() {
+	for {
+		start := time.Now()
+		s.pass()
+		logger.Info("%v", s.Stats())
+		if d := s.Interval - time.Since(start); d > 0 {
+			time.Sleep(d)
+		}
+	}
+}
+
+func (s *Scrubber) pass() {
+	for _, d := range s.Store.Disks {
+		if !d.Mon.Readable() {
+			continue
+		}
+		for _, blockID := range s.Store.Blocks(d) {
+			_, dir := s.Store.Block(blockID, false)
+			fis, err := ioutil.ReadDir(dir)
+			if err != nil {
+				continue
+			}
+			for _, fi := range fis {
+				name := fi.Name()
+				if !strings.HasPrefix(name, "chunk-") || strings.HasSuffix(name, ".crc") {
+					continue
+				}
+				chunkID, err := strconv.ParseUint(name[len("chunk-"):], 10, 64)
+				if err != nil {
+					continue
+				}
+				s.scrubChunk(d, blockID, chunkID, dir+"/"+name)
+			}
+		}
+	}
+}
+
+func (s *Scrubber) scrubChunk(d *store.Disk, blockID uint32, chunkID uint64, path string) {
+	ok, unchecked, err := store.VerifyChunk(path, s.throttle)
+	atomic.AddUint64(&s.Chunks, 1)
+	if err != nil {
+		atomic.AddUint64(&s.Errors, 1)
+		d.Mon.ReadError(err)
+		logger.Error("scrub chunk %v err:%v", path, err)
+		return
+	}
+	if !ok {
+		atomic.AddUint64(&s.Corrupt, 1)
+		logger.Error("scrub found corrupt chunk %v", path)
+		if s.Report != nil {
+			s.Report(blockID, chunkID)
+		}
+		return
+	}
+	if len(unchecked) > 0 {
+		atomic.AddUint64(&s.Seeded, 1)
+		if err := store.SeedChecksums(path, unchecked, s.throttle); err != nil {
+			atomic.AddUint64(&s.Errors, 1)
+			logger.Error("seed checksums of chunk %v err:%v", path, err)
+		}
+	}
+}
+
+// throttle sleeps off the time n bytes take at BytesPerSec, then waits for a background IO slot
+func (s *Scrubber) throttle(n int) func() {
+	atomic.AddUint64(&s.Bytes, uint64(n))
+	if s.BytesPerSec > 0 {
+		time.Sleep(time.Duration(int64(n) * int64(time.Second) / s.BytesPerSec))
+	}
+	s.Sched.Acquire(iosched.Background)
+	return s.Sched.Release
+}
+
+// Stats ...
+func (s *Scrubber) Stats() string {
+	return fmt.Sprintf("scrub chunks:%v bytes:%v corrupt:%v errors:%v seeded:%v", atomic.LoadUint64(&s.Chunks),
+		atomic.LoadUint64(&s.Bytes), atomic.LoadUint64(&s.Corrupt), atomic.LoadUint64(&s.Errors), atomic.LoadUint64(&s.Seeded))
+}
@@ -0,0 +1,166 @@
+package store
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// Each write appended to a chunk leaves a record in chunk-N.crc: the offset and
+// length of the write and the crc32 of its data, so the scrubber can tell a
+// rotten chunk without asking the other replicas.
+const checksumRecordSize = 8 + 4 + 4
+
+// checksumPiece the most data a record of RecordChecksums covers, the scrubber
+// reads the data of a record in one go
+const checksumPiece = 1 << 20
+
+// Span a range of a chunk file
+type Span struct {
+	Offset int64
+	Len    int64
+}
+
+// ChecksumFile the checksum sidecar of a chunk file
+func ChecksumFile(chunkFile string) string {
+	return chunkFile + ".crc"
+}
+
+// AppendChecksum records the write of data at offset of chunkFile
+func AppendChecksum(chunkFile string, offset int64, data []byte) error {
+	var rec [checksumRecordSize]byte
+	binary.LittleEndian.PutUint64(rec[0:], uint64(offset))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(rec[12:], crc32.ChecksumIEEE(data))
+	f, err := os.OpenFile(ChecksumFile(chunkFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0660)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(rec[:])
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// RecordChecksums records data written at offset of chunkFile by pieces, for the
+// chunks not written through WriteChunk
+func RecordChecksums(chunkFile string, offset int64, data []byte) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > checksumPiece {
+			n = checksumPiece
+		}
+		if err := AppendChecksum(chunkFile, offset, data[:n]); err != nil {
+			return err
+		}
+		offset += int64(n)
+		data = data[n:]
+	}
+	return nil
+}
+
+// VerifyChunk reads back the writes recorded for chunkFile, false when one does not
+// match its checksum. It returns the spans of the chunk no record covers too: the
+// chunk was written before the checksums were, or a record failed to be written.
+// Each read of n bytes waits for throttle(n) and calls the func it returns when done.
+func VerifyChunk(chunkFile string, throttle func(n int) func()) (bool, []Span, error) {
+	f, err := os.Open(chunkFile)
+	if err != nil {
+		return true, nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return true, nil, err
+	}
+	recs, err := ioutil.ReadFile(ChecksumFile(chunkFile))
+	if err != nil && !os.IsNotExist(err) {
+		return true, nil, err
+	}
+
+	var buf []byte
+	var covered []Span
+	for len(recs) >= checksumRecordSize {
+		offset := int64(binary.LittleEndian.Uint64(recs[0:]))
+		size := int(binary.LittleEndian.Uint32(recs[8:]))
+		crc := binary.LittleEndian.Uint32(recs[12:])
+		recs = recs[checksumRecordSize:]
+
+		if cap(buf) < size {
+			buf = make([]byte, size)
+		}
+		buf = buf[:size]
+		done := throttle(size)
+		n, err := f.ReadAt(buf, offset)
+		done()
+		if err == io.EOF && n < size {
+			// truncated under the record
+			return false, nil, nil
+		}
+		if err != nil && err != io.EOF {
+			return true, nil, err
+		}
+		if crc32.ChecksumIEEE(buf) != crc {
+			return false, nil, nil
+		}
+		covered = append(covered, Span{Offset: offset, Len: int64(size)})
+	}
+	return true, gaps(covered, fi.Size()), nil
+}
+
+// gaps the spans of the first size bytes outside covered
+func gaps(covered []Span, size int64) []Span {
+	sort.Slice(covered, func(i, j int) bool { return covered[i].Offset < covered[j].Offset })
+	var spans []Span
+	var end int64
+	for _, c := range covered {
+		if c.Offset > end {
+			spans = append(spans, Span{Offset: end, Len: c.Offset - end})
+		}
+		if c.Offset+c.Len > end {
+			end = c.Offset + c.Len
+		}
+	}
+	if end < size {
+		spans = append(spans, Span{Offset: end, Len: size - end})
+	}
+	return spans
+}
+
+// SeedChecksums records the spans of chunkFile as they are now, the scrubber checks
+// them from its next pass on. Each read of n bytes waits for throttle(n) and calls
+// the func it returns when done.
+func SeedChecksums(chunkFile string, spans []Span, throttle func(n int) func()) error {
+	f, err := os.Open(chunkFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, checksumPiece)
+	for _, s := range spans {
+		for off := s.Offset; off < s.Offset+s.Len; {
+			n := s.Offset + s.Len - off
+			if n > checksumPiece {
+				n = checksumPiece
+			}
+			done := throttle(int(n))
+			n2, err := f.ReadAt(buf[:n], off)
+			done()
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if n2 == 0 {
+				return nil
+			}
+			if err := AppendChecksum(chunkFile, off, buf[:n2]); err != nil {
+				return err
+			}
+			off += int64(n2)
+		}
+	}
+	return nil
+}
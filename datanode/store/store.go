@@ -0,0 +1,133 @@
+package store
+
+import (
+	"github.com/ipdcode/containerfs/datanode/diskmon"
+	"github.com/ipdcode/containerfs/utils"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Disk one data directory of the datanode
+type Disk struct {
+	Path string
+	Mon  *diskmon.Monitor
+}
+
+// Store spreads the blocks of a datanode over its data directories. A block
+// stays on the disk that got its first chunk, new blocks go to the least
+// utilized healthy disk.
+type Store struct {
+	Disks []*Disk
+
+	mu     sync.RWMutex
+	blocks map[uint32]*Disk
+}
+
+// Open takes the data directories, smartDevs[i] is the device of paths[i] checked with smartctl
+func Open(paths []string, smartDevs []string, maxErrors int) *Store {
+	s := &Store{blocks: make(map[uint32]*Disk)}
+	for i, p := range paths {
+		dev := ""
+		if i < len(smartDevs) {
+			dev = smartDevs[i]
+		}
+		d := &Disk{Path: p, Mon: diskmon.New(p, dev, maxErrors)}
+		s.Disks = append(s.Disks, d)
+		s.scan(d)
+	}
+	return s
+}
+
+// scan maps the blocks already on d
+func (s *Store) scan(d *Disk) {
+	fis, err := ioutil.ReadDir(d.Path)
+	if err != nil {
+		return
+	}
+	for _, fi := range fis {
+		if id, ok := blockID(fi.Name()); ok && fi.IsDir() {
+			s.blocks[id] = d
+		}
+	}
+}
+
+func blockID(name string) (uint32, bool) {
+	if !strings.HasPrefix(name, "block-") {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(name[len("block-"):], 10, 32)
+	return uint32(id), err == nil
+}
+
+func blockDir(d *Disk, blockID uint32) string {
+	return d.Path + "/block-" + strconv.Itoa(int(blockID))
+}
+
+// Block the disk of the block and its dir. An unknown block is looked for on
+// all the disks, repair may have made it, and placed on the least utilized
+// writable disk when create is set; without create the first disk is returned.
+func (s *Store) Block(blockID uint32, create bool) (*Disk, string) {
+	s.mu.RLock()
+	d, ok := s.blocks[blockID]
+	s.mu.RUnlock()
+	if ok {
+		return d, blockDir(d, blockID)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d, ok := s.blocks[blockID]; ok {
+		return d, blockDir(d, blockID)
+	}
+	for _, d := range s.Disks {
+		if fi, err := os.Stat(blockDir(d, blockID)); err == nil && fi.IsDir() {
+			s.blocks[blockID] = d
+			return d, blockDir(d, blockID)
+		}
+	}
+	if !create {
+		return s.Disks[0], blockDir(s.Disks[0], blockID)
+	}
+
+	var best *Disk
+	var bestUsed float64
+	for _, d := range s.Disks {
+		if !d.Mon.Writable() {
+			continue
+		}
+		usage := utils.DiskUsage(d.Path)
+		if usage.All == 0 {
+			continue
+		}
+		used := float64(usage.Used) / float64(usage.All)
+		if best == nil || used < bestUsed {
+			best, bestUsed = d, used
+		}
+	}
+	if best == nil {
+		best = s.Disks[0]
+	}
+	dir := blockDir(best, blockID)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		best.Mon.WriteError(err)
+	} else {
+		s.blocks[blockID] = best
+	}
+	return best, dir
+}
+
+// Blocks the blocks on d
+func (s *Store) Blocks(d *Disk) []uint32 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var ids []uint32
+	for id, bd := range s.blocks {
+		if bd == d {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
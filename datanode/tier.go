@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	vp "github.com/ipdcode/containerfs/proto/vp"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// detectMedia ssd or hdd, from the rotational flag of the device holding path,
+// empty when the device is not found
+func detectMedia(path string) string {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return ""
+	}
+	dev := uint64(st.Dev)
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	sys := fmt.Sprintf("/sys/dev/block/%d:%d", major, minor)
+	b, err := ioutil.ReadFile(sys + "/queue/rotational")
+	if err != nil {
+		// a partition, the flag is on its disk
+		if b, err = ioutil.ReadFile(sys + "/../queue/rotational"); err != nil {
+			return ""
+		}
+	}
+	if strings.TrimSpace(string(b)) == "0" {
+		return "ssd"
+	}
+	return "hdd"
+}
+
+// withMedia adds media=ssd|hdd to the labels the datanode registers with, unless
+// they already tell it
+func withMedia(labels string, media string) string {
+	if media == "" || strings.Contains(","+labels, ",media=") {
+		return labels
+	}
+	if labels == "" {
+		return "media=" + media
+	}
+	return labels + ",media=" + media
+}
+
+// accessLog the chunk ops on each block since the last heartbeat, the volmgr moves
+// the hot blocks of tiered volumes to ssd and the cold ones to hdd
+type accessLog struct {
+	mu  sync.Mutex
+	ops map[uint32]*vp.BlockAccess
+}
+
+// Access ...
+var Access = &accessLog{ops: make(map[uint32]*vp.BlockAccess)}
+
+func (a *accessLog) touch(blockID uint32) {
+	a.mu.Lock()
+	ba, ok := a.ops[blockID]
+	if !ok {
+		ba = &vp.BlockAccess{BlockID: blockID}
+		a.ops[blockID] = ba
+	}
+	ba.Ops++
+	ba.Last = time.Now().Unix()
+	a.mu.Unlock()
+}
+
+// take the ops logged and starts over
+func (a *accessLog) take() []*vp.BlockAccess {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := make([]*vp.BlockAccess, 0, len(a.ops))
+	for _, ba := range a.ops {
+		out = append(out, ba)
+	}
+	a.ops = make(map[uint32]*vp.BlockAccess)
+	return out
+}
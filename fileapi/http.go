@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/ipdcode/containerfs/logger"
+	fp "github.com/ipdcode/containerfs/proto/fp"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// httpHandler the files under /files/<uuid>/<path>:
+//
+//	GET    a file, Range as usual; a dir as a json list of FileInfo
+//	PUT    creates the file with the body, ?append=1 appends it to the file;
+//	       a path ending in / makes the dir
+//	DELETE removes a file or an empty dir
+//
+// with the token of the volume in "Authorization: Bearer <token>"
+type httpHandler struct {
+	vols *volumes
+}
+
+// httpStatus the status of the errno of a request
+var httpStatus = map[int32]int{
+	int32(syscall.EACCES):    http.StatusForbidden,
+	int32(syscall.ENOENT):    http.StatusNotFound,
+	int32(syscall.EEXIST):    http.StatusConflict,
+	int32(syscall.ENOTEMPTY): http.StatusConflict,
+	int32(syscall.EBUSY):     http.StatusConflict,
+	int32(syscall.ENOTDIR):   http.StatusBadRequest,
+	int32(syscall.EISDIR):    http.StatusBadRequest,
+	int32(syscall.EINVAL):    http.StatusBadRequest,
+	int32(syscall.EPERM):     http.StatusBadRequest,
+	int32(syscall.ENOSPC):    http.StatusInsufficientStorage,
+}
+
+func httpError(w http.ResponseWriter, err error) {
+	ret := errno(err)
+	status, ok := httpStatus[ret]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	if err == errNoToken {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		status = http.StatusUnauthorized
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/files/") {
+		http.NotFound(w, r)
+		return
+	}
+	parts := strings.SplitN(r.URL.Path[len("/files/"):], "/", 2)
+	volID, path := parts[0], ""
+	if len(parts) == 2 {
+		path = parts[1]
+	}
+	fsys, err := h.vols.get(volID, bearer(r.Header.Get("Authorization")))
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		fi, err := fsys.Stat(name(path))
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		if fi.IsDir() {
+			entries, err := fsys.ReadDir(name(path))
+			if err != nil {
+				httpError(w, err)
+				return
+			}
+			list := make([]*fp.FileInfo, 0, len(entries))
+			for _, e := range entries {
+				if info, err := e.Info(); err == nil {
+					list = append(list, fileInfo(info))
+				} else {
+					list = append(list, &fp.FileInfo{Name: e.Name(), Dir: e.IsDir()})
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(list)
+			return
+		}
+		f, err := fsys.OpenFile(name(path), os.O_RDONLY, 0)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		defer f.Close()
+		http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+
+	case "PUT":
+		if strings.HasSuffix(path, "/") {
+			if err := fsys.Mkdir(name(path)); err != nil {
+				httpError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		flag := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		if r.URL.Query().Get("append") == "1" {
+			flag = os.O_WRONLY | os.O_APPEND
+		}
+		f, err := fsys.OpenFile(name(path), flag, 0644)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		_, err = io.Copy(f, r.Body)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			logger.Error("put %v/%v err:%v", volID, path, err)
+			httpError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+
+	case "DELETE":
+		if err := fsys.Remove(name(path)); err != nil {
+			httpError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,208 @@
+// Command fileapi serves the files of ContainerFS volumes over gRPC (proto/fp)
+// and HTTP, for containers that cannot take a privileged fuse mount: a sidecar
+// in the pod talks to it instead. It reads and writes through libcfs, so the
+// files follow its rules, writes append at the end of the file.
+//
+// Each volume served has a token in the volumes key, a request for a volume
+// must carry it as "authorization: Bearer <token>".
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/ipdcode/containerfs/libcfs"
+	"github.com/ipdcode/containerfs/logger"
+	fp "github.com/ipdcode/containerfs/proto/fp"
+	"github.com/ipdcode/containerfs/utils"
+	"github.com/lxmgo/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
+	iofs "io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// errors of the requests, as errno in the Ret of the acks
+var (
+	errNoToken  = errors.New("no token")
+	errBadToken = errors.New("wrong token")
+)
+
+// volumes the volumes served and their tokens
+type volumes struct {
+	cfg    libcfs.Config
+	tokens map[string]string
+
+	mu   sync.Mutex
+	open map[string]*libcfs.FS
+}
+
+// parseVolumes the uuid:token entries of the volumes key
+func parseVolumes(entries []string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, e := range entries {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		kv := strings.SplitN(e, ":", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("wrong volume %v, use uuid:token", e)
+		}
+		tokens[kv[0]] = kv[1]
+	}
+	return tokens, nil
+}
+
+// bearer the token of an authorization value
+func bearer(auth string) string {
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	return ""
+}
+
+// get the volume volID when token is its token, opened on first use
+func (v *volumes) get(volID string, token string) (*libcfs.FS, error) {
+	want, ok := v.tokens[volID]
+	if !ok {
+		return nil, &iofs.PathError{Op: "open", Path: volID, Err: iofs.ErrNotExist}
+	}
+	if token == "" {
+		return nil, errNoToken
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+		return nil, errBadToken
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if fsys, ok := v.open[volID]; ok {
+		return fsys, nil
+	}
+	fsys, err := libcfs.Open(volID, v.cfg)
+	if err != nil {
+		return nil, err
+	}
+	v.open[volID] = fsys
+	return fsys, nil
+}
+
+// errno the Ret of err
+func errno(err error) int32 {
+	var en syscall.Errno
+	switch {
+	case err == nil:
+		return 0
+	case err == errNoToken, err == errBadToken:
+		return int32(syscall.EACCES)
+	case errors.As(err, &en):
+		return int32(en)
+	case errors.Is(err, iofs.ErrNotExist):
+		return int32(syscall.ENOENT)
+	case errors.Is(err, iofs.ErrExist):
+		return int32(syscall.EEXIST)
+	case errors.Is(err, iofs.ErrInvalid), errors.Is(err, libcfs.ErrNotAppend):
+		return int32(syscall.EINVAL)
+	case errors.Is(err, iofs.ErrClosed):
+		return int32(syscall.EBADF)
+	}
+	return int32(syscall.EIO)
+}
+
+// name the libcfs name of a request path, "/a/b" -> "a/b", "/" -> "."
+func name(path string) string {
+	n := strings.Trim(path, "/")
+	if n == "" {
+		return "."
+	}
+	return n
+}
+
+func fileInfo(fi iofs.FileInfo) *fp.FileInfo {
+	return &fp.FileInfo{Name: fi.Name(), Dir: fi.IsDir(), Size: fi.Size(), MTime: fi.ModTime().Unix()}
+}
+
+func main() {
+
+	if len(os.Args) < 2 {
+		fmt.Println("cfs-fileapi [ini]")
+		os.Exit(1)
+	}
+	c, err := config.NewConfig(os.Args[1])
+	if err != nil {
+		fmt.Println("NewConfig err")
+		os.Exit(1)
+	}
+	utils.ConfigEnv(c)
+
+	logger.SetConsole(true)
+	logger.SetRollingFile(c.String("log"), "fileapi.log", 10, 100, logger.MB) //each 100M rolling
+	switch level := c.String("loglevel"); level {
+	case "error":
+		logger.SetLevel(logger.ERROR)
+	case "debug":
+		logger.SetLevel(logger.DEBUG)
+	case "info":
+		logger.SetLevel(logger.INFO)
+	default:
+		logger.SetLevel(logger.ERROR)
+	}
+	if err := logger.Configure(c.String("logformat"), c.String("logoutput"), c.String("logmodules"), "cfs-fileapi"); err != nil {
+		fmt.Println("log config err:", err)
+		os.Exit(1)
+	}
+
+	tokens, err := parseVolumes(c.Strings("volumes"))
+	if err != nil || len(tokens) == 0 {
+		fmt.Println("no volumes to serve:", err)
+		os.Exit(1)
+	}
+	vols := &volumes{
+		cfg:    libcfs.Config{VolMgr: c.String("volmgr"), MetaNodes: c.Strings("metanode")},
+		tokens: tokens,
+		open:   make(map[string]*libcfs.FS),
+	}
+
+	idle := 10 * time.Minute
+	if n, err := c.Int("handle_idle_secs"); err == nil && n > 0 {
+		idle = time.Duration(n) * time.Second
+	}
+	srv := newServer(vols)
+	go srv.reapIdle(idle)
+
+	if addr := c.String("debug_addr"); addr != "" {
+		if err := utils.ServeDebug(addr, func() map[string]int64 {
+			return map[string]int64{"open_handles": int64(srv.handleCount())}
+		}); err != nil {
+			logger.Error("debug server err:%v", err)
+		}
+	}
+
+	if port := c.String("http_port"); port != "" {
+		go func() {
+			h := &httpHandler{vols: vols}
+			if err := http.ListenAndServe(c.String("host")+":"+port, h); err != nil {
+				logger.Error("http server err:%v", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	lis, err := net.Listen("tcp", c.String("host")+":"+c.String("port"))
+	if err != nil {
+		logger.Error("failed to listen: %v", err)
+		os.Exit(1)
+	}
+	s := grpc.NewServer()
+	fp.RegisterFileApiServer(s, srv)
+	// Register reflection service on gRPC server.
+	reflection.Register(s)
+	if err := s.Serve(utils.CountConns(lis)); err != nil {
+		logger.Error("failed to serve: %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"github.com/ipdcode/containerfs/libcfs"
+	"github.com/ipdcode/containerfs/logger"
+	fp "github.com/ipdcode/containerfs/proto/fp"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxRead the most bytes a Read returns, under the message size of grpc
+const maxRead = 1024 * 1024
+
+// handle a file opened by Open, until Close or idle for too long
+type handle struct {
+	volID string
+	mu    sync.Mutex
+	f     *libcfs.File
+	used  time.Time
+}
+
+// server the FileApi service
+type server struct {
+	vols *volumes
+
+	mu      sync.Mutex
+	nextFd  uint64
+	handles map[uint64]*handle
+}
+
+func newServer(vols *volumes) *server {
+	return &server{vols: vols, handles: make(map[uint64]*handle)}
+}
+
+// token the bearer token of the authorization metadata of ctx
+func token(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	for _, v := range md["authorization"] {
+		if t := bearer(v); t != "" {
+			return t
+		}
+	}
+	return ""
+}
+
+// handle the open file fd, the caller must carry the token of its volume
+func (s *server) handle(ctx context.Context, fd uint64) (*handle, int32) {
+	s.mu.Lock()
+	h, ok := s.handles[fd]
+	s.mu.Unlock()
+	if !ok {
+		return nil, int32(syscall.EBADF)
+	}
+	if _, err := s.vols.get(h.volID, token(ctx)); err != nil {
+		return nil, errno(err)
+	}
+	return h, 0
+}
+
+func (s *server) handleCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.handles)
+}
+
+// reapIdle closes the handles left open for idle, by sidecars gone without Close
+func (s *server) reapIdle(idle time.Duration) {
+	for range time.Tick(idle / 2) {
+		var stale []*handle
+		s.mu.Lock()
+		for fd, h := range s.handles {
+			h.mu.Lock()
+			if time.Since(h.used) > idle {
+				stale = append(stale, h)
+				delete(s.handles, fd)
+			}
+			h.mu.Unlock()
+		}
+		s.mu.Unlock()
+		for _, h := range stale {
+			h.mu.Lock()
+			if err := h.f.Close(); err != nil {
+				logger.Error("close idle %v err:%v", h.f.Name(), err)
+			}
+			h.mu.Unlock()
+		}
+	}
+}
+
+// Open ...
+func (s *server) Open(ctx context.Context, in *fp.OpenReq) (*fp.OpenAck, error) {
+	ack := fp.OpenAck{}
+	fsys, err := s.vols.get(in.VolID, token(ctx))
+	if err != nil {
+		ack.Ret = errno(err)
+		return &ack, nil
+	}
+	f, err := fsys.OpenFile(name(in.Path), int(in.Flags)&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_EXCL|os.O_APPEND), 0644)
+	if err != nil {
+		ack.Ret = errno(err)
+		return &ack, nil
+	}
+	if fi, err := f.Stat(); err == nil {
+		ack.Size = fi.Size()
+	}
+	s.mu.Lock()
+	s.nextFd++
+	ack.Fd = s.nextFd
+	s.handles[ack.Fd] = &handle{volID: in.VolID, f: f, used: time.Now()}
+	s.mu.Unlock()
+	return &ack, nil
+}
+
+// Read ...
+func (s *server) Read(ctx context.Context, in *fp.ReadReq) (*fp.ReadAck, error) {
+	ack := fp.ReadAck{}
+	h, ret := s.handle(ctx, in.Fd)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	size := in.Size
+	if size > maxRead {
+		size = maxRead
+	}
+	if size < 0 {
+		ack.Ret = int32(syscall.EINVAL)
+		return &ack, nil
+	}
+	buf := make([]byte, size)
+	h.mu.Lock()
+	h.used = time.Now()
+	n, err := h.f.ReadAt(buf, in.Offset)
+	h.mu.Unlock()
+	ack.Data = buf[:n]
+	if err == io.EOF {
+		ack.EOF = true
+	} else if err != nil {
+		logger.Error("read %v at %v err:%v", h.f.Name(), in.Offset, err)
+		ack.Ret = errno(err)
+	}
+	return &ack, nil
+}
+
+// Write ...
+func (s *server) Write(ctx context.Context, in *fp.WriteReq) (*fp.WriteAck, error) {
+	ack := fp.WriteAck{}
+	h, ret := s.handle(ctx, in.Fd)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	h.mu.Lock()
+	h.used = time.Now()
+	_, err := h.f.WriteAt(in.Data, in.Offset)
+	h.mu.Unlock()
+	if err != nil {
+		logger.Error("write %v at %v err:%v", h.f.Name(), in.Offset, err)
+		ack.Ret = errno(err)
+	}
+	return &ack, nil
+}
+
+// Close flushes a written file
+func (s *server) Close(ctx context.Context, in *fp.CloseReq) (*fp.CloseAck, error) {
+	ack := fp.CloseAck{}
+	h, ret := s.handle(ctx, in.Fd)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	s.mu.Lock()
+	delete(s.handles, in.Fd)
+	s.mu.Unlock()
+	h.mu.Lock()
+	ack.Ret = errno(h.f.Close())
+	h.mu.Unlock()
+	return &ack, nil
+}
+
+// Stat ...
+func (s *server) Stat(ctx context.Context, in *fp.StatReq) (*fp.StatAck, error) {
+	ack := fp.StatAck{}
+	fsys, err := s.vols.get(in.VolID, token(ctx))
+	if err != nil {
+		ack.Ret = errno(err)
+		return &ack, nil
+	}
+	fi, err := fsys.Stat(name(in.Path))
+	if err != nil {
+		ack.Ret = errno(err)
+		return &ack, nil
+	}
+	ack.Info = fileInfo(fi)
+	return &ack, nil
+}
+
+// List the entries of a dir in name order
+func (s *server) List(ctx context.Context, in *fp.ListReq) (*fp.ListAck, error) {
+	ack := fp.ListAck{}
+	fsys, err := s.vols.get(in.VolID, token(ctx))
+	if err != nil {
+		ack.Ret = errno(err)
+		return &ack, nil
+	}
+	entries, err := fsys.ReadDir(name(in.Path))
+	if err != nil {
+		ack.Ret = errno(err)
+		return &ack, nil
+	}
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			ack.Entries = append(ack.Entries, &fp.FileInfo{Name: e.Name(), Dir: e.IsDir()})
+			continue
+		}
+		ack.Entries = append(ack.Entries, fileInfo(fi))
+	}
+	return &ack, nil
+}
+
+// Mkdir ...
+func (s *server) Mkdir(ctx context.Context, in *fp.MkdirReq) (*fp.MkdirAck, error) {
+	ack := fp.MkdirAck{}
+	fsys, err := s.vols.get(in.VolID, token(ctx))
+	if err == nil {
+		err = fsys.Mkdir(name(in.Path))
+	}
+	ack.Ret = errno(err)
+	return &ack, nil
+}
+
+// Remove a file or an empty dir
+func (s *server) Remove(ctx context.Context, in *fp.RemoveReq) (*fp.RemoveAck, error) {
+	ack := fp.RemoveAck{}
+	fsys, err := s.vols.get(in.VolID, token(ctx))
+	if err == nil {
+		err = fsys.Remove(name(in.Path))
+	}
+	ack.Ret = errno(err)
+	return &ack, nil
+}
@@ -0,0 +1,105 @@
+package cfs
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	vp "github.com/ipdcode/containerfs/proto/vp"
+	"golang.org/x/net/context"
+	"os"
+	"sync"
+	"time"
+)
+
+// the mounts registered with volmgr, their heartbeats keep them alive
+var registeredMounts = make(map[string]*vp.RegisterMountReq)
+var registeredMountsMutex sync.Mutex
+
+// RegisterMount registers the mount of the volume by ClientID with volmgr, which
+// checks it against the access mode of the volume: 30 EROFS a read-write mount of
+// a ROX volume, 16 EBUSY another host mounts the RWO volume read-write, holder
+// tells which. 11 EAGAIN volmgr just restarted and waits for the mounts to heartbeat.
+func RegisterMount(volID string, mountPoint string, readOnly bool) (int32, string) {
+	host, _ := os.Hostname()
+	pRegisterMountReq := &vp.RegisterMountReq{
+		VolID:      volID,
+		ClientID:   ClientID,
+		Host:       host,
+		MountPoint: mountPoint,
+		ReadOnly:   readOnly,
+	}
+	conn, err := DialVolmgr(VolMgrAddr)
+	if err != nil {
+		logger.Error("RegisterMount failed,Dial to volmgr fail :%v", err)
+		return -1, ""
+	}
+	defer conn.Close()
+	vc := vp.NewVolMgrClient(conn)
+	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	pRegisterMountAck, err := vc.RegisterMount(ctx, pRegisterMountReq)
+	if err != nil {
+		logger.Error("RegisterMount failed,grpc func err :%v", err)
+		return -1, ""
+	}
+	if pRegisterMountAck.Ret != 0 {
+		return pRegisterMountAck.Ret, pRegisterMountAck.Holder
+	}
+	registeredMountsMutex.Lock()
+	registeredMounts[volID] = pRegisterMountReq
+	registeredMountsMutex.Unlock()
+	return 0, ""
+}
+
+// UnregisterMount frees the registration of the mount of the volume at unmount
+func UnregisterMount(volID string) int32 {
+	registeredMountsMutex.Lock()
+	delete(registeredMounts, volID)
+	registeredMountsMutex.Unlock()
+
+	conn, err := DialVolmgr(VolMgrAddr)
+	if err != nil {
+		logger.Error("UnregisterMount failed,Dial to volmgr fail :%v", err)
+		return -1
+	}
+	defer conn.Close()
+	vc := vp.NewVolMgrClient(conn)
+	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	pUnregisterMountAck, err := vc.UnregisterMount(ctx, &vp.UnregisterMountReq{VolID: volID, ClientID: ClientID})
+	if err != nil {
+		logger.Error("UnregisterMount failed,grpc func err :%v", err)
+		return -1
+	}
+	return pUnregisterMountAck.Ret
+}
+
+// registeredMount the registration of the mount of volID for its heartbeats, nil when none
+func registeredMount(volID string) *vp.RegisterMountReq {
+	registeredMountsMutex.Lock()
+	defer registeredMountsMutex.Unlock()
+	return registeredMounts[volID]
+}
+
+// SetVolAccessMode : RWO one host mounts the volume read-write, ROX read-only mounts
+// only, RWX any. Checked when the clients mount, EBUSY when the mounts there do not fit
+func SetVolAccessMode(uuid string, mode string) int32 {
+	conn, err := DialVolmgr(VolMgrAddr)
+	if err != nil {
+		logger.Error("SetVolAccessMode failed,Dial to volmgr fail :%v", err)
+		return -1
+	}
+	defer conn.Close()
+	vc := vp.NewVolMgrClient(conn)
+	pSetVolAccessModeReq := &vp.SetVolAccessModeReq{
+		UUID:       uuid,
+		AccessMode: mode,
+	}
+	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	pSetVolAccessModeAck, err := vc.SetVolAccessMode(ctx, pSetVolAccessModeReq)
+	if err != nil {
+		logger.Error("SetVolAccessMode failed,grpc func err :%v", err)
+		return -1
+	}
+	if pSetVolAccessModeAck.Ret != 0 {
+		logger.Error("SetVolAccessMode failed,grpc func ret :%v", pSetVolAccessModeAck.Ret)
+		return pSetVolAccessModeAck.Ret
+	}
+	return 0
+}
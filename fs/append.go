@@ -0,0 +1,141 @@
+package cfs
+
+import (
+	"bytes"
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"golang.org/x/net/context"
+	"os"
+)
+
+// A file opened with O_APPEND does not write at its own idea of the end: the
+// buffered writes go to a chunk allocated detached from the file, and once the
+// replicas have it the metanode links the chunk after whatever other appenders
+// committed meanwhile. Each write() is kept whole inside one chunk so it lands
+// contiguous at the end of the file.
+
+// setAppend switches a file opened with O_APPEND to committed appends, inline data is promoted first
+func (cfile *CFile) setAppend(flags int) int32 {
+	if flags&os.O_APPEND == 0 || cfile.appendMode {
+		return 0
+	}
+	if cfile.inlineMode || len(cfile.inline) > 0 {
+		if ret := cfile.promoteInline(); ret != 0 {
+			return ret
+		}
+		if ret := cfile.Flush(); ret != 0 {
+			return ret
+		}
+	}
+	cfile.appendMode = true
+	return 0
+}
+
+// Appending true when the writes are appends placed by the metanode
+func (cfile *CFile) Appending() bool {
+	return cfile.appendMode
+}
+
+// appendWrite buffers buf as one append, committing the buffer first when buf does not fit
+func (cfile *CFile) appendWrite(buf []byte) int32 {
+	if cfile.appendBuf == nil {
+		cfile.appendBuf = new(bytes.Buffer)
+	}
+	if cfile.appendBuf.Len() > 0 && cfile.appendBuf.Len()+len(buf) > int(cfile.bufSize) {
+		if ret := cfile.flushAppend(); ret != 0 {
+			return ret
+		}
+		cfile.appendBuf = new(bytes.Buffer)
+	}
+	cfile.appendBuf.Write(buf)
+	cfile.FileSize += int64(len(buf))
+
+	if cfile.appendBuf.Len() >= int(cfile.bufSize) || cfile.syncWrite() {
+		if ret := cfile.flushAppend(); ret != 0 {
+			return ret
+		}
+	}
+	return int32(len(buf))
+}
+
+// flushAppend writes the buffered appends to a new chunk and commits it at the end of the file
+func (cfile *CFile) flushAppend() int32 {
+	data := cfile.appendBuf
+	if data == nil || data.Len() == 0 {
+		return 0
+	}
+	cfile.appendBuf = nil
+	size := int32(data.Len())
+
+	ret, chunkInfo := cfile.allocateChunk(true)
+	if ret != 0 {
+		cfile.Status = -2
+		if ret == 28 /*ENOSPC*/ {
+			cfile.Status = -1
+		}
+		return cfile.Status
+	}
+	chunkInfo.ChunkSize = size
+
+	v := &wBuffer{
+		buffer:    data,
+		chunkInfo: chunkInfo,
+		size:      size,
+	}
+	if ret := cfile.writeReplicas(&cfile.appendPipe, v); ret != 0 {
+		cfile.Status = -2
+		return cfile.Status
+	}
+
+	var tmpChunkInfo mp.ChunkInfo
+	tmpChunkInfo.ChunkSize = size
+	tmpChunkInfo.ChunkID = chunkInfo.ChunkID
+	tmpChunkInfo.BlockGroupID = chunkInfo.BlockGroup.BlockGroupID
+	tmpChunkInfo.Status = cfile.appendPipe.status()
+
+	pCommitAppendReq := &mp.CommitAppendReq{
+		ParentInodeID: cfile.ParentInodeID,
+		Name:          cfile.Name,
+		ChunkInfo:     &tmpChunkInfo,
+	}
+	var offset int64
+	ret, err := cfile.cfs.retryShard(cfile.ParentInodeID, false, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pCommitAppendReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfile.cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.CommitAppend(ctx, pCommitAppendReq)
+		if err != nil {
+			return -1, err
+		}
+		offset = ack.Offset
+		return ack.Ret, nil
+	})
+	if err != nil || ret != 0 {
+		logger.Error("CommitAppend %v chunk %v failed, ret:%v err:%v", cfile.Name, chunkInfo.ChunkID, ret, err)
+		cfile.Status = -2
+		return cfile.Status
+	}
+
+	chunkInfo.Status = tmpChunkInfo.Status
+	cfile.RMutex.Lock()
+	var local int64
+	for _, c := range cfile.chunks {
+		local += int64(c.ChunkSize)
+	}
+	if local == offset {
+		cfile.chunks = append(cfile.chunks, chunkInfo)
+		cfile.RMutex.Unlock()
+	} else {
+		// other clients appended in between
+		cfile.RMutex.Unlock()
+		if ret := cfile.Refresh(); ret != 0 {
+			logger.Error("Refresh %v after append ret:%v", cfile.Name, ret)
+		}
+	}
+
+	pending := int64(0)
+	if cfile.appendBuf != nil {
+		pending = int64(cfile.appendBuf.Len())
+	}
+	cfile.FileSize = offset + int64(size) + pending
+	return 0
+}
@@ -0,0 +1,100 @@
+package cfs
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"golang.org/x/net/context"
+	"sync"
+	"time"
+)
+
+// SetAccessTimes of the files in names of the dir pinode, times in unix seconds,
+// BatchSize files per rpc. The metanode only moves an access time forward.
+func (cfs *CFS) SetAccessTimes(pinode uint64, names []string, times []int64) int32 {
+	for len(names) > 0 {
+		n := len(names)
+		if n > BatchSize {
+			n = BatchSize
+		}
+		pSetAccessTimesReq := &mp.SetAccessTimesReq{
+			PInode: pinode,
+			Names:  names[:n],
+			Times:  times[:n],
+		}
+		ret, err := cfs.retryShard(pinode, true, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+			pSetAccessTimesReq.VolID = volID
+			ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+			ack, err := mc.SetAccessTimes(ctx, pSetAccessTimesReq)
+			if err != nil {
+				return -1, err
+			}
+			return ack.Ret, nil
+		})
+		if err != nil {
+			logger.Error("SetAccessTimes failed,grpc func err :%v", err)
+			return -1
+		}
+		if ret != 0 {
+			return ret
+		}
+		names, times = names[n:], times[n:]
+	}
+	return 0
+}
+
+// the access times waiting for FlushAccessTimes, per volume and dir
+var accessTimes = struct {
+	sync.Mutex
+	m map[*CFS]map[uint64]map[string]int64
+}{m: make(map[*CFS]map[uint64]map[string]int64)}
+
+// QueueAccessTime keeps the access time of the file name of the dir pinode for the
+// next FlushAccessTimes, the files of a dir go in one rpc
+func (cfs *CFS) QueueAccessTime(pinode uint64, name string, t int64) {
+	accessTimes.Lock()
+	defer accessTimes.Unlock()
+	dirs, ok := accessTimes.m[cfs]
+	if !ok {
+		dirs = make(map[uint64]map[string]int64)
+		accessTimes.m[cfs] = dirs
+	}
+	files, ok := dirs[pinode]
+	if !ok {
+		files = make(map[string]int64)
+		dirs[pinode] = files
+	}
+	if t > files[name] {
+		files[name] = t
+	}
+}
+
+// FlushAccessTimes sets the queued access times, the ones failing are dropped
+func FlushAccessTimes() {
+	accessTimes.Lock()
+	queued := accessTimes.m
+	accessTimes.m = make(map[*CFS]map[uint64]map[string]int64)
+	accessTimes.Unlock()
+
+	for cfs, dirs := range queued {
+		for pinode, files := range dirs {
+			names := make([]string, 0, len(files))
+			times := make([]int64, 0, len(files))
+			for name, t := range files {
+				names = append(names, name)
+				times = append(times, t)
+			}
+			if ret := cfs.SetAccessTimes(pinode, names, times); ret != 0 {
+				logger.Error("SetAccessTimes of %v files in dir %v ret:%v", len(names), pinode, ret)
+			}
+		}
+	}
+}
+
+// StartAccessTimeFlusher runs FlushAccessTimes every interval
+func StartAccessTimeFlusher(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			FlushAccessTimes()
+		}
+	}()
+}
@@ -0,0 +1,123 @@
+package cfs
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"golang.org/x/net/context"
+	"time"
+)
+
+// BatchSize entries sent to the metanode per batch op, the metanodes take up to 1024
+var BatchSize = 1024
+
+// BatchCreate creates files and dirs in the dir pinode with one rpc per BatchSize
+// entries, the results are in the order of entries. A result has ret 17 when its
+// name exists. ret is the first failed rpc, the entries after it are not created.
+func (cfs *CFS) BatchCreate(pinode uint64, entries []*mp.BatchEntry) (int32, []*mp.BatchCreateResult) {
+	var results []*mp.BatchCreateResult
+	for len(entries) > 0 {
+		n := len(entries)
+		if n > BatchSize {
+			n = BatchSize
+		}
+		var pBatchCreateAck *mp.BatchCreateAck
+		pBatchCreateReq := &mp.BatchCreateReq{
+			PInode:  pinode,
+			Entries: entries[:n],
+		}
+		ret, err := cfs.retryShard(pinode, false, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+			pBatchCreateReq.VolID = volID
+			ctx, _ := context.WithTimeout(cfs.callCtx(), 30*time.Second)
+			ack, err := mc.BatchCreate(ctx, pBatchCreateReq)
+			if err != nil {
+				return -1, err
+			}
+			pBatchCreateAck = ack
+			return ack.Ret, nil
+		})
+		if err != nil {
+			logger.Error("BatchCreate failed,grpc func err :%v\n", err)
+			return -1, results
+		}
+		if ret != 0 {
+			return ret, results
+		}
+		results = append(results, pBatchCreateAck.Results...)
+		entries = entries[n:]
+	}
+	return 0, results
+}
+
+// BatchStat the dentries and inodes of names in the dir pinode, a result has ret 2
+// when its name is missing
+func (cfs *CFS) BatchStat(pinode uint64, names []string) (int32, []*mp.BatchStatResult) {
+	var results []*mp.BatchStatResult
+	for len(names) > 0 {
+		n := len(names)
+		if n > BatchSize {
+			n = BatchSize
+		}
+		var pBatchStatAck *mp.BatchStatAck
+		pBatchStatReq := &mp.BatchStatReq{
+			PInode: pinode,
+			Names:  names[:n],
+		}
+		ret, err := cfs.retryShard(pinode, true, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+			pBatchStatReq.VolID = volID
+			ctx, _ := context.WithTimeout(cfs.callCtx(), 30*time.Second)
+			ack, err := mc.BatchStat(ctx, pBatchStatReq)
+			if err != nil {
+				return -1, err
+			}
+			pBatchStatAck = ack
+			return ack.Ret, nil
+		})
+		if err != nil {
+			logger.Error("BatchStat failed,grpc func err :%v\n", err)
+			return -1, results
+		}
+		if ret != 0 {
+			return ret, results
+		}
+		results = append(results, pBatchStatAck.Results...)
+		names = names[n:]
+	}
+	return 0, results
+}
+
+// BatchUnlink removes files of the dir pinode, the rets are in the order of names,
+// 21 for a dir. The metanode deletes the chunks of the removed files in the background.
+func (cfs *CFS) BatchUnlink(pinode uint64, names []string) (int32, []int32) {
+	var rets []int32
+	for len(names) > 0 {
+		n := len(names)
+		if n > BatchSize {
+			n = BatchSize
+		}
+		var pBatchUnlinkAck *mp.BatchUnlinkAck
+		pBatchUnlinkReq := &mp.BatchUnlinkReq{
+			PInode: pinode,
+			Names:  names[:n],
+		}
+		ret, err := cfs.retryShard(pinode, false, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+			pBatchUnlinkReq.VolID = volID
+			ctx, _ := context.WithTimeout(cfs.callCtx(), 30*time.Second)
+			ack, err := mc.BatchUnlink(ctx, pBatchUnlinkReq)
+			if err != nil {
+				return -1, err
+			}
+			pBatchUnlinkAck = ack
+			return ack.Ret, nil
+		})
+		if err != nil {
+			logger.Error("BatchUnlink failed,grpc func err :%v\n", err)
+			return -1, rets
+		}
+		if ret != 0 {
+			return ret, rets
+		}
+		rets = append(rets, pBatchUnlinkAck.Rets...)
+		names = names[n:]
+	}
+	return 0, rets
+}
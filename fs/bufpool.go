@@ -0,0 +1,31 @@
+package cfs
+
+import (
+	"bytes"
+	"sync"
+)
+
+// chunkBufPool buffers for the read path, a chunk read from a datanode lands in
+// one of them and it goes back once the reader consumed it. A buffer is grown to
+// the bytes read of its chunk, up to chunkSize.
+var chunkBufPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func getChunkBuf(size int64) *bytes.Buffer {
+	b := chunkBufPool.Get().(*bytes.Buffer)
+	b.Reset()
+	b.Grow(int(size))
+	return b
+}
+
+func putChunkBuf(b *bytes.Buffer) {
+	if b == nil || b.Cap() == 0 {
+		return
+	}
+	// a stream longer than its chunk grew the buffer past any read to come
+	if b.Cap() > 2*chunkSize {
+		return
+	}
+	chunkBufPool.Put(b)
+}
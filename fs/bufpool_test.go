@@ -0,0 +1,32 @@
+package cfs
+
+import (
+	"bytes"
+	"testing"
+)
+
+// the bytes of a read of a chunk, as streamread gets them from a datanode
+const benchReadSize = 4 << 20
+
+var benchData = make([]byte, benchReadSize)
+
+// BenchmarkChunkBufPool a chunk read into a pooled buffer, as streamread does
+func BenchmarkChunkBufPool(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(benchReadSize)
+	for i := 0; i < b.N; i++ {
+		buf := getChunkBuf(benchReadSize)
+		buf.Write(benchData)
+		putChunkBuf(buf)
+	}
+}
+
+// BenchmarkChunkBufAlloc a chunk read into a new buffer, as before the pool
+func BenchmarkChunkBufAlloc(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(benchReadSize)
+	for i := 0; i < b.N; i++ {
+		buf := new(bytes.Buffer)
+		buf.Write(benchData)
+	}
+}
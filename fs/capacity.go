@@ -0,0 +1,81 @@
+package cfs
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	vp "github.com/ipdcode/containerfs/proto/vp"
+	"golang.org/x/net/context"
+	"sync"
+	"time"
+)
+
+// capacity states of a volume, see SetVolCapacityLimits
+const (
+	CapacityOK   = 0
+	CapacitySoft = 1 // over the soft limit
+	CapacityHard = 2 // over the hard limit, writes fail with ENOSPC
+)
+
+// the last capacity state seen per volume, warned about when it changes
+var capacityStates = make(map[string]int)
+var capacityStatesMutex sync.Mutex
+
+// CheckCapacity the capacity state of the volume and its percent of space used,
+// logged as a warning when it goes over a limit and back
+func CheckCapacity(volID string) (int, int64) {
+	ret, info := GetFSInfo(volID)
+	if ret != 0 || info.TotalSpace == 0 {
+		return CapacityOK, 0
+	}
+	used := int64((info.TotalSpace - info.FreeSpace) * 100 / info.TotalSpace)
+	state := CapacityOK
+	switch {
+	case info.HardLimit > 0 && used >= int64(info.HardLimit):
+		state = CapacityHard
+	case info.SoftLimit > 0 && used >= int64(info.SoftLimit):
+		state = CapacitySoft
+	}
+
+	capacityStatesMutex.Lock()
+	last := capacityStates[volID]
+	capacityStates[volID] = state
+	capacityStatesMutex.Unlock()
+	if state != last {
+		switch state {
+		case CapacityOK:
+			logger.Info("volume %v %v%% used, back under its capacity limits", volID, used)
+		case CapacitySoft:
+			logger.Warn("volume %v %v%% used, over its soft limit %v%%", volID, used, info.SoftLimit)
+		case CapacityHard:
+			logger.Error("volume %v %v%% used, over its hard limit %v%%: writes fail with ENOSPC until files are deleted", volID, used, info.HardLimit)
+		}
+	}
+	return state, used
+}
+
+// SetVolCapacityLimits : the soft and hard limits of the volume in percent of its
+// space used, 0 for none
+func SetVolCapacityLimits(uuid string, soft int32, hard int32) int32 {
+	conn, err := DialVolmgr(VolMgrAddr)
+	if err != nil {
+		logger.Error("SetVolCapacityLimits failed,Dial to volmgr fail :%v", err)
+		return -1
+	}
+	defer conn.Close()
+	vc := vp.NewVolMgrClient(conn)
+	pSetVolCapacityLimitsReq := &vp.SetVolCapacityLimitsReq{
+		UUID: uuid,
+		Soft: soft,
+		Hard: hard,
+	}
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	pSetVolCapacityLimitsAck, err := vc.SetVolCapacityLimits(ctx, pSetVolCapacityLimitsReq)
+	if err != nil {
+		logger.Error("SetVolCapacityLimits failed,grpc func err :%v", err)
+		return -1
+	}
+	if pSetVolCapacityLimitsAck.Ret != 0 {
+		logger.Error("SetVolCapacityLimits failed,grpc func ret :%v", pSetVolCapacityLimitsAck.Ret)
+		return pSetVolCapacityLimitsAck.Ret
+	}
+	return 0
+}
@@ -0,0 +1,138 @@
+package cfs
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"golang.org/x/net/context"
+	"time"
+)
+
+// kinds of mp.ChangeEvent.Op, the same as in the metanode namespace
+const (
+	ChangeWrite  = 1
+	ChangeCreate = 2
+	ChangeRemove = 3
+	ChangeRename = 4
+	// ChangeCloseWrite a client closed the last handle it wrote the file through
+	ChangeCloseWrite = 5
+)
+
+// WatchOptions narrows the changes a watcher gets
+type WatchOptions struct {
+	Subtree uint64 // dir inode, 0 is the root
+	Direct  bool   // only the entries of Subtree, not those further below
+}
+
+// WatchChanges calls fn with each namespace change of the volume pushed by the
+// metanode leader. The stream breaks when the leader changes or the client falls
+// behind, then fn gets nil after reconnecting as changes may have been missed.
+// It never returns.
+func WatchChanges(volumeID string, fn func(ev *mp.ChangeEvent)) {
+	watchLoop(context.Background(), volumeID, WatchOptions{}, fn)
+}
+
+// Watch is WatchChanges for the changes below opts.Subtree, for sync daemons and
+// indexers that would rescan otherwise. fn runs in its own goroutine until stop.
+func Watch(volumeID string, opts WatchOptions, fn func(ev *mp.ChangeEvent)) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go watchLoop(ctx, volumeID, opts, fn)
+	return cancel
+}
+
+func watchLoop(ctx context.Context, volumeID string, opts WatchOptions, fn func(ev *mp.ChangeEvent)) {
+	for connected := false; ctx.Err() == nil; {
+		if watchChanges(ctx, volumeID, opts, fn, connected) {
+			connected = true
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(300 * time.Millisecond):
+		}
+	}
+}
+
+// watchChanges follows one stream, true once it was established
+func watchChanges(ctx context.Context, volumeID string, opts WatchOptions, fn func(ev *mp.ChangeEvent), reconnect bool) bool {
+	conn, err := DialMeta(volumeID)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	mc := mp.NewMetaNodeClient(conn)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pWatchChangesReq := &mp.WatchChangesReq{
+		VolID:   volumeID,
+		Subtree: opts.Subtree,
+		Direct:  opts.Direct,
+	}
+	stream, err := mc.WatchChanges(ctx, pWatchChangesReq)
+	if err != nil {
+		logger.Error("WatchChanges of %v failed :%v", volumeID, err)
+		return false
+	}
+	if reconnect {
+		fn(nil)
+	}
+	for {
+		ack, err := stream.Recv()
+		if ctx.Err() != nil {
+			return true
+		}
+		if err != nil {
+			logger.Debug("WatchChanges of %v broken :%v", volumeID, err)
+			return true
+		}
+		if ack.Ret != 0 {
+			// the leader moved, DialMeta looks it up again
+			forgetLeader(volumeID)
+			return true
+		}
+		fn(ack.Event)
+	}
+}
+
+// CloseWrite tells the watchers of the volume this client is done writing the file
+func (cfs *CFS) CloseWrite(pinode uint64, name string, inode uint64) int32 {
+	pCloseWriteReq := &mp.CloseWriteReq{
+		PInode: pinode,
+		Name:   name,
+		Inode:  inode,
+	}
+	ret, err := cfs.retryShard(pinode, true, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pCloseWriteReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.CloseWrite(ctx, pCloseWriteReq)
+		if err != nil {
+			return -1, err
+		}
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("CloseWrite failed,grpc func err :%v", err)
+		return -1
+	}
+	return ret
+}
+
+// Refresh reloads the chunks of a file opened read-only after another client changed it
+func (cfile *CFile) Refresh() int32 {
+	ret, ack := cfile.cfs.getFileChunksDirect(cfile.ParentInodeID, cfile.Name)
+	if ret != 0 {
+		return ret
+	}
+	var size int64
+	for _, v := range ack.ChunkInfos {
+		size += int64(v.ChunkSize)
+	}
+	cfile.RMutex.Lock()
+	cfile.chunks = ack.ChunkInfos
+	cfile.inline = nil
+	if len(ack.ChunkInfos) == 0 && len(ack.InlineData) > 0 {
+		cfile.inline = ack.InlineData
+		size = int64(len(ack.InlineData))
+	}
+	cfile.FileSize = size
+	cfile.RMutex.Unlock()
+	return 0
+}
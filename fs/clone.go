@@ -0,0 +1,56 @@
+package cfs
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"golang.org/x/net/context"
+)
+
+// CloneFile makes dstName of dstPInode a copy of srcName of srcPInode on the
+// metanode, sharing the chunks of the source: no data moves. dstName may be an
+// empty file. The two dirs must be in one shard, EXDEV otherwise.
+func (cfs *CFS) CloneFile(srcPInode uint64, srcName string, dstPInode uint64, dstName string) (int32, uint64, *mp.InodeInfo) {
+	pCloneFileReq := &mp.CloneFileReq{
+		SrcPInode: srcPInode,
+		SrcName:   srcName,
+		DstPInode: dstPInode,
+		DstName:   dstName,
+		Uid:       cfs.uid,
+		Gid:       cfs.gid,
+	}
+	var inode uint64
+	var inodeInfo *mp.InodeInfo
+	ret, err := cfs.retryShard(dstPInode, false, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pCloneFileReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.CloneFile(ctx, pCloneFileReq)
+		if err != nil {
+			return -1, err
+		}
+		inode, inodeInfo = ack.Inode, ack.InodeInfo
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("CloneFile failed,grpc func err :%v", err)
+		return -1, 0, nil
+	}
+	return ret, inode, inodeInfo
+}
+
+// CloneFile the file at src in the volume to dst
+func CloneFile(uuid string, src string, dst string) int32 {
+	cfs := OpenFileSystem(uuid)
+	ret, srcPInode, srcName := cfs.entryOf(src)
+	if ret != 0 {
+		return ret
+	}
+	ret, dstPInode, dstName := cfs.entryOf(dst)
+	if ret != 0 {
+		return ret
+	}
+	if srcName == "" || dstName == "" {
+		return 21 /*EISDIR*/
+	}
+	ret, _, _ = cfs.CloneFile(srcPInode, srcName, dstPInode, dstName)
+	return ret
+}
@@ -0,0 +1,166 @@
+package cfs
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	dp "github.com/ipdcode/containerfs/proto/dp"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"sync"
+	"time"
+)
+
+type pooledConn struct {
+	addr      string
+	conn      *grpc.ClientConn
+	refs      int
+	idleSince time.Time
+}
+
+// ConnPool datanode connections shared by all files, one per datanode address.
+// Get/Put count the users of a connection, unused ones are health checked and
+// closed after IdleTimeout.
+type ConnPool struct {
+	sync.Mutex
+	byAddr map[string]*pooledConn
+	byConn map[*grpc.ClientConn]*pooledConn
+
+	IdleTimeout   time.Duration
+	CheckInterval time.Duration
+}
+
+// DataConnPool ...
+var DataConnPool = NewConnPool(5*time.Minute, 30*time.Second)
+
+// NewConnPool ...
+func NewConnPool(idleTimeout time.Duration, checkInterval time.Duration) *ConnPool {
+	p := &ConnPool{
+		byAddr:        make(map[string]*pooledConn),
+		byConn:        make(map[*grpc.ClientConn]*pooledConn),
+		IdleTimeout:   idleTimeout,
+		CheckInterval: checkInterval,
+	}
+	go p.maintain()
+	return p
+}
+
+// Get returns the shared connection to addr, dialing it if needed. Release it with Put.
+func (p *ConnPool) Get(addr string) (*grpc.ClientConn, error) {
+	p.Lock()
+	if pc, ok := p.byAddr[addr]; ok {
+		pc.refs++
+		p.Unlock()
+		return pc.conn, nil
+	}
+	p.Unlock()
+
+	conn, err := DialData(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if pc, ok := p.byAddr[addr]; ok {
+		// dialed concurrently by another user
+		conn.Close()
+		pc.refs++
+		return pc.conn, nil
+	}
+	pc := &pooledConn{addr: addr, conn: conn, refs: 1}
+	p.byAddr[addr] = pc
+	p.byConn[conn] = pc
+	return conn, nil
+}
+
+// Len the open connections of the pool
+func (p *ConnPool) Len() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.byConn)
+}
+
+// Put releases a connection got from Get
+func (p *ConnPool) Put(conn *grpc.ClientConn) {
+	if conn == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	pc, ok := p.byConn[conn]
+	if !ok {
+		conn.Close()
+		return
+	}
+	pc.refs--
+	if pc.refs > 0 {
+		return
+	}
+	pc.idleSince = time.Now()
+	if p.byAddr[pc.addr] != pc {
+		// marked broken while in use
+		p.remove(pc)
+	}
+}
+
+// MarkBroken makes the next Get of the address dial a new connection,
+// conn itself is closed when its last user puts it back
+func (p *ConnPool) MarkBroken(conn *grpc.ClientConn) {
+	if conn == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	pc, ok := p.byConn[conn]
+	if !ok {
+		return
+	}
+	if p.byAddr[pc.addr] == pc {
+		delete(p.byAddr, pc.addr)
+	}
+	if pc.refs == 0 {
+		p.remove(pc)
+	}
+}
+
+// remove must be called with p locked
+func (p *ConnPool) remove(pc *pooledConn) {
+	delete(p.byConn, pc.conn)
+	if p.byAddr[pc.addr] == pc {
+		delete(p.byAddr, pc.addr)
+	}
+	pc.conn.Close()
+}
+
+func (p *ConnPool) maintain() {
+	ticker := time.NewTicker(p.CheckInterval)
+	for range ticker.C {
+		p.check()
+	}
+}
+
+// check closes the connections idle for longer than IdleTimeout and health checks the other unused ones
+func (p *ConnPool) check() {
+	var idle []*pooledConn
+	p.Lock()
+	for _, pc := range p.byConn {
+		if pc.refs > 0 {
+			continue
+		}
+		if time.Since(pc.idleSince) > p.IdleTimeout {
+			p.remove(pc)
+			continue
+		}
+		idle = append(idle, pc)
+	}
+	p.Unlock()
+
+	for _, pc := range idle {
+		dc := dp.NewDataNodeClient(pc.conn)
+		ctx, _ := context.WithTimeout(context.Background(), 2*time.Second)
+		_, err := dc.DatanodeHealthCheck(ctx, &dp.DatanodeHealthCheckReq{})
+		if err != nil {
+			logger.Error("datanode %v health check failed :%v, drop its connection", pc.addr, err)
+			p.MarkBroken(pc.conn)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package cfs
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/ipdcode/containerfs/logger"
+	dp "github.com/ipdcode/containerfs/proto/dp"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"github.com/ipdcode/containerfs/utils"
+	"golang.org/x/net/context"
+	"strconv"
+	"time"
+)
+
+// DedupStats of a dedup pass
+type DedupStats struct {
+	Files      int64
+	Chunks     int64
+	Duplicates int64 // chunks pointed at another copy
+	Saved      int64 // bytes freed on each replica
+	Failed     int64
+}
+
+func (s DedupStats) String() string {
+	return fmt.Sprintf("files %v chunks %v duplicates %v saved %vMB failed %v",
+		s.Files, s.Chunks, s.Duplicates, s.Saved>>20, s.Failed)
+}
+
+type keptChunk struct {
+	chunk *mp.ChunkInfoWithBG
+	inode uint64
+}
+
+// dedup a pass over a tree, the first chunk seen of each content is kept
+type dedup struct {
+	cfs    *CFS
+	minAge time.Duration
+	kept   map[string]keptChunk // by shard, size and digest
+	stats  DedupStats
+}
+
+// Dedup points the chunks of the files under path with the same content at one
+// copy and deletes the others. It is an offline job: the files modified within
+// minAge are left alone, a writer must not hold a file it looks at. Chunks are
+// only shared within a shard of a sharded volume.
+func Dedup(uuid string, path string, minAge time.Duration) (int32, DedupStats) {
+	cfs := OpenFileSystem(uuid)
+	cfs.Background = true
+	ret, inode := cfs.DirInode(path)
+	if ret != 0 {
+		return ret, DedupStats{}
+	}
+	d := &dedup{cfs: cfs, minAge: minAge, kept: make(map[string]keptChunk)}
+	ret = d.dir(inode)
+	return ret, d.stats
+}
+
+func (d *dedup) dir(pinode uint64) int32 {
+	marker := ""
+	for {
+		ret, dirents, infos, next := d.cfs.ListWithAttrsPage(pinode, marker, 1024)
+		if ret != 0 {
+			return ret
+		}
+		for i, e := range dirents {
+			if !e.InodeType {
+				if ret := d.dir(e.Inode); ret != 0 {
+					return ret
+				}
+				continue
+			}
+			if infos[i] == nil || len(infos[i].Chunks) == 0 ||
+				time.Since(time.Unix(infos[i].ModifiTime, 0)) < d.minAge {
+				continue
+			}
+			d.file(pinode, e.Name, e.Inode)
+		}
+		if next == "" {
+			return 0
+		}
+		marker = next
+	}
+}
+
+func (d *dedup) file(pinode uint64, name string, inode uint64) {
+	ret, chunks, _ := d.cfs.GetFileChunksDirect(pinode, name)
+	if ret != 0 {
+		return
+	}
+	d.stats.Files++
+	shard := d.cfs.shard(pinode)
+	for i, c := range chunks {
+		d.stats.Chunks++
+		digest, ok := d.digest(c)
+		if !ok {
+			continue
+		}
+		key := shard + "/" + strconv.Itoa(int(c.ChunkSize)) + "/" + hex.EncodeToString(digest)
+		k, ok := d.kept[key]
+		if !ok {
+			d.kept[key] = keptChunk{chunk: c, inode: inode}
+			continue
+		}
+		// a file points at a chunk once
+		if k.inode == inode || c.Shared {
+			continue
+		}
+		if ret := d.cfs.dedupChunk(pinode, name, int32(i), c.ChunkID, k.chunk); ret != 0 {
+			logger.Error("dedup chunk %v of %v/%v ret:%v", c.ChunkID, pinode, name, ret)
+			d.stats.Failed++
+			continue
+		}
+		d.cfs.deleteChunks([]*mp.ChunkInfoWithBG{c})
+		d.stats.Duplicates++
+		d.stats.Saved += int64(c.ChunkSize)
+	}
+}
+
+// digest of the chunk from the first replica that answers
+func (d *dedup) digest(c *mp.ChunkInfoWithBG) ([]byte, bool) {
+	for i, b := range c.BlockGroup.BlockInfos {
+		if i < len(c.Status) && c.Status[i] != 0 {
+			continue
+		}
+		addr := utils.InetNtoa(b.DataNodeIP).String() + ":" + strconv.Itoa(int(b.DataNodePort))
+		conn, err := DataConnPool.Get(addr)
+		if err != nil {
+			continue
+		}
+		ctx, _ := context.WithTimeout(context.Background(), 5*time.Minute)
+		ack, err := dp.NewDataNodeClient(conn).ChunkDigest(ctx, &dp.ChunkDigestReq{ChunkID: c.ChunkID, BlockID: b.BlockID})
+		if err != nil {
+			DataConnPool.MarkBroken(conn)
+		}
+		DataConnPool.Put(conn)
+		if err == nil && ack.Ret == 0 && ack.Size == int64(c.ChunkSize) {
+			return ack.Digest, true
+		}
+	}
+	return nil, false
+}
+
+// dedupChunk has the metanode point chunk index of the file at target
+func (cfs *CFS) dedupChunk(pinode uint64, name string, index int32, chunkID uint64, target *mp.ChunkInfoWithBG) int32 {
+	pDedupChunkReq := &mp.DedupChunkReq{
+		PInode:  pinode,
+		Name:    name,
+		Index:   index,
+		ChunkID: chunkID,
+		Target: &mp.ChunkInfo{
+			ChunkID:      target.ChunkID,
+			ChunkSize:    target.ChunkSize,
+			BlockGroupID: target.BlockGroup.BlockGroupID,
+			Status:       target.Status,
+		},
+	}
+	ret, err := cfs.retryShard(pinode, false, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pDedupChunkReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.DedupChunk(ctx, pDedupChunkReq)
+		if err != nil {
+			return -1, err
+		}
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("DedupChunk failed,grpc func err :%v", err)
+		return -1
+	}
+	return ret
+}
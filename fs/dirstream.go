@@ -0,0 +1,177 @@
+package cfs
+
+import (
+	"encoding/binary"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"github.com/ipdcode/containerfs/utils"
+	"golang.org/x/net/context"
+	"hash/fnv"
+)
+
+// ListPageSize entries fetched from the metanode per ListDirect page
+var ListPageSize = utils.NewInt(1024)
+
+// direntSize fixed part of a fuse_dirent: ino, off, namelen, type
+const direntSize = 8 + 8 + 4 + 4
+
+// the d_type of a fuse_dirent
+const (
+	dtDir  = 4
+	dtFile = 8
+)
+
+// DirStream serves a directory to the kernel page by page, so listing a huge
+// directory never holds all its entries in the client. Offsets are positions in
+// the encoded stream, a read at an earlier offset restarts the listing.
+type DirStream struct {
+	cfs    *CFS
+	pinode uint64
+
+	// Extra entries listed after the volume ones, those already in the volume are skipped
+	Extra func() []*mp.DirentN
+
+	// Attrs set, the volume entries are listed with their inode infos and handed
+	// to it, so the lookups and stats after the listing need no metanode
+	Attrs func(v *mp.DirentN, info *mp.InodeInfo)
+
+	// Ino set, the inode numbers listed are Ino of those of the volume
+	Ino func(inode uint64) uint64
+
+	marker  string
+	volDone bool
+	done    bool
+	seen    map[string]bool
+
+	base int64 // stream offset of buf[0]
+	buf  []byte
+}
+
+// NewDirStream ...
+func (cfs *CFS) NewDirStream(pinode uint64) *DirStream {
+	return &DirStream{
+		cfs:    cfs,
+		pinode: pinode,
+	}
+}
+
+func (ds *DirStream) reset() {
+	ds.marker = ""
+	ds.volDone = false
+	ds.done = false
+	ds.seen = nil
+	ds.base = 0
+	ds.buf = nil
+}
+
+// ReadContext is Read with the metanode rpcs giving up once ctx is cancelled
+func (ds *DirStream) ReadContext(ctx context.Context, offset int64, size int) ([]byte, int32) {
+	base := ds.cfs
+	ds.cfs = base.WithContext(ctx)
+	defer func() { ds.cfs = base }()
+	return ds.Read(offset, size)
+}
+
+// Read returns up to size bytes of encoded dirents starting at offset
+func (ds *DirStream) Read(offset int64, size int) ([]byte, int32) {
+	if offset < ds.base {
+		ds.reset()
+	}
+	for !ds.done && ds.base+int64(len(ds.buf)) < offset+int64(size) {
+		if ret := ds.fill(); ret != 0 {
+			return nil, ret
+		}
+	}
+
+	// the kernel never comes back for what it consumed
+	skip := offset - ds.base
+	if skip > int64(len(ds.buf)) {
+		skip = int64(len(ds.buf))
+	}
+	ds.buf = ds.buf[skip:]
+	ds.base += skip
+
+	// only whole entries
+	n := 0
+	for n < len(ds.buf) {
+		reclen := direntSize + (int(binary.LittleEndian.Uint32(ds.buf[n+16:]))+7)&^7
+		if n+reclen > size {
+			break
+		}
+		n += reclen
+	}
+	return ds.buf[:n], 0
+}
+
+// fill encodes the next page
+func (ds *DirStream) fill() int32 {
+	if ds.volDone {
+		if ds.Extra != nil {
+			for _, v := range ds.Extra() {
+				if ds.seen[v.Name] {
+					continue
+				}
+				if v.Inode == 0 {
+					h := fnv.New64a()
+					h.Write([]byte(v.Name))
+					v.Inode = h.Sum64()
+				}
+				ds.append(v)
+			}
+		}
+		ds.done = true
+		return 0
+	}
+
+	var ret int32
+	var dirents []*mp.DirentN
+	var next string
+	if ds.Attrs != nil {
+		var infos []*mp.InodeInfo
+		ret, dirents, infos, next = ds.cfs.ListWithAttrsPage(ds.pinode, ds.marker, ListPageSize.Get())
+		for i, v := range dirents {
+			if infos[i] != nil {
+				ds.Attrs(v, infos[i])
+			}
+		}
+	} else {
+		ret, dirents, next = ds.cfs.ListDirectPage(ds.pinode, ds.marker, ListPageSize.Get())
+	}
+	if ret != 0 {
+		return ret
+	}
+	for _, v := range dirents {
+		if ds.Extra != nil {
+			if ds.seen == nil {
+				ds.seen = make(map[string]bool)
+			}
+			ds.seen[v.Name] = true
+		}
+		ds.append(v)
+	}
+	ds.marker = next
+	if next == "" {
+		ds.volDone = true
+	}
+	return 0
+}
+
+// append encodes v as a fuse_dirent whose off is the stream offset of the next entry
+func (ds *DirStream) append(v *mp.DirentN) {
+	typ := dtDir
+	if v.InodeType {
+		typ = dtFile
+	}
+	padded := (len(v.Name) + 7) &^ 7
+	rec := make([]byte, direntSize+padded)
+	next := ds.base + int64(len(ds.buf)) + int64(len(rec))
+	ino := v.Inode
+	if ds.Ino != nil {
+		ino = ds.Ino(ino)
+	}
+	binary.LittleEndian.PutUint64(rec[0:], ino)
+	binary.LittleEndian.PutUint64(rec[8:], uint64(next))
+	binary.LittleEndian.PutUint32(rec[16:], uint32(len(v.Name)))
+	binary.LittleEndian.PutUint32(rec[20:], uint32(typ))
+	copy(rec[direntSize:], v.Name)
+	ds.buf = append(ds.buf, rec...)
+}
@@ -0,0 +1,153 @@
+package cfs
+
+import (
+	"fmt"
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	vp "github.com/ipdcode/containerfs/proto/vp"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"time"
+)
+
+// EnsureVol the volume named in.VolName as described, created or changed to match, see
+// the EnsureVol of the volmgr. It does the namespace part on the metanodes, and
+// ensures a volume it created again for the settings kept there. The changes of the
+// ack are those made, or to make with DryRun. A volume an earlier call left without
+// its namespace or some of its block groups, it failed after the volmgr part, gets
+// them here.
+func EnsureVol(in *vp.EnsureVolReq) (int32, *vp.EnsureVolAck) {
+	if in.MetaDomain == "" {
+		in.MetaDomain = MetaNodeAddr
+	}
+	ret, ack := ensureVol(in)
+	if ret != 0 && !in.DryRun && ack != nil && ack.UUID != "" && !ack.Created {
+		// the settings kept in the namespace fail without it
+		if repairNameSpace(ack) == 0 {
+			ret, ack = ensureVol(in)
+		}
+	}
+	if ret != 0 || in.DryRun {
+		return ret, ack
+	}
+	if ack.Created {
+		if ret := createNameSpace(in.MetaDomain, ack.UUID, ack.RaftGroupID); ret != 0 {
+			return ret, ack
+		}
+		ret, again := ensureVol(in)
+		if ret != 0 {
+			return ret, ack
+		}
+		ack.Changes = append(ack.Changes, again.Changes...)
+	}
+	if len(ack.BlockGroups) > 0 {
+		if ret := expandNameSpace(ack.UUID, ack.BlockGroups); ret != 0 {
+			return ret, ack
+		}
+	}
+	if !ack.Created {
+		if ret := repairNameSpace(ack); ret != 0 {
+			return ret, ack
+		}
+	}
+	return 0, ack
+}
+
+// repairNameSpace creates the namespace of the volume when its metadomain has none,
+// then adds the block groups of the volmgr it lacks
+func repairNameSpace(ack *vp.EnsureVolAck) int32 {
+	ret, vack := GetVolInfo(ack.UUID)
+	if ret != 0 {
+		return ret
+	}
+	info := vack.VolInfo
+	missing, err := nameSpaceMissing(info.MetaDomain, ack.UUID)
+	if err != nil {
+		logger.Error("EnsureVol %v: look up the namespace on %v err:%v", ack.UUID, info.MetaDomain, err)
+		return -1
+	}
+	if missing {
+		if ret := createNameSpace(info.MetaDomain, ack.UUID, ack.RaftGroupID); ret != 0 {
+			return ret
+		}
+		ack.Changes = append(ack.Changes, "namespace created")
+		// a new namespace takes the block groups from the volmgr
+		return 0
+	}
+	if len(info.BlockGroups) == 0 {
+		return 0
+	}
+	// the metanode adds only the block groups it does not have
+	return expandNameSpace(ack.UUID, info.BlockGroups)
+}
+
+// nameSpaceMissing whether the metanode addr has no namespace for the volume, -1 from
+// GetMetaLeader: one without a leader yet has it
+func nameSpaceMissing(addr string, volID string) (bool, error) {
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Millisecond*300), grpc.FailOnNonTempDialError(true))
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	lack, err := mp.NewMetaNodeClient(conn).GetMetaLeader(ctx, &mp.GetMetaLeaderReq{VolID: volID})
+	if err != nil {
+		return false, err
+	}
+	switch lack.Ret {
+	case 0, 1:
+		return false, nil
+	case -1:
+		return true, nil
+	}
+	return false, fmt.Errorf("GetMetaLeader ret %v", lack.Ret)
+}
+
+func ensureVol(in *vp.EnsureVolReq) (int32, *vp.EnsureVolAck) {
+	conn, err := DialVolmgr(VolMgrAddr)
+	if err != nil {
+		logger.Error("EnsureVol failed,Dial to volmgr fail :%v", err)
+		return -1, nil
+	}
+	defer conn.Close()
+	vc := vp.NewVolMgrClient(conn)
+	ctx, _ := context.WithTimeout(context.Background(), 100*time.Second)
+	pEnsureVolAck, err := vc.EnsureVol(ctx, in)
+	if err != nil {
+		logger.Error("EnsureVol failed,grpc func err :%v", err)
+		return -1, nil
+	}
+	if pEnsureVolAck.Ret != 0 {
+		logger.Error("EnsureVol failed,grpc func ret :%v", pEnsureVolAck.Ret)
+	}
+	return pEnsureVolAck.Ret, pEnsureVolAck
+}
+
+func expandNameSpace(uuid string, blockGroups []*vp.BlockGroup) int32 {
+	var mpBlockGroups []*mp.BlockGroup
+	for _, v := range blockGroups {
+		mpBlockGroups = append(mpBlockGroups, BlockGroupVp2Mp(v))
+	}
+	conn, err := DialMeta(uuid)
+	if err != nil {
+		logger.Error("ExpandNameSpace failed,Dial to metanode fail :%v", err)
+		return -1
+	}
+	defer conn.Close()
+	mc := mp.NewMetaNodeClient(conn)
+	pmExpandNameSpaceReq := &mp.ExpandNameSpaceReq{
+		VolID:       uuid,
+		BlockGroups: mpBlockGroups,
+	}
+	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	pmExpandNameSpaceAck, err := mc.ExpandNameSpace(ctx, pmExpandNameSpaceReq)
+	if err != nil {
+		logger.Error("ExpandNameSpace failed,grpc func err :%v", err)
+		return -1
+	}
+	if pmExpandNameSpaceAck.Ret != 0 {
+		logger.Error("ExpandNameSpace failed :%v", pmExpandNameSpaceAck.Ret)
+		return -1
+	}
+	return 0
+}
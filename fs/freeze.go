@@ -0,0 +1,127 @@
+package cfs
+
+import (
+	"bufio"
+	"github.com/ipdcode/containerfs/logger"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Quiesce holds back mutating ops while the mount is frozen, so a container
+// using it can be checkpointed (CRIU) and resumed with a consistent view
+type Quiesce struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	frozen   bool
+	inflight int
+}
+
+// NewQuiesce ...
+func NewQuiesce() *Quiesce {
+	q := &Quiesce{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Enter waits until the mount is thawed, call Exit when the op is done
+func (q *Quiesce) Enter() {
+	q.mu.Lock()
+	for q.frozen {
+		q.cond.Wait()
+	}
+	q.inflight++
+	q.mu.Unlock()
+}
+
+// Exit ...
+func (q *Quiesce) Exit() {
+	q.mu.Lock()
+	q.inflight--
+	if q.inflight == 0 {
+		q.cond.Broadcast()
+	}
+	q.mu.Unlock()
+}
+
+// Inflight the ops between Enter and Exit
+func (q *Quiesce) Inflight() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.inflight
+}
+
+// Freeze stops new ops, waits for the running ones and then calls flush
+// to write back dirty data and release what the client holds on the servers
+func (q *Quiesce) Freeze(flush func()) {
+	q.mu.Lock()
+	if q.frozen {
+		q.mu.Unlock()
+		return
+	}
+	q.frozen = true
+	for q.inflight > 0 {
+		q.cond.Wait()
+	}
+	q.mu.Unlock()
+	if flush != nil {
+		flush()
+	}
+}
+
+// Thaw ...
+func (q *Quiesce) Thaw() {
+	q.mu.Lock()
+	q.frozen = false
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// Frozen ...
+func (q *Quiesce) Frozen() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.frozen
+}
+
+// ServeControl accepts one-line commands on a unix socket and answers with the
+// handler's reply, e.g. echo freeze | nc -U /run/cfs.sock
+func ServeControl(path string, handlers map[string]func() string) error {
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				logger.Error("control socket %v accept err:%v", path, err)
+				return
+			}
+			go serveControlConn(conn, handlers)
+		}
+	}()
+	return nil
+}
+
+func serveControlConn(conn net.Conn, handlers map[string]func() string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		cmd := strings.TrimSpace(line)
+		if cmd != "" {
+			reply := "unknown command " + cmd
+			if h, ok := handlers[cmd]; ok {
+				reply = h()
+			}
+			logger.Debug("control command %v : %v", cmd, reply)
+			conn.Write([]byte(reply + "\n"))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
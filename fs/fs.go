@@ -1,7 +1,6 @@
 package cfs
 
 import (
-	"bazil.org/fuse"
 	"bufio"
 	"bytes"
 	"fmt"
@@ -12,6 +11,8 @@ import (
 	"github.com/ipdcode/containerfs/utils"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"io"
 	"math/rand"
 	"os"
@@ -26,7 +27,7 @@ var MetaNodePeers []string
 // VolMgrAddr ...
 var VolMgrAddr string
 
-//MetaNodeAddr ...
+// MetaNodeAddr ...
 var MetaNodeAddr string
 
 // chunksize for write
@@ -34,38 +35,65 @@ const (
 	chunkSize = 64 * 1024 * 1024
 )
 
-// BufferSize ...
-var BufferSize int32
+// BufferSize write buffer of the files opened from now on, see CFile.bufSize
+var BufferSize = utils.NewInt(512 * 1024)
+
+// ReadParallelism max chunks fetched from datanodes at the same time for one read request
+var ReadParallelism = utils.NewInt(4)
 
 // CFS ...
 type CFS struct {
 	VolID string
+	qos   *qos
+	lat   *latency
+
+	// ctx of the request the ops are for, see WithContext
+	ctx context.Context
+
+	// Background tags the datanode traffic as bulk, it yields to client IO
+	Background bool
+
+	// owner of the files and dirs created, see WithOwner
+	uid, gid uint32
+	// permission bits of the files and dirs created, see WithMode
+	mode uint32
 	//Status int // 0 ok , 1 readonly 2 invaild
 }
 
-// CreateVol volume function
-func CreateVol(name string, capacity string) int32 {
+// CreateVol volume function, class the storage class of its blocks: ssd, hdd, auto or empty for any
+func CreateVol(name string, capacity string, class string) int32 {
+	ret, uuid := NewVol(name, capacity, class)
+	if ret != 0 {
+		return ret
+	}
+	fmt.Println(uuid)
+	return 0
+}
+
+// NewVol creates the volume like CreateVol, with its uuid
+func NewVol(name string, capacity string, class string) (int32, string) {
 	conn, err := DialVolmgr(VolMgrAddr)
 	if err != nil {
 		logger.Error("CreateVol failed,Dial to volmgr fail :%v\n", err)
-		return -1
+		return -1, ""
 
 	}
 	defer conn.Close()
 	vc := vp.NewVolMgrClient(conn)
 	spaceQuota, _ := strconv.Atoi(capacity)
 	pCreateVolReq := &vp.CreateVolReq{
-		VolName:    name,
-		SpaceQuota: int32(spaceQuota),
-		MetaDomain: MetaNodeAddr,
+		VolName:      name,
+		SpaceQuota:   int32(spaceQuota),
+		MetaDomain:   MetaNodeAddr,
+		StorageClass: class,
 	}
 	ctx, _ := context.WithTimeout(context.Background(), 100*time.Second)
 	pCreateVolAck, err := vc.CreateVol(ctx, pCreateVolReq)
 	if err != nil {
-		return -1
+		return -1, ""
 	}
 	if pCreateVolAck.Ret != 0 {
-		return -1
+		return -1, ""
 	}
 
 	// send to metadata to registry a new map
@@ -73,7 +101,7 @@ func CreateVol(name string, capacity string) int32 {
 	conn2, err := grpc.Dial(MetaNodeAddr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Millisecond*300), grpc.FailOnNonTempDialError(true))
 	if err != nil {
 		logger.Error("CreateVol failed,Dial to metanode fail :%v\n", err)
-		return -1
+		return -1, ""
 	}
 	defer conn2.Close()
 	mc := mp.NewMetaNodeClient(conn2)
@@ -85,19 +113,17 @@ func CreateVol(name string, capacity string) int32 {
 	ctx2, _ := context.WithTimeout(context.Background(), 5*time.Second)
 	pmCreateNameSpaceAck, err := mc.CreateNameSpace(ctx2, pmCreateNameSpaceReq)
 	if err != nil {
-		return -1
+		return -1, ""
 	}
 	if pmCreateNameSpaceAck.Ret != 0 {
 		logger.Error("CreateNameSpace failed :%v\n", pmCreateNameSpaceAck.Ret)
-		return -1
+		return -1, ""
 	}
 
-	fmt.Println(pCreateVolAck.UUID)
-
-	return 0
+	return 0, pCreateVolAck.UUID
 }
 
-//BlockGroupVp2Mp ...
+// BlockGroupVp2Mp ...
 func BlockGroupVp2Mp(in *vp.BlockGroup) *mp.BlockGroup {
 
 	var mpBlockGroup = mp.BlockGroup{}
@@ -107,6 +133,7 @@ func BlockGroupVp2Mp(in *vp.BlockGroup) *mp.BlockGroup {
 	mpBlockGroup.BlockGroupID = in.BlockGroupID
 	mpBlockGroup.FreeSize = in.FreeSize
 	mpBlockGroup.Status = in.Status
+	mpBlockGroup.Media = in.Media
 
 	for i := range in.BlockInfos {
 		var pVpBlockInfo *vp.BlockInfo
@@ -205,6 +232,27 @@ func GetVolInfo(name string) (int32, *vp.GetVolInfoAck) {
 	return 0, pGetVolInfoAck
 }
 
+// GetVolList the uuids of all the volumes
+func GetVolList() (int32, []*vp.VolIDs) {
+	conn, err := DialVolmgr(VolMgrAddr)
+	if err != nil {
+		logger.Error("GetVolList failed,Dial to volmgr fail :%v", err)
+		return -1, nil
+	}
+	defer conn.Close()
+	vc := vp.NewVolMgrClient(conn)
+	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	pGetVolListAck, err := vc.GetVolList(ctx, &vp.GetVolListReq{})
+	if err != nil {
+		logger.Error("GetVolList failed,grpc func err :%v", err)
+		return -1, nil
+	}
+	if pGetVolListAck.Ret != 0 {
+		return pGetVolListAck.Ret, nil
+	}
+	return 0, pGetVolListAck.VolIDs
+}
+
 // SnapShootVol ...
 func SnapShootVol(uuid string) int32 {
 	// send to metadata to delete a  map
@@ -233,13 +281,143 @@ func SnapShootVol(uuid string) int32 {
 	return 0
 }
 
-// DeleteVol function
+// DeleteVol : the volume is kept pending purge by volmgr and can be brought back with RestoreVol
 func DeleteVol(uuid string) int32 {
+	conn, err := DialVolmgr(VolMgrAddr)
+	if err != nil {
+		logger.Error("deleteVol failed,Dial to volmgr fail :%v", err)
+		return -1
+	}
+	defer conn.Close()
+	vc := vp.NewVolMgrClient(conn)
+	pDeleteVolReq := &vp.DeleteVolReq{
+		UUID: uuid,
+	}
+	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	pDeleteVolAck, err := vc.DeleteVol(ctx, pDeleteVolReq)
+	if err != nil {
+		logger.Error("DeleteVol failed,grpc func err :%v", err)
+		return -1
+	}
+	if pDeleteVolAck.Ret != 0 {
+		logger.Error("DeleteVol failed,grpc func ret :%v", pDeleteVolAck.Ret)
+		return -1
+	}
+	return 0
+}
+
+// RestoreVol ...
+func RestoreVol(uuid string) int32 {
+	conn, err := DialVolmgr(VolMgrAddr)
+	if err != nil {
+		logger.Error("RestoreVol failed,Dial to volmgr fail :%v", err)
+		return -1
+	}
+	defer conn.Close()
+	vc := vp.NewVolMgrClient(conn)
+	pRestoreVolReq := &vp.RestoreVolReq{
+		UUID: uuid,
+	}
+	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	pRestoreVolAck, err := vc.RestoreVol(ctx, pRestoreVolReq)
+	if err != nil {
+		logger.Error("RestoreVol failed,grpc func err :%v", err)
+		return -1
+	}
+	if pRestoreVolAck.Ret != 0 {
+		logger.Error("RestoreVol failed,grpc func ret :%v", pRestoreVolAck.Ret)
+		return pRestoreVolAck.Ret
+	}
+	return 0
+}
+
+// SetVolStorageClass : the media of the blocks of the volume, ssd, hdd, auto (ssd while hot)
+// or empty for any, the volmgr moves the blocks on another media
+func SetVolStorageClass(uuid string, class string) int32 {
+	conn, err := DialVolmgr(VolMgrAddr)
+	if err != nil {
+		logger.Error("SetVolStorageClass failed,Dial to volmgr fail :%v", err)
+		return -1
+	}
+	defer conn.Close()
+	vc := vp.NewVolMgrClient(conn)
+	pSetVolStorageClassReq := &vp.SetVolStorageClassReq{
+		UUID:         uuid,
+		StorageClass: class,
+	}
+	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	pSetVolStorageClassAck, err := vc.SetVolStorageClass(ctx, pSetVolStorageClassReq)
+	if err != nil {
+		logger.Error("SetVolStorageClass failed,grpc func err :%v", err)
+		return -1
+	}
+	if pSetVolStorageClassAck.Ret != 0 {
+		logger.Error("SetVolStorageClass failed,grpc func ret :%v", pSetVolStorageClassAck.Ret)
+		return pSetVolStorageClassAck.Ret
+	}
+	return 0
+}
+
+// SetVolReplica : replica true makes the volume a geo-replication target clients mount
+// read-only, false promotes it to a writable volume on failover
+func SetVolReplica(uuid string, replica bool) int32 {
+	conn, err := DialVolmgr(VolMgrAddr)
+	if err != nil {
+		logger.Error("SetVolReplica failed,Dial to volmgr fail :%v", err)
+		return -1
+	}
+	defer conn.Close()
+	vc := vp.NewVolMgrClient(conn)
+	pSetVolReplicaReq := &vp.SetVolReplicaReq{
+		UUID:    uuid,
+		Replica: replica,
+	}
+	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	pSetVolReplicaAck, err := vc.SetVolReplica(ctx, pSetVolReplicaReq)
+	if err != nil {
+		logger.Error("SetVolReplica failed,grpc func err :%v", err)
+		return -1
+	}
+	if pSetVolReplicaAck.Ret != 0 {
+		logger.Error("SetVolReplica failed,grpc func ret :%v", pSetVolReplicaAck.Ret)
+		return pSetVolReplicaAck.Ret
+	}
+	return 0
+}
+
+// MoveVol : records in volmgr that the volume is served by the metanodes of metadomain
+func MoveVol(uuid string, metadomain string) int32 {
+	conn, err := DialVolmgr(VolMgrAddr)
+	if err != nil {
+		logger.Error("MoveVol failed,Dial to volmgr fail :%v", err)
+		return -1
+	}
+	defer conn.Close()
+	vc := vp.NewVolMgrClient(conn)
+	pMoveVolReq := &vp.MoveVolReq{
+		UUID:       uuid,
+		MetaDomain: metadomain,
+	}
+	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	pMoveVolAck, err := vc.MoveVol(ctx, pMoveVolReq)
+	if err != nil {
+		logger.Error("MoveVol failed,grpc func err :%v", err)
+		return -1
+	}
+	if pMoveVolAck.Ret != 0 {
+		logger.Error("MoveVol failed,grpc func ret :%v", pMoveVolAck.Ret)
+		return pMoveVolAck.Ret
+	}
+	return 0
+}
+
+// PurgeVol : delete the volume at once, without the retention period
+func PurgeVol(uuid string) int32 {
 
 	// send to metadata to delete a  map
 	conn2, err := DialMeta(uuid)
 	if err != nil {
-		logger.Error("DeleteVol failed,Dial to metanode fail :%v\n", err)
+		logger.Error("PurgeVol failed,Dial to metanode fail :%v\n", err)
 		return -1
 	}
 	defer conn2.Close()
@@ -261,24 +439,25 @@ func DeleteVol(uuid string) int32 {
 
 	conn, err := DialVolmgr(VolMgrAddr)
 	if err != nil {
-		logger.Error("deleteVol failed,Dial to volmgr fail :%v", err)
+		logger.Error("PurgeVol failed,Dial to volmgr fail :%v", err)
 		return -1
 
 	}
 	defer conn.Close()
 	vc := vp.NewVolMgrClient(conn)
 	pDeleteVolReq := &vp.DeleteVolReq{
-		UUID: uuid,
+		UUID:  uuid,
+		Purge: true,
 	}
 	ctx, _ = context.WithTimeout(context.Background(), 5*time.Second)
 	pDeleteVolAck, err := vc.DeleteVol(ctx, pDeleteVolReq)
 	if err != nil {
-		logger.Error("DeleteVol failed,grpc func err :%v", err)
+		logger.Error("PurgeVol failed,grpc func err :%v", err)
 
 		return -1
 	}
 	if pDeleteVolAck.Ret != 0 {
-		logger.Error("DeleteVol failed,grpc func ret :%v", pDeleteVolAck.Ret)
+		logger.Error("PurgeVol failed,grpc func ret :%v", pDeleteVolAck.Ret)
 		return -1
 	}
 
@@ -287,192 +466,372 @@ func DeleteVol(uuid string) int32 {
 
 // GetFSInfo ...
 func GetFSInfo(name string) (int32, *mp.GetFSInfoAck) {
-
-	conn, err := DialMeta(name)
-	if err != nil {
-		logger.Error("GetFSInfo failed,Dial to metanode fail :%v\n", err)
-		return -1, nil
-	}
-	defer conn.Close()
-	mc := mp.NewMetaNodeClient(conn)
+	var pGetFSInfoAck *mp.GetFSInfoAck
 	pGetFSInfoReq := &mp.GetFSInfoReq{
 		VolID: name,
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	pGetFSInfoAck, err := mc.GetFSInfo(ctx, pGetFSInfoReq)
+	ret, err := retryMeta(name, true, func(mc mp.MetaNodeClient) (int32, error) {
+		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+		ack, err := mc.GetFSInfo(ctx, pGetFSInfoReq)
+		if err != nil {
+			return -1, err
+		}
+		pGetFSInfoAck = ack
+		return ack.Ret, nil
+	})
 	if err != nil {
 		logger.Error("GetFSInfo failed,grpc func err :%v", err)
 		return 1, nil
 	}
-	if pGetFSInfoAck.Ret != 0 {
-		logger.Error("GetFSInfo failed,grpc func ret :%v", pGetFSInfoAck.Ret)
+	if ret != 0 {
+		logger.Error("GetFSInfo failed,grpc func ret :%v", ret)
 		return 1, nil
 	}
 	return 0, pGetFSInfoAck
 }
 
+// BackgroundIO the volumes opened by OpenFileSystem tag their datanode traffic as background
+var BackgroundIO bool
+
 // OpenFileSystem ...
 func OpenFileSystem(UUID string) *CFS {
-	cfs := CFS{VolID: UUID}
+	cfs := CFS{VolID: UUID, Background: BackgroundIO, qos: &qos{}, lat: volLatency(UUID)}
+	cfs.SetQoS(VolQoS)
 	return &cfs
 }
 
-// CreateDirDirect ...
-func (cfs *CFS) CreateDirDirect(pinode uint64, name string) (int32, uint64) {
-	conn, err := DialMeta(cfs.VolID)
-	if err != nil {
-		logger.Error("CreateDir failed,Dial to metanode fail :%v", err)
-		return -1, 0
+// WithContext the volume for the ops of one request, its rpcs and retries give up
+// once ctx is cancelled: the kernel interrupted the syscall. Not for opening files,
+// a CFile keeps the CFS it was opened with.
+func (cfs *CFS) WithContext(ctx context.Context) *CFS {
+	c := *cfs
+	c.ctx = ctx
+	return &c
+}
+
+// WithOwner the volume for the ops of one request creating files or dirs owned by
+// uid and gid, as stored in the volume
+func (cfs *CFS) WithOwner(uid uint32, gid uint32) *CFS {
+	c := *cfs
+	c.uid, c.gid = uid, gid
+	return &c
+}
+
+// WithMode the volume for the ops of one request creating files or dirs with the
+// permission bits mode, as the low 12 bits of st_mode. 0 leaves the default.
+func (cfs *CFS) WithMode(mode uint32) *CFS {
+	c := *cfs
+	c.mode = mode
+	return &c
+}
+
+// callCtx the parent of the contexts of the rpcs of cfs, they carry ClientID
+func (cfs *CFS) callCtx() context.Context {
+	ctx := cfs.ctx
+	if ctx == nil {
+		ctx = context.Background()
 	}
-	defer conn.Close()
-	mc := mp.NewMetaNodeClient(conn)
+	if ClientID != "" {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.Pairs(utils.ClientIDMetadata, ClientID))
+	}
+	return ctx
+}
+
+// CreateDirDirect returns the attributes of the new dir, saving the client a GetInodeInfo
+func (cfs *CFS) CreateDirDirect(pinode uint64, name string) (int32, uint64, *mp.InodeInfo) {
+	var inode uint64
+	var inodeInfo *mp.InodeInfo
 	pCreateDirDirectReq := &mp.CreateDirDirectReq{
 		PInode: pinode,
 		Name:   name,
-		VolID:  cfs.VolID,
-	}
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	pCreateDirDirectAck, err := mc.CreateDirDirect(ctx, pCreateDirDirectReq)
+		Uid:    cfs.uid,
+		Gid:    cfs.gid,
+		Mode:   cfs.mode,
+	}
+	ret, err := cfs.retryShard(pinode, false, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pCreateDirDirectReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.CreateDirDirect(ctx, pCreateDirDirectReq)
+		if err != nil {
+			return -1, err
+		}
+		inode = ack.Inode
+		inodeInfo = ack.InodeInfo
+		return ack.Ret, nil
+	})
 	if err != nil {
 		logger.Error("CreateDir failed,grpc func err :%v", err)
-		return -1, 0
+		return -1, 0, nil
 	}
-	return pCreateDirDirectAck.Ret, pCreateDirDirectAck.Inode
+	return ret, inode, inodeInfo
 }
 
-// GetInodeInfoDirect ...
-func (cfs *CFS) GetInodeInfoDirect(pinode uint64, name string) (int32, uint64, *mp.InodeInfo) {
-	conn, err := DialMeta(cfs.VolID)
+// SetOwner of the entry name of the dir pinode, the uid and the gid only when set
+func (cfs *CFS) SetOwner(pinode uint64, name string, uid uint32, gid uint32, setUID bool, setGID bool) int32 {
+	pSetOwnerReq := &mp.SetOwnerReq{
+		PInode: pinode,
+		Name:   name,
+		Uid:    uid,
+		Gid:    gid,
+		SetUid: setUID,
+		SetGid: setGID,
+	}
+	ret, err := cfs.retryShard(pinode, true, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pSetOwnerReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.SetOwner(ctx, pSetOwnerReq)
+		if err != nil {
+			return -1, err
+		}
+		return ack.Ret, nil
+	})
 	if err != nil {
-		logger.Error("Stat failed,Dial to metanode fail :%v\n", err)
-		return -1, 0, nil
+		logger.Error("SetOwner failed,grpc func err :%v", err)
+		return -1
 	}
-	defer conn.Close()
-	mc := mp.NewMetaNodeClient(conn)
-	pGetInodeInfoDirectReq := &mp.GetInodeInfoDirectReq{
+	return ret
+}
+
+// SetTimes of the entry name of the dir pinode, a zero time is left as it is
+func (cfs *CFS) SetTimes(pinode uint64, name string, atime time.Time, mtime time.Time) int32 {
+	pSetTimesReq := &mp.SetTimesReq{
+		PInode:   pinode,
+		Name:     name,
+		SetAtime: !atime.IsZero(),
+		SetMtime: !mtime.IsZero(),
+	}
+	if pSetTimesReq.SetAtime {
+		pSetTimesReq.Atime = atime.UnixNano()
+	}
+	if pSetTimesReq.SetMtime {
+		pSetTimesReq.Mtime = mtime.UnixNano()
+	}
+	ret, err := cfs.retryShard(pinode, true, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pSetTimesReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.SetTimes(ctx, pSetTimesReq)
+		if err != nil {
+			return -1, err
+		}
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("SetTimes failed,grpc func err :%v", err)
+		return -1
+	}
+	return ret
+}
+
+// SetMode the permission bits of the entry name of the dir pinode
+func (cfs *CFS) SetMode(pinode uint64, name string, mode uint32) int32 {
+	pSetModeReq := &mp.SetModeReq{
 		PInode: pinode,
 		Name:   name,
-		VolID:  cfs.VolID,
+		Mode:   mode,
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	pGetInodeInfoDirectAck, err := mc.GetInodeInfoDirect(ctx, pGetInodeInfoDirectReq)
-	if err != nil {
-		time.Sleep(time.Second)
-		conn, err = DialMeta(cfs.VolID)
+	ret, err := cfs.retryShard(pinode, true, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pSetModeReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.SetMode(ctx, pSetModeReq)
 		if err != nil {
-			logger.Error("Stat failed,Dial to metanode fail :%v\n", err)
-			return -1, 0, nil
+			return -1, err
 		}
-		mc = mp.NewMetaNodeClient(conn)
-		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-		pGetInodeInfoDirectAck, err = mc.GetInodeInfoDirect(ctx, pGetInodeInfoDirectReq)
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("SetMode failed,grpc func err :%v", err)
+		return -1
+	}
+	return ret
+}
+
+// GetInodeInfoDirect ...
+func (cfs *CFS) GetInodeInfoDirect(pinode uint64, name string) (int32, uint64, *mp.InodeInfo) {
+	var pGetInodeInfoDirectAck *mp.GetInodeInfoDirectAck
+	pGetInodeInfoDirectReq := &mp.GetInodeInfoDirectReq{
+		PInode: pinode,
+		Name:   name,
+	}
+	ret, err := cfs.retryShard(pinode, true, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pGetInodeInfoDirectReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.GetInodeInfoDirect(ctx, pGetInodeInfoDirectReq)
 		if err != nil {
-			return -1, 0, nil
+			return -1, err
 		}
+		pGetInodeInfoDirectAck = ack
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("Stat failed,grpc func err :%v\n", err)
+		return -1, 0, nil
 	}
-	return pGetInodeInfoDirectAck.Ret, pGetInodeInfoDirectAck.Inode, pGetInodeInfoDirectAck.InodeInfo
+	return ret, pGetInodeInfoDirectAck.Inode, pGetInodeInfoDirectAck.InodeInfo
 }
 
 // StatDirect ...
 func (cfs *CFS) StatDirect(pinode uint64, name string) (int32, bool, uint64) {
-	conn, err := DialMeta(cfs.VolID)
-	if err != nil {
-		logger.Error("Stat failed,Dial to metanode fail :%v\n", err)
-		return -1, false, 0
-	}
-	defer conn.Close()
-	mc := mp.NewMetaNodeClient(conn)
+	ret, inodeType, inode, _ := cfs.StatGeneration(pinode, name)
+	return ret, inodeType, inode
+}
+
+// StatGeneration StatDirect with the generation of the inode
+func (cfs *CFS) StatGeneration(pinode uint64, name string) (int32, bool, uint64, uint64) {
+	var pStatDirectAck *mp.StatDirectAck
 	pStatDirectReq := &mp.StatDirectReq{
 		PInode: pinode,
 		Name:   name,
-		VolID:  cfs.VolID,
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	pStatDirectAck, err := mc.StatDirect(ctx, pStatDirectReq)
-	if err != nil {
-		time.Sleep(time.Second)
-		conn, err = DialMeta(cfs.VolID)
-		if err != nil {
-			logger.Error("Stat failed,Dial to metanode fail :%v\n", err)
-			return -1, false, 0
-		}
-		mc = mp.NewMetaNodeClient(conn)
-		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-		pStatDirectAck, err = mc.StatDirect(ctx, pStatDirectReq)
+	ret, err := cfs.retryShard(pinode, true, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pStatDirectReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.StatDirect(ctx, pStatDirectReq)
 		if err != nil {
-			return -1, false, 0
+			return -1, err
 		}
+		pStatDirectAck = ack
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("Stat failed,grpc func err :%v\n", err)
+		return -1, false, 0, 0
 	}
-	return pStatDirectAck.Ret, pStatDirectAck.InodeType, pStatDirectAck.Inode
+	return ret, pStatDirectAck.InodeType, pStatDirectAck.Inode, pStatDirectAck.Generation
 }
 
 // ListDirect ...
 func (cfs *CFS) ListDirect(pinode uint64) (int32, []*mp.DirentN) {
-	conn, err := DialMeta(cfs.VolID)
-	if err != nil {
-		logger.Error("List failed,Dial to metanode fail :%v\n", err)
-		return -1, nil
+	var dirents []*mp.DirentN
+	marker := ""
+	for {
+		ret, page, next := cfs.ListDirectPage(pinode, marker, ListPageSize.Get())
+		if ret != 0 {
+			return ret, nil
+		}
+		dirents = append(dirents, page...)
+		if next == "" {
+			return 0, dirents
+		}
+		marker = next
 	}
-	defer conn.Close()
-	mc := mp.NewMetaNodeClient(conn)
+}
+
+// ListDirectPage lists up to limit entries after marker in name order, next is empty on the last page
+func (cfs *CFS) ListDirectPage(pinode uint64, marker string, limit int) (int32, []*mp.DirentN, string) {
+	var dirents []*mp.DirentN
+	var next string
 	pListDirectReq := &mp.ListDirectReq{
 		PInode: pinode,
-		VolID:  cfs.VolID,
+		Marker: marker,
+		Limit:  int32(limit),
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	pListDirectAck, err := mc.ListDirect(ctx, pListDirectReq)
+	ret, err := cfs.retryShard(pinode, true, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pListDirectReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.ListDirect(ctx, pListDirectReq)
+		if err != nil {
+			return -1, err
+		}
+		dirents = ack.Dirents
+		next = ack.NextMarker
+		return ack.Ret, nil
+	})
 	if err != nil {
-		return -1, nil
+		logger.Error("List failed,grpc func err :%v\n", err)
+		return -1, nil, ""
 	}
+	return ret, dirents, next
+}
 
-	return pListDirectAck.Ret, pListDirectAck.Dirents
+// ListWithAttrsPage is ListDirectPage with the inode info of each entry,
+// infos[i] is nil when the inode of dirents[i] is gone
+func (cfs *CFS) ListWithAttrsPage(pinode uint64, marker string, limit int) (int32, []*mp.DirentN, []*mp.InodeInfo, string) {
+	var pListWithAttrsAck *mp.ListWithAttrsAck
+	pListWithAttrsReq := &mp.ListWithAttrsReq{
+		PInode: pinode,
+		Marker: marker,
+		Limit:  int32(limit),
+	}
+	ret, err := cfs.retryShard(pinode, true, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pListWithAttrsReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.ListWithAttrs(ctx, pListWithAttrsReq)
+		if err != nil {
+			return -1, err
+		}
+		pListWithAttrsAck = ack
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("ListWithAttrs failed,grpc func err :%v\n", err)
+		return -1, nil, nil, ""
+	}
+	if ret != 0 {
+		return ret, nil, nil, ""
+	}
+	infos := make([]*mp.InodeInfo, len(pListWithAttrsAck.Dirents))
+	for i := range infos {
+		if i < len(pListWithAttrsAck.InodeInfos) && pListWithAttrsAck.InodeInfos[i].ModifiTime != 0 {
+			infos[i] = pListWithAttrsAck.InodeInfos[i]
+		}
+	}
+	return 0, pListWithAttrsAck.Dirents, infos, pListWithAttrsAck.NextMarker
 }
 
 // DeleteDirDirect ...
 func (cfs *CFS) DeleteDirDirect(pinode uint64, name string) int32 {
-	conn, err := DialMeta(cfs.VolID)
-	if err != nil {
-		logger.Error("DeleteDir failed,Dial to metanode fail :%v\n", err)
-		return -1
-	}
-	defer conn.Close()
-	mc := mp.NewMetaNodeClient(conn)
 	pDeleteDirDirectReq := &mp.DeleteDirDirectReq{
 		PInode: pinode,
 		Name:   name,
-		VolID:  cfs.VolID,
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	pDeleteDirDirectAck, err := mc.DeleteDirDirect(ctx, pDeleteDirDirectReq)
+	ret, err := cfs.retryShard(pinode, false, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pDeleteDirDirectReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.DeleteDirDirect(ctx, pDeleteDirDirectReq)
+		if err != nil {
+			return -1, err
+		}
+		return ack.Ret, nil
+	})
 	if err != nil {
+		logger.Error("DeleteDir failed,grpc func err :%v\n", err)
 		return -1
 	}
-	return pDeleteDirDirectAck.Ret
+	return ret
 }
 
 // RenameDirect ...
 func (cfs *CFS) RenameDirect(oldpinode uint64, oldname string, newpinode uint64, newname string) int32 {
-	conn, err := DialMeta(cfs.VolID)
-	if err != nil {
-		logger.Error("Rename failed,Dial to metanode fail :%v\n", err)
-		return -1
-	}
-	defer conn.Close()
-	mc := mp.NewMetaNodeClient(conn)
+	return cfs.rename(oldpinode, oldname, newpinode, newname, false)
+}
+
+// RenameNoReplace is RenameDirect failing with 17 (EEXIST) when newname exists
+func (cfs *CFS) RenameNoReplace(oldpinode uint64, oldname string, newpinode uint64, newname string) int32 {
+	return cfs.rename(oldpinode, oldname, newpinode, newname, true)
+}
+
+func (cfs *CFS) rename(oldpinode uint64, oldname string, newpinode uint64, newname string, noReplace bool) int32 {
 	pRenameDirectReq := &mp.RenameDirectReq{
 		OldPInode: oldpinode,
 		OldName:   oldname,
 		NewPInode: newpinode,
 		NewName:   newname,
-		VolID:     cfs.VolID,
+		NoReplace: noReplace,
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	pRenameDirectAck, err := mc.RenameDirect(ctx, pRenameDirectReq)
+	ret, err := cfs.retryShard(oldpinode, false, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pRenameDirectReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.RenameDirect(ctx, pRenameDirectReq)
+		if err != nil {
+			return -1, err
+		}
+		return ack.Ret, nil
+	})
 	if err != nil {
+		logger.Error("Rename failed,grpc func err :%v\n", err)
 		return -1
 	}
-
-	return pRenameDirectAck.Ret
+	return ret
 }
 
 // CreateFileDirect ...
@@ -493,56 +852,63 @@ func (cfs *CFS) CreateFileDirect(pinode uint64, name string, flags int) (int32,
 	}
 
 	cfile := CFile{}
-	ret, inode := cfs.createFileDirect(pinode, name)
+	bufSize := int32(BufferSize.Get())
+	ret, inode, inodeInfo := cfs.createFileDirect(pinode, name)
 	if ret != 0 {
 		return ret, nil
 	}
 
-	conn, err := DialMeta(cfs.VolID)
+	conn, err := DialMeta(cfs.shard(pinode))
 	if err != nil {
 		return -1, nil
 	}
 
 	tmpBuffer := wBuffer{
 		buffer:   new(bytes.Buffer),
-		freeSize: BufferSize,
+		freeSize: bufSize,
 	}
 
 	cfile = CFile{
 		OpenFlag:      flags,
 		cfs:           cfs,
+		bufSize:       bufSize,
 		FileSize:      0,
 		ParentInodeID: pinode,
 		Inode:         inode,
+		InodeInfo:     inodeInfo,
 		Name:          name,
-		ReaderMap:     make(map[fuse.HandleID]*ReaderInfo),
+		readers:       make(map[HandleID]*ReaderInfo),
 		wBuffer:       tmpBuffer,
 		ConnM:         conn,
+		inlineMode:    InlineThreshold > 0,
 	}
 	//go cfile.send()
+	if ret := cfile.setAppend(flags); ret != 0 {
+		return ret, nil
+	}
 
 	return 0, &cfile
 }
 
 // OpenFileDirect ...
 func (cfs *CFS) OpenFileDirect(pinode uint64, name string, flags int) (int32, *CFile) {
-	var ret int32
 	var writer int32
 	var tmpFileSize int64
 
 	cfile := CFile{}
+	bufSize := int32(BufferSize.Get())
 
 	if (flags&os.O_WRONLY) != 0 || (flags&os.O_RDWR) != 0 {
 
-		conn, err := DialMeta(cfs.VolID)
+		conn, err := DialMeta(cfs.shard(pinode))
 		if err != nil {
 			return -1, nil
 		}
-		chunkInfos := make([]*mp.ChunkInfoWithBG, 0)
-		var inode uint64
-		if ret, chunkInfos, inode = cfs.GetFileChunksDirect(pinode, name); ret != 0 {
+		ret, ack := cfs.getFileChunksDirect(pinode, name)
+		if ret != 0 {
 			return ret, nil
 		}
+		chunkInfos, inode := ack.ChunkInfos, ack.Inode
 
 		if len(chunkInfos) > 0 {
 
@@ -553,13 +919,20 @@ func (cfs *CFS) OpenFileDirect(pinode uint64, name string, flags int) (int32, *C
 
 			tmpBuffer := wBuffer{
 				buffer:    new(bytes.Buffer),
-				freeSize:  BufferSize - (lastChunk.ChunkSize % BufferSize),
+				freeSize:  bufSize - (lastChunk.ChunkSize % bufSize),
 				chunkInfo: lastChunk,
 			}
+			if lastChunk.Shared {
+				// deduplicated, the writes go to a chunk of their own ending
+				// where the chunk would have
+				tmpBuffer.freeSize = bufSize - int32(tmpFileSize%int64(bufSize))
+				tmpBuffer.chunkInfo = nil
+			}
 
 			cfile = CFile{
 				OpenFlag:      flags,
 				cfs:           cfs,
+				bufSize:       bufSize,
 				Writer:        writer,
 				FileSize:      tmpFileSize,
 				wBuffer:       tmpBuffer,
@@ -567,7 +940,7 @@ func (cfs *CFS) OpenFileDirect(pinode uint64, name string, flags int) (int32, *C
 				Inode:         inode,
 				Name:          name,
 				chunks:        chunkInfos,
-				ReaderMap:     make(map[fuse.HandleID]*ReaderInfo),
+				readers:       make(map[HandleID]*ReaderInfo),
 				ConnM:         conn,
 			}
 
@@ -575,29 +948,40 @@ func (cfs *CFS) OpenFileDirect(pinode uint64, name string, flags int) (int32, *C
 
 			tmpBuffer := wBuffer{
 				buffer:   new(bytes.Buffer),
-				freeSize: BufferSize,
+				freeSize: bufSize,
 			}
 			cfile = CFile{
 				OpenFlag:      flags,
 				cfs:           cfs,
+				bufSize:       bufSize,
 				Writer:        writer,
-				FileSize:      0,
+				FileSize:      int64(len(ack.InlineData)),
 				ParentInodeID: pinode,
 				Inode:         inode,
 				Name:          name,
 				wBuffer:       tmpBuffer,
-				ReaderMap:     make(map[fuse.HandleID]*ReaderInfo),
+				readers:       make(map[HandleID]*ReaderInfo),
 				ConnM:         conn,
+				inline:        ack.InlineData,
+				inlineMode:    InlineThreshold > 0,
+			}
+			if !cfile.inlineMode && len(ack.InlineData) > 0 {
+				if ret := cfile.promoteInline(); ret != 0 {
+					return ret, nil
+				}
 			}
 
 		}
+		if ret := cfile.setAppend(flags); ret != 0 {
+			return ret, nil
+		}
 
 	} else {
-		chunkInfos := make([]*mp.ChunkInfoWithBG, 0)
-		var inode uint64
-		if ret, chunkInfos, inode = cfs.GetFileChunksDirect(pinode, name); ret != 0 {
+		ret, ack := cfs.getFileChunksDirect(pinode, name)
+		if ret != 0 {
 			return ret, nil
 		}
+		chunkInfos, inode := ack.ChunkInfos, ack.Inode
 
 		for i := range chunkInfos {
 			tmpFileSize += int64(chunkInfos[i].ChunkSize)
@@ -605,12 +989,13 @@ func (cfs *CFS) OpenFileDirect(pinode uint64, name string, flags int) (int32, *C
 
 		tmpBuffer := wBuffer{
 			buffer:   new(bytes.Buffer),
-			freeSize: BufferSize,
+			freeSize: bufSize,
 		}
 
 		cfile = CFile{
 			OpenFlag:      flags,
 			cfs:           cfs,
+			bufSize:       bufSize,
 			Writer:        writer,
 			FileSize:      tmpFileSize,
 			wBuffer:       tmpBuffer,
@@ -618,7 +1003,11 @@ func (cfs *CFS) OpenFileDirect(pinode uint64, name string, flags int) (int32, *C
 			Inode:         inode,
 			Name:          name,
 			chunks:        chunkInfos,
-			ReaderMap:     make(map[fuse.HandleID]*ReaderInfo),
+			readers:       make(map[HandleID]*ReaderInfo),
+		}
+		if len(chunkInfos) == 0 && len(ack.InlineData) > 0 {
+			cfile.inline = ack.InlineData
+			cfile.FileSize = int64(len(ack.InlineData))
 		}
 
 	}
@@ -628,89 +1017,132 @@ func (cfs *CFS) OpenFileDirect(pinode uint64, name string, flags int) (int32, *C
 // UpdateOpenFileDirect ...
 func (cfs *CFS) UpdateOpenFileDirect(pinode uint64, name string, cfile *CFile, flags int) int32 {
 
+	if isSyncFlags(flags) {
+		cfile.syncOpen = true
+	}
+
 	if (flags&os.O_WRONLY) != 0 || (flags&os.O_RDWR) != 0 {
-		conn, err := DialMeta(cfs.VolID)
+		conn, err := DialMeta(cfs.shard(pinode))
 		if err != nil {
 			return -1
 		}
 
 		cfile.ConnM = conn
-		chunkInfos := make([]*mp.ChunkInfoWithBG, 0)
 
-		var ret int32
-		if ret, chunkInfos, _ = cfs.GetFileChunksDirect(pinode, name); ret != 0 {
+		ret, ack := cfs.getFileChunksDirect(pinode, name)
+		if ret != 0 {
 			return ret
 		}
+		chunkInfos := ack.ChunkInfos
+		if len(chunkInfos) == 0 && !cfile.inlineMode {
+			cfile.inline = ack.InlineData
+			cfile.FileSize = int64(len(ack.InlineData))
+			cfile.inlineMode = InlineThreshold > 0
+		}
 
 		if len(chunkInfos) > 0 {
 			lastChunk := chunkInfos[len(chunkInfos)-1]
 			tmpBuffer := wBuffer{
 				buffer:    new(bytes.Buffer),
-				freeSize:  BufferSize - (lastChunk.ChunkSize % BufferSize),
+				freeSize:  cfile.bufSize - (lastChunk.ChunkSize % cfile.bufSize),
 				chunkInfo: lastChunk,
 			}
 			cfile.wBuffer = tmpBuffer
 		}
+		return cfile.setAppend(flags)
 	}
 	return 0
 }
 
 // createFileDirect ...
-func (cfs *CFS) createFileDirect(pinode uint64, name string) (int32, uint64) {
-
-	conn, err := DialMeta(cfs.VolID)
-	if err != nil {
-		logger.Error("createFileDirect failed,Dial to metanode fail :%v\n", err)
-		return -1, 0
-	}
-	defer conn.Close()
-	mc := mp.NewMetaNodeClient(conn)
+func (cfs *CFS) createFileDirect(pinode uint64, name string) (int32, uint64, *mp.InodeInfo) {
+	var inode uint64
+	var inodeInfo *mp.InodeInfo
 	pCreateFileDirectReq := &mp.CreateFileDirectReq{
 		PInode: pinode,
 		Name:   name,
-		VolID:  cfs.VolID,
-	}
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	pCreateFileDirectAck, err := mc.CreateFileDirect(ctx, pCreateFileDirectReq)
-	if err != nil || pCreateFileDirectAck.Ret != 0 {
-		time.Sleep(time.Second)
-		conn, err = DialMeta(cfs.VolID)
-		if err != nil {
-			logger.Error("CreateFileDirect failed,Dial to metanode fail :%v\n", err)
-			return -1, 0
-		}
-		mc = mp.NewMetaNodeClient(conn)
-		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-		pCreateFileDirectAck, err = mc.CreateFileDirect(ctx, pCreateFileDirectReq)
+		Uid:    cfs.uid,
+		Gid:    cfs.gid,
+		Mode:   cfs.mode,
+	}
+	ret, err := cfs.retryShard(pinode, false, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pCreateFileDirectReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.CreateFileDirect(ctx, pCreateFileDirectReq)
 		if err != nil {
-			logger.Error("CreateFileDirect failed,grpc func failed :%v\n", err)
-			return -1, 0
+			return -1, err
 		}
+		inode = ack.Inode
+		inodeInfo = ack.InodeInfo
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("CreateFileDirect failed,grpc func failed :%v\n", err)
+		return -1, 0, nil
 	}
-	if pCreateFileDirectAck.Ret == 1 {
-		return 1, 0
+	if ret == 1 {
+		return 1, 0, nil
 	}
-	if pCreateFileDirectAck.Ret == 2 {
-		return 2, 0
+	if ret == 2 {
+		return 2, 0, nil
 	}
-	if pCreateFileDirectAck.Ret == 17 {
-		return 17, 0
+	if ret == 17 {
+		return 17, 0, nil
 	}
-	return 0, pCreateFileDirectAck.Inode
+	return 0, inode, inodeInfo
 }
 
 // DeleteFileDirect ...
 func (cfs *CFS) DeleteFileDirect(pinode uint64, name string) int32 {
 
+	// with the trash on the metanode keeps the file for a while
+	if ret, trashed := cfs.trashFile(pinode, name); ret != 0 || trashed {
+		return ret
+	}
+	// a file other clients have open stays until they close it
+	if ret, orphaned := cfs.orphanFile(pinode, name, false); ret != 0 || orphaned {
+		return ret
+	}
+
 	ret, chunkInfos, _ := cfs.GetFileChunksDirect(pinode, name)
 	if ret != 0 {
 		return ret
 	}
+	if ret := cfs.deleteChunks(chunkInfos); ret != 0 {
+		return ret
+	}
+
+	mpDeleteFileDirectReq := &mp.DeleteFileDirectReq{
+		PInode: pinode,
+		Name:   name,
+	}
+	ret, err := cfs.retryShard(pinode, false, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		mpDeleteFileDirectReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.DeleteFileDirect(ctx, mpDeleteFileDirectReq)
+		if err != nil {
+			return -1, err
+		}
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("DeleteFile failed,grpc func err :%v\n", err)
+		return -1
+	}
+	return ret
+}
+
+// deleteChunks deletes the chunks from all their datanodes
+func (cfs *CFS) deleteChunks(chunkInfos []*mp.ChunkInfoWithBG) int32 {
 	for _, v1 := range chunkInfos {
+		if v1.Shared {
+			// other files use it, the metanode drops its reference
+			continue
+		}
 		for _, v2 := range v1.BlockGroup.BlockInfos {
 
 			addr := utils.InetNtoa(v2.DataNodeIP).String() + ":" + strconv.Itoa(int(v2.DataNodePort))
-			conn, err := DialData(addr)
+			conn, err := DataConnPool.Get(addr)
 			if err != nil {
 				logger.Error("DeleteFile failed,Dial to datanode fail :%v\n", err)
 				return -1
@@ -719,19 +1151,24 @@ func (cfs *CFS) DeleteFileDirect(pinode uint64, name string) int32 {
 			dc := dp.NewDataNodeClient(conn)
 
 			dpDeleteChunkReq := &dp.DeleteChunkReq{
-				ChunkID: v1.ChunkID,
-				BlockID: v2.BlockID,
+				ChunkID:      v1.ChunkID,
+				BlockID:      v2.BlockID,
+				VolID:        cfs.VolID,
+				BlockGroupID: v1.BlockGroup.BlockGroupID,
+				Background:   cfs.Background,
 			}
-			ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+			ctx, _ := context.WithTimeout(cfs.callCtx(), DataOpTimeout.Get())
 			_, err = dc.DeleteChunk(ctx, dpDeleteChunkReq)
 			if err != nil {
 				time.Sleep(time.Second)
-				conn, err = DialData(addr)
+				DataConnPool.MarkBroken(conn)
+				DataConnPool.Put(conn)
+				conn, err = DataConnPool.Get(addr)
 				if err != nil {
 					logger.Error("DeleteChunk failed,Dial to metanode fail :%v\n", err)
 				} else {
 					dc = dp.NewDataNodeClient(conn)
-					ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+					ctx, _ := context.WithTimeout(cfs.callCtx(), DataOpTimeout.Get())
 					_, err = dc.DeleteChunk(ctx, dpDeleteChunkReq)
 					if err != nil {
 						logger.Error("DeleteChunk failed,grpc func failed :%v\n", err)
@@ -739,74 +1176,43 @@ func (cfs *CFS) DeleteFileDirect(pinode uint64, name string) int32 {
 				}
 			}
 
-			conn.Close()
-		}
-	}
-
-	conn, err := DialMeta(cfs.VolID)
-	if err != nil {
-		logger.Error("DeleteFile failed,Dial to metanode fail :%v\n", err)
-		return -1
-	}
-	defer conn.Close()
-	mc := mp.NewMetaNodeClient(conn)
-	mpDeleteFileDirectReq := &mp.DeleteFileDirectReq{
-		PInode: pinode,
-		Name:   name,
-		VolID:  cfs.VolID,
-	}
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	mpDeleteFileDirectAck, err := mc.DeleteFileDirect(ctx, mpDeleteFileDirectReq)
-	if err != nil || mpDeleteFileDirectAck.Ret != 0 {
-		time.Sleep(time.Second)
-		conn, err = DialMeta(cfs.VolID)
-		if err != nil {
-			logger.Error("DeleteChunk failed,Dial to metanode fail :%v\n", err)
-			return -1
-		}
-		mc = mp.NewMetaNodeClient(conn)
-		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-		mpDeleteFileDirectAck, err = mc.DeleteFileDirect(ctx, mpDeleteFileDirectReq)
-		if err != nil {
-			logger.Error("DeleteFile failed,grpc func err :%v\n", err)
-			return -1
+			DataConnPool.Put(conn)
 		}
 	}
-	return mpDeleteFileDirectAck.Ret
+	return 0
 }
 
 // GetFileChunksDirect ...
 func (cfs *CFS) GetFileChunksDirect(pinode uint64, name string) (int32, []*mp.ChunkInfoWithBG, uint64) {
-	conn, err := DialMeta(cfs.VolID)
-	if err != nil {
-		logger.Error("GetFileChunksDirect failed,Dial to metanode fail :%v\n", err)
-		return -1, nil, 0
+	ret, ack := cfs.getFileChunksDirect(pinode, name)
+	if ack == nil {
+		return ret, nil, 0
 	}
-	defer conn.Close()
-	mc := mp.NewMetaNodeClient(conn)
+	return ret, ack.ChunkInfos, ack.Inode
+}
+
+// getFileChunksDirect also returns the inline data of a small file
+func (cfs *CFS) getFileChunksDirect(pinode uint64, name string) (int32, *mp.GetFileChunksDirectAck) {
+	var pGetFileChunksDirectAck *mp.GetFileChunksDirectAck
 	pGetFileChunksDirectReq := &mp.GetFileChunksDirectReq{
 		PInode: pinode,
 		Name:   name,
-		VolID:  cfs.VolID,
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	pGetFileChunksDirectAck, err := mc.GetFileChunksDirect(ctx, pGetFileChunksDirectReq)
-	if err != nil || pGetFileChunksDirectAck.Ret != 0 {
-		conn, err = DialMeta(cfs.VolID)
-		time.Sleep(time.Second)
-		if err != nil {
-			logger.Error("GetFileChunks failed,Dial to metanode fail :%v\n", err)
-			return -1, nil, 0
-		}
-		mc = mp.NewMetaNodeClient(conn)
-		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-		pGetFileChunksDirectAck, err = mc.GetFileChunksDirect(ctx, pGetFileChunksDirectReq)
+	ret, err := cfs.retryShard(pinode, true, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pGetFileChunksDirectReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.GetFileChunksDirect(ctx, pGetFileChunksDirectReq)
 		if err != nil {
-			logger.Error("GetFileChunks failed,grpc func failed :%v\n", err)
-			return -1, nil, 0
+			return -1, err
 		}
+		pGetFileChunksDirectAck = ack
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("GetFileChunks failed,grpc func failed :%v\n", err)
+		return -1, nil
 	}
-	return pGetFileChunksDirectAck.Ret, pGetFileChunksDirectAck.ChunkInfos, pGetFileChunksDirectAck.Inode
+	return ret, pGetFileChunksDirectAck
 }
 
 type wBuffer struct {
@@ -815,23 +1221,70 @@ type wBuffer struct {
 	buffer      *bytes.Buffer       // chunk data
 	startOffset int64
 	endOffset   int64
+	size        int32 // chunk size once this buffer is written
 }
 
 // ReaderInfo ...
 type ReaderInfo struct {
 	LastOffset int64
 	readBuf    []byte
+	buf        *bytes.Buffer // pooled buffer backing readBuf
 	Ch         chan *bytes.Buffer
+	busy       int // reads in progress
+	lastUse    time.Time
+	dropped    bool  // released or collected
+	charged    int64 // bytes of buf accounted against MaxMemory
+}
+
+// pipeline datanode connections and replica status of the chunk being sent
+type pipeline struct {
+	wgWriteReps    sync.WaitGroup
+	wLastDataNode  [3]string
+	ConnD          [3]*grpc.ClientConn
+	Dc             [3]dp.DataNodeClient
+	CurChunkID     uint64
+	CurChunkStatus [3]int32
+
+	// the replicas acking after the write quorum, see writeReplicas
+	mu       sync.Mutex       // CurChunkStatus
+	inflight [3]chan struct{} // closed once the last write sent to the replica is done
+}
+
+// status the replica status of the current chunk
+func (p *pipeline) status() []int32 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return []int32{p.CurChunkStatus[0], p.CurChunkStatus[1], p.CurChunkStatus[2]}
+}
+
+func (p *pipeline) closeConns() {
+	p.wgWriteReps.Wait()
+	p.inflight = [3]chan struct{}{}
+	for i := range p.ConnD {
+		DataConnPool.Put(p.ConnD[i])
+		p.ConnD[i] = nil
+	}
+	p.wLastDataNode = [3]string{}
+	p.Dc = [3]dp.DataNodeClient{}
+	p.CurChunkID = 0
+	p.CurChunkStatus = [3]int32{}
 }
 
+// HandleID an open handle of a file, the fuse handle in the fuseclient, for the
+// read state kept per handle
+type HandleID uint64
+
 // CFile ...
 type CFile struct {
 	cfs           *CFS
 	ParentInodeID uint64
 	Name          string
 	Inode         uint64
+	InodeInfo     *mp.InodeInfo // attributes returned by create, nil for opened files
 
 	OpenFlag int
+	syncOpen bool  // a handle was opened with O_SYNC/O_DSYNC
+	bufSize  int32 // BufferSize when the file was opened
 	FileSize int64
 	Status   int32 // 0 ok
 
@@ -839,57 +1292,75 @@ type CFile struct {
 	//WMutex sync.Mutex
 	Writer int32
 	//FirstW bool
-	wBuffer        wBuffer
-	wgWriteReps    sync.WaitGroup
-	ConnM          *grpc.ClientConn
-	wLastDataNode  [3]string
-	ConnD          [3]*grpc.ClientConn
-	Dc             [3]dp.DataNodeClient
-	CurChunkID     uint64
-	CurChunkStatus [3]int32
+	wBuffer wBuffer
+	ConnM   *grpc.ClientConn
+	pipeline
+	stripes []*stripe
+	syncMu  sync.Mutex // SyncChunk and chunks of concurrent stripes
+
+	// small files, see InlineThreshold
+	inline      []byte
+	inlineMode  bool // writes go to inline until the file outgrows it
+	inlineDirty bool
+
+	// O_APPEND, see append.go
+	appendMode bool
+	appendBuf  *bytes.Buffer
+	appendPipe pipeline
 
 	// for read
 	//lastoffset int64
 	RMutex sync.Mutex
 	chunks []*mp.ChunkInfoWithBG // chunkinfo
 	//readBuf    []byte
-	ReaderMap map[fuse.HandleID]*ReaderInfo
+	readersMu sync.Mutex
+	readers   map[HandleID]*ReaderInfo // read state of each handle, see readers.go
+
+	wCharged int64 // bytes of wBuffer accounted against MaxMemory
+
+	replicas int32 // copies of the new chunks by the policy of the file, 0 all
+
+	unsyncedMu sync.Mutex
+	unsynced   map[string]map[uint64]*unsyncedChunk // chunks written without Sync by datanode, see Sync
+
+	journal *journal // the writes not synced yet, see journal.go
 }
 
+// replicaNotKept the status of the replicas of a chunk left out by the policy of its
+// file, never written: the readers skip them like the failed ones
+const replicaNotKept = 3
+
 // AllocateChunk ...
 func (cfile *CFile) AllocateChunk() (int32, *mp.ChunkInfoWithBG) {
+	return cfile.allocateChunk(false)
+}
 
-	conn, err := DialMeta(cfile.cfs.VolID)
-	if err != nil {
-		logger.Error("AllocateChunk failed,Dial to metanode fail :%v\n", err)
-		return -1, nil
-	}
-	defer conn.Close()
-	mc := mp.NewMetaNodeClient(conn)
+// allocateChunk detached chunks are not linked to the file until CommitAppend
+func (cfile *CFile) allocateChunk(detached bool) (int32, *mp.ChunkInfoWithBG) {
+	var chunkInfo *mp.ChunkInfoWithBG
 	pAllocateChunkReq := &mp.AllocateChunkReq{
 		ParentInodeID: cfile.ParentInodeID,
 		Name:          cfile.Name,
-		VolID:         cfile.cfs.VolID,
+		Detached:      detached,
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	pAllocateChunkAck, err := mc.AllocateChunk(ctx, pAllocateChunkReq)
-	if err != nil || pAllocateChunkAck.Ret != 0 {
-		time.Sleep(time.Second)
-		conn, err = DialMeta(cfile.cfs.VolID)
+	ret, err := cfile.cfs.retryShard(cfile.ParentInodeID, false, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pAllocateChunkReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfile.cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.AllocateChunk(ctx, pAllocateChunkReq)
 		if err != nil {
-			logger.Error("AllocateChunk failed,Dial to metanode fail :%v\n", err)
-			return -1, nil
+			return -1, err
 		}
-		mc = mp.NewMetaNodeClient(conn)
-		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-		pAllocateChunkAck, err = mc.AllocateChunk(ctx, pAllocateChunkReq)
-		if err != nil {
-			logger.Error("AllocateChunk failed,grpc func failed :%v\n", err)
-			return -1, nil
+		chunkInfo = ack.ChunkInfo
+		if ack.Ret == 0 {
+			cfile.replicas = ack.Replicas
 		}
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("AllocateChunk failed,grpc func failed :%v\n", err)
+		return -1, nil
 	}
-
-	return pAllocateChunkAck.Ret, pAllocateChunkAck.ChunkInfo
+	return ret, chunkInfo
 }
 
 func generateRandomNumber(start int, end int, count int) []int {
@@ -918,27 +1389,49 @@ func generateRandomNumber(start int, end int, count int) []int {
 	return nums
 }
 
-func (cfile *CFile) streamread(chunkidx int, ch chan *bytes.Buffer, offset int64, size int64) {
+func (cfile *CFile) streamread(parent context.Context, chunkidx int, ch chan *bytes.Buffer, offset int64, size int64) {
 	var conn *grpc.ClientConn
 	var err error
 	var buffer *bytes.Buffer
 	outflag := 0
 	inflag := 0
-	idxs := generateRandomNumber(0, 3, 3)
+	idxs := cfile.replicaOrder(chunkidx)
 
 	for n := 0; n < len(cfile.chunks[chunkidx].BlockGroup.BlockInfos); n++ {
+		if parent.Err() != nil {
+			// the reader is gone, no other replica to try
+			putChunkBuf(buffer)
+			ch <- new(bytes.Buffer)
+			return
+		}
 		i := idxs[n]
 		if cfile.chunks[chunkidx].Status[i] != 0 {
-			logger.Error("streamreadChunkReq chunk status:%v error, so retry other datanode!", cfile.chunks[chunkidx].Status[i])
+			if cfile.chunks[chunkidx].Status[i] != replicaNotKept {
+				logger.Error("streamreadChunkReq chunk status:%v error, so retry other datanode!", cfile.chunks[chunkidx].Status[i])
+			}
 			outflag++
 			continue
 		}
 
-		buffer = new(bytes.Buffer)
+		if buffer == nil {
+			buffer = getChunkBuf(size)
+		} else {
+			buffer.Reset()
+		}
 		//r := rand.New(rand.NewSource(time.Now().UnixNano()))
 		//idx := r.Intn(len(cfile.chunks[chunkidx].BlockGroup.BlockInfos))
 
-		conn, err = DialData(utils.InetNtoa(cfile.chunks[chunkidx].BlockGroup.BlockInfos[i].DataNodeIP).String() + ":" + strconv.Itoa(int(cfile.chunks[chunkidx].BlockGroup.BlockInfos[i].DataNodePort)))
+		if bi := cfile.chunks[chunkidx].BlockGroup.BlockInfos[i]; ShortCircuit && isLocal(bi) {
+			err := readLocal(parent, bi, cfile.chunks[chunkidx].ChunkID, offset, size, buffer)
+			if err == nil {
+				ch <- buffer
+				return
+			}
+			logger.Debug("short-circuit read of chunk %v err:%v, read it from the datanode", cfile.chunks[chunkidx].ChunkID, err)
+			buffer.Reset()
+		}
+
+		conn, err = DataConnPool.Get(utils.InetNtoa(cfile.chunks[chunkidx].BlockGroup.BlockInfos[i].DataNodeIP).String() + ":" + strconv.Itoa(int(cfile.chunks[chunkidx].BlockGroup.BlockInfos[i].DataNodePort)))
 		if err != nil {
 			logger.Error("streamread failed,Dial to datanode fail :%v", err)
 			outflag++
@@ -947,15 +1440,20 @@ func (cfile *CFile) streamread(chunkidx int, ch chan *bytes.Buffer, offset int64
 
 		dc := dp.NewDataNodeClient(conn)
 		streamreadChunkReq := &dp.StreamReadChunkReq{
-			ChunkID:  cfile.chunks[chunkidx].ChunkID,
-			BlockID:  cfile.chunks[chunkidx].BlockGroup.BlockInfos[i].BlockID,
-			Offset:   offset,
-			Readsize: size,
+			ChunkID:      cfile.chunks[chunkidx].ChunkID,
+			BlockID:      cfile.chunks[chunkidx].BlockGroup.BlockInfos[i].BlockID,
+			Offset:       offset,
+			Readsize:     size,
+			VolID:        cfile.cfs.VolID,
+			BlockGroupID: cfile.chunks[chunkidx].BlockGroup.BlockGroupID,
+			Background:   cfile.cfs.Background,
 		}
-		ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+		ctx, _ := context.WithTimeout(parent, DataOpTimeout.Get())
 		stream, err := dc.StreamReadChunk(ctx, streamreadChunkReq)
 		if err != nil {
 			logger.Error("streamreadChunkReq error:%v, so retry other datanode!", err)
+			DataConnPool.MarkBroken(conn)
+			DataConnPool.Put(conn)
 			outflag++
 			continue
 		}
@@ -967,6 +1465,7 @@ func (cfile *CFile) streamread(chunkidx int, ch chan *bytes.Buffer, offset int64
 			}
 			if err != nil {
 				logger.Error("=== streamreadChunkReq Recv err:%v ===", err)
+				DataConnPool.MarkBroken(conn)
 				inflag++
 				outflag++
 				break
@@ -984,16 +1483,22 @@ func (cfile *CFile) streamread(chunkidx int, ch chan *bytes.Buffer, offset int64
 
 		}
 
+		DataConnPool.Put(conn)
+
+		if inflag == 0 && int64(buffer.Len()) < size {
+			// a replica behind the write quorum, the next may have it all
+			logger.Error("streamread chunk %v got %v of %v bytes, so retry other datanode!", cfile.chunks[chunkidx].ChunkID, buffer.Len(), size)
+			inflag++
+			outflag++
+		}
 		if inflag == 0 {
 			ch <- buffer
-			conn.Close()
 			break
 		} else if inflag == 3 {
+			putChunkBuf(buffer)
 			buffer = new(bytes.Buffer)
-			buffer.Write([]byte{})
 			logger.Error("Stream Read the chunk three copy Recv error")
 			ch <- buffer
-			conn.Close()
 			break
 		} else if inflag < 3 {
 			logger.Error("Stream Read the chunk %v copy Recv error, so need retry other datanode!!!", inflag)
@@ -1001,27 +1506,69 @@ func (cfile *CFile) streamread(chunkidx int, ch chan *bytes.Buffer, offset int64
 		}
 	}
 	if outflag == 3 {
+		putChunkBuf(buffer)
 		buffer = new(bytes.Buffer)
-		buffer.Write([]byte{})
 		logger.Error("Stream Read the chunk three copy Datanode error")
 		ch <- buffer
-		conn.Close()
 	}
 }
 
+// fetchChunks starts streaming chunks first..last, at most ReadParallelism at a time,
+// the i-th channel yields chunk first+i so the caller assembles them in order
+func (cfile *CFile) fetchChunks(ctx context.Context, first int, last int) []chan *bytes.Buffer {
+	chs := make([]chan *bytes.Buffer, last-first+1)
+	for i := range chs {
+		chs[i] = make(chan *bytes.Buffer, 1)
+	}
+	parallel := ReadParallelism.Get()
+	if parallel < 1 {
+		parallel = 1
+	}
+	sem := make(chan struct{}, parallel)
+	go func() {
+		for i := range chs {
+			sem <- struct{}{}
+			go func(i int) {
+				cfile.streamread(ctx, first+i, chs[i], 0, int64(cfile.chunks[first+i].ChunkSize))
+				<-sem
+			}(i)
+		}
+	}()
+	return chs
+}
+
+// Interrupted : ret of a read whose ctx was cancelled before the data came
+const Interrupted = -4
+
 // Read ...
-func (cfile *CFile) Read(handleID fuse.HandleID, data *[]byte, offset int64, readsize int64) int64 {
+func (cfile *CFile) Read(handleID HandleID, data *[]byte, offset int64, readsize int64) int64 {
+	return cfile.ReadContext(context.Background(), handleID, data, offset, readsize)
+}
+
+// ReadContext is Read giving up on the datanodes with Interrupted once ctx is cancelled
+func (cfile *CFile) ReadContext(ctx context.Context, handleID HandleID, data *[]byte, offset int64, readsize int64) int64 {
+	if Fenced(cfile.cfs.VolID) {
+		return -1
+	}
+	cfile.cfs.qos.read(readsize)
+	defer cfile.cfs.lat.read.ObserveSince(time.Now())
+
+	if cfile.inlineMode || (len(cfile.chunks) == 0 && cfile.inline != nil) {
+		return cfile.readInline(data, offset, readsize)
+	}
+
 	// read data from write buffer
 
 	cache := cfile.wBuffer
 	n := cache.buffer.Len()
-	if n != 0 && offset >= cache.startOffset {
-		cfile.ReaderMap[handleID].readBuf = cache.buffer.Bytes()
+	// the buffer holds the bytes up to endOffset, startOffset is only the last write
+	if start := cache.endOffset - int64(n); n != 0 && offset >= start {
+		cached := cache.buffer.Bytes()
 		if offset+readsize < cache.endOffset {
-			*data = append(*data, cfile.ReaderMap[handleID].readBuf[offset:offset+readsize]...)
+			*data = append(*data, cached[offset-start:offset-start+readsize]...)
 			return readsize
 		}
-		*data = append(*data, cfile.ReaderMap[handleID].readBuf[offset:cache.endOffset]...)
+		*data = append(*data, cached[offset-start:]...)
 		return cache.endOffset - offset
 	}
 
@@ -1074,6 +1621,19 @@ func (cfile *CFile) Read(handleID fuse.HandleID, data *[]byte, offset int64, rea
 		return -1
 	}
 
+	r := cfile.reader(handleID)
+	defer cfile.doneReader(r)
+
+	// fetch the chunks of the request in parallel, the first one may already be in readBuf
+	firstFetch := beginChunkNum
+	if len(r.readBuf) != 0 {
+		firstFetch++
+	}
+	var fetched []chan *bytes.Buffer
+	if firstFetch <= endChunkNum {
+		fetched = cfile.fetchChunks(ctx, firstFetch, endChunkNum)
+	}
+
 	//for i, _ := range cfile.chunks[beginChunkNum : endChunkNum+1] {
 	for i := 0; i < len(cfile.chunks[beginChunkNum:endChunkNum+1]); i++ {
 		index := i + beginChunkNum
@@ -1082,23 +1642,30 @@ func (cfile *CFile) Read(handleID fuse.HandleID, data *[]byte, offset int64, rea
 		} else {
 			eachReadLen = int64(cfile.chunks[index].ChunkSize) - curOffset
 		}
-		if len(cfile.ReaderMap[handleID].readBuf) == 0 {
-			buffer := new(bytes.Buffer)
-			cfile.ReaderMap[handleID].Ch = make(chan *bytes.Buffer)
-			go cfile.streamread(index, cfile.ReaderMap[handleID].Ch, 0, int64(cfile.chunks[index].ChunkSize))
-			buffer = <-cfile.ReaderMap[handleID].Ch
+		if len(r.readBuf) == 0 {
+			var buffer *bytes.Buffer
+			select {
+			case buffer = <-fetched[index-firstFetch]:
+			case <-ctx.Done():
+				return Interrupted
+			}
 			if buffer.Len() == 0 {
+				if ctx.Err() != nil {
+					return Interrupted
+				}
 				logger.Error("Recv chunk:%v from datanode size:%v , but retsize is 0", index, cfile.chunks[index].ChunkSize)
 				return -1
 			}
-			cfile.ReaderMap[handleID].readBuf = buffer.Next(buffer.Len())
-			buffer.Reset()
-			buffer = nil
-			//logger.Debug("#### Read chunk:%v == bufferlen:%v == curoffset:%v == eachlen:%v ==offset:%v == readsize:%v ####", index, len(cfile.ReaderMap[handleID].readBuf), curOffset, eachReadLen, offset, readsize)
+			// readBuf slices the pooled buffer, no copy until resp.Data
+			r.buf = buffer
+			r.readBuf = buffer.Bytes()
+			r.charged = int64(buffer.Cap())
+			MemCharge(MemRead, r.charged)
+			//logger.Debug("#### Read chunk:%v == bufferlen:%v == curoffset:%v == eachlen:%v ==offset:%v == readsize:%v ####", index, len(r.readBuf), curOffset, eachReadLen, offset, readsize)
 		}
 
-		buflen := int64(len(cfile.ReaderMap[handleID].readBuf))
-		bufcap := int64(cap(cfile.ReaderMap[handleID].readBuf))
+		buflen := int64(len(r.readBuf))
+		bufcap := int64(cap(r.readBuf))
 
 		if curOffset > buflen || curOffset > bufcap {
 			logger.Error("== Read chunk:%v from datanode (offset:%v -- needreadsize:%v) lager than exist (buflen:%v -- bufcap:%v)\n", index, curOffset, eachReadLen, buflen, bufcap)
@@ -1107,15 +1674,15 @@ func (cfile *CFile) Read(handleID fuse.HandleID, data *[]byte, offset int64, rea
 
 		if curOffset+eachReadLen > buflen {
 			eachReadLen = buflen - curOffset
-			*data = append(*data, cfile.ReaderMap[handleID].readBuf[curOffset:curOffset+eachReadLen]...)
+			*data = append(*data, r.readBuf[curOffset:curOffset+eachReadLen]...)
 		} else {
-			*data = append(*data, cfile.ReaderMap[handleID].readBuf[curOffset:curOffset+eachReadLen]...)
+			*data = append(*data, r.readBuf[curOffset:curOffset+eachReadLen]...)
 		}
 
 		curOffset += eachReadLen
-		if curOffset == int64(len(cfile.ReaderMap[handleID].readBuf)) {
+		if curOffset == int64(len(r.readBuf)) {
 			curOffset = 0
-			cfile.ReaderMap[handleID].readBuf = []byte{}
+			r.free()
 		}
 		freesize = freesize - eachReadLen
 		length += eachReadLen
@@ -1126,16 +1693,43 @@ func (cfile *CFile) Read(handleID fuse.HandleID, data *[]byte, offset int64, rea
 // Write ...
 func (cfile *CFile) Write(buf []byte, len int32) int32 {
 
+	if Fenced(cfile.cfs.VolID) {
+		return -2
+	}
+	cfile.cfs.qos.write(int64(len))
+	defer cfile.cfs.lat.write.ObserveSince(time.Now())
+
 	if cfile.Status != 0 {
 		logger.Error("cfile status error , Write func return -2 ")
 		return -2
 	}
 
+	if err := cfile.journalWrite(cfile.FileSize, buf[:len]); err != nil {
+		logger.Error("journal write of %v err:%v", cfile.Name, err)
+		return -2
+	}
+
+	if cfile.appendMode {
+		return cfile.appendWrite(buf[:len])
+	}
+
+	if cfile.inlineMode {
+		if cfile.writeInline(buf[:len]) {
+			if cfile.syncWrite() && cfile.Flush() != 0 {
+				return -2
+			}
+			return len
+		}
+		if ret := cfile.promoteInline(); ret != 0 {
+			return ret
+		}
+	}
+
 	var w int32
 	w = 0
 
 	for w < len {
-		if (cfile.FileSize % chunkSize) == 0 {
+		if (cfile.FileSize%chunkUnit()) == 0 || cfile.wBuffer.chunkInfo == nil {
 			logger.Debug("need a new chunk...")
 			var ret int32
 			ret, cfile.wBuffer.chunkInfo = cfile.AllocateChunk()
@@ -1149,7 +1743,7 @@ func (cfile *CFile) Write(buf []byte, len int32) int32 {
 		}
 		if cfile.wBuffer.freeSize == 0 {
 			cfile.wBuffer.buffer = new(bytes.Buffer)
-			cfile.wBuffer.freeSize = BufferSize
+			cfile.wBuffer.freeSize = cfile.bufSize
 		}
 		if len-w < cfile.wBuffer.freeSize {
 			if len != w {
@@ -1180,6 +1774,15 @@ func (cfile *CFile) Write(buf []byte, len int32) int32 {
 		}
 	}
 
+	cfile.accountWrite()
+	if cfile.syncWrite() || cfile.memFlush() || cfile.journalFull() {
+		// O_SYNC: the data is on the datanodes (fsynced) and synced to the metanode,
+		// over MaxMemory or JournalMax the buffer is sent early
+		if ret := cfile.Flush(); ret != 0 {
+			return -2
+		}
+	}
+
 	return w
 }
 
@@ -1194,24 +1797,50 @@ func (cfile *CFile) push() int32 {
 		return 0
 	}
 	wBuffer := cfile.wBuffer // record cur buffer
+	wBuffer.size = wBuffer.chunkInfo.ChunkSize
 
+	if StripeWidth > 1 {
+		return cfile.pushStripe(&wBuffer)
+	}
 	return cfile.send(&wBuffer)
 }
 
-// Flush ...
+// Flush sends the buffered writes and syncs them to the metanode, the journal of the
+// file is emptied once they are
 func (cfile *CFile) Flush() int32 {
+	ret := cfile.flush()
+	if ret == 0 {
+		cfile.trimJournal()
+	}
+	return ret
+}
+
+func (cfile *CFile) flush() int32 {
 
 	if cfile.Status != 0 {
 		logger.Error("cfile status error , Flush func return err ")
 		return cfile.Status
 	}
+	if cfile.appendMode {
+		return cfile.flushAppend()
+	}
+	if cfile.inlineMode {
+		return cfile.flushInline()
+	}
 	//avoid repeat push for integer file ETC. 64MB , the last push has already done in Write func
 	if cfile.wBuffer.freeSize != 0 && cfile.wBuffer.chunkInfo != nil {
 		wBuffer := cfile.wBuffer
+		wBuffer.size = wBuffer.chunkInfo.ChunkSize
 		cfile.wBuffer.freeSize = 0
-		return cfile.send(&wBuffer)
+		cfile.accountWrite()
+		if StripeWidth <= 1 {
+			return cfile.send(&wBuffer)
+		}
+		if ret := cfile.pushStripe(&wBuffer); ret != 0 {
+			return ret
+		}
 	}
-	return 0
+	return cfile.waitStripes()
 }
 
 // SetChunkStatus ...
@@ -1245,171 +1874,308 @@ func (cfile *CFile) SetChunkStatus(ip string, port int32, blkgrpid uint32, blkid
 
 	return 0
 }
-func (cfile *CFile) writeChunk(ip string, port int32, dc dp.DataNodeClient, req *dp.WriteChunkReq, blkgrpid uint32, copies *int, position int32) {
 
-	if dc == nil {
-		cfile.SetChunkStatus(ip, port, blkgrpid, req.BlockID, req.ChunkID, position, 1)
-		cfile.CurChunkStatus[position] = 1
-	} else {
-		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+// writeChunk sends req to the replica at position once the write sent to it before,
+// prev, is done, and acks the result
+func (cfile *CFile) writeChunk(p *pipeline, ip string, port int32, dc dp.DataNodeClient, conn *grpc.ClientConn, req *dp.WriteChunkReq, blkgrpid uint32, position int32, prev <-chan struct{}, done chan<- struct{}, acks chan<- bool) {
+
+	if prev != nil {
+		<-prev
+	}
+	ok := false
+	if dc != nil {
+		ctx, _ := context.WithTimeout(cfile.cfs.callCtx(), DataOpTimeout.Get())
 		ret, err := dc.WriteChunk(ctx, req)
+		if grpc.Code(err) == codes.PermissionDenied {
+			// fenced off, the replica is fine
+			setFenced(cfile.cfs.VolID)
+			acks <- false
+			close(done)
+			p.wgWriteReps.Add(-1)
+			return
+		}
 		if err != nil {
-			cfile.SetChunkStatus(ip, port, blkgrpid, req.BlockID, req.ChunkID, position, 1)
-			cfile.CurChunkStatus[position] = 1
+			DataConnPool.MarkBroken(conn)
 		} else {
-			if ret.Ret != 0 {
-				cfile.SetChunkStatus(ip, port, blkgrpid, req.BlockID, req.ChunkID, position, 1)
-				cfile.CurChunkStatus[position] = 1
-			} else {
-				*copies = *copies + 1
-			}
+			ok = ret.Ret == 0
 		}
 	}
-	cfile.wgWriteReps.Add(-1)
+	if !ok {
+		cfile.SetChunkStatus(ip, port, blkgrpid, req.BlockID, req.ChunkID, position, 1)
+		p.mu.Lock()
+		if p.CurChunkID == req.ChunkID {
+			p.CurChunkStatus[position] = 1
+		}
+		p.mu.Unlock()
+	}
+	if ok && !req.Sync {
+		cfile.addUnsynced(p, ip, port, position, req)
+	}
+	acks <- ok
+	close(done)
+	p.wgWriteReps.Add(-1)
 
 }
 
+// send writes v to the datanodes and syncs the chunk to the metanode, blocking the writer
 func (cfile *CFile) send(v *wBuffer) int32 {
-
-	dataBuf := v.buffer.Next(v.buffer.Len())
-	copies := 0
-
-	if v.chunkInfo.ChunkID != cfile.CurChunkID {
-		cfile.CurChunkID = v.chunkInfo.ChunkID
-		cfile.CurChunkStatus[0] = 0
-		cfile.CurChunkStatus[1] = 0
-		cfile.CurChunkStatus[2] = 0
+	if ret := cfile.sendOn(&cfile.pipeline, v); ret != 0 {
+		cfile.Status = ret
 	}
+	return cfile.Status
+}
 
-	for i := range v.chunkInfo.BlockGroup.BlockInfos {
-
-		if cfile.CurChunkStatus[i] != 0 {
-			continue
-		}
-
-		ip := utils.InetNtoa(v.chunkInfo.BlockGroup.BlockInfos[i].DataNodeIP).String()
-		port := int(v.chunkInfo.BlockGroup.BlockInfos[i].DataNodePort)
-		addr := ip + ":" + strconv.Itoa(port)
-
-		if addr != cfile.wLastDataNode[i] {
-			if cfile.ConnD[i] != nil {
-				cfile.ConnD[i].Close()
-			}
-			var err error
-			cfile.ConnD[i], err = DialData(addr)
-			if err != nil {
-				logger.Error("send to datanode failed,Dial failed:%v\n", err)
-				cfile.Dc[i] = nil
-				cfile.wLastDataNode[i] = addr
-			} else {
-				cfile.Dc[i] = dp.NewDataNodeClient(cfile.ConnD[i])
-				cfile.wLastDataNode[i] = addr
-			}
-
-		}
-
-		blockID := v.chunkInfo.BlockGroup.BlockInfos[i].BlockID
-		chunkID := v.chunkInfo.ChunkID
-
-		pWriteChunkReq := &dp.WriteChunkReq{
-			ChunkID: chunkID,
-			BlockID: blockID,
-			Databuf: dataBuf,
-		}
-
-		cfile.wgWriteReps.Add(1)
-		go cfile.writeChunk(ip, v.chunkInfo.BlockGroup.BlockInfos[i].DataNodePort, cfile.Dc[i], pWriteChunkReq, v.chunkInfo.BlockGroup.BlockGroupID, &copies, int32(i))
+// sendOn sends v through the datanode connections of p
+func (cfile *CFile) sendOn(p *pipeline, v *wBuffer) int32 {
 
+	if ret := cfile.writeReplicas(p, v); ret != 0 {
+		return ret
 	}
 
-	cfile.wgWriteReps.Wait()
-
-	if copies < 2 {
-		logger.Error("WriteChunk copies < 2")
-		cfile.Status = 1
-		return cfile.Status
-	}
+	cfile.syncMu.Lock()
+	defer cfile.syncMu.Unlock()
 
 	mc := mp.NewMetaNodeClient(cfile.ConnM)
 	pSyncChunkReq := &mp.SyncChunkReq{
 		ParentInodeID: cfile.ParentInodeID,
 		Name:          cfile.Name,
-		VolID:         cfile.cfs.VolID,
+		VolID:         cfile.cfs.shard(cfile.ParentInodeID),
 	}
 
 	var tmpChunkInfo mp.ChunkInfo
-	tmpChunkInfo.ChunkSize = v.chunkInfo.ChunkSize
+	tmpChunkInfo.ChunkSize = v.size
 	tmpChunkInfo.ChunkID = v.chunkInfo.ChunkID
 	tmpChunkInfo.BlockGroupID = v.chunkInfo.BlockGroup.BlockGroupID
 
-	for i := 0; i < 3; i++ {
-		tmpChunkInfo.Status = append(tmpChunkInfo.Status, cfile.CurChunkStatus[i])
-	}
+	tmpChunkInfo.Status = p.status()
 
 	pSyncChunkReq.ChunkInfo = &tmpChunkInfo
 
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, _ := context.WithTimeout(cfile.cfs.callCtx(), MetaOpTimeout.Get())
 	pSyncChunkAck, err := mc.SyncChunk(ctx, pSyncChunkReq)
 	if err != nil || pSyncChunkAck.Ret != 0 {
 		logger.Error("send SyncChunk Failed :%v\n", pSyncChunkReq.ChunkInfo)
 		cfile.ConnM.Close()
-		var err error
-		time.Sleep(2 * time.Second)
-		cfile.ConnM, err = DialMeta(cfile.cfs.VolID)
+		// the leader may have changed, retry on the new one and keep its conn for the next chunks
+		ret, err := cfile.cfs.retryShard(cfile.ParentInodeID, true, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+			pSyncChunkReq.VolID = volID
+			ctx, _ := context.WithTimeout(cfile.cfs.callCtx(), MetaOpTimeout.Get())
+			ack, err := mc.SyncChunk(ctx, pSyncChunkReq)
+			if err != nil {
+				return -1, err
+			}
+			return ack.Ret, nil
+		})
+		if err != nil || ret != 0 {
+			logger.Error("send SyncChunk Failed again:%v\n", pSyncChunkReq.ChunkInfo)
+			return 1
+		}
+		cfile.ConnM, err = DialMeta(pSyncChunkReq.VolID)
 		if err != nil {
 			logger.Error("Dial failed:%v\n", err)
-			cfile.Status = 1
-			return cfile.Status
-		}
-		mc := mp.NewMetaNodeClient(cfile.ConnM)
-		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-		pSyncChunkAck, err = mc.SyncChunk(ctx, pSyncChunkReq)
-		if err != nil || pSyncChunkAck.Ret != 0 {
-			logger.Error("send SyncChunk Failed again:%v\n", pSyncChunkReq.ChunkInfo)
-			cfile.Status = 1
-			return cfile.Status
+			return 1
 		}
 	}
 
-	chunkNum := len(cfile.chunks)
 	v.chunkInfo.Status = tmpChunkInfo.Status
-	if chunkNum == 0 {
-		cfile.chunks = append(cfile.chunks, v.chunkInfo)
+	// stripes may finish out of order, chunk ids grow with allocation so keep chunks sorted by id
+	n := len(cfile.chunks)
+	for n > 0 && cfile.chunks[n-1].ChunkID > v.chunkInfo.ChunkID {
+		n--
+	}
+	if n > 0 && cfile.chunks[n-1].ChunkID == v.chunkInfo.ChunkID {
+		cfile.chunks[n-1].ChunkSize = v.chunkInfo.ChunkSize
+		cfile.chunks[n-1].Status = v.chunkInfo.Status
 	} else {
-		if cfile.chunks[chunkNum-1].ChunkID == v.chunkInfo.ChunkID {
-			cfile.chunks[chunkNum-1].ChunkSize = v.chunkInfo.ChunkSize
-			cfile.chunks[chunkNum-1].Status = v.chunkInfo.Status
-		} else {
-			cfile.chunks = append(cfile.chunks, v.chunkInfo)
+		cfile.chunks = append(cfile.chunks, nil)
+		copy(cfile.chunks[n+1:], cfile.chunks[n:])
+		cfile.chunks[n] = v.chunkInfo
+	}
+	if cfile.journal != nil {
+		var synced int64
+		for _, c := range cfile.chunks {
+			synced += int64(c.ChunkSize)
 		}
+		cfile.journalSynced(synced)
 	}
-	return cfile.Status
+	return 0
 }
 
-// Sync ...
-func (cfile *CFile) Sync() int32 {
+// writeReplicas writes the data of v to the blocks of its chunk, marking the failed replicas in p.
+// It returns once the write quorum of the volume acked, the other replicas finish behind it.
+func (cfile *CFile) writeReplicas(p *pipeline, v *wBuffer) int32 {
+
+	infos := v.chunkInfo.BlockGroup.BlockInfos
+	quorum := cfile.cfs.writeQuorum()
+
+	p.mu.Lock()
+	if v.chunkInfo.ChunkID != p.CurChunkID {
+		p.CurChunkID = v.chunkInfo.ChunkID
+		for i := range p.CurChunkStatus {
+			p.CurChunkStatus[i] = 0
+			if cfile.notKept(v.chunkInfo, i) {
+				p.CurChunkStatus[i] = replicaNotKept
+			}
+		}
+	}
+	status := p.CurChunkStatus
+	p.mu.Unlock()
+
+	kept := 0
+	for i := range infos {
+		if status[i] != replicaNotKept {
+			kept++
+		}
+	}
+	need := writeAcks(quorum, kept)
+
+	dataBuf := v.buffer.Next(v.buffer.Len())
+	if need < len(infos) {
+		// the buffer takes the next writes while the last replicas still send it
+		dataBuf = append([]byte(nil), dataBuf...)
+	}
+
+	sync := cfile.syncWrite()
+	if quorum == WriteAsync && !sync {
+		if cfile.writePrimary(p, v, dataBuf, status) {
+			return 0
+		}
+		// the primary failed, the others take the write themselves
+		need = writeAcks(WriteMajority, kept)
+		p.mu.Lock()
+		status = p.CurChunkStatus
+		p.mu.Unlock()
+	}
+
+	acks := make(chan bool, len(infos))
+	sent := 0
+	for i := range infos {
+
+		if status[i] != 0 {
+			continue
+		}
+		cfile.sendReplica(p, v, i, cfile.chunkReq(v, i, dataBuf), acks)
+		sent++
+
+	}
+
+	copies, failed := 0, 0
+	for copies < need && sent-failed >= need {
+		if <-acks {
+			copies++
+		} else {
+			failed++
+		}
+	}
+	if sync {
+		// O_SYNC: every replica sent is on its disk before the write returns, the
+		// failed ones are marked for repair
+		for copies+failed < sent {
+			if <-acks {
+				copies++
+			} else {
+				failed++
+			}
+		}
+	}
+
+	if copies < need {
+		logger.Error("WriteChunk copies %v < %v", copies, need)
+		return 1
+	}
 	return 0
 }
 
+// notKept whether the replica i of the chunk is left out by the policy of the file: as
+// recorded for a chunk written before, by the copies of the allocation for a new one
+func (cfile *CFile) notKept(c *mp.ChunkInfoWithBG, i int) bool {
+	if len(c.Status) > 0 {
+		return i < len(c.Status) && c.Status[i] == replicaNotKept
+	}
+	return cfile.replicas > 0 && i >= int(cfile.replicas)
+}
+
+// writePrimary writes dataBuf to the first live replica only, it forwards the data to
+// the others after acking, for the volumes with WriteAsync
+func (cfile *CFile) writePrimary(p *pipeline, v *wBuffer, dataBuf []byte, status [3]int32) bool {
+	primary := -1
+	var forwards []*dp.ForwardReplica
+	for i, bi := range v.chunkInfo.BlockGroup.BlockInfos {
+		if status[i] != 0 {
+			continue
+		}
+		if primary < 0 {
+			primary = i
+			continue
+		}
+		forwards = append(forwards, &dp.ForwardReplica{
+			Addr:     dataNodeKey(bi.DataNodeIP, bi.DataNodePort),
+			BlockID:  bi.BlockID,
+			Position: int32(i),
+		})
+	}
+	if primary < 0 {
+		return false
+	}
+	req := cfile.chunkReq(v, primary, dataBuf)
+	req.Forwards = forwards
+	req.Inode = cfile.Inode
+	acks := make(chan bool, 1)
+	cfile.sendReplica(p, v, primary, req, acks)
+	return <-acks
+}
+
+// chunkReq the write of dataBuf to the replica i of the chunk of v
+func (cfile *CFile) chunkReq(v *wBuffer, i int, dataBuf []byte) *dp.WriteChunkReq {
+	return &dp.WriteChunkReq{
+		ChunkID:      v.chunkInfo.ChunkID,
+		BlockID:      v.chunkInfo.BlockGroup.BlockInfos[i].BlockID,
+		Databuf:      dataBuf,
+		VolID:        cfile.cfs.VolID,
+		BlockGroupID: v.chunkInfo.BlockGroup.BlockGroupID,
+		Sync:         cfile.syncWrite(),
+		Background:   cfile.cfs.Background,
+	}
+}
+
+// sendReplica sends req to the replica i of the chunk of v through p, its ack goes to acks
+func (cfile *CFile) sendReplica(p *pipeline, v *wBuffer, i int, req *dp.WriteChunkReq, acks chan<- bool) {
+	bi := v.chunkInfo.BlockGroup.BlockInfos[i]
+	ip := utils.InetNtoa(bi.DataNodeIP).String()
+	addr := ip + ":" + strconv.Itoa(int(bi.DataNodePort))
+
+	if addr != p.wLastDataNode[i] {
+		DataConnPool.Put(p.ConnD[i])
+		var err error
+		p.ConnD[i], err = DataConnPool.Get(addr)
+		if err != nil {
+			logger.Error("send to datanode failed,Dial failed:%v\n", err)
+			p.Dc[i] = nil
+			p.wLastDataNode[i] = addr
+		} else {
+			p.Dc[i] = dp.NewDataNodeClient(p.ConnD[i])
+			p.wLastDataNode[i] = addr
+		}
+
+	}
+
+	// the writes to a replica go in order, a slow one may still have the last
+	prev, done := p.inflight[i], make(chan struct{})
+	p.inflight[i] = done
+	p.wgWriteReps.Add(1)
+	go cfile.writeChunk(p, ip, bi.DataNodePort, p.Dc[i], p.ConnD[i], req, v.chunkInfo.BlockGroup.BlockGroupID, int32(i), prev, done, acks)
+}
+
 // CloseConns ...
 func (cfile *CFile) CloseConns() {
 
+	cfile.waitStripes()
 	if cfile.ConnM != nil {
 		cfile.ConnM.Close()
 	}
-	if cfile.ConnD[0] != nil {
-		cfile.ConnD[0].Close()
-	}
-	if cfile.ConnD[1] != nil {
-		cfile.ConnD[1].Close()
-	}
-	if cfile.ConnD[2] != nil {
-		cfile.ConnD[2].Close()
-	}
-	cfile.wLastDataNode = [3]string{}
-	cfile.Dc = [3]dp.DataNodeClient{}
-	cfile.CurChunkID = 0
-	cfile.CurChunkStatus = [3]int32{}
+	cfile.pipeline.closeConns()
+	cfile.appendPipe.closeConns()
+	cfile.closeJournal()
 }
 
 // Close ...
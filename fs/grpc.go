@@ -2,9 +2,15 @@ package cfs
 
 import (
 	"errors"
+	"fmt"
+	"github.com/ipdcode/containerfs/logger"
 	mp "github.com/ipdcode/containerfs/proto/mp"
+	"github.com/ipdcode/containerfs/utils"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -38,52 +44,287 @@ func GetLeader(volumeID string) (string, error) {
 		break
 	}
 	if !flag {
+		// the volume may have migrated to metanodes this client was not configured with
+		if ret, vi := GetVolInfo(volumeID); ret == 0 && vi.VolInfo != nil && vi.VolInfo.MetaDomain != "" {
+			if leader, err := leaderAt(vi.VolInfo.MetaDomain, volumeID); err == nil {
+				return leader, nil
+			}
+		}
 		return "", errors.New("Get leader failed")
 	}
 	return leader, nil
 
 }
 
-// DialMeta ...
-func DialMeta(volumeID string) (*grpc.ClientConn, error) {
-	var conn *grpc.ClientConn
-	var err error
-
-	MetaNodeAddr, err = GetLeader(volumeID)
+// leaderAt asks the metanode at addr for the leader of the volume
+func leaderAt(addr string, volumeID string) (string, error) {
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Millisecond*300), grpc.FailOnNonTempDialError(true))
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	conn, err = grpc.Dial(MetaNodeAddr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Millisecond*300), grpc.FailOnNonTempDialError(true))
+	defer conn.Close()
+	mc := mp.NewMetaNodeClient(conn)
+	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	ack, err := mc.GetMetaLeader(ctx, &mp.GetMetaLeaderReq{VolID: volumeID})
 	if err != nil {
+		return "", err
+	}
+	if ack.Ret != 0 {
+		return "", fmt.Errorf("GetMetaLeader ret %v", ack.Ret)
+	}
+	return ack.Leader, nil
+}
+
+// leaders : known metanode leader of each volume, kept up to date by WatchLeader
+// and dropped on a failed dial or a NotLeader answer so the next DialMeta looks it up again
+var leaders = make(map[string]string)
+var leadersMutex sync.RWMutex
+
+func cachedLeader(volumeID string) string {
+	leadersMutex.RLock()
+	defer leadersMutex.RUnlock()
+	return leaders[volumeID]
+}
+
+func setLeader(volumeID string, leader string) {
+	leadersMutex.Lock()
+	leaders[volumeID] = leader
+	MetaNodeAddr = leader
+	leadersMutex.Unlock()
+}
+
+func forgetLeader(volumeID string) {
+	leadersMutex.Lock()
+	delete(leaders, volumeID)
+	leadersMutex.Unlock()
+}
+
+// WatchLeader follows the leader changes of the volume pushed by the metanodes, it never returns
+func WatchLeader(volumeID string) {
+	for i := 0; ; i++ {
+		watchLeader(volumeID, MetaNodePeers[i%len(MetaNodePeers)])
 		time.Sleep(300 * time.Millisecond)
-		MetaNodeAddr, err = GetLeader(volumeID)
+	}
+}
+
+func watchLeader(volumeID string, peer string) {
+	conn, err := grpc.Dial(peer, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Millisecond*300), grpc.FailOnNonTempDialError(true))
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	mc := mp.NewMetaNodeClient(conn)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := mc.WatchLeader(ctx, &mp.WatchLeaderReq{VolID: volumeID})
+	if err != nil {
+		logger.Error("WatchLeader on %v failed :%v", peer, err)
+		return
+	}
+	for {
+		ack, err := stream.Recv()
 		if err != nil {
-			return nil, err
+			logger.Error("WatchLeader on %v broken :%v", peer, err)
+			return
 		}
-		conn, err = grpc.Dial(MetaNodeAddr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Millisecond*300), grpc.FailOnNonTempDialError(true))
-		if err != nil {
+		if ack.Ret == 1 {
+			// election in progress
+			forgetLeader(volumeID)
+			continue
+		}
+		if ack.Ret != 0 {
+			return
+		}
+		if ack.Leader != cachedLeader(volumeID) {
+			logger.Debug("Leader of volume %v changed to %v", volumeID, ack.Leader)
+		}
+		setLeader(volumeID, ack.Leader)
+	}
+}
+
+// MetaCompression grpc compressor ("gzip" or "snappy") for the rpcs to the metanode leader,
+// pays off for big listings and chunk maps over slow links, empty for none
+var MetaCompression string
+
+// DialMeta dials the metanode leader of the volume
+func DialMeta(volumeID string) (*grpc.ClientConn, error) {
+	var conn *grpc.ClientConn
+	var err error
+
+	leader := cachedLeader(volumeID)
+	for i := 0; i < 3; i++ {
+		if i > 0 {
 			time.Sleep(300 * time.Millisecond)
-			MetaNodeAddr, err = GetLeader(volumeID)
+		}
+		if leader == "" {
+			leader, err = GetLeader(volumeID)
 			if err != nil {
 				return nil, err
 			}
-			conn, err = grpc.Dial(MetaNodeAddr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Millisecond*300), grpc.FailOnNonTempDialError(true))
+			setLeader(volumeID, leader)
+		}
+		opts := []grpc.DialOption{grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Millisecond * 300), grpc.FailOnNonTempDialError(true)}
+		if MetaCompression != "" {
+			opts = append(opts, grpc.WithDefaultCallOptions(grpc.UseCompressor(MetaCompression)))
 		}
+		opts = append(opts, utils.FaultDialOptions()...)
+		conn, err = grpc.Dial(leader, opts...)
+		if err == nil {
+			return conn, nil
+		}
+		forgetLeader(volumeID)
+		leader = ""
 	}
 	return conn, err
 }
 
+// MetaRetryTimes : attempts of a metanode op before the error is returned
+var MetaRetryTimes = utils.NewInt(5)
+
+// MetaRetryBackoff : sleep before the first retry, doubled for each next one up to MetaRetryMaxBackoff
+var MetaRetryBackoff = 100 * time.Millisecond
+
+// MetaRetryMaxBackoff ...
+var MetaRetryMaxBackoff = 2 * time.Second
+
+// MetaFrozenWait : how long an op waits out the read-only cutover of a migrating volume
+var MetaFrozenWait = 30 * time.Second
+
+// MetaOpTimeout : deadline of one rpc of a metanode op
+var MetaOpTimeout = utils.NewDuration(5 * time.Second)
+
+// DataOpTimeout : deadline of one rpc to a datanode, a read of a chunk included
+var DataOpTimeout = utils.NewDuration(10 * time.Second)
+
+// MetaRetryBudget : when set a metanode op is retried until it has taken this long,
+// past MetaRetryTimes: a long one waits for the cluster to recover, a short one
+// fails fast. The op then fails with context.DeadlineExceeded.
+var MetaRetryBudget utils.Duration
+
+// SoftGrace : when set the mount is soft, like nfs soft mounts: a metanode op failing
+// for a leader election or a lost metanode is retried for up to SoftGrace, in place of
+// MetaRetryBudget, then fails with utils.Unavailable, EAGAIN to the applications.
+// Without it, the ops failing past their retries return EIO.
+var SoftGrace utils.Duration
+
+// retryBudget how long a metanode op keeps retrying, 0 for MetaRetryTimes attempts
+func retryBudget() time.Duration {
+	if grace := SoftGrace.Get(); grace > 0 {
+		return grace
+	}
+	return MetaRetryBudget.Get()
+}
+
+// retryMeta runs op against the metanode leader of the volume.
+// A NotLeader answer or a failed dial means the op was not applied, so it is retried
+// with exponential backoff after looking up the leader again (DialMeta does GetLeader).
+// grpc errors are retried the same way only for idempotent ops, a failed call may have been applied.
+// A ReadOnly answer is retried for up to MetaFrozenWait, the volume is being migrated.
+func retryMeta(volumeID string, idempotent bool, op func(mc mp.MetaNodeClient) (int32, error)) (int32, error) {
+	return retryMetaCtx(context.Background(), volumeID, idempotent, op)
+}
+
+// retryMetaCtx is retryMeta giving up once ctx is cancelled, with ctx.Err()
+func retryMetaCtx(ctx context.Context, volumeID string, idempotent bool, op func(mc mp.MetaNodeClient) (int32, error)) (int32, error) {
+	parent := ctx
+	if budget := retryBudget(); budget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, budget)
+		defer cancel()
+	}
+	deadline := time.Now().Add(MetaFrozenWait)
+	for {
+		ret, err := retryMetaAttempts(ctx, volumeID, idempotent, op)
+		if err != nil && SoftGrace.Get() > 0 && ctx.Err() != nil && parent.Err() == nil {
+			logger.Error("metanode of volume %v unavailable for %v, op given up", volumeID, SoftGrace.Get())
+			return utils.Unavailable, nil
+		}
+		if err != nil || ret != utils.ReadOnly || time.Now().After(deadline) {
+			return ret, err
+		}
+		forgetLeader(volumeID)
+		if err := sleepCtx(ctx, 500*time.Millisecond); err != nil {
+			return -1, err
+		}
+	}
+}
+
+// sleepCtx sleeps for d, ctx.Err() when ctx is cancelled first
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func retryMetaAttempts(ctx context.Context, volumeID string, idempotent bool, op func(mc mp.MetaNodeClient) (int32, error)) (int32, error) {
+	var ret int32
+	var err error
+	backoff := MetaRetryBackoff
+	for i := 0; i < MetaRetryTimes.Get() || retryBudget() > 0; i++ {
+		if ctx.Err() != nil {
+			return -1, ctx.Err()
+		}
+		if i > 0 {
+			if err := sleepCtx(ctx, backoff); err != nil {
+				return -1, err
+			}
+			backoff *= 2
+			if backoff > MetaRetryMaxBackoff {
+				backoff = MetaRetryMaxBackoff
+			}
+		}
+
+		var conn *grpc.ClientConn
+		conn, err = DialMeta(volumeID)
+		if err != nil {
+			continue
+		}
+		ret, err = op(mp.NewMetaNodeClient(conn))
+		conn.Close()
+		if ctx.Err() != nil {
+			return -1, ctx.Err()
+		}
+		if grpc.Code(err) == codes.PermissionDenied {
+			setFenced(volumeID)
+			return utils.SessionRevoked, nil
+		}
+		if err != nil {
+			forgetLeader(volumeID)
+			if !idempotent {
+				return ret, err
+			}
+			continue
+		}
+		if ret == utils.NotLeader {
+			forgetLeader(volumeID)
+			err = errors.New("metanode is not leader")
+			continue
+		}
+		return ret, nil
+	}
+	return ret, err
+}
+
 // DialData ...
 func DialData(host string) (*grpc.ClientConn, error) {
+	if strings.HasPrefix(host, "unix:") {
+		return dialUnix(host[len("unix:"):])
+	}
 	var conn *grpc.ClientConn
 	var err error
-	conn, err = grpc.Dial(host, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Millisecond*300), grpc.FailOnNonTempDialError(true))
+	opts := append([]grpc.DialOption{grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Millisecond * 300), grpc.FailOnNonTempDialError(true)}, utils.FaultDialOptions()...)
+	conn, err = grpc.Dial(host, opts...)
 	if err != nil {
 		time.Sleep(300 * time.Millisecond)
-		conn, err = grpc.Dial(host, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Millisecond*300), grpc.FailOnNonTempDialError(true))
+		conn, err = grpc.Dial(host, opts...)
 		if err != nil {
 			time.Sleep(300 * time.Millisecond)
-			conn, err = grpc.Dial(host, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Millisecond*300), grpc.FailOnNonTempDialError(true))
+			conn, err = grpc.Dial(host, opts...)
 		}
 	}
 	return conn, err
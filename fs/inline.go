@@ -0,0 +1,94 @@
+package cfs
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"golang.org/x/net/context"
+)
+
+// InlineThreshold files up to this size are stored inline in the metanode inode
+// instead of a chunk in a block group, 0 disables inline data
+var InlineThreshold int32 = 4 * 1024
+
+// WriteInline replaces the content of a chunkless file with data
+func (cfs *CFS) WriteInline(pinode uint64, name string, data []byte) int32 {
+	pWriteInlineReq := &mp.WriteInlineReq{
+		PInode: pinode,
+		Name:   name,
+		Data:   data,
+	}
+	ret, err := cfs.retryShard(pinode, true, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pWriteInlineReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.WriteInline(ctx, pWriteInlineReq)
+		if err != nil {
+			return -1, err
+		}
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("WriteInline failed,grpc func err :%v", err)
+		return -1
+	}
+	return ret
+}
+
+// writeInline appends to the inline data, false when the file would grow past InlineThreshold
+func (cfile *CFile) writeInline(buf []byte) bool {
+	if cfile.FileSize+int64(len(buf)) > int64(InlineThreshold) {
+		return false
+	}
+	cfile.inline = append(cfile.inline, buf...)
+	cfile.FileSize += int64(len(buf))
+	cfile.inlineDirty = true
+	return true
+}
+
+// promoteInline rewrites the inline data of a file that outgrew it through the chunk path,
+// the metanode drops the inline data on the first SyncChunk
+func (cfile *CFile) promoteInline() int32 {
+	data := cfile.inline
+	cfile.inlineMode = false
+	cfile.inline = nil
+	cfile.inlineDirty = false
+	cfile.FileSize = 0
+	if len(data) == 0 {
+		return 0
+	}
+	logger.Debug("promote inline file %v size:%v to chunks", cfile.Name, len(data))
+	if w := cfile.Write(data, int32(len(data))); w != int32(len(data)) {
+		if w < 0 {
+			return w
+		}
+		return -2
+	}
+	return 0
+}
+
+// flushInline stores the inline data on the metanode, falling back to chunks when it refuses
+func (cfile *CFile) flushInline() int32 {
+	if !cfile.inlineDirty {
+		return 0
+	}
+	if ret := cfile.cfs.WriteInline(cfile.ParentInodeID, cfile.Name, cfile.inline); ret == 0 {
+		cfile.inlineDirty = false
+		return 0
+	}
+	if ret := cfile.promoteInline(); ret != 0 {
+		return ret
+	}
+	return cfile.Flush()
+}
+
+// readInline ...
+func (cfile *CFile) readInline(data *[]byte, offset int64, readsize int64) int64 {
+	size := int64(len(cfile.inline))
+	if offset >= size {
+		return 0
+	}
+	if offset+readsize > size {
+		readsize = size - offset
+	}
+	*data = append(*data, cfile.inline[offset:offset+readsize]...)
+	return readsize
+}
@@ -0,0 +1,304 @@
+package cfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ipdcode/containerfs/logger"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The write journal keeps the data written to a file and not yet synced to the
+// metanode in a local file, JournalDir/<volid>-*, so a fuseclient that dies does
+// not lose the writes it acked: the next mount of the volume appends what the file
+// misses. Files are written by appending, a journal is a header with the offset it
+// starts at and the data from there, emptied by each Flush. The header is rewritten
+// in place as the chunks are synced and when the file is renamed, a replay refuses
+// a file changed by another client since. O_APPEND writes are not journaled, the
+// metanode places them. It covers the crash of the client, not of the host: the
+// journal is not fsynced, O_SYNC and fsync are for that.
+
+// JournalDir the dir of the write journals, empty disables them
+var JournalDir string
+
+// JournalMax the bytes a file journals before it is flushed
+var JournalMax int64 = 256 * 1024 * 1024
+
+// journalHeaderLen the header line is padded to it, to be rewritten in place
+const journalHeaderLen = 4096
+
+type journalHeader struct {
+	PInode     uint64
+	Name       string
+	Inode      uint64
+	Generation uint64
+	Offset     int64 // in the file of the data of the journal
+	Synced     int64 // the size of the file the metanode has, up to Offset and the data
+}
+
+type journal struct {
+	f     *os.File
+	start int64 // offset in the file of the data, -1 empty
+	size  int64
+
+	mu  sync.Mutex // the header, the chunk syncs set it
+	hdr journalHeader
+}
+
+// writeHeader rewrites the header of j
+func (j *journal) writeHeader() error {
+	b, err := json.Marshal(&j.hdr)
+	if err != nil {
+		return err
+	}
+	if len(b) >= journalHeaderLen {
+		return fmt.Errorf("journal header of %v too long", j.hdr.Name)
+	}
+	line := bytes.Repeat([]byte{' '}, journalHeaderLen)
+	copy(line, b)
+	line[journalHeaderLen-1] = '\n'
+	_, err = j.f.WriteAt(line, 0)
+	return err
+}
+
+// journalWrite records data written at offset, the part of it the journal has is skipped
+func (cfile *CFile) journalWrite(offset int64, data []byte) error {
+	if JournalDir == "" || cfile.appendMode {
+		return nil
+	}
+	j := cfile.journal
+	if j == nil {
+		f, err := ioutil.TempFile(JournalDir, cfile.cfs.VolID+"-")
+		if err != nil {
+			return err
+		}
+		if err := lockJournal(f); err != nil {
+			os.Remove(f.Name())
+			f.Close()
+			return err
+		}
+		j = &journal{f: f, start: -1}
+		ret, _, info := cfile.cfs.GetInodeInfoDirect(cfile.ParentInodeID, cfile.Name)
+		if ret == 0 && info != nil {
+			j.hdr.Generation = info.Generation
+		}
+		cfile.journal = j
+	}
+	if j.start < 0 {
+		j.mu.Lock()
+		j.hdr.PInode, j.hdr.Name, j.hdr.Inode = cfile.ParentInodeID, cfile.Name, cfile.Inode
+		j.hdr.Offset, j.hdr.Synced = offset, offset
+		err := j.writeHeader()
+		j.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if _, err := j.f.Seek(journalHeaderLen, io.SeekStart); err != nil {
+			return err
+		}
+		j.start = offset
+	}
+	end := j.start + j.size
+	if offset > end {
+		return fmt.Errorf("journal of %v ends at %v, write at %v", cfile.Name, end, offset)
+	}
+	if skip := end - offset; skip > 0 {
+		// the rewrite of the inline data promoted to chunks
+		if skip >= int64(len(data)) {
+			return nil
+		}
+		data = data[skip:]
+	}
+	n, err := j.f.Write(data)
+	j.size += int64(n)
+	return err
+}
+
+// journalSynced records the size of the file the metanode has after a chunk sync
+func (cfile *CFile) journalSynced(size int64) {
+	j := cfile.journal
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if size <= j.hdr.Synced {
+		return
+	}
+	j.hdr.Synced = size
+	if err := j.writeHeader(); err != nil {
+		logger.Error("journal %v header err:%v", j.f.Name(), err)
+	}
+}
+
+// Renamed moves the open file to name in the dir pinode, for a rename of it, its
+// journal follows it
+func (cfile *CFile) Renamed(pinode uint64, name string) {
+	cfile.ParentInodeID, cfile.Name = pinode, name
+	j := cfile.journal
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.hdr.PInode, j.hdr.Name = pinode, name
+	if err := j.writeHeader(); err != nil {
+		logger.Error("journal %v header err:%v", j.f.Name(), err)
+	}
+}
+
+// journalFull whether the file is to be flushed to bound its journal
+func (cfile *CFile) journalFull() bool {
+	return cfile.journal != nil && cfile.journal.size >= JournalMax
+}
+
+// trimJournal empties the journal of a file synced
+func (cfile *CFile) trimJournal() {
+	j := cfile.journal
+	if j == nil || j.start < 0 {
+		return
+	}
+	err := j.f.Truncate(0)
+	if err == nil {
+		_, err = j.f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		// it keeps growing, a replay skips what the file has
+		logger.Error("trim journal %v err:%v", j.f.Name(), err)
+		return
+	}
+	j.start, j.size = -1, 0
+}
+
+// closeJournal removes the journal of a file synced, one with data left is kept for
+// the next mount
+func (cfile *CFile) closeJournal() {
+	j := cfile.journal
+	if j == nil {
+		return
+	}
+	cfile.journal = nil
+	if j.start < 0 {
+		os.Remove(j.f.Name())
+	} else {
+		logger.Error("journal %v of %v kept, %v bytes not synced", j.f.Name(), cfile.Name, j.size)
+	}
+	j.f.Close()
+}
+
+// ReplayJournal appends to the files of the volume what their journals have past
+// their size, the writes of a client that died before syncing them. The journals
+// of a live client are skipped. It returns the number of journals not replayed, they
+// are kept
+func (cfs *CFS) ReplayJournal() int {
+	if JournalDir == "" {
+		return 0
+	}
+	paths, _ := filepath.Glob(filepath.Join(JournalDir, cfs.VolID+"-*"))
+	failed := 0
+	for _, path := range paths {
+		if err := cfs.replayJournal(path); err != nil {
+			logger.Error("replay journal %v err:%v", path, err)
+			failed++
+		}
+	}
+	return failed
+}
+
+func (cfs *CFS) replayJournal(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if lockJournal(f) != nil {
+		return nil
+	}
+	r := bufio.NewReader(f)
+	line, err := r.ReadBytes('\n')
+	if err == io.EOF && len(line) == 0 {
+		return os.Remove(path)
+	}
+	if err != nil {
+		return err
+	}
+	var hdr journalHeader
+	if err := json.Unmarshal(line, &hdr); err != nil {
+		return err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	end := hdr.Offset + st.Size() - int64(len(line))
+
+	// a file removed, replaced or changed by another client is left to the operator
+	ret, inode, info := cfs.GetInodeInfoDirect(hdr.PInode, hdr.Name)
+	if ret == 2 /*ENOENT*/ {
+		return fmt.Errorf("%v is gone, the journal is kept", hdr.Name)
+	}
+	if ret != 0 {
+		return fmt.Errorf("get inode of %v ret %v", hdr.Name, ret)
+	}
+	if inode != hdr.Inode || hdr.Generation != 0 && info.Generation != hdr.Generation {
+		return fmt.Errorf("%v is inode %v now, the journal has %v", hdr.Name, inode, hdr.Inode)
+	}
+	ret, ack := cfs.getFileChunksDirect(hdr.PInode, hdr.Name)
+	if ret != 0 {
+		return fmt.Errorf("get chunks of %v ret %v", hdr.Name, ret)
+	}
+	if ack.Inode != hdr.Inode {
+		return fmt.Errorf("%v is inode %v now, the journal has %v", hdr.Name, ack.Inode, hdr.Inode)
+	}
+	size := int64(len(ack.InlineData))
+	if len(ack.ChunkInfos) > 0 {
+		size = 0
+		for _, v := range ack.ChunkInfos {
+			size += int64(v.ChunkSize)
+		}
+	}
+	if size < hdr.Offset || size < hdr.Synced || size > end {
+		return fmt.Errorf("%v is %v bytes, the journal has %v to %v synced to %v", hdr.Name, size, hdr.Offset, end, hdr.Synced)
+	}
+	if size == end {
+		// synced before the client died
+		return os.Remove(path)
+	}
+	if _, err := r.Discard(int(size - hdr.Offset)); err != nil {
+		return err
+	}
+
+	ret, cfile := cfs.OpenFileDirect(hdr.PInode, hdr.Name, os.O_WRONLY)
+	if ret != 0 {
+		return fmt.Errorf("open %v ret %v", hdr.Name, ret)
+	}
+	defer cfile.CloseConns()
+	buf := make([]byte, BufferSize.Get())
+	var n int64
+	for {
+		k, err := io.ReadFull(r, buf)
+		if k > 0 {
+			if cfile.Write(buf[:k], int32(k)) != int32(k) {
+				return fmt.Errorf("write %v failed", hdr.Name)
+			}
+			n += int64(k)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if ret := cfile.Flush(); ret != 0 {
+		return fmt.Errorf("flush %v ret %v", hdr.Name, ret)
+	}
+	logger.Info("journal %v: %v bytes appended to %v", path, n, hdr.Name)
+	return os.Remove(path)
+}
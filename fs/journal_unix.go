@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package cfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockJournal fails while another client holds the journal
+func lockJournal(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
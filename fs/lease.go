@@ -0,0 +1,98 @@
+package cfs
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"golang.org/x/net/context"
+	"time"
+)
+
+// LeaseClientID identifies this client in the metanode lease table, empty disables leases
+var LeaseClientID string
+
+// AcquireLease blocks until the metanode grants a read or write lease on inode,
+// other clients holding a conflicting one are asked to give it back first
+func (cfs *CFS) AcquireLease(inode uint64, write bool) int32 {
+	pAcquireLeaseReq := &mp.AcquireLeaseReq{
+		VolID:    cfs.VolID,
+		Inode:    inode,
+		ClientID: LeaseClientID,
+		Write:    write,
+	}
+	ret, err := retryMetaCtx(cfs.callCtx(), cfs.VolID, true, func(mc mp.MetaNodeClient) (int32, error) {
+		ctx, _ := context.WithTimeout(cfs.callCtx(), 15*time.Second)
+		ack, err := mc.AcquireLease(ctx, pAcquireLeaseReq)
+		if err != nil {
+			return -1, err
+		}
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("AcquireLease failed,grpc func err :%v", err)
+		return -1
+	}
+	return ret
+}
+
+// ReleaseLease ...
+func (cfs *CFS) ReleaseLease(inode uint64) int32 {
+	pReleaseLeaseReq := &mp.ReleaseLeaseReq{
+		VolID:    cfs.VolID,
+		Inode:    inode,
+		ClientID: LeaseClientID,
+	}
+	ret, err := retryMetaCtx(cfs.callCtx(), cfs.VolID, true, func(mc mp.MetaNodeClient) (int32, error) {
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.ReleaseLease(ctx, pReleaseLeaseReq)
+		if err != nil {
+			return -1, err
+		}
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("ReleaseLease failed,grpc func err :%v", err)
+		return -1
+	}
+	return ret
+}
+
+// WatchLeases calls fn with each inode whose lease the metanode revokes, and with 0
+// when the stream broke: a new leader knows no leases so all of them are lost.
+// It never returns.
+func WatchLeases(volumeID string, fn func(inode uint64)) {
+	for {
+		if watchLeases(volumeID, fn) {
+			fn(0)
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+}
+
+// watchLeases follows one stream, true once it was established
+func watchLeases(volumeID string, fn func(inode uint64)) bool {
+	conn, err := DialMeta(volumeID)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	mc := mp.NewMetaNodeClient(conn)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := mc.WatchLeases(ctx, &mp.WatchLeasesReq{VolID: volumeID, ClientID: LeaseClientID})
+	if err != nil {
+		logger.Error("WatchLeases of %v failed :%v", volumeID, err)
+		return false
+	}
+	for {
+		ack, err := stream.Recv()
+		if err != nil {
+			logger.Debug("WatchLeases of %v broken :%v", volumeID, err)
+			return true
+		}
+		if ack.Ret != 0 {
+			forgetLeader(volumeID)
+			return true
+		}
+		fn(ack.Inode)
+	}
+}
@@ -0,0 +1,90 @@
+package cfs
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"golang.org/x/net/context"
+	"strings"
+)
+
+// SetLifecycle the lifecycle rules of the dir name of pinode, as delete:30d,archive:7d,
+// none drops them. The root is pinode 0 with an empty name.
+func (cfs *CFS) SetLifecycle(pinode uint64, name string, rules string) int32 {
+	pSetLifecycleReq := &mp.SetLifecycleReq{
+		PInode:    pinode,
+		Name:      name,
+		Lifecycle: rules,
+	}
+	ret, err := cfs.retryShard(pinode, false, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pSetLifecycleReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.SetLifecycle(ctx, pSetLifecycleReq)
+		if err != nil {
+			return -1, err
+		}
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("SetLifecycle failed,grpc func err :%v", err)
+		return -1
+	}
+	return ret
+}
+
+// GetLifecycle the lifecycle rules of the dir name of pinode, empty when it has none
+func (cfs *CFS) GetLifecycle(pinode uint64, name string) (int32, string) {
+	pGetLifecycleReq := &mp.GetLifecycleReq{
+		PInode: pinode,
+		Name:   name,
+	}
+	var rules string
+	ret, err := cfs.retryShard(pinode, true, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pGetLifecycleReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.GetLifecycle(ctx, pGetLifecycleReq)
+		if err != nil {
+			return -1, err
+		}
+		rules = ack.Lifecycle
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("GetLifecycle failed,grpc func err :%v", err)
+		return -1, ""
+	}
+	return ret, rules
+}
+
+// entryOf the parent dir inode and the name of path in the volume, 0 and "" for the root
+func (cfs *CFS) entryOf(path string) (int32, uint64, string) {
+	path = strings.Trim(path, "/")
+	if path == "" || path == "." {
+		return 0, 0, ""
+	}
+	dir, name := "", path
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		dir, name = path[:i], path[i+1:]
+	}
+	ret, pinode := cfs.DirInode(dir)
+	return ret, pinode, name
+}
+
+// SetLifecycle of the dir at path in the volume
+func SetLifecycle(uuid string, path string, rules string) int32 {
+	cfs := OpenFileSystem(uuid)
+	ret, pinode, name := cfs.entryOf(path)
+	if ret != 0 {
+		return ret
+	}
+	return cfs.SetLifecycle(pinode, name, rules)
+}
+
+// GetLifecycle of the dir at path in the volume
+func GetLifecycle(uuid string, path string) (int32, string) {
+	cfs := OpenFileSystem(uuid)
+	ret, pinode, name := cfs.entryOf(path)
+	if ret != 0 {
+		return ret, ""
+	}
+	return cfs.GetLifecycle(pinode, name)
+}
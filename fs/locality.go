@@ -0,0 +1,367 @@
+package cfs
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ipdcode/containerfs/logger"
+	dp "github.com/ipdcode/containerfs/proto/dp"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	vp "github.com/ipdcode/containerfs/proto/vp"
+	"github.com/ipdcode/containerfs/utils"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ShortCircuit reads the replicas on this host from their chunk files, the dir
+// of a block asked to the datanode on its unix socket, see utils.DataNodeSocket
+var ShortCircuit bool
+
+// dataNode a datanode as listed by the volmgr
+type dataNode struct {
+	local  bool
+	labels map[string]string
+}
+
+var topoMu sync.RWMutex
+var topology = make(map[string]*dataNode) // by ip:port
+
+func dataNodeKey(ip int32, port int32) string {
+	return utils.InetNtoa(ip).String() + ":" + strconv.Itoa(int(port))
+}
+
+// LoadTopology the datanodes and their labels from the volmgr, the reads try
+// the replicas close to this client first
+func LoadTopology() int32 {
+	ret, dataNodes := GetDataNodes()
+	if ret != 0 {
+		return ret
+	}
+	topo := make(map[string]*dataNode, len(dataNodes))
+	for _, dn := range dataNodes {
+		topo[dataNodeKey(dn.Ip, dn.Port)] = &dataNode{
+			local:  utils.IsLocalIP(dn.Ip),
+			labels: parseLabels(dn.Labels),
+		}
+	}
+	topoMu.Lock()
+	topology = topo
+	topoMu.Unlock()
+	return 0
+}
+
+// GetDataNodes the datanodes registered with the volmgr and their labels
+func GetDataNodes() (int32, []*vp.DataNodeTopo) {
+	conn, err := DialVolmgr(VolMgrAddr)
+	if err != nil {
+		logger.Error("GetDataNodes failed,Dial to volmgr fail :%v", err)
+		return -1, nil
+	}
+	defer conn.Close()
+	vc := vp.NewVolMgrClient(conn)
+	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	ack, err := vc.GetDataNodes(ctx, &vp.GetDataNodesReq{})
+	if err != nil {
+		logger.Error("GetDataNodes failed,grpc func err :%v", err)
+		return -1, nil
+	}
+	if ack.Ret != 0 {
+		return ack.Ret, nil
+	}
+	return 0, ack.DataNodes
+}
+
+// WatchTopology reloads the topology every interval, for the datanodes added later
+func WatchTopology(interval time.Duration) {
+	for range time.Tick(interval) {
+		LoadTopology()
+	}
+}
+
+// LocalDataNodes the datanodes of the topology on this host
+func LocalDataNodes() []string {
+	topoMu.RLock()
+	defer topoMu.RUnlock()
+	var local []string
+	for k, dn := range topology {
+		if dn.local {
+			local = append(local, k)
+		}
+	}
+	sort.Strings(local)
+	return local
+}
+
+// parseLabels k1=v1,k2=v2
+func parseLabels(s string) map[string]string {
+	labels := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if i := strings.Index(kv, "="); i > 0 {
+			labels[strings.TrimSpace(kv[:i])] = strings.TrimSpace(kv[i+1:])
+		}
+	}
+	return labels
+}
+
+// isLocal the replica is on this host, by the topology or else by its address
+func isLocal(bi *mp.BlockInfo) bool {
+	topoMu.RLock()
+	dn, ok := topology[dataNodeKey(bi.DataNodeIP, bi.DataNodePort)]
+	topoMu.RUnlock()
+	if ok {
+		return dn.local
+	}
+	return utils.IsLocalIP(bi.DataNodeIP)
+}
+
+// read preferences, the replica a read tries first
+const (
+	ReadLocal   = iota // the one on this host, else any
+	ReadNearest        // the one on this host, else the one sharing the most labels, else the fastest to answer
+	ReadPrimary        // the first of the block group, as the writes
+	ReadRandom         // any
+)
+
+// ReadPreference ...
+var ReadPreference = utils.NewInt(ReadNearest)
+
+// ParseReadPreference ...
+func ParseReadPreference(s string) (int, bool) {
+	switch s {
+	case "", "nearest":
+		return ReadNearest, true
+	case "local":
+		return ReadLocal, true
+	case "primary":
+		return ReadPrimary, true
+	case "random":
+		return ReadRandom, true
+	}
+	return ReadNearest, false
+}
+
+// ClientLabels the labels of this client, as zone=a,rack=r1, compared to the
+// ones of the datanodes by ReadNearest, under topoMu
+var ClientLabels map[string]string
+
+// SetClientLabels ...
+func SetClientLabels(s string) {
+	labels := parseLabels(s)
+	topoMu.Lock()
+	ClientLabels = labels
+	topoMu.Unlock()
+}
+
+// rtts the answer time of each datanode, by ip:port, see ProbeLatency
+var rtts = make(map[string]time.Duration)
+
+// sharedLabels the labels of the datanode equal to the ones of this client
+func sharedLabels(dn *dataNode) int {
+	n := 0
+	for k, v := range ClientLabels {
+		if dn.labels[k] == v {
+			n++
+		}
+	}
+	return n
+}
+
+// replicaOrder the replicas of the chunk in the order to read them, per ReadPreference,
+// the ties at random
+func (cfile *CFile) replicaOrder(chunkidx int) []int {
+	idxs := generateRandomNumber(0, 3, 3)
+	infos := cfile.chunks[chunkidx].BlockGroup.BlockInfos
+	pref := ReadPreference.Get()
+	switch pref {
+	case ReadRandom:
+		return idxs
+	case ReadPrimary:
+		sort.Ints(idxs)
+		return idxs
+	}
+
+	type rank struct {
+		local  bool
+		shared int
+		rtt    time.Duration
+	}
+	ranks := make(map[int]rank, len(idxs))
+	topoMu.RLock()
+	for _, i := range idxs {
+		if i >= len(infos) {
+			continue
+		}
+		key := dataNodeKey(infos[i].DataNodeIP, infos[i].DataNodePort)
+		r := rank{rtt: time.Hour}
+		if dn, ok := topology[key]; ok {
+			r.local = dn.local
+			if pref == ReadNearest {
+				r.shared = sharedLabels(dn)
+			}
+		} else {
+			r.local = utils.IsLocalIP(infos[i].DataNodeIP)
+		}
+		if rtt, ok := rtts[key]; ok && pref == ReadNearest {
+			r.rtt = rtt
+		}
+		ranks[i] = r
+	}
+	topoMu.RUnlock()
+	sort.SliceStable(idxs, func(a, b int) bool {
+		ra, rb := ranks[idxs[a]], ranks[idxs[b]]
+		if ra.local != rb.local {
+			return ra.local
+		}
+		if ra.shared != rb.shared {
+			return ra.shared > rb.shared
+		}
+		return ra.rtt < rb.rtt
+	})
+	return idxs
+}
+
+// ProbeLatency times a health check of each datanode every interval, ReadNearest
+// then prefers the fastest when the labels do not tell the replicas apart
+func ProbeLatency(interval time.Duration) {
+	for ; ; time.Sleep(interval) {
+		if ReadPreference.Get() != ReadNearest {
+			continue
+		}
+		topoMu.RLock()
+		addrs := make([]string, 0, len(topology))
+		for k := range topology {
+			addrs = append(addrs, k)
+		}
+		topoMu.RUnlock()
+
+		for _, addr := range addrs {
+			rtt, err := probe(addr)
+			topoMu.Lock()
+			if err != nil {
+				// tried last until it answers again
+				rtts[addr] = time.Hour
+			} else if old, ok := rtts[addr]; ok && old < time.Hour {
+				rtts[addr] = (old*3 + rtt) / 4
+			} else {
+				rtts[addr] = rtt
+			}
+			topoMu.Unlock()
+		}
+	}
+}
+
+func probe(addr string) (time.Duration, error) {
+	conn, err := DataConnPool.Get(addr)
+	if err != nil {
+		return 0, err
+	}
+	defer DataConnPool.Put(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if _, err := dp.NewDataNodeClient(conn).DatanodeHealthCheck(ctx, &dp.DatanodeHealthCheckReq{}); err != nil {
+		DataConnPool.MarkBroken(conn)
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// the unix sockets failing, skipped for a while
+var localDown = make(map[string]time.Time)
+var blockDirs = make(map[string]string) // by socket and block
+var localMu sync.Mutex
+
+const localRetry = time.Minute
+
+var shortCircuitReads int64
+
+// ShortCircuitReads the chunks read from the local chunk files
+func ShortCircuitReads() int64 {
+	return atomic.LoadInt64(&shortCircuitReads)
+}
+
+// dialUnix a datanode on its unix socket
+func dialUnix(sock string) (*grpc.ClientConn, error) {
+	return grpc.Dial(sock, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Millisecond*300),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}))
+}
+
+// blockDir the dir of the chunk files of the block on the datanode of sock
+func blockDir(ctx context.Context, sock string, blockID uint32) (string, error) {
+	key := sock + "/" + strconv.Itoa(int(blockID))
+	localMu.Lock()
+	dir, ok := blockDirs[key]
+	down := time.Since(localDown[sock]) < localRetry
+	localMu.Unlock()
+	if ok {
+		return dir, nil
+	}
+	if down {
+		return "", fmt.Errorf("%v down", sock)
+	}
+
+	conn, err := DataConnPool.Get("unix:" + sock)
+	if err != nil {
+		localMu.Lock()
+		localDown[sock] = time.Now()
+		localMu.Unlock()
+		return "", err
+	}
+	defer DataConnPool.Put(conn)
+	ctx, cancel := context.WithTimeout(ctx, DataOpTimeout.Get())
+	defer cancel()
+	ack, err := dp.NewDataNodeClient(conn).BlockPath(ctx, &dp.BlockPathReq{BlockID: blockID})
+	if err != nil {
+		DataConnPool.MarkBroken(conn)
+		return "", err
+	}
+	if ack.Ret != 0 {
+		return "", fmt.Errorf("BlockPath ret %v", ack.Ret)
+	}
+	localMu.Lock()
+	blockDirs[key] = ack.Path
+	localMu.Unlock()
+	return ack.Path, nil
+}
+
+func forgetBlockDir(sock string, blockID uint32) {
+	localMu.Lock()
+	delete(blockDirs, sock+"/"+strconv.Itoa(int(blockID)))
+	localMu.Unlock()
+}
+
+// readLocal reads size bytes of the chunk at offset from its file on this host
+// into buffer, as StreamReadChunk would send them
+func readLocal(ctx context.Context, bi *mp.BlockInfo, chunkID uint64, offset int64, size int64, buffer *bytes.Buffer) error {
+	sock := utils.DataNodeSocket(bi.DataNodePort)
+	dir, err := blockDir(ctx, sock, bi.BlockID)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(dir + "/chunk-" + strconv.Itoa(int(chunkID)))
+	if err != nil {
+		// the block may have moved to another disk
+		forgetBlockDir(sock, bi.BlockID)
+		return err
+	}
+	defer f.Close()
+	n, err := io.Copy(buffer, io.NewSectionReader(f, offset, size))
+	if err != nil {
+		return err
+	}
+	if n < size {
+		return io.ErrUnexpectedEOF
+	}
+	atomic.AddInt64(&shortCircuitReads, 1)
+	return nil
+}
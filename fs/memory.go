@@ -0,0 +1,194 @@
+package cfs
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The buffers and caches of a client are accounted against one budget so the
+// clients sharing a node cannot grow without bound. Over it the least recently
+// used read buffers are given back first, then the caches of the reclaimers
+// registered by the fuse layer. A writer holding a good part of a buffer waits
+// for the others to give memory back, and sends its buffer early only when they
+// do not: sending each small write on its own would cost a metanode sync each.
+
+// MaxMemory the budget in bytes of the read buffers, write buffers and dirent
+// caches of the client, 0 for none
+var MaxMemory int64
+
+// MemWait how long a writer over MaxMemory waits for the budget before it sends
+// its buffer early
+var MemWait = time.Second
+
+// the kinds of memory accounted against MaxMemory
+const (
+	MemRead    = iota // chunk buffers held by the read states
+	MemWrite          // data buffered by the writers, not yet sent
+	MemDirents        // dirents cached by the fuse layer
+	memKinds
+)
+
+// MemoryStats the bytes accounted against MaxMemory
+type MemoryStats struct {
+	Max       int64
+	Read      int64
+	Write     int64
+	Dirents   int64
+	Reclaims  int64 // times the budget was exceeded
+	Reclaimed int64 // bytes given back for it
+}
+
+var memUsed [memKinds]int64
+var memReclaims, memReclaimed int64
+
+// Memory the bytes accounted now, and the reclaims so far
+func Memory() MemoryStats {
+	return MemoryStats{
+		Max:       MaxMemory,
+		Read:      atomic.LoadInt64(&memUsed[MemRead]),
+		Write:     atomic.LoadInt64(&memUsed[MemWrite]),
+		Dirents:   atomic.LoadInt64(&memUsed[MemDirents]),
+		Reclaims:  atomic.LoadInt64(&memReclaims),
+		Reclaimed: atomic.LoadInt64(&memReclaimed),
+	}
+}
+
+func memUsage() int64 {
+	var n int64
+	for i := range memUsed {
+		n += atomic.LoadInt64(&memUsed[i])
+	}
+	return n
+}
+
+// memOver whether the client is over its budget
+func memOver() bool {
+	return MaxMemory > 0 && memUsage() > MaxMemory
+}
+
+// memWait waits up to MemWait for the client to get under its budget, false
+// when it did not
+func memWait() bool {
+	deadline := time.Now().Add(MemWait)
+	for memOver() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// MemCharge accounts n bytes of kind, a negative n gives them back. Going over
+// MaxMemory reclaims down to 90% of it. The caller holds no lock a reclaimer takes.
+func MemCharge(kind int, n int64) {
+	atomic.AddInt64(&memUsed[kind], n)
+	if n > 0 && memOver() {
+		reclaimMemory()
+	}
+}
+
+var memReclaimers struct {
+	sync.Mutex
+	fns []func(need int64) int64
+}
+
+// RegisterReclaimer adds fn to the reclaimers run over MaxMemory after the read
+// buffers. fn gives back about need bytes, least recently used first, and returns
+// the bytes it gave back.
+func RegisterReclaimer(fn func(need int64) int64) {
+	memReclaimers.Lock()
+	memReclaimers.fns = append(memReclaimers.fns, fn)
+	memReclaimers.Unlock()
+}
+
+var reclaiming int32
+
+func reclaimMemory() {
+	// one reclaim at a time, the others charging meanwhile go on over budget
+	if !atomic.CompareAndSwapInt32(&reclaiming, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&reclaiming, 0)
+
+	need := memUsage() - MaxMemory*9/10
+	if need <= 0 {
+		return
+	}
+	atomic.AddInt64(&memReclaims, 1)
+	memReclaimers.Lock()
+	fns := append([]func(int64) int64{evictReadBufs}, memReclaimers.fns...)
+	memReclaimers.Unlock()
+	for _, fn := range fns {
+		if need <= 0 {
+			break
+		}
+		n := fn(need)
+		atomic.AddInt64(&memReclaimed, n)
+		need -= n
+	}
+}
+
+// evictReadBufs gives back the buffers of the idle read states, least recently
+// used first. The states stay, their next read fetches the chunk again.
+func evictReadBufs(need int64) int64 {
+	type idleBuf struct {
+		cfile   *CFile
+		r       *ReaderInfo
+		lastUse time.Time
+	}
+	var idle []idleBuf
+	readerFiles.Lock()
+	defer readerFiles.Unlock()
+	for cfile := range readerFiles.m {
+		cfile.readersMu.Lock()
+		for _, r := range cfile.readers {
+			if r.busy == 0 && r.charged > 0 {
+				idle = append(idle, idleBuf{cfile, r, r.lastUse})
+			}
+		}
+		cfile.readersMu.Unlock()
+	}
+	sort.Slice(idle, func(i, j int) bool { return idle[i].lastUse.Before(idle[j].lastUse) })
+
+	var n int64
+	for _, v := range idle {
+		if n >= need {
+			break
+		}
+		v.cfile.readersMu.Lock()
+		// used again since
+		if v.r.busy == 0 {
+			n += v.r.charged
+			v.r.free()
+		}
+		v.cfile.readersMu.Unlock()
+	}
+	return n
+}
+
+// memFlush whether the writer of cfile must send its buffer early for the budget:
+// a buffer under a quarter of the buffer is left to fill, a bigger one once the
+// others did not give memory back within MemWait
+func (cfile *CFile) memFlush() bool {
+	if cfile.wCharged < int64(cfile.bufSize)/4 || !memOver() {
+		return false
+	}
+	reclaimMemory()
+	return !memWait()
+}
+
+// accountWrite charges the data buffered by the writer of cfile, a buffer is
+// given back once it is sent
+func (cfile *CFile) accountWrite() {
+	var n int64
+	if cfile.wBuffer.freeSize != 0 && cfile.wBuffer.buffer != nil {
+		n = int64(cfile.wBuffer.buffer.Len())
+	}
+	if n != cfile.wCharged {
+		MemCharge(MemWrite, n-cfile.wCharged)
+		cfile.wCharged = n
+	}
+}
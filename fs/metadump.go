@@ -0,0 +1,212 @@
+package cfs
+
+import (
+	"bufio"
+	"encoding/binary"
+	pbproto "github.com/golang/protobuf/proto"
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"github.com/ipdcode/containerfs/utils"
+	"golang.org/x/net/context"
+	"io"
+	"os"
+	"time"
+)
+
+// A dump file holds the DumpMetaAcks of the metanode as they came, each marshaled
+// behind its length as 4 bytes big endian. The first one is the header.
+
+// restoreMetaBatch records sent per RestoreMeta
+const restoreMetaBatch = 1024
+
+// DumpMeta writes a dump of the namespace of the volume to path, a full one when
+// since is 0, else the changes after since. Returns the applied index to pass as
+// since for the next incremental dump. ret 34 ERANGE: the metanode no longer has
+// all the changes since since, take a full dump.
+func DumpMeta(uuid string, since uint64, path string) (int32, uint64) {
+	conn, err := DialMeta(uuid)
+	if err != nil {
+		logger.Error("DumpMeta failed,Dial to metanode fail :%v", err)
+		return -1, 0
+	}
+	defer conn.Close()
+	mc := mp.NewMetaNodeClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	stream, err := mc.DumpMeta(ctx, &mp.DumpMetaReq{VolID: uuid, Since: since})
+	if err != nil {
+		logger.Error("DumpMeta failed,grpc func err :%v", err)
+		return -1, 0
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		logger.Error("DumpMeta create %v err:%v", tmp, err)
+		return -1, 0
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	var applied uint64
+	for first := true; ; first = false {
+		ack, err := stream.Recv()
+		if err == io.EOF && !first {
+			break
+		}
+		if err != nil {
+			logger.Error("DumpMeta failed,grpc func err :%v", err)
+			return -1, 0
+		}
+		if ack.Ret != 0 {
+			if ack.Ret == utils.NotLeader {
+				forgetLeader(uuid)
+			}
+			return ack.Ret, 0
+		}
+		if first {
+			applied = ack.Applied
+		}
+		if err := writeDumpAck(w, ack); err != nil {
+			logger.Error("DumpMeta write %v err:%v", tmp, err)
+			return -1, 0
+		}
+	}
+	if err := w.Flush(); err != nil {
+		logger.Error("DumpMeta write %v err:%v", tmp, err)
+		return -1, 0
+	}
+	if err := f.Sync(); err != nil {
+		logger.Error("DumpMeta sync %v err:%v", tmp, err)
+		return -1, 0
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		logger.Error("DumpMeta rename %v err:%v", tmp, err)
+		return -1, 0
+	}
+	return 0, applied
+}
+
+func writeDumpAck(w io.Writer, ack *mp.DumpMetaAck) error {
+	data, err := pbproto.Marshal(ack)
+	if err != nil {
+		return err
+	}
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(data)))
+	if _, err := w.Write(l[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func readDumpAck(r io.Reader) (*mp.DumpMetaAck, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(l[:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	ack := &mp.DumpMetaAck{}
+	if err := pbproto.Unmarshal(data, ack); err != nil {
+		return nil, err
+	}
+	return ack, nil
+}
+
+// RestoreMeta replays dump files into the namespace of the volume: a full dump,
+// restored only into an empty namespace, then the incremental dumps taken after it
+// in order. For metadata disaster recovery the namespace is recreated for the
+// same volume, the dumped block groups still point at its blocks.
+func RestoreMeta(uuid string, paths []string) int32 {
+	run := func(idempotent bool, op func(mc mp.MetaNodeClient) (int32, error)) (int32, error) {
+		return retryMeta(uuid, idempotent, op)
+	}
+	var applied uint64
+	for i, path := range paths {
+		ret, header := restoreMetaFile(uuid, run, path, i == 0, applied)
+		if ret != 0 {
+			return ret
+		}
+		applied = header.Applied
+	}
+	return 0
+}
+
+// restoreMetaFile replays one dump through run, first is the full dump and the
+// others must follow on from applied
+func restoreMetaFile(uuid string, run metaRunner, path string, first bool, applied uint64) (int32, *mp.DumpMetaAck) {
+	f, err := os.Open(path)
+	if err != nil {
+		logger.Error("RestoreMeta open %v err:%v", path, err)
+		return -1, nil
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	header, err := readDumpAck(r)
+	if err != nil {
+		logger.Error("RestoreMeta read %v err:%v", path, err)
+		return -1, nil
+	}
+	if first != (header.Since == 0) || (!first && header.Since > applied) {
+		logger.Error("RestoreMeta %v since:%v does not follow on from applied:%v", path, header.Since, applied)
+		return 22 /*EINVAL*/, nil
+	}
+
+	full := first
+	var records []*mp.MetaRecord
+	send := func() int32 {
+		pRestoreMetaReq := &mp.RestoreMetaReq{
+			VolID:   uuid,
+			Full:    full,
+			ChunkID: header.ChunkID,
+			InodeID: header.InodeID,
+			Records: records,
+		}
+		// replaying records is idempotent, but not the empty check of the first batch
+		ret, err := run(!full, func(mc mp.MetaNodeClient) (int32, error) {
+			ctx, _ := context.WithTimeout(context.Background(), 60*time.Second)
+			ack, err := mc.RestoreMeta(ctx, pRestoreMetaReq)
+			if err != nil {
+				return -1, err
+			}
+			return ack.Ret, nil
+		})
+		if err != nil {
+			logger.Error("RestoreMeta failed,grpc func err :%v", err)
+			return -1
+		}
+		full = false
+		records = nil
+		return ret
+	}
+
+	for {
+		ack, err := readDumpAck(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logger.Error("RestoreMeta read %v err:%v", path, err)
+			return -1, nil
+		}
+		for _, rec := range ack.Records {
+			records = append(records, rec)
+			if len(records) >= restoreMetaBatch {
+				if ret := send(); ret != 0 {
+					return ret, nil
+				}
+			}
+		}
+	}
+	// also sent when there are no records left, it raises the ids
+	if ret := send(); ret != 0 {
+		return ret, nil
+	}
+	return 0, header
+}
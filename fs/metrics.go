@@ -0,0 +1,101 @@
+package cfs
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	vp "github.com/ipdcode/containerfs/proto/vp"
+	"github.com/ipdcode/containerfs/utils"
+	"golang.org/x/net/context"
+	"os"
+	"sync"
+	"time"
+)
+
+// latency the op latencies of CFile.Read and CFile.Write on one volume, a mount of
+// a federation serves several
+type latency struct {
+	read  *utils.Histogram
+	write *utils.Histogram
+}
+
+var volLatencies = struct {
+	sync.Mutex
+	m map[string]*latency
+}{m: make(map[string]*latency)}
+
+// volLatency the latencies of volume volID, shared by all its CFS
+func volLatency(volID string) *latency {
+	volLatencies.Lock()
+	defer volLatencies.Unlock()
+	l := volLatencies.m[volID]
+	if l == nil {
+		l = &latency{read: utils.NewHistogram(), write: utils.NewHistogram()}
+		volLatencies.m[volID] = l
+	}
+	return l
+}
+
+// ClientHeartbeat pushes the latency histograms of volID collected since the last heartbeat to volmgr
+func ClientHeartbeat(volID string) int32 {
+	host, _ := os.Hostname()
+	lat := volLatency(volID)
+	pClientHeartbeatReq := &vp.ClientHeartbeatReq{
+		VolID: volID,
+		Host:  host,
+		Histograms: []*vp.LatencyHistogram{
+			{Op: "read", Counts: lat.read.Drain()},
+			{Op: "write", Counts: lat.write.Drain()},
+		},
+	}
+	if m := registeredMount(volID); m != nil {
+		pClientHeartbeatReq.ClientID = m.ClientID
+		pClientHeartbeatReq.ReadOnly = m.ReadOnly
+		pClientHeartbeatReq.MountPoint = m.MountPoint
+	}
+
+	conn, err := DialVolmgr(VolMgrAddr)
+	if err != nil {
+		logger.Error("ClientHeartbeat failed,Dial to volmgr fail :%v", err)
+		restoreHistograms(lat, pClientHeartbeatReq)
+		return -1
+	}
+	defer conn.Close()
+	vc := vp.NewVolMgrClient(conn)
+	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	pClientHeartbeatAck, err := vc.ClientHeartbeat(ctx, pClientHeartbeatReq)
+	if err != nil {
+		logger.Error("ClientHeartbeat failed,grpc func err :%v", err)
+		restoreHistograms(lat, pClientHeartbeatReq)
+		return -1
+	}
+	return pClientHeartbeatAck.Ret
+}
+
+// keep the samples of a failed heartbeat for the next one
+func restoreHistograms(lat *latency, req *vp.ClientHeartbeatReq) {
+	lat.read.Merge(req.Histograms[0].Counts)
+	lat.write.Merge(req.Histograms[1].Counts)
+}
+
+// GetVolLatency ...
+func GetVolLatency(uuid string) (int32, *vp.GetVolLatencyAck) {
+	conn, err := DialVolmgr(VolMgrAddr)
+	if err != nil {
+		logger.Error("GetVolLatency failed,Dial to volmgr fail :%v", err)
+		return -1, nil
+	}
+	defer conn.Close()
+	vc := vp.NewVolMgrClient(conn)
+	pGetVolLatencyReq := &vp.GetVolLatencyReq{
+		UUID: uuid,
+	}
+	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	pGetVolLatencyAck, err := vc.GetVolLatency(ctx, pGetVolLatencyReq)
+	if err != nil {
+		logger.Error("GetVolLatency failed,grpc func err :%v", err)
+		return -1, nil
+	}
+	if pGetVolLatencyAck.Ret != 0 {
+		return pGetVolLatencyAck.Ret, nil
+	}
+	return 0, pGetVolLatencyAck
+}
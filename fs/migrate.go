@@ -0,0 +1,150 @@
+package cfs
+
+import (
+	"fmt"
+	"github.com/ipdcode/containerfs/logger"
+	"io"
+	"os"
+	"strconv"
+	"sync/atomic"
+)
+
+// MigrateSource read-only legacy tree (local dir or nfs path) the mount falls through to,
+// files and dirs missing in the volume are copied in from it on first access. A name
+// removed or renamed away in the volume gets a tombstone, /.migrate/<parent inode>/<name>,
+// and is not copied in again.
+var MigrateSource string
+
+// migrateDir the dir of the tombstones, in the root of the volume
+const migrateDir = ".migrate"
+
+// migratingPrefix the temp names of the copies under way, one left by a crashed
+// client can be removed
+const migratingPrefix = ".migrating-"
+
+var migrateSeq uint64
+
+// MigrateFile copies the local file src into the volume as name under pinode. The copy
+// goes to a temp name that takes name once complete, no one sees a partial file.
+// Returns 0 when the file is in the volume afterwards, also when another client migrated it first.
+func (cfs *CFS) MigrateFile(pinode uint64, name string, src string) int32 {
+	f, err := os.Open(src)
+	if err != nil {
+		logger.Error("MigrateFile open source %v err:%v", src, err)
+		return 2
+	}
+	defer f.Close()
+
+	tmp := fmt.Sprintf("%s%s-%d", migratingPrefix, ClientID, atomic.AddUint64(&migrateSeq, 1))
+	ret, cfile := cfs.CreateFileDirect(pinode, tmp, os.O_WRONLY|os.O_EXCL)
+	if ret != 0 {
+		return ret
+	}
+	ret = cfs.copyIn(cfile, f, src)
+	cfile.CloseConns()
+	if ret == 0 {
+		ret = cfs.RenameNoReplace(pinode, tmp, pinode, name)
+	}
+	if ret != 0 {
+		cfs.DeleteFileDirect(pinode, tmp)
+	}
+	if ret == 17 {
+		// migrated by another client meanwhile
+		return 0
+	}
+	if ret != 0 {
+		logger.Error("MigrateFile %v failed, ret:%v", src, ret)
+		return -1
+	}
+	logger.Debug("MigrateFile %v migrated, size:%v", src, cfile.FileSize)
+	return 0
+}
+
+// copyIn writes the content of f to cfile
+func (cfs *CFS) copyIn(cfile *CFile, f *os.File, src string) int32 {
+	buf := make([]byte, cfile.bufSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if w := cfile.Write(buf[:n], int32(n)); w != int32(n) {
+				logger.Error("MigrateFile write %v to volume failed, ret:%v", src, w)
+				return -1
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logger.Error("MigrateFile read source %v err:%v", src, err)
+			return -1
+		}
+	}
+	return cfile.Flush()
+}
+
+// MigrateDir creates the dir name under pinode for the source dir of the same name
+func (cfs *CFS) MigrateDir(pinode uint64, name string) int32 {
+	ret, _, _ := cfs.CreateDirDirect(pinode, name)
+	if ret == 17 {
+		return 0
+	}
+	return ret
+}
+
+// MigrateRemoved leaves the tombstone of name under pinode, removed or renamed away
+func (cfs *CFS) MigrateRemoved(pinode uint64, name string) int32 {
+	ret, dir := cfs.tombstoneDir(pinode, true)
+	if ret != 0 {
+		return ret
+	}
+	ret, _, _ = cfs.createFileDirect(dir, name)
+	if ret == 17 {
+		return 0
+	}
+	return ret
+}
+
+// MigrateTombstoned whether name under pinode has a tombstone
+func (cfs *CFS) MigrateTombstoned(pinode uint64, name string) bool {
+	ret, dir := cfs.tombstoneDir(pinode, false)
+	if ret != 0 {
+		return false
+	}
+	ret, _, _ = cfs.StatDirect(dir, name)
+	return ret == 0
+}
+
+// MigrateTombstones the names under pinode with a tombstone
+func (cfs *CFS) MigrateTombstones(pinode uint64) map[string]bool {
+	stones := make(map[string]bool)
+	ret, dir := cfs.tombstoneDir(pinode, false)
+	if ret != 0 {
+		return stones
+	}
+	if ret, dirents := cfs.ListDirect(dir); ret == 0 {
+		for _, e := range dirents {
+			stones[e.Name] = true
+		}
+	}
+	return stones
+}
+
+// tombstoneDir the dir of the tombstones of pinode, created when create, 2 (ENOENT)
+// when there is none
+func (cfs *CFS) tombstoneDir(pinode uint64, create bool) (int32, uint64) {
+	var dir uint64
+	for _, name := range []string{migrateDir, strconv.FormatUint(pinode, 10)} {
+		ret, _, inode := cfs.StatDirect(dir, name)
+		if ret == 2 && create {
+			ret, inode, _ = cfs.CreateDirDirect(dir, name)
+			if ret == 17 {
+				ret, _, inode = cfs.StatDirect(dir, name)
+			}
+		}
+		if ret != 0 {
+			return ret, 0
+		}
+		dir = inode
+	}
+	return 0, dir
+}
@@ -0,0 +1,169 @@
+package cfs
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"github.com/ipdcode/containerfs/utils"
+	"golang.org/x/net/context"
+	"strconv"
+	"sync"
+)
+
+// the inodes this client has open by volume, reported to the metanodes with the
+// session and on their first open: a file one of them has open is kept as an orphan
+// when unlinked
+var openInodes = struct {
+	sync.Mutex
+	vols map[string]map[uint64]int
+}{vols: make(map[string]map[uint64]int)}
+
+// reportMu orders the opens added to the reports and the whole reports, a report
+// taken before an open must not replace it on the metanode after it
+var reportMu sync.Mutex
+
+// OrphanName the name of the file inode unlinked while open, in the dir it was
+// unlinked from: its reads and writes go on under it until CloseOrphan
+func OrphanName(inode uint64) string {
+	return "/orphan/" + strconv.FormatUint(inode, 10)
+}
+
+// Opened this client opened inode of the dir pinode, see Closed. The first open is
+// added to the report of the shard of pinode before it returns, the file is kept from
+// then on when another client unlinks it.
+func (cfs *CFS) Opened(pinode uint64, inode uint64) {
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	openInodes.Lock()
+	opens, ok := openInodes.vols[cfs.VolID]
+	if !ok {
+		opens = make(map[uint64]int)
+		openInodes.vols[cfs.VolID] = opens
+	}
+	opens[inode]++
+	first := opens[inode] == 1
+	openInodes.Unlock()
+	if !first {
+		return
+	}
+
+	pReportOpensReq := &mp.ReportOpensReq{ClientID: ClientID, Inodes: []uint64{inode}, Add: true}
+	ret, err := cfs.retryShard(pinode, true, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pReportOpensReq.VolID = volID
+		ctx, _ := context.WithTimeout(context.Background(), MetaOpTimeout.Get())
+		ack, err := mc.ReportOpens(ctx, pReportOpensReq)
+		if err != nil {
+			return -1, err
+		}
+		return ack.Ret, nil
+	})
+	if err != nil || ret != 0 {
+		logger.Error("ReportOpens of inode %v failed, ret:%v err:%v, left to the session heartbeat", inode, ret, err)
+	}
+}
+
+// Closed this client closed inode
+func (cfs *CFS) Closed(inode uint64) {
+	openInodes.Lock()
+	defer openInodes.Unlock()
+	opens := openInodes.vols[cfs.VolID]
+	if opens[inode] <= 1 {
+		delete(opens, inode)
+		return
+	}
+	opens[inode]--
+}
+
+// ReportOpens tells each shard of the volume which inodes this client has open
+func ReportOpens(uuid string) int32 {
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	openInodes.Lock()
+	inodes := make([]uint64, 0, len(openInodes.vols[uuid]))
+	for inode := range openInodes.vols[uuid] {
+		inodes = append(inodes, inode)
+	}
+	openInodes.Unlock()
+
+	n := ShardCount(uuid)
+	for i := int32(0); i < n; i++ {
+		volID := utils.ShardVolID(uuid, i)
+		pReportOpensReq := &mp.ReportOpensReq{VolID: volID, ClientID: ClientID, Inodes: inodes}
+		ret, err := retryMeta(volID, true, func(mc mp.MetaNodeClient) (int32, error) {
+			ctx, _ := context.WithTimeout(context.Background(), MetaOpTimeout.Get())
+			ack, err := mc.ReportOpens(ctx, pReportOpensReq)
+			if err != nil {
+				return -1, err
+			}
+			return ack.Ret, nil
+		})
+		if err != nil {
+			logger.Error("ReportOpens failed,grpc func err :%v", err)
+			return -1
+		}
+		if ret != 0 {
+			return ret
+		}
+	}
+	return 0
+}
+
+// orphanFile asks the metanode to unlink the file but keep it while a client has it
+// open, open when this one has. orphaned is false when none has, the file must be deleted.
+func (cfs *CFS) orphanFile(pinode uint64, name string, open bool) (int32, bool) {
+	pOrphanFileReq := &mp.OrphanFileReq{
+		PInode: pinode,
+		Name:   name,
+	}
+	if open {
+		pOrphanFileReq.ClientID = ClientID
+	}
+	var orphaned bool
+	ret, err := cfs.retryShard(pinode, false, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pOrphanFileReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.OrphanFile(ctx, pOrphanFileReq)
+		if err != nil {
+			return -1, err
+		}
+		orphaned = ack.Orphaned
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("OrphanFile failed,grpc func err :%v", err)
+		return -1, false
+	}
+	return ret, orphaned
+}
+
+// UnlinkOpen unlinks the file name of pinode this client has open, it goes on under
+// OrphanName until CloseOrphan. orphaned is false when the file went to the trash.
+func (cfs *CFS) UnlinkOpen(pinode uint64, name string) (int32, bool) {
+	if ret, trashed := cfs.trashFile(pinode, name); ret != 0 || trashed {
+		return ret, false
+	}
+	return cfs.orphanFile(pinode, name, true)
+}
+
+// CloseOrphan this client closed the orphan inode unlinked from pinode, the metanode
+// reclaims it when no other client has it open
+func (cfs *CFS) CloseOrphan(pinode uint64, inode uint64) int32 {
+	pCloseOrphanReq := &mp.CloseOrphanReq{
+		PInode:   pinode,
+		Inode:    inode,
+		ClientID: ClientID,
+	}
+	ret, err := cfs.retryShard(pinode, true, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pCloseOrphanReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.CloseOrphan(ctx, pCloseOrphanReq)
+		if err != nil {
+			return -1, err
+		}
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("CloseOrphan failed,grpc func err :%v", err)
+		return -1
+	}
+	return ret
+}
@@ -0,0 +1,76 @@
+package cfs
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"golang.org/x/net/context"
+)
+
+// SetPolicy the storage policy of the file or dir name of pinode, as replicas=2,tier=ssd,
+// none drops it. It applies to the data written afterwards, the new entries of a dir
+// take it. EINVAL for a bad policy, ENOTSUP for erasure coding (ec=).
+func (cfs *CFS) SetPolicy(pinode uint64, name string, policy string) int32 {
+	pSetPolicyReq := &mp.SetPolicyReq{
+		PInode: pinode,
+		Name:   name,
+		Policy: policy,
+	}
+	ret, err := cfs.retryShard(pinode, true, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pSetPolicyReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.SetPolicy(ctx, pSetPolicyReq)
+		if err != nil {
+			return -1, err
+		}
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("SetPolicy failed,grpc func err :%v", err)
+		return -1
+	}
+	return ret
+}
+
+// GetPolicy the storage policy of the file or dir name of pinode, empty when it has none
+func (cfs *CFS) GetPolicy(pinode uint64, name string) (int32, string) {
+	pGetPolicyReq := &mp.GetPolicyReq{
+		PInode: pinode,
+		Name:   name,
+	}
+	var policy string
+	ret, err := cfs.retryShard(pinode, true, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pGetPolicyReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.GetPolicy(ctx, pGetPolicyReq)
+		if err != nil {
+			return -1, err
+		}
+		policy = ack.Policy
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("GetPolicy failed,grpc func err :%v", err)
+		return -1, ""
+	}
+	return ret, policy
+}
+
+// SetPolicy of the file or dir at path in the volume
+func SetPolicy(uuid string, path string, policy string) int32 {
+	cfs := OpenFileSystem(uuid)
+	ret, pinode, name := cfs.entryOf(path)
+	if ret != 0 {
+		return ret
+	}
+	return cfs.SetPolicy(pinode, name, policy)
+}
+
+// GetPolicy of the file or dir at path in the volume
+func GetPolicy(uuid string, path string) (int32, string) {
+	cfs := OpenFileSystem(uuid)
+	ret, pinode, name := cfs.entryOf(path)
+	if ret != 0 {
+		return ret, ""
+	}
+	return cfs.GetPolicy(pinode, name)
+}
@@ -0,0 +1,84 @@
+package cfs
+
+import (
+	"sync"
+	"time"
+)
+
+// QoSLimits caps the IO of one volume from this client, 0 is unlimited
+type QoSLimits struct {
+	ReadMBps  int
+	WriteMBps int
+	ReadIOPS  int
+	WriteIOPS int
+}
+
+// VolQoS the limits of the volumes opened by OpenFileSystem
+var VolQoS QoSLimits
+
+// tokenBucket lets rate tokens a second through with a burst of one second.
+// A take larger than what is left goes into debt and waits it out, so a big
+// request is never refused.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) setRate(rate int64) {
+	b.mu.Lock()
+	b.rate = float64(rate)
+	b.tokens = b.rate
+	b.last = time.Now()
+	b.mu.Unlock()
+}
+
+// take waits until n tokens are available
+func (b *tokenBucket) take(n int64) {
+	b.mu.Lock()
+	if b.rate <= 0 {
+		b.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+type qos struct {
+	readBytes  tokenBucket
+	writeBytes tokenBucket
+	readOps    tokenBucket
+	writeOps   tokenBucket
+}
+
+// SetQoS changes the limits of the volume, taking effect on the next IO
+func (cfs *CFS) SetQoS(l QoSLimits) {
+	cfs.qos.readBytes.setRate(int64(l.ReadMBps) * 1024 * 1024)
+	cfs.qos.writeBytes.setRate(int64(l.WriteMBps) * 1024 * 1024)
+	cfs.qos.readOps.setRate(int64(l.ReadIOPS))
+	cfs.qos.writeOps.setRate(int64(l.WriteIOPS))
+}
+
+func (q *qos) read(size int64) {
+	q.readOps.take(1)
+	q.readBytes.take(size)
+}
+
+func (q *qos) write(size int64) {
+	q.writeOps.take(1)
+	q.writeBytes.take(size)
+}
@@ -0,0 +1,119 @@
+package cfs
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	vp "github.com/ipdcode/containerfs/proto/vp"
+	"golang.org/x/net/context"
+	"sync"
+	"time"
+)
+
+// write quorums of a volume, the replicas a chunk write waits for before it returns,
+// the others finish behind it and are marked failed for repair if they do not make it
+const (
+	WriteAll      = 0 // every replica, one node down fails the writes
+	WriteOne      = 1 // the fastest, a lost node may lose the last writes
+	WriteAsync    = 2 // the primary only, it writes the others behind: scratch volumes
+	WriteMajority = 3 // two of three
+)
+
+// ParseWriteQuorum one, quorum, all or async
+func ParseWriteQuorum(s string) (int32, bool) {
+	switch s {
+	case "quorum", "majority":
+		return WriteMajority, true
+	case "one":
+		return WriteOne, true
+	case "all":
+		return WriteAll, true
+	case "async":
+		return WriteAsync, true
+	}
+	return WriteAll, false
+}
+
+// SetVolWriteQuorum : the replicas the writes of the volume wait for, the clients
+// pick it up within quorumRefresh
+func SetVolWriteQuorum(uuid string, quorum int32) int32 {
+	conn, err := DialVolmgr(VolMgrAddr)
+	if err != nil {
+		logger.Error("SetVolWriteQuorum failed,Dial to volmgr fail :%v", err)
+		return -1
+	}
+	defer conn.Close()
+	vc := vp.NewVolMgrClient(conn)
+	pSetVolWriteQuorumReq := &vp.SetVolWriteQuorumReq{
+		UUID:        uuid,
+		WriteQuorum: quorum,
+	}
+	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	pSetVolWriteQuorumAck, err := vc.SetVolWriteQuorum(ctx, pSetVolWriteQuorumReq)
+	if err != nil {
+		logger.Error("SetVolWriteQuorum failed,grpc func err :%v", err)
+		return -1
+	}
+	if pSetVolWriteQuorumAck.Ret != 0 {
+		logger.Error("SetVolWriteQuorum failed,grpc func ret :%v", pSetVolWriteQuorumAck.Ret)
+		return pSetVolWriteQuorumAck.Ret
+	}
+	return 0
+}
+
+const quorumRefresh = time.Minute
+
+// volQuorum the write quorum of a volume as last read from the volmgr
+type volQuorum struct {
+	quorum     int32
+	at         time.Time
+	refreshing bool
+}
+
+var quorumMu sync.Mutex
+var quorums = make(map[string]*volQuorum)
+
+// writeQuorum the write quorum of the volume, read from the volmgr on the first
+// write and refreshed behind the writes after
+func (cfs *CFS) writeQuorum() int32 {
+	quorumMu.Lock()
+	vq, ok := quorums[cfs.VolID]
+	if !ok {
+		quorumMu.Unlock()
+		return loadWriteQuorum(cfs.VolID)
+	}
+	if !vq.refreshing && time.Since(vq.at) > quorumRefresh {
+		vq.refreshing = true
+		go loadWriteQuorum(cfs.VolID)
+	}
+	q := vq.quorum
+	quorumMu.Unlock()
+	return q
+}
+
+// loadWriteQuorum keeps the last one known when the volmgr does not answer
+func loadWriteQuorum(volID string) int32 {
+	ret, vi := GetVolInfo(volID)
+	quorumMu.Lock()
+	defer quorumMu.Unlock()
+	vq, ok := quorums[volID]
+	if !ok {
+		vq = &volQuorum{}
+		quorums[volID] = vq
+	}
+	if ret == 0 && vi.VolInfo != nil {
+		vq.quorum = vi.VolInfo.WriteQuorum
+	}
+	vq.at = time.Now()
+	vq.refreshing = false
+	return vq.quorum
+}
+
+// writeAcks the acks a write to n replicas waits for
+func writeAcks(quorum int32, n int) int {
+	switch quorum {
+	case WriteOne, WriteAsync:
+		return 1
+	case WriteMajority:
+		return n/2 + 1
+	}
+	return n
+}
@@ -0,0 +1,166 @@
+package cfs
+
+import (
+	"github.com/ipdcode/containerfs/utils"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The read state of a handle holds a chunk buffer from the pool until the handle
+// is released. A handle never released, or one idle for long, would keep it for
+// the life of the file, the reader GC gives those buffers back. Over MaxMemory
+// the buffers of the idle states go back early, see memory.go.
+
+// ReaderIdle a read state unused this long is collected, 0 keeps them until the
+// release of their handle
+var ReaderIdle = utils.NewDuration(5 * time.Minute)
+
+// ReaderStats counts the read states of the handles
+type ReaderStats struct {
+	Live      int64 // held now
+	Released  int64 // dropped by the release of their handle
+	Collected int64 // dropped by the GC after ReaderIdle
+}
+
+var readerStats ReaderStats
+
+// Readers the counts of the read states
+func Readers() ReaderStats {
+	return ReaderStats{
+		Live:      atomic.LoadInt64(&readerStats.Live),
+		Released:  atomic.LoadInt64(&readerStats.Released),
+		Collected: atomic.LoadInt64(&readerStats.Collected),
+	}
+}
+
+// the cfiles holding read states
+var readerFiles = struct {
+	sync.Mutex
+	on bool // the GC runs
+	m  map[*CFile]bool
+}{m: make(map[*CFile]bool)}
+
+// reader the read state of the handle, made on its first read. The state is busy
+// for the GC until done.
+func (cfile *CFile) reader(handleID HandleID) *ReaderInfo {
+	cfile.readersMu.Lock()
+	r, ok := cfile.readers[handleID]
+	if !ok {
+		r = &ReaderInfo{}
+		cfile.readers[handleID] = r
+		atomic.AddInt64(&readerStats.Live, 1)
+	}
+	r.busy++
+	r.lastUse = time.Now()
+	cfile.readersMu.Unlock()
+
+	if !ok {
+		readerFiles.Lock()
+		readerFiles.m[cfile] = true
+		readerFiles.Unlock()
+	}
+	return r
+}
+
+func (cfile *CFile) doneReader(r *ReaderInfo) {
+	cfile.readersMu.Lock()
+	r.busy--
+	r.lastUse = time.Now()
+	if r.busy == 0 && r.dropped {
+		// released while reading
+		r.free()
+	}
+	cfile.readersMu.Unlock()
+}
+
+func (r *ReaderInfo) free() {
+	r.readBuf = nil
+	putChunkBuf(r.buf)
+	r.buf = nil
+	if r.charged != 0 {
+		MemCharge(MemRead, -r.charged)
+		r.charged = 0
+	}
+}
+
+// ReleaseReader drops the read state of the released handle
+func (cfile *CFile) ReleaseReader(handleID HandleID) {
+	cfile.readersMu.Lock()
+	r, ok := cfile.readers[handleID]
+	if !ok {
+		cfile.readersMu.Unlock()
+		return
+	}
+	delete(cfile.readers, handleID)
+	r.dropped = true
+	if r.busy == 0 {
+		r.free()
+	}
+	empty := len(cfile.readers) == 0
+	cfile.readersMu.Unlock()
+	atomic.AddInt64(&readerStats.Live, -1)
+	atomic.AddInt64(&readerStats.Released, 1)
+
+	if empty {
+		// readerFiles is locked before readersMu
+		readerFiles.Lock()
+		cfile.readersMu.Lock()
+		if len(cfile.readers) == 0 {
+			delete(readerFiles.m, cfile)
+		}
+		cfile.readersMu.Unlock()
+		readerFiles.Unlock()
+	}
+}
+
+// collectReaders drops the read states unused for idle, a later read of their
+// handle starts over with a new one. Returns whether the cfile has none left.
+func (cfile *CFile) collectReaders(idle time.Duration) bool {
+	cfile.readersMu.Lock()
+	defer cfile.readersMu.Unlock()
+	for h, r := range cfile.readers {
+		if r.busy > 0 || time.Since(r.lastUse) < idle {
+			continue
+		}
+		delete(cfile.readers, h)
+		r.dropped = true
+		r.free()
+		atomic.AddInt64(&readerStats.Live, -1)
+		atomic.AddInt64(&readerStats.Collected, 1)
+	}
+	return len(cfile.readers) == 0
+}
+
+// StartReaderGC collects the read states idle for ReaderIdle, every ReaderIdle/2
+func StartReaderGC() {
+	if ReaderIdle.Get() <= 0 {
+		return
+	}
+	readerFiles.Lock()
+	if readerFiles.on {
+		readerFiles.Unlock()
+		return
+	}
+	readerFiles.on = true
+	readerFiles.Unlock()
+
+	go func() {
+		for {
+			idle := ReaderIdle.Get()
+			if idle <= 0 {
+				// off since a reload
+				time.Sleep(time.Minute)
+				continue
+			}
+			time.Sleep(idle / 2)
+			readerFiles.Lock()
+			for cfile := range readerFiles.m {
+				if cfile.collectReaders(idle) {
+					delete(readerFiles.m, cfile)
+				}
+			}
+			readerFiles.Unlock()
+		}
+	}()
+}
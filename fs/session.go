@@ -0,0 +1,238 @@
+package cfs
+
+import (
+	"fmt"
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"github.com/ipdcode/containerfs/utils"
+	"golang.org/x/net/context"
+	"os"
+	"sync"
+	"time"
+)
+
+// ClientID identifies this mount in the sessions of the metanodes, and in their
+// lease table when leases are on. The metanodes and the datanodes fence the
+// clients by it, every process has one.
+var ClientID = newClientID()
+
+func newClientID() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano())
+}
+
+// the volumes this client was fenced off or evicted from
+var fencedVols = make(map[string]bool)
+var fencedVolsMutex sync.RWMutex
+
+func setFenced(volID string) {
+	uuid, _ := utils.ParseShardVolID(volID)
+	fencedVolsMutex.Lock()
+	defer fencedVolsMutex.Unlock()
+	if !fencedVols[uuid] {
+		logger.Error("client %v fenced off volume %v, its I/O fails from now on", ClientID, uuid)
+		fencedVols[uuid] = true
+	}
+}
+
+// Fenced whether this client was fenced off or evicted from the volume, its reads
+// and writes fail with EIO, remounting gives a new ClientID
+func Fenced(volID string) bool {
+	fencedVolsMutex.RLock()
+	defer fencedVolsMutex.RUnlock()
+	return fencedVols[volID]
+}
+
+// SessionHeartbeatInterval how often keepSession heartbeats, well within the
+// session ttl of the metanodes
+var SessionHeartbeatInterval = 10 * time.Second
+
+// ReplicaWriter this client is the replication agent: the metanodes refuse the
+// writes to a replica volume of all the other clients
+var ReplicaWriter bool
+
+// OpenSession registers this client as mounting the volume at mountPoint, on each of
+// its shards. A read-write session gets 30 (EROFS) on a ROX volume, 16 (EBUSY) on an
+// RWO volume another host writes, 11 (EAGAIN) while a new metanode leader waits for
+// the sessions to be opened again.
+func OpenSession(volID string, mountPoint string, readOnly bool) int32 {
+	host, _ := os.Hostname()
+	n := shardMap(volID).Count()
+	for i := int32(0); i < n; i++ {
+		pOpenSessionReq := &mp.OpenSessionReq{
+			VolID: utils.ShardVolID(volID, i),
+			Session: &mp.SessionInfo{
+				ClientID:      ClientID,
+				Host:          host,
+				MountPoint:    mountPoint,
+				ReadOnly:      readOnly,
+				ReplicaWriter: ReplicaWriter,
+			},
+		}
+		ret, err := retryMeta(pOpenSessionReq.VolID, true, func(mc mp.MetaNodeClient) (int32, error) {
+			ctx, _ := context.WithTimeout(context.Background(), MetaOpTimeout.Get())
+			ack, err := mc.OpenSession(ctx, pOpenSessionReq)
+			if err != nil {
+				return -1, err
+			}
+			return ack.Ret, nil
+		})
+		if err != nil {
+			logger.Error("OpenSession failed,grpc func err :%v", err)
+			return -1
+		}
+		if ret != 0 {
+			return ret
+		}
+	}
+	return 0
+}
+
+// SessionHeartbeat keeps the session of this client on each shard, ret 2 when a
+// metanode lost it
+func SessionHeartbeat(volID string, opens int64) int32 {
+	n := shardMap(volID).Count()
+	for i := int32(0); i < n; i++ {
+		pSessionHeartbeatReq := &mp.SessionHeartbeatReq{
+			VolID:    utils.ShardVolID(volID, i),
+			ClientID: ClientID,
+			Opens:    opens,
+		}
+		ret, err := retryMeta(pSessionHeartbeatReq.VolID, true, func(mc mp.MetaNodeClient) (int32, error) {
+			ctx, _ := context.WithTimeout(context.Background(), MetaOpTimeout.Get())
+			ack, err := mc.SessionHeartbeat(ctx, pSessionHeartbeatReq)
+			if err != nil {
+				return -1, err
+			}
+			return ack.Ret, nil
+		})
+		if err != nil {
+			logger.Error("SessionHeartbeat failed,grpc func err :%v", err)
+			return -1
+		}
+		if ret != 0 {
+			return ret
+		}
+	}
+	return 0
+}
+
+// CloseSession ends the session of clientID, revoke keeps it from opening another
+func CloseSession(volID string, clientID string, revoke bool) int32 {
+	pCloseSessionReq := &mp.CloseSessionReq{
+		VolID:    volID,
+		ClientID: clientID,
+		Revoke:   revoke,
+	}
+	ret, err := retryMeta(volID, true, func(mc mp.MetaNodeClient) (int32, error) {
+		ctx, _ := context.WithTimeout(context.Background(), MetaOpTimeout.Get())
+		ack, err := mc.CloseSession(ctx, pCloseSessionReq)
+		if err != nil {
+			return -1, err
+		}
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("CloseSession failed,grpc func err :%v", err)
+		return -1
+	}
+	return ret
+}
+
+// ListSessions the clients mounting the volume
+func ListSessions(volID string) (int32, []*mp.SessionInfo) {
+	var sessions []*mp.SessionInfo
+	ret, err := retryMeta(volID, true, func(mc mp.MetaNodeClient) (int32, error) {
+		ctx, _ := context.WithTimeout(context.Background(), MetaOpTimeout.Get())
+		ack, err := mc.ListSessions(ctx, &mp.ListSessionsReq{VolID: volID})
+		if err != nil {
+			return -1, err
+		}
+		sessions = ack.Sessions
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("ListSessions failed,grpc func err :%v", err)
+		return -1, nil
+	}
+	return ret, sessions
+}
+
+// StartSession opens the session of this client on the volume before it reads or
+// writes it, waiting out the EAGAIN of a new metanode leader, then keeps it behind,
+// see keepSession. The writes of a client without one are refused on the RWO and
+// ROX volumes.
+func StartSession(volID string, mountPoint string, readOnly bool, opens func() int64, revoked func()) int32 {
+	ret := OpenSession(volID, mountPoint, readOnly)
+	for ret == 11 /*EAGAIN*/ {
+		time.Sleep(SessionHeartbeatInterval)
+		ret = OpenSession(volID, mountPoint, readOnly)
+	}
+	if ret != 0 {
+		return ret
+	}
+	go keepSession(volID, mountPoint, readOnly, true, opens, revoked)
+	return 0
+}
+
+// keepSession heartbeats the session of this client on the volume with the count of
+// open files and their inodes, opening it again when the metanode lost it. It returns
+// once the session is revoked, after calling revoked.
+func keepSession(volID string, mountPoint string, readOnly bool, open bool, opens func() int64, revoked func()) {
+	for {
+		var ret int32
+		if open {
+			ret = SessionHeartbeat(volID, opens())
+		} else {
+			ret = OpenSession(volID, mountPoint, readOnly)
+		}
+		switch ret {
+		case 0:
+			open = true
+			ReportOpens(volID)
+		case 2 /*ENOENT*/ :
+			if open {
+				logger.Error("session of %v on %v lost, opening it again", ClientID, volID)
+				open = false
+				continue
+			}
+			logger.Error("OpenSession of %v on %v ret:%v", ClientID, volID, ret)
+		case utils.SessionRevoked:
+			logger.Error("session of %v on %v revoked", ClientID, volID)
+			setFenced(volID)
+			revoked()
+			return
+		default:
+			logger.Error("session of %v on %v ret:%v", ClientID, volID, ret)
+		}
+		time.Sleep(SessionHeartbeatInterval)
+	}
+}
+
+// FenceVol sets the fence of the volume on each of its shards: while it is on the
+// ops of the clients are refused, the clients mounting it are evicted for good.
+// With clientID only that client is evicted.
+func FenceVol(uuid string, clientID string, fenced bool) int32 {
+	n := ShardCount(uuid)
+	for i := int32(0); i < n; i++ {
+		volID := utils.ShardVolID(uuid, i)
+		pFenceReq := &mp.FenceReq{VolID: volID, ClientID: clientID, Fenced: fenced}
+		ret, err := retryMeta(volID, true, func(mc mp.MetaNodeClient) (int32, error) {
+			ctx, _ := context.WithTimeout(context.Background(), MetaOpTimeout.Get())
+			ack, err := mc.Fence(ctx, pFenceReq)
+			if err != nil {
+				return -1, err
+			}
+			return ack.Ret, nil
+		})
+		if err != nil {
+			logger.Error("Fence failed,grpc func err :%v", err)
+			return -1
+		}
+		if ret != 0 {
+			logger.Error("Fence of %v ret:%v", volID, ret)
+			return ret
+		}
+	}
+	return 0
+}
@@ -0,0 +1,314 @@
+package cfs
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	vp "github.com/ipdcode/containerfs/proto/vp"
+	"github.com/ipdcode/containerfs/utils"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// shardMaps : the shard map of each volume, fetched from the namespace of the volume
+// on first use and again when a shard answers utils.WrongShard
+var shardMaps = make(map[string]utils.ShardMap)
+var shardMapsMutex sync.RWMutex
+
+func shardMap(volumeID string) utils.ShardMap {
+	shardMapsMutex.RLock()
+	m, ok := shardMaps[volumeID]
+	shardMapsMutex.RUnlock()
+	if ok {
+		return m
+	}
+
+	var s string
+	ret, err := retryMeta(volumeID, true, func(mc mp.MetaNodeClient) (int32, error) {
+		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+		ack, err := mc.GetShards(ctx, &mp.GetShardsReq{VolID: volumeID})
+		if err != nil {
+			return -1, err
+		}
+		s = ack.Map
+		return ack.Ret, nil
+	})
+	if err != nil || ret != 0 {
+		// the ops go to the namespace of the volume, it answers WrongShard if need be
+		logger.Error("GetShards of %v failed, ret:%v err:%v", volumeID, ret, err)
+		return utils.ShardMap{}
+	}
+	m, err = utils.ParseShardMap(s)
+	if err != nil {
+		logger.Error("GetShards of %v: %v", volumeID, err)
+		return utils.ShardMap{}
+	}
+	shardMapsMutex.Lock()
+	shardMaps[volumeID] = m
+	shardMapsMutex.Unlock()
+	return m
+}
+
+func forgetShards(volumeID string) {
+	shardMapsMutex.Lock()
+	delete(shardMaps, volumeID)
+	shardMapsMutex.Unlock()
+}
+
+// shard the namespace holding the dentries of the dir inode
+func (cfs *CFS) shard(inode uint64) string {
+	return utils.ShardVolID(cfs.VolID, shardMap(cfs.VolID).Shard(inode))
+}
+
+// retryShard is retryMeta for an op on the dir inode, op sets volID as the VolID of
+// its request. The op goes again to the new shard of the dir after a split.
+func (cfs *CFS) retryShard(inode uint64, idempotent bool, op func(mc mp.MetaNodeClient, volID string) (int32, error)) (int32, error) {
+	for i := 0; ; i++ {
+		volID := cfs.shard(inode)
+		ret, err := retryMetaCtx(cfs.callCtx(), volID, idempotent, func(mc mp.MetaNodeClient) (int32, error) {
+			return op(mc, volID)
+		})
+		if err != nil || ret != utils.WrongShard || i >= 3 {
+			return ret, err
+		}
+		forgetShards(cfs.VolID)
+		if err := sleepCtx(cfs.callCtx(), time.Duration(100<<uint(i))*time.Millisecond); err != nil {
+			return -1, err
+		}
+	}
+}
+
+// AddVolShard : numbers a new shard of the volume in volmgr, returns it and its raft group
+func AddVolShard(uuid string) (int32, int32, uint64) {
+	conn, err := DialVolmgr(VolMgrAddr)
+	if err != nil {
+		logger.Error("AddVolShard failed,Dial to volmgr fail :%v", err)
+		return -1, 0, 0
+	}
+	defer conn.Close()
+	vc := vp.NewVolMgrClient(conn)
+	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	pAddVolShardAck, err := vc.AddVolShard(ctx, &vp.AddVolShardReq{UUID: uuid})
+	if err != nil {
+		logger.Error("AddVolShard failed,grpc func err :%v", err)
+		return -1, 0, 0
+	}
+	if pAddVolShardAck.Ret != 0 {
+		return pAddVolShardAck.Ret, 0, 0
+	}
+	return 0, pAddVolShardAck.Shard, pAddVolShardAck.RaftGroupID
+}
+
+// ShardInfo the load of a shard of the volume and where to split it
+func ShardInfo(uuid string, shard int32) (int32, *mp.ShardInfoAck) {
+	var pShardInfoAck *mp.ShardInfoAck
+	volID := utils.ShardVolID(uuid, shard)
+	ret, err := retryMeta(volID, true, func(mc mp.MetaNodeClient) (int32, error) {
+		ctx, _ := context.WithTimeout(context.Background(), 60*time.Second)
+		ack, err := mc.ShardInfo(ctx, &mp.ShardInfoReq{VolID: volID})
+		if err != nil {
+			return -1, err
+		}
+		pShardInfoAck = ack
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("ShardInfo failed,grpc func err :%v", err)
+		return -1, nil
+	}
+	return ret, pShardInfoAck
+}
+
+// ShardCount the shards of the volume in its shard map
+func ShardCount(uuid string) int32 {
+	forgetShards(uuid)
+	return shardMap(uuid).Count()
+}
+
+// HotShard the shard of the volume serving the most ops over interval, and its ops per second
+func HotShard(uuid string, interval time.Duration) (int32, float64) {
+	n := ShardCount(uuid)
+	before := make([]uint64, n)
+	for i := int32(0); i < n; i++ {
+		if ret, info := ShardInfo(uuid, i); ret == 0 || ret == 22 {
+			before[i] = info.Ops
+		}
+	}
+	time.Sleep(interval)
+	hot, rate := int32(-1), 0.0
+	for i := int32(0); i < n; i++ {
+		ret, info := ShardInfo(uuid, i)
+		if (ret != 0 && ret != 22) || info.Ops < before[i] {
+			continue
+		}
+		if r := float64(info.Ops-before[i]) / interval.Seconds(); r > rate || hot < 0 {
+			hot, rate = i, r
+		}
+	}
+	return hot, rate
+}
+
+// createNameSpace has the metanode at addr and its peers create the namespace
+func createNameSpace(addr string, volID string, raftGroupID uint64) int32 {
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Millisecond*300), grpc.FailOnNonTempDialError(true))
+	if err != nil {
+		logger.Error("CreateNameSpace failed,Dial to metanode fail :%v", err)
+		return -1
+	}
+	defer conn.Close()
+	mc := mp.NewMetaNodeClient(conn)
+	pmCreateNameSpaceReq := &mp.CreateNameSpaceReq{
+		VolID:       volID,
+		RaftGroupID: raftGroupID,
+		Type:        0,
+	}
+	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	pmCreateNameSpaceAck, err := mc.CreateNameSpace(ctx, pmCreateNameSpaceReq)
+	if err != nil {
+		logger.Error("CreateNameSpace failed,grpc func err :%v", err)
+		return -1
+	}
+	if pmCreateNameSpaceAck.Ret != 0 {
+		logger.Error("CreateNameSpace failed :%v", pmCreateNameSpaceAck.Ret)
+	}
+	return pmCreateNameSpaceAck.Ret
+}
+
+func setShards(volID string, m utils.ShardMap, fresh bool) int32 {
+	pSetShardsReq := &mp.SetShardsReq{VolID: volID, Map: m.String(), Fresh: fresh}
+	ret, err := retryMeta(volID, true, func(mc mp.MetaNodeClient) (int32, error) {
+		ctx, _ := context.WithTimeout(context.Background(), 300*time.Second)
+		ack, err := mc.SetShards(ctx, pSetShardsReq)
+		if err != nil {
+			return -1, err
+		}
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("SetShards failed,grpc func err :%v", err)
+		return -1
+	}
+	return ret
+}
+
+// SplitShard moves the upper half of the dirs of a shard to a new shard, online:
+// the dirs are copied by a full dump and incremental ones, then the shard is frozen
+// for one last incremental dump and the new shard map. ret 22 when the shard has
+// too few dirs to split.
+func SplitShard(uuid string, shard int32) int32 {
+	srcID := utils.ShardVolID(uuid, shard)
+	ret, info := ShardInfo(uuid, shard)
+	if ret != 0 {
+		return ret
+	}
+	forgetShards(uuid)
+	m := shardMap(uuid)
+
+	ret, newShard, raftGroupID := AddVolShard(uuid)
+	if ret != 0 {
+		return ret
+	}
+	newID := utils.ShardVolID(uuid, newShard)
+	leader, err := GetLeader(uuid)
+	if err != nil {
+		logger.Error("SplitShard no leader for %v: %v", uuid, err)
+		return -1
+	}
+	if ret := createNameSpace(leader, newID, raftGroupID); ret != 0 {
+		return ret
+	}
+	run := func(idempotent bool, op func(mc mp.MetaNodeClient) (int32, error)) (int32, error) {
+		return retryMeta(newID, idempotent, op)
+	}
+
+	dir, err := ioutil.TempDir("", "cfs-split-")
+	if err != nil {
+		logger.Error("SplitShard tempdir err:%v", err)
+		return -1
+	}
+	defer os.RemoveAll(dir)
+
+	var applied uint64
+	pass := func(i int) int32 {
+		path := filepath.Join(dir, "dump")
+		ret, next := DumpMeta(srcID, applied, path)
+		if ret != 0 {
+			logger.Error("SplitShard %v dump since:%v ret:%v", srcID, applied, ret)
+			return ret
+		}
+		if ret, _ := restoreMetaFile(newID, run, path, i == 0, applied); ret != 0 {
+			logger.Error("SplitShard %v restore since:%v ret:%v", newID, applied, ret)
+			return ret
+		}
+		applied = next
+		return 0
+	}
+	for i := 0; i <= MigrateCatchUp; i++ {
+		// the new shard first waits for its raft group to elect a leader
+		for try := 0; ; try++ {
+			ret = pass(i)
+			if i > 0 || ret != utils.NotLeader && ret != -1 || try >= 10 {
+				break
+			}
+			time.Sleep(time.Second)
+		}
+		if ret != 0 {
+			return ret
+		}
+	}
+	// the new shard allocates from its own ids
+	ret, err = run(true, func(mc mp.MetaNodeClient) (int32, error) {
+		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+		ack, err := mc.RestoreMeta(ctx, &mp.RestoreMetaReq{VolID: newID, ChunkID: uint64(newShard) << utils.ShardChunkBits, InodeID: uint64(newShard) << utils.ShardInodeBits})
+		if err != nil {
+			return -1, err
+		}
+		return ack.Ret, nil
+	})
+	if err != nil || ret != 0 {
+		logger.Error("SplitShard %v raise ids ret:%v err:%v", newID, ret, err)
+		return -1
+	}
+
+	// cutover
+	if ret := FreezeVol(srcID, true, ""); ret != 0 {
+		return ret
+	}
+	start := time.Now()
+	defer func() {
+		if ret := FreezeVol(srcID, false, ""); ret != 0 {
+			logger.Error("SplitShard %v could not thaw, ret:%v, thawvol it", srcID, ret)
+		}
+	}()
+	if ret := pass(MigrateCatchUp + 1); ret != 0 {
+		return ret
+	}
+	// the frozen mark went along with the last dump
+	if ret := freezeWith(run, newID, false, ""); ret != 0 {
+		return ret
+	}
+	to := m.Assign(info.SplitStart, info.SplitEnd, newShard)
+	to = to.Assign(uint64(newShard)<<utils.ShardInodeBits, uint64(newShard+1)<<utils.ShardInodeBits, newShard)
+	// the shard giving the dirs away last, the clients it sends away find the new map
+	if ret := setShards(newID, to, true); ret != 0 {
+		return ret
+	}
+	for i := int32(0); i < newShard; i++ {
+		if i == shard {
+			continue
+		}
+		if ret := setShards(utils.ShardVolID(uuid, i), to, false); ret != 0 {
+			logger.Error("SplitShard %v set map on shard %v ret:%v", uuid, i, ret)
+		}
+	}
+	if ret := setShards(srcID, to, false); ret != 0 {
+		return ret
+	}
+	forgetShards(uuid)
+	logger.Info("SplitShard %v moved dirs [%v,%v) to %v, read-only for %v", srcID, info.SplitStart, info.SplitEnd, newID, time.Since(start))
+	return 0
+}
@@ -0,0 +1,49 @@
+package cfs
+
+import (
+	"bytes"
+)
+
+// Reload picks up what other clients appended while this one did not hold the
+// write lease, so the next Write continues after their data instead of
+// clobbering it. The buffered data must have been flushed.
+func (cfile *CFile) Reload() int32 {
+	cfile.waitStripes()
+	cfile.pipeline.closeConns()
+
+	ret, ack := cfile.cfs.getFileChunksDirect(cfile.ParentInodeID, cfile.Name)
+	if ret != 0 {
+		return ret
+	}
+	var size int64
+	for _, v := range ack.ChunkInfos {
+		size += int64(v.ChunkSize)
+	}
+
+	cfile.RMutex.Lock()
+	defer cfile.RMutex.Unlock()
+	cfile.chunks = ack.ChunkInfos
+	cfile.wBuffer = wBuffer{
+		buffer:   new(bytes.Buffer),
+		freeSize: cfile.bufSize,
+	}
+	if n := len(ack.ChunkInfos); n > 0 {
+		lastChunk := ack.ChunkInfos[n-1]
+		if lastChunk.Shared {
+			// deduplicated, see OpenFileDirect
+			cfile.wBuffer.freeSize = cfile.bufSize - int32(size%int64(cfile.bufSize))
+		} else {
+			cfile.wBuffer.freeSize = cfile.bufSize - (lastChunk.ChunkSize % cfile.bufSize)
+			cfile.wBuffer.chunkInfo = lastChunk
+		}
+		cfile.inline = nil
+		cfile.inlineMode = false
+	} else {
+		cfile.inline = ack.InlineData
+		cfile.inlineMode = InlineThreshold > 0
+		size = int64(len(ack.InlineData))
+	}
+	cfile.inlineDirty = false
+	cfile.FileSize = size
+	return 0
+}
@@ -0,0 +1,101 @@
+package cfs
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+)
+
+// StripeWidth chunks of one file sent at the same time, each chunk lives in the
+// block group the metanode allocated for it so a single writer is not bound to
+// one datanode pipeline. 1 sends every buffer synchronously.
+var StripeWidth = 1
+
+// StripeUnit chunk size while striping, smaller than the usual 64MB chunk so the
+// writer moves on to the next block group early. Must be a multiple of BufferSize.
+var StripeUnit int64 = 8 * 1024 * 1024
+
+// chunkUnit size at which Write starts a new chunk
+func chunkUnit() int64 {
+	if StripeWidth > 1 && StripeUnit > 0 {
+		return StripeUnit
+	}
+	return chunkSize
+}
+
+// stripe sends the buffers of one chunk in order through its own pipeline
+type stripe struct {
+	pipeline
+	chunkID uint64
+	bufs    chan *wBuffer
+	closed  bool
+	done    chan struct{}
+	ret     int32
+}
+
+// finish tells the stripe no more buffers are coming for its chunk
+func (s *stripe) finish() {
+	if !s.closed {
+		s.closed = true
+		close(s.bufs)
+	}
+}
+
+// pushStripe queues v on the stripe of its chunk, starting a new stripe when the
+// writer moved to the next chunk and waiting for the oldest one when StripeWidth are busy
+func (cfile *CFile) pushStripe(v *wBuffer) int32 {
+	n := len(cfile.stripes)
+	if n == 0 || cfile.stripes[n-1].chunkID != v.chunkInfo.ChunkID {
+		if n > 0 {
+			// the previous chunk is complete
+			cfile.stripes[n-1].finish()
+		}
+		for len(cfile.stripes) >= StripeWidth {
+			if ret := cfile.reapStripe(); ret != 0 {
+				return ret
+			}
+		}
+		s := &stripe{
+			chunkID: v.chunkInfo.ChunkID,
+			bufs:    make(chan *wBuffer, chunkUnit()/int64(cfile.bufSize)+1),
+			done:    make(chan struct{}),
+		}
+		go cfile.runStripe(s)
+		cfile.stripes = append(cfile.stripes, s)
+	}
+	cfile.stripes[len(cfile.stripes)-1].bufs <- v
+	return 0
+}
+
+func (cfile *CFile) runStripe(s *stripe) {
+	for v := range s.bufs {
+		if s.ret == 0 {
+			s.ret = cfile.sendOn(&s.pipeline, v)
+		}
+	}
+	s.closeConns()
+	close(s.done)
+}
+
+// reapStripe waits for the oldest stripe, its bufs must be closed
+func (cfile *CFile) reapStripe() int32 {
+	s := cfile.stripes[0]
+	<-s.done
+	cfile.stripes = cfile.stripes[1:]
+	if s.ret != 0 {
+		logger.Error("stripe of chunk %v failed, ret:%v", s.chunkID, s.ret)
+		cfile.Status = s.ret
+	}
+	return s.ret
+}
+
+// waitStripes waits until all the queued buffers are written and synced
+func (cfile *CFile) waitStripes() int32 {
+	n := len(cfile.stripes)
+	if n == 0 {
+		return cfile.Status
+	}
+	cfile.stripes[n-1].finish()
+	for len(cfile.stripes) > 0 {
+		cfile.reapStripe()
+	}
+	return cfile.Status
+}
@@ -0,0 +1,168 @@
+package cfs
+
+import (
+	"fmt"
+	"github.com/ipdcode/containerfs/logger"
+	dp "github.com/ipdcode/containerfs/proto/dp"
+	"golang.org/x/net/context"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// sync modes of a mount, the sync_mode option of fuseclient
+const (
+	SyncHonor  = iota // O_SYNC/O_DSYNC opens write through, the others are buffered
+	SyncAlways        // every write is durable on the datanodes before it returns
+	SyncNever         // O_SYNC/O_DSYNC are ignored
+)
+
+// SyncMode ...
+var SyncMode = SyncHonor
+
+// ParseSyncMode ...
+func ParseSyncMode(s string) (int, bool) {
+	switch s {
+	case "", "honor":
+		return SyncHonor, true
+	case "always":
+		return SyncAlways, true
+	case "never":
+		return SyncNever, true
+	}
+	return SyncHonor, false
+}
+
+func isSyncFlags(flags int) bool {
+	return flags&(os.O_SYNC|oDSYNC) != 0
+}
+
+// syncWrite tells whether writes of the file must be persisted before returning
+func (cfile *CFile) syncWrite() bool {
+	switch SyncMode {
+	case SyncAlways:
+		return true
+	case SyncNever:
+		return false
+	}
+	return cfile.syncOpen || isSyncFlags(cfile.OpenFlag)
+}
+
+// unsyncedChunk a replica of a chunk written without Sync, and where to mark it failed
+type unsyncedChunk struct {
+	p            *pipeline
+	ip           string
+	port         int32
+	position     int32
+	blockGroupID uint32
+	chunk        *dp.SyncChunk
+}
+
+// addUnsynced records the replica at position of the chunk req wrote to the datanode
+// ip:port without Sync
+func (cfile *CFile) addUnsynced(p *pipeline, ip string, port int32, position int32, req *dp.WriteChunkReq) {
+	addr := ip + ":" + strconv.Itoa(int(port))
+	cfile.unsyncedMu.Lock()
+	defer cfile.unsyncedMu.Unlock()
+	if cfile.unsynced == nil {
+		cfile.unsynced = make(map[string]map[uint64]*unsyncedChunk)
+	}
+	if cfile.unsynced[addr] == nil {
+		cfile.unsynced[addr] = make(map[uint64]*unsyncedChunk)
+	}
+	cfile.unsynced[addr][req.ChunkID] = &unsyncedChunk{
+		p:            p,
+		ip:           ip,
+		port:         port,
+		position:     position,
+		blockGroupID: req.BlockGroupID,
+		chunk:        &dp.SyncChunk{ChunkID: req.ChunkID, BlockID: req.BlockID, BlockGroupID: req.BlockGroupID, Forwards: req.Forwards},
+	}
+}
+
+// Sync makes the data written durable, for fsync: it flushes the buffer, waits for
+// the replicas still writing and has the datanodes fsync the chunks written without
+// Sync since the last one. The primary of an async volume has the replicas it
+// forwarded to fsync theirs. A replica that fails it is marked failed for repair,
+// Sync fails when a chunk is left with fewer synced replicas than the write quorum.
+func (cfile *CFile) Sync() int32 {
+	if ret := cfile.Flush(); ret != 0 {
+		return ret
+	}
+	cfile.pipeline.wgWriteReps.Wait()
+	cfile.appendPipe.wgWriteReps.Wait()
+
+	cfile.unsyncedMu.Lock()
+	unsynced := cfile.unsynced
+	cfile.unsynced = nil
+	cfile.unsyncedMu.Unlock()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	replicas := make(map[uint64]int)
+	synced := make(map[uint64]int)
+	for addr, chunks := range unsynced {
+		for chunkID := range chunks {
+			replicas[chunkID]++
+		}
+		wg.Add(1)
+		go func(addr string, chunks map[uint64]*unsyncedChunk) {
+			defer wg.Done()
+			if err := cfile.syncChunks(addr, chunks); err != nil {
+				logger.Error("SyncChunks %v failed: %v", addr, err)
+				for _, c := range chunks {
+					cfile.failReplica(c)
+				}
+				return
+			}
+			mu.Lock()
+			for chunkID := range chunks {
+				synced[chunkID]++
+			}
+			mu.Unlock()
+		}(addr, chunks)
+	}
+	wg.Wait()
+
+	quorum := cfile.cfs.writeQuorum()
+	for chunkID, n := range replicas {
+		if synced[chunkID] < writeAcks(quorum, n) {
+			logger.Error("chunk %v synced on %v of %v replicas", chunkID, synced[chunkID], n)
+			return 5 /*EIO*/
+		}
+	}
+	return 0
+}
+
+// failReplica marks the replica of c failed, the next writes of the chunk skip it
+func (cfile *CFile) failReplica(c *unsyncedChunk) {
+	cfile.SetChunkStatus(c.ip, c.port, c.blockGroupID, c.chunk.BlockID, c.chunk.ChunkID, c.position, 1)
+	c.p.mu.Lock()
+	if c.p.CurChunkID == c.chunk.ChunkID {
+		c.p.CurChunkStatus[c.position] = 1
+	}
+	c.p.mu.Unlock()
+}
+
+// syncChunks has the datanode addr fsync chunks
+func (cfile *CFile) syncChunks(addr string, chunks map[uint64]*unsyncedChunk) error {
+	conn, err := DataConnPool.Get(addr)
+	if err != nil {
+		return err
+	}
+	defer DataConnPool.Put(conn)
+	req := &dp.SyncChunksReq{VolID: cfile.cfs.VolID, Inode: cfile.Inode}
+	for _, c := range chunks {
+		req.Chunks = append(req.Chunks, c.chunk)
+	}
+	ctx, _ := context.WithTimeout(context.Background(), DataOpTimeout.Get())
+	ack, err := dp.NewDataNodeClient(conn).SyncChunks(ctx, req)
+	if err != nil {
+		DataConnPool.MarkBroken(conn)
+		return err
+	}
+	if ack.Ret != 0 {
+		return fmt.Errorf("ret %v", ack.Ret)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+// +build !windows
+
+package cfs
+
+import (
+	"syscall"
+)
+
+const oDSYNC = syscall.O_DSYNC
@@ -0,0 +1,4 @@
+package cfs
+
+// no O_DSYNC on windows, O_SYNC only
+const oDSYNC = 0
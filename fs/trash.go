@@ -0,0 +1,76 @@
+package cfs
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"golang.org/x/net/context"
+	"time"
+)
+
+// trashFile asks the metanode to move the file to /.trash, trashed is false when
+// the volume keeps no trash or the file is in it already
+func (cfs *CFS) trashFile(pinode uint64, name string) (int32, bool) {
+	pTrashFileReq := &mp.TrashFileReq{
+		PInode: pinode,
+		Name:   name,
+	}
+	var trashed bool
+	ret, err := cfs.retryShard(pinode, false, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pTrashFileReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.TrashFile(ctx, pTrashFileReq)
+		if err != nil {
+			return -1, err
+		}
+		trashed = ack.Trashed
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("TrashFile failed,grpc func err :%v", err)
+		return -1, false
+	}
+	return ret, trashed
+}
+
+// RestoreTrash puts /.trash/<date>/<name> back where it was deleted from
+func RestoreTrash(uuid string, date string, name string) int32 {
+	pRestoreTrashReq := &mp.RestoreTrashReq{
+		VolID: uuid,
+		Date:  date,
+		Name:  name,
+	}
+	ret, err := retryMeta(uuid, true, func(mc mp.MetaNodeClient) (int32, error) {
+		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+		ack, err := mc.RestoreTrash(ctx, pRestoreTrashReq)
+		if err != nil {
+			return -1, err
+		}
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("RestoreTrash failed,grpc func err :%v", err)
+		return -1
+	}
+	return ret
+}
+
+// PurgeTrash frees the files deleted on date, the whole trash when date is empty
+func PurgeTrash(uuid string, date string) int32 {
+	pPurgeTrashReq := &mp.PurgeTrashReq{
+		VolID: uuid,
+		Date:  date,
+	}
+	ret, err := retryMeta(uuid, true, func(mc mp.MetaNodeClient) (int32, error) {
+		ctx, _ := context.WithTimeout(context.Background(), 60*time.Second)
+		ack, err := mc.PurgeTrash(ctx, pPurgeTrashReq)
+		if err != nil {
+			return -1, err
+		}
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("PurgeTrash failed,grpc func err :%v", err)
+		return -1
+	}
+	return ret
+}
@@ -0,0 +1,141 @@
+package cfs
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"golang.org/x/net/context"
+	"time"
+)
+
+// TreeOpTimeout a copy of a tree is one call however big the tree
+var TreeOpTimeout = 10 * time.Minute
+
+// CopyTree copies the file or dir tree srcName of srcPInode to dstName of
+// dstPInode on the metanode, the files sharing the chunks of the sources.
+// Returns the files and dirs copied.
+func (cfs *CFS) CopyTree(srcPInode uint64, srcName string, dstPInode uint64, dstName string) (int32, uint64, uint64) {
+	pCopyTreeReq := &mp.CopyTreeReq{
+		SrcPInode: srcPInode,
+		SrcName:   srcName,
+		DstPInode: dstPInode,
+		DstName:   dstName,
+		Uid:       cfs.uid,
+		Gid:       cfs.gid,
+	}
+	var files, dirs uint64
+	ret, err := cfs.retryShard(dstPInode, false, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pCopyTreeReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), TreeOpTimeout)
+		ack, err := mc.CopyTree(ctx, pCopyTreeReq)
+		if err != nil {
+			return -1, err
+		}
+		files, dirs = ack.Files, ack.Dirs
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("CopyTree failed,grpc func err :%v", err)
+		return -1, files, dirs
+	}
+	return ret, files, dirs
+}
+
+// MoveTree renames the file or dir tree srcName of srcPInode to dstName of
+// dstPInode, which must not exist
+func (cfs *CFS) MoveTree(srcPInode uint64, srcName string, dstPInode uint64, dstName string) int32 {
+	pMoveTreeReq := &mp.MoveTreeReq{
+		SrcPInode: srcPInode,
+		SrcName:   srcName,
+		DstPInode: dstPInode,
+		DstName:   dstName,
+	}
+	ret, err := cfs.retryShard(srcPInode, false, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pMoveTreeReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), TreeOpTimeout)
+		ack, err := mc.MoveTree(ctx, pMoveTreeReq)
+		if err != nil {
+			return -1, err
+		}
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("MoveTree failed,grpc func err :%v", err)
+		return -1
+	}
+	return ret
+}
+
+// DeleteTree removes the file or dir tree name of pinode on the metanode, into the
+// trash when the volume keeps one. Returns the files and dirs removed.
+func (cfs *CFS) DeleteTree(pinode uint64, name string) (int32, uint64, uint64) {
+	pDeleteTreeReq := &mp.DeleteTreeReq{
+		PInode: pinode,
+		Name:   name,
+	}
+	var files, dirs uint64
+	ret, err := cfs.retryShard(pinode, false, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pDeleteTreeReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), TreeOpTimeout)
+		ack, err := mc.DeleteTree(ctx, pDeleteTreeReq)
+		if err != nil {
+			return -1, err
+		}
+		files, dirs = ack.Files, ack.Dirs
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("DeleteTree failed,grpc func err :%v", err)
+		return -1, files, dirs
+	}
+	return ret, files, dirs
+}
+
+// DeleteTree the file or dir at path in the volume
+func DeleteTree(uuid string, path string) (int32, uint64, uint64) {
+	cfs := OpenFileSystem(uuid)
+	ret, pinode, name := cfs.entryOf(path)
+	if ret != 0 {
+		return ret, 0, 0
+	}
+	if name == "" {
+		// the root
+		return 22 /*EINVAL*/, 0, 0
+	}
+	return cfs.DeleteTree(pinode, name)
+}
+
+// CopyTree the file or dir at src in the volume to dst
+func CopyTree(uuid string, src string, dst string) (int32, uint64, uint64) {
+	cfs := OpenFileSystem(uuid)
+	ret, srcPInode, srcName, dstPInode, dstName := cfs.treeEntries(src, dst)
+	if ret != 0 {
+		return ret, 0, 0
+	}
+	return cfs.CopyTree(srcPInode, srcName, dstPInode, dstName)
+}
+
+// MoveTree the file or dir at src in the volume to dst
+func MoveTree(uuid string, src string, dst string) int32 {
+	cfs := OpenFileSystem(uuid)
+	ret, srcPInode, srcName, dstPInode, dstName := cfs.treeEntries(src, dst)
+	if ret != 0 {
+		return ret
+	}
+	return cfs.MoveTree(srcPInode, srcName, dstPInode, dstName)
+}
+
+func (cfs *CFS) treeEntries(src string, dst string) (int32, uint64, string, uint64, string) {
+	ret, srcPInode, srcName := cfs.entryOf(src)
+	if ret != 0 {
+		return ret, 0, "", 0, ""
+	}
+	ret, dstPInode, dstName := cfs.entryOf(dst)
+	if ret != 0 {
+		return ret, 0, "", 0, ""
+	}
+	if srcName == "" || dstName == "" {
+		// the root
+		return 22 /*EINVAL*/, 0, "", 0, ""
+	}
+	return 0, srcPInode, srcName, dstPInode, dstName
+}
@@ -0,0 +1,180 @@
+package cfs
+
+import (
+	"bytes"
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"golang.org/x/net/context"
+	"io"
+	"os"
+)
+
+// Truncate the file name of pinode to size. The files are written by appending: the
+// metanode cuts a file at the end of a chunk, the part of the chunk kept past that
+// is read and written again, at most a chunk, and a longer file gets zeros. They go
+// to detached chunks the metanode links in the same op as the cut, so the file is
+// never seen cut short. A file open for writing here must have been flushed, and
+// reloaded after.
+func (cfs *CFS) Truncate(pinode uint64, name string, size int64) int32 {
+	if size < 0 {
+		return 22 /*EINVAL*/
+	}
+	for i := 0; ; i++ {
+		// another client wrote the file between the read of its chunks and the cut
+		ret := cfs.truncateOnce(pinode, name, size)
+		if ret != 11 /*EAGAIN*/ || i >= 3 {
+			return ret
+		}
+	}
+}
+
+func (cfs *CFS) truncateOnce(pinode uint64, name string, size int64) int32 {
+	ret, ack := cfs.getFileChunksDirect(pinode, name)
+	if ret != 0 {
+		return ret
+	}
+	var cur int64
+	for _, v := range ack.ChunkInfos {
+		cur += int64(v.ChunkSize)
+	}
+	inline := len(ack.ChunkInfos) == 0
+	if inline {
+		cur = int64(len(ack.InlineData))
+	}
+	if size == cur || inline && size < cur {
+		return cfs.truncate(pinode, name, size, cur, nil)
+	}
+
+	// the file is cut at end, keep chunks stay, head and the zeros past cur follow
+	var end int64
+	var head []byte
+	keep := len(ack.ChunkInfos)
+	switch {
+	case inline:
+		head = ack.InlineData
+	case size > cur:
+		end = cur
+	default:
+		keep = 0
+		for end+int64(ack.ChunkInfos[keep].ChunkSize) <= size {
+			end += int64(ack.ChunkInfos[keep].ChunkSize)
+			keep++
+		}
+		if end < size {
+			ret, cfile := cfs.OpenFileDirect(pinode, name, os.O_RDONLY)
+			if ret != 0 {
+				return ret
+			}
+			for off := end; off < size; {
+				n := cfile.Read(0, &head, off, size-off)
+				if n <= 0 {
+					logger.Error("Truncate %v: read at %v failed", name, off)
+					cfile.ReleaseReader(0)
+					return -1
+				}
+				off += n
+			}
+			cfile.ReleaseReader(0)
+		}
+	}
+	var grow int64
+	if size > cur {
+		grow = size - cur
+	}
+
+	ret, tail := cfs.writeDetached(pinode, name, io.MultiReader(bytes.NewReader(head), io.LimitReader(zeroReader{}, grow)))
+	if ret != 0 {
+		cfs.deleteChunks(tail)
+		return ret
+	}
+	chunks := make([]*mp.ChunkInfo, len(tail))
+	for i, c := range tail {
+		chunks[i] = &mp.ChunkInfo{ChunkID: c.ChunkID, ChunkSize: c.ChunkSize, BlockGroupID: c.BlockGroup.BlockGroupID, Status: c.Status}
+	}
+	if ret := cfs.truncate(pinode, name, end, cur, chunks); ret != 0 {
+		if ret != -1 {
+			// not linked, -1 is a failed call that may have been applied
+			cfs.deleteChunks(tail)
+		}
+		return ret
+	}
+	cfs.deleteChunks(ack.ChunkInfos[keep:])
+	return 0
+}
+
+// zeroReader reads zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// writeDetached writes the data of r to new chunks of the file name of pinode, not
+// linked to it, for the metanode to link them in another op. The chunks written are
+// returned, with a failure too, for their deletion.
+func (cfs *CFS) writeDetached(pinode uint64, name string, r io.Reader) (int32, []*mp.ChunkInfoWithBG) {
+	ret, cfile := cfs.OpenFileDirect(pinode, name, os.O_WRONLY)
+	if ret != 0 {
+		return ret, nil
+	}
+	defer cfile.CloseConns()
+	var chunks []*mp.ChunkInfoWithBG
+	buf := make([]byte, BufferSize.Get())
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			ret, chunkInfo := cfile.allocateChunk(true)
+			if ret != 0 {
+				return ret, chunks
+			}
+			chunkInfo.ChunkSize = int32(n)
+			chunks = append(chunks, chunkInfo)
+			v := &wBuffer{
+				buffer:    bytes.NewBuffer(buf[:n]),
+				chunkInfo: chunkInfo,
+				size:      int32(n),
+			}
+			if ret := cfile.writeReplicas(&cfile.appendPipe, v); ret != 0 {
+				return -1, chunks
+			}
+			chunkInfo.Status = cfile.appendPipe.status()
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return -1, chunks
+		}
+	}
+	cfile.appendPipe.wgWriteReps.Wait()
+	return 0, chunks
+}
+
+// truncate has the metanode cut the file at size and link tail after it, from is
+// the size it was cut from
+func (cfs *CFS) truncate(pinode uint64, name string, size int64, from int64, tail []*mp.ChunkInfo) int32 {
+	pTruncateReq := &mp.TruncateReq{
+		PInode: pinode,
+		Name:   name,
+		Size:   size,
+		From:   from,
+		Tail:   tail,
+	}
+	ret, err := cfs.retryShard(pinode, len(tail) == 0, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pTruncateReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.Truncate(ctx, pTruncateReq)
+		if err != nil {
+			return -1, err
+		}
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("Truncate failed,grpc func err :%v", err)
+		return -1
+	}
+	return ret
+}
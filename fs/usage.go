@@ -0,0 +1,89 @@
+package cfs
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"golang.org/x/net/context"
+	"strings"
+	"time"
+)
+
+// DirUsage the bytes, files and dirs below the dir, kept up to date by the metanode
+func (cfs *CFS) DirUsage(inode uint64) (int32, *mp.DirUsageAck) {
+	var pDirUsageAck *mp.DirUsageAck
+	pDirUsageReq := &mp.DirUsageReq{
+		Inode: inode,
+	}
+	// the first call after a leader change walks the whole namespace
+	ret, err := cfs.retryShard(inode, true, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pDirUsageReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), 60*time.Second)
+		ack, err := mc.DirUsage(ctx, pDirUsageReq)
+		if err != nil {
+			return -1, err
+		}
+		pDirUsageAck = ack
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("DirUsage failed,grpc func err :%v", err)
+		return -1, nil
+	}
+	return ret, pDirUsageAck
+}
+
+// GetDirAttr the inode of the dir and the dirs right in it, -1 while the metanode
+// does not know them yet
+func (cfs *CFS) GetDirAttr(inode uint64) (int32, *mp.InodeInfo, int64) {
+	var pGetDirAttrAck *mp.GetDirAttrAck
+	pGetDirAttrReq := &mp.GetDirAttrReq{
+		Inode: inode,
+	}
+	ret, err := cfs.retryShard(inode, true, func(mc mp.MetaNodeClient, volID string) (int32, error) {
+		pGetDirAttrReq.VolID = volID
+		ctx, _ := context.WithTimeout(cfs.callCtx(), MetaOpTimeout.Get())
+		ack, err := mc.GetDirAttr(ctx, pGetDirAttrReq)
+		if err != nil {
+			return -1, err
+		}
+		pGetDirAttrAck = ack
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("GetDirAttr failed,grpc func err :%v", err)
+		return -1, nil, -1
+	}
+	if ret != 0 {
+		return ret, nil, -1
+	}
+	return 0, pGetDirAttrAck.InodeInfo, pGetDirAttrAck.Subdirs
+}
+
+// DirUsage the usage of the dir at path in the volume
+func DirUsage(uuid string, path string) (int32, *mp.DirUsageAck) {
+	cfs := OpenFileSystem(uuid)
+	ret, inode := cfs.DirInode(path)
+	if ret != 0 {
+		return ret, nil
+	}
+	return cfs.DirUsage(inode)
+}
+
+// DirInode the inode of the dir at path in the volume, ret 20 when a part of it is a file
+func (cfs *CFS) DirInode(path string) (int32, uint64) {
+	var inode uint64
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		ret, isFile, child := cfs.StatDirect(inode, name)
+		if ret != 0 {
+			return ret, 0
+		}
+		if isFile {
+			return 20 /*ENOTDIR*/, 0
+		}
+		inode = child
+	}
+	return 0, inode
+}
@@ -0,0 +1,219 @@
+package cfs
+
+import (
+	"errors"
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"github.com/ipdcode/containerfs/utils"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// metaRunner runs an op against the metanode leader of a volume, like retryMeta
+type metaRunner func(idempotent bool, op func(mc mp.MetaNodeClient) (int32, error)) (int32, error)
+
+// MigrateCatchUp incremental passes a migration makes before the cutover, each one
+// shorter than the one before while the volume keeps being written
+var MigrateCatchUp = 3
+
+// metaRunnerAt a metaRunner for the volume on the metanodes of metadomain, which
+// this client was not configured with
+func metaRunnerAt(metadomain string, volumeID string) metaRunner {
+	return func(idempotent bool, op func(mc mp.MetaNodeClient) (int32, error)) (int32, error) {
+		var ret int32
+		var err error
+		for i := 0; i < 5; i++ {
+			if i > 0 {
+				time.Sleep(time.Duration(300<<uint(i-1)) * time.Millisecond)
+			}
+			var leader string
+			leader, err = leaderAt(metadomain, volumeID)
+			if err != nil {
+				continue
+			}
+			var conn *grpc.ClientConn
+			conn, err = grpc.Dial(leader, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Millisecond*300), grpc.FailOnNonTempDialError(true))
+			if err != nil {
+				continue
+			}
+			ret, err = op(mp.NewMetaNodeClient(conn))
+			conn.Close()
+			if err != nil && !idempotent {
+				return ret, err
+			}
+			if err == nil && ret != utils.NotLeader {
+				return ret, nil
+			}
+		}
+		if err == nil {
+			err = errors.New("no leader at " + metadomain)
+		}
+		return -1, err
+	}
+}
+
+func freezeWith(run metaRunner, uuid string, frozen bool, movedTo string) int32 {
+	pFreezeNameSpaceReq := &mp.FreezeNameSpaceReq{
+		VolID:   uuid,
+		Frozen:  frozen,
+		MovedTo: movedTo,
+	}
+	ret, err := run(true, func(mc mp.MetaNodeClient) (int32, error) {
+		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+		ack, err := mc.FreezeNameSpace(ctx, pFreezeNameSpaceReq)
+		if err != nil {
+			return -1, err
+		}
+		return ack.Ret, nil
+	})
+	if err != nil {
+		logger.Error("FreezeNameSpace failed,grpc func err :%v", err)
+		return -1
+	}
+	return ret
+}
+
+// FreezeVol makes the volume read-only, the clients wait out their writes until it
+// is thawed or for MetaFrozenWait. movedTo set sends the clients to that metadomain.
+func FreezeVol(uuid string, frozen bool, movedTo string) int32 {
+	return freezeWith(func(idempotent bool, op func(mc mp.MetaNodeClient) (int32, error)) (int32, error) {
+		return retryMeta(uuid, idempotent, op)
+	}, uuid, frozen, movedTo)
+}
+
+// waitNameSpace waits for the namespace created at metadomain to have set up the
+// block groups and the root of the volume, a restore started earlier is overwritten
+func waitNameSpace(run metaRunner, uuid string) int32 {
+	pGetInodeInfoDirectReq := &mp.GetInodeInfoDirectReq{
+		VolID:  uuid,
+		PInode: 0,
+	}
+	var ret int32
+	for i := 0; i < 30; i++ {
+		time.Sleep(time.Second)
+		var err error
+		ret, err = run(true, func(mc mp.MetaNodeClient) (int32, error) {
+			ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+			ack, err := mc.GetInodeInfoDirect(ctx, pGetInodeInfoDirectReq)
+			if err != nil {
+				return -1, err
+			}
+			return ack.Ret, nil
+		})
+		if err == nil && ret == 0 {
+			return 0
+		}
+	}
+	logger.Error("MigrateVol namespace of %v not set up, ret:%v", uuid, ret)
+	return 1
+}
+
+// MigrateVol moves the metadata of the volume to the metanode cluster of
+// metadomain, under the same raft group id, the data stays on the datanodes the block groups point at. The volume
+// is copied online by a full dump and incremental ones, then frozen for one last
+// incremental dump: the read-only cutover the clients wait out. volmgr and the old
+// namespace send the clients to the new one after.
+func MigrateVol(uuid string, metadomain string) int32 {
+	ret, vi := GetVolInfo(uuid)
+	if ret != 0 || vi.VolInfo == nil {
+		return 2
+	}
+	if vi.VolInfo.MetaDomain == metadomain {
+		return 17
+	}
+	if ShardCount(uuid) > 1 {
+		logger.Error("MigrateVol %v is sharded, only whole raft groups of single shard volumes move", uuid)
+		return 95 /*EOPNOTSUPP*/
+	}
+
+	conn, err := grpc.Dial(metadomain, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Millisecond*300), grpc.FailOnNonTempDialError(true))
+	if err != nil {
+		logger.Error("MigrateVol failed,Dial to metanode fail :%v", err)
+		return -1
+	}
+	mc := mp.NewMetaNodeClient(conn)
+	pmCreateNameSpaceReq := &mp.CreateNameSpaceReq{
+		VolID:       uuid,
+		RaftGroupID: vi.VolInfo.RaftGroupID,
+		Type:        0,
+	}
+	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	pmCreateNameSpaceAck, err := mc.CreateNameSpace(ctx, pmCreateNameSpaceReq)
+	conn.Close()
+	if err != nil {
+		logger.Error("MigrateVol failed,CreateNameSpace err :%v", err)
+		return -1
+	}
+	if pmCreateNameSpaceAck.Ret != 0 {
+		logger.Error("MigrateVol failed,CreateNameSpace ret :%v", pmCreateNameSpaceAck.Ret)
+		return pmCreateNameSpaceAck.Ret
+	}
+	target := metaRunnerAt(metadomain, uuid)
+	if ret := waitNameSpace(target, uuid); ret != 0 {
+		return ret
+	}
+
+	dir, err := ioutil.TempDir("", "cfs-migrate-")
+	if err != nil {
+		logger.Error("MigrateVol tempdir err:%v", err)
+		return -1
+	}
+	defer os.RemoveAll(dir)
+
+	var applied uint64
+	pass := func(i int) int32 {
+		path := filepath.Join(dir, "dump")
+		ret, next := DumpMeta(uuid, applied, path)
+		if ret != 0 {
+			logger.Error("MigrateVol %v dump since:%v ret:%v", uuid, applied, ret)
+			return ret
+		}
+		if ret, _ := restoreMetaFile(uuid, target, path, i == 0, applied); ret != 0 {
+			logger.Error("MigrateVol %v restore since:%v ret:%v", uuid, applied, ret)
+			return ret
+		}
+		logger.Info("MigrateVol %v copied up to applied:%v", uuid, next)
+		applied = next
+		return 0
+	}
+	for i := 0; i <= MigrateCatchUp; i++ {
+		if ret := pass(i); ret != 0 {
+			return ret
+		}
+	}
+
+	// cutover
+	if ret := FreezeVol(uuid, true, ""); ret != 0 {
+		return ret
+	}
+	start := time.Now()
+	thaw := func() {
+		if ret := FreezeVol(uuid, false, ""); ret != 0 {
+			logger.Error("MigrateVol %v could not thaw the source, ret:%v, thawvol it", uuid, ret)
+		}
+	}
+	if ret := pass(MigrateCatchUp + 1); ret != 0 {
+		thaw()
+		return ret
+	}
+	// the frozen mark went along with the last dump
+	if ret := freezeWith(target, uuid, false, ""); ret != 0 {
+		thaw()
+		return ret
+	}
+	if ret := MoveVol(uuid, metadomain); ret != 0 {
+		freezeWith(target, uuid, true, "")
+		thaw()
+		return ret
+	}
+	if ret := FreezeVol(uuid, true, metadomain); ret != 0 {
+		logger.Error("MigrateVol %v moved, but the source is not marked, ret:%v", uuid, ret)
+	}
+	forgetLeader(uuid)
+	logger.Info("MigrateVol %v moved to %v, read-only for %v", uuid, metadomain, time.Since(start))
+	return 0
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// -daemon starts the fuseclient again in the background with -foreground, its
+// output in daemon_log, and returns once the mount is ready, as mount(8) expects
+// of a helper. The child reports on the pipe given as -ready-fd.
+
+var readyFD = flag.Int("ready-fd", 0, "set by -daemon, the fd to report the mount ready on")
+
+func init() {
+	flag.BoolVar(daemon, "d", false, "same as -daemon")
+}
+
+// daemonLog the file for the output of the daemon
+func daemonLog(c settings) string {
+	if f := c.String("daemon_log"); f != "" {
+		return f
+	}
+	if dir := c.String("log"); dir != "" {
+		return filepath.Join(dir, "fuse.out")
+	}
+	// the logs go to stderr without a log dir
+	return "/var/log/cfs-fuseclient-" + c.String("uuid") + ".log"
+}
+
+// daemonize starts this fuseclient again in the background and waits for its
+// mount, returns its pid
+func daemonize(c settings) (int, error) {
+	logFile := daemonLog(c)
+	out, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	// fd 3 is the first of ExtraFiles
+	cmd := exec.Command(os.Args[0], append(os.Args[1:], "-foreground", "-ready-fd", "3")...)
+	cmd.Stdout, cmd.Stderr = out, out
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return 0, err
+	}
+	line, _ := bufio.NewReader(r).ReadString('\n')
+	line = strings.TrimSpace(line)
+	if line != "ok" {
+		if line == "" {
+			line = "exited"
+		}
+		return 0, fmt.Errorf("mount failed: %v, see %v", line, logFile)
+	}
+	return cmd.Process.Pid, nil
+}
+
+// notifyReady tells the -daemon parent how the mount went, once
+func notifyReady(err error) {
+	if *readyFD == 0 {
+		return
+	}
+	f := os.NewFile(uintptr(*readyFD), "ready")
+	*readyFD = 0
+	if err != nil {
+		fmt.Fprintf(f, "%v\n", err)
+	} else {
+		fmt.Fprintln(f, "ok")
+	}
+	f.Close()
+}
+
+var pidfile string
+
+// writePidfile writes the pid to path, refused while the pid in it runs
+func writePidfile(path string) error {
+	if path == "" {
+		return nil
+	}
+	if pid, err := readPidfile(path); err == nil && syscall.Kill(pid, 0) == nil {
+		return fmt.Errorf("%v holds the running pid %v", path, pid)
+	}
+	if err := ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return err
+	}
+	pidfile = path
+	return nil
+}
+
+func readPidfile(path string) (int, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+func removePidfile() {
+	if pidfile != "" {
+		os.Remove(pidfile)
+	}
+}
+
+// umountCmd is `cfs-fuseclient umount [-pidfile file] mountpoint`. With the
+// pidfile the fuseclient is sent SIGTERM, it flushes and unmounts; the command
+// waits for it to exit. Else the mountpoint is unmounted, lazily when busy.
+func umountCmd(args []string) int {
+	fs := flag.NewFlagSet("umount", flag.ExitOnError)
+	pidPath := fs.String("pidfile", "", "pidfile of the fuseclient serving the mount")
+	timeout := fs.Duration("timeout", time.Minute, "wait for the fuseclient to exit")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %v umount [flags] mountpoint\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	mnt := fs.Arg(0)
+
+	if *pidPath != "" {
+		pid, err := readPidfile(*pidPath)
+		if err == nil && syscall.Kill(pid, syscall.SIGTERM) == nil {
+			deadline := time.Now().Add(*timeout)
+			for syscall.Kill(pid, 0) == nil {
+				if time.Now().After(deadline) {
+					fmt.Printf("fuseclient %v still running after %v\n", pid, *timeout)
+					return 1
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+			return 0
+		}
+		fmt.Printf("no fuseclient in %v (%v), unmounting %v\n", *pidPath, err, mnt)
+	}
+	if err := unmount(mnt); err != nil {
+		fmt.Println("umount err:", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	cfs "github.com/ipdcode/containerfs/fs"
+	"golang.org/x/net/context"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// healthCanary a file of the volume whose first block /healthz reads from the
+// datanodes past the kernel and client caches, empty for none
+var healthCanary string
+
+// healthTimeout a probe not done within it finds the mount hung
+var healthTimeout = 5 * time.Second
+
+type healthReport struct {
+	Status    string `json:"status"` // ok, down, error or hung
+	Mount     string `json:"mount"`  // health of the mount and of a stat of its root
+	Canary    string `json:"canary,omitempty"`
+	Remounts  int    `json:"remounts"`
+	LatencyMs int64  `json:"latency_ms"`
+}
+
+// serveHealthz serves GET /healthz at addr for the liveness probes of kubernetes and
+// the node agents: 200 when the mount answers a stat of its root and the canary reads,
+// 503 otherwise, the agent then remounts
+func serveHealthz(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		rep := probe()
+		w.Header().Set("Content-Type", "application/json")
+		if rep.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(rep)
+	})
+	go http.Serve(l, mux)
+	return nil
+}
+
+// probe the mount end to end: its state, a stat of the root through the kernel and a
+// read of the canary through the metanode and the datanodes
+func probe() healthReport {
+	start := time.Now()
+	rep := healthReport{Mount: health()}
+	mountHealth.Lock()
+	rep.Remounts = mountHealth.remounts
+	mountHealth.Unlock()
+	rep.Status = strings.Fields(rep.Mount)[0]
+	if rep.Status == "ok" && healthCanary != "" {
+		rep.Canary = readCanary()
+		if rep.Canary != "ok" {
+			rep.Status = "error"
+			if rep.Canary == "hung" {
+				rep.Status = "hung"
+			}
+		}
+	}
+	rep.LatencyMs = int64(time.Since(start) / time.Millisecond)
+	return rep
+}
+
+// readCanary reads the first block of healthCanary, ok or what failed
+func readCanary() string {
+	ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+	defer cancel()
+	done := make(chan string, 1)
+	go func() {
+		c := cfs.OpenFileSystem(uuid).WithContext(ctx)
+		ret, pinode := c.DirInode(path.Dir(healthCanary))
+		if ret != 0 {
+			done <- fmt.Sprintf("lookup ret:%v", ret)
+			return
+		}
+		ret, cfile := c.OpenFileDirect(pinode, path.Base(healthCanary), os.O_RDONLY)
+		if ret != 0 {
+			done <- fmt.Sprintf("open ret:%v", ret)
+			return
+		}
+		defer cfile.Close(os.O_RDONLY)
+		defer cfile.ReleaseReader(0)
+		size := int64(4096)
+		if cfile.FileSize < size {
+			size = cfile.FileSize
+		}
+		data := make([]byte, 0, size)
+		if n := cfile.ReadContext(ctx, 0, &data, 0, size); n != size {
+			done <- fmt.Sprintf("read %v of %v", n, size)
+			return
+		}
+		done <- "ok"
+	}()
+	select {
+	case s := <-done:
+		return s
+	case <-ctx.Done():
+		return "hung"
+	}
+}
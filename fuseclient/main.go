@@ -3,17 +3,28 @@ package main
 import (
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
+	"bytes"
+	"flag"
 	"fmt"
 	cfs "github.com/ipdcode/containerfs/fs"
 	"github.com/ipdcode/containerfs/logger"
-	//mp "github.com/ipdcode/containerfs/proto/mp"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"github.com/ipdcode/containerfs/utils"
 	"github.com/lxmgo/config"
 	"golang.org/x/net/context"
+	"io/ioutil"
 	"log"
 	"math"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
 	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -21,9 +32,34 @@ import (
 var uuid string
 var mountPoint string
 
+// subpath the dir of the volume mounted, like an nfs export
+var subpath string
+
 // FS struct
 type FS struct {
-	cfs *cfs.CFS
+	cfs     *cfs.CFS
+	subpath string // dir of the volume mounted as the root, "" for the volume root
+
+	// the entry of the subpath in its parent, for the xattrs of the root
+	rootPInode uint64
+	rootName   string
+
+	// fedIndex the place of the volume in a federation from 1, 0 for a mount of one
+	// volume. The volumes of a federation share the st_dev of the mount, each gets
+	// its inode numbers in a range of its own.
+	fedIndex uint64
+}
+
+// fedInodeBits the inode numbers a volume of a federation keeps, the fedIndex is
+// put above them
+const fedInodeBits = 48
+
+// ino the inode number the kernel sees for inode of the volume
+func (filesys *FS) ino(inode uint64) uint64 {
+	if filesys.fedIndex == 0 {
+		return inode
+	}
+	return filesys.fedIndex<<fedInodeBits | inode&(1<<fedInodeBits-1)
 }
 
 type dir struct {
@@ -51,13 +87,226 @@ type dir struct {
 	// each child also stores its own name; if the value in the child
 	// is an empty string, that means the child has been unlinked
 	active map[string]*refcount
+
+	// attributes returned by mkdir or the last Attr, and the dirs right in it,
+	// -1 when not known
+	attr       *mp.InodeInfo
+	attrExpire time.Time
+	subdirs    int64
+
+	// names looked up and not found, with their expiry. Own lock so
+	// it can be cleared without the dir lock ordering of mu
+	negMu    sync.Mutex
+	negative map[string]time.Time
+	cached   int       // entries of negative and listed charged to the memory budget
+	cacheUse time.Time // last change of negative or listed
+
+	// entries a listing returned with their attributes, the Lookup and Attr the
+	// kernel sends for each of them right after (ls -l, find) are answered from
+	// here. bazil fuse has no READDIRPLUS, this gives the same round trips
+	listed map[string]listedEntry
+
+	// changes seen by the watcher, and the pollers to wake on the next
+	pollMu  sync.Mutex
+	pollSeq uint64
+	wakeups []fuse.PollWakeup
+}
+
+// negativeTTL how long a dir remembers that a name does not exist,
+// saves the metanode from library path searches. 0 disables
+var negativeTTL = utils.NewDuration(time.Second)
+
+// negativeMax names remembered per dir
+const negativeMax = 1024
+
+func (d *dir) isNegative(name string) bool {
+	d.negMu.Lock()
+	defer d.unlockCache()
+	expire, ok := d.negative[name]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expire) {
+		delete(d.negative, name)
+		return false
+	}
+	return true
+}
+
+func (d *dir) cacheNegative(name string) {
+	ttl := negativeTTL.Get()
+	if ttl <= 0 {
+		return
+	}
+	d.negMu.Lock()
+	defer d.unlockCache()
+	if d.negative == nil {
+		d.negative = make(map[string]time.Time)
+	}
+	if len(d.negative) >= negativeMax {
+		now := time.Now()
+		for k, expire := range d.negative {
+			if now.After(expire) {
+				delete(d.negative, k)
+			}
+		}
+		if len(d.negative) >= negativeMax {
+			d.negative = make(map[string]time.Time)
+		}
+	}
+	d.negative[name] = time.Now().Add(ttl)
+}
+
+// direntCost the bytes a cached entry is charged to the memory budget, about
+// the name, the attributes and the map overhead
+const direntCost = 256
+
+// the dirs caching entries, their caches go least recently changed first when
+// over the memory budget. Taken after negMu.
+var cachedDirs = struct {
+	sync.Mutex
+	m map[*dir]bool
+}{m: make(map[*dir]bool)}
+
+// unlockCache releases negMu, charging the change in the entries cached by d
+func (d *dir) unlockCache() {
+	n := len(d.negative) + len(d.listed)
+	delta := int64(n-d.cached) * direntCost
+	if delta != 0 {
+		d.cached = n
+		d.cacheUse = time.Now()
+		cachedDirs.Lock()
+		if n > 0 {
+			cachedDirs.m[d] = true
+		} else {
+			delete(cachedDirs.m, d)
+		}
+		cachedDirs.Unlock()
+	}
+	d.negMu.Unlock()
+	if delta != 0 {
+		cfs.MemCharge(cfs.MemDirents, delta)
+	}
+}
+
+// dropCache forgets the cached entries of d, returns the bytes given back
+func (d *dir) dropCache() int64 {
+	d.negMu.Lock()
+	n := int64(d.cached) * direntCost
+	d.negative = nil
+	d.listed = nil
+	d.unlockCache()
+	return n
+}
+
+// reclaimDirents drops the caches of the dirs least recently changed
+func reclaimDirents(need int64) int64 {
+	cachedDirs.Lock()
+	dirs := make([]*dir, 0, len(cachedDirs.m))
+	for d := range cachedDirs.m {
+		dirs = append(dirs, d)
+	}
+	cachedDirs.Unlock()
+
+	used := make(map[*dir]time.Time, len(dirs))
+	for _, d := range dirs {
+		d.negMu.Lock()
+		used[d] = d.cacheUse
+		d.negMu.Unlock()
+	}
+	sort.Slice(dirs, func(i, j int) bool { return used[dirs[i]].Before(used[dirs[j]]) })
+
+	var n int64
+	for _, d := range dirs {
+		if n >= need {
+			break
+		}
+		n += d.dropCache()
+	}
+	return n
+}
+
+// clearNegative is called when name is created in d by this client
+func (d *dir) clearNegative(name string) {
+	d.negMu.Lock()
+	delete(d.negative, name)
+	delete(d.listed, name)
+	d.unlockCache()
+}
+
+// errInterrupted answers an op the kernel interrupted (FUSE_INTERRUPT, bazil fuse
+// cancels the ctx of the op), so a read stuck on a dead datanode can be killed.
+// The lookups, stats and reads give up, the ops changing the volume run to the end:
+// the metanode may have applied them already.
+var errInterrupted = fuse.Errno(syscall.EINTR)
+
+// errIO the error of an op failed with ret, EAGAIN when a soft mount gave up on the
+// metanode (see soft_grace_secs): the op was not applied and may be tried again
+func errIO(ret int32) error {
+	if ret == utils.Unavailable {
+		return fuse.Errno(syscall.EAGAIN)
+	}
+	return fuse.Errno(syscall.EIO)
+}
+
+// readdirPlus dirs are listed with the attributes of their entries
+var readdirPlus = true
+
+type listedEntry struct {
+	inodeType bool
+	inode     uint64
+	info      *mp.InodeInfo
+	expire    time.Time
+}
+
+// cacheListed remembers an entry of a listing for attrCacheTTL
+func (d *dir) cacheListed(v *mp.DirentN, info *mp.InodeInfo) {
+	d.negMu.Lock()
+	defer d.unlockCache()
+	if d.listed == nil || len(d.listed) >= cfs.ListPageSize.Get()*4 {
+		// a listing way ahead of the lookups, start over
+		d.listed = make(map[string]listedEntry)
+	}
+	d.listed[v.Name] = listedEntry{v.InodeType, v.Inode, info, time.Now().Add(attrCacheTTL)}
+}
+
+// takeListed the entry a recent listing returned for name, used once
+func (d *dir) takeListed(name string) (listedEntry, bool) {
+	d.negMu.Lock()
+	defer d.unlockCache()
+	e, ok := d.listed[name]
+	if !ok {
+		return e, false
+	}
+	delete(d.listed, name)
+	return e, time.Now().Before(e.expire)
+}
+
+// forgetListed is called when name is removed or renamed by this client
+func (d *dir) forgetListed(name string) {
+	d.negMu.Lock()
+	delete(d.listed, name)
+	d.unlockCache()
 }
 
 var _ = fs.FS(&FS{})
 
-// Root ...
+// Root the dir at the subpath, resolved once at mount: renaming it later does not
+// move the mount
 func (fs *FS) Root() (fs.Node, error) {
-	n := newDir(fs, 0, nil, "")
+	ret, inode := fs.cfs.DirInode(fs.subpath)
+	if ret != 0 {
+		logger.Error("subpath %v of the volume ret:%v", fs.subpath, ret)
+		return nil, fmt.Errorf("subpath %v: %v", fs.subpath, syscall.Errno(ret))
+	}
+	if sub := strings.Trim(path.Clean("/"+fs.subpath), "/"); sub != "" {
+		dir, name := path.Split(sub)
+		if ret, fs.rootPInode = fs.cfs.DirInode(dir); ret != 0 {
+			return nil, fmt.Errorf("subpath %v: %v", fs.subpath, syscall.Errno(ret))
+		}
+		fs.rootName = name
+	}
+	n := newDir(fs, inode, nil, "")
 	return n, nil
 }
 
@@ -86,6 +335,124 @@ func (fs *FS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.St
 	return nil
 }
 
+// fedFS mounts several volumes under one mountpoint, each as a top-level directory
+type fedFS struct {
+	names []string // in config order
+	vols  map[string]*FS
+	root  *fedRoot
+}
+
+var _ = fs.FS(&fedFS{})
+
+// newFedFS parses the federation entries, "/dir:uuid" each
+func newFedFS(entries []string) (*fedFS, error) {
+	fed := &fedFS{vols: make(map[string]*FS)}
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		kv := strings.SplitN(e, ":", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("wrong federation entry %q, use /dir:uuid", e)
+		}
+		name := strings.Trim(kv[0], "/")
+		if name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("wrong federation dir %q, only top-level dirs are supported", kv[0])
+		}
+		if _, ok := fed.vols[name]; ok {
+			return nil, fmt.Errorf("federation dir %q mapped twice", name)
+		}
+		if len(fed.names) == 1<<(64-fedInodeBits)-1 {
+			return nil, fmt.Errorf("more than %v volumes in the federation", len(fed.names))
+		}
+		fed.names = append(fed.names, name)
+		fed.vols[name] = &FS{cfs: cfs.OpenFileSystem(kv[1]), fedIndex: uint64(len(fed.names))}
+	}
+	if len(fed.names) == 0 {
+		return nil, fmt.Errorf("empty federation")
+	}
+	fed.root = &fedRoot{fed: fed, roots: make(map[string]*dir)}
+	return fed, nil
+}
+
+// volIDs ...
+func (fed *fedFS) volIDs() []string {
+	var ids []string
+	for _, name := range fed.names {
+		ids = append(ids, fed.vols[name].cfs.VolID)
+	}
+	return ids
+}
+
+// Root ...
+func (fed *fedFS) Root() (fs.Node, error) {
+	return fed.root, nil
+}
+
+// Statfs sums up the volumes
+func (fed *fedFS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
+	var one, sum fuse.StatfsResponse
+	for _, name := range fed.names {
+		if err := fed.vols[name].Statfs(ctx, req, &one); err != nil {
+			return err
+		}
+		sum.Blocks += one.Blocks
+		sum.Bfree += one.Bfree
+		sum.Bavail += one.Bavail
+	}
+	resp.Bsize = 4 * 1024
+	resp.Frsize = resp.Bsize
+	resp.Blocks = sum.Blocks
+	resp.Bfree = sum.Bfree
+	resp.Bavail = sum.Bavail
+	return nil
+}
+
+// fedRoot read-only directory holding the root of each volume
+type fedRoot struct {
+	fed *fedFS
+
+	mu    sync.Mutex
+	roots map[string]*dir
+}
+
+var _ fs.Node = (*fedRoot)(nil)
+var _ fs.NodeStringLookuper = (*fedRoot)(nil)
+var _ fs.HandleReadDirAller = (*fedRoot)(nil)
+
+// Attr ...
+func (r *fedRoot) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0555
+	a.Inode = 1
+	return nil
+}
+
+// Lookup ...
+func (r *fedRoot) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	vol, ok := r.fed.vols[name]
+	if !ok {
+		return nil, fuse.Errno(syscall.ENOENT)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.roots[name]
+	if !ok {
+		d = newDir(vol, 0, nil, name)
+		r.roots[name] = d
+	}
+	return d, nil
+}
+
+// ReadDirAll ...
+func (r *fedRoot) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	var res []fuse.Dirent
+	for _, name := range r.fed.names {
+		res = append(res, fuse.Dirent{Inode: r.fed.vols[name].ino(0), Name: name, Type: fuse.DT_Dir})
+	}
+	return res, nil
+}
+
 type refcount struct {
 	node   node
 	kernel bool
@@ -94,11 +461,12 @@ type refcount struct {
 
 func newDir(filesys *FS, inode uint64, parent *dir, name string) *dir {
 	d := &dir{
-		inode:  inode,
-		name:   name,
-		parent: parent,
-		fs:     filesys,
-		active: make(map[string]*refcount),
+		inode:   inode,
+		name:    name,
+		parent:  parent,
+		fs:      filesys,
+		active:  make(map[string]*refcount),
+		subdirs: -1,
 	}
 	return d
 }
@@ -110,8 +478,11 @@ var _ fs.NodeForgetter = (*dir)(nil)
 var _ fs.NodeMkdirer = (*dir)(nil)
 var _ fs.NodeRemover = (*dir)(nil)
 var _ fs.NodeRenamer = (*dir)(nil)
-var _ fs.NodeStringLookuper = (*dir)(nil)
-var _ fs.HandleReadDirAller = (*dir)(nil)
+var _ fs.NodeRequestLookuper = (*dir)(nil)
+var _ fs.NodeOpener = (*dir)(nil)
+var _ fs.NodeSymlinker = (*dir)(nil)
+var _ fs.NodeLinker = (*dir)(nil)
+var _ fs.NodeMknoder = (*dir)(nil)
 
 func (d *dir) setName(name string) {
 
@@ -131,365 +502,1646 @@ func (d *dir) setParentInode(pdir *dir) {
 // Attr ...
 func (d *dir) Attr(ctx context.Context, a *fuse.Attr) error {
 
-	a.Mode = os.ModeDir | 0755
 	//a.Valid = time.Second
-	a.Inode = d.inode
-	return nil
-}
-
-func (d *dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	a.Inode = d.fs.ino(d.inode)
+	a.Size = dirSize
+	a.Blocks = dirSize / 512
 
 	d.mu.Lock()
-	defer d.mu.Unlock()
-
-	if a, ok := d.active[name]; ok {
-		return a.node, nil
+	fresh := d.attr != nil && time.Now().Before(d.attrExpire)
+	d.mu.Unlock()
+	if !fresh {
+		ret, info, subdirs := d.fs.cfs.WithContext(ctx).GetDirAttr(d.inode)
+		switch {
+		case ret == 0:
+			d.mu.Lock()
+			d.attr, d.subdirs = info, subdirs
+			d.attrExpire = time.Now().Add(attrCacheTTL)
+			d.mu.Unlock()
+		case ret == 2 /*ENOENT*/ :
+			return fuse.ENOENT
+		case ctx.Err() != nil:
+			return errInterrupted
+		default:
+			logger.Debug("Attr of dir %v ret:%v, answered with cached attributes", d.name, ret)
+		}
 	}
 
-	ret, inodeType, inode := d.fs.cfs.StatDirect(d.inode, name)
-
-	if ret == 2 {
-		return nil, fuse.ENOENT
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	a.Mode = os.ModeDir | permOf(d.attr, 0755)
+	if d.attr != nil {
+		a.Ctime = ctimeOf(d.attr)
+		a.Mtime = mtimeOf(d.attr)
+		a.Atime = atimeOf(d.attr)
 	}
-	if ret != 0 {
-		return nil, fuse.ENOENT
+	// . and the entry in the parent, plus the .. of each subdir; 1 tells find
+	// the count is not known
+	a.Nlink = 1
+	if d.subdirs >= 0 {
+		a.Nlink = uint32(2 + d.subdirs)
 	}
-	n, _ := d.reviveNode(inodeType, inode, name)
+	attrOwner(a, d.attr)
+	return nil
+}
 
-	a := &refcount{node: n}
-	d.active[name] = a
+// dirSize the size of a dir in Attr
+const dirSize = 4096
 
-	a.kernel = true
+// ownership as seen by the mount: squashUID and squashGID, when not -1, replace
+// every owner, chown fails with EPERM. uidMap and gidMap translate ranges of ids
+// for user namespaces, the callers outside of them cannot create nor chown.
+var squashUID, squashGID int64 = -1, -1
+var uidMap, gidMap utils.IDMap
 
-	return a.node, nil
+// attrOwner sets the owner of a from the one stored in info
+func attrOwner(a *fuse.Attr, info *mp.InodeInfo) {
+	var uid, gid uint32
+	if info != nil {
+		uid, gid = info.Uid, info.Gid
+	}
+	a.Uid, a.Gid = uidMap.FromVolume(uid), gidMap.FromVolume(gid)
+	if squashUID >= 0 {
+		a.Uid = uint32(squashUID)
+	}
+	if squashGID >= 0 {
+		a.Gid = uint32(squashGID)
+	}
 }
 
-func (d *dir) reviveDir(inode uint64, name string) (*dir, error) {
-	child := newDir(d.fs, inode, d, name)
-	return child, nil
+// volumeOwner the owner stored for the entries created by the caller, EOVERFLOW
+// when its ids are not mapped
+func volumeOwner(uid uint32, gid uint32) (uint32, uint32, error) {
+	if squashUID >= 0 {
+		uid = uint32(squashUID)
+	} else if v, ok := uidMap.ToVolume(uid); ok {
+		uid = v
+	} else {
+		return 0, 0, fuse.Errno(syscall.EOVERFLOW)
+	}
+	if squashGID >= 0 {
+		gid = uint32(squashGID)
+	} else if v, ok := gidMap.ToVolume(gid); ok {
+		gid = v
+	} else {
+		return 0, 0, fuse.Errno(syscall.EOVERFLOW)
+	}
+	return uid, gid, nil
 }
 
-func (d *dir) reviveNode(inodeType bool, inode uint64, name string) (node, error) {
-	if inodeType {
-		child := &File{
-			inode:  inode,
-			name:   name,
-			parent: d,
-		}
-		return child, nil
+// permOf the permission bits of info, def for the inodes stored without a mode
+func permOf(info *mp.InodeInfo, def os.FileMode) os.FileMode {
+	if info == nil || info.Mode == 0 {
+		return def
 	}
-	child, _ := d.reviveDir(inode, name)
-	return child, nil
-
+	m := os.FileMode(info.Mode & 0777)
+	if info.Mode&syscall.S_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if info.Mode&syscall.S_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if info.Mode&syscall.S_ISVTX != 0 {
+		m |= os.ModeSticky
+	}
+	return m
 }
 
-// ReadDirAll ...
-func (d *dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+// stMode the st_mode of m, the type and the permission bits
+func stMode(m os.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		mode |= syscall.S_ISUID
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= syscall.S_ISGID
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= syscall.S_ISVTX
+	}
+	if m.IsDir() {
+		return mode | syscall.S_IFDIR
+	}
+	return mode | syscall.S_IFREG
+}
 
-	var res []fuse.Dirent
-	ret, dirents := d.fs.cfs.ListDirect(d.inode)
+// setMode the chmod of the entry name of the dir pinode
+func setMode(filesys *FS, pinode uint64, name string, req *fuse.SetattrRequest) error {
+	if !req.Valid.Mode() {
+		return nil
+	}
+	if readOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+	switch ret := filesys.cfs.SetMode(pinode, name, stMode(req.Mode)); ret {
+	case 0:
+		return nil
+	case 2:
+		return fuse.ENOENT
+	default:
+		return errIO(ret)
+	}
+}
 
-	if ret == 2 {
-		return nil, fuse.Errno(syscall.ENOENT)
+// setOwner the chown of the entry name of the dir pinode
+func setOwner(filesys *FS, pinode uint64, name string, req *fuse.SetattrRequest) error {
+	if !req.Valid.Uid() && !req.Valid.Gid() {
+		return nil
 	}
-	if ret != 0 {
-		return nil, fuse.Errno(syscall.EIO)
+	if (req.Valid.Uid() && squashUID >= 0) || (req.Valid.Gid() && squashGID >= 0) {
+		return fuse.EPERM
+	}
+	uid, ok := uidMap.ToVolume(req.Uid)
+	if req.Valid.Uid() && !ok {
+		return fuse.Errno(syscall.EINVAL)
 	}
-	for _, v := range dirents {
-		de := fuse.Dirent{
-			Name: v.Name,
+	gid, ok := gidMap.ToVolume(req.Gid)
+	if req.Valid.Gid() && !ok {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	if req.Header.Uid != 0 {
+		ret, _, info := filesys.cfs.GetInodeInfoDirect(pinode, name)
+		if ret == 2 {
+			return fuse.ENOENT
+		} else if ret != 0 {
+			return errIO(ret)
 		}
-		if v.InodeType {
-			de.Type = fuse.DT_File
-		} else {
-			de.Type = fuse.DT_Dir
+		if !chownAllowed(req, info, uid, gid) {
+			return fuse.EPERM
 		}
-		res = append(res, de)
 	}
-
-	return res, nil
+	switch ret := filesys.cfs.SetOwner(pinode, name, uid, gid, req.Valid.Uid(), req.Valid.Gid()); ret {
+	case 0:
+		return nil
+	case 2:
+		return fuse.ENOENT
+	default:
+		return errIO(ret)
+	}
 }
 
-// Create ...
-func (d *dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
-
-	logger.Debug("Create path %v name %v Flags %v", d.name, req.Name, req.Flags)
-
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	ret, cfile := d.fs.cfs.CreateFileDirect(d.inode, req.Name, int(req.Flags))
-	if ret != 0 {
-		if ret == 17 {
-			return nil, nil, fuse.Errno(syscall.EEXIST)
-
+// chownAllowed the rules of chown(2) for a caller other than root: only root gives
+// a file away, its owner may set its group to one of the groups of the caller
+func chownAllowed(req *fuse.SetattrRequest, info *mp.InodeInfo, uid uint32, gid uint32) bool {
+	if req.Valid.Uid() && uid != info.Uid {
+		return false
+	}
+	if !req.Valid.Gid() || gid == info.Gid {
+		return true
+	}
+	if caller, ok := uidMap.ToVolume(req.Header.Uid); !ok || caller != info.Uid {
+		return false
+	}
+	if req.Gid == req.Header.Gid {
+		return true
+	}
+	for _, g := range callerGroups(req.Header.Pid) {
+		if g == req.Gid {
+			return true
 		}
-		return nil, nil, fuse.Errno(syscall.EIO)
-
 	}
+	return false
+}
 
-	child := &File{
-		inode:   cfile.Inode,
-		name:    req.Name,
-		parent:  d,
-		handles: 1,
-		writers: 1,
-		cfile:   cfile,
+// callerGroups the supplementary groups of the process pid, from /proc
+func callerGroups(pid uint32) []uint32 {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil
 	}
+	var groups []uint32
+	for _, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		for _, f := range strings.Fields(line[len("Groups:"):]) {
+			if g, err := strconv.ParseUint(f, 10, 32); err == nil {
+				groups = append(groups, uint32(g))
+			}
+		}
+	}
+	return groups
+}
 
-	d.active[req.Name] = &refcount{node: child}
-
-	return child, child, nil
+// mtimeOf the modification time of info, to the nanosecond
+func mtimeOf(info *mp.InodeInfo) time.Time {
+	return time.Unix(info.ModifiTime, int64(info.ModifiTimeNsec))
 }
 
-func (d *dir) forgetChild(name string, child node) {
-	if name == "" {
-		return
+// ctimeOf the change time of info, its mtime for the inodes that have none
+func ctimeOf(info *mp.InodeInfo) time.Time {
+	if info.ChangeTime == 0 {
+		return mtimeOf(info)
 	}
+	return time.Unix(info.ChangeTime, int64(info.ChangeTimeNsec))
+}
 
-	d.mu.Lock()
-	defer d.mu.Unlock()
+// atimeOf the access time of info, to the nanosecond
+func atimeOf(info *mp.InodeInfo) time.Time {
+	return time.Unix(info.AccessTime, int64(info.AccessTimeNsec))
+}
 
-	a, ok := d.active[name]
-	if !ok {
-		return
+// setTimes the utimensat of the entry name of the dir pinode
+func setTimes(filesys *FS, pinode uint64, name string, req *fuse.SetattrRequest) error {
+	if !req.Valid.Atime() && !req.Valid.Mtime() && !req.Valid.AtimeNow() && !req.Valid.MtimeNow() {
+		return nil
 	}
-
-	a.kernel = false
-	if a.refs == 0 {
-		delete(d.active, name)
+	if readOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+	now := time.Now()
+	var atime, mtime time.Time
+	switch {
+	case req.Valid.AtimeNow():
+		atime = now
+	case req.Valid.Atime():
+		atime = req.Atime
+	}
+	switch {
+	case req.Valid.MtimeNow():
+		mtime = now
+	case req.Valid.Mtime():
+		mtime = req.Mtime
+	}
+	switch ret := filesys.cfs.SetTimes(pinode, name, atime, mtime); ret {
+	case 0:
+		return nil
+	case 2:
+		return fuse.ENOENT
+	default:
+		return errIO(ret)
 	}
 }
 
-func (d *dir) Forget() {
-
-	if d.parent == nil {
-		return
-	}
+var _ fs.NodeSetattrer = (*dir)(nil)
 
+// Setattr of a dir, only its owner and its times are kept
+func (d *dir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
 	d.mu.Lock()
-	name := d.name
+	parent, name := d.parent, d.name
 	d.mu.Unlock()
-
-	d.parent.forgetChild(name, d)
-}
-
-// Mkdir ...
-func (d *dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
-
-	ret, inode := d.fs.cfs.CreateDirDirect(d.inode, req.Name)
-	if ret == -1 {
-		return nil, fuse.Errno(syscall.EIO)
+	if parent == nil {
+		// the dentry of the root is not known, the volume root has none
+		if req.Valid.Uid() || req.Valid.Gid() || req.Valid.Mode() {
+			return fuse.EPERM
+		}
+		return nil
 	}
-	if ret == 1 {
-		return nil, fuse.Errno(syscall.EPERM)
+	if err := setOwner(d.fs, parent.inode, name, req); err != nil {
+		return err
 	}
-	if ret == 2 {
-		return nil, fuse.Errno(syscall.ENOENT)
+	if err := setMode(d.fs, parent.inode, name, req); err != nil {
+		return err
 	}
-	if ret == 17 {
-		return nil, fuse.Errno(syscall.EEXIST)
+	if err := setTimes(d.fs, parent.inode, name, req); err != nil {
+		return err
+	}
+	if req.Valid.Uid() || req.Valid.Gid() || req.Valid.Mode() || req.Valid.Atime() || req.Valid.Mtime() || req.Valid.AtimeNow() || req.Valid.MtimeNow() {
+		if ret, _, info := d.fs.cfs.GetInodeInfoDirect(parent.inode, name); ret == 0 {
+			d.mu.Lock()
+			d.attr = info
+			d.mu.Unlock()
+		}
 	}
+	return d.Attr(ctx, &resp.Attr)
+}
 
-	child := newDir(d.fs, inode, d, req.Name)
+// recursive usage of the subtree, kept by the metanode
+const (
+	xattrRBytes   = "cfs.dir.rbytes"
+	xattrRFiles   = "cfs.dir.rfiles"
+	xattrRSubdirs = "cfs.dir.rsubdirs"
+)
 
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	d.active[req.Name] = &refcount{node: child, kernel: true}
+// xattrLifecycle the lifecycle rules of a dir, as delete:30d,archive:7d
+const xattrLifecycle = "cfs.lifecycle"
 
-	return child, nil
-}
+// xattrPolicy the storage policy of a file or dir, as replicas=2,tier=ssd, taken by
+// the new entries of a dir
+const xattrPolicy = "cfs.policy"
 
-// Remove ...
-func (d *dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+// xattrGeneration the generation of the inode, read only. Inode numbers may come back
+// after a file is deleted, a volume restored from a dump or recreated, (st_ino, generation)
+// tells the files apart, for an NFS re-export or a backup tool.
+const xattrGeneration = "cfs.generation"
 
-	if req.Dir {
-		ret := d.fs.cfs.DeleteDirDirect(d.inode, req.Name)
-		if ret != 0 {
-			if ret == 2 {
-				return fuse.Errno(syscall.EPERM)
-			}
-			return fuse.Errno(syscall.EIO)
+// getGeneration answers the xattrGeneration of name of pinode
+func getGeneration(ctx context.Context, c *cfs.CFS, pinode uint64, name string, resp *fuse.GetxattrResponse) error {
+	ret, _, info := c.WithContext(ctx).GetInodeInfoDirect(pinode, name)
+	if ret != 0 {
+		if ctx.Err() != nil {
+			return errInterrupted
+		}
+		if ret == 2 {
+			return fuse.ENOENT
+		}
+		return errIO(ret)
+	}
+	resp.Xattr = []byte(strconv.FormatUint(info.Generation, 10))
+	return nil
+}
 
+// getPolicy answers the xattrPolicy of name of pinode
+func getPolicy(ctx context.Context, c *cfs.CFS, pinode uint64, name string, resp *fuse.GetxattrResponse) error {
+	ret, policy := c.WithContext(ctx).GetPolicy(pinode, name)
+	if ret != 0 {
+		if ctx.Err() != nil {
+			return errInterrupted
 		}
-	} else {
-		ret := d.fs.cfs.DeleteFileDirect(d.inode, req.Name)
-		if ret != 0 {
-			if ret == 2 {
-				return fuse.Errno(syscall.EPERM)
-			}
-			return fuse.Errno(syscall.EIO)
+		return errIO(ret)
+	}
+	if policy == "" {
+		return fuse.ErrNoXattr
+	}
+	resp.Xattr = []byte(policy)
+	return nil
+}
+
+// setPolicy sets the xattrPolicy of name of pinode, empty drops it
+func setPolicy(ctx context.Context, c *cfs.CFS, pinode uint64, name string, policy string) error {
+	if readOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+	switch ret := c.WithContext(ctx).SetPolicy(pinode, name, strings.TrimSpace(policy)); ret {
+	case 0:
+		return nil
+	case 22:
+		return fuse.Errno(syscall.EINVAL)
+	case 95:
+		return fuse.Errno(syscall.ENOTSUP)
+	default:
+		if ctx.Err() != nil {
+			return errInterrupted
 		}
+		return errIO(ret)
 	}
+}
 
+// entry the parent inode and name of the dir, 0 and "" for the volume root
+func (d *dir) entry() (uint64, string) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-
-	if a, ok := d.active[req.Name]; ok {
-		delete(d.active, req.Name)
-		a.node.setName("")
+	if d.parent == nil {
+		// the subpath mounted, not the volume root
+		return d.fs.rootPInode, d.fs.rootName
 	}
+	return d.parent.inode, d.name
+}
 
+// Getxattr serves the virtual usage xattrs, getfattr -n cfs.dir.rbytes is a du of the tree,
+// the lifecycle rules, the storage policy and the generation
+func (d *dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	switch req.Name {
+	case xattrRBytes, xattrRFiles, xattrRSubdirs:
+	case xattrLifecycle:
+		pinode, name := d.entry()
+		ret, rules := d.fs.cfs.WithContext(ctx).GetLifecycle(pinode, name)
+		if ret != 0 {
+			if ctx.Err() != nil {
+				return errInterrupted
+			}
+			return errIO(ret)
+		}
+		if rules == "" {
+			return fuse.ErrNoXattr
+		}
+		resp.Xattr = []byte(rules)
+		return nil
+	case xattrPolicy:
+		pinode, name := d.entry()
+		return getPolicy(ctx, d.fs.cfs, pinode, name, resp)
+	case xattrGeneration:
+		pinode, name := d.entry()
+		if pinode == 0 && name == "" {
+			// the volume root has no dentry and is never recreated
+			return fuse.ErrNoXattr
+		}
+		return getGeneration(ctx, d.fs.cfs, pinode, name, resp)
+	default:
+		return fuse.ErrNoXattr
+	}
+	ret, du := d.fs.cfs.WithContext(ctx).DirUsage(d.inode)
+	if ret != 0 {
+		if ctx.Err() != nil {
+			return errInterrupted
+		}
+		return errIO(ret)
+	}
+	var v int64
+	switch req.Name {
+	case xattrRBytes:
+		v = du.Bytes
+	case xattrRFiles:
+		v = du.Files
+	case xattrRSubdirs:
+		v = du.Dirs
+	}
+	resp.Xattr = []byte(strconv.FormatInt(v, 10))
 	return nil
 }
 
-// Rename ...
-func (d *dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+// Listxattr ...
+func (d *dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	resp.Append(xattrRBytes, xattrRFiles, xattrRSubdirs)
+	pinode, name := d.entry()
+	if ret, rules := d.fs.cfs.WithContext(ctx).GetLifecycle(pinode, name); ret == 0 && rules != "" {
+		resp.Append(xattrLifecycle)
+	}
+	if ret, policy := d.fs.cfs.WithContext(ctx).GetPolicy(pinode, name); ret == 0 && policy != "" {
+		resp.Append(xattrPolicy)
+	}
+	if pinode != 0 || name != "" {
+		resp.Append(xattrGeneration)
+	}
+	return nil
+}
 
-	ret, _, _ := d.fs.cfs.StatDirect(newDir.(*dir).inode, req.NewName)
-	if ret == 0 {
-		logger.Error("Rename Failed , newName in newDir is already exsit")
-		return fuse.Errno(syscall.EPERM)
+// Setxattr sets the lifecycle rules, setfattr -n cfs.lifecycle -v delete:30d, or the
+// storage policy, setfattr -n cfs.policy -v replicas=2
+func (d *dir) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	switch req.Name {
+	case xattrLifecycle:
+		return d.setLifecycle(ctx, string(req.Xattr))
+	case xattrPolicy:
+		pinode, name := d.entry()
+		return setPolicy(ctx, d.fs.cfs, pinode, name, string(req.Xattr))
 	}
+	return fuse.Errno(syscall.ENOTSUP)
+}
 
-	if newDir != d {
+// Removexattr drops the lifecycle rules or the storage policy
+func (d *dir) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	switch req.Name {
+	case xattrLifecycle:
+		return d.setLifecycle(ctx, "")
+	case xattrPolicy:
+		pinode, name := d.entry()
+		return setPolicy(ctx, d.fs.cfs, pinode, name, "")
+	}
+	return fuse.ErrNoXattr
+}
 
-		d.mu.Lock()
-		defer d.mu.Unlock()
+func (d *dir) setLifecycle(ctx context.Context, rules string) error {
+	if readOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+	pinode, name := d.entry()
+	switch ret := d.fs.cfs.WithContext(ctx).SetLifecycle(pinode, name, strings.TrimSpace(rules)); ret {
+	case 0:
+		return nil
+	case 22:
+		return fuse.Errno(syscall.EINVAL)
+	default:
+		if ctx.Err() != nil {
+			return errInterrupted
+		}
+		return errIO(ret)
+	}
+}
 
-		logger.Debug("Rename d.inode %v, req.OldName %v, newDir.(*dir).inode %v , req.NewName %v", d.inode, req.OldName, newDir.(*dir).inode, req.NewName)
+// Lookup answers the entry with the generation of its inode: a file recreated
+// under an inode number that came back is told apart, by an NFS re-export
+func (d *dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
 
-		ret := d.fs.cfs.RenameDirect(d.inode, req.OldName, newDir.(*dir).inode, req.NewName)
-		if ret != 0 {
-			if ret == 2 {
-				return fuse.Errno(syscall.ENOENT)
-			} else if ret == 1 || ret == 17 {
-				return fuse.Errno(syscall.EPERM)
-			} else {
-				return fuse.Errno(syscall.EIO)
-			}
-		}
+	name := req.Name
+	var srcPath string
+	if cfs.MigrateSource != "" {
+		srcPath = d.sourcePath(name)
+	}
 
-		if aOld, ok := d.active[req.OldName]; ok {
-			delete(d.active, req.OldName)
-			aOld.node.setName(req.NewName)
-			aOld.node.setParentInode(newDir.(*dir))
-			//d.active[req.NewName] = aOld
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
+	if a, ok := d.active[name]; ok {
+		return a.node, nil
+	}
+	if d.isNegative(name) {
+		return nil, fuse.ENOENT
+	}
+	if e, ok := d.takeListed(name); ok {
+		n, _ := d.reviveNode(e.inodeType, e.inode, name)
+		switch n := n.(type) {
+		case *File:
+			n.cacheAttr(e.info)
+		case *dir:
+			// the listing does not count its subdirs, Nlink is 1 until it expires
+			n.attr, n.attrExpire = e.info, e.expire
 		}
+		d.active[name] = &refcount{node: n, kernel: true}
+		resp.Generation = e.info.Generation
+		return n, nil
+	}
 
-	} else {
-
+	ret, inodeType, inode, gen := d.fs.cfs.WithContext(ctx).StatGeneration(d.inode, name)
+	if ret != 0 && ctx.Err() != nil {
+		return nil, errInterrupted
+	}
+	if ret == 2 && srcPath != "" && !d.fs.cfs.MigrateTombstoned(d.inode, name) {
+		// the copy takes as long as the file, the other ops of d go on meanwhile
+		d.mu.Unlock()
+		ret = d.migrate(name, srcPath)
 		d.mu.Lock()
-		defer d.mu.Unlock()
-
-		logger.Debug("Rename d.inode %v, req.OldName %v, newDir.(*dir).inode %v , req.NewName %v", d.inode, req.OldName, newDir.(*dir).inode, req.NewName)
-
-		ret := d.fs.cfs.RenameDirect(d.inode, req.OldName, d.inode, req.NewName)
-		if ret != 0 {
-			if ret == 2 {
-				return fuse.Errno(syscall.ENOENT)
-			} else if ret == 1 || ret == 17 {
-				return fuse.Errno(syscall.EPERM)
-			} else {
-				return fuse.Errno(syscall.EIO)
-			}
+		if a, ok := d.active[name]; ok {
+			return a.node, nil
 		}
-
-		if a, ok := d.active[req.NewName]; ok {
-			a.node.setName("")
+		if ret == 0 {
+			ret, inodeType, inode, gen = d.fs.cfs.StatGeneration(d.inode, name)
 		}
+	}
 
-		if aOld, ok := d.active[req.OldName]; ok {
-			aOld.node.setName(req.NewName)
-			delete(d.active, req.OldName)
-			d.active[req.NewName] = aOld
-		}
+	if ret == 2 {
+		d.cacheNegative(name)
+		return nil, fuse.ENOENT
+	}
+	if ret == utils.Unavailable {
+		return nil, errIO(ret)
+	}
+	if ret != 0 {
+		return nil, fuse.ENOENT
 	}
+	n, _ := d.reviveNode(inodeType, inode, name)
 
-	return nil
-}
+	a := &refcount{node: n}
+	d.active[name] = a
 
-type node interface {
-	fs.Node
-	setName(name string)
-	setParentInode(pdir *dir)
+	a.kernel = true
+
+	resp.Generation = gen
+	return a.node, nil
 }
 
-// File struct
-type File struct {
-	mu    sync.Mutex
-	inode uint64
+// sourcePath path of name under d in the migration source
+func (d *dir) sourcePath(name string) string {
+	elems := []string{name}
+	for n := d; n != nil; {
+		n.mu.Lock()
+		elems = append(elems, n.name)
+		parent := n.parent
+		n.mu.Unlock()
+		n = parent
+	}
+	for i, j := 0, len(elems)-1; i < j; i, j = i+1, j-1 {
+		elems[i], elems[j] = elems[j], elems[i]
+	}
+	return filepath.Join(cfs.MigrateSource, filepath.Join(elems...))
+}
 
-	parent  *dir
-	name    string
-	writers uint
-	handles uint32
-	cfile   *cfs.CFile
+// migrate copies name in from the migration source, only dirs and regular files are migrated
+func (d *dir) migrate(name string, srcPath string) int32 {
+	fi, err := os.Lstat(srcPath)
+	if err != nil {
+		return 2
+	}
+	switch {
+	case fi.IsDir():
+		return d.fs.cfs.MigrateDir(d.inode, name)
+	case fi.Mode().IsRegular():
+		return d.fs.cfs.MigrateFile(d.inode, name, srcPath)
+	default:
+		logger.Debug("migrate %v: unsupported file type %v", srcPath, fi.Mode())
+		return 2
+	}
 }
 
-var _ node = (*File)(nil)
-var _ = fs.Node(&File{})
-var _ = fs.Handle(&File{})
+// migrateRemoved leaves a tombstone for name, removed from d or renamed away, when
+// the migration source has it at srcPath: Lookup would copy it in again
+func (d *dir) migrateRemoved(name string, srcPath string) {
+	if srcPath == "" {
+		return
+	}
+	if _, err := os.Lstat(srcPath); err != nil {
+		return
+	}
+	if ret := d.fs.cfs.MigrateRemoved(d.inode, name); ret != 0 {
+		logger.Error("tombstone of %v in dir %v ret:%v, it comes back from %v", name, d.inode, ret, srcPath)
+	}
+}
 
-func (f *File) setName(name string) {
+func (d *dir) reviveDir(inode uint64, name string) (*dir, error) {
+	child := newDir(d.fs, inode, d, name)
+	return child, nil
+}
 
-	f.mu.Lock()
-	f.name = name
-	f.mu.Unlock()
+func (d *dir) reviveNode(inodeType bool, inode uint64, name string) (node, error) {
+	if inodeType {
+		child := &File{
+			inode:  inode,
+			name:   name,
+			parent: d,
+		}
+		return child, nil
+	}
+	child, _ := d.reviveDir(inode, name)
+	return child, nil
 
 }
 
-func (f *File) setParentInode(pdir *dir) {
+// Open ...
+func (d *dir) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	ds := d.fs.cfs.NewDirStream(d.inode)
+	ds.Ino = d.fs.ino
+	if readdirPlus {
+		ds.Attrs = d.cacheListed
+	}
 
-	f.mu.Lock()
-	f.parent = pdir
-	f.mu.Unlock()
+	// entries not migrated yet, Lookup copies them in
+	if cfs.MigrateSource != "" {
+		srcDir := d.sourcePath("")
+		ds.Extra = func() []*mp.DirentN {
+			fis, _ := ioutil.ReadDir(srcDir)
+			stones := d.fs.cfs.MigrateTombstones(d.inode)
+			var res []*mp.DirentN
+			for _, fi := range fis {
+				if !fi.IsDir() && !fi.Mode().IsRegular() || stones[fi.Name()] {
+					continue
+				}
+				res = append(res, &mp.DirentN{Name: fi.Name(), InodeType: !fi.IsDir()})
+			}
+			return res
+		}
+	}
+	return &dirHandle{d: d, ds: ds, seen: d.seq()}, nil
 }
 
-// Attr ...
-func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
+// dirHandle streams a listing to the kernel, one per opendir
+type dirHandle struct {
+	d    *dir
+	mu   sync.Mutex
+	ds   *cfs.DirStream
+	seen uint64 // pollSeq when the listing started
+}
 
-	f.mu.Lock()
-	defer f.mu.Unlock()
-	ret, inode, inodeInfo := f.parent.fs.cfs.GetInodeInfoDirect(f.parent.inode, f.name)
+var _ fs.HandleReader = (*dirHandle)(nil)
+var _ fs.HandleReleaser = (*dirHandle)(nil)
+var _ fs.HandlePoller = (*dirHandle)(nil)
+
+// Read ...
+func (h *dirHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if req.Offset == 0 {
+		h.seen = h.d.seq()
+	}
+	data, ret := h.ds.ReadContext(ctx, req.Offset, req.Size)
+	if ret != 0 && ctx.Err() != nil {
+		return errInterrupted
+	}
+	if ret == 2 {
+		return fuse.Errno(syscall.ENOENT)
+	}
 	if ret != 0 {
-		return nil
+		return errIO(ret)
 	}
+	resp.Data = append(resp.Data[:0], data...)
+	return nil
+}
 
-	a.Ctime = time.Unix(inodeInfo.ModifiTime, 0)
-	a.Mtime = time.Unix(inodeInfo.ModifiTime, 0)
-	a.Atime = time.Unix(inodeInfo.AccessTime, 0)
-	a.Size = uint64(inodeInfo.FileSize)
-	a.Inode = uint64(inode)
+// Release ...
+func (h *dirHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	h.mu.Lock()
+	h.ds = nil
+	h.mu.Unlock()
+	return nil
+}
 
-	a.BlockSize = 4 * 1024 // this is for fuse attr quick update
-	a.Blocks = uint64(math.Ceil(float64(a.Size) / float64(a.BlockSize)))
-	a.Mode = 0666
-	//a.Valid = 0
+// Poll reports POLLIN once an entry changed since the handle listed the dir from the start
+func (h *dirHandle) Poll(ctx context.Context, req *fuse.PollRequest, resp *fuse.PollResponse) error {
+	if !dirNotify {
+		return fuse.Errno(syscall.ENOSYS)
+	}
+	polledDirs.add(h.d)
+
+	h.mu.Lock()
+	seen := h.seen
+	h.mu.Unlock()
 
+	d := h.d
+	d.pollMu.Lock()
+	defer d.pollMu.Unlock()
+	if d.pollSeq != seen {
+		resp.REvents = fuse.PollIn
+		return nil
+	}
+	if w, ok := req.Wakeup(); ok {
+		d.wakeups = append(d.wakeups, w)
+	}
 	return nil
 }
 
-var _ = fs.NodeOpener(&File{})
+// dirNotify dirs open for polling signal POLLIN when an entry changes on any client,
+// so sync daemons and indexers wait on the dir fd instead of rescanning
+var dirNotify bool
 
-// Open ...
-func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
-	var ret int32
+// polledDirs dirs a handle polled, by volume and inode
+var polledDirs = dirSet{dirs: make(map[string]map[uint64]*dir)}
 
-	logger.Debug("Open path %v name %v Flags %v", f.parent.name, f.name, req.Flags)
+type dirSet struct {
+	sync.Mutex
+	dirs map[string]map[uint64]*dir
+}
 
-	if int(req.Flags)&os.O_TRUNC != 0 {
-		return nil, fuse.Errno(syscall.EPERM)
+func (s *dirSet) add(d *dir) {
+	volID := d.fs.cfs.VolID
+	s.Lock()
+	if s.dirs[volID] == nil {
+		s.dirs[volID] = make(map[uint64]*dir)
 	}
+	s.dirs[volID][d.inode] = d
+	s.Unlock()
+}
 
-	f.mu.Lock()
-	defer f.mu.Unlock()
-
-	if f.writers > 0 {
-		if int(req.Flags)&os.O_WRONLY != 0 || int(req.Flags)&os.O_RDWR != 0 {
-			return nil, fuse.Errno(syscall.EPERM)
-		}
+func (s *dirSet) del(d *dir) {
+	s.Lock()
+	if s.dirs[d.fs.cfs.VolID][d.inode] == d {
+		delete(s.dirs[d.fs.cfs.VolID], d.inode)
 	}
+	s.Unlock()
+}
 
-	if f.cfile == nil && f.handles == 0 {
-		ret, f.cfile = f.parent.fs.cfs.OpenFileDirect(f.parent.inode, f.name, int(req.Flags))
-		if ret != 0 {
-			return nil, fuse.Errno(syscall.EIO)
+// changed wakes the pollers of the dirs ev touches, of all dirs when events were lost
+func (s *dirSet) changed(volID string, ev *mp.ChangeEvent) {
+	var dirs []*dir
+	s.Lock()
+	if ev == nil {
+		for _, d := range s.dirs[volID] {
+			dirs = append(dirs, d)
 		}
 	} else {
-		f.parent.fs.cfs.UpdateOpenFileDirect(f.parent.inode, f.name, f.cfile, int(req.Flags))
+		if d, ok := s.dirs[volID][ev.PInode]; ok {
+			dirs = append(dirs, d)
+		}
+		if d, ok := s.dirs[volID][ev.NewPInode]; ok && ev.Op == cfs.ChangeRename && ev.NewPInode != ev.PInode {
+			dirs = append(dirs, d)
+		}
+	}
+	s.Unlock()
+
+	for _, d := range dirs {
+		d.wake()
+	}
+}
+
+func (d *dir) seq() uint64 {
+	d.pollMu.Lock()
+	defer d.pollMu.Unlock()
+	return d.pollSeq
+}
+
+// wake marks the dir changed and wakes its pollers
+func (d *dir) wake() {
+	d.pollMu.Lock()
+	d.pollSeq++
+	wakeups := d.wakeups
+	d.wakeups = nil
+	d.pollMu.Unlock()
+
+	if fuseServer == nil {
+		return
+	}
+	for _, w := range wakeups {
+		if err := fuseServer.NotifyPollWakeup(w); err != nil {
+			logger.Debug("poll wakeup of %v err:%v", d.name, err)
+		}
+	}
+}
+
+// Create ...
+func (d *dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+
+	logger.Debug("Create path %v name %v Flags %v", d.name, req.Name, req.Flags)
+
+	quiesce.Enter()
+	defer quiesce.Exit()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	uid, gid, err := volumeOwner(req.Uid, req.Gid)
+	if err != nil {
+		return nil, nil, err
+	}
+	ret, cfile := d.fs.cfs.WithOwner(uid, gid).WithMode(stMode(req.Mode)).CreateFileDirect(d.inode, req.Name, int(req.Flags))
+	d.clearNegative(req.Name)
+	if ret != 0 {
+		if ret == 17 {
+			return nil, nil, fuse.Errno(syscall.EEXIST)
+
+		}
+		return nil, nil, errIO(ret)
+
+	}
+
+	child := &File{
+		inode:   cfile.Inode,
+		name:    req.Name,
+		parent:  d,
+		handles: 1,
+		writers: 1,
+		cfile:   cfile,
+	}
+	child.cacheAttr(cfile.InodeInfo)
+
+	d.active[req.Name] = &refcount{node: child}
+	d.fs.cfs.Opened(d.inode, child.inode)
+	child.acquireLease(true)
+	resp.Generation = cfile.InodeInfo.Generation
+
+	if useDirectIO(req.Name) {
+		resp.Flags = fuse.OpenDirectIO
+	} else {
+		cachedFiles.add(child)
+	}
+	return child, child.newHandle(req.Flags), nil
+}
+
+func (d *dir) forgetChild(name string, child node) {
+	if name == "" {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	a, ok := d.active[name]
+	if !ok {
+		return
+	}
+
+	a.kernel = false
+	if a.refs == 0 {
+		delete(d.active, name)
+	}
+}
+
+func (d *dir) Forget() {
+
+	polledDirs.del(d)
+	d.dropCache()
+	if d.parent == nil {
+		return
+	}
+
+	d.mu.Lock()
+	name := d.name
+	d.mu.Unlock()
+
+	d.parent.forgetChild(name, d)
+}
+
+// Mkdir ...
+func (d *dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+
+	quiesce.Enter()
+	defer quiesce.Exit()
+
+	uid, gid, err := volumeOwner(req.Uid, req.Gid)
+	if err != nil {
+		return nil, err
+	}
+	ret, inode, inodeInfo := d.fs.cfs.WithOwner(uid, gid).WithMode(stMode(req.Mode)).CreateDirDirect(d.inode, req.Name)
+	d.clearNegative(req.Name)
+	if ret == -1 {
+		return nil, fuse.Errno(syscall.EIO)
+	}
+	if ret == 1 {
+		return nil, fuse.Errno(syscall.EPERM)
+	}
+	if ret == 2 {
+		return nil, fuse.Errno(syscall.ENOENT)
+	}
+	if ret == 17 {
+		return nil, fuse.Errno(syscall.EEXIST)
+	}
+	if ret != 0 {
+		return nil, errIO(ret)
+	}
+
+	child := newDir(d.fs, inode, d, req.Name)
+	child.attr = inodeInfo
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.active[req.Name] = &refcount{node: child, kernel: true}
+
+	return child, nil
+}
+
+// Symlink the volume has no symlinks, the callers get ENOTSUP rather than the EIO
+// of a missing op
+func (d *dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+	logger.Error("symlink %v -> %v in dir %v: not supported", req.NewName, req.Target, d.inode)
+	return nil, fuse.Errno(syscall.ENOTSUP)
+}
+
+// Link the volume has no hard links
+func (d *dir) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (fs.Node, error) {
+	logger.Error("link %v in dir %v: not supported", req.NewName, d.inode)
+	return nil, fuse.Errno(syscall.ENOTSUP)
+}
+
+// Mknod the volume keeps regular files and dirs only, no devices, fifos or sockets
+func (d *dir) Mknod(ctx context.Context, req *fuse.MknodRequest) (fs.Node, error) {
+	logger.Error("mknod %v mode %v in dir %v: not supported", req.Name, req.Mode, d.inode)
+	return nil, fuse.Errno(syscall.ENOTSUP)
+}
+
+// Remove ...
+func (d *dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+
+	quiesce.Enter()
+	defer quiesce.Exit()
+
+	var srcPath string
+	if cfs.MigrateSource != "" {
+		srcPath = d.sourcePath(req.Name)
+	}
+	d.forgetListed(req.Name)
+	if req.Dir {
+		ret := d.fs.cfs.DeleteDirDirect(d.inode, req.Name)
+		switch ret {
+		case 0:
+		case 2:
+			return fuse.ENOENT
+		case 20:
+			return fuse.Errno(syscall.ENOTDIR)
+		case 39:
+			return fuse.Errno(syscall.ENOTEMPTY)
+		default:
+			return errIO(ret)
+		}
+	} else if f := d.openFile(req.Name); f != nil {
+		// its handles go on reading and writing it, the metanode keeps it
+		ret, orphaned := d.fs.cfs.UnlinkOpen(d.inode, req.Name)
+		if ret != 0 {
+			if ret == 2 {
+				return fuse.Errno(syscall.EPERM)
+			}
+			return errIO(ret)
+		}
+		if orphaned {
+			d.mu.Lock()
+			if a, ok := d.active[req.Name]; ok && a.node == f {
+				delete(d.active, req.Name)
+			}
+			d.mu.Unlock()
+			f.orphan()
+			d.migrateRemoved(req.Name, srcPath)
+			return nil
+		}
+	} else {
+		ret := d.fs.cfs.DeleteFileDirect(d.inode, req.Name)
+		if ret != 0 {
+			if ret == 2 {
+				return fuse.Errno(syscall.EPERM)
+			}
+			return errIO(ret)
+		}
+	}
+
+	d.mu.Lock()
+	if a, ok := d.active[req.Name]; ok {
+		delete(d.active, req.Name)
+		a.node.setName("")
+	}
+	d.mu.Unlock()
+
+	d.migrateRemoved(req.Name, srcPath)
+	return nil
+}
+
+// openFile the file name of d while it has open handles
+func (d *dir) openFile(name string) *File {
+	d.mu.Lock()
+	a, ok := d.active[name]
+	d.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	f, ok := a.node.(*File)
+	if !ok {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.handles == 0 {
+		return nil
+	}
+	return f
+}
+
+// Rename ...
+func (d *dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) (err error) {
+
+	quiesce.Enter()
+	defer quiesce.Exit()
+
+	// volumes of a federation mount are separate filesystems
+	if nd, ok := newDir.(*dir); !ok || nd.fs != d.fs {
+		return fuse.Errno(syscall.EXDEV)
+	}
+
+	defer newDir.(*dir).clearNegative(req.NewName)
+	d.forgetListed(req.OldName)
+	if cfs.MigrateSource != "" {
+		srcPath := d.sourcePath(req.OldName)
+		defer func() {
+			if err == nil {
+				d.migrateRemoved(req.OldName, srcPath)
+			}
+		}()
+	}
+
+	if newDir != d {
+
+		d.mu.Lock()
+
+		logger.Debug("Rename d.inode %v, req.OldName %v, newDir.(*dir).inode %v , req.NewName %v", d.inode, req.OldName, newDir.(*dir).inode, req.NewName)
+
+		ret := d.fs.cfs.RenameDirect(d.inode, req.OldName, newDir.(*dir).inode, req.NewName)
+		if ret != 0 {
+			d.mu.Unlock()
+			return renameErr(ret)
+		}
+
+		if aOld, ok := d.active[req.OldName]; ok {
+			delete(d.active, req.OldName)
+			aOld.node.setName(req.NewName)
+			aOld.node.setParentInode(newDir.(*dir))
+			//d.active[req.NewName] = aOld
+
+		}
+		d.mu.Unlock()
+
+		// not under d.mu, a rename the other way holds the locks in the other order
+		nd := newDir.(*dir)
+		nd.mu.Lock()
+		if a, ok := nd.active[req.NewName]; ok {
+			// the replaced node
+			a.node.setName("")
+			delete(nd.active, req.NewName)
+		}
+		nd.mu.Unlock()
+
+	} else {
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		logger.Debug("Rename d.inode %v, req.OldName %v, newDir.(*dir).inode %v , req.NewName %v", d.inode, req.OldName, newDir.(*dir).inode, req.NewName)
+
+		ret := d.fs.cfs.RenameDirect(d.inode, req.OldName, d.inode, req.NewName)
+		if ret != 0 {
+			return renameErr(ret)
+		}
+
+		if a, ok := d.active[req.NewName]; ok {
+			// the replaced node
+			a.node.setName("")
+			delete(d.active, req.NewName)
+		}
+
+		if aOld, ok := d.active[req.OldName]; ok {
+			aOld.node.setName(req.NewName)
+			delete(d.active, req.OldName)
+			d.active[req.NewName] = aOld
+		}
+	}
+
+	return nil
+}
+
+// renameErr an existing target is replaced by the metanode, like rename(2)
+func renameErr(ret int32) error {
+	switch ret {
+	case 2:
+		return fuse.Errno(syscall.ENOENT)
+	case 20:
+		return fuse.Errno(syscall.ENOTDIR)
+	case 21:
+		return fuse.Errno(syscall.EISDIR)
+	case 39:
+		return fuse.Errno(syscall.ENOTEMPTY)
+	case 18:
+		// across shards, mv copies
+		return fuse.Errno(syscall.EXDEV)
+	case 1, 17:
+		return fuse.Errno(syscall.EPERM)
+	}
+	return errIO(ret)
+}
+
+type node interface {
+	fs.Node
+	setName(name string)
+	setParentInode(pdir *dir)
+}
+
+// File struct
+type File struct {
+	mu    sync.Mutex
+	inode uint64
+
+	parent  *dir
+	name    string
+	writers uint
+	handles uint32
+	cfile   *cfs.CFile
+
+	// attributes from create or the last GetInodeInfo, valid until attrExpire
+	attr       *mp.InodeInfo
+	attrExpire time.Time
+
+	// the last attributes fetched, kept when attr is dropped. Attr falls back
+	// on them while the metanode cannot be reached, see attrStaleMax
+	lastAttr   *mp.InodeInfo
+	lastAttrAt time.Time
+
+	// lease from the metanode, while held the cached attributes and pages are
+	// trusted as no other client can write (or, for a write lease, read) the file
+	leased     bool
+	leaseWrite bool
+
+	// shared_write: another client appended since the write lease was revoked
+	stale bool
+
+	// access time set by the last read, ahead of the metanode until it is flushed
+	atime int64
+
+	// unlinked while open, kept by the metanode under cfs.OrphanName until the
+	// last handle is released
+	orphaned bool
+
+	// pages written back past the end, by offset, waiting for the ones before them
+	pending      map[int64][]byte
+	pendingBytes int
+}
+
+// attrCacheTTL how long Attr trusts cached attributes of a file
+var attrCacheTTL = time.Second
+
+// attrStaleMax how old the attributes Attr falls back on may be when they
+// cannot be refreshed, past it Attr fails with EIO. Open files fall back on
+// their handle whatever the age
+var attrStaleMax = utils.NewDuration(30 * time.Second)
+
+// atimePolicy how reads set the access time of a file. strict: every read, relatime:
+// the first read after a change or a day after the last access, like the kernel,
+// noatime: never. relatime ones go to the metanode in batches every atimeFlush.
+var atimePolicy = "relatime"
+var atimeFlush = 30 * time.Second
+
+// touchAtime after a read, must be called with f.mu held
+func (f *File) touchAtime() {
+	if atimePolicy == "noatime" || readOnly {
+		return
+	}
+	now := time.Now().Unix()
+	atime, mtime := f.atime, int64(0)
+	for _, info := range []*mp.InodeInfo{f.lastAttr, f.cfile.InodeInfo} {
+		if info == nil {
+			continue
+		}
+		if info.AccessTime > atime {
+			atime = info.AccessTime
+		}
+		if info.ModifiTime > mtime {
+			mtime = info.ModifiTime
+		}
+	}
+	switch atimePolicy {
+	case "strict":
+		if now <= atime {
+			return
+		}
+		f.atime = now
+		go f.parent.fs.cfs.SetAccessTimes(f.parent.inode, []string{f.name}, []int64{now})
+	default:
+		if atime > mtime && now-atime < 24*3600 {
+			return
+		}
+		f.atime = now
+		f.parent.fs.cfs.QueueAccessTime(f.parent.inode, f.name, now)
+	}
+}
+
+// cacheAttr must be called with f.mu held
+func (f *File) cacheAttr(inodeInfo *mp.InodeInfo) {
+	f.attr = inodeInfo
+	f.attrExpire = time.Now().Add(attrCacheTTL)
+	f.lastAttr = inodeInfo
+	f.lastAttrAt = time.Now()
+}
+
+// staleAttr the attributes to answer with when they cannot be refreshed, must be
+// called with f.mu held. An open handle knows the size it read or wrote up to.
+func (f *File) staleAttr() (*mp.InodeInfo, bool) {
+	if f.cfile != nil {
+		info := mp.InodeInfo{FileSize: f.cfile.FileSize}
+		if last := f.lastAttr; last != nil {
+			info.ModifiTime, info.AccessTime = last.ModifiTime, last.AccessTime
+			info.ModifiTimeNsec, info.AccessTimeNsec = last.ModifiTimeNsec, last.AccessTimeNsec
+			info.ChangeTime, info.ChangeTimeNsec = last.ChangeTime, last.ChangeTimeNsec
+		} else if last := f.cfile.InodeInfo; last != nil {
+			info.ModifiTime, info.AccessTime = last.ModifiTime, last.AccessTime
+			info.ModifiTimeNsec, info.AccessTimeNsec = last.ModifiTimeNsec, last.AccessTimeNsec
+			info.ChangeTime, info.ChangeTimeNsec = last.ChangeTime, last.ChangeTimeNsec
+		}
+		if f.lastAttr != nil && f.lastAttr.FileSize > info.FileSize {
+			// a reader whose handle has not seen the appends of others
+			info.FileSize = f.lastAttr.FileSize
+		}
+		return &info, true
+	}
+	if f.lastAttr != nil && time.Since(f.lastAttrAt) < attrStaleMax.Get() {
+		return f.lastAttr, true
+	}
+	return nil, false
+}
+
+// fileSet files opened for write, flushed on shutdown
+type fileSet struct {
+	sync.Mutex
+	files map[*File]bool
+}
+
+var writingFiles = fileSet{files: make(map[*File]bool)}
+
+// cachedFiles files open through the kernel page cache by volume and inode,
+// their pages are dropped when another client changes them
+var cachedFiles = cacheSet{files: make(map[string]map[uint64]*File)}
+
+type cacheSet struct {
+	sync.Mutex
+	files map[string]map[uint64]*File
+}
+
+func (cset *cacheSet) add(f *File) {
+	volID := f.parent.fs.cfs.VolID
+	cset.Lock()
+	if cset.files[volID] == nil {
+		cset.files[volID] = make(map[uint64]*File)
+	}
+	cset.files[volID][f.inode] = f
+	cset.Unlock()
+}
+
+func (cset *cacheSet) del(f *File) {
+	cset.Lock()
+	delete(cset.files[f.parent.fs.cfs.VolID], f.inode)
+	cset.Unlock()
+}
+
+// changed handles a change event of volID, nil means events were lost
+func (cset *cacheSet) changed(volID string, ev *mp.ChangeEvent) {
+	if ev != nil && ev.Op != cfs.ChangeWrite {
+		return
+	}
+	var files []*File
+	cset.Lock()
+	if ev == nil {
+		for _, f := range cset.files[volID] {
+			files = append(files, f)
+		}
+	} else if f, ok := cset.files[volID][ev.Inode]; ok {
+		files = append(files, f)
+	}
+	cset.Unlock()
+
+	for _, f := range files {
+		f.mu.Lock()
+		if f.writers > 0 || f.cfile == nil {
+			// our own writes
+			f.mu.Unlock()
+			continue
+		}
+		f.attr = nil
+		f.cfile.Refresh()
+		f.mu.Unlock()
+		invalidateKernel(f)
+	}
+}
+
+// invalidateKernel drops the attributes and pages the kernel caches for f
+func invalidateKernel(f *File) {
+	if fuseServer == nil {
+		return
+	}
+	if err := fuseServer.InvalidateNodeAttr(f); err != nil && err != fuse.ErrNotCached {
+		logger.Debug("invalidate attr of %v err:%v", f.name, err)
+	}
+	if err := fuseServer.InvalidateNodeData(f); err != nil && err != fuse.ErrNotCached {
+		logger.Debug("invalidate data of %v err:%v", f.name, err)
+	}
+}
+
+// leasedFiles open files holding a metanode lease, by volume and inode
+var leasedFiles = cacheSet{files: make(map[string]map[uint64]*File)}
+
+// acquireLease takes a lease for a new handle of f, false when leases are off or refused
+func (f *File) acquireLease(write bool) bool {
+	if cfs.LeaseClientID == "" {
+		return false
+	}
+	f.mu.Lock()
+	held := f.leased && (f.leaseWrite || !write)
+	f.mu.Unlock()
+	if held {
+		return true
+	}
+	if ret := f.parent.fs.cfs.AcquireLease(f.inode, write); ret != 0 {
+		logger.Error("AcquireLease of %v ret:%v, caching off", f.name, ret)
+		return false
+	}
+	f.mu.Lock()
+	f.leased = true
+	f.leaseWrite = f.leaseWrite || write
+	f.mu.Unlock()
+	leasedFiles.add(f)
+	return true
+}
+
+// sharedWrite lets several writers, local or on other clients, append to the same
+// file. Writers take turns through the write lease: a revoked writer flushes, and
+// continues after the appends of the others once it got the lease back.
+var sharedWrite bool
+
+// lockWriter locks f.mu holding the write lease, false with f.mu unlocked when the
+// lease cannot be had: the write would interleave with the one of another writer
+func (f *File) lockWriter() bool {
+	for i := 0; i < 3; i++ {
+		f.mu.Lock()
+		if f.leaseWrite || f.cfile == nil {
+			return true
+		}
+		f.mu.Unlock()
+		f.acquireLease(true)
+	}
+	logger.Error("no write lease of %v, write refused", f.name)
+	return false
+}
+
+// dropLease gives back the lease when the last handle is gone, f.mu must be held
+func (f *File) dropLease() {
+	if !f.leased {
+		return
+	}
+	f.leased = false
+	f.leaseWrite = false
+	leasedFiles.del(f)
+	f.parent.fs.cfs.ReleaseLease(f.inode)
+}
+
+// revoke gives back the lease of inode in volID after writing back the dirty data,
+// inode 0 when all the leases of the volume are lost
+func (cset *cacheSet) revoke(volID string, inode uint64) {
+	var files []*File
+	cset.Lock()
+	for ino, f := range cset.files[volID] {
+		if inode == 0 || ino == inode {
+			files = append(files, f)
+			delete(cset.files[volID], ino)
+		}
+	}
+	cset.Unlock()
+
+	for _, f := range files {
+		f.mu.Lock()
+		if f.leased && f.writers > 0 && f.cfile != nil {
+			f.cfile.Flush()
+			f.stale = sharedWrite
+		}
+		f.leased = false
+		f.leaseWrite = false
+		f.attr = nil
+		f.mu.Unlock()
+		invalidateKernel(f)
+	}
+	if inode != 0 {
+		// also when the file was closed in the meantime, the metanode waits for it
+		cfs.OpenFileSystem(volID).ReleaseLease(inode)
+	}
+}
+
+// releaseAll gives back every lease, before a freeze
+func (cset *cacheSet) releaseAll() {
+	cset.Lock()
+	var vols []string
+	for volID := range cset.files {
+		vols = append(vols, volID)
+	}
+	cset.Unlock()
+	for _, volID := range vols {
+		cset.Lock()
+		var inodes []uint64
+		for ino := range cset.files[volID] {
+			inodes = append(inodes, ino)
+		}
+		cset.Unlock()
+		for _, ino := range inodes {
+			cset.revoke(volID, ino)
+		}
+	}
+}
+
+// quiesce holds back mutating ops while the mount is frozen for a checkpoint
+var quiesce = cfs.NewQuiesce()
+
+func freeze() string {
+	if quiesce.Frozen() {
+		return "frozen"
+	}
+	logger.Error("freeze %v, flush dirty data", mountPoint)
+	quiesce.Freeze(func() {
+		writingFiles.flushAll(false)
+		leasedFiles.releaseAll()
+	})
+	return "frozen"
+}
+
+func thaw() string {
+	logger.Error("thaw %v", mountPoint)
+	quiesce.Thaw()
+	return "thawed"
+}
+
+func (fset *fileSet) add(f *File) {
+	fset.Lock()
+	fset.files[f] = true
+	fset.Unlock()
+}
+
+func (fset *fileSet) del(f *File) {
+	fset.Lock()
+	delete(fset.files, f)
+	fset.Unlock()
+}
+
+// flushAll flushes dirty buffers of all files opened for write, and closes their
+// datanode connections and journals when final, the mount going away. The files
+// are flushed off the set lock, an open or a release waits on none of them
+func (fset *fileSet) flushAll(final bool) {
+	fset.Lock()
+	files := make([]*File, 0, len(fset.files))
+	for f := range fset.files {
+		files = append(files, f)
+	}
+	fset.Unlock()
+	for _, f := range files {
+		f.mu.Lock()
+		if f.cfile != nil {
+			f.cfile.Flush()
+			if final {
+				f.cfile.CloseConns()
+			}
+		}
+		f.mu.Unlock()
+	}
+}
+
+var _ node = (*File)(nil)
+var _ = fs.Node(&File{})
+
+func (f *File) setName(name string) {
+
+	f.mu.Lock()
+	f.name = name
+	if f.cfile != nil && name != "" {
+		// the writes and the journal of the open file follow it
+		f.cfile.Renamed(f.parent.inode, name)
+	}
+	f.mu.Unlock()
+
+}
+
+// orphan renames f to its orphan name once the metanode kept it, its last Release
+// lets the metanode reclaim it
+func (f *File) orphan() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.name = cfs.OrphanName(f.inode)
+	if f.cfile != nil {
+		f.cfile.Name = f.name
+	}
+	f.orphaned = true
+	if f.handles == 0 {
+		// released meanwhile
+		go f.parent.fs.cfs.CloseOrphan(f.parent.inode, f.inode)
+	}
+}
+
+func (f *File) setParentInode(pdir *dir) {
+
+	f.mu.Lock()
+	f.parent = pdir
+	if f.cfile != nil && f.name != "" {
+		f.cfile.Renamed(pdir.inode, f.name)
+	}
+	f.mu.Unlock()
+}
+
+// Attr ...
+func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	inode, inodeInfo := f.inode, f.attr
+	if inodeInfo == nil || (!f.leased && time.Now().After(f.attrExpire)) {
+		var ret int32
+		var fresh *mp.InodeInfo
+		ret, inode, fresh = f.parent.fs.cfs.WithContext(ctx).GetInodeInfoDirect(f.parent.inode, f.name)
+		switch {
+		case ret != 0 && ctx.Err() != nil:
+			return errInterrupted
+		case ret == 0:
+			inodeInfo = fresh
+			f.cacheAttr(inodeInfo)
+		case ret == 2 /*ENOENT*/ :
+			// removed by another client, a zero size would pass for an empty file
+			return fuse.ENOENT
+		default:
+			var ok bool
+			if inodeInfo, ok = f.staleAttr(); !ok {
+				logger.Error("Attr %v ret:%v and no attributes to fall back on", f.name, ret)
+				return errIO(ret)
+			}
+			logger.Debug("Attr %v ret:%v, answered with cached attributes", f.name, ret)
+			inode = f.inode
+		}
+	}
+
+	a.Ctime = ctimeOf(inodeInfo)
+	a.Mtime = mtimeOf(inodeInfo)
+	a.Atime = atimeOf(inodeInfo)
+	if f.atime > inodeInfo.AccessTime {
+		// not flushed yet
+		a.Atime = time.Unix(f.atime, 0)
+	}
+	a.Size = uint64(inodeInfo.FileSize)
+	if f.leaseWrite && f.cfile != nil {
+		// the only writer, its buffered data counts
+		a.Size = uint64(f.cfile.FileSize)
+	}
+	a.Inode = f.parent.fs.ino(inode)
+
+	a.BlockSize = 4 * 1024 // this is for fuse attr quick update
+	a.Blocks = uint64(math.Ceil(float64(a.Size) / float64(a.BlockSize)))
+	a.Mode = permOf(inodeInfo, 0666)
+	attrOwner(a, inodeInfo)
+	//a.Valid = 0
+
+	return nil
+}
+
+var _ = fs.NodeOpener(&File{})
+
+// Open ...
+func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	var ret int32
+
+	logger.Debug("Open path %v name %v Flags %v", f.parent.name, f.name, req.Flags)
+
+	write := int(req.Flags)&os.O_WRONLY != 0 || int(req.Flags)&os.O_RDWR != 0
+	if write {
+		quiesce.Enter()
+		defer quiesce.Exit()
+	}
+	if int(req.Flags)&os.O_TRUNC != 0 && write {
+		if err := f.cut(0); err != nil {
+			return nil, err
+		}
+	}
+
+	// before opening, so a conflicting writer elsewhere has flushed
+	leased := f.acquireLease(write)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	appendOpen := int(req.Flags)&os.O_APPEND != 0
+	if f.writers > 0 && write {
+		// O_APPEND writers share the cfile, the metanode places each of their writes
+		if f.cfile.Appending() != appendOpen || !(appendOpen || sharedWrite) {
+			return nil, fuse.Errno(syscall.EPERM)
+		}
+	}
+
+	if f.handles == 0 {
+		// before the open, an unlink of another client after it keeps the file
+		f.parent.fs.cfs.Opened(f.parent.inode, f.inode)
+	}
+	if f.cfile == nil && f.handles == 0 {
+		ret, f.cfile = f.parent.fs.cfs.OpenFileDirect(f.parent.inode, f.name, int(req.Flags))
+		if ret != 0 {
+			f.parent.fs.cfs.Closed(f.inode)
+			f.dropLease()
+			return nil, errIO(ret)
+		}
+	} else {
+		flags := int(req.Flags)
+		if f.writers > 0 {
+			// shared_write or O_APPEND: the cfile is already set up for writing
+			flags &^= os.O_WRONLY | os.O_RDWR
+		}
+		f.parent.fs.cfs.UpdateOpenFileDirect(f.parent.inode, f.name, f.cfile, flags)
 	}
 
 	tmp := f.handles + 1
@@ -498,149 +2150,1132 @@ func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenR
 	if int(req.Flags)&os.O_WRONLY != 0 || int(req.Flags)&os.O_RDWR != 0 {
 		tmp := f.writers + 1
 		f.writers = tmp
+		writingFiles.add(f)
+	}
+
+	if useDirectIO(f.name) || appendOpen {
+		// page cache writeback would merge and split the appends
+		resp.Flags = fuse.OpenDirectIO
+	} else {
+		cachedFiles.add(f)
+		if leased && f.leased {
+			resp.Flags |= fuse.OpenKeepCache
+		}
+	}
+	return f.newHandle(req.Flags), nil
+}
+
+// fileHandle one open of a File, the kernel passes it back with the reads, writes,
+// flushes and the release of that open. The flags of the open stay with it, its
+// read state is kept by the cfile under the fuse handle id. The write buffer stays with the cfile of the File: the writers of
+// an append-only file all write at its end.
+type fileHandle struct {
+	f     *File
+	flags fuse.OpenFlags
+	write bool
+}
+
+var _ fs.HandleReader = (*fileHandle)(nil)
+var _ fs.HandleWriter = (*fileHandle)(nil)
+var _ fs.HandleFlusher = (*fileHandle)(nil)
+var _ fs.HandleReleaser = (*fileHandle)(nil)
+
+// openHandles the open file handles of the mount, reported with the session
+var openHandles int64
+
+func (f *File) newHandle(flags fuse.OpenFlags) *fileHandle {
+	atomic.AddInt64(&openHandles, 1)
+	return &fileHandle{
+		f:     f,
+		flags: flags,
+		write: int(flags)&os.O_WRONLY != 0 || int(flags)&os.O_RDWR != 0,
+	}
+}
+
+// Release ...
+func (h *fileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	logger.Debug("Release...")
+
+	f := h.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.handles--
+	atomic.AddInt64(&openHandles, -1)
+	if f.cfile != nil {
+		f.cfile.ReleaseReader(cfs.HandleID(req.Handle))
+	}
+
+	if h.write {
+		//f.cfile.Flush()
+		f.writers--
+		if f.writers == 0 {
+			f.holeLeft("release")
+			f.cfile.CloseConns()
+			writingFiles.del(f)
+			// for the watchers waiting for complete files
+			go f.parent.fs.cfs.CloseWrite(f.parent.inode, f.name, f.inode)
+		}
+	}
+
+	if f.handles == 0 {
+		f.cfile = nil
+		cachedFiles.del(f)
+		f.dropLease()
+		f.parent.fs.cfs.Closed(f.inode)
+		if f.orphaned {
+			go f.parent.fs.cfs.CloseOrphan(f.parent.inode, f.inode)
+		}
+	}
+
+	logger.Debug("Release end...")
+
+	return nil
+}
+
+// log with the volume, inode and op of a record on f
+func (f *File) log(op string) *logger.Entry {
+	return logger.WithFields(logger.Fields{
+		logger.FieldVolume: f.parent.fs.cfs.VolID,
+		logger.FieldInode:  f.inode,
+		logger.FieldOp:     op,
+	})
+}
+
+// readsInFlight the file reads being served, the other ops changing the volume
+// are counted by quiesce
+var readsInFlight int64
+
+// Read ...
+func (h *fileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+
+	atomic.AddInt64(&readsInFlight, 1)
+	defer atomic.AddInt64(&readsInFlight, -1)
+	f := h.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if req.Offset >= f.cfile.FileSize {
+		// the page cache reads whole pages, the last one goes past the end
+		logger.Debug("Request Read file offset at or past filesize")
+		return nil
+	}
+
+	length := f.cfile.ReadContext(ctx, cfs.HandleID(req.Handle), &resp.Data, req.Offset, int64(req.Size))
+	if length == cfs.Interrupted {
+		return errInterrupted
+	}
+	if length != int64(req.Size) {
+		logger.Debug("== Read reqsize:%v, but return datasize:%v ==\n", req.Size, length)
+	}
+	if length < 0 {
+		f.log("read").Error("Request Read file I/O Error(return data from cfs less than zero)")
+		return fuse.Errno(syscall.EIO)
+	}
+	f.touchAtime()
+	return nil
+}
+
+// Write ...
+func (h *fileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+
+	f := h.f
+	if !h.write {
+		return fuse.Errno(syscall.EBADF)
+	}
+	quiesce.Enter()
+	defer quiesce.Exit()
+	if sharedWrite {
+		if !f.lockWriter() {
+			return fuse.Errno(syscall.EAGAIN)
+		}
+	} else {
+		f.mu.Lock()
+	}
+	defer f.mu.Unlock()
+	f.attr = nil
+
+	if f.stale {
+		if ret := f.cfile.Reload(); ret != 0 {
+			logger.Error("Reload %v for append ret:%v", f.name, ret)
+			return fuse.Errno(syscall.EIO)
+		}
+		f.stale = false
+	}
+
+	if !useDirectIO(f.name) && !f.cfile.Appending() {
+		if err := f.pageWrite(ctx, cfs.HandleID(req.Handle), req.Offset, req.Data); err != nil {
+			return err
+		}
+		resp.Size = len(req.Data)
+		return nil
+	}
+	if err := f.appendWrite(req.Offset, req.Data); err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
+
+// pendingMax the bytes of the pages past the end a file holds at most
+const pendingMax = 64 << 20
+
+// pageWrite a write back of the page cache. The kernel writes the dirty pages in
+// any order, and a page holding the tail of the file again with the bytes already
+// sent. Files are append-only: the bytes before the end must be the ones written,
+// the pages past the end wait in pending for the ones before them.
+func (f *File) pageWrite(ctx context.Context, handleID cfs.HandleID, offset int64, data []byte) error {
+	if offset > f.cfile.FileSize {
+		if _, ok := f.pending[offset]; !ok && f.pendingBytes+len(data) > pendingMax {
+			f.log("write").Error("Write %v bytes at offset %v, %v bytes past the end %v wait already", len(data), offset, f.pendingBytes, f.cfile.FileSize)
+			return fuse.Errno(syscall.EIO)
+		}
+		if f.pending == nil {
+			f.pending = make(map[int64][]byte)
+		}
+		f.pendingBytes += len(data) - len(f.pending[offset])
+		f.pending[offset] = append([]byte(nil), data...)
+		return nil
+	}
+	for {
+		if err := f.tailWrite(ctx, handleID, offset, data); err != nil {
+			return err
+		}
+		// the pages the end reached now
+		found := false
+		for off, d := range f.pending {
+			if off <= f.cfile.FileSize {
+				delete(f.pending, off)
+				f.pendingBytes -= len(d)
+				offset, data, found = off, d, true
+				break
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+}
+
+// tailWrite writes the part of data past the end, the part before it must be the
+// bytes of the file: an overwrite of an append-only file fails with EPERM
+func (f *File) tailWrite(ctx context.Context, handleID cfs.HandleID, offset int64, data []byte) error {
+	if n := f.cfile.FileSize - offset; n > 0 {
+		if n > int64(len(data)) {
+			n = int64(len(data))
+		}
+		var old []byte
+		got := f.cfile.ReadContext(ctx, handleID, &old, offset, n)
+		if got >= 0 && got != n {
+			// the bytes span the chunks and the write buffer, the reads of the
+			// chunks get only what was sent
+			f.cfile.Flush()
+			old = old[:0]
+			got = f.cfile.ReadContext(ctx, handleID, &old, offset, n)
+		}
+		if got == cfs.Interrupted {
+			return errInterrupted
+		} else if got != n || !bytes.Equal(old, data[:n]) {
+			f.log("write").Error("Write %v bytes at offset %v before the end %v changes the file", len(data), offset, f.cfile.FileSize)
+			return fuse.EPERM
+		}
+		data = data[n:]
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return f.appendWrite(offset, data)
+}
+
+// appendWrite data at the end of the file
+func (f *File) appendWrite(offset int64, data []byte) error {
+	w := f.cfile.Write(data, int32(len(data)))
+	if w != int32(len(data)) {
+		f.log("write").WithFields(logger.Fields{logger.FieldError: w}).Error("Write %v bytes at offset %v failed", len(data), offset)
+		if w == -1 {
+			return fuse.Errno(syscall.ENOSPC)
+		}
+		return fuse.Errno(syscall.EIO)
+	}
+	return nil
+}
+
+// holeLeft fails with EIO while pages past the end wait: the kernel wrote back
+// all the dirty pages, the bytes before them were never written
+func (f *File) holeLeft(op string) error {
+	if len(f.pending) == 0 {
+		return nil
+	}
+	f.log(op).Error("%v bytes past the end %v, the file has a hole before them", f.pendingBytes, f.cfile.FileSize)
+	f.pending, f.pendingBytes = nil, 0
+	return fuse.Errno(syscall.EIO)
+}
+
+// Flush on close, only the opens for writing push the buffer out
+func (h *fileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	logger.Debug("Flush...")
+	if !h.write {
+		return nil
+	}
+	f := h.f
+	quiesce.Enter()
+	defer quiesce.Exit()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.holeLeft("flush")
+	f.cfile.Flush()
+	f.attr = nil
+	return err
+}
+
+var _ fs.NodeFsyncer = (*File)(nil)
+
+// Fsync returns once the datanodes have the data written on disk
+func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	logger.Debug("Fsync...")
+	quiesce.Enter()
+	defer quiesce.Exit()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.cfile == nil {
+		return nil
+	}
+	f.attr = nil
+	if err := f.holeLeft("fsync"); err != nil {
+		return err
+	}
+	if ret := f.cfile.Sync(); ret != 0 {
+		logger.Error("Fsync %v failed: %v", f.name, ret)
+		return fuse.Errno(syscall.EIO)
+	}
+	return nil
+}
+
+var _ = fs.NodeSetattrer(&File{})
+
+// Setattr keeps the owner, the mode, the size and the times
+func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	f.mu.Lock()
+	parent, name := f.parent, f.name
+	f.mu.Unlock()
+	if err := setOwner(parent.fs, parent.inode, name, req); err != nil {
+		return err
+	}
+	if err := setMode(parent.fs, parent.inode, name, req); err != nil {
+		return err
+	}
+	if req.Valid.Size() {
+		if err := f.truncate(int64(req.Size)); err != nil {
+			return err
+		}
+	}
+	if req.Valid.Mtime() || req.Valid.MtimeNow() {
+		// the buffered writes stamp the mtime once synced, they go before the one set
+		if err := f.flushWrites(); err != nil {
+			return err
+		}
+	}
+	if err := setTimes(parent.fs, parent.inode, name, req); err != nil {
+		return err
+	}
+	if req.Valid.Uid() || req.Valid.Gid() || req.Valid.Mode() || req.Valid.Size() || req.Valid.Atime() || req.Valid.Mtime() || req.Valid.AtimeNow() || req.Valid.MtimeNow() {
+		f.mu.Lock()
+		f.attr = nil
+		if req.Valid.Atime() || req.Valid.AtimeNow() {
+			// an explicit atime wins over the one of the last read
+			f.atime = 0
+		}
+		f.mu.Unlock()
+		return f.Attr(ctx, &resp.Attr)
+	}
+	return nil
+}
+
+// flushWrites sends the buffered writes of f
+func (f *File) flushWrites() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cfile != nil && f.writers > 0 {
+		if ret := f.cfile.Flush(); ret != 0 {
+			return errIO(ret)
+		}
+	}
+	return nil
+}
+
+// truncate f to size, its buffered writes sent first and its open cfile reloaded
+// after: the cut is made by the metanode
+func (f *File) truncate(size int64) error {
+	quiesce.Enter()
+	defer quiesce.Exit()
+	return f.cut(size)
+}
+
+// cut is truncate for a caller holding quiesce
+func (f *File) cut(size int64) error {
+	if readOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// the pages past the old end are gone with the truncate
+	f.pending, f.pendingBytes = nil, 0
+	if f.cfile != nil && f.writers > 0 {
+		if ret := f.cfile.Flush(); ret != 0 {
+			return errIO(ret)
+		}
+	}
+	switch ret := f.parent.fs.cfs.Truncate(f.parent.inode, f.name, size); ret {
+	case 0:
+	case 2:
+		return fuse.ENOENT
+	case 22:
+		return fuse.Errno(syscall.EINVAL)
+	default:
+		return errIO(ret)
+	}
+	f.attr = nil
+	if f.cfile != nil {
+		if ret := f.cfile.Reload(); ret != 0 {
+			logger.Error("Reload %v after truncate ret:%v", f.name, ret)
+			f.stale = true
+		}
+	}
+	return nil
+}
+
+// xattrClone set on an empty file, with the path of a file of the mount as the
+// value, makes it a copy sharing the chunks of that file. bazil fuse does not pass
+// FUSE_COPY_FILE_RANGE or the FICLONE ioctl on, so cp --reflink falls back to a
+// plain copy here: setfattr -n cfs.clone -v src/file dst/file is the mount's reflink.
+// libcfs.CopyFileRange and cfs_copy_file_range of libcfs.so clone without a mount.
+const xattrClone = "cfs.clone"
+
+// Getxattr the storage policy and the generation of the file
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	f.mu.Lock()
+	parent, name := f.parent, f.name
+	f.mu.Unlock()
+	switch req.Name {
+	case xattrPolicy:
+		return getPolicy(ctx, parent.fs.cfs, parent.inode, name, resp)
+	case xattrGeneration:
+		return getGeneration(ctx, parent.fs.cfs, parent.inode, name, resp)
+	}
+	return fuse.ErrNoXattr
+}
+
+// Listxattr ...
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	f.mu.Lock()
+	parent, name := f.parent, f.name
+	f.mu.Unlock()
+	if ret, policy := parent.fs.cfs.WithContext(ctx).GetPolicy(parent.inode, name); ret == 0 && policy != "" {
+		resp.Append(xattrPolicy)
+	}
+	resp.Append(xattrGeneration)
+	return nil
+}
+
+// Removexattr drops the storage policy of the file
+func (f *File) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	if req.Name != xattrPolicy {
+		return fuse.ErrNoXattr
+	}
+	f.mu.Lock()
+	parent, name := f.parent, f.name
+	f.mu.Unlock()
+	return setPolicy(ctx, parent.fs.cfs, parent.inode, name, "")
+}
+
+// Setxattr clones a file into this one, see xattrClone, or sets its storage policy,
+// for the chunks written afterwards
+func (f *File) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	if req.Name == xattrPolicy {
+		f.mu.Lock()
+		parent, name := f.parent, f.name
+		f.mu.Unlock()
+		return setPolicy(ctx, parent.fs.cfs, parent.inode, name, string(req.Xattr))
+	}
+	if req.Name != xattrClone {
+		return fuse.Errno(syscall.ENOTSUP)
+	}
+	if readOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+	f.mu.Lock()
+	parent, name, writers := f.parent, f.name, f.writers
+	f.mu.Unlock()
+	if writers > 0 {
+		return fuse.Errno(syscall.EBUSY)
+	}
+	// cleaned against the root first, no .. leaves the subpath mounted
+	rel := path.Join("/", string(req.Xattr))
+	if rel == "/" {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	src := strings.Trim(path.Join(parent.fs.subpath, rel), "/")
+	if sub := strings.Trim(parent.fs.subpath, "/"); sub != "" && !strings.HasPrefix(src, sub+"/") {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	srcDir, srcName := path.Split(src)
+	c := parent.fs.cfs.WithContext(ctx)
+	ret, srcPInode := c.DirInode(srcDir)
+	if ret == 0 {
+		var inodeInfo *mp.InodeInfo
+		ret, _, inodeInfo = c.CloneFile(srcPInode, srcName, parent.inode, name)
+		if ret == 0 {
+			f.mu.Lock()
+			f.cacheAttr(inodeInfo)
+			f.mu.Unlock()
+			return nil
+		}
+	}
+	if ret > 0 {
+		return fuse.Errno(syscall.Errno(ret))
+	}
+	if ctx.Err() != nil {
+		return errInterrupted
+	}
+	return fuse.Errno(syscall.EIO)
+}
+
+// The keys come from the config file, then the environment (see utils.ConfigEnv),
+// then the flags of flagKeys. Given the required keys by flags no file is needed.
+var configPath = flag.String("config", "", "config file, also taken as the first argument")
+var forceUnmount = flag.Bool("force-unmount-on-start", false, "unmount a stale mount left at the mountpoint by a killed fuseclient")
+var daemon = flag.Bool("daemon", false, "run in the background")
+var foreground = flag.Bool("foreground", false, "stay in the foreground, over -daemon")
+
+// flagKeys the flags setting the key of their name
+var flagKeys = map[string]*string{
+	"uuid":       flag.String("uuid", "", "volume to mount"),
+	"mountpoint": flag.String("mountpoint", "", "dir to mount the volume on"),
+	"volmgr":     flag.String("volmgr", "", "volmgr address, host:port"),
+	"metanode":   flag.String("metanode", "", "metanode addresses, comma separated"),
+	"subpath":    flag.String("subpath", "", "dir of the volume to mount instead of its root"),
+	"buffertype": flag.String("buffertype", "", "write buffer size, see cfs-fuseclient.ini (default 0)"),
+	"log":        flag.String("log", "", "log dir"),
+	"pidfile":    flag.String("pidfile", "", "file to write the pid to, removed on exit"),
+	"daemon_log": flag.String("daemon_log", "", "file for the output of -daemon (default fuse.out in the log dir)"),
+	"loglevel":   flag.String("loglevel", "", "error, info or debug"),
+}
+
+// requiredKeys the keys a mount cannot go without
+var requiredKeys = []string{"uuid", "mountpoint", "volmgr", "metanode"}
+
+// settings the keys of the config file, the environment and the flags
+type settings interface {
+	Set(key, val string) error
+	String(key string) string
+	Strings(key string) []string
+	Int(key string) (int, error)
+}
+
+// parseFlags the flags, the config file is -config or the first argument, the
+// flags may follow it
+func parseFlags() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %v [config file] [flags]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *configPath == "" && flag.NArg() > 0 {
+		*configPath = flag.Arg(0)
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// loadSettings the keys of the config file at path, none when path is empty,
+// overridden by the environment and the flags given
+func loadSettings(path string) (settings, error) {
+	var c settings = utils.MapConfig{}
+	if path != "" {
+		fc, err := config.NewConfig(path)
+		if err != nil {
+			return nil, err
+		}
+		c = fc
 	}
-
-	resp.Flags = fuse.OpenDirectIO
-	return f, nil
+	utils.ConfigEnv(c)
+	flag.Visit(func(f *flag.Flag) {
+		if _, ok := flagKeys[f.Name]; ok {
+			c.Set(f.Name, f.Value.String())
+		}
+	})
+	return c, nil
 }
 
-var _ = fs.HandleReleaser(&File{})
+func main() {
 
-// Release ...
-func (f *File) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
-	logger.Debug("Release...")
+	if len(os.Args) > 1 && os.Args[1] == "umount" {
+		os.Exit(umountCmd(os.Args[2:]))
+	}
+	parseFlags()
+	c, err := loadSettings(*configPath)
+	if err != nil {
+		fmt.Println("NewConfig err:", err)
+		os.Exit(1)
+	}
+	for _, key := range requiredKeys {
+		if c.String(key) == "" {
+			fmt.Printf("no %v, set it in the config file, as CFS_%v or with -%v\n", key, strings.ToUpper(key), key)
+			os.Exit(2)
+		}
+	}
+	if *daemon && !*foreground {
+		pid, err := daemonize(c)
+		if err != nil {
+			fmt.Println("daemon err:", err)
+			os.Exit(1)
+		}
+		fmt.Println(pid)
+		os.Exit(0)
+	}
+	uuid = c.String("uuid")
+	mountPoint = c.String("mountpoint")
+	subpath = c.String("subpath")
+	if n, err := c.Int("squash_uid"); err == nil && n >= 0 {
+		squashUID = int64(n)
+	}
+	if n, err := c.Int("squash_gid"); err == nil && n >= 0 {
+		squashGID = int64(n)
+	}
+	if uidMap, err = utils.ParseIDMap(c.String("uid_map")); err != nil {
+		fmt.Println("wrong uid_map:", err)
+		os.Exit(1)
+	}
+	if gidMap, err = utils.ParseIDMap(c.String("gid_map")); err != nil {
+		fmt.Println("wrong gid_map:", err)
+		os.Exit(1)
+	}
+	cfs.VolMgrAddr = c.String("volmgr")
+	if c.String("buffertype") != "" {
+		if _, err = c.Int("buffertype"); err != nil {
+			fmt.Println("wrong buffertype")
+			os.Exit(1)
+		}
+	}
+	cfs.MetaNodePeers = c.Strings("metanode")
+	cfs.MigrateSource = c.String("migrate_source")
+	cfs.MetaCompression = c.String("meta_compression")
+	if !utils.ValidCompressor(cfs.MetaCompression) {
+		fmt.Println("wrong meta_compression, use gzip or snappy")
+		os.Exit(1)
+	}
+	faultSeed, _ := c.Int("fault_seed")
+	if err := utils.SetFaults(c.String("faults"), int64(faultSeed)); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	loadTunables(c)
+	if n, err := c.Int("writeback_cache"); err == nil {
+		writebackCache = n != 0
+	}
+	switch v := c.String("allow"); v {
+	case "", "other", "root":
+		allowAccess = v
+	default:
+		fmt.Println("wrong allow, use other or root")
+		os.Exit(1)
+	}
+	if n, err := c.Int("default_permissions"); err == nil {
+		defaultPermissions = n != 0
+	}
+	if n, err := c.Int("remount"); err == nil {
+		remount = n != 0
+	}
+	if n, err := c.Int("remount_max_backoff_secs"); err == nil && n > 0 {
+		remountMaxBackoff = time.Duration(n) * time.Second
+	}
+	if n, err := c.Int("max_readahead"); err == nil && n > 0 {
+		maxReadahead = uint32(n) * 1024
+	}
+	if n, err := c.Int("max_background"); err == nil && n > 0 && n <= math.MaxUint16 {
+		maxBackground = uint16(n)
+	}
+	if n, err := c.Int("congestion_threshold"); err == nil && n > 0 && n <= math.MaxUint16 {
+		congestionThreshold = uint16(n)
+	}
+	switch v := c.String("direct_io"); v {
+	case "", "all":
+	case "none":
+		directIO = nil
+	default:
+		directIO = nil
+		for _, pattern := range strings.Split(v, ",") {
+			directIO = append(directIO, strings.TrimSpace(pattern))
+		}
+	}
+	if n, err := c.Int("shared_write"); err == nil && n != 0 {
+		sharedWrite = true
+	}
+	if n, err := c.Int("leases"); (err == nil && n != 0) || sharedWrite {
+		cfs.LeaseClientID = cfs.ClientID
+	}
+	if n, err := c.Int("dir_notify"); err == nil && n != 0 {
+		dirNotify = true
+	}
+	if n, err := c.Int("readdir_plus"); err == nil && n == 0 {
+		readdirPlus = false
+	}
+	switch v := c.String("atime"); v {
+	case "":
+	case "strict", "relatime", "noatime":
+		atimePolicy = v
+	default:
+		fmt.Println("wrong atime, use strict, relatime or noatime")
+		os.Exit(1)
+	}
+	if n, err := c.Int("atime_flush_secs"); err == nil && n > 0 {
+		atimeFlush = time.Duration(n) * time.Second
+	}
+	if n, err := c.Int("max_memory_mb"); err == nil && n > 0 {
+		cfs.MaxMemory = int64(n) << 20
+		cfs.RegisterReclaimer(reclaimDirents)
+	}
+	if n, err := c.Int("stripe_width"); err == nil && n > 0 {
+		cfs.StripeWidth = n
+	}
+	if n, err := c.Int("stripe_unit"); err == nil && n > 0 {
+		cfs.StripeUnit = int64(n) * 1024 * 1024
+	}
+	if n, err := c.Int("inline_threshold"); err == nil && n >= 0 {
+		cfs.InlineThreshold = int32(n)
+	}
+	if n, err := c.Int("background_io"); err == nil && n != 0 {
+		cfs.BackgroundIO = true
+	}
+	if n, err := c.Int("read_only"); err == nil && n != 0 {
+		readOnly = true
+	}
+	if n, err := c.Int("replica_writer"); err == nil && n != 0 {
+		replicaWriter = true
+		cfs.ReplicaWriter = true
+	}
+	if n, err := c.Int("short_circuit"); err == nil && n != 0 {
+		cfs.ShortCircuit = true
+	}
+	if n, err := c.Int("qos_read_mbps"); err == nil && n >= 0 {
+		cfs.VolQoS.ReadMBps = n
+	}
+	if n, err := c.Int("qos_write_mbps"); err == nil && n >= 0 {
+		cfs.VolQoS.WriteMBps = n
+	}
+	if n, err := c.Int("qos_read_iops"); err == nil && n >= 0 {
+		cfs.VolQoS.ReadIOPS = n
+	}
+	if n, err := c.Int("qos_write_iops"); err == nil && n >= 0 {
+		cfs.VolQoS.WriteIOPS = n
+	}
+	if mode, ok := cfs.ParseSyncMode(c.String("sync_mode")); ok {
+		cfs.SyncMode = mode
+	} else {
+		fmt.Println("wrong sync_mode, use honor, always or never")
+		os.Exit(1)
+	}
+	if _, ok := cfs.ParseReadPreference(c.String("read_preference")); !ok {
+		fmt.Println("wrong read_preference, use local, nearest, primary or random")
+		os.Exit(1)
+	}
+	if dir := c.String("write_journal"); dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			fmt.Println("write_journal:", err)
+			os.Exit(1)
+		}
+		cfs.JournalDir = dir
+	}
 
-	f.mu.Lock()
-	defer f.mu.Unlock()
+	logger.SetConsole(true)
+	logOutput := c.String("logoutput")
+	if c.String("log") != "" {
+		logger.SetRollingFile(c.String("log"), "fuse.log", 10, 100, logger.MB) //each 100M rolling
+	} else if logOutput == "" {
+		// no log dir, as when started by flags alone
+		logOutput = "stderr"
+	}
+	setLogLevel(c.String("loglevel"))
+	if err := logger.Configure(c.String("logformat"), logOutput, c.String("logmodules"), "cfs-fuseclient"); err != nil {
+		fmt.Println("log config err:", err)
+		os.Exit(1)
+	}
+	if faults := c.String("faults"); faults != "" {
+		logger.Warn("fault injection on: %v", faults)
+	}
 
-	f.handles--
+	// SIGHUP re-reads loglevel, logmodules, buffertype and the tunables without remounting
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadConfig(*configPath)
+		}
+	}()
 
-	if int(req.Flags)&os.O_WRONLY != 0 || int(req.Flags)&os.O_RDWR != 0 {
-		//f.cfile.Flush()
-		f.cfile.CloseConns()
-		f.writers--
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Error("panic !!! :%v", err)
+			logger.Error("stacks:%v", string(debug.Stack()))
+		}
+	}()
+
+	// with federation the mountpoint holds one directory per volume instead of the uuid volume
+	volIDs := []string{uuid}
+	var fed *fedFS
+	if entries := c.String("federation"); entries != "" {
+		if subpath != "" {
+			fmt.Println("subpath is not supported with federation")
+			os.Exit(1)
+		}
+		fed, err = newFedFS(strings.Split(entries, ","))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		volIDs = fed.volIDs()
 	}
 
-	if f.handles == 0 {
-		f.cfile = nil
+	// the replicas on this host are read first
+	if ret := cfs.LoadTopology(); ret == 0 {
+		fmt.Printf("local datanodes: %v\n", cfs.LocalDataNodes())
 	}
+	go cfs.WatchTopology(5 * time.Minute)
+	go cfs.ProbeLatency(30 * time.Second)
+
+	for _, volID := range volIDs {
+		if ret, vi := cfs.GetVolInfo(volID); ret == 0 && vi.VolInfo != nil && vi.VolInfo.Status == 1 {
+			fmt.Printf("volume %v is pending purge, restorevol it before mount\n", volID)
+			os.Exit(1)
+		} else if ret == 0 && vi.VolInfo != nil && vi.VolInfo.Replica && !replicaWriter {
+			fmt.Printf("volume %v is a replica, mounted read-only until promotevol\n", volID)
+			readOnly = true
+		}
 
-	logger.Debug("Release end...")
+		// checked against the access mode of the volume, volmgr answers EAGAIN
+		// for a while after it restarted
+		ret, holder := cfs.RegisterMount(volID, mountPoint, readOnly)
+		for ret == 11 {
+			time.Sleep(5 * time.Second)
+			ret, holder = cfs.RegisterMount(volID, mountPoint, readOnly)
+		}
+		switch ret {
+		case 0:
+		case 30:
+			fmt.Printf("volume %v is ROX, mount it read-only\n", volID)
+			os.Exit(1)
+		case 16:
+			fmt.Printf("volume %v is RWO and mounted read-write by %v\n", volID, holder)
+			os.Exit(1)
+		default:
+			fmt.Printf("register mount of volume %v failed:%v\n", volID, ret)
+			os.Exit(1)
+		}
 
-	return nil
-}
+		cfs.MetaNodeAddr, _ = cfs.GetLeader(volID)
+		fmt.Printf("Leader of %v:%v\n", volID, cfs.MetaNodeAddr)
+		go cfs.WatchLeader(volID)
+
+		// the metanodes enforce the access mode on the session and on the writes
+		ret = cfs.StartSession(volID, mountPoint, readOnly, func() int64 {
+			return atomic.LoadInt64(&openHandles)
+		}, func() {
+			// the metanode took the leases away with the session
+			leasedFiles.revoke(volID, 0)
+		})
+		switch ret {
+		case 0:
+		case 30:
+			fmt.Printf("volume %v is ROX, mount it read-only\n", volID)
+			os.Exit(1)
+		case 16:
+			fmt.Printf("volume %v is RWO and written by another host\n", volID)
+			os.Exit(1)
+		default:
+			fmt.Printf("open session of volume %v failed:%v\n", volID, ret)
+			os.Exit(1)
+		}
 
-var _ = fs.HandleReader(&File{})
+		// the writes a client that died here had acked
+		if !readOnly {
+			if n := cfs.OpenFileSystem(volID).ReplayJournal(); n > 0 {
+				fmt.Printf("%v write journals of volume %v not replayed, kept in %v\n", n, volID, cfs.JournalDir)
+			}
+		}
 
-// Read ...
-func (f *File) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+		if cfs.LeaseClientID != "" {
+			go func(volID string) {
+				cfs.WatchLeases(volID, func(inode uint64) {
+					leasedFiles.revoke(volID, inode)
+				})
+			}(volID)
+		}
 
-	f.mu.Lock()
-	defer f.mu.Unlock()
-	if _, ok := f.cfile.ReaderMap[req.Handle]; !ok {
-		rdinfo := cfs.ReaderInfo{}
-		rdinfo.LastOffset = int64(0)
-		f.cfile.ReaderMap[req.Handle] = &rdinfo
+		// files read through the page cache follow the writes of other clients,
+		// polled dirs their entries
+		if pageCacheUsed() || dirNotify {
+			go func(volID string) {
+				cfs.WatchChanges(volID, func(ev *mp.ChangeEvent) {
+					cachedFiles.changed(volID, ev)
+					polledDirs.changed(volID, ev)
+				})
+			}(volID)
+		}
 	}
-	if req.Offset == f.cfile.FileSize {
 
-		logger.Debug("Request Read file offset equal filesize")
-		return nil
+	if *forceUnmount {
+		// clean up a stale mount left by a killed fuseclient
+		if err := unmount(mountPoint); err != nil {
+			logger.Error("force unmount %v on start err:%v", mountPoint, err)
+		}
 	}
 
-	length := f.cfile.Read(req.Handle, &resp.Data, req.Offset, int64(req.Size))
-	if length != int64(req.Size) {
-		logger.Debug("== Read reqsize:%v, but return datasize:%v ==\n", req.Size, length)
+	// SIGUSR1 freezes the mount before a checkpoint, SIGUSR2 thaws it after restore,
+	// the same is available as freeze/thaw/status commands on control_socket
+	usr := make(chan os.Signal, 1)
+	signal.Notify(usr, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for s := range usr {
+			if s == syscall.SIGUSR1 {
+				freeze()
+			} else {
+				thaw()
+			}
+		}
+	}()
+	if sock := c.String("control_socket"); sock != "" {
+		err := cfs.ServeControl(sock, map[string]func() string{
+			"freeze": freeze,
+			"thaw":   thaw,
+			"status": func() string {
+				if quiesce.Frozen() {
+					return "frozen"
+				}
+				return "thawed"
+			},
+			"health": health,
+			"memory": memory,
+		})
+		if err != nil {
+			logger.Error("listen on control socket %v err:%v", sock, err)
+		}
 	}
-	if length < 0 {
-		logger.Error("Request Read file I/O Error(return data from cfs less than zero)")
-		return fuse.Errno(syscall.EIO)
+	if addr := c.String("debug_addr"); addr != "" {
+		if err := utils.ServeDebug(addr, debugStats); err != nil {
+			logger.Error("listen on debug addr %v err:%v", addr, err)
+		}
+	}
+	if addr := c.String("health_addr"); addr != "" {
+		healthCanary = c.String("health_canary")
+		if err := serveHealthz(addr); err != nil {
+			logger.Error("listen on health addr %v err:%v", addr, err)
+		}
+	}
+	if sock := c.String("health_socket"); sock != "" {
+		// only health, for a node agent not trusted with freeze and thaw
+		if err := cfs.ServeControl(sock, map[string]func() string{"health": health}); err != nil {
+			logger.Error("listen on health socket %v err:%v", sock, err)
+		}
 	}
-	return nil
-}
-
-var _ = fs.HandleWriter(&File{})
-
-// Write ...
-func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
 
-	f.mu.Lock()
-	defer f.mu.Unlock()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		s := <-sig
+		logger.Error("got signal %v, flush and unmount %v", s, mountPoint)
+		writingFiles.flushAll(true)
+		cfs.FlushAccessTimes()
+		for _, volID := range volIDs {
+			cfs.CloseSession(volID, cfs.ClientID, false)
+			cfs.UnregisterMount(volID)
+		}
+		if err := unmount(mountPoint); err != nil {
+			logger.Error("unmount %v err:%v", mountPoint, err)
+			removePidfile()
+			os.Exit(1)
+		}
+	}()
 
-	w := f.cfile.Write(req.Data, int32(len(req.Data)))
-	if w != int32(len(req.Data)) {
-		if w == -1 {
-			return fuse.Errno(syscall.ENOSPC)
+	cfs.StartReaderGC()
+	if atimePolicy == "relatime" && !readOnly {
+		cfs.StartAccessTimeFlusher(atimeFlush)
+	}
+	hbticker := time.NewTicker(time.Second * 10)
+	go func() {
+		var last cfs.ReaderStats
+		var lastMem cfs.MemoryStats
+		for range hbticker.C {
+			var state, used int64
+			for _, volID := range volIDs {
+				cfs.ClientHeartbeat(volID)
+				s, u := cfs.CheckCapacity(volID)
+				if int64(s) > state {
+					state = int64(s)
+				}
+				if u > used {
+					used = u
+				}
+			}
+			atomic.StoreInt64(&capacityState, state)
+			atomic.StoreInt64(&capacityUsed, used)
+			if r := cfs.Readers(); r != last {
+				logger.Info("readers live:%v released:%v collected:%v", r.Live, r.Released, r.Collected)
+				last = r
+			}
+			if m := cfs.Memory(); m != lastMem {
+				logger.Info("memory %v", memory())
+				lastMem = m
+			}
 		}
-		return fuse.Errno(syscall.EIO)
+	}()
 
+	var filesys fs.FS = &FS{cfs: cfs.OpenFileSystem(uuid), subpath: subpath}
+	name := uuid
+	if fed != nil {
+		filesys, name = fed, "federation"
 	}
-	resp.Size = int(w)
-	return nil
+	if err := writePidfile(c.String("pidfile")); err != nil {
+		fmt.Println("pidfile err:", err)
+		notifyReady(err)
+		os.Exit(1)
+	}
+	if err := superviseMount(filesys, name); err != nil {
+		notifyReady(err)
+		removePidfile()
+		log.Fatal(err)
+	}
+	removePidfile()
 }
 
-var _ = fs.HandleFlusher(&File{})
-
-// Flush ...
-func (f *File) Flush(ctx context.Context, req *fuse.FlushRequest) error {
-	logger.Debug("Flush...")
-	f.mu.Lock()
-	defer f.mu.Unlock()
-
-	f.cfile.Flush()
-	return nil
+// remount: a mount whose serving failed is cleaned up and mounted again after
+// remountBackoff, doubled up to remountMaxBackoff while it keeps failing
+var remount = true
+var remountBackoff = time.Second
+var remountMaxBackoff = time.Minute
+
+// mountHealth for the health checks of a node agent
+var mountHealth struct {
+	sync.Mutex
+	up       bool
+	err      error
+	remounts int
 }
 
-var _ fs.NodeFsyncer = (*File)(nil)
-
-// Fsync ...
-func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
-	logger.Debug("Fsync...")
-	f.mu.Lock()
-	defer f.mu.Unlock()
-
-	f.cfile.Flush()
-	return nil
+func setMountHealth(up bool, err error) {
+	mountHealth.Lock()
+	mountHealth.up, mountHealth.err = up, err
+	mountHealth.Unlock()
 }
 
-var _ = fs.NodeSetattrer(&File{})
-
-// Setattr ...
-func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
-	return nil
+// capacityState and capacityUsed of the fullest volume mounted, for /debug/stats:
+// 1 over its soft limit, 2 over its hard limit, and its percent of space used
+var capacityState, capacityUsed int64
+
+// debugStats the counters of the mount for /debug/stats
+func debugStats() map[string]int64 {
+	m := cfs.Memory()
+	r := cfs.Readers()
+	return map[string]int64{
+		"fuse_reads":        atomic.LoadInt64(&readsInFlight),
+		"fuse_changes":      int64(quiesce.Inflight()),
+		"open_handles":      atomic.LoadInt64(&openHandles),
+		"datanode_conns":    int64(cfs.DataConnPool.Len()),
+		"local_reads":       cfs.ShortCircuitReads(),
+		"mem_read":          m.Read,
+		"mem_write":         m.Write,
+		"mem_dirents":       m.Dirents,
+		"capacity_state":    atomic.LoadInt64(&capacityState),
+		"capacity_used":     atomic.LoadInt64(&capacityUsed),
+		"readers_live":      r.Live,
+		"readers_released":  r.Released,
+		"readers_collected": r.Collected,
+	}
 }
 
-func main() {
+// memory the bytes accounted against max_memory_mb
+func memory() string {
+	m := cfs.Memory()
+	return fmt.Sprintf("max:%d read:%d write:%d dirents:%d reclaims:%d reclaimed:%d", m.Max, m.Read, m.Write, m.Dirents, m.Reclaims, m.Reclaimed)
+}
 
-	c, err := config.NewConfig(os.Args[1])
-	if err != nil {
-		fmt.Println("NewConfig err")
-		os.Exit(1)
+// health "ok" when the mountpoint answers a stat, else why not
+func health() string {
+	mountHealth.Lock()
+	up, err, remounts := mountHealth.up, mountHealth.err, mountHealth.remounts
+	mountHealth.Unlock()
+	if !up {
+		return fmt.Sprintf("down err:%v remounts:%d", err, remounts)
 	}
-	uuid = c.String("uuid")
-	mountPoint = c.String("mountpoint")
-	cfs.VolMgrAddr = c.String("volmgr")
-	bufferType, err := c.Int("buffertype")
-	if err != nil {
-		fmt.Println("wrong buffertype")
-		os.Exit(1)
+	done := make(chan error, 1)
+	go func() {
+		_, err := os.Stat(mountPoint)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Sprintf("error %v remounts:%d", err, remounts)
+		}
+		return fmt.Sprintf("ok remounts:%d", remounts)
+	case <-time.After(5 * time.Second):
+		return fmt.Sprintf("hung remounts:%d", remounts)
 	}
-	cfs.MetaNodePeers = c.Strings("metanode")
+}
+
+// superviseMount serves filesys at mountPoint until it is unmounted. A failure
+// of the first mount is returned, later ones are remounted with remount set.
+func superviseMount(filesys fs.FS, name string) error {
+	backoff := remountBackoff
+	for attempt := 0; ; attempt++ {
+		err := mountFS(filesys, name, mountPoint)
+		mountHealth.Lock()
+		served := mountHealth.up
+		mountHealth.up, mountHealth.err = false, err
+		mountHealth.Unlock()
+		if err == nil {
+			// unmounted
+			return nil
+		}
+		if !remount || (attempt == 0 && !served) {
+			return err
+		}
+		if served {
+			// a new failure
+			backoff = remountBackoff
+		}
+		logger.Error("serving %v failed: %v, remounting in %v", mountPoint, err, backoff)
+		writingFiles.flushAll(true)
+		if err := unmount(mountPoint); err != nil {
+			logger.Error("unmount stale %v err:%v", mountPoint, err)
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > remountMaxBackoff {
+			backoff = remountMaxBackoff
+		}
+		mountHealth.Lock()
+		mountHealth.remounts++
+		mountHealth.Unlock()
+	}
+}
 
+// bufferSize the write buffer size of a buffertype
+func bufferSize(bufferType int) int {
 	switch bufferType {
-	case 0:
-		cfs.BufferSize = 512 * 1024
 	case 1:
-		cfs.BufferSize = 256 * 1024
+		return 256 * 1024
 	case 2:
-		cfs.BufferSize = 128 * 1024
+		return 128 * 1024
 	default:
-		cfs.BufferSize = 512 * 1024
+		return 512 * 1024
 	}
+}
 
-	logger.SetConsole(true)
-	logger.SetRollingFile(c.String("log"), "fuse.log", 10, 100, logger.MB) //each 100M rolling
-	switch level := c.String("loglevel"); level {
+func setLogLevel(level string) {
+	switch level {
 	case "error":
 		logger.SetLevel(logger.ERROR)
 	case "debug":
@@ -650,49 +3285,172 @@ func main() {
 	default:
 		logger.SetLevel(logger.ERROR)
 	}
+}
 
-	defer func() {
-		if err := recover(); err != nil {
-			logger.Error("panic !!! :%v", err)
-			logger.Error("stacks:%v", string(debug.Stack()))
-		}
-	}()
-
-	cfs.MetaNodeAddr, _ = cfs.GetLeader(uuid)
-	fmt.Printf("Leader:%v\n", cfs.MetaNodeAddr)
-	ticker := time.NewTicker(time.Second * 60)
-	go func() {
-		for range ticker.C {
-			cfs.MetaNodeAddr, _ = cfs.GetLeader(uuid)
-			fmt.Printf("Leader:%v\n", cfs.MetaNodeAddr)
-		}
-	}()
+// loadTunables reads the keys that take effect on a running mount, at start and
+// again on SIGHUP
+func loadTunables(c settings) {
+	if n, err := c.Int("buffertype"); err == nil {
+		cfs.BufferSize.Set(bufferSize(n))
+	}
+	if n, err := c.Int("read_parallelism"); err == nil && n > 0 {
+		cfs.ReadParallelism.Set(n)
+	}
+	if n, err := c.Int("negative_ttl_ms"); err == nil && n >= 0 {
+		negativeTTL.Set(time.Duration(n) * time.Millisecond)
+	}
+	if n, err := c.Int("list_page_size"); err == nil && n > 0 {
+		cfs.ListPageSize.Set(n)
+	}
+	if n, err := c.Int("attr_stale_max_secs"); err == nil && n >= 0 {
+		attrStaleMax.Set(time.Duration(n) * time.Second)
+	}
+	if n, err := c.Int("reader_idle_secs"); err == nil && n >= 0 {
+		cfs.ReaderIdle.Set(time.Duration(n) * time.Second)
+	}
+	if n, err := c.Int("meta_timeout_ms"); err == nil && n > 0 {
+		cfs.MetaOpTimeout.Set(time.Duration(n) * time.Millisecond)
+	}
+	if n, err := c.Int("data_timeout_ms"); err == nil && n > 0 {
+		cfs.DataOpTimeout.Set(time.Duration(n) * time.Millisecond)
+	}
+	if n, err := c.Int("meta_retry_times"); err == nil && n > 0 {
+		cfs.MetaRetryTimes.Set(n)
+	}
+	if n, err := c.Int("retry_budget_secs"); err == nil && n >= 0 {
+		cfs.MetaRetryBudget.Set(time.Duration(n) * time.Second)
+	}
+	if n, err := c.Int("soft_grace_secs"); err == nil && n >= 0 {
+		cfs.SoftGrace.Set(time.Duration(n) * time.Second)
+	}
+	if pref, ok := cfs.ParseReadPreference(c.String("read_preference")); ok {
+		cfs.ReadPreference.Set(pref)
+	}
+	cfs.SetClientLabels(c.String("labels"))
+}
 
-	err = mount(uuid, mountPoint)
+// reloadConfig applies loglevel, logmodules and the tunables of loadTunables from the config file
+// and the environment to the running mount. The mount options such as max_readahead need a
+// remount, a new buffertype applies to the files opened from then on.
+func reloadConfig(path string) {
+	c, err := loadSettings(path)
 	if err != nil {
-		log.Fatal(err)
+		logger.Error("reload config %v err:%v", path, err)
+		return
+	}
+	loadTunables(c)
+	level := c.String("loglevel")
+	setLogLevel(level)
+	if levels, err := logger.ParseModuleLevels(c.String("logmodules")); err != nil {
+		logger.Error("reload config: %v, keep the levels of the modules", err)
+	} else {
+		logger.SetModuleLevels(levels)
 	}
+	logger.Info("config %v reloaded, loglevel:%v", path, level)
 }
 
-func mount(uuid, mountPoint string) error {
-	cfs := cfs.OpenFileSystem(uuid)
-	c, err := fuse.Mount(
-		mountPoint,
-		fuse.MaxReadahead(128*1024),
+// unmount tries a normal unmount first and falls back to a lazy one when the mountpoint is busy
+func unmount(mountPoint string) error {
+	err := fuse.Unmount(mountPoint)
+	if err == nil {
+		return nil
+	}
+	out, lerr := lazyUnmount(mountPoint)
+	if lerr != nil {
+		return fmt.Errorf("%v; lazy unmount: %v %s", err, lerr, out)
+	}
+	return nil
+}
+
+// mount tuning from the config file
+var writebackCache = true
+var maxReadahead uint32 = 128 * 1024
+var maxBackground uint16
+var congestionThreshold uint16
+
+// directIO file name patterns opened with direct IO, the others go through the
+// kernel page cache. Default all files, as before the option existed.
+var directIO = []string{"*"}
+
+func useDirectIO(name string) bool {
+	for _, pattern := range directIO {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// readOnly mounted with read_only, or the volume is a geo-replication target only the
+// replication agent writes
+var readOnly bool
+
+// replicaWriter the replication agent mounts the replica read-write
+var replicaWriter bool
+
+// allowAccess other: any user may use the mount, root: the mounting user and root,
+// "": only the mounting user. Other than root needs user_allow_other in /etc/fuse.conf
+var allowAccess string
+
+// defaultPermissions the kernel checks the mode and owner of the entries before an op
+var defaultPermissions bool
+
+// pageCacheUsed some files may go through the kernel page cache
+func pageCacheUsed() bool {
+	return len(directIO) != 1 || directIO[0] != "*"
+}
+
+func mountOptions(name string) []fuse.MountOption {
+	opts := []fuse.MountOption{
+		fuse.MaxReadahead(maxReadahead),
 		fuse.AsyncRead(),
-		fuse.WritebackCache(),
-		fuse.FSName("ContainerFS-"+uuid),
+		fuse.FSName("ContainerFS-" + name),
 		fuse.LocalVolume(),
-		fuse.VolumeName("ContainerFS-"+uuid))
+		fuse.VolumeName("ContainerFS-" + name),
+	}
+	if writebackCache {
+		opts = append(opts, fuse.WritebackCache())
+	}
+	if maxBackground > 0 {
+		opts = append(opts, fuse.MaxBackground(maxBackground))
+	}
+	if congestionThreshold > 0 {
+		opts = append(opts, fuse.CongestionThreshold(congestionThreshold))
+	}
+	if readOnly {
+		opts = append(opts, fuse.ReadOnly())
+	}
+	switch allowAccess {
+	case "other":
+		opts = append(opts, fuse.AllowOther())
+	case "root":
+		opts = append(opts, fuse.AllowRoot())
+	}
+	if defaultPermissions {
+		opts = append(opts, fuse.DefaultPermissions())
+	}
+	return opts
+}
+
+// fuseServer serves the mount, it is used to invalidate the kernel caches
+var fuseServer *fs.Server
+
+func mountFS(filesys fs.FS, name, mountPoint string) error {
+	c, err := fuse.Mount(mountPoint, mountOptions(name)...)
 	if err != nil {
 		return err
 	}
 	defer c.Close()
 
-	filesys := &FS{
-		cfs: cfs,
-	}
-	if err := fs.Serve(c, filesys); err != nil {
+	fuseServer = fs.New(c, nil)
+	go func() {
+		<-c.Ready
+		if c.MountError == nil {
+			setMountHealth(true, nil)
+		}
+		notifyReady(c.MountError)
+	}()
+	if err := fuseServer.Serve(filesys); err != nil {
 		return err
 	}
 	// check if the mount process has an error to report
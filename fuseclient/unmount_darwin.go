@@ -0,0 +1,10 @@
+package main
+
+import (
+	"os/exec"
+)
+
+// lazyUnmount macOS has no lazy unmount, the mount is forced off
+func lazyUnmount(mountPoint string) ([]byte, error) {
+	return exec.Command("umount", "-f", mountPoint).CombinedOutput()
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	"os/exec"
+)
+
+// lazyUnmount detaches the mount now, it goes away when no longer busy
+func lazyUnmount(mountPoint string) ([]byte, error) {
+	return exec.Command("fusermount", "-u", "-z", mountPoint).CombinedOutput()
+}
@@ -0,0 +1,527 @@
+// Package agent replicates a volume into a volume of another cluster. The source
+// is read through libcfs and followed through the change stream of its metanode
+// leader, the replica is written through its FUSE mount. A file written since the
+// last pass only has its tail copied when it kept the chunks it had then: a
+// truncate writes the part it keeps to new chunks, so the file is copied whole.
+package agent
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	cfs "github.com/ipdcode/containerfs/fs"
+	"github.com/ipdcode/containerfs/libcfs"
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// tmpPrefix files being copied in, renamed over the replica file when complete
+	tmpPrefix = ".georep."
+	// conflictSuffix replica files changed behind the agent are kept aside with it
+	conflictSuffix = ".conflict-"
+)
+
+// fileState what the agent left on the replica, to tell it from a change made there
+type fileState struct {
+	Inode    uint64 // source inode, a recreated file is copied again
+	SrcSize  int64
+	SrcMTime int64
+	Size     int64    // of the replica file
+	MTime    int64    // of the replica file, unix nano
+	Chunks   []uint64 // of the source file, empty for an inline one
+}
+
+type fileKey struct {
+	pinode uint64
+	name   string
+}
+
+// Agent replicates VolID into the mount Target
+type Agent struct {
+	Source *libcfs.FS
+	CFS    *cfs.CFS
+	VolID  string
+	Target string
+	RPO    time.Duration // changes reach the replica within it
+	State  string        // file keeping what was replicated, empty keeps it in memory
+
+	mu     sync.Mutex
+	events []*mp.ChangeEvent
+	resync bool
+	oldest time.Time // of the events not applied yet
+
+	dirs  map[uint64]string    // source dir inode -> path
+	files map[string]fileState // path -> replica file
+
+	Copied    uint64
+	Appended  uint64
+	Removed   uint64
+	Conflicts uint64
+	Bytes     uint64
+}
+
+// New ...
+func New(source *libcfs.FS, volID string, target string, rpo time.Duration, state string) *Agent {
+	return &Agent{
+		Source: source,
+		CFS:    cfs.OpenFileSystem(volID),
+		VolID:  volID,
+		Target: target,
+		RPO:    rpo,
+		State:  state,
+		dirs:   map[uint64]string{0: ""},
+		files:  make(map[string]fileState),
+	}
+}
+
+// Run does the initial full sync, then applies the changes every RPO/2. It never returns.
+func (a *Agent) Run() {
+	a.load()
+	a.mu.Lock()
+	a.resync = true
+	a.mu.Unlock()
+	// watched before the full sync, so no change made during it is missed
+	cfs.Watch(a.VolID, cfs.WatchOptions{}, a.changed)
+
+	interval := a.RPO / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for {
+		start := time.Now()
+		a.pass()
+		logger.Debug("%v", a.Stats())
+		if d := interval - time.Since(start); d > 0 {
+			time.Sleep(d)
+		}
+	}
+}
+
+// changed queues a change, nil means changes were missed
+func (a *Agent) changed(ev *mp.ChangeEvent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if ev == nil {
+		a.resync = true
+		return
+	}
+	if len(a.events) == 0 {
+		a.oldest = time.Now()
+	}
+	a.events = append(a.events, ev)
+}
+
+func (a *Agent) pass() {
+	a.mu.Lock()
+	events, resync, oldest := a.events, a.resync, a.oldest
+	a.events, a.resync = nil, false
+	a.mu.Unlock()
+
+	if resync {
+		// the walk covers the queued changes
+		logger.Info("georep %v full sync to %v", a.VolID, a.Target)
+		if err := a.syncDir(0, "", true); err != nil {
+			logger.Error("georep %v full sync err:%v", a.VolID, err)
+			a.mu.Lock()
+			a.resync = true
+			a.mu.Unlock()
+			return
+		}
+	} else if len(events) > 0 {
+		a.apply(events)
+	}
+	a.save()
+
+	if len(events) > 0 && !resync {
+		if lag := time.Since(oldest); lag > a.RPO {
+			logger.Error("georep %v lag %v exceeds the rpo %v", a.VolID, lag, a.RPO)
+		}
+	}
+}
+
+// apply replays the changes in order, renames and removes at once, the files written
+// are copied last, once each
+func (a *Agent) apply(events []*mp.ChangeEvent) {
+	dirty := make(map[fileKey]bool)
+	for _, ev := range events {
+		rel, ok := a.dirs[ev.PInode]
+		if !ok {
+			a.needResync("change in unknown dir %v", ev.PInode)
+			return
+		}
+		rel = path.Join(rel, ev.Name)
+		switch ev.Op {
+		case cfs.ChangeCreate:
+			if ev.Dir {
+				a.dirs[ev.Inode] = rel
+				if err := a.syncDir(ev.Inode, rel, true); err != nil {
+					a.needResync("sync dir %v err:%v", rel, err)
+				}
+			} else {
+				dirty[fileKey{ev.PInode, ev.Name}] = true
+			}
+		case cfs.ChangeRemove:
+			a.remove(rel)
+		case cfs.ChangeRename:
+			newRel, ok := a.dirs[ev.NewPInode]
+			if !ok {
+				a.needResync("rename to unknown dir %v", ev.NewPInode)
+				return
+			}
+			newRel = path.Join(newRel, ev.NewName)
+			if !a.rename(rel, newRel) {
+				if ev.Dir {
+					a.dirs[ev.Inode] = newRel
+					if err := a.syncDir(ev.Inode, newRel, true); err != nil {
+						a.needResync("sync dir %v err:%v", newRel, err)
+					}
+				}
+			}
+			if !ev.Dir {
+				dirty[fileKey{ev.NewPInode, ev.NewName}] = true
+			}
+		case cfs.ChangeWrite, cfs.ChangeCloseWrite:
+			dirty[fileKey{ev.PInode, ev.Name}] = true
+		}
+	}
+	for k := range dirty {
+		if rel, ok := a.dirs[k.pinode]; ok {
+			if err := a.syncFile(k.pinode, rel, k.name); err != nil {
+				a.needResync("sync file %v err:%v", path.Join(rel, k.name), err)
+			}
+		}
+	}
+}
+
+func (a *Agent) needResync(format string, args ...interface{}) {
+	logger.Error("georep %v: "+format+", full sync again", append([]interface{}{a.VolID}, args...)...)
+	a.mu.Lock()
+	a.resync = true
+	a.mu.Unlock()
+}
+
+// syncDir makes the replica dir rel match the source dir inode; deep compares
+// every file below it, else only the entries added or gone are handled
+func (a *Agent) syncDir(inode uint64, rel string, deep bool) error {
+	ret, ents := a.CFS.ListDirect(inode)
+	if ret != 0 {
+		return fmt.Errorf("list %v ret %v", rel, ret)
+	}
+	tp := path.Join(a.Target, rel)
+	if fi, err := os.Lstat(tp); err == nil && !fi.IsDir() {
+		a.conflict(rel)
+	}
+	if err := os.MkdirAll(tp, 0755); err != nil {
+		return err
+	}
+	fis, err := ioutil.ReadDir(tp)
+	if err != nil {
+		return err
+	}
+	onReplica := make(map[string]os.FileInfo, len(fis))
+	for _, fi := range fis {
+		onReplica[fi.Name()] = fi
+	}
+
+	var files []string
+	for _, e := range ents {
+		if inode == 0 && e.Name == ".trash" {
+			// the trash of the source is no part of the replica
+			continue
+		}
+		erel := path.Join(rel, e.Name)
+		fi, exists := onReplica[e.Name]
+		delete(onReplica, e.Name)
+		if !e.InodeType {
+			a.dirs[e.Inode] = erel
+			if deep || !exists || !fi.IsDir() {
+				if err := a.syncDir(e.Inode, erel, true); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if deep || !exists {
+			files = append(files, e.Name)
+		}
+	}
+	// the files of a dir are stated in batches, a big dir does not cost one rpc a file
+	if len(files) > 0 {
+		ret, stats := a.CFS.BatchStat(inode, files)
+		if ret != 0 {
+			return fmt.Errorf("stat files of %v ret %v", rel, ret)
+		}
+		for i, st := range stats {
+			if err := a.syncFileInfo(path.Join(rel, files[i]), st.Ret, st.Inode, st.InodeInfo); err != nil {
+				return err
+			}
+		}
+	}
+	for name := range onReplica {
+		if strings.HasPrefix(name, tmpPrefix) || strings.Contains(name, conflictSuffix) {
+			continue
+		}
+		a.remove(path.Join(rel, name))
+	}
+	return nil
+}
+
+// syncFile brings the replica of file name of the source dir pinode at rel up to date
+func (a *Agent) syncFile(pinode uint64, rel string, name string) error {
+	ret, inode, info := a.CFS.GetInodeInfoDirect(pinode, name)
+	return a.syncFileInfo(path.Join(rel, name), ret, inode, info)
+}
+
+// syncFileInfo syncFile with the source file already stated
+func (a *Agent) syncFileInfo(frel string, ret int32, inode uint64, info *mp.InodeInfo) error {
+	if ret == 2 /*ENOENT*/ {
+		a.remove(frel)
+		return nil
+	}
+	if ret != 0 {
+		return fmt.Errorf("stat %v ret %v", frel, ret)
+	}
+
+	tp := path.Join(a.Target, frel)
+	known, ok := a.files[frel]
+	var offset int64
+	if fi, err := os.Lstat(tp); err == nil {
+		intact := ok && !fi.IsDir() && fi.Size() == known.Size && fi.ModTime().UnixNano() == known.MTime
+		if !intact {
+			a.conflict(frel)
+		} else if known.Inode == inode && known.SrcSize == info.FileSize && known.SrcMTime == info.ModifiTime {
+			return nil
+		} else if known.Inode == inode && info.FileSize > known.SrcSize && known.Size == known.SrcSize && grown(known.Chunks, info) {
+			offset = known.SrcSize
+		}
+	}
+
+	if err := a.copyFile(frel, offset, info.FileSize); err != nil {
+		return err
+	}
+	fi, err := os.Lstat(tp)
+	if err != nil {
+		return err
+	}
+	a.files[frel] = fileState{
+		Inode:    inode,
+		SrcSize:  info.FileSize,
+		SrcMTime: info.ModifiTime,
+		Size:     fi.Size(),
+		MTime:    fi.ModTime().UnixNano(),
+		Chunks:   chunkIDs(info),
+	}
+	return nil
+}
+
+func chunkIDs(info *mp.InodeInfo) []uint64 {
+	var ids []uint64
+	for _, c := range info.Chunks {
+		ids = append(ids, c.ChunkID)
+	}
+	return ids
+}
+
+// grown whether the file only grew since it had the chunks old: it still begins
+// with them, none was truncated away or rewritten
+func grown(old []uint64, info *mp.InodeInfo) bool {
+	if len(old) == 0 || len(old) > len(info.Chunks) {
+		return false
+	}
+	for i, id := range old {
+		if info.Chunks[i].ChunkID != id {
+			return false
+		}
+	}
+	return true
+}
+
+// copyFile copies the source file from offset to size, a copy from 0 goes through a
+// temporary file renamed over the replica one
+func (a *Agent) copyFile(frel string, offset int64, size int64) error {
+	src, err := a.Source.OpenFile(frel, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tp := path.Join(a.Target, frel)
+	dst := tp
+	flag := os.O_WRONLY | os.O_APPEND
+	if offset == 0 {
+		dst = path.Join(path.Dir(tp), tmpPrefix+path.Base(tp))
+		os.Remove(dst)
+		flag = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	}
+	f, err := os.OpenFile(dst, flag, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(f, 1024*1024)
+	n, err := io.Copy(w, io.NewSectionReader(src, offset, size-offset))
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	atomic.AddUint64(&a.Bytes, uint64(n))
+	if err != nil {
+		if offset == 0 {
+			os.Remove(dst)
+		}
+		return err
+	}
+	if offset != 0 {
+		atomic.AddUint64(&a.Appended, 1)
+		return nil
+	}
+	atomic.AddUint64(&a.Copied, 1)
+	return os.Rename(dst, tp)
+}
+
+// remove drops rel from the replica, a file changed there is kept aside instead
+func (a *Agent) remove(rel string) {
+	tp := path.Join(a.Target, rel)
+	fi, err := os.Lstat(tp)
+	if err != nil {
+		a.forget(rel)
+		return
+	}
+	if known, ok := a.files[rel]; !fi.IsDir() && (!ok || fi.Size() != known.Size || fi.ModTime().UnixNano() != known.MTime) {
+		a.conflict(rel)
+	} else if err := os.RemoveAll(tp); err != nil {
+		logger.Error("georep %v remove %v err:%v", a.VolID, tp, err)
+		return
+	}
+	atomic.AddUint64(&a.Removed, 1)
+	a.forget(rel)
+}
+
+// rename moves rel to newRel on the replica, false when rel is not there
+func (a *Agent) rename(rel string, newRel string) bool {
+	if _, err := os.Lstat(path.Join(a.Target, rel)); err != nil {
+		return false
+	}
+	if fi, err := os.Lstat(path.Join(a.Target, newRel)); err == nil && fi.IsDir() {
+		// replaced an empty dir
+		os.Remove(path.Join(a.Target, newRel))
+	}
+	if err := os.Rename(path.Join(a.Target, rel), path.Join(a.Target, newRel)); err != nil {
+		logger.Error("georep %v rename %v to %v err:%v", a.VolID, rel, newRel, err)
+		return false
+	}
+	a.forget(newRel)
+	prefix := rel + "/"
+	for p, st := range a.files {
+		if p == rel || strings.HasPrefix(p, prefix) {
+			delete(a.files, p)
+			a.files[newRel+p[len(rel):]] = st
+		}
+	}
+	for inode, p := range a.dirs {
+		if p == rel || strings.HasPrefix(p, prefix) {
+			a.dirs[inode] = newRel + p[len(rel):]
+		}
+	}
+	return true
+}
+
+// forget drops what is known of rel and what was below it
+func (a *Agent) forget(rel string) {
+	prefix := rel + "/"
+	for p := range a.files {
+		if p == rel || strings.HasPrefix(p, prefix) {
+			delete(a.files, p)
+		}
+	}
+	for inode, p := range a.dirs {
+		if inode != 0 && (p == rel || strings.HasPrefix(p, prefix)) {
+			delete(a.dirs, inode)
+		}
+	}
+}
+
+// conflict keeps a replica entry changed behind the agent as rel.conflict-<unix time>,
+// the source wins
+func (a *Agent) conflict(rel string) {
+	tp := path.Join(a.Target, rel)
+	aside := fmt.Sprintf("%s%s%d", tp, conflictSuffix, time.Now().Unix())
+	if err := os.Rename(tp, aside); err != nil {
+		logger.Error("georep %v keep conflict %v err:%v", a.VolID, tp, err)
+		os.RemoveAll(tp)
+	} else {
+		logger.Error("georep %v: %v was changed on the replica, kept as %v", a.VolID, rel, aside)
+	}
+	atomic.AddUint64(&a.Conflicts, 1)
+	a.forget(rel)
+}
+
+type savedState struct {
+	Files map[string]fileState
+}
+
+// load reads back what an earlier run replicated
+func (a *Agent) load() {
+	if a.State == "" {
+		return
+	}
+	f, err := os.Open(a.State)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var s savedState
+	if err := gob.NewDecoder(bufio.NewReader(f)).Decode(&s); err != nil {
+		logger.Error("georep %v load state %v err:%v", a.VolID, a.State, err)
+		return
+	}
+	if s.Files != nil {
+		a.files = s.Files
+	}
+}
+
+func (a *Agent) save() {
+	if a.State == "" {
+		return
+	}
+	tmp := a.State + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		logger.Error("georep %v save state %v err:%v", a.VolID, tmp, err)
+		return
+	}
+	w := bufio.NewWriter(f)
+	err = gob.NewEncoder(w).Encode(&savedState{Files: a.files})
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, a.State)
+	}
+	if err != nil {
+		logger.Error("georep %v save state %v err:%v", a.VolID, a.State, err)
+	}
+}
+
+// Stats ...
+func (a *Agent) Stats() string {
+	a.mu.Lock()
+	pending := len(a.events)
+	a.mu.Unlock()
+	return fmt.Sprintf("georep %v pending:%v copied:%v appended:%v removed:%v conflicts:%v bytes:%v", a.VolID, pending,
+		atomic.LoadUint64(&a.Copied), atomic.LoadUint64(&a.Appended), atomic.LoadUint64(&a.Removed),
+		atomic.LoadUint64(&a.Conflicts), atomic.LoadUint64(&a.Bytes))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	cfs "github.com/ipdcode/containerfs/fs"
+	"github.com/ipdcode/containerfs/georep/agent"
+	"github.com/ipdcode/containerfs/libcfs"
+	"github.com/ipdcode/containerfs/logger"
+	"github.com/ipdcode/containerfs/utils"
+	"github.com/lxmgo/config"
+	"os"
+	"time"
+)
+
+func main() {
+
+	if len(os.Args) < 2 {
+		fmt.Println("cfs-georep [ini] [promote]")
+		os.Exit(1)
+	}
+	c, err := config.NewConfig(os.Args[1])
+	if err != nil {
+		fmt.Println("NewConfig err")
+		os.Exit(1)
+	}
+	utils.ConfigEnv(c)
+
+	logger.SetConsole(true)
+	logger.SetRollingFile(c.String("logger::log"), "georep.log", 10, 100, logger.MB) //each 100M rolling
+	switch level := c.String("logger::loglevel"); level {
+	case "error":
+		logger.SetLevel(logger.ERROR)
+	case "debug":
+		logger.SetLevel(logger.DEBUG)
+	case "info":
+		logger.SetLevel(logger.INFO)
+	default:
+		logger.SetLevel(logger.ERROR)
+	}
+
+	// the remote volmgr first, the source cluster takes the process wide addresses after
+	targetUUID := c.String("target::uuid")
+	cfs.VolMgrAddr = c.String("target::volmgr")
+
+	if len(os.Args) > 2 && os.Args[2] == "promote" {
+		// failover: the replica becomes a writable volume, stop the agent before
+		if ret := cfs.SetVolReplica(targetUUID, false); ret != 0 {
+			fmt.Printf("promote %v failed , ret :%d\n", targetUUID, ret)
+			os.Exit(1)
+		}
+		fmt.Printf("%v promoted, mount it read-write\n", targetUUID)
+		return
+	}
+
+	// never write over a volume that was promoted
+	ret, vi := cfs.GetVolInfo(targetUUID)
+	if ret != 0 || vi.VolInfo == nil {
+		fmt.Printf("get target volume %v failed , ret :%d\n", targetUUID, ret)
+		os.Exit(1)
+	}
+	if !vi.VolInfo.Replica {
+		fmt.Printf("target volume %v is not a replica, replicavol it first\n", targetUUID)
+		os.Exit(1)
+	}
+
+	uuid := c.String("source::uuid")
+	src, err := libcfs.Open(uuid, libcfs.Config{
+		VolMgr:    c.String("source::volmgr"),
+		MetaNodes: c.Strings("source::metanode"),
+		ReadOnly:  true,
+	})
+	if err != nil {
+		fmt.Printf("open source volume %v err:%v\n", uuid, err)
+		os.Exit(1)
+	}
+
+	rpo := 300 * time.Second
+	if n, err := c.Int("georep::rpo"); err == nil && n > 0 {
+		rpo = time.Duration(n) * time.Second
+	}
+	a := agent.New(src, uuid, c.String("target::path"), rpo, c.String("georep::state"))
+	a.Run()
+}
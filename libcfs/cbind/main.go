@@ -0,0 +1,253 @@
+// Command cbind builds libcfs.so, a C API over libcfs for applications and
+// language bindings that want to skip the FUSE mount:
+//
+//	go build -buildmode=c-shared -o libcfs.so main.go
+//
+// Volumes and files are referred to by positive ids, errors are returned as
+// negative errno values.
+package main
+
+/*
+#include <stdint.h>
+
+typedef struct {
+	int64_t size;
+	int64_t mtime;
+	int     is_dir;
+} cfs_stat_t;
+*/
+import "C"
+
+import (
+	"errors"
+	"github.com/ipdcode/containerfs/libcfs"
+	"io"
+	iofs "io/fs"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+var mu sync.Mutex
+var nextID int64
+var volumes = make(map[int64]*libcfs.FS)
+var files = make(map[int64]*libcfs.File)
+
+func errno(err error) C.int64_t {
+	var en syscall.Errno
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &en):
+		return -C.int64_t(en)
+	case errors.Is(err, iofs.ErrNotExist):
+		return -C.int64_t(syscall.ENOENT)
+	case errors.Is(err, iofs.ErrExist):
+		return -C.int64_t(syscall.EEXIST)
+	case errors.Is(err, iofs.ErrInvalid), errors.Is(err, libcfs.ErrNotAppend):
+		return -C.int64_t(syscall.EINVAL)
+	case errors.Is(err, iofs.ErrClosed):
+		return -C.int64_t(syscall.EBADF)
+	}
+	return -C.int64_t(syscall.EIO)
+}
+
+// name turns a C path into a libcfs name, "/a/b" -> "a/b", "/" -> "."
+func name(path *C.char) string {
+	n := strings.Trim(C.GoString(path), "/")
+	if n == "" {
+		return "."
+	}
+	return n
+}
+
+func volume(id C.int64_t) *libcfs.FS {
+	mu.Lock()
+	defer mu.Unlock()
+	return volumes[int64(id)]
+}
+
+func file(id C.int64_t) *libcfs.File {
+	mu.Lock()
+	defer mu.Unlock()
+	return files[int64(id)]
+}
+
+// buffer the size bytes at buf, checked: an error for a negative size or offset,
+// or a NULL buf
+func buffer(buf unsafe.Pointer, size C.int64_t, offset C.int64_t) ([]byte, C.int64_t) {
+	if size < 0 || offset < 0 || int64(size) != int64(int(size)) {
+		return nil, -C.int64_t(syscall.EINVAL)
+	}
+	if size == 0 {
+		return []byte{}, 0
+	}
+	if buf == nil {
+		return nil, -C.int64_t(syscall.EFAULT)
+	}
+	return unsafe.Slice((*byte)(buf), int(size)), 0
+}
+
+// cfs_init opens the volume uuid, metanodes is a comma separated list
+//
+//export cfs_init
+func cfs_init(volmgr *C.char, metanodes *C.char, uuid *C.char) C.int64_t {
+	cfg := libcfs.Config{
+		VolMgr:    C.GoString(volmgr),
+		MetaNodes: strings.Split(C.GoString(metanodes), ","),
+	}
+	fsys, err := libcfs.Open(C.GoString(uuid), cfg)
+	if err != nil {
+		return errno(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	nextID++
+	volumes[nextID] = fsys
+	return C.int64_t(nextID)
+}
+
+// cfs_open opens path with open(2) flags and returns a file id
+//
+//export cfs_open
+func cfs_open(vol C.int64_t, path *C.char, flags C.int) C.int64_t {
+	fsys := volume(vol)
+	if fsys == nil {
+		return -C.int64_t(syscall.EBADF)
+	}
+	f, err := fsys.OpenFile(name(path), int(flags), 0644)
+	if err != nil {
+		return errno(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	nextID++
+	files[nextID] = f
+	return C.int64_t(nextID)
+}
+
+// cfs_read reads up to size bytes at offset, like pread(2)
+//
+//export cfs_read
+func cfs_read(fd C.int64_t, buf unsafe.Pointer, size C.int64_t, offset C.int64_t) C.int64_t {
+	f := file(fd)
+	if f == nil {
+		return -C.int64_t(syscall.EBADF)
+	}
+	p, ret := buffer(buf, size, offset)
+	if ret != 0 {
+		return ret
+	}
+	n, err := f.ReadAt(p, int64(offset))
+	if err != nil && err != io.EOF {
+		return errno(err)
+	}
+	return C.int64_t(n)
+}
+
+// cfs_write writes size bytes at offset, which must be the end of the file
+//
+//export cfs_write
+func cfs_write(fd C.int64_t, buf unsafe.Pointer, size C.int64_t, offset C.int64_t) C.int64_t {
+	f := file(fd)
+	if f == nil {
+		return -C.int64_t(syscall.EBADF)
+	}
+	p, ret := buffer(buf, size, offset)
+	if ret != 0 {
+		return ret
+	}
+	// the writes may be buffered past the call, they get a copy of the caller's bytes
+	n, err := f.WriteAt(append([]byte(nil), p...), int64(offset))
+	if err != nil {
+		return errno(err)
+	}
+	return C.int64_t(n)
+}
+
+// cfs_copy_file_range copies len bytes of fd_in at off_in to fd_out at off_out, like
+// copy_file_range(2): a whole file to an empty one is cloned on the metanode
+//
+//export cfs_copy_file_range
+func cfs_copy_file_range(fdIn C.int64_t, offIn C.int64_t, fdOut C.int64_t, offOut C.int64_t, size C.int64_t) C.int64_t {
+	src, dst := file(fdIn), file(fdOut)
+	if src == nil || dst == nil {
+		return -C.int64_t(syscall.EBADF)
+	}
+	n, err := libcfs.CopyFileRange(src, int64(offIn), dst, int64(offOut), int64(size))
+	if err != nil && n == 0 {
+		return errno(err)
+	}
+	return C.int64_t(n)
+}
+
+// cfs_close flushes and releases the file id
+//
+//export cfs_close
+func cfs_close(fd C.int64_t) C.int64_t {
+	mu.Lock()
+	f := files[int64(fd)]
+	delete(files, int64(fd))
+	mu.Unlock()
+	if f == nil {
+		return -C.int64_t(syscall.EBADF)
+	}
+	return errno(f.Close())
+}
+
+// cfs_stat ...
+//
+//export cfs_stat
+func cfs_stat(vol C.int64_t, path *C.char, st *C.cfs_stat_t) C.int64_t {
+	fsys := volume(vol)
+	if fsys == nil {
+		return -C.int64_t(syscall.EBADF)
+	}
+	fi, err := fsys.Stat(name(path))
+	if err != nil {
+		return errno(err)
+	}
+	st.size = C.int64_t(fi.Size())
+	st.mtime = C.int64_t(fi.ModTime().Unix())
+	st.is_dir = 0
+	if fi.IsDir() {
+		st.is_dir = 1
+	}
+	return 0
+}
+
+// cfs_mkdir ...
+//
+//export cfs_mkdir
+func cfs_mkdir(vol C.int64_t, path *C.char) C.int64_t {
+	fsys := volume(vol)
+	if fsys == nil {
+		return -C.int64_t(syscall.EBADF)
+	}
+	return errno(fsys.Mkdir(name(path)))
+}
+
+// cfs_remove removes a file or an empty directory
+//
+//export cfs_remove
+func cfs_remove(vol C.int64_t, path *C.char) C.int64_t {
+	fsys := volume(vol)
+	if fsys == nil {
+		return -C.int64_t(syscall.EBADF)
+	}
+	return errno(fsys.Remove(name(path)))
+}
+
+// cfs_rename ...
+//
+//export cfs_rename
+func cfs_rename(vol C.int64_t, oldpath *C.char, newpath *C.char) C.int64_t {
+	fsys := volume(vol)
+	if fsys == nil {
+		return -C.int64_t(syscall.EBADF)
+	}
+	return errno(fsys.Rename(name(oldpath), name(newpath)))
+}
+
+func main() {}
@@ -0,0 +1,779 @@
+// Package libcfs lets Go applications use a ContainerFS volume directly,
+// without a FUSE mount. FS implements io/fs.FS, StatFS and ReadDirFS, and
+// File implements io.ReaderAt, io.WriterAt and io.Seeker.
+//
+// Like the FUSE client, files are written sequentially: writes must append
+// at the end of the file, which can be truncated to any size first.
+package libcfs
+
+import (
+	"errors"
+	cfs "github.com/ipdcode/containerfs/fs"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ErrNotAppend a write that does not start at the end of the file
+var ErrNotAppend = errors.New("cfs: writes must append at the end of the file")
+
+// Config cluster addresses, they are process-wide so every FS opened
+// in one process talks to the same cluster
+type Config struct {
+	VolMgr     string
+	MetaNodes  []string
+	BufferSize int32 // write buffer, 512KB when 0
+	ReadOnly   bool  // a read-only session, the one an ROX volume takes
+}
+
+var watchOnce = make(map[string]bool)
+var watchMu sync.Mutex
+
+// openFiles the files open in the process, for the session heartbeats
+var openFiles int64
+
+// FS one volume, names are slash-separated paths relative to the volume root
+type FS struct {
+	cfs     *cfs.CFS
+	handles uint64
+}
+
+var _ iofs.FS = (*FS)(nil)
+var _ iofs.StatFS = (*FS)(nil)
+var _ iofs.ReadDirFS = (*FS)(nil)
+
+// Open opens the volume uuid
+func Open(uuid string, cfg Config) (*FS, error) {
+	cfs.VolMgrAddr = cfg.VolMgr
+	cfs.MetaNodePeers = cfg.MetaNodes
+	if cfg.BufferSize == 0 {
+		cfg.BufferSize = 512 * 1024
+	}
+	cfs.BufferSize.Set(int(cfg.BufferSize))
+	if len(cfs.MetaNodePeers) == 0 {
+		return nil, errors.New("cfs: no metanode")
+	}
+
+	leader, err := cfs.GetLeader(uuid)
+	if err != nil {
+		return nil, err
+	}
+	cfs.MetaNodeAddr = leader
+
+	// one session per volume for the process, the metanodes check the access mode
+	// of the volume against it
+	watchMu.Lock()
+	defer watchMu.Unlock()
+	if !watchOnce[uuid] {
+		ret := cfs.StartSession(uuid, os.Args[0], cfg.ReadOnly, func() int64 {
+			return atomic.LoadInt64(&openFiles)
+		}, func() {})
+		switch ret {
+		case 0:
+		case 16:
+			return nil, &iofs.PathError{Op: "open", Path: uuid, Err: syscall.EBUSY}
+		case 30:
+			return nil, &iofs.PathError{Op: "open", Path: uuid, Err: syscall.EROFS}
+		default:
+			return nil, retErr("open", uuid, ret)
+		}
+		watchOnce[uuid] = true
+		go cfs.WatchLeader(uuid)
+	}
+
+	return &FS{cfs: cfs.OpenFileSystem(uuid)}, nil
+}
+
+// retErr maps the metanode and datanode return codes to errors
+func retErr(op string, name string, ret int32) error {
+	var err error
+	switch ret {
+	case 0:
+		return nil
+	case 2:
+		err = iofs.ErrNotExist
+	case 17:
+		err = iofs.ErrExist
+	case 20:
+		err = syscall.ENOTDIR
+	case 21:
+		err = syscall.EISDIR
+	case 39:
+		err = syscall.ENOTEMPTY
+	case 28:
+		err = syscall.ENOSPC
+	case 27:
+		err = syscall.EFBIG
+	case 18:
+		err = syscall.EXDEV
+	case 22:
+		err = syscall.EINVAL
+	default:
+		err = syscall.EIO
+	}
+	return &iofs.PathError{Op: op, Path: name, Err: err}
+}
+
+// split walks to the parent dir of name and returns its inode with the base name,
+// base is empty for the root
+func (fsys *FS) split(op string, name string) (uint64, string, error) {
+	if !iofs.ValidPath(name) {
+		return 0, "", &iofs.PathError{Op: op, Path: name, Err: iofs.ErrInvalid}
+	}
+	if name == "." {
+		return 0, "", nil
+	}
+	elems := strings.Split(name, "/")
+	var pinode uint64
+	for _, e := range elems[:len(elems)-1] {
+		ret, isFile, inode := fsys.cfs.StatDirect(pinode, e)
+		if ret != 0 {
+			return 0, "", retErr(op, name, ret)
+		}
+		if isFile {
+			return 0, "", &iofs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+		pinode = inode
+	}
+	return pinode, elems[len(elems)-1], nil
+}
+
+// lookup returns the inode of name and whether it is a file
+func (fsys *FS) lookup(op string, name string) (uint64, uint64, string, bool, error) {
+	pinode, base, err := fsys.split(op, name)
+	if err != nil || base == "" {
+		return pinode, 0, base, false, err
+	}
+	ret, isFile, inode := fsys.cfs.StatDirect(pinode, base)
+	if ret != 0 {
+		return 0, 0, "", false, retErr(op, name, ret)
+	}
+	return pinode, inode, base, isFile, nil
+}
+
+// Open opens name for reading, fs.FS
+func (fsys *FS) Open(name string) (iofs.File, error) {
+	pinode, inode, base, isFile, err := fsys.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if !isFile {
+		return &Dir{fsys: fsys, name: name, inode: inode}, nil
+	}
+	return fsys.openFile(name, pinode, base, os.O_RDONLY)
+}
+
+// OpenFile opens name with flag, O_CREATE and O_EXCL create the file, O_TRUNC empties
+// it when opened for writing
+func (fsys *FS) OpenFile(name string, flag int, perm os.FileMode) (*File, error) {
+	if flag&os.O_CREATE == 0 {
+		pinode, _, base, isFile, err := fsys.lookup("open", name)
+		if err != nil {
+			return nil, err
+		}
+		if !isFile {
+			return nil, &iofs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		return fsys.openFile(name, pinode, base, flag)
+	}
+
+	pinode, base, err := fsys.split("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if base == "" {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	if flag&os.O_EXCL == 0 {
+		if ret, isFile, _ := fsys.cfs.StatDirect(pinode, base); ret == 0 {
+			if !isFile {
+				return nil, &iofs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+			}
+			return fsys.openFile(name, pinode, base, flag)
+		}
+	}
+	ret, cfile := fsys.cfs.CreateFileDirect(pinode, base, flag)
+	if ret != 0 {
+		return nil, retErr("open", name, ret)
+	}
+	return fsys.newFile(name, cfile, flag), nil
+}
+
+// Create creates a new file for writing, it fails when name exists
+func (fsys *FS) Create(name string) (*File, error) {
+	return fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+}
+
+func (fsys *FS) openFile(name string, pinode uint64, base string, flag int) (*File, error) {
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if ret := fsys.cfs.Truncate(pinode, base, 0); ret != 0 {
+			return nil, retErr("open", name, ret)
+		}
+	}
+	ret, cfile := fsys.cfs.OpenFileDirect(pinode, base, flag)
+	if ret != 0 {
+		return nil, retErr("open", name, ret)
+	}
+	return fsys.newFile(name, cfile, flag), nil
+}
+
+func (fsys *FS) newFile(name string, cfile *cfs.CFile, flag int) *File {
+	f := &File{
+		fsys:   fsys,
+		name:   name,
+		cfile:  cfile,
+		flag:   flag,
+		handle: cfs.HandleID(atomic.AddUint64(&fsys.handles, 1)),
+	}
+	// reported open, another client unlinking it leaves it to this one until Close
+	fsys.cfs.Opened(cfile.ParentInodeID, cfile.Inode)
+	atomic.AddInt64(&openFiles, 1)
+	if flag&os.O_APPEND != 0 {
+		f.offset = cfile.FileSize
+	}
+	return f
+}
+
+// Mkdir ...
+func (fsys *FS) Mkdir(name string) error {
+	pinode, base, err := fsys.split("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if base == "" {
+		return &iofs.PathError{Op: "mkdir", Path: name, Err: iofs.ErrExist}
+	}
+	ret, _, _ := fsys.cfs.CreateDirDirect(pinode, base)
+	return retErr("mkdir", name, ret)
+}
+
+// Remove removes a file or an empty directory
+func (fsys *FS) Remove(name string) error {
+	pinode, _, base, isFile, err := fsys.lookup("remove", name)
+	if err != nil {
+		return err
+	}
+	if base == "" {
+		return &iofs.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
+	}
+	var ret int32
+	if isFile {
+		ret = fsys.cfs.DeleteFileDirect(pinode, base)
+	} else {
+		ret = fsys.cfs.DeleteDirDirect(pinode, base)
+	}
+	return retErr("remove", name, ret)
+}
+
+// BatchEntry an entry for CreateBatch
+type BatchEntry struct {
+	Name    string
+	Dir     bool
+	Data    []byte // files: the content, up to 64KB
+	Uid     uint32
+	Gid     uint32
+	Mode    uint32    // the permission bits, 0 for the default
+	ModTime time.Time // the zero time for now
+}
+
+func (e *BatchEntry) proto() *mp.BatchEntry {
+	b := &mp.BatchEntry{Name: e.Name, Dir: e.Dir, InlineData: e.Data, Uid: e.Uid, Gid: e.Gid, Mode: e.Mode}
+	if !e.ModTime.IsZero() {
+		b.ModifiTime = e.ModTime.Unix()
+	}
+	return b
+}
+
+// CreateBatch creates dirs and small files in the directory dir with a few rpcs,
+// for unpacking archives. errs has the error of each entry, nil when created.
+func (fsys *FS) CreateBatch(dir string, entries []BatchEntry) (errs []error, err error) {
+	inode, err := fsys.dirInode("create", dir)
+	if err != nil {
+		return nil, err
+	}
+	batch := make([]*mp.BatchEntry, len(entries))
+	for i, e := range entries {
+		batch[i] = e.proto()
+	}
+	ret, results := fsys.cfs.BatchCreate(inode, batch)
+	errs = make([]error, len(entries))
+	for i, r := range results {
+		errs[i] = retErr("create", path.Join(dir, entries[i].Name), r.Ret)
+	}
+	return errs, retErr("create", dir, ret)
+}
+
+// RemoveBatch removes files of the directory dir with a few rpcs, errs has the
+// error of each name, nil when removed
+func (fsys *FS) RemoveBatch(dir string, names []string) (errs []error, err error) {
+	inode, err := fsys.dirInode("remove", dir)
+	if err != nil {
+		return nil, err
+	}
+	ret, rets := fsys.cfs.BatchUnlink(inode, names)
+	errs = make([]error, len(names))
+	for i, r := range rets {
+		errs[i] = retErr("remove", path.Join(dir, names[i]), r)
+	}
+	return errs, retErr("remove", dir, ret)
+}
+
+func (fsys *FS) dirInode(op string, dir string) (uint64, error) {
+	_, inode, base, isFile, err := fsys.lookup(op, dir)
+	if err != nil {
+		return 0, err
+	}
+	if base != "" && isFile {
+		return 0, &iofs.PathError{Op: op, Path: dir, Err: syscall.ENOTDIR}
+	}
+	return inode, nil
+}
+
+// Rename replaces newname if it exists, a dir only by an empty dir
+func (fsys *FS) Rename(oldname, newname string) error {
+	oldp, oldbase, err := fsys.split("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newp, newbase, err := fsys.split("rename", newname)
+	if err != nil {
+		return err
+	}
+	if oldbase == "" || newbase == "" {
+		return &iofs.PathError{Op: "rename", Path: oldname, Err: syscall.EBUSY}
+	}
+	ret := fsys.cfs.RenameDirect(oldp, oldbase, newp, newbase)
+	return retErr("rename", oldname, ret)
+}
+
+// Truncate changes the size of the file name, see cfs.Truncate. A file open for
+// writing is truncated through its File.
+func (fsys *FS) Truncate(name string, size int64) error {
+	pinode, _, base, isFile, err := fsys.lookup("truncate", name)
+	if err != nil {
+		return err
+	}
+	if !isFile {
+		return &iofs.PathError{Op: "truncate", Path: name, Err: syscall.EISDIR}
+	}
+	return retErr("truncate", name, fsys.cfs.Truncate(pinode, base, size))
+}
+
+// Clone makes newname a copy of the file oldname sharing its chunks, no data is
+// copied. newname must not exist or be an empty file, EXDEV when the two are in
+// different shards of the volume.
+func (fsys *FS) Clone(oldname, newname string) error {
+	oldp, oldbase, err := fsys.split("clone", oldname)
+	if err != nil {
+		return err
+	}
+	newp, newbase, err := fsys.split("clone", newname)
+	if err != nil {
+		return err
+	}
+	if oldbase == "" || newbase == "" {
+		return &iofs.PathError{Op: "clone", Path: oldname, Err: syscall.EISDIR}
+	}
+	ret, _, _ := fsys.cfs.CloneFile(oldp, oldbase, newp, newbase)
+	return retErr("clone", oldname, ret)
+}
+
+// Stat ...
+func (fsys *FS) Stat(name string) (iofs.FileInfo, error) {
+	pinode, _, base, isFile, err := fsys.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.stat(name, pinode, base, isFile)
+}
+
+func (fsys *FS) stat(name string, pinode uint64, base string, isFile bool) (iofs.FileInfo, error) {
+	fi := &fileInfo{name: path.Base(name), dir: !isFile}
+	if !isFile {
+		return fi, nil
+	}
+	ret, _, info := fsys.cfs.GetInodeInfoDirect(pinode, base)
+	if ret != 0 {
+		return nil, retErr("stat", name, ret)
+	}
+	fi.size = info.FileSize
+	fi.mtime = time.Unix(info.ModifiTime, int64(info.ModifiTimeNsec))
+	return fi, nil
+}
+
+// ReadDir returns the entries of a directory in name order
+func (fsys *FS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	d, ok := f.(*Dir)
+	if !ok {
+		return nil, &iofs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	return d.ReadDir(-1)
+}
+
+type fileInfo struct {
+	name  string
+	size  int64
+	mtime time.Time
+	dir   bool
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *fileInfo) IsDir() bool        { return fi.dir }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+func (fi *fileInfo) Mode() iofs.FileMode {
+	if fi.dir {
+		return iofs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// File an open file, safe for concurrent use
+type File struct {
+	fsys   *FS
+	name   string
+	flag   int
+	handle cfs.HandleID
+
+	mu     sync.Mutex
+	cfile  *cfs.CFile
+	offset int64
+}
+
+var _ io.ReaderAt = (*File)(nil)
+var _ io.WriterAt = (*File)(nil)
+var _ io.Seeker = (*File)(nil)
+
+func (f *File) writable() bool {
+	return f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+// Name ...
+func (f *File) Name() string {
+	return f.name
+}
+
+// Stat ...
+func (f *File) Stat() (iofs.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cfile == nil {
+		return nil, iofs.ErrClosed
+	}
+	return &fileInfo{name: path.Base(f.name), size: f.cfile.FileSize}, nil
+}
+
+// ReadAt ...
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.readAt(p, off)
+}
+
+func (f *File) readAt(p []byte, off int64) (int, error) {
+	if f.cfile == nil {
+		return 0, iofs.ErrClosed
+	}
+	n := 0
+	for n < len(p) {
+		if off+int64(n) >= f.cfile.FileSize {
+			return n, io.EOF
+		}
+		want := int64(len(p) - n)
+		if rem := f.cfile.FileSize - off - int64(n); rem < want {
+			want = rem
+		}
+		data := p[n:n]
+		got := f.cfile.Read(f.handle, &data, off+int64(n), want)
+		if got < 0 {
+			return n, &iofs.PathError{Op: "read", Path: f.name, Err: syscall.EIO}
+		}
+		if got == 0 {
+			return n, io.EOF
+		}
+		copy(p[n:], data[:got])
+		n += int(got)
+	}
+	return n, nil
+}
+
+// Read ...
+func (f *File) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// WriteAt only appends, off must be the current size of the file
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writeAt(p, off)
+}
+
+func (f *File) writeAt(p []byte, off int64) (int, error) {
+	if f.cfile == nil {
+		return 0, iofs.ErrClosed
+	}
+	if !f.writable() {
+		return 0, &iofs.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+	if off != f.cfile.FileSize {
+		return 0, &iofs.PathError{Op: "write", Path: f.name, Err: ErrNotAppend}
+	}
+	w := f.cfile.Write(p, int32(len(p)))
+	if w != int32(len(p)) {
+		if w == -1 {
+			return 0, &iofs.PathError{Op: "write", Path: f.name, Err: syscall.ENOSPC}
+		}
+		return 0, &iofs.PathError{Op: "write", Path: f.name, Err: syscall.EIO}
+	}
+	return len(p), nil
+}
+
+// Write ...
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.flag&os.O_APPEND != 0 && f.cfile != nil {
+		f.offset = f.cfile.FileSize
+	}
+	n, err := f.writeAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// Seek ...
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cfile == nil {
+		return 0, iofs.ErrClosed
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.cfile.FileSize
+	}
+	if offset < 0 {
+		return 0, &iofs.PathError{Op: "seek", Path: f.name, Err: iofs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Truncate changes the size of the file, its buffered writes are sent first
+func (f *File) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cfile == nil {
+		return iofs.ErrClosed
+	}
+	if !f.writable() {
+		return &iofs.PathError{Op: "truncate", Path: f.name, Err: syscall.EBADF}
+	}
+	if ret := f.cfile.Flush(); ret != 0 {
+		return retErr("truncate", f.name, ret)
+	}
+	c := f.cfile
+	if ret := f.fsys.cfs.Truncate(c.ParentInodeID, c.Name, size); ret != 0 {
+		return retErr("truncate", f.name, ret)
+	}
+	return retErr("truncate", f.name, c.Reload())
+}
+
+// Sync writes the buffered data to the datanodes and the chunk sizes to the metanode,
+// it returns once the datanodes have it on disk
+func (f *File) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cfile == nil {
+		return iofs.ErrClosed
+	}
+	if !f.writable() {
+		return nil
+	}
+	if ret := f.cfile.Sync(); ret != 0 {
+		return retErr("sync", f.name, ret)
+	}
+	return nil
+}
+
+// CopyFileRange copies n bytes of src at offIn to dst at offOut, like copy_file_range(2),
+// and returns the bytes copied. A whole file copied to an empty one is a clone, see
+// Clone, no data moves; else the data goes through the client, and offOut must be the
+// end of dst.
+func CopyFileRange(src *File, offIn int64, dst *File, offOut int64, n int64) (int64, error) {
+	if src == dst || offIn < 0 || offOut < 0 || n < 0 {
+		return 0, &iofs.PathError{Op: "copy_file_range", Path: dst.name, Err: syscall.EINVAL}
+	}
+	first, second := src, dst
+	if second.handle < first.handle {
+		first, second = second, first
+	}
+	first.mu.Lock()
+	defer first.mu.Unlock()
+	second.mu.Lock()
+	defer second.mu.Unlock()
+	if src.cfile == nil || dst.cfile == nil {
+		return 0, iofs.ErrClosed
+	}
+	if !dst.writable() {
+		return 0, &iofs.PathError{Op: "copy_file_range", Path: dst.name, Err: syscall.EBADF}
+	}
+	if src.writable() {
+		if ret := src.cfile.Flush(); ret != 0 {
+			return 0, retErr("copy_file_range", src.name, ret)
+		}
+	}
+	size := src.cfile.FileSize
+	if offIn == 0 && offOut == 0 && n >= size && dst.cfile.FileSize == 0 && src.fsys == dst.fsys {
+		s, d := src.cfile, dst.cfile
+		ret, _, _ := src.fsys.cfs.CloneFile(s.ParentInodeID, s.Name, d.ParentInodeID, d.Name)
+		if ret == 0 {
+			if ret := d.Reload(); ret != 0 {
+				return 0, retErr("copy_file_range", dst.name, ret)
+			}
+			return size, nil
+		}
+		if ret != 18 /*EXDEV*/ {
+			return 0, retErr("copy_file_range", dst.name, ret)
+		}
+	}
+
+	buf := make([]byte, 1024*1024)
+	var copied int64
+	for copied < n {
+		p := buf
+		if rem := n - copied; rem < int64(len(p)) {
+			p = p[:rem]
+		}
+		k, err := src.readAt(p, offIn+copied)
+		if k > 0 {
+			if _, err := dst.writeAt(p[:k], offOut+copied); err != nil {
+				return copied, err
+			}
+			copied += int64(k)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return copied, err
+		}
+	}
+	return copied, nil
+}
+
+// Close flushes a written file
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cfile == nil {
+		return iofs.ErrClosed
+	}
+	var err error
+	if f.writable() {
+		if ret := f.cfile.Flush(); ret != 0 {
+			err = retErr("close", f.name, ret)
+		}
+		f.cfile.CloseConns()
+	}
+	f.cfile.ReleaseReader(f.handle)
+	f.fsys.cfs.Closed(f.cfile.Inode)
+	f.cfile = nil
+	atomic.AddInt64(&openFiles, -1)
+	return err
+}
+
+// Dir an open directory, ReadDir pages through it in name order
+type Dir struct {
+	fsys   *FS
+	name   string
+	inode  uint64
+	marker string
+	eof    bool
+}
+
+var _ iofs.ReadDirFile = (*Dir)(nil)
+
+// Stat ...
+func (d *Dir) Stat() (iofs.FileInfo, error) {
+	return &fileInfo{name: path.Base(d.name), dir: true}, nil
+}
+
+// Read ...
+func (d *Dir) Read(p []byte) (int, error) {
+	return 0, &iofs.PathError{Op: "read", Path: d.name, Err: syscall.EISDIR}
+}
+
+// Close ...
+func (d *Dir) Close() error {
+	return nil
+}
+
+// ReadDir returns up to n entries, all the remaining ones when n <= 0
+func (d *Dir) ReadDir(n int) ([]iofs.DirEntry, error) {
+	var res []iofs.DirEntry
+	for !d.eof && (n <= 0 || len(res) < n) {
+		limit := cfs.ListPageSize.Get()
+		if n > 0 && n-len(res) < limit {
+			limit = n - len(res)
+		}
+		// the infos come with the page, Info is then free
+		ret, dirents, infos, next := d.fsys.cfs.ListWithAttrsPage(d.inode, d.marker, limit)
+		if ret != 0 {
+			return res, retErr("readdir", d.name, ret)
+		}
+		for i, v := range dirents {
+			res = append(res, &dirEntry{d: d, name: v.Name, file: v.InodeType, info: infos[i]})
+		}
+		d.marker = next
+		d.eof = next == ""
+	}
+	if n > 0 && len(res) == 0 && d.eof {
+		return nil, io.EOF
+	}
+	return res, nil
+}
+
+type dirEntry struct {
+	d    *Dir
+	name string
+	file bool
+	info *mp.InodeInfo // nil when ReadDir could not stat it
+}
+
+func (e *dirEntry) Name() string { return e.name }
+func (e *dirEntry) IsDir() bool  { return !e.file }
+func (e *dirEntry) Type() iofs.FileMode {
+	if e.file {
+		return 0
+	}
+	return iofs.ModeDir
+}
+func (e *dirEntry) Info() (iofs.FileInfo, error) {
+	if e.file && e.info != nil {
+		return &fileInfo{name: e.name, size: e.info.FileSize, mtime: time.Unix(e.info.ModifiTime, int64(e.info.ModifiTimeNsec))}, nil
+	}
+	return e.d.fsys.stat(path.Join(e.d.name, e.name), e.d.inode, e.name, e.file)
+}
@@ -0,0 +1,399 @@
+package libcfs
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	cfs "github.com/ipdcode/containerfs/fs"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// the whiteouts of the image layers, .wh.name hides name of the layers below and
+// .wh..wh..opq all the entries of its dir
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// tarBatchBytes the most file content sent in one batch
+const tarBatchBytes = 1 << 20
+
+// TarOptions of IngestTar
+type TarOptions struct {
+	// Whiteouts applies the whiteouts of an image layer to the dir, instead of
+	// keeping them as files for the layer store to apply
+	Whiteouts bool
+	// SkipSpecial skips the symlinks, devices and fifos, a volume cannot hold
+	// them, and lists them in TarStats. Without it they fail the ingest.
+	SkipSpecial bool
+}
+
+// ErrSpecial a tar entry a volume cannot hold
+var ErrSpecial = errors.New("symlinks, devices and fifos are not supported")
+
+// TarStats what IngestTar did
+type TarStats struct {
+	Files   int64
+	Dirs    int64
+	Links   int64 // hard links, made clones of their target
+	Removed int64 // by whiteouts
+	Skipped int64 // symlinks, devices and fifos, with SkipSpecial
+	Bytes   int64
+
+	SkippedNames []string // the first maxSkippedNames skipped, by path in the volume
+}
+
+// maxSkippedNames the skipped entries TarStats lists at most
+const maxSkippedNames = 100
+
+type ingest struct {
+	fsys    *FS
+	opt     TarOptions
+	dirs    map[string]uint64 // inodes of the dirs, by path in the volume
+	created map[string]bool   // the entries of the tar, the whiteouts leave them
+	st      TarStats
+
+	batchDir   string
+	batch      []BatchEntry
+	batchBytes int
+}
+
+// IngestTar unpacks the tar stream r, gzipped or not, into the dir of the volume.
+// The dirs and the small files go to the metanode in batches with their content,
+// the larger files are streamed to the datanodes. An entry already there is
+// replaced. The entries keep their owner, the dirs and small files their mtime.
+// A symlink, a device or a fifo fails the ingest, unless opt.SkipSpecial.
+func (fsys *FS) IngestTar(dir string, r io.Reader, opt TarOptions) (TarStats, error) {
+	inode, err := fsys.dirInode("ingest", dir)
+	if err != nil {
+		return TarStats{}, err
+	}
+	br := bufio.NewReaderSize(r, 1<<20)
+	r = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return TarStats{}, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	in := &ingest{
+		fsys:    fsys,
+		opt:     opt,
+		dirs:    map[string]uint64{path.Clean(dir): inode},
+		created: make(map[string]bool),
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return in.st, err
+		}
+		if err := in.entry(path.Clean(dir), hdr, tr); err != nil {
+			return in.st, err
+		}
+	}
+	return in.st, in.flush()
+}
+
+// metadataOnly the typeflags of the headers holding no entry, the pax global
+// headers of git archive and the image builders among them
+func metadataOnly(typeflag byte) bool {
+	switch typeflag {
+	case tar.TypeXGlobalHeader, tar.TypeXHeader, tar.TypeGNULongName, tar.TypeGNULongLink:
+		return true
+	}
+	return false
+}
+
+func (in *ingest) entry(root string, hdr *tar.Header, tr io.Reader) error {
+	if metadataOnly(hdr.Typeflag) {
+		return nil
+	}
+	// the names are kept under root, whatever .. they hold
+	name := strings.Trim(path.Clean("/"+hdr.Name), "/")
+	if name == "" {
+		return nil
+	}
+	full := path.Join(root, name)
+	parent, base := path.Dir(full), path.Base(full)
+
+	if in.opt.Whiteouts && strings.HasPrefix(base, whiteoutPrefix) {
+		if err := in.flush(); err != nil {
+			return err
+		}
+		if base == whiteoutOpaque {
+			return in.opaque(parent)
+		}
+		return in.whiteout(path.Join(parent, base[len(whiteoutPrefix):]))
+	}
+
+	e := BatchEntry{Name: base, Uid: uint32(hdr.Uid), Gid: uint32(hdr.Gid), Mode: uint32(hdr.Mode) & 07777, ModTime: hdr.ModTime}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		in.created[full] = true
+		if _, ok := in.dirs[full]; ok {
+			return nil
+		}
+		e.Dir = true
+		return in.add(parent, e)
+	case tar.TypeReg:
+		in.created[full] = true
+		if hdr.Size <= int64(cfs.InlineThreshold) {
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			e.Data = data
+			return in.add(parent, e)
+		}
+		if err := in.flush(); err != nil {
+			return err
+		}
+		return in.write(full, e, tr)
+	case tar.TypeLink:
+		in.created[full] = true
+		if err := in.flush(); err != nil {
+			return err
+		}
+		target := path.Join(root, strings.Trim(path.Clean("/"+hdr.Linkname), "/"))
+		return in.link(target, full)
+	}
+	if !in.opt.SkipSpecial {
+		return &iofs.PathError{Op: "ingest", Path: full, Err: ErrSpecial}
+	}
+	in.st.Skipped++
+	if len(in.st.SkippedNames) < maxSkippedNames {
+		in.st.SkippedNames = append(in.st.SkippedNames, full)
+	}
+	return nil
+}
+
+// add the entry to the batch of parent, sent when full or for another dir
+func (in *ingest) add(parent string, e BatchEntry) error {
+	if parent != in.batchDir || len(in.batch) >= cfs.BatchSize || in.batchBytes+len(e.Data) > tarBatchBytes {
+		if err := in.flush(); err != nil {
+			return err
+		}
+	}
+	in.batchDir = parent
+	in.batch = append(in.batch, e)
+	in.batchBytes += len(e.Data)
+	return nil
+}
+
+func (in *ingest) flush() error {
+	if len(in.batch) == 0 {
+		return nil
+	}
+	dir, batch := in.batchDir, in.batch
+	in.batch, in.batchBytes = nil, 0
+	pinode, err := in.dir(dir)
+	if err != nil {
+		return err
+	}
+	entries := make([]*mp.BatchEntry, len(batch))
+	for i := range batch {
+		entries[i] = batch[i].proto()
+	}
+	ret, results := in.fsys.cfs.BatchCreate(pinode, entries)
+	if ret != 0 {
+		return retErr("create", dir, ret)
+	}
+	for i, r := range results {
+		e, p := batch[i], path.Join(dir, batch[i].Name)
+		switch {
+		case r.Ret == 17 && e.Dir:
+			// merged with the dir there
+			continue
+		case r.Ret == 17:
+			if err := in.remove(p); err != nil {
+				return err
+			}
+			var rets []*mp.BatchCreateResult
+			ret, rets = in.fsys.cfs.BatchCreate(pinode, entries[i:i+1])
+			if ret == 0 && len(rets) == 1 {
+				ret = rets[0].Ret
+			}
+			if ret != 0 {
+				return retErr("create", p, ret)
+			}
+		case r.Ret != 0:
+			return retErr("create", p, r.Ret)
+		case e.Dir:
+			in.dirs[p] = r.Inode
+		}
+		if e.Dir {
+			in.st.Dirs++
+		} else {
+			in.st.Files++
+			in.st.Bytes += int64(len(e.Data))
+		}
+	}
+	return nil
+}
+
+// dir the inode of the dir p, made when the tar did not have it (before its entries)
+func (in *ingest) dir(p string) (uint64, error) {
+	if inode, ok := in.dirs[p]; ok {
+		return inode, nil
+	}
+	pinode, err := in.dir(path.Dir(p))
+	if err != nil {
+		return 0, err
+	}
+	base := path.Base(p)
+	ret, isFile, inode := in.fsys.cfs.StatDirect(pinode, base)
+	if ret == 0 && isFile {
+		if err := in.remove(p); err != nil {
+			return 0, err
+		}
+		ret = 2
+	}
+	if ret == 2 {
+		ret, inode, _ = in.fsys.cfs.CreateDirDirect(pinode, base)
+	}
+	if ret != 0 {
+		return 0, retErr("mkdir", p, ret)
+	}
+	in.dirs[p] = inode
+	return inode, nil
+}
+
+// write a file too large to go inline, streaming it to the datanodes
+func (in *ingest) write(p string, e BatchEntry, r io.Reader) error {
+	pinode, err := in.dir(path.Dir(p))
+	if err != nil {
+		return err
+	}
+	c := in.fsys.cfs.WithOwner(e.Uid, e.Gid).WithMode(e.Mode)
+	ret, cfile := c.CreateFileDirect(pinode, e.Name, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if ret == 17 {
+		if err := in.remove(p); err != nil {
+			return err
+		}
+		ret, cfile = c.CreateFileDirect(pinode, e.Name, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	}
+	if ret != 0 {
+		return retErr("create", p, ret)
+	}
+	f := in.fsys.newFile(p, cfile, os.O_WRONLY)
+	n, err := io.CopyBuffer(f, r, make([]byte, 1<<20))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	in.st.Files++
+	in.st.Bytes += n
+	return nil
+}
+
+// link a hard link, a clone of target when the two are in one shard, a copy otherwise
+func (in *ingest) link(target string, p string) error {
+	if err := in.remove(p); err != nil {
+		return err
+	}
+	if _, err := in.dir(path.Dir(p)); err != nil {
+		return err
+	}
+	err := in.fsys.Clone(target, p)
+	if errors.Is(err, syscall.EXDEV) {
+		err = in.copy(target, p)
+	}
+	if err != nil {
+		return err
+	}
+	in.st.Links++
+	return nil
+}
+
+func (in *ingest) copy(src string, dst string) error {
+	r, err := in.fsys.OpenFile(src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := in.fsys.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyBuffer(w, r, make([]byte, 1<<20))
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// whiteout removes p of the layers below
+func (in *ingest) whiteout(p string) error {
+	if in.created[p] {
+		return nil
+	}
+	if _, err := in.fsys.Stat(p); errors.Is(err, iofs.ErrNotExist) {
+		return nil
+	}
+	if err := in.remove(p); err != nil {
+		return err
+	}
+	in.st.Removed++
+	return nil
+}
+
+// opaque removes the entries of dir from the layers below
+func (in *ingest) opaque(dir string) error {
+	if _, err := in.dir(dir); err != nil {
+		return err
+	}
+	des, err := in.fsys.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, de := range des {
+		if err := in.whiteout(path.Join(dir, de.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove the file or dir tree p, if there
+func (in *ingest) remove(p string) error {
+	fi, err := in.fsys.Stat(p)
+	if errors.Is(err, iofs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		des, err := in.fsys.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		for _, de := range des {
+			if err := in.remove(path.Join(p, de.Name())); err != nil {
+				return err
+			}
+		}
+		for d := range in.dirs {
+			if d == p || strings.HasPrefix(d, p+"/") {
+				delete(in.dirs, d)
+			}
+		}
+	}
+	return in.fsys.Remove(p)
+}
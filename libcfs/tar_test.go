@@ -0,0 +1,59 @@
+package libcfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// TestIngestGlobalHeader a pax global header, as git archive writes first, is no
+// entry: neither ingested nor skipped. A symlink after it still fails the ingest.
+func TestIngestGlobalHeader(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	hdrs := []*tar.Header{
+		{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header", PAXRecords: map[string]string{"comment": "0123abcd"}, Format: tar.FormatPAX},
+		{Typeflag: tar.TypeSymlink, Name: "link", Linkname: "target"},
+	}
+	for _, hdr := range hdrs {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(&buf)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Typeflag != tar.TypeXGlobalHeader {
+		t.Fatalf("first header typeflag %q, want the global header", hdr.Typeflag)
+	}
+	in := &ingest{dirs: map[string]uint64{"dst": 1}, created: make(map[string]bool)}
+	if err := in.entry("dst", hdr, tr); err != nil {
+		t.Errorf("global header: %v", err)
+	}
+	if in.st.Skipped != 0 || len(in.st.SkippedNames) != 0 || len(in.batch) != 0 {
+		t.Errorf("global header taken as an entry: %+v, %v in the batch", in.st, len(in.batch))
+	}
+
+	hdr, err = tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := in.entry("dst", hdr, tr); !errors.Is(err, ErrSpecial) {
+		t.Errorf("symlink: %v, want ErrSpecial", err)
+	}
+	in.opt.SkipSpecial = true
+	if err := in.entry("dst", hdr, tr); err != nil || in.st.Skipped != 1 || in.st.SkippedNames[0] != "dst/link" {
+		t.Errorf("symlink with SkipSpecial: %v, %+v", err, in.st)
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("after the symlink: %v, want EOF", err)
+	}
+}
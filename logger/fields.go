@@ -0,0 +1,213 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// FORMAT of the records
+type FORMAT int32
+
+// const var
+const (
+	TEXT FORMAT = iota // [level] msg key=value ..., after the date and file of log
+	JSON               // one json object per line
+)
+
+var logFormat = TEXT
+
+// SetFormat ...
+func SetFormat(f FORMAT) {
+	logFormat = f
+}
+
+// Fields of a structured record, the common ones have a Field constant. A
+// time.Duration is written in microseconds, an error as its message.
+type Fields map[string]interface{}
+
+// the common fields, so the records of all the daemons can be searched alike
+const (
+	FieldVolume  = "volume"
+	FieldInode   = "inode"
+	FieldOp      = "op"
+	FieldLatency = "latency"
+	FieldError   = "error"
+)
+
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case time.Duration:
+		return int64(v / time.Microsecond)
+	case error:
+		return v.Error()
+	}
+	return v
+}
+
+func (f Fields) keys() []string {
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// text " key=value" for each field, in key order
+func (f Fields) text() string {
+	if len(f) == 0 {
+		return ""
+	}
+	var b bytes.Buffer
+	for _, k := range f.keys() {
+		s := fmt.Sprint(fieldValue(f[k]))
+		if strings.ContainsAny(s, " \"=") {
+			s = strconv.Quote(s)
+		}
+		b.WriteString(" " + k + "=" + s)
+	}
+	return b.String()
+}
+
+func jsonRecord(level LEVEL, file string, line int, msg string, fields Fields) []byte {
+	rec := make(map[string]interface{}, len(fields)+5)
+	for k, v := range fields {
+		rec[k] = fieldValue(v)
+	}
+	rec["time"] = time.Now().Format(time.RFC3339Nano)
+	rec["level"] = levelTags[level]
+	rec["module"] = moduleOf(file)
+	rec["caller"] = shortFile(file) + ":" + strconv.Itoa(line)
+	rec["msg"] = msg
+	b, err := json.Marshal(rec)
+	if err != nil {
+		b, _ = json.Marshal(map[string]interface{}{"time": rec["time"], "level": rec["level"], "msg": msg, "caller": rec["caller"]})
+	}
+	return append(b, '\n')
+}
+
+// Entry logs its fields with each record
+type Entry struct {
+	fields Fields
+}
+
+// WithFields an Entry logging fields
+func WithFields(fields Fields) *Entry {
+	return &Entry{fields: fields}
+}
+
+// WithFields an Entry logging the fields of e and fields
+func (e *Entry) WithFields(fields Fields) *Entry {
+	all := make(Fields, len(e.fields)+len(fields))
+	for k, v := range e.fields {
+		all[k] = v
+	}
+	for k, v := range fields {
+		all[k] = v
+	}
+	return &Entry{fields: all}
+}
+
+// Debug ...
+func (e *Entry) Debug(format string, args ...interface{}) {
+	output(DEBUG, e.fields, format, args...)
+}
+
+// Info ...
+func (e *Entry) Info(format string, args ...interface{}) {
+	output(INFO, e.fields, format, args...)
+}
+
+// Warn ...
+func (e *Entry) Warn(format string, args ...interface{}) {
+	output(WARN, e.fields, format, args...)
+}
+
+// Error ...
+func (e *Entry) Error(format string, args ...interface{}) {
+	output(ERROR, e.fields, format, args...)
+}
+
+// Fatal ...
+func (e *Entry) Fatal(format string, args ...interface{}) {
+	output(FATAL, e.fields, format, args...)
+}
+
+// ParseLevel the LEVEL named s: debug, info, warn, error, fatal or off
+func ParseLevel(s string) (LEVEL, bool) {
+	for l, tag := range levelTags {
+		if tag == s {
+			return l, true
+		}
+	}
+	if s == "off" {
+		return OFF, true
+	}
+	return ERROR, false
+}
+
+// the levels set per module, a map[string]LEVEL replaced as a whole
+var moduleLevels atomic.Value
+
+// SetModuleLevels sets the level of the records of modules, a module is a dir of
+// the source tree like fs or metanode/namespace and its level holds for its
+// subdirs too. The other modules keep the level of SetLevel.
+func SetModuleLevels(levels map[string]LEVEL) {
+	moduleLevels.Store(levels)
+}
+
+func hasModuleLevels() bool {
+	m, _ := moduleLevels.Load().(map[string]LEVEL)
+	return len(m) > 0
+}
+
+// minLevel the lowest level a record may be kept at
+func minLevel() LEVEL {
+	min := logLevel
+	m, _ := moduleLevels.Load().(map[string]LEVEL)
+	for _, l := range m {
+		if l < min {
+			min = l
+		}
+	}
+	return min
+}
+
+// moduleLevel the level of the records of the source file
+func moduleLevel(file string) LEVEL {
+	m, _ := moduleLevels.Load().(map[string]LEVEL)
+	if len(m) == 0 {
+		return logLevel
+	}
+	module := moduleOf(file)
+	level, best := logLevel, -1
+	for k, l := range m {
+		if (module == k || strings.HasPrefix(module, k+"/")) && len(k) > best {
+			level, best = l, len(k)
+		}
+	}
+	return level
+}
+
+// moduleOf the dir of file under the source tree
+func moduleOf(file string) string {
+	i := strings.LastIndex(file, "/")
+	if i < 0 {
+		return ""
+	}
+	dir := file[:i]
+	if j := strings.LastIndex(dir, "/containerfs/"); j >= 0 {
+		return dir[j+len("/containerfs/"):]
+	}
+	return dir[strings.LastIndex(dir, "/")+1:]
+}
+
+func shortFile(file string) string {
+	return file[strings.LastIndex(file, "/")+1:]
+}
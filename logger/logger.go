@@ -156,94 +156,63 @@ func catchError() {
 
 // Debug debug
 func Debug(format string, args ...interface{}) {
-	if dailyRolling {
-		fileCheck()
-	}
-	defer catchError()
-	if logObj != nil {
-		logObj.mu.RLock()
-		defer logObj.mu.RUnlock()
-	}
-
-	if logLevel <= DEBUG {
-		if logObj != nil {
-			format = "[debug] " + format
-			logObj.lg.Output(2, fmt.Sprintf(format, args...))
-		}
-	}
+	output(DEBUG, nil, format, args...)
 }
 
 // Info info
 func Info(format string, args ...interface{}) {
-	if dailyRolling {
-		fileCheck()
-	}
-	defer catchError()
-	if logObj != nil {
-		logObj.mu.RLock()
-		defer logObj.mu.RUnlock()
-	}
-	if logLevel <= INFO {
-		if logObj != nil {
-			format = "[info] " + format
-			logObj.lg.Output(2, fmt.Sprintf(format, args...))
-		}
-	}
+	output(INFO, nil, format, args...)
 }
 
 // Warn ...
 func Warn(format string, args ...interface{}) {
-	if dailyRolling {
-		fileCheck()
-	}
-	defer catchError()
-	if logObj != nil {
-		logObj.mu.RLock()
-		defer logObj.mu.RUnlock()
-	}
-
-	if logLevel <= WARN {
-		if logObj != nil {
-			format = "[warn] " + format
-			logObj.lg.Output(2, fmt.Sprintf(format, args...))
-		}
-	}
+	output(WARN, nil, format, args...)
 }
 
 // Error ...
 func Error(format string, args ...interface{}) {
-	if dailyRolling {
-		fileCheck()
-	}
-	defer catchError()
-	if logObj != nil {
-		logObj.mu.RLock()
-		defer logObj.mu.RUnlock()
-	}
-	if logLevel <= ERROR {
-		if logObj != nil {
-			format = "[error] " + format
-			logObj.lg.Output(2, fmt.Sprintf(format, args...))
-		}
-	}
+	output(ERROR, nil, format, args...)
 }
 
 // Fatal ...
 func Fatal(format string, args ...interface{}) {
+	output(FATAL, nil, format, args...)
+}
+
+var levelTags = map[LEVEL]string{DEBUG: "debug", INFO: "info", WARN: "warn", ERROR: "error", FATAL: "fatal"}
+
+// output is called by the exported log funcs, the caller of those is 2 frames up
+func output(level LEVEL, fields Fields, format string, args ...interface{}) {
 	if dailyRolling {
 		fileCheck()
 	}
 	defer catchError()
-	if logObj != nil {
-		logObj.mu.RLock()
-		defer logObj.mu.RUnlock()
+	if level < minLevel() {
+		return
 	}
-	if logLevel <= FATAL {
-		if logObj != nil {
-			format = "[fatal] " + format
-			logObj.lg.Output(2, fmt.Sprintf(format, args...))
+	var file string
+	var line int
+	if hasModuleLevels() || logFormat == JSON || logSink != nil {
+		_, file, line, _ = runtime.Caller(2)
+		if level < moduleLevel(file) {
+			return
 		}
 	}
+	msg := fmt.Sprintf(format, args...)
+	if logSink != nil {
+		logSink.write(level, file, line, msg, fields)
+		return
+	}
+	if logObj == nil {
+		return
+	}
+	logObj.mu.RLock()
+	defer logObj.mu.RUnlock()
+	if logFormat == JSON {
+		logObj.logfile.Write(jsonRecord(level, file, line, msg, fields))
+		return
+	}
+	logObj.lg.Output(3, "["+levelTags[level]+"] "+msg+fields.text())
 }
 
 func (f *_FILE) isMustRename() bool {
@@ -276,7 +245,7 @@ func (f *_FILE) rename() {
 			t, _ := time.Parse(DATEFORMAT, time.Now().Format(DATEFORMAT))
 			f._date = &t
 			f.logfile, _ = os.Create(f.dir + "/" + f.filename)
-			f.lg = log.New(logObj.logfile, "\n", log.Ldate|log.Ltime|log.Lshortfile)
+			f.lg = log.New(logObj.logfile, "", log.Ldate|log.Ltime|log.Lshortfile)
 		}
 	} else {
 		f.coverNextOne()
@@ -297,7 +266,7 @@ func (f *_FILE) coverNextOne() {
 	}
 	os.Rename(f.dir+"/"+f.filename, f.dir+"/"+f.filename+"."+strconv.Itoa(int(f._suffix)))
 	f.logfile, _ = os.Create(f.dir + "/" + f.filename)
-	f.lg = log.New(logObj.logfile, "\n", log.Ldate|log.Ltime|log.Lshortfile)
+	f.lg = log.New(logObj.logfile, "", log.Ldate|log.Ltime|log.Lshortfile)
 }
 
 func fileSize(file string) int64 {
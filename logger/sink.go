@@ -0,0 +1,149 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a target the records go to instead of the log file
+type sink interface {
+	write(level LEVEL, file string, line int, msg string, fields Fields)
+}
+
+var logSink sink
+
+// SetOutput sends the records to target: file (the rolling file, default),
+// stderr, syslog or journald. tag names the daemon in syslog and journald.
+func SetOutput(target string, tag string) error {
+	switch target {
+	case "", "file":
+		logSink = nil
+	case "stderr":
+		logSink = &streamSink{w: os.Stderr}
+	case "syslog":
+		s, err := newSyslogSink(tag)
+		if err != nil {
+			return err
+		}
+		logSink = s
+	case "journald":
+		conn, err := net.Dial("unixgram", journaldSocket)
+		if err != nil {
+			return err
+		}
+		logSink = &journaldSink{conn: conn, tag: tag}
+	default:
+		return fmt.Errorf("unknown log output %v", target)
+	}
+	return nil
+}
+
+// Configure applies the log options of a daemon: format text or json, output
+// as SetOutput, and modules the levels per module as fs=debug,metanode=info
+func Configure(format string, output string, modules string, tag string) error {
+	switch format {
+	case "", "text":
+		SetFormat(TEXT)
+	case "json":
+		SetFormat(JSON)
+	default:
+		return fmt.Errorf("unknown log format %v", format)
+	}
+	levels, err := ParseModuleLevels(modules)
+	if err != nil {
+		return err
+	}
+	SetModuleLevels(levels)
+	return SetOutput(output, tag)
+}
+
+// ParseModuleLevels the levels per module of modules, as fs=debug,metanode=info
+func ParseModuleLevels(modules string) (map[string]LEVEL, error) {
+	levels := make(map[string]LEVEL)
+	for _, kv := range strings.Split(modules, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("log module %v is not module=level", kv)
+		}
+		l, ok := ParseLevel(kv[i+1:])
+		if !ok {
+			return nil, fmt.Errorf("log module %v has an unknown level", kv)
+		}
+		levels[kv[:i]] = l
+	}
+	return levels, nil
+}
+
+// text or json lines on w
+type streamSink struct {
+	mu sync.Mutex
+	w  *os.File
+}
+
+func (s *streamSink) write(level LEVEL, file string, line int, msg string, fields Fields) {
+	var b []byte
+	if logFormat == JSON {
+		b = jsonRecord(level, file, line, msg, fields)
+	} else {
+		b = []byte(fmt.Sprintf("%v %v:%v [%v] %v%v\n", time.Now().Format("2006/01/02 15:04:05"), shortFile(file), line, levelTags[level], msg, fields.text()))
+	}
+	s.mu.Lock()
+	s.w.Write(b)
+	s.mu.Unlock()
+}
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+var journaldPriority = map[LEVEL]int{DEBUG: 7, INFO: 6, WARN: 4, ERROR: 3, FATAL: 2}
+
+// the native protocol of journald, the fields are journal fields, in upper case
+type journaldSink struct {
+	conn net.Conn
+	tag  string
+}
+
+func (s *journaldSink) write(level LEVEL, file string, line int, msg string, fields Fields) {
+	var b bytes.Buffer
+	journaldField(&b, "MESSAGE", msg)
+	journaldField(&b, "PRIORITY", strconv.Itoa(journaldPriority[level]))
+	journaldField(&b, "SYSLOG_IDENTIFIER", s.tag)
+	journaldField(&b, "CODE_FILE", file)
+	journaldField(&b, "CODE_LINE", strconv.Itoa(line))
+	journaldField(&b, "CFS_MODULE", moduleOf(file))
+	for _, k := range fields.keys() {
+		journaldField(&b, journaldName(k), fmt.Sprint(fieldValue(fields[k])))
+	}
+	s.conn.Write(b.Bytes())
+}
+
+func journaldField(b *bytes.Buffer, name string, value string) {
+	if !strings.Contains(value, "\n") {
+		b.WriteString(name + "=" + value + "\n")
+		return
+	}
+	// a value with newlines goes with its length
+	b.WriteString(name + "\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
+
+// journaldName key as a journal field name: upper case letters, digits and _
+func journaldName(key string) string {
+	name := []byte(strings.ToUpper(key))
+	for i, c := range name {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			name[i] = '_'
+		}
+	}
+	return "CFS_" + string(name)
+}
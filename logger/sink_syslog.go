@@ -0,0 +1,43 @@
+//go:build !windows
+// +build !windows
+
+package logger
+
+import (
+	"bytes"
+	"log/syslog"
+	"strconv"
+)
+
+func newSyslogSink(tag string) (sink, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w: w}, nil
+}
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func (s *syslogSink) write(level LEVEL, file string, line int, msg string, fields Fields) {
+	var m string
+	if logFormat == JSON {
+		m = string(bytes.TrimRight(jsonRecord(level, file, line, msg, fields), "\n"))
+	} else {
+		m = shortFile(file) + ":" + strconv.Itoa(line) + " " + msg + fields.text()
+	}
+	switch level {
+	case DEBUG:
+		s.w.Debug(m)
+	case INFO:
+		s.w.Info(m)
+	case WARN:
+		s.w.Warning(m)
+	case ERROR:
+		s.w.Err(m)
+	default:
+		s.w.Crit(m)
+	}
+}
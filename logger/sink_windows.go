@@ -0,0 +1,10 @@
+package logger
+
+import (
+	"errors"
+)
+
+// no syslog on windows, the records go to a file or stderr
+func newSyslogSink(tag string) (sink, error) {
+	return nil, errors.New("no syslog on windows")
+}
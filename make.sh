@@ -7,23 +7,29 @@ else
   rm -rf ./output/*
 fi
 
-for dir in ./proto/mp ./proto/dp ./proto/vp ./proto/rp  ./proto/kvp
+for dir in ./proto/mp ./proto/dp ./proto/vp ./proto/rp  ./proto/kvp ./proto/fp
 do
   pushd $dir
   make
   popd
 done
 
-for dir in client fuseclient metanode datanode volmgr repair 
+for dir in client fuseclient metanode datanode volmgr repair georep fileapi sync snapshotter adminapi
 do
   pushd $dir
   go get
-  go build -o cfs-$dir main.go
+  go build -o cfs-$dir .
   cp cfs-$dir cfs-$dir.ini ../output
   rm -rf cfs-$dir
   popd
 done
 
+cd ./mountcfs
+  go get
+  go build -o mount.cfs main.go
+  mv mount.cfs ../output
+cd ..
+
 #cd ./fuseclient_flag
 #  go get
 #  go build -o cfs-fuseclient_flag main.go
@@ -36,9 +42,15 @@ cd ./client_flag
   mv cfs-client_flag ../output
 cd ..
 
+cd ./libcfs/cbind
+  go get
+  go build -buildmode=c-shared -o libcfs.so main.go
+  mv libcfs.so libcfs.h ../../output
+cd ../..
+
 cp ./service/* ./output
 cd ./output
-tar zcvf cfs-server.tar.gz ./cfs-repair* ./cfs-metanode* ./cfs-volmgr* ./cfs-datanode*  ./install.sh
-tar zcvf cfs-client.tar.gz ./cfs-client* ./cfs-fuseclient*
+tar zcvf cfs-server.tar.gz ./cfs-repair* ./cfs-metanode* ./cfs-volmgr* ./cfs-datanode* ./cfs-adminapi* ./install.sh
+tar zcvf cfs-client.tar.gz ./cfs-client* ./cfs-fuseclient* ./mount.cfs ./cfs-georep* ./cfs-sync* ./cfs-snapshotter* ./cfs-fileapi* ./libcfs.so ./libcfs.h
 
 echo "------------- build end -------------"
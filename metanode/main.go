@@ -6,18 +6,22 @@ import (
 	ns "github.com/ipdcode/containerfs/metanode/namespace"
 	"github.com/ipdcode/containerfs/metanode/raftopt"
 	mp "github.com/ipdcode/containerfs/proto/mp"
+	"github.com/ipdcode/containerfs/utils" // also registers the gzip and snappy compressors of the rpcs
 	"github.com/ipdcode/raft"
 	"github.com/ipdcode/raft/proto"
 	"github.com/lxmgo/config"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/reflection"
 	"net"
-	"net/http"
-	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"reflect"
 	"runtime"
 	"strconv"
+	"syscall"
 	"time"
 )
 
@@ -28,6 +32,7 @@ type addr struct {
 	ips    []string
 	waldir string
 	log    string
+	debug  string // pprof and stats
 }
 
 // MetaNodeServerAddr ...
@@ -49,6 +54,10 @@ func (s *MetaNodeServer) GetMetaLeader(ctx context.Context, in *mp.GetMetaLeader
 		ack.Ret = ret
 		return &ack, nil
 	}
+	if to := nameSpace.MovedTo(); to != "" {
+		// migrated, ask the metanodes serving it now
+		return movedMetaLeader(to, in)
+	}
 	leaderID, _ := s.RaftServer.LeaderTerm(nameSpace.RaftGroupID)
 	if leaderID <= 0 {
 		ack.Ret = 1
@@ -59,6 +68,285 @@ func (s *MetaNodeServer) GetMetaLeader(ctx context.Context, in *mp.GetMetaLeader
 	return &ack, nil
 }
 
+// movedMetaLeader the leader of a volume at the metadomain it migrated to
+func movedMetaLeader(metadomain string, in *mp.GetMetaLeaderReq) (*mp.GetMetaLeaderAck, error) {
+	conn, err := grpc.Dial(metadomain, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Millisecond*300), grpc.FailOnNonTempDialError(true))
+	if err != nil {
+		logger.Error("GetMetaLeader of moved volume:%v, dial %v err:%v", in.VolID, metadomain, err)
+		return &mp.GetMetaLeaderAck{Ret: 1}, nil
+	}
+	defer conn.Close()
+	mc := mp.NewMetaNodeClient(conn)
+	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	ack, err := mc.GetMetaLeader(ctx, in)
+	if err != nil {
+		return &mp.GetMetaLeaderAck{Ret: 1}, nil
+	}
+	return ack, nil
+}
+
+// WatchLeader : sends the current leader of the volume, then each new one as raft elects it
+func (s *MetaNodeServer) WatchLeader(in *mp.WatchLeaderReq, stream mp.MetaNode_WatchLeaderServer) error {
+	ret, nameSpace := ns.GetNameSpace(in.VolID)
+	if ret != 0 {
+		return stream.Send(&mp.WatchLeaderAck{Ret: ret})
+	}
+
+	ch, cancel := nameSpace.RaftGroup.WatchLeader()
+	defer cancel()
+
+	leaderID, _ := s.RaftServer.LeaderTerm(nameSpace.RaftGroupID)
+	for {
+		ack := mp.WatchLeaderAck{}
+		if addr, ok := raftopt.AddrDatabase[leaderID]; ok && leaderID > 0 {
+			ack.Leader = addr.Grpc
+		} else {
+			ack.Ret = 1 // no leader now, the next one follows
+		}
+		if err := stream.Send(&ack); err != nil {
+			return err
+		}
+
+		select {
+		case leaderID = <-ch:
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// WatchChanges : streams the namespace changes of the volume made through this leader,
+// the stream ends when leadership moves or the watcher falls behind
+func (s *MetaNodeServer) WatchChanges(in *mp.WatchChangesReq, stream mp.MetaNode_WatchChangesServer) error {
+	ret, nameSpace := ns.GetNameSpaceLeader(in.VolID)
+	if ret != 0 {
+		return stream.Send(&mp.WatchChangesAck{Ret: ret})
+	}
+
+	ch, cancel := nameSpace.WatchChanges()
+	defer cancel()
+
+	// after WatchChanges, so no dir made meanwhile is missed
+	var filter *ns.SubtreeFilter
+	if in.Subtree != 0 || in.Direct {
+		filter = nameSpace.NewSubtreeFilter(in.Subtree, in.Direct)
+	}
+
+	leaderCh, cancelLeader := nameSpace.RaftGroup.WatchLeader()
+	defer cancelLeader()
+
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if filter != nil && !filter.Match(ev) {
+				continue
+			}
+			if err := stream.Send(&mp.WatchChangesAck{Event: ev}); err != nil {
+				return err
+			}
+		case <-leaderCh:
+			return nil
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// CloseWrite ...
+func (s *MetaNodeServer) CloseWrite(ctx context.Context, in *mp.CloseWriteReq) (*mp.CloseWriteAck, error) {
+	ack := mp.CloseWriteAck{}
+	ret, nameSpace := ns.GetShardLeader(in.VolID, in.PInode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.CloseWrite(in.PInode, in.Name, in.Inode)
+	return &ack, nil
+}
+
+// AcquireLease : waits until the conflicting leases are given back or taken away
+func (s *MetaNodeServer) AcquireLease(ctx context.Context, in *mp.AcquireLeaseReq) (*mp.AcquireLeaseAck, error) {
+	ack := mp.AcquireLeaseAck{}
+	ret, nameSpace := ns.GetNameSpaceLeader(in.VolID)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.AcquireLease(in.Inode, in.ClientID, in.Write)
+	return &ack, nil
+}
+
+// ReleaseLease ...
+func (s *MetaNodeServer) ReleaseLease(ctx context.Context, in *mp.ReleaseLeaseReq) (*mp.ReleaseLeaseAck, error) {
+	ack := mp.ReleaseLeaseAck{}
+	ret, nameSpace := ns.GetNameSpaceLeader(in.VolID)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.ReleaseLease(in.Inode, in.ClientID)
+	return &ack, nil
+}
+
+// WatchLeases : streams the leases the client must give back, the stream ends when leadership moves
+func (s *MetaNodeServer) WatchLeases(in *mp.WatchLeasesReq, stream mp.MetaNode_WatchLeasesServer) error {
+	ret, nameSpace := ns.GetNameSpaceLeader(in.VolID)
+	if ret != 0 {
+		return stream.Send(&mp.WatchLeasesAck{Ret: ret})
+	}
+
+	ch, cancel := nameSpace.WatchLeases(in.ClientID)
+	defer cancel()
+
+	leaderCh, cancelLeader := nameSpace.RaftGroup.WatchLeader()
+	defer cancelLeader()
+
+	for {
+		select {
+		case inode := <-ch:
+			if err := stream.Send(&mp.WatchLeasesAck{Inode: inode}); err != nil {
+				return err
+			}
+		case <-leaderCh:
+			return nil
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// OpenSession ...
+func (s *MetaNodeServer) OpenSession(ctx context.Context, in *mp.OpenSessionReq) (*mp.OpenSessionAck, error) {
+	ack := mp.OpenSessionAck{}
+	ret, nameSpace := ns.GetNameSpaceLeader(in.VolID)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.OpenSession(in.Session)
+	ack.TTL = int64(ns.SessionTTL.Get() / time.Second)
+	return &ack, nil
+}
+
+// SessionHeartbeat ...
+func (s *MetaNodeServer) SessionHeartbeat(ctx context.Context, in *mp.SessionHeartbeatReq) (*mp.SessionHeartbeatAck, error) {
+	ack := mp.SessionHeartbeatAck{}
+	ret, nameSpace := ns.GetNameSpaceLeader(in.VolID)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.SessionHeartbeat(in.ClientID, in.Opens)
+	return &ack, nil
+}
+
+// CloseSession : a client unmounting, or an admin revoking its session
+func (s *MetaNodeServer) CloseSession(ctx context.Context, in *mp.CloseSessionReq) (*mp.CloseSessionAck, error) {
+	ack := mp.CloseSessionAck{}
+	ret, nameSpace := ns.GetNameSpaceLeader(in.VolID)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.CloseSession(in.ClientID, in.Revoke)
+	return &ack, nil
+}
+
+// ListSessions ...
+func (s *MetaNodeServer) ListSessions(ctx context.Context, in *mp.ListSessionsReq) (*mp.ListSessionsAck, error) {
+	ack := mp.ListSessionsAck{}
+	ret, nameSpace := ns.GetNameSpaceLeader(in.VolID)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Sessions = nameSpace.ListSessions()
+	return &ack, nil
+}
+
+// Fence : evicts a client from the volume, or fences off all of them
+func (s *MetaNodeServer) Fence(ctx context.Context, in *mp.FenceReq) (*mp.FenceAck, error) {
+	ack := mp.FenceAck{}
+	ret, nameSpace := ns.GetNameSpaceLeader(in.VolID)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.Fence(in.ClientID, in.Fenced)
+	return &ack, nil
+}
+
+// SetAccessMode : the access mode of the namespace, from volmgr
+func (s *MetaNodeServer) SetAccessMode(ctx context.Context, in *mp.SetAccessModeReq) (*mp.SetAccessModeAck, error) {
+	ack := mp.SetAccessModeAck{}
+	ret, nameSpace := ns.GetNameSpaceLeader(in.VolID)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.SetAccessMode(in.AccessMode)
+	return &ack, nil
+}
+
+// SetReplica : the namespace is a geo-replication replica, from volmgr
+func (s *MetaNodeServer) SetReplica(ctx context.Context, in *mp.SetReplicaReq) (*mp.SetReplicaAck, error) {
+	ack := mp.SetReplicaAck{}
+	ret, nameSpace := ns.GetNameSpaceLeader(in.VolID)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.SetReplica(in.Replica)
+	return &ack, nil
+}
+
+// SetCapacityLimits : the soft and hard capacity limits of the namespace, from volmgr
+func (s *MetaNodeServer) SetCapacityLimits(ctx context.Context, in *mp.SetCapacityLimitsReq) (*mp.SetCapacityLimitsAck, error) {
+	ack := mp.SetCapacityLimitsAck{}
+	ret, nameSpace := ns.GetNameSpaceLeader(in.VolID)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.SetCapacityLimits(in.Soft, in.Hard)
+	return &ack, nil
+}
+
+// clientWrites the ops only the clients send, refused without a client id: a
+// client fenced off must not get around it by leaving the id out. They are refused
+// too under the access mode of the volume, see ns.AdmitsWrite.
+var clientWrites = map[string]bool{
+	"/mp.MetaNode/AllocateChunk": true,
+	"/mp.MetaNode/SyncChunk":     true,
+	"/mp.MetaNode/CommitAppend":  true,
+	"/mp.MetaNode/WriteInline":   true,
+}
+
+// fence refuses the ops of the clients evicted from the namespace of the request,
+// and of all of them while it is fenced
+func fence(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md[utils.ClientIDMetadata]) == 0 {
+		if clientWrites[info.FullMethod] {
+			return nil, grpc.Errorf(codes.PermissionDenied, "%v without a client id", info.FullMethod)
+		}
+		return handler(ctx, req)
+	}
+	volID := reflect.Indirect(reflect.ValueOf(req)).FieldByName("VolID")
+	if !volID.IsValid() || volID.Kind() != reflect.String {
+		return handler(ctx, req)
+	}
+	if clientID := md[utils.ClientIDMetadata][0]; !ns.Admits(volID.String(), clientID) {
+		return nil, grpc.Errorf(codes.PermissionDenied, "client %v fenced off %v", clientID, volID.String())
+	} else if clientWrites[info.FullMethod] && !ns.AdmitsWrite(volID.String(), clientID) {
+		return nil, grpc.Errorf(codes.PermissionDenied, "client %v may not write %v", clientID, volID.String())
+	}
+	return handler(ctx, req)
+}
+
 //CreateNameSpace ...
 func (s *MetaNodeServer) CreateNameSpace(ctx context.Context, in *mp.CreateNameSpaceReq) (*mp.CreateNameSpaceAck, error) {
 	ack := mp.CreateNameSpaceAck{}
@@ -100,16 +388,109 @@ func (s *MetaNodeServer) ExpandNameSpace(ctx context.Context, in *mp.ExpandNameS
 
 	ack := mp.ExpandNameSpaceAck{}
 
-	ret, nameSpace := ns.GetNameSpace(in.VolID)
+	ret, nameSpace := ns.GetNameSpaceWriter(in.VolID)
 	if ret != 0 {
 		ack.Ret = ret
 		return &ack, nil
 	}
 	ack.Ret = nameSpace.ExpandNameSpace(in.BlockGroups)
+	if ack.Ret == 0 {
+		// every shard allocates chunks in the block groups of the volume
+		ack.Ret = s.toShards(in.VolID, func(mc mp.MetaNodeClient, id string) int32 {
+			ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+			a, err := mc.ExpandNameSpace(ctx, &mp.ExpandNameSpaceReq{VolID: id, BlockGroups: in.BlockGroups})
+			if err != nil {
+				return 1
+			}
+			return a.Ret
+		})
+	}
 
 	return &ack, nil
 }
 
+// toShards runs send for each other shard of the volume on the metanode leading it,
+// send passes the id of the shard as VolID
+func (s *MetaNodeServer) toShards(volID string, send func(mc mp.MetaNodeClient, id string) int32) int32 {
+	for _, id := range ns.ShardsOf(volID)[1:] {
+		if ret := s.onShard(id, send); ret != 0 {
+			return ret
+		}
+	}
+	return 0
+}
+
+// onShard runs send on the metanode leading the shard id, a shard not loaded here
+// is skipped
+func (s *MetaNodeServer) onShard(id string, send func(mc mp.MetaNodeClient, id string) int32) int32 {
+	ret, nameSpace := ns.GetNameSpace(id)
+	if ret != 0 {
+		return 0
+	}
+	leaderID, _ := s.RaftServer.LeaderTerm(nameSpace.RaftGroupID)
+	addr, ok := raftopt.AddrDatabase[leaderID]
+	if leaderID <= 0 || !ok {
+		logger.Error("no leader for shard:%v", id)
+		return 1
+	}
+	conn, err := grpc.Dial(addr.Grpc, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Millisecond*300), grpc.FailOnNonTempDialError(true))
+	if err != nil {
+		logger.Error("dial leader %v of shard:%v err:%v", addr.Grpc, id, err)
+		return 1
+	}
+	defer conn.Close()
+	return send(mp.NewMetaNodeClient(conn), id)
+}
+
+// shardDirEmpty : ns.ShardDirEmpty, lists one entry of the dir on its shard
+func (s *MetaNodeServer) shardDirEmpty(id string, inode uint64) int32 {
+	empty := false
+	ret := s.onShard(id, func(mc mp.MetaNodeClient, id string) int32 {
+		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+		a, err := mc.ListDirect(ctx, &mp.ListDirectReq{VolID: id, PInode: inode, Limit: 1})
+		if err != nil {
+			return 1
+		}
+		empty = a.Ret == 0 && len(a.Dirents) == 0
+		return a.Ret
+	})
+	if ret == 0 && !empty {
+		return 39 /*ENOTEMPTY*/
+	}
+	return ret
+}
+
+// shardChargeBlockGroup : ns.ShardChargeBlockGroup
+func (s *MetaNodeServer) shardChargeBlockGroup(volID string, blockGroupID uint32, delta int64) (int32, *mp.BlockGroup) {
+	var bg *mp.BlockGroup
+	ret := s.onShard(volID, func(mc mp.MetaNodeClient, id string) int32 {
+		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+		a, err := mc.ChargeBlockGroup(ctx, &mp.ChargeBlockGroupReq{VolID: id, BlockGroupID: blockGroupID, Delta: delta})
+		if err != nil {
+			return 1
+		}
+		bg = a.BlockGroup
+		return a.Ret
+	})
+	if ret == 0 && bg == nil {
+		// the first shard is not loaded here
+		return 1, nil
+	}
+	return ret, bg
+}
+
+// ChargeBlockGroup : served by the first shard of a volume for the others
+func (s *MetaNodeServer) ChargeBlockGroup(ctx context.Context, in *mp.ChargeBlockGroupReq) (*mp.ChargeBlockGroupAck, error) {
+	ack := mp.ChargeBlockGroupAck{}
+	ret, nameSpace := ns.GetNameSpaceWriter(in.VolID)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret, ack.BlockGroup = nameSpace.ChargeBlockGroup(in.BlockGroupID, in.Delta)
+	return &ack, nil
+}
+
 // SnapShootNameSpace ...
 func (s *MetaNodeServer) SnapShootNameSpace(ctx context.Context, in *mp.SnapShootNameSpaceReq) (*mp.SnapShootNameSpaceAck, error) {
 	ack := mp.SnapShootNameSpaceAck{}
@@ -182,11 +563,112 @@ func (s *MetaNodeServer) DeleteNameSpace(ctx context.Context, in *mp.DeleteNameS
 	return &ack, nil
 }
 
+// dumpMetaBatch records sent per DumpMetaAck
+const dumpMetaBatch = 1024
+
+// DumpMeta : streams a full or incremental dump of the namespace, the first ack
+// is the header, a Ret other than 0 ends the stream
+func (s *MetaNodeServer) DumpMeta(in *mp.DumpMetaReq, stream mp.MetaNode_DumpMetaServer) error {
+	ret, nameSpace := ns.GetNameSpaceLeader(in.VolID)
+	if ret != 0 {
+		return stream.Send(&mp.DumpMetaAck{Ret: ret})
+	}
+	var records []*mp.MetaRecord
+	ret = nameSpace.Dump(in.Since, func(applied uint64, chunkID uint64, inodeID uint64) error {
+		return stream.Send(&mp.DumpMetaAck{Since: in.Since, Applied: applied, ChunkID: chunkID, InodeID: inodeID})
+	}, func(r *mp.MetaRecord) error {
+		records = append(records, r)
+		if len(records) < dumpMetaBatch {
+			return nil
+		}
+		err := stream.Send(&mp.DumpMetaAck{Records: records})
+		records = nil
+		return err
+	})
+	if ret != 0 {
+		return stream.Send(&mp.DumpMetaAck{Ret: ret})
+	}
+	if len(records) > 0 {
+		return stream.Send(&mp.DumpMetaAck{Records: records})
+	}
+	return nil
+}
+
+// FreezeNameSpace : makes the namespace read-only for the cutover of a migration, or thaws it
+func (s *MetaNodeServer) FreezeNameSpace(ctx context.Context, in *mp.FreezeNameSpaceReq) (*mp.FreezeNameSpaceAck, error) {
+	ack := mp.FreezeNameSpaceAck{}
+	// not GetNameSpaceLeader, a volume marked moved can still be thawed
+	ret, nameSpace := ns.GetNameSpace(in.VolID)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	if !nameSpace.RaftGroup.IsLeader(nameSpace.RaftGroupID) {
+		ack.Ret = utils.NotLeader
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.Freeze(in.Frozen, in.MovedTo)
+	return &ack, nil
+}
+
+// GetShards : the shard map of the volume, empty when it is not sharded
+func (s *MetaNodeServer) GetShards(ctx context.Context, in *mp.GetShardsReq) (*mp.GetShardsAck, error) {
+	ack := mp.GetShardsAck{}
+	ret, nameSpace := ns.GetNameSpaceLeader(in.VolID)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Map = nameSpace.Shards().String()
+	return &ack, nil
+}
+
+// SetShards : stores a new shard map in a shard, served while it is frozen for a split
+func (s *MetaNodeServer) SetShards(ctx context.Context, in *mp.SetShardsReq) (*mp.SetShardsAck, error) {
+	ack := mp.SetShardsAck{}
+	m, err := utils.ParseShardMap(in.Map)
+	if err != nil {
+		ack.Ret = 22 /*EINVAL*/
+		return &ack, nil
+	}
+	ret, nameSpace := ns.GetNameSpaceLeader(in.VolID)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.SetShards(m, in.Fresh)
+	return &ack, nil
+}
+
+// ShardInfo : the load of a shard and where to split it
+func (s *MetaNodeServer) ShardInfo(ctx context.Context, in *mp.ShardInfoReq) (*mp.ShardInfoAck, error) {
+	ack := mp.ShardInfoAck{}
+	ret, nameSpace := ns.GetNameSpaceLeader(in.VolID)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret, ack.Ops, ack.Dirs, ack.SplitStart, ack.SplitEnd = nameSpace.ShardInfo()
+	return &ack, nil
+}
+
+// RestoreMeta : replays a batch of dumped records
+func (s *MetaNodeServer) RestoreMeta(ctx context.Context, in *mp.RestoreMetaReq) (*mp.RestoreMetaAck, error) {
+	ack := mp.RestoreMetaAck{}
+	ret, nameSpace := ns.GetNameSpaceLeader(in.VolID)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.Restore(in.Full, in.ChunkID, in.InodeID, in.Records)
+	return &ack, nil
+}
+
 //GetFSInfo ...
 func (s *MetaNodeServer) GetFSInfo(ctx context.Context, in *mp.GetFSInfoReq) (*mp.GetFSInfoAck, error) {
 	ack := mp.GetFSInfoAck{}
 
-	ret, nameSpace := ns.GetNameSpace(in.VolID)
+	ret, nameSpace := ns.GetNameSpaceLeader(in.VolID)
 	if ret != 0 {
 		ack.Ret = ret
 		return &ack, nil
@@ -199,19 +681,19 @@ func (s *MetaNodeServer) GetFSInfo(ctx context.Context, in *mp.GetFSInfoReq) (*m
 //CreateDirDirect ...
 func (s *MetaNodeServer) CreateDirDirect(ctx context.Context, in *mp.CreateDirDirectReq) (*mp.CreateDirDirectAck, error) {
 	ack := mp.CreateDirDirectAck{}
-	ret, nameSpace := ns.GetNameSpace(in.VolID)
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.PInode)
 	if ret != 0 {
 		ack.Ret = ret
 		return &ack, nil
 	}
-	ack.Ret, ack.Inode = nameSpace.CreateDirDirect(in.PInode, in.Name)
+	ack.Ret, ack.Inode, ack.InodeInfo = nameSpace.CreateDirDirect(in.PInode, in.Name, in.Uid, in.Gid, in.Mode)
 	return &ack, nil
 }
 
 //GetInodeInfoDirect ...
 func (s *MetaNodeServer) GetInodeInfoDirect(ctx context.Context, in *mp.GetInodeInfoDirectReq) (*mp.GetInodeInfoDirectAck, error) {
 	ack := mp.GetInodeInfoDirectAck{}
-	ret, nameSpace := ns.GetNameSpace(in.VolID)
+	ret, nameSpace := ns.GetShardLeader(in.VolID, in.PInode)
 	if ret != 0 {
 		ack.Ret = ret
 		return &ack, nil
@@ -223,12 +705,39 @@ func (s *MetaNodeServer) GetInodeInfoDirect(ctx context.Context, in *mp.GetInode
 //StatDirect ...
 func (s *MetaNodeServer) StatDirect(ctx context.Context, in *mp.StatDirectReq) (*mp.StatDirectAck, error) {
 	ack := mp.StatDirectAck{}
-	ret, nameSpace := ns.GetNameSpace(in.VolID)
+	ret, nameSpace := ns.GetShardLeader(in.VolID, in.PInode)
 	if ret != 0 {
 		ack.Ret = ret
 		return &ack, nil
 	}
 	ack.InodeType, ack.Inode, ack.Ret = nameSpace.StatDirect(in.PInode, in.Name)
+	if ack.Ret == 0 {
+		ack.Generation = nameSpace.Generation(ack.Inode)
+	}
+	return &ack, nil
+}
+
+//DirUsage ...
+func (s *MetaNodeServer) DirUsage(ctx context.Context, in *mp.DirUsageReq) (*mp.DirUsageAck, error) {
+	ack := mp.DirUsageAck{}
+	ret, nameSpace := ns.GetShardLeader(in.VolID, in.Inode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret, ack.Bytes, ack.Files, ack.Dirs = nameSpace.Usage(in.Inode)
+	return &ack, nil
+}
+
+// GetDirAttr ...
+func (s *MetaNodeServer) GetDirAttr(ctx context.Context, in *mp.GetDirAttrReq) (*mp.GetDirAttrAck, error) {
+	ack := mp.GetDirAttrAck{}
+	ret, nameSpace := ns.GetShardLeader(in.VolID, in.Inode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret, ack.InodeInfo, ack.Subdirs = nameSpace.GetDirAttr(in.Inode)
 	return &ack, nil
 }
 
@@ -236,12 +745,33 @@ func (s *MetaNodeServer) StatDirect(ctx context.Context, in *mp.StatDirectReq) (
 func (s *MetaNodeServer) ListDirect(ctx context.Context, in *mp.ListDirectReq) (*mp.ListDirectAck, error) {
 	ack := mp.ListDirectAck{}
 
-	ret, nameSpace := ns.GetNameSpace(in.VolID)
+	ret, nameSpace := ns.GetShardLeader(in.VolID, in.PInode)
 	if ret != 0 {
 		ack.Ret = ret
 		return &ack, nil
 	}
-	ack.Dirents, ack.Ret = nameSpace.ListDirect(in.PInode)
+	ack.Dirents, ack.NextMarker, ack.Ret = nameSpace.ListDirectPage(in.PInode, in.Marker, int(in.Limit))
+	return &ack, nil
+}
+
+// ListWithAttrs ...
+func (s *MetaNodeServer) ListWithAttrs(ctx context.Context, in *mp.ListWithAttrsReq) (*mp.ListWithAttrsAck, error) {
+	ack := mp.ListWithAttrsAck{}
+
+	ret, nameSpace := ns.GetShardLeader(in.VolID, in.PInode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	var infos []*mp.InodeInfo
+	ack.Dirents, infos, ack.NextMarker, ack.Ret = nameSpace.ListWithAttrs(in.PInode, in.Marker, int(in.Limit))
+	for _, v := range infos {
+		// repeated fields cannot hold nil
+		if v == nil {
+			v = &mp.InodeInfo{}
+		}
+		ack.InodeInfos = append(ack.InodeInfos, v)
+	}
 	return &ack, nil
 }
 
@@ -250,7 +780,7 @@ func (s *MetaNodeServer) DeleteDirDirect(ctx context.Context, in *mp.DeleteDirDi
 
 	ack := mp.DeleteDirDirectAck{}
 
-	ret, nameSpace := ns.GetNameSpace(in.VolID)
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.PInode)
 	if ret != 0 {
 		ack.Ret = ret
 		return &ack, nil
@@ -264,24 +794,36 @@ func (s *MetaNodeServer) DeleteDirDirect(ctx context.Context, in *mp.DeleteDirDi
 func (s *MetaNodeServer) RenameDirect(ctx context.Context, in *mp.RenameDirectReq) (*mp.RenameDirectAck, error) {
 	ack := mp.RenameDirectAck{}
 
-	ret, nameSpace := ns.GetNameSpace(in.VolID)
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.OldPInode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.RenameDirect(in.OldPInode, in.OldName, in.NewPInode, in.NewName, in.NoReplace)
+	return &ack, nil
+}
+
+// ReclaimInode ...
+func (s *MetaNodeServer) ReclaimInode(ctx context.Context, in *mp.ReclaimInodeReq) (*mp.ReclaimInodeAck, error) {
+	ack := mp.ReclaimInodeAck{}
+	ret, nameSpace := ns.GetNameSpaceWriter(in.VolID)
 	if ret != 0 {
 		ack.Ret = ret
 		return &ack, nil
 	}
-	ack.Ret = nameSpace.RenameDirect(in.OldPInode, in.OldName, in.NewPInode, in.NewName)
+	ack.Ret = nameSpace.ReclaimInode(in.Inode)
 	return &ack, nil
 }
 
 //CreateFileDirect ...
 func (s *MetaNodeServer) CreateFileDirect(ctx context.Context, in *mp.CreateFileDirectReq) (*mp.CreateFileDirectAck, error) {
 	ack := mp.CreateFileDirectAck{}
-	ret, nameSpace := ns.GetNameSpace(in.VolID)
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.PInode)
 	if ret != 0 {
 		ack.Ret = ret
 		return &ack, nil
 	}
-	ack.Ret, ack.Inode = nameSpace.CreateFileDirect(in.PInode, in.Name)
+	ack.Ret, ack.Inode, ack.InodeInfo = nameSpace.CreateFileDirect(in.PInode, in.Name, in.Uid, in.Gid, in.Mode)
 	return &ack, nil
 }
 
@@ -290,7 +832,7 @@ func (s *MetaNodeServer) DeleteFileDirect(ctx context.Context, in *mp.DeleteFile
 
 	ack := mp.DeleteFileDirectAck{}
 
-	ret, nameSpace := ns.GetNameSpace(in.VolID)
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.PInode)
 	if ret != 0 {
 		ack.Ret = ret
 		return &ack, nil
@@ -300,11 +842,147 @@ func (s *MetaNodeServer) DeleteFileDirect(ctx context.Context, in *mp.DeleteFile
 
 }
 
+// BatchCreate ...
+func (s *MetaNodeServer) BatchCreate(ctx context.Context, in *mp.BatchCreateReq) (*mp.BatchCreateAck, error) {
+	ack := mp.BatchCreateAck{}
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.PInode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret, ack.Results = nameSpace.BatchCreate(in.PInode, in.Entries)
+	return &ack, nil
+}
+
+// BatchStat ...
+func (s *MetaNodeServer) BatchStat(ctx context.Context, in *mp.BatchStatReq) (*mp.BatchStatAck, error) {
+	ack := mp.BatchStatAck{}
+	ret, nameSpace := ns.GetShardLeader(in.VolID, in.PInode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret, ack.Results = nameSpace.BatchStat(in.PInode, in.Names)
+	return &ack, nil
+}
+
+// BatchUnlink ...
+func (s *MetaNodeServer) BatchUnlink(ctx context.Context, in *mp.BatchUnlinkReq) (*mp.BatchUnlinkAck, error) {
+	ack := mp.BatchUnlinkAck{}
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.PInode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret, ack.Rets = nameSpace.BatchUnlink(in.PInode, in.Names)
+	return &ack, nil
+}
+
+// TrashFile ...
+func (s *MetaNodeServer) TrashFile(ctx context.Context, in *mp.TrashFileReq) (*mp.TrashFileAck, error) {
+	ack := mp.TrashFileAck{}
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.PInode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret, ack.Trashed = nameSpace.TrashFile(in.PInode, in.Name)
+	return &ack, nil
+}
+
+// OrphanFile ...
+func (s *MetaNodeServer) OrphanFile(ctx context.Context, in *mp.OrphanFileReq) (*mp.OrphanFileAck, error) {
+	ack := mp.OrphanFileAck{}
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.PInode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret, ack.Orphaned = nameSpace.OrphanFile(in.PInode, in.Name, in.ClientID)
+	return &ack, nil
+}
+
+// CloseOrphan ...
+func (s *MetaNodeServer) CloseOrphan(ctx context.Context, in *mp.CloseOrphanReq) (*mp.CloseOrphanAck, error) {
+	ack := mp.CloseOrphanAck{}
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.PInode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.CloseOrphan(in.Inode, in.ClientID)
+	return &ack, nil
+}
+
+// ReportOpens : the files a client has open, kept while it unlinks them
+func (s *MetaNodeServer) ReportOpens(ctx context.Context, in *mp.ReportOpensReq) (*mp.ReportOpensAck, error) {
+	ack := mp.ReportOpensAck{}
+	ret, nameSpace := ns.GetNameSpaceLeader(in.VolID)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.ReportOpens(in.ClientID, in.Inodes, in.Add)
+	return &ack, nil
+}
+
+// RestoreTrash : the entry is in the trash of the first shard or of another one
+func (s *MetaNodeServer) RestoreTrash(ctx context.Context, in *mp.RestoreTrashReq) (*mp.RestoreTrashAck, error) {
+	ack := mp.RestoreTrashAck{}
+	ret, nameSpace := ns.GetNameSpaceWriter(in.VolID)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.RestoreTrash(in.Date, in.Name)
+	for _, id := range ns.ShardsOf(in.VolID)[1:] {
+		if ack.Ret != 2 /*ENOENT*/ {
+			break
+		}
+		s.onShard(id, func(mc mp.MetaNodeClient, id string) int32 {
+			req := *in
+			req.VolID = id
+			ctx, _ := context.WithTimeout(context.Background(), 60*time.Second)
+			a, err := mc.RestoreTrash(ctx, &req)
+			if err != nil {
+				return 1
+			}
+			ack.Ret = a.Ret
+			return a.Ret
+		})
+	}
+	return &ack, nil
+}
+
+// PurgeTrash ...
+func (s *MetaNodeServer) PurgeTrash(ctx context.Context, in *mp.PurgeTrashReq) (*mp.PurgeTrashAck, error) {
+	ack := mp.PurgeTrashAck{}
+	ret, nameSpace := ns.GetNameSpaceWriter(in.VolID)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.PurgeTrash(in.Date)
+	if ack.Ret == 0 {
+		ack.Ret = s.toShards(in.VolID, func(mc mp.MetaNodeClient, id string) int32 {
+			req := *in
+			req.VolID = id
+			ctx, _ := context.WithTimeout(context.Background(), 60*time.Second)
+			a, err := mc.PurgeTrash(ctx, &req)
+			if err != nil {
+				return 1
+			}
+			return a.Ret
+		})
+	}
+	return &ack, nil
+}
+
 // GetFileChunksDirect ...
 func (s *MetaNodeServer) GetFileChunksDirect(ctx context.Context, in *mp.GetFileChunksDirectReq) (*mp.GetFileChunksDirectAck, error) {
 	ack := mp.GetFileChunksDirectAck{}
 
-	ret, nameSpace := ns.GetNameSpace(in.VolID)
+	ret, nameSpace := ns.GetShardLeader(in.VolID, in.PInode)
 	if ret != 0 {
 		ack.Ret = ret
 		return &ack, nil
@@ -330,24 +1008,211 @@ func (s *MetaNodeServer) GetFileChunksDirect(ctx context.Context, in *mp.GetFile
 
 	}
 
+	if len(chunkInfos) == 0 {
+		// small files keep their data inline in the inode
+		if ret, inodeInfo, _ := nameSpace.GetInodeInfoDirect(in.PInode, in.Name); ret == 0 {
+			ack.InlineData = inodeInfo.InlineData
+		}
+	}
+
 	ack.Ret = 0
 	ack.Inode = inode
 
 	return &ack, nil
 }
 
+// WriteInline ...
+func (s *MetaNodeServer) WriteInline(ctx context.Context, in *mp.WriteInlineReq) (*mp.WriteInlineAck, error) {
+	ack := mp.WriteInlineAck{}
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.PInode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.WriteInline(in.PInode, in.Name, in.Data)
+	return &ack, nil
+}
+
+// SetAccessTimes ...
+func (s *MetaNodeServer) SetAccessTimes(ctx context.Context, in *mp.SetAccessTimesReq) (*mp.SetAccessTimesAck, error) {
+	ack := mp.SetAccessTimesAck{}
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.PInode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.SetAccessTimes(in.PInode, in.Names, in.Times)
+	return &ack, nil
+}
+
+// SetOwner ...
+func (s *MetaNodeServer) SetOwner(ctx context.Context, in *mp.SetOwnerReq) (*mp.SetOwnerAck, error) {
+	ack := mp.SetOwnerAck{}
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.PInode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.SetOwner(in.PInode, in.Name, in.Uid, in.Gid, in.SetUid, in.SetGid)
+	return &ack, nil
+}
+
+// SetTimes ...
+func (s *MetaNodeServer) SetTimes(ctx context.Context, in *mp.SetTimesReq) (*mp.SetTimesAck, error) {
+	ack := mp.SetTimesAck{}
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.PInode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.SetTimes(in.PInode, in.Name, in.Atime, in.Mtime, in.SetAtime, in.SetMtime)
+	return &ack, nil
+}
+
+// SetMode ...
+func (s *MetaNodeServer) SetMode(ctx context.Context, in *mp.SetModeReq) (*mp.SetModeAck, error) {
+	ack := mp.SetModeAck{}
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.PInode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.SetMode(in.PInode, in.Name, in.Mode)
+	return &ack, nil
+}
+
+// Truncate ...
+func (s *MetaNodeServer) Truncate(ctx context.Context, in *mp.TruncateReq) (*mp.TruncateAck, error) {
+	ack := mp.TruncateAck{}
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.PInode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.Truncate(in.PInode, in.Name, in.Size, in.From, in.Tail)
+	return &ack, nil
+}
+
+// SetLifecycle ...
+func (s *MetaNodeServer) SetLifecycle(ctx context.Context, in *mp.SetLifecycleReq) (*mp.SetLifecycleAck, error) {
+	ack := mp.SetLifecycleAck{}
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.PInode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.SetLifecycle(in.PInode, in.Name, in.Lifecycle)
+	return &ack, nil
+}
+
+// SetPolicy ...
+func (s *MetaNodeServer) SetPolicy(ctx context.Context, in *mp.SetPolicyReq) (*mp.SetPolicyAck, error) {
+	ack := mp.SetPolicyAck{}
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.PInode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.SetPolicy(in.PInode, in.Name, in.Policy)
+	return &ack, nil
+}
+
+// GetPolicy ...
+func (s *MetaNodeServer) GetPolicy(ctx context.Context, in *mp.GetPolicyReq) (*mp.GetPolicyAck, error) {
+	ack := mp.GetPolicyAck{}
+	ret, nameSpace := ns.GetShardLeader(in.VolID, in.PInode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret, ack.Policy = nameSpace.GetPolicy(in.PInode, in.Name)
+	return &ack, nil
+}
+
+// GetLifecycle ...
+func (s *MetaNodeServer) GetLifecycle(ctx context.Context, in *mp.GetLifecycleReq) (*mp.GetLifecycleAck, error) {
+	ack := mp.GetLifecycleAck{}
+	ret, nameSpace := ns.GetShardLeader(in.VolID, in.PInode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret, ack.Lifecycle = nameSpace.GetLifecycle(in.PInode, in.Name)
+	return &ack, nil
+}
+
+// DedupChunk ...
+func (s *MetaNodeServer) DedupChunk(ctx context.Context, in *mp.DedupChunkReq) (*mp.DedupChunkAck, error) {
+	ack := mp.DedupChunkAck{}
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.PInode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.DedupChunk(in.PInode, in.Name, in.Index, in.ChunkID, in.Target)
+	return &ack, nil
+}
+
+// CloneFile ...
+func (s *MetaNodeServer) CloneFile(ctx context.Context, in *mp.CloneFileReq) (*mp.CloneFileAck, error) {
+	ack := mp.CloneFileAck{}
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.DstPInode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret, ack.Inode, ack.InodeInfo = nameSpace.CloneFile(in.SrcPInode, in.SrcName, in.DstPInode, in.DstName, in.Uid, in.Gid)
+	return &ack, nil
+}
+
+// CopyTree ...
+func (s *MetaNodeServer) CopyTree(ctx context.Context, in *mp.CopyTreeReq) (*mp.CopyTreeAck, error) {
+	ack := mp.CopyTreeAck{}
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.DstPInode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret, ack.Files, ack.Dirs = nameSpace.CopyTree(in.SrcPInode, in.SrcName, in.DstPInode, in.DstName, in.Uid, in.Gid)
+	return &ack, nil
+}
+
+// DeleteTree ...
+func (s *MetaNodeServer) DeleteTree(ctx context.Context, in *mp.DeleteTreeReq) (*mp.DeleteTreeAck, error) {
+	ack := mp.DeleteTreeAck{}
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.PInode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret, ack.Files, ack.Dirs = nameSpace.DeleteTree(in.PInode, in.Name)
+	return &ack, nil
+}
+
+// MoveTree ...
+func (s *MetaNodeServer) MoveTree(ctx context.Context, in *mp.MoveTreeReq) (*mp.MoveTreeAck, error) {
+	ack := mp.MoveTreeAck{}
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.SrcPInode)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret = nameSpace.MoveTree(in.SrcPInode, in.SrcName, in.DstPInode, in.DstName)
+	return &ack, nil
+}
+
 // AllocateChunk ...
 func (s *MetaNodeServer) AllocateChunk(ctx context.Context, in *mp.AllocateChunkReq) (*mp.AllocateChunkAck, error) {
 	ack := mp.AllocateChunkAck{}
 
 	ack.SequenceID = in.SequenceID
 
-	ret, nameSpace := ns.GetNameSpace(in.VolID)
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.ParentInodeID)
 	if ret != 0 {
 		ack.Ret = ret
 		return &ack, nil
 	}
-	ret, chunkInfo := nameSpace.AllocateChunk(in.ParentInodeID, in.Name)
+	ret, chunkInfo, replicas := nameSpace.AllocateChunk(in.ParentInodeID, in.Name, in.Detached)
 	if ret != 0 {
 		ack.Ret = ret
 		return &ack, nil
@@ -365,6 +1230,7 @@ func (s *MetaNodeServer) AllocateChunk(ctx context.Context, in *mp.AllocateChunk
 	tmpChunkInfo.BlockGroup = blockGroup
 
 	ack.ChunkInfo = &tmpChunkInfo
+	ack.Replicas = replicas
 	return &ack, nil
 }
 
@@ -372,7 +1238,7 @@ func (s *MetaNodeServer) AllocateChunk(ctx context.Context, in *mp.AllocateChunk
 func (s *MetaNodeServer) SyncChunk(ctx context.Context, in *mp.SyncChunkReq) (*mp.SyncChunkAck, error) {
 	ack := mp.SyncChunkAck{}
 	chunkinfo := in.ChunkInfo
-	ret, nameSpace := ns.GetNameSpace(in.VolID)
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.ParentInodeID)
 	if ret != 0 {
 		ack.Ret = ret
 		return &ack, nil
@@ -381,15 +1247,82 @@ func (s *MetaNodeServer) SyncChunk(ctx context.Context, in *mp.SyncChunkReq) (*m
 	return &ack, nil
 }
 
+// CommitAppend ...
+func (s *MetaNodeServer) CommitAppend(ctx context.Context, in *mp.CommitAppendReq) (*mp.CommitAppendAck, error) {
+	ack := mp.CommitAppendAck{}
+	ret, nameSpace := ns.GetShardWriter(in.VolID, in.ParentInodeID)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret, ack.Offset = nameSpace.CommitAppend(in.ParentInodeID, in.Name, in.ChunkInfo)
+	return &ack, nil
+}
+
 // UpdateChunkInfo ...
 func (s *MetaNodeServer) UpdateChunkInfo(ctx context.Context, in *mp.UpdateChunkInfoReq) (*mp.UpdateChunkInfoAck, error) {
 	ack := mp.UpdateChunkInfoAck{}
-	ret, nameSpace := ns.GetNameSpace(in.VolID)
+	ret, nameSpace := ns.GetNameSpaceWriter(in.VolID)
 	if ret != 0 {
 		ack.Ret = ret
 		return &ack, nil
 	}
 	ack.Ret = nameSpace.UpdateChunkInfo(in)
+	if ack.Ret == 0 {
+		// the inode is in one of the shards
+		ack.Ret = s.toShards(in.VolID, func(mc mp.MetaNodeClient, id string) int32 {
+			req := *in
+			req.VolID = id
+			ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+			a, err := mc.UpdateChunkInfo(ctx, &req)
+			if err != nil {
+				return 1
+			}
+			return a.Ret
+		})
+	}
+	return &ack, nil
+}
+
+//ListChunkRefs ...
+func (s *MetaNodeServer) ListChunkRefs(ctx context.Context, in *mp.ListChunkRefsReq) (*mp.ListChunkRefsAck, error) {
+	ack := mp.ListChunkRefsAck{}
+	ret, nameSpace := ns.GetNameSpaceLeader(in.VolID)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	ack.Ret, ack.Groups = nameSpace.ListChunkRefs()
+	return &ack, nil
+}
+
+//FailBlock ...
+func (s *MetaNodeServer) FailBlock(ctx context.Context, in *mp.FailBlockReq) (*mp.FailBlockAck, error) {
+	ack := mp.FailBlockAck{}
+	ret, nameSpace := ns.GetNameSpaceWriter(in.VolID)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	if in.MoveToIP != 0 && !in.ListOnly {
+		if ack.Ret = nameSpace.MoveBlock(in.BlockGroupID, in.Position, in.MoveToIP, in.MoveToPort); ack.Ret != 0 {
+			return &ack, nil
+		}
+	}
+	ack.Ret, ack.Chunks = nameSpace.FailBlock(in)
+	if ack.Ret == 0 {
+		ack.Ret = s.toShards(in.VolID, func(mc mp.MetaNodeClient, id string) int32 {
+			req := *in
+			req.VolID = id
+			ctx, _ := context.WithTimeout(context.Background(), 60*time.Second)
+			a, err := mc.FailBlock(ctx, &req)
+			if err != nil {
+				return 1
+			}
+			ack.Chunks = append(ack.Chunks, a.Chunks...)
+			return a.Ret
+		})
+	}
 	return &ack, nil
 }
 
@@ -399,11 +1332,11 @@ func startMetaDataService(metaServer *MetaNodeServer) {
 	if err != nil {
 		panic(fmt.Sprintf("Failed to listen on:%v", metaServer.Addr.Grpc))
 	}
-	s := grpc.NewServer()
+	s := grpc.NewServer(grpc.UnaryInterceptor(fence))
 	mp.RegisterMetaNodeServer(s, metaServer)
 	// Register reflection service on gRPC server.
 	reflection.Register(s)
-	if err := s.Serve(lis); err != nil {
+	if err := s.Serve(utils.CountConns(lis)); err != nil {
 		panic("Failed to serve")
 	}
 }
@@ -418,6 +1351,9 @@ func loadMetaData(rs *raft.RaftServer) int32 {
 	for _, v := range vols {
 		logger.Debug("loadMetaData,Vol:%v", v)
 		ns.CreateNameSpace(rs, MetaNodeServerAddr.peers, MetaNodeServerAddr.nodeID, MetaNodeServerAddr.waldir, v.UUID, v.RaftGroupID, true)
+		for shard := int32(1); shard < v.Shards; shard++ {
+			ns.CreateNameSpace(rs, MetaNodeServerAddr.peers, MetaNodeServerAddr.nodeID, MetaNodeServerAddr.waldir, utils.ShardVolID(v.UUID, shard), utils.ShardRaftGroupID(v.RaftGroupID, shard), true)
+		}
 	}
 	return 0
 }
@@ -429,6 +1365,7 @@ func init() {
 		fmt.Println("NewConfig err")
 		os.Exit(1)
 	}
+	utils.ConfigEnv(c)
 
 	ns.VolMgrAddress = c.String("volmgr::host")
 	MetaNodeServerAddr.host = c.String("metanode::host")
@@ -442,9 +1379,36 @@ func init() {
 	MetaNodeServerAddr.ips = c.Strings("metanode::ips")
 	MetaNodeServerAddr.waldir = c.String("metanode::waldir")
 	MetaNodeServerAddr.log = c.String("metanode::log")
+	switch a := c.String("metanode::debug_addr"); a {
+	case "":
+		MetaNodeServerAddr.debug = "127.0.0.1:10000"
+	case "none":
+	default:
+		MetaNodeServerAddr.debug = a
+	}
 
 	logger.SetConsole(true)
 	logger.SetRollingFile(MetaNodeServerAddr.log, "metanode.log", 10, 100, logger.MB) //each 100M rolling
+	if err := logger.Configure(c.String("metanode::logformat"), c.String("metanode::logoutput"), c.String("metanode::logmodules"), "cfs-metanode"); err != nil {
+		fmt.Println("log config err:", err)
+		os.Exit(1)
+	}
+	loadTunables(c)
+
+}
+
+// loadTunables reads the keys that take effect on a running metanode, at start and
+// again on SIGHUP
+func loadTunables(c config.ConfigInterface) {
+	if days, err := c.Int("metanode::trash_days"); err == nil && days > 0 {
+		ns.TrashRetention.Set(time.Duration(days) * 24 * time.Hour)
+	}
+	if secs, err := c.Int("metanode::session_ttl_secs"); err == nil && secs > 0 {
+		ns.SessionTTL.Set(time.Duration(secs) * time.Second)
+	}
+	if mins, err := c.Int("metanode::lifecycle_interval_mins"); err == nil && mins > 0 {
+		ns.LifecycleInterval.Set(time.Duration(mins) * time.Minute)
+	}
 	switch level := c.String("metanode::loglevel"); level {
 	case "error":
 		logger.SetLevel(logger.ERROR)
@@ -455,7 +1419,23 @@ func init() {
 	default:
 		logger.SetLevel(logger.ERROR)
 	}
+	if levels, err := logger.ParseModuleLevels(c.String("metanode::logmodules")); err != nil {
+		logger.Error("config: %v, keep the levels of the modules", err)
+	} else {
+		logger.SetModuleLevels(levels)
+	}
+}
 
+// reloadConfig applies the tunables from the config file and the environment
+func reloadConfig(path string) {
+	c, err := config.NewConfig(path)
+	if err != nil {
+		logger.Error("reload config %v err:%v", path, err)
+		return
+	}
+	utils.ConfigEnv(c)
+	loadTunables(c)
+	logger.Info("config %v reloaded", path)
 }
 
 func parsePeers(peersstr []string) (peers []proto.Peer, err error) {
@@ -525,6 +1505,9 @@ func main() {
 	}
 	logger.Debug("AddNode success ...")
 
+	ns.ShardDirEmpty = metaServer.shardDirEmpty
+	ns.ShardChargeBlockGroup = metaServer.shardChargeBlockGroup
+
 	ret := loadMetaData(metaServer.RaftServer)
 	if ret != 0 {
 		if ret == 1 {
@@ -535,8 +1518,26 @@ func main() {
 		}
 	}
 
+	if MetaNodeServerAddr.debug != "" {
+		err := utils.ServeDebug(MetaNodeServerAddr.debug, func() map[string]int64 {
+			return map[string]int64{"namespaces": int64(ns.NameSpaceCount())}
+		})
+		if err != nil {
+			logger.Error("listen on debug addr %v err:%v", MetaNodeServerAddr.debug, err)
+		}
+	}
+
+	go ns.RunTrashExpiry()
+	go ns.RunOrphanSweep()
+	go ns.RunLifecycle()
+
+	// SIGHUP re-reads the tunables without a restart
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
-		http.ListenAndServe("127.0.0.1:10000", nil)
+		for range hup {
+			reloadConfig(os.Args[1])
+		}
 	}()
 
 	ticker := time.NewTicker(time.Second * 10)
@@ -0,0 +1,220 @@
+package namespace
+
+import (
+	pbproto "github.com/golang/protobuf/proto"
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"github.com/ipdcode/containerfs/utils"
+	"time"
+)
+
+// The access mode of a volume is kept by volmgr and set in its namespaces: RWO lets
+// the clients of one host write, ROX none. The clients writing an RWO volume are
+// kept in the rwo dentry, a new leader knows them. A client of another host opening
+// a read-write session takes over once their sessions expired, they are fenced off
+// then: one that was cut off and comes back cannot write over the new writer.
+// A geo-replication replica is written by the sessions of the replication agent
+// only, whatever the access mode.
+
+// accessModeKey the dentry holding the access mode, RWX when it has none
+const accessModeKey = "accessmode"
+
+// rwoKey the dentry holding the mp.RWOHolder of an RWO volume
+const rwoKey = "rwo"
+
+// replicaKey the dentry set while the volume is a geo-replication replica
+const replicaKey = "replica"
+
+func (ns *nameSpace) accessMode() string {
+	v, err := ns.RaftGroup.DentryGet(ns.RaftGroupID, accessModeKey)
+	if err != nil {
+		return "RWX"
+	}
+	return string(v)
+}
+
+//SetAccessMode the access mode of the volume, RWX, RWO or ROX
+func (ns *nameSpace) SetAccessMode(mode string) int32 {
+
+	defer catchPanic()
+
+	switch mode {
+	case "":
+		mode = "RWX"
+	case "RWX", "RWO", "ROX":
+	default:
+		return 22 /*EINVAL*/
+	}
+	if err := ns.RaftGroup.DentrySet(ns.RaftGroupID, accessModeKey, []byte(mode)); err != nil {
+		logger.Error("SetAccessMode vol:%v err:%v", ns.VolID, err)
+		return utils.NotLeader
+	}
+	logger.Info("vol:%v access mode %v", ns.VolID, mode)
+	return 0
+}
+
+//SetReplica makes the volume a geo-replication replica, on false promotes it back
+func (ns *nameSpace) SetReplica(on bool) int32 {
+
+	defer catchPanic()
+
+	var err error
+	if on {
+		err = ns.RaftGroup.DentrySet(ns.RaftGroupID, replicaKey, []byte{1})
+	} else {
+		err = ns.RaftGroup.DentryDel(ns.RaftGroupID, replicaKey)
+	}
+	if err != nil {
+		logger.Error("SetReplica vol:%v on:%v err:%v", ns.VolID, on, err)
+		return utils.NotLeader
+	}
+	logger.Info("vol:%v replica %v", ns.VolID, on)
+	return 0
+}
+
+func (ns *nameSpace) replica() bool {
+	_, err := ns.RaftGroup.DentryGet(ns.RaftGroupID, replicaKey)
+	return err == nil
+}
+
+// replicaWriter whether clientID opened its session as the replication agent, or
+// may have while a new leader waits for the sessions to be opened again
+func (ns *nameSpace) replicaWriter(clientID string) bool {
+	t := &ns.sessions
+	t.Lock()
+	s, ok := t.clients[clientID]
+	t.Unlock()
+	if !ok {
+		return ns.newLeader()
+	}
+	return s.ReplicaWriter
+}
+
+func (ns *nameSpace) rwoHolder() *mp.RWOHolder {
+	h := &mp.RWOHolder{}
+	v, err := ns.RaftGroup.DentryGet(ns.RaftGroupID, rwoKey)
+	if err != nil {
+		return h
+	}
+	if err := pbproto.Unmarshal(v, h); err != nil {
+		logger.Error("vol:%v bad rwo holder: %v", ns.VolID, err)
+	}
+	return h
+}
+
+func (ns *nameSpace) setRWOHolder(h *mp.RWOHolder) int32 {
+	val, _ := pbproto.Marshal(h)
+	if err := ns.RaftGroup.DentrySet(ns.RaftGroupID, rwoKey, val); err != nil {
+		logger.Error("vol:%v set rwo holder err:%v", ns.VolID, err)
+		return utils.NotLeader
+	}
+	return 0
+}
+
+// checkAccess whether the session s may be opened under the access mode: 30
+// (EROFS) for a read-write one of a ROX volume or of a replica but by the
+// replication agent, 16 (EBUSY) for one of an RWO
+// volume while another host writes it, 11 (EAGAIN) while a new leader cannot
+// tell yet
+func (ns *nameSpace) checkAccess(s *mp.SessionInfo) int32 {
+	if s.ReadOnly {
+		return 0
+	}
+	if ns.replica() && !s.ReplicaWriter {
+		return 30 /*EROFS*/
+	}
+	switch ns.accessMode() {
+	case "ROX":
+		return 30 /*EROFS*/
+	case "RWO":
+	default:
+		return 0
+	}
+
+	ns.rwoMu.Lock()
+	defer ns.rwoMu.Unlock()
+	h := ns.rwoHolder()
+	if h.Host == s.Host || len(h.ClientIDs) == 0 {
+		for _, id := range h.ClientIDs {
+			if id == s.ClientID {
+				return 0
+			}
+		}
+		h.Host = s.Host
+		h.ClientIDs = append(h.ClientIDs, s.ClientID)
+		return ns.setRWOHolder(h)
+	}
+	live := make(map[string]bool)
+	for _, o := range ns.ListSessions() {
+		live[o.ClientID] = true
+	}
+	for _, id := range h.ClientIDs {
+		if live[id] {
+			return 16 /*EBUSY*/
+		}
+	}
+	if ns.newLeader() {
+		// the writers may not have opened their sessions again yet
+		return 11 /*EAGAIN*/
+	}
+	for _, id := range h.ClientIDs {
+		if ret := ns.Fence(id, true); ret != 0 {
+			return ret
+		}
+	}
+	logger.Error("vol:%v rwo writers on %v expired, %v of %v takes over", ns.VolID, h.Host, s.ClientID, s.Host)
+	return ns.setRWOHolder(&mp.RWOHolder{Host: s.Host, ClientIDs: []string{s.ClientID}})
+}
+
+// dropRWOHolder clientID closed its session, it writes no more
+func (ns *nameSpace) dropRWOHolder(clientID string) {
+	ns.rwoMu.Lock()
+	defer ns.rwoMu.Unlock()
+	h := ns.rwoHolder()
+	for i, id := range h.ClientIDs {
+		if id == clientID {
+			h.ClientIDs = append(h.ClientIDs[:i], h.ClientIDs[i+1:]...)
+			ns.setRWOHolder(h)
+			return
+		}
+	}
+}
+
+// newLeader whether this metanode leads the namespace for less than SessionTTL,
+// the clients may not have opened their sessions again
+func (ns *nameSpace) newLeader() bool {
+	t := &ns.orphans
+	t.Lock()
+	defer t.Unlock()
+	return t.leading.IsZero() || time.Since(t.leading) < SessionTTL.Get()
+}
+
+//AdmitsWrite whether the writes of the client go through under the access mode: none
+//for a ROX volume, the ones of the clients holding an RWO volume, the ones of the
+//replication agent for a replica
+func (ns *nameSpace) AdmitsWrite(clientID string) bool {
+	if ns.replica() && !ns.replicaWriter(clientID) {
+		return false
+	}
+	switch ns.accessMode() {
+	case "ROX":
+		return false
+	case "RWO":
+		for _, id := range ns.rwoHolder().ClientIDs {
+			if id == clientID {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+//AdmitsWrite : nameSpace.AdmitsWrite for the namespace volID, true when it is not here
+func AdmitsWrite(volID string, clientID string) bool {
+	ret, ns := GetNameSpace(volID)
+	if ret != 0 {
+		return true
+	}
+	return ns.AdmitsWrite(clientID)
+}
@@ -0,0 +1,207 @@
+package namespace
+
+import (
+	pbproto "github.com/golang/protobuf/proto"
+	"github.com/ipdcode/containerfs/logger"
+	"github.com/ipdcode/containerfs/metanode/raftopt"
+	kvp "github.com/ipdcode/containerfs/proto/kvp"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"strconv"
+	"time"
+)
+
+// BatchMaxEntries the most entries of one batch op, a larger one answers 22
+const BatchMaxEntries = 1024
+
+//BatchCreate creates the entries of one dir in a single raft entry, an entry
+//already there gets 17 and the others are still created. A file may come with
+//its content when it fits inline.
+func (ns *nameSpace) BatchCreate(pinode uint64, entries []*mp.BatchEntry) (int32, []*mp.BatchCreateResult) {
+
+	defer catchPanic()
+
+	if len(entries) == 0 || len(entries) > BatchMaxEntries {
+		return 22 /*EINVAL*/, nil
+	}
+
+	results := make([]*mp.BatchCreateResult, len(entries))
+	seen := make(map[string]bool)
+	var todo []int
+	for i, e := range entries {
+		results[i] = &mp.BatchCreateResult{}
+		if e.Name == "" || (e.Dir && len(e.InlineData) > 0) {
+			results[i].Ret = 22 /*EINVAL*/
+			continue
+		}
+		if len(e.InlineData) > InlineMaxSize {
+			results[i].Ret = 27 /*EFBIG*/
+			continue
+		}
+		if ok, _ := ns.DentryDBGet(strconv.FormatUint(pinode, 10) + "-" + e.Name); ok || seen[e.Name] {
+			results[i].Ret = 17 /*EEXIST*/
+			continue
+		}
+		seen[e.Name] = true
+		todo = append(todo, i)
+	}
+	if len(todo) == 0 {
+		return 0, results
+	}
+
+	first, err := ns.AllocateInodeIDs(len(todo))
+	if err != nil {
+		return 1, nil
+	}
+	now := time.Now()
+	policy := ns.inheritedPolicy(pinode)
+	defer ns.lockInodes(pinode)()
+	var ops []*kvp.Kv
+	for n, i := range todo {
+		inode := first + uint64(n)
+		e := entries[i]
+		info := &mp.InodeInfo{Uid: e.Uid, Gid: e.Gid, Mode: inodeMode(!e.Dir, e.Mode), Policy: policy, Generation: newGeneration()}
+		stampTimes(info, now)
+		if e.ModifiTime != 0 {
+			info.ModifiTime, info.ModifiTimeNsec = e.ModifiTime, 0
+		}
+		if len(e.InlineData) > 0 {
+			info.InlineData = e.InlineData
+			info.FileSize = int64(len(e.InlineData))
+		}
+		val, _ := pbproto.Marshal(info)
+		ops = append(ops,
+			&kvp.Kv{Opt: raftopt.OPT_SET_INODE, K: strconv.FormatUint(inode, 10), V: val},
+			setDentryOp(strconv.FormatUint(pinode, 10)+"-"+e.Name, !e.Dir, inode))
+		results[i].Inode = inode
+		results[i].InodeInfo = info
+	}
+	ops = append(ops, ns.touchDirOps(now, pinode)...)
+	t := ns.beginUsage()
+	for _, i := range todo {
+		if entries[i].Dir {
+			t.entry(pinode, &mp.Dirent{Inode: results[i].Inode}, 1)
+		} else {
+			t.add(pinode, results[i].InodeInfo.FileSize, 1, 0)
+		}
+	}
+	err = ns.RaftGroup.Batch(ns.RaftGroupID, append(ops, t.ops()...))
+	t.release()
+	if err != nil {
+		logger.Error("BatchCreate vol:%v pinode:%v entries:%v err:%v", ns.VolID, pinode, len(todo), err)
+		return 1, nil
+	}
+
+	for _, i := range todo {
+		e := entries[i]
+		ns.notify(&mp.ChangeEvent{Op: ChangeCreate, PInode: pinode, Name: e.Name, Inode: results[i].Inode, Dir: e.Dir})
+	}
+	return 0, results
+}
+
+//BatchStat the dentries and inodes of names in one dir, a missing one gets 2
+func (ns *nameSpace) BatchStat(pinode uint64, names []string) (int32, []*mp.BatchStatResult) {
+
+	defer catchPanic()
+
+	if len(names) > BatchMaxEntries {
+		return 22 /*EINVAL*/, nil
+	}
+
+	results := make([]*mp.BatchStatResult, len(names))
+	for i, name := range names {
+		results[i] = &mp.BatchStatResult{}
+		ok, dirent := ns.DentryDBGet(strconv.FormatUint(pinode, 10) + "-" + name)
+		if !ok {
+			results[i].Ret = 2 /*ENOENT*/
+			continue
+		}
+		results[i].InodeType = dirent.InodeType
+		results[i].Inode = dirent.Inode
+		if ok, results[i].InodeInfo = ns.InodeDBGet(dirent.Inode); !ok {
+			results[i].Ret = 2 /*ENOENT*/
+		}
+	}
+	return 0, results
+}
+
+//BatchUnlink removes files of one dir in a single raft entry. The files go under their
+//orphan dentries, reclaimed once no client has them open. With the trash on the files
+//go to the trash instead.
+func (ns *nameSpace) BatchUnlink(pinode uint64, names []string) (int32, []int32) {
+
+	defer catchPanic()
+
+	if len(names) == 0 || len(names) > BatchMaxEntries {
+		return 22 /*EINVAL*/, nil
+	}
+
+	rets := make([]int32, len(names))
+	if ns.keepsTrash(pinode) {
+		for i, name := range names {
+			if ok, dirent := ns.DentryDBGet(strconv.FormatUint(pinode, 10) + "-" + name); ok && !dirent.InodeType {
+				rets[i] = 21 /*EISDIR*/
+				continue
+			}
+			rets[i], _ = ns.TrashFile(pinode, name)
+		}
+		return 0, rets
+	}
+
+	type unlinked struct {
+		name   string
+		dirent *mp.Dirent
+	}
+	locked := []uint64{pinode}
+	for _, name := range names {
+		if ok, dirent := ns.DentryDBGet(strconv.FormatUint(pinode, 10) + "-" + name); ok && dirent.InodeType {
+			locked = append(locked, dirent.Inode)
+		}
+	}
+	defer ns.lockInodes(locked...)()
+
+	var done []unlinked
+	var orphans []uint64
+	var ops []*kvp.Kv
+	seen := make(map[string]bool)
+	for i, name := range names {
+		dentryKey := strconv.FormatUint(pinode, 10) + "-" + name
+		ok, dirent := ns.DentryDBGet(dentryKey)
+		if !ok || seen[name] {
+			rets[i] = 2 /*ENOENT*/
+			continue
+		}
+		if !dirent.InodeType {
+			rets[i] = 21 /*EISDIR*/
+			continue
+		}
+		if !containsInode(locked, dirent.Inode) {
+			// replaced since the locking, left to a retry
+			rets[i] = 11 /*EAGAIN*/
+			continue
+		}
+		seen[name] = true
+		ops = append(ops, &kvp.Kv{Opt: raftopt.OPT_DEL_DENTRY, K: dentryKey}, orphanOp(dirent.Inode))
+		orphans = append(orphans, dirent.Inode)
+		done = append(done, unlinked{name, dirent})
+	}
+	if len(ops) == 0 {
+		return 0, rets
+	}
+	ops = append(ops, ns.touchDirOps(time.Now(), pinode)...)
+	t := ns.beginUsage()
+	for _, u := range done {
+		t.entry(pinode, u.dirent, -1)
+	}
+	err := ns.RaftGroup.Batch(ns.RaftGroupID, append(ops, t.ops()...))
+	t.release()
+	if err != nil {
+		logger.Error("BatchUnlink vol:%v pinode:%v names:%v err:%v", ns.VolID, pinode, len(done), err)
+		return 1, nil
+	}
+	ns.orphaned(orphans)
+
+	for _, u := range done {
+		ns.notify(&mp.ChangeEvent{Op: ChangeRemove, PInode: pinode, Name: u.name, Inode: u.dirent.Inode})
+	}
+	return 0, rets
+}
@@ -0,0 +1,159 @@
+package namespace
+
+import (
+	pbproto "github.com/golang/protobuf/proto"
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"github.com/ipdcode/containerfs/utils"
+	"sync"
+	"time"
+)
+
+// capacityKey the dentry holding the mp.CapacityLimits of the namespace, set by volmgr
+const capacityKey = "capacity"
+
+// capacity states of a namespace, by the part of its space used
+const (
+	capacityOK   = 0
+	capacitySoft = 1 // past the soft limit: warned about
+	capacityHard = 2 // past the hard limit: no new chunks, deletes skip the trash
+)
+
+// capacityWarnInterval between the warnings of a namespace over a limit
+var capacityWarnInterval = 10 * time.Minute
+
+// spaceRefresh how long checkCapacity goes by the space it summed over the block
+// groups, kept up to the changes of the block groups set here meanwhile
+var spaceRefresh = time.Minute
+
+type capacityState struct {
+	mu       sync.Mutex
+	state    int
+	lastWarn time.Time
+
+	total   uint64
+	free    int64
+	spaceAt time.Time // of the last sum, zero before the first
+}
+
+// space the total and free bytes of the block groups of the namespace
+func (ns *nameSpace) space() (uint64, uint64) {
+	var totalSpace uint64
+	var freeSpace uint64
+
+	ns.RaftGroup.BlockGroupLocker.RLock()
+	defer ns.RaftGroup.BlockGroupLocker.RUnlock()
+
+	bgmap, _ := ns.BlockGroupDBGetAll()
+	var blockGroup mp.BlockGroup
+	for _, v := range *bgmap {
+		if err := pbproto.Unmarshal(v, &blockGroup); err != nil {
+			continue
+		}
+		totalSpace = totalSpace + BlockGroupSize
+		freeSpace = freeSpace + uint64(blockGroup.FreeSize)
+	}
+	return totalSpace, freeSpace
+}
+
+// cachedSpace space, summed again once older than spaceRefresh
+func (ns *nameSpace) cachedSpace() (uint64, uint64) {
+	c := &ns.capacity
+	c.mu.Lock()
+	if !c.spaceAt.IsZero() && time.Since(c.spaceAt) < spaceRefresh {
+		defer c.mu.Unlock()
+		if c.free < 0 {
+			return c.total, 0
+		}
+		return c.total, uint64(c.free)
+	}
+	c.mu.Unlock()
+	total, free := ns.space()
+	c.mu.Lock()
+	c.total, c.free, c.spaceAt = total, int64(free), time.Now()
+	c.mu.Unlock()
+	return total, free
+}
+
+// spaceSet keeps the cached space up to a block group set from the free size
+// oldFree to free, a new one when !existed
+func (ns *nameSpace) spaceSet(existed bool, oldFree int64, free int64) {
+	c := &ns.capacity
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.spaceAt.IsZero() {
+		return
+	}
+	if !existed {
+		c.total += BlockGroupSize
+	}
+	c.free += free - oldFree
+}
+
+func (ns *nameSpace) capacityLimits() mp.CapacityLimits {
+	limits := mp.CapacityLimits{}
+	v, err := ns.RaftGroup.DentryGet(ns.RaftGroupID, capacityKey)
+	if err != nil {
+		return limits
+	}
+	if err := pbproto.Unmarshal(v, &limits); err != nil {
+		logger.Error("vol:%v bad capacity limits: %v", ns.VolID, err)
+	}
+	return limits
+}
+
+//SetCapacityLimits the soft and hard limits of the namespace, in percent of its
+//space, 0 for none
+func (ns *nameSpace) SetCapacityLimits(soft int32, hard int32) int32 {
+
+	defer catchPanic()
+
+	if soft < 0 || soft > 100 || hard < 0 || hard > 100 || (soft > 0 && hard > 0 && soft > hard) {
+		return 22 /*EINVAL*/
+	}
+	val, _ := pbproto.Marshal(&mp.CapacityLimits{Soft: soft, Hard: hard})
+	if err := ns.RaftGroup.DentrySet(ns.RaftGroupID, capacityKey, val); err != nil {
+		logger.Error("SetCapacityLimits vol:%v err:%v", ns.VolID, err)
+		return utils.NotLeader
+	}
+	logger.Info("vol:%v capacity limits soft:%v%% hard:%v%%", ns.VolID, soft, hard)
+	ns.checkCapacity()
+	return 0
+}
+
+// checkCapacity the capacity state of the namespace, logged when it changes and
+// every capacityWarnInterval while over a limit
+func (ns *nameSpace) checkCapacity() int {
+	limits := ns.capacityLimits()
+	if limits.Soft == 0 && limits.Hard == 0 {
+		return capacityOK
+	}
+	total, free := ns.cachedSpace()
+	state := capacityOK
+	var used uint64
+	if total > 0 {
+		used = (total - free) * 100 / total
+		switch {
+		case limits.Hard > 0 && used >= uint64(limits.Hard):
+			state = capacityHard
+		case limits.Soft > 0 && used >= uint64(limits.Soft):
+			state = capacitySoft
+		}
+	}
+
+	c := &ns.capacity
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if state != c.state || (state != capacityOK && time.Since(c.lastWarn) > capacityWarnInterval) {
+		switch state {
+		case capacityOK:
+			logger.Info("vol:%v %v%% used, back under its capacity limits", ns.VolID, used)
+		case capacitySoft:
+			logger.Warn("vol:%v %v%% used, over its soft limit %v%%", ns.VolID, used, limits.Soft)
+		case capacityHard:
+			logger.Error("vol:%v %v%% used, over its hard limit %v%%: writes fail with ENOSPC, deletes free their space at once", ns.VolID, used, limits.Hard)
+		}
+		c.state, c.lastWarn = state, time.Now()
+	}
+	return state
+}
@@ -0,0 +1,140 @@
+package namespace
+
+import (
+	pbproto "github.com/golang/protobuf/proto"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"strconv"
+	"strings"
+)
+
+// kinds of ChangeEvent.Op
+const (
+	ChangeWrite  = 1
+	ChangeCreate = 2
+	ChangeRemove = 3
+	ChangeRename = 4
+	// ChangeCloseWrite the last writer of a client closed the file
+	ChangeCloseWrite = 5
+)
+
+// changeQueueLen events buffered per watcher, a watcher falling further behind is dropped
+const changeQueueLen = 1024
+
+//WatchChanges : the channel gets each namespace change made on this node, it is closed
+//when the watcher fell behind and missed events. Call cancel when done.
+func (ns *nameSpace) WatchChanges() (<-chan *mp.ChangeEvent, func()) {
+	ch := make(chan *mp.ChangeEvent, changeQueueLen)
+	ns.changeMu.Lock()
+	if ns.changeWatchers == nil {
+		ns.changeWatchers = make(map[chan *mp.ChangeEvent]bool)
+	}
+	ns.changeWatchers[ch] = true
+	ns.changeMu.Unlock()
+	cancel := func() {
+		ns.changeMu.Lock()
+		if ns.changeWatchers[ch] {
+			delete(ns.changeWatchers, ch)
+			close(ch)
+		}
+		ns.changeMu.Unlock()
+	}
+	return ch, cancel
+}
+
+//CloseWrite tells the watchers a client is done writing the file
+func (ns *nameSpace) CloseWrite(pinode uint64, name string, inode uint64) int32 {
+	ns.notify(&mp.ChangeEvent{Op: ChangeCloseWrite, PInode: pinode, Name: name, Inode: inode})
+	return 0
+}
+
+func (ns *nameSpace) notify(ev *mp.ChangeEvent) {
+	ns.changeMu.Lock()
+	defer ns.changeMu.Unlock()
+	for ch := range ns.changeWatchers {
+		select {
+		case ch <- ev:
+		default:
+			delete(ns.changeWatchers, ch)
+			close(ch)
+		}
+	}
+}
+
+//SubtreeFilter passes the changes below a dir, following the dirs created,
+//removed and renamed under it
+type SubtreeFilter struct {
+	ns     *nameSpace
+	root   uint64
+	direct bool
+	dirs   map[uint64]bool
+}
+
+//NewSubtreeFilter direct only passes the changes of the entries of root itself
+func (ns *nameSpace) NewSubtreeFilter(root uint64, direct bool) *SubtreeFilter {
+	f := &SubtreeFilter{ns: ns, root: root, direct: direct}
+	f.load()
+	return f
+}
+
+// load collects the dirs below root in one pass over the dentries
+func (f *SubtreeFilter) load() {
+	f.dirs = map[uint64]bool{f.root: true}
+	if f.direct {
+		return
+	}
+	allMap, err := f.ns.RaftGroup.DentryGetAll(f.ns.RaftGroupID)
+	if err != nil {
+		return
+	}
+	children := make(map[uint64][]uint64)
+	f.ns.RaftGroup.DentryLocker.RLock()
+	for k, v := range *allMap {
+		i := strings.IndexByte(k, '-')
+		if i < 0 {
+			continue
+		}
+		pinode, err := strconv.ParseUint(k[:i], 10, 64)
+		if err != nil {
+			continue
+		}
+		dirent := mp.Dirent{}
+		if pbproto.Unmarshal(v, &dirent) != nil || dirent.InodeType {
+			continue
+		}
+		children[pinode] = append(children[pinode], dirent.Inode)
+	}
+	f.ns.RaftGroup.DentryLocker.RUnlock()
+
+	queue := []uint64{f.root}
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+		for _, c := range children[d] {
+			if !f.dirs[c] {
+				f.dirs[c] = true
+				queue = append(queue, c)
+			}
+		}
+	}
+}
+
+//Match true when ev is below the subtree, a dir event updates the dirs followed
+func (f *SubtreeFilter) Match(ev *mp.ChangeEvent) bool {
+	in := f.dirs[ev.PInode]
+	if ev.Op == ChangeRename {
+		in = in || f.dirs[ev.NewPInode]
+	}
+	if !in || !ev.Dir || f.direct {
+		return in
+	}
+	switch ev.Op {
+	case ChangeCreate:
+		f.dirs[ev.Inode] = true
+	case ChangeRemove:
+		delete(f.dirs, ev.Inode)
+	case ChangeRename:
+		// a dir moved in or out takes its whole tree along
+		f.load()
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+package namespace
+
+import (
+	pbproto "github.com/golang/protobuf/proto"
+	"github.com/ipdcode/containerfs/logger"
+	"github.com/ipdcode/containerfs/metanode/raftopt"
+	kvp "github.com/ipdcode/containerfs/proto/kvp"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"strconv"
+	"time"
+)
+
+//CloneFile makes the file dstName of dstPInode a copy of srcName of srcPInode
+//sharing its chunks, the data does not move. The first write to a shared chunk
+//starts a new one. dstName may exist as an empty file, as cp --reflink leaves it.
+//Both dirs must be in this shard, the chunk refs are kept per shard.
+func (ns *nameSpace) CloneFile(srcPInode uint64, srcName string, dstPInode uint64, dstName string, uid uint32, gid uint32) (int32, uint64, *mp.InodeInfo) {
+
+	defer catchPanic()
+
+	if !ns.owns(srcPInode) || !ns.owns(dstPInode) {
+		return 18 /*EXDEV*/, 0, nil
+	}
+	dstKey := strconv.FormatUint(dstPInode, 10) + "-" + dstName
+	locked := []uint64{dstPInode}
+	ok, srcDirent := ns.DentryDBGet(strconv.FormatUint(srcPInode, 10) + "-" + srcName)
+	if !ok {
+		return 2 /*ENOENT*/, 0, nil
+	}
+	if !srcDirent.InodeType {
+		return 21 /*EISDIR*/, 0, nil
+	}
+	locked = append(locked, srcDirent.Inode)
+	if ok, dirent := ns.DentryDBGet(dstKey); ok {
+		locked = append(locked, dirent.Inode)
+	}
+	defer ns.lockInodes(locked...)()
+	// the source is read and its chunk refs counted up in one go, against other
+	// clones, dedup and the deletes
+	ns.refMu.Lock()
+	defer ns.refMu.Unlock()
+	ok, src := ns.InodeDBGet(srcDirent.Inode)
+	if !ok {
+		return 2 /*ENOENT*/, 0, nil
+	}
+
+	var inodeID uint64
+	created := false
+	info := &mp.InodeInfo{Uid: uid, Gid: gid}
+	if ok, dirent := ns.DentryDBGet(dstKey); ok {
+		if !dirent.InodeType {
+			return 21 /*EISDIR*/, 0, nil
+		}
+		if dirent.Inode == srcDirent.Inode {
+			return 22 /*EINVAL*/, 0, nil
+		}
+		if !containsInode(locked, dirent.Inode) {
+			return 11 /*EAGAIN*/, 0, nil
+		}
+		ok, old := ns.InodeDBGet(dirent.Inode)
+		if !ok {
+			return 2 /*ENOENT*/, 0, nil
+		}
+		if old.FileSize != 0 || len(old.Chunks) != 0 || len(old.InlineData) != 0 {
+			return 17 /*EEXIST*/, 0, nil
+		}
+		inodeID = dirent.Inode
+		info.Uid, info.Gid, info.Mode, info.Policy, info.Generation = old.Uid, old.Gid, old.Mode, old.Policy, old.Generation
+	} else {
+		id, err := ns.AllocateInodeID()
+		if err != nil {
+			return 1, 0, nil
+		}
+		inodeID = id
+		created = true
+		info.Mode = src.Mode
+		info.Policy = ns.inheritedPolicy(dstPInode)
+		info.Generation = newGeneration()
+	}
+
+	now := time.Now()
+	stampMtime(info, now)
+	stampAtime(info, now)
+	info.FileSize = src.FileSize
+	info.InlineData = src.InlineData
+	for _, c := range src.Chunks {
+		info.Chunks = append(info.Chunks, &mp.ChunkInfo{
+			ChunkID:      c.ChunkID,
+			ChunkSize:    c.ChunkSize,
+			BlockGroupID: c.BlockGroupID,
+			Status:       c.Status,
+		})
+	}
+	val, err := pbproto.Marshal(info)
+	if err != nil {
+		return 1, 0, nil
+	}
+	ops := []*kvp.Kv{{Opt: raftopt.OPT_SET_INODE, K: strconv.FormatUint(inodeID, 10), V: val}}
+	if created {
+		ops = append(ops, setDentryOp(dstKey, true, inodeID))
+		ops = append(ops, ns.touchDirOps(now, dstPInode)...)
+	}
+	refs := make(map[uint64]uint64)
+	for _, c := range src.Chunks {
+		if _, ok := refs[c.ChunkID]; !ok {
+			refs[c.ChunkID] = ns.chunkRefs(c.ChunkID)
+		}
+		refs[c.ChunkID]++
+	}
+	for chunkID, n := range refs {
+		ops = append(ops, setDentryOp(chunkRefKey(chunkID), true, n))
+	}
+	t := ns.beginUsage()
+	if created {
+		t.add(dstPInode, 0, 1, 0)
+	}
+	t.add(dstPInode, info.FileSize, 0, 0)
+	err = ns.RaftGroup.Batch(ns.RaftGroupID, append(ops, t.ops()...))
+	t.release()
+	if err != nil {
+		logger.Error("CloneFile vol:%v inode:%v to %v err:%v", ns.VolID, srcDirent.Inode, dstKey, err)
+		return 1, 0, nil
+	}
+
+	if created {
+		ns.notify(&mp.ChangeEvent{Op: ChangeCreate, PInode: dstPInode, Name: dstName, Inode: inodeID})
+	} else {
+		ns.notify(&mp.ChangeEvent{Op: ChangeWrite, PInode: dstPInode, Name: dstName, Inode: inodeID})
+	}
+	return 0, inodeID, info
+}
@@ -0,0 +1,135 @@
+package namespace
+
+import (
+	pbproto "github.com/golang/protobuf/proto"
+	"github.com/ipdcode/containerfs/logger"
+	"github.com/ipdcode/containerfs/metanode/raftopt"
+	kvp "github.com/ipdcode/containerfs/proto/kvp"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"strconv"
+)
+
+// The dedup job of cfs-cli points the duplicate chunks of the files at one copy.
+// A shared chunk has a chunkref dentry holding the number of chunk entries of
+// the files pointing at it, no record is one. The data of a shared chunk stays
+// on the datanodes until the last entry goes. The counts are read and set back:
+// refMu is held from the read to the Batch of the ops setting them.
+
+// chunkRefPrefix dentries of the shared chunks, the Inode of the dirent is the count
+const chunkRefPrefix = "chunkref-"
+
+func chunkRefKey(chunkID uint64) string {
+	return chunkRefPrefix + strconv.FormatUint(chunkID, 10)
+}
+
+// chunkRefs the chunk entries of the files pointing at the chunk
+func (ns *nameSpace) chunkRefs(chunkID uint64) uint64 {
+	if ok, dirent := ns.DentryDBGet(chunkRefKey(chunkID)); ok && dirent.Inode > 1 {
+		return dirent.Inode
+	}
+	return 1
+}
+
+// unrefChunks the ops dropping a file made of chunks, and the chunks other files
+// still point at: their data and their space in the block group stay
+func (ns *nameSpace) unrefChunks(chunks []*mp.ChunkInfo) ([]*kvp.Kv, map[uint64]bool) {
+	entries := make(map[uint64]uint64)
+	for _, c := range chunks {
+		entries[c.ChunkID]++
+	}
+	var ops []*kvp.Kv
+	shared := make(map[uint64]bool)
+	for chunkID, n := range entries {
+		refs := ns.chunkRefs(chunkID)
+		if refs == 1 {
+			continue
+		}
+		switch {
+		case refs <= n:
+			ops = append(ops, &kvp.Kv{Opt: raftopt.OPT_DEL_DENTRY, K: chunkRefKey(chunkID)})
+		case refs-n == 1:
+			ops = append(ops, &kvp.Kv{Opt: raftopt.OPT_DEL_DENTRY, K: chunkRefKey(chunkID)})
+			shared[chunkID] = true
+		default:
+			ops = append(ops, setDentryOp(chunkRefKey(chunkID), true, refs-n))
+			shared[chunkID] = true
+		}
+	}
+	return ops, shared
+}
+
+// releaseChunks gives the space of the chunks back to their block groups, but
+// for the shared ones, once each
+func (ns *nameSpace) releaseChunks(chunks []*mp.ChunkInfo, shared map[uint64]bool) {
+	released := make(map[uint64]bool)
+	for _, v := range chunks {
+		if !shared[v.ChunkID] && !released[v.ChunkID] {
+			released[v.ChunkID] = true
+			ns.ReleaseBlockGroup(v.BlockGroupID, v.ChunkSize)
+		}
+	}
+}
+
+//DedupChunk points the chunk at index of the file name of pinode, chunkID, at
+//target, a chunk with the same content. The caller then deletes the data of chunkID.
+func (ns *nameSpace) DedupChunk(pinode uint64, name string, index int32, chunkID uint64, target *mp.ChunkInfo) int32 {
+
+	defer catchPanic()
+
+	if target == nil || target.ChunkID == chunkID {
+		return 22 /*EINVAL*/
+	}
+	ok, dirent := ns.DentryDBGet(strconv.FormatUint(pinode, 10) + "-" + name)
+	if !ok || !dirent.InodeType {
+		return 2 /*ENOENT*/
+	}
+	defer ns.lockInodes(dirent.Inode)()
+	ns.refMu.Lock()
+	defer ns.refMu.Unlock()
+	ok, inodeInfo := ns.InodeDBGet(dirent.Inode)
+	if !ok {
+		return 2 /*ENOENT*/
+	}
+	if index < 0 || int(index) >= len(inodeInfo.Chunks) {
+		return 22 /*EINVAL*/
+	}
+	old := inodeInfo.Chunks[index]
+	if old.ChunkID != chunkID || old.ChunkSize != target.ChunkSize {
+		// written meanwhile
+		return 16 /*EBUSY*/
+	}
+	if ns.chunkRefs(chunkID) > 1 {
+		// others use it, it would have to go with them
+		return 16 /*EBUSY*/
+	}
+	if ok, _ := ns.BlockGroupDBGet(target.BlockGroupID); !ok {
+		return 22 /*EINVAL*/
+	}
+	for _, c := range inodeInfo.Chunks {
+		// a file points at a chunk once, its writes would change it twice
+		if c.ChunkID == target.ChunkID {
+			return 22 /*EINVAL*/
+		}
+	}
+
+	inodeInfo.Chunks[index] = &mp.ChunkInfo{
+		ChunkID:      target.ChunkID,
+		ChunkSize:    target.ChunkSize,
+		BlockGroupID: target.BlockGroupID,
+		Status:       target.Status,
+	}
+	val, err := pbproto.Marshal(inodeInfo)
+	if err != nil {
+		return 1
+	}
+	ops := []*kvp.Kv{
+		{Opt: raftopt.OPT_SET_INODE, K: strconv.FormatUint(dirent.Inode, 10), V: val},
+		setDentryOp(chunkRefKey(target.ChunkID), true, ns.chunkRefs(target.ChunkID)+1),
+	}
+	if err := ns.RaftGroup.Batch(ns.RaftGroupID, ops); err != nil {
+		logger.Error("DedupChunk vol:%v inode:%v chunk:%v err:%v", ns.VolID, dirent.Inode, chunkID, err)
+		return 1
+	}
+	ns.ReleaseBlockGroup(old.BlockGroupID, old.ChunkSize)
+	return 0
+}
@@ -0,0 +1,134 @@
+package namespace
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	"github.com/ipdcode/containerfs/metanode/raftopt"
+	kvp "github.com/ipdcode/containerfs/proto/kvp"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"time"
+)
+
+// restoreBatchLen ops proposed per raft entry by a restore
+const restoreBatchLen = 1024
+
+func kvToRecord(kv *kvp.Kv) *mp.MetaRecord {
+	r := &mp.MetaRecord{Opt: kv.Opt, K: kv.K, V: kv.V}
+	for _, op := range kv.Batch {
+		r.Batch = append(r.Batch, kvToRecord(op))
+	}
+	return r
+}
+
+// recordToKv the op of a record, nil for the ops a restore does not replay
+func recordToKv(r *mp.MetaRecord) *kvp.Kv {
+	switch r.Opt {
+	case raftopt.OPT_SET_DENTRY, raftopt.OPT_DEL_DENTRY, raftopt.OPT_SET_INODE, raftopt.OPT_DEL_INODE, raftopt.OPT_SET_BG:
+		return &kvp.Kv{Opt: r.Opt, K: r.K, V: r.V}
+	}
+	return nil
+}
+
+//Dump passes the namespace to fn, all of it when since is 0, else the changes after
+//since. header gets the applied index to dump from next time and the last ids
+//allocated before the records.
+func (ns *nameSpace) Dump(since uint64, header func(applied uint64, chunkID uint64, inodeID uint64) error, fn func(r *mp.MetaRecord) error) int32 {
+
+	defer catchPanic()
+
+	applied, kvs, err := ns.RaftGroup.Dump(ns.RaftGroupID, since)
+	if err == raftopt.ErrJournalTrimmed {
+		return 34 /*ERANGE*/
+	}
+	if err != nil {
+		logger.Error("Dump vol:%v since:%v err:%v", ns.VolID, since, err)
+		return 1
+	}
+	chunkID, inodeID := ns.RaftGroup.IDs()
+	if header(applied, chunkID, inodeID) != nil {
+		return 1
+	}
+	for _, kv := range kvs {
+		if fn(kvToRecord(kv)) != nil {
+			return 1
+		}
+	}
+	return 0
+}
+
+//Restore replays dumped records through raft. The records of a full dump start on
+//an empty namespace, the block groups volmgr set up are overwritten by the dumped ones.
+func (ns *nameSpace) Restore(full bool, chunkID uint64, inodeID uint64, records []*mp.MetaRecord) int32 {
+
+	defer catchPanic()
+
+	if full {
+		allMap, err := ns.RaftGroup.DentryGetAll(ns.RaftGroupID)
+		if err != nil {
+			return 1
+		}
+		ns.RaftGroup.DentryLocker.RLock()
+		n := len(*allMap)
+		ns.RaftGroup.DentryLocker.RUnlock()
+		if n != 0 {
+			return 39 /*ENOTEMPTY*/
+		}
+	}
+
+	var ops []*kvp.Kv
+	flush := func() int32 {
+		if len(ops) == 0 {
+			return 0
+		}
+		if err := ns.RaftGroup.Batch(ns.RaftGroupID, ops); err != nil {
+			logger.Error("Restore vol:%v err:%v", ns.VolID, err)
+			return 1
+		}
+		ops = nil
+		return 0
+	}
+	for _, r := range records {
+		if r.Opt == raftopt.OPT_BATCH {
+			// a transaction of the source stays one
+			if ret := flush(); ret != 0 {
+				return ret
+			}
+			for _, op := range r.Batch {
+				if kv := recordToKv(op); kv != nil {
+					ops = append(ops, kv)
+				}
+			}
+			if ret := flush(); ret != 0 {
+				return ret
+			}
+			continue
+		}
+		if kv := recordToKv(r); kv != nil {
+			ops = append(ops, kv)
+		}
+		if len(ops) >= restoreBatchLen {
+			if ret := flush(); ret != 0 {
+				return ret
+			}
+		}
+	}
+	if ret := flush(); ret != 0 {
+		return ret
+	}
+	if err := ns.RaftGroup.RaiseIDs(ns.RaftGroupID, chunkID, inodeID); err != nil {
+		logger.Error("Restore vol:%v raise ids err:%v", ns.VolID, err)
+		return 1
+	}
+
+	// the leader only tables are rebuilt from the restored namespace, the usage
+	// records came along unless the dump is older than them
+	ns.usage.Lock()
+	ns.usage.built = false
+	ns.usage.Unlock()
+	ns.trashMu.Lock()
+	ns.trashDirs = nil
+	ns.trashMu.Unlock()
+	ns.capacity.mu.Lock()
+	ns.capacity.spaceAt = time.Time{}
+	ns.capacity.mu.Unlock()
+	return 0
+}
@@ -0,0 +1,188 @@
+package namespace
+
+import (
+	pbproto "github.com/golang/protobuf/proto"
+	"github.com/ipdcode/containerfs/logger"
+	dp "github.com/ipdcode/containerfs/proto/dp"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"github.com/ipdcode/containerfs/utils"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fenceKey the dentry holding the mp.FenceState of the namespace, kept through raft
+// so a fence outlives a leader change
+const fenceKey = "fence"
+
+// fenceState cache of the fence dentry
+type fenceState struct {
+	mu      sync.Mutex
+	raw     string
+	fenced  bool
+	revoked map[string]bool
+
+	pushMu sync.Mutex // a round of pushFence
+	pushes int64      // the last push started, an older one gives up
+}
+
+func (ns *nameSpace) loadFence() (mp.FenceState, bool) {
+	st := mp.FenceState{}
+	v, err := ns.RaftGroup.DentryGet(ns.RaftGroupID, fenceKey)
+	if err != nil {
+		return st, false
+	}
+	if err := pbproto.Unmarshal(v, &st); err != nil {
+		logger.Error("vol:%v bad fence state: %v", ns.VolID, err)
+		return st, false
+	}
+	return st, true
+}
+
+//Admits whether the ops of the client go through: not for a client evicted, nor
+//for any client while the namespace is fenced. The admin tools send no client id.
+func (ns *nameSpace) Admits(clientID string) bool {
+	if clientID == "" {
+		return true
+	}
+	v, err := ns.RaftGroup.DentryGet(ns.RaftGroupID, fenceKey)
+	if err != nil {
+		return true
+	}
+	f := &ns.fence
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if string(v) != f.raw {
+		st := mp.FenceState{}
+		if err := pbproto.Unmarshal(v, &st); err != nil {
+			logger.Error("vol:%v bad fence state: %v", ns.VolID, err)
+			return true
+		}
+		f.raw, f.fenced = string(v), st.Fenced
+		f.revoked = make(map[string]bool)
+		for _, id := range st.Revoked {
+			f.revoked[id] = true
+		}
+	}
+	return !f.fenced && !f.revoked[clientID]
+}
+
+//Admits : nameSpace.Admits for the namespace volID, true when it is not here
+func Admits(volID string, clientID string) bool {
+	ret, ns := GetNameSpace(volID)
+	if ret != 0 {
+		return true
+	}
+	return ns.Admits(clientID)
+}
+
+//Fence refuses the ops of clientID from now on, or with no clientID the ops of all
+//the clients while fenced is set: the clients with a session are evicted, they stay
+//out once the fence is lifted, the ones mounting meanwhile are refused.
+func (ns *nameSpace) Fence(clientID string, fenced bool) int32 {
+
+	defer catchPanic()
+
+	st, _ := ns.loadFence()
+	var evict []string
+	if clientID != "" {
+		evict = append(evict, clientID)
+	} else {
+		st.Fenced = fenced
+		if fenced {
+			for _, s := range ns.ListSessions() {
+				evict = append(evict, s.ClientID)
+			}
+		}
+	}
+	st.Revoked = append(st.Revoked, evict...)
+	val, _ := pbproto.Marshal(&st)
+	if err := ns.RaftGroup.DentrySet(ns.RaftGroupID, fenceKey, val); err != nil {
+		logger.Error("Fence vol:%v err:%v", ns.VolID, err)
+		return utils.NotLeader
+	}
+	go ns.pushFence(atomic.AddInt64(&ns.fence.pushes, 1), &dp.SetFenceReq{VolID: ns.VolID, Fenced: st.Fenced, Revoked: st.Revoked})
+
+	t := &ns.sessions
+	t.Lock()
+	t.init()
+	for _, id := range evict {
+		delete(t.clients, id)
+		ns.leases.drop(id)
+		logger.Error("vol:%v client %v evicted", ns.VolID, id)
+	}
+	t.Unlock()
+	if clientID == "" {
+		logger.Error("vol:%v fenced:%v", ns.VolID, fenced)
+	}
+	return 0
+}
+
+// fencePushRetries the rounds pushing a fence state to the datanodes that did not
+// take it, fencePushInterval apart
+const fencePushRetries = 30
+
+var fencePushInterval = 10 * time.Second
+
+// pushFence sends the fence state to the datanodes of the block groups of the
+// namespace, they refuse the writes of the clients fenced off too
+func (ns *nameSpace) pushFence(seq int64, req *dp.SetFenceReq) {
+	todo := make(map[string]bool)
+	ns.RaftGroup.BlockGroupLocker.RLock()
+	bgmap, err := ns.BlockGroupDBGetAll()
+	if err == nil {
+		var blockGroup mp.BlockGroup
+		for _, v := range *bgmap {
+			if err := pbproto.Unmarshal(v, &blockGroup); err != nil {
+				continue
+			}
+			for _, b := range blockGroup.BlockInfos {
+				todo[utils.InetNtoa(b.DataNodeIP).String()+":"+strconv.Itoa(int(b.DataNodePort))] = true
+			}
+		}
+	}
+	ns.RaftGroup.BlockGroupLocker.RUnlock()
+	if err != nil {
+		logger.Error("push fence vol:%v, block groups err:%v", ns.VolID, err)
+		return
+	}
+	for i := 0; len(todo) > 0; i++ {
+		if i == fencePushRetries {
+			logger.Error("push fence vol:%v, datanodes %v left out", ns.VolID, todo)
+			return
+		}
+		if i > 0 {
+			time.Sleep(fencePushInterval)
+		}
+		if !ns.pushFenceRound(seq, req, todo) {
+			return
+		}
+	}
+}
+
+// pushFenceRound sends req to the datanodes of todo and drops those taking it, false
+// once a newer push started
+func (ns *nameSpace) pushFenceRound(seq int64, req *dp.SetFenceReq, todo map[string]bool) bool {
+	f := &ns.fence
+	f.pushMu.Lock()
+	defer f.pushMu.Unlock()
+	for addr := range todo {
+		if atomic.LoadInt64(&f.pushes) != seq {
+			return false
+		}
+		conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Second))
+		if err != nil {
+			continue
+		}
+		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+		ack, err := dp.NewDataNodeClient(conn).SetFence(ctx, req)
+		conn.Close()
+		if err == nil && ack.Ret == 0 {
+			delete(todo, addr)
+		}
+	}
+	return true
+}
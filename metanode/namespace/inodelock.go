@@ -0,0 +1,79 @@
+package namespace
+
+import (
+	"sort"
+	"sync"
+)
+
+// An inode is read, changed and set back whole, by the writes, the attribute
+// changes and the background jobs alike: two of them at once would lose one of
+// the changes. They lock the inodes they set with lockInodes first, and read them
+// once they hold the locks. The locks of the inodes come before refMu and ns.Lock.
+
+type inodeLocks struct {
+	mu    sync.Mutex
+	locks map[uint64]*inodeLock
+}
+
+type inodeLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockInodes locks the inodes in their order, against the deadlock of two callers
+// locking the same ones, and returns the func unlocking them
+func (ns *nameSpace) lockInodes(inodes ...uint64) func() {
+	sorted := append([]uint64(nil), inodes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var held []*inodeLock
+	var ids []uint64
+	for i, inode := range sorted {
+		if i > 0 && inode == sorted[i-1] {
+			continue
+		}
+		l := ns.inodeLocks.get(inode)
+		l.Lock()
+		held = append(held, l)
+		ids = append(ids, inode)
+	}
+	return func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			held[i].Unlock()
+			ns.inodeLocks.put(ids[i], held[i])
+		}
+	}
+}
+
+func (t *inodeLocks) get(inode uint64) *inodeLock {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.locks == nil {
+		t.locks = make(map[uint64]*inodeLock)
+	}
+	l := t.locks[inode]
+	if l == nil {
+		l = &inodeLock{}
+		t.locks[inode] = l
+	}
+	l.refs++
+	return l
+}
+
+func (t *inodeLocks) put(inode uint64, l *inodeLock) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if l.refs--; l.refs == 0 {
+		delete(t.locks, inode)
+	}
+}
+
+// containsInode whether inode is one of inodes, of a caller checking an inode it
+// read again is still one it locked
+func containsInode(inodes []uint64, inode uint64) bool {
+	for _, i := range inodes {
+		if i == inode {
+			return true
+		}
+	}
+	return false
+}
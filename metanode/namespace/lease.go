@@ -0,0 +1,156 @@
+package namespace
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	"github.com/ipdcode/containerfs/utils"
+	"sync"
+	"time"
+)
+
+// LeaseTTL how long the leases of a client outlive its WatchLeases stream
+var LeaseTTL = 30 * time.Second
+
+// LeaseRevokeWait how long AcquireLease waits for conflicting holders to give
+// their leases back before taking them away
+var LeaseRevokeWait = 10 * time.Second
+
+// leaseTable read and write leases of the files of a volume, kept in memory on
+// the leader only: after a leader change the clients reconnect and drop theirs
+type leaseTable struct {
+	sync.Mutex
+	inodes  map[uint64]map[string]bool // holders of each inode, true for a write lease
+	clients map[string]*leaseClient
+}
+
+type leaseClient struct {
+	revoke chan uint64 // nil while the client is not watching
+	lost   time.Time   // when it stopped watching
+}
+
+func (t *leaseTable) init() {
+	if t.inodes == nil {
+		t.inodes = make(map[uint64]map[string]bool)
+		t.clients = make(map[string]*leaseClient)
+	}
+}
+
+// alive drops the clients that stopped watching more than LeaseTTL ago with their leases
+func (t *leaseTable) alive(clientID string) bool {
+	c, ok := t.clients[clientID]
+	if !ok {
+		return false
+	}
+	if c.revoke != nil || time.Since(c.lost) < LeaseTTL {
+		return true
+	}
+	delete(t.clients, clientID)
+	for _, holders := range t.inodes {
+		delete(holders, clientID)
+	}
+	return false
+}
+
+// drop takes all the leases of clientID away
+func (t *leaseTable) drop(clientID string) {
+	t.Lock()
+	defer t.Unlock()
+	t.init()
+	delete(t.clients, clientID)
+	for inode, holders := range t.inodes {
+		delete(holders, clientID)
+		if len(holders) == 0 {
+			delete(t.inodes, inode)
+		}
+	}
+}
+
+//AcquireLease : grants clientID a read or write lease on inode, conflicting
+//holders are asked to give theirs back. A holder still alive after LeaseRevokeWait
+//keeps its lease, the caller gets utils.LeaseHeld: taking it away would let two
+//writers at the file at once. A client whose session was revoked gets none.
+func (ns *nameSpace) AcquireLease(inode uint64, clientID string, write bool) int32 {
+	if !ns.Admits(clientID) {
+		return utils.SessionRevoked
+	}
+	t := &ns.leases
+	deadline := time.Now().Add(LeaseRevokeWait)
+	revoked := make(map[string]bool)
+	for {
+		t.Lock()
+		t.init()
+		holders := t.inodes[inode]
+		var conflicts []string
+		for id, w := range holders {
+			if id == clientID || !t.alive(id) || !(write || w) {
+				continue
+			}
+			conflicts = append(conflicts, id)
+			if c := t.clients[id]; c.revoke != nil && !revoked[id] {
+				select {
+				case c.revoke <- inode:
+					revoked[id] = true
+				default:
+				}
+			}
+		}
+		if len(conflicts) > 0 && time.Now().After(deadline) {
+			t.Unlock()
+			logger.Error("lease of inode %v held by %v, refused to %v", inode, conflicts, clientID)
+			return utils.LeaseHeld
+		}
+		if len(conflicts) == 0 {
+			if holders == nil {
+				holders = make(map[string]bool)
+				t.inodes[inode] = holders
+			}
+			holders[clientID] = holders[clientID] || write
+			if _, ok := t.clients[clientID]; !ok {
+				t.clients[clientID] = &leaseClient{lost: time.Now()}
+			}
+			t.Unlock()
+			return 0
+		}
+		t.Unlock()
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+//ReleaseLease ...
+func (ns *nameSpace) ReleaseLease(inode uint64, clientID string) int32 {
+	t := &ns.leases
+	t.Lock()
+	defer t.Unlock()
+	t.init()
+	if holders, ok := t.inodes[inode]; ok {
+		delete(holders, clientID)
+		if len(holders) == 0 {
+			delete(t.inodes, inode)
+		}
+	}
+	return 0
+}
+
+//WatchLeases : the channel gets the inodes whose lease clientID must give back,
+//the leases outlive cancel by LeaseTTL so a client can reconnect
+func (ns *nameSpace) WatchLeases(clientID string) (<-chan uint64, func()) {
+	t := &ns.leases
+	ch := make(chan uint64, changeQueueLen)
+	t.Lock()
+	t.init()
+	c, ok := t.clients[clientID]
+	if !ok {
+		c = &leaseClient{}
+		t.clients[clientID] = c
+	}
+	c.revoke = ch
+	t.Unlock()
+	cancel := func() {
+		t.Lock()
+		if c.revoke == ch {
+			c.revoke = nil
+			c.lost = time.Now()
+		}
+		t.Unlock()
+	}
+	return ch, cancel
+}
@@ -0,0 +1,311 @@
+package namespace
+
+import (
+	"fmt"
+	"github.com/ipdcode/containerfs/logger"
+	dp "github.com/ipdcode/containerfs/proto/dp"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"github.com/ipdcode/containerfs/utils"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A dir may carry lifecycle rules for the files below it, as delete:30d,archive:7d.
+// The leader walks the tree every LifecycleInterval: a file not modified for the
+// age of a delete rule is deleted (to the trash when the volume keeps one), a file
+// neither read nor modified for the age of an archive rule has its chunks moved to
+// the archive bucket of the datanodes. The rules of a dir hold for its subtree,
+// down to a dir with rules of its own.
+
+// LifecycleInterval ...
+var LifecycleInterval = utils.NewDuration(time.Hour)
+
+// lifecycle actions
+const (
+	LifecycleDelete  = "delete"
+	LifecycleArchive = "archive"
+)
+
+// lifecycleRule an action on the files older than age
+type lifecycleRule struct {
+	action string
+	age    time.Duration
+}
+
+// parseLifecycle action:age,... with the age in d, h or m; "none" or empty drops the rules
+func parseLifecycle(s string) ([]lifecycleRule, error) {
+	var rules []lifecycleRule
+	if s == "" || s == "none" {
+		return nil, nil
+	}
+	for _, r := range strings.Split(s, ",") {
+		f := strings.SplitN(strings.TrimSpace(r), ":", 2)
+		if len(f) != 2 || (f[0] != LifecycleDelete && f[0] != LifecycleArchive) {
+			return nil, fmt.Errorf("lifecycle rule %q: want delete:<age> or archive:<age>", r)
+		}
+		age, err := parseAge(f[1])
+		if err != nil {
+			return nil, fmt.Errorf("lifecycle rule %q: %v", r, err)
+		}
+		rules = append(rules, lifecycleRule{action: f[0], age: age})
+	}
+	return rules, nil
+}
+
+// parseAge 30d, 12h or 90m
+func parseAge(s string) (time.Duration, error) {
+	if len(s) < 2 {
+		return 0, fmt.Errorf("bad age %q", s)
+	}
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("bad age %q", s)
+	}
+	switch s[len(s)-1] {
+	case 'd':
+		return time.Duration(n) * 24 * time.Hour, nil
+	case 'h':
+		return time.Duration(n) * time.Hour, nil
+	case 'm':
+		return time.Duration(n) * time.Minute, nil
+	}
+	return 0, fmt.Errorf("bad age %q", s)
+}
+
+//SetLifecycle the rules of the dir name of pinode, empty or none drops them
+func (ns *nameSpace) SetLifecycle(pinode uint64, name string, rules string) int32 {
+
+	defer catchPanic()
+
+	if _, err := parseLifecycle(rules); err != nil {
+		return 22 /*EINVAL*/
+	}
+	if rules == "none" {
+		rules = ""
+	}
+	inode := uint64(0)
+	if pinode != 0 || name != "" {
+		ok, dirent := ns.DentryDBGet(strconv.FormatUint(pinode, 10) + "-" + name)
+		if !ok {
+			return 2 /*ENOENT*/
+		}
+		if dirent.InodeType {
+			return 20 /*ENOTDIR*/
+		}
+		inode = dirent.Inode
+	}
+	defer ns.lockInodes(inode)()
+	ok, inodeInfo := ns.InodeDBGet(inode)
+	if !ok {
+		return 2 /*ENOENT*/
+	}
+	inodeInfo.Lifecycle = rules
+	stampCtime(inodeInfo, time.Now())
+	if err := ns.InodeDBSet(inode, inodeInfo); err != nil {
+		return 1
+	}
+	return 0
+}
+
+//GetLifecycle the rules of the dir name of pinode
+func (ns *nameSpace) GetLifecycle(pinode uint64, name string) (int32, string) {
+
+	defer catchPanic()
+
+	inode := uint64(0)
+	if pinode != 0 || name != "" {
+		ok, dirent := ns.DentryDBGet(strconv.FormatUint(pinode, 10) + "-" + name)
+		if !ok {
+			return 2 /*ENOENT*/, ""
+		}
+		inode = dirent.Inode
+	}
+	ok, inodeInfo := ns.InodeDBGet(inode)
+	if !ok {
+		return 2 /*ENOENT*/, ""
+	}
+	return 0, inodeInfo.Lifecycle
+}
+
+// lifecycleStats of a pass
+type lifecycleStats struct {
+	deleted  int
+	archived int
+	failed   int
+}
+
+// ApplyLifecycle runs the rules of the volume once
+func (ns *nameSpace) ApplyLifecycle() int32 {
+
+	defer catchPanic()
+
+	// a sharded volume is walked from the shard of the root
+	if !ns.owns(0) {
+		return 0
+	}
+	var rules []lifecycleRule
+	if ok, root := ns.InodeDBGet(0); ok {
+		rules, _ = parseLifecycle(root.Lifecycle)
+	}
+	children, err := ns.dirTree()
+	if err != nil {
+		return 1
+	}
+	if trash, ok := ns.trashInode(false); ok {
+		delete(children, trash)
+	}
+	var st lifecycleStats
+	ns.applyLifecycle(0, rules, children, 0, &st)
+	if st.deleted+st.archived+st.failed > 0 {
+		logger.Info("lifecycle vol:%v deleted:%v archived:%v failed:%v", ns.VolID, st.deleted, st.archived, st.failed)
+	}
+	if st.failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func (ns *nameSpace) applyLifecycle(dir uint64, rules []lifecycleRule, children map[uint64][]*mp.DirentN, depth int, st *lifecycleStats) {
+	if depth > usageMaxDepth {
+		return
+	}
+	for _, d := range children[dir] {
+		if !d.InodeType {
+			if _, ok := children[d.Inode]; !ok {
+				continue
+			}
+			sub := rules
+			if ok, info := ns.InodeDBGet(d.Inode); ok && info.Lifecycle != "" {
+				sub, _ = parseLifecycle(info.Lifecycle)
+			}
+			ns.applyLifecycle(d.Inode, sub, children, depth+1, st)
+			continue
+		}
+		if len(rules) != 0 {
+			ns.applyRules(dir, d, rules, st)
+		}
+	}
+}
+
+// applyRules to the file d of dir, a delete wins over an archive
+func (ns *nameSpace) applyRules(dir uint64, d *mp.DirentN, rules []lifecycleRule, st *lifecycleStats) {
+	ok, info := ns.InodeDBGet(d.Inode)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	modified := time.Unix(info.ModifiTime, 0)
+	used := modified
+	if info.AccessTime > info.ModifiTime {
+		used = time.Unix(info.AccessTime, 0)
+	}
+	for _, r := range rules {
+		if r.action == LifecycleDelete && now.Sub(modified) > r.age {
+			if ns.lifecycleDelete(dir, d.Name) != 0 {
+				st.failed++
+			} else {
+				st.deleted++
+			}
+			return
+		}
+	}
+	for _, r := range rules {
+		if r.action != LifecycleArchive || now.Sub(used) <= r.age || len(info.Chunks) == 0 {
+			continue
+		}
+		// archived since its last use
+		if info.ArchiveTime >= used.Unix() {
+			return
+		}
+		if !ns.archiveChunks(info.Chunks) {
+			st.failed++
+			return
+		}
+		if ns.setArchiveTime(d.Inode, info.ModifiTime, now) != 0 {
+			st.failed++
+			return
+		}
+		st.archived++
+		return
+	}
+}
+
+// setArchiveTime stamps the inode archived at t, unless it was written since its
+// chunks were archived: the next pass archives it again
+func (ns *nameSpace) setArchiveTime(inode uint64, modified int64, t time.Time) int32 {
+	defer ns.lockInodes(inode)()
+	ok, info := ns.InodeDBGet(inode)
+	if !ok {
+		return 2 /*ENOENT*/
+	}
+	if info.ModifiTime != modified {
+		return 0
+	}
+	info.ArchiveTime = t.Unix()
+	if err := ns.InodeDBSet(inode, info); err != nil {
+		return 1
+	}
+	return 0
+}
+
+// lifecycleDelete deletes the file as an unlink would, one still open is left to
+// its last close
+func (ns *nameSpace) lifecycleDelete(dir uint64, name string) int32 {
+	if ret, trashed := ns.TrashFile(dir, name); ret != 0 || trashed {
+		return ret
+	}
+	return ns.removeFile(dir, name)
+}
+
+// archiveChunks asks the datanodes of the chunks to archive them now, false if
+// one could not
+func (ns *nameSpace) archiveChunks(chunks []*mp.ChunkInfo) bool {
+	for _, c := range chunks {
+		ok, blockGroup := ns.BlockGroupDBGet(c.BlockGroupID)
+		if !ok {
+			continue
+		}
+		for _, b := range blockGroup.BlockInfos {
+			addr := utils.InetNtoa(b.DataNodeIP).String() + ":" + strconv.Itoa(int(b.DataNodePort))
+			conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Second))
+			if err != nil {
+				logger.Error("archive chunk %v, dial datanode %v failed:%v", c.ChunkID, addr, err)
+				return false
+			}
+			ctx, _ := context.WithTimeout(context.Background(), 10*time.Minute)
+			ack, err := dp.NewDataNodeClient(conn).ArchiveChunk(ctx, &dp.ArchiveChunkReq{
+				ChunkID:      c.ChunkID,
+				BlockID:      b.BlockID,
+				VolID:        ns.VolID,
+				BlockGroupID: c.BlockGroupID,
+			})
+			conn.Close()
+			if err != nil || ack.Ret != 0 {
+				logger.Error("archive chunk %v on %v failed, err:%v ack:%v", c.ChunkID, addr, err, ack)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+//RunLifecycle applies the lifecycle rules of the volumes this metanode leads, it never returns
+func RunLifecycle() {
+	for {
+		time.Sleep(LifecycleInterval.Get())
+		gMutex.RLock()
+		var all []*nameSpace
+		for _, v := range AllNameSpace {
+			all = append(all, v)
+		}
+		gMutex.RUnlock()
+		for _, v := range all {
+			if v.RaftGroup.IsLeader(v.RaftGroupID) {
+				v.ApplyLifecycle()
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package namespace
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	"github.com/ipdcode/containerfs/utils"
+)
+
+// frozenKey the dentry set while a migration freezes the namespace, its value is
+// the metadomain the volume moved to once the cutover is done. Being in the raft
+// state it holds across leader changes and goes along with the dumps.
+const frozenKey = "frozen"
+
+//Freeze makes the namespace read-only for the cutover of a migration, movedTo set
+//sends the clients to the metanodes of movedTo. on false thaws it.
+func (ns *nameSpace) Freeze(on bool, movedTo string) int32 {
+
+	defer catchPanic()
+
+	var err error
+	if on {
+		err = ns.RaftGroup.DentrySet(ns.RaftGroupID, frozenKey, []byte(movedTo))
+	} else {
+		err = ns.RaftGroup.DentryDel(ns.RaftGroupID, frozenKey)
+	}
+	if err != nil {
+		logger.Error("Freeze vol:%v on:%v moved to:%v err:%v", ns.VolID, on, movedTo, err)
+		return 1
+	}
+	logger.Info("Freeze vol:%v on:%v moved to:%v", ns.VolID, on, movedTo)
+	return 0
+}
+
+// frozen whether writes are refused and where the volume moved to
+func (ns *nameSpace) frozen() (bool, string) {
+	v, err := ns.RaftGroup.DentryGet(ns.RaftGroupID, frozenKey)
+	if err != nil {
+		return false, ""
+	}
+	return true, string(v)
+}
+
+//MovedTo the metadomain a migrated volume is served by now, empty when it is still here
+func (ns *nameSpace) MovedTo() string {
+	_, to := ns.frozen()
+	return to
+}
+
+//GetNameSpaceWriter : GetNameSpaceLeader for the ops changing the namespace, a frozen
+//namespace answers utils.ReadOnly
+func GetNameSpaceWriter(UUID string) (int32, *nameSpace) {
+	ret, ns := GetNameSpaceLeader(UUID)
+	if ret != 0 {
+		return ret, nil
+	}
+	if frozen, _ := ns.frozen(); frozen {
+		return utils.ReadOnly, nil
+	}
+	return 0, ns
+}
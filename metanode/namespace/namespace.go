@@ -5,8 +5,10 @@ import (
 	pbproto "github.com/golang/protobuf/proto"
 	"github.com/ipdcode/containerfs/logger"
 	"github.com/ipdcode/containerfs/metanode/raftopt"
+	kvp "github.com/ipdcode/containerfs/proto/kvp"
 	mp "github.com/ipdcode/containerfs/proto/mp"
 	vp "github.com/ipdcode/containerfs/proto/vp"
+	"github.com/ipdcode/containerfs/utils"
 	"github.com/ipdcode/raft"
 	"github.com/ipdcode/raft/proto"
 	"github.com/ipdcode/raft/storage/wal"
@@ -15,8 +17,8 @@ import (
 	"path"
 	"runtime/debug"
 	"strconv"
-	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -25,6 +27,8 @@ const (
 	BlockGroupSize = 10 * 1024 * 1024 * 1024
 	//ChunkSize 64MB
 	ChunkSize = 64 * 1024 * 1024
+	//InlineMaxSize largest file kept inline in its inode
+	InlineMaxSize = 64 * 1024
 )
 
 //VolMgrAddress ...
@@ -36,6 +40,30 @@ type nameSpace struct {
 	RaftGroupID uint64
 	RaftGroup   *raftopt.KvStateMachine
 	RaftStorage *wal.Storage
+
+	changeMu       sync.Mutex
+	changeWatchers map[chan *mp.ChangeEvent]bool
+
+	leases   leaseTable
+	sessions sessionTable
+	fence    fenceState
+
+	inodeLocks inodeLocks // see inodelock.go
+	refMu      sync.Mutex // the chunkref counts are read and set back, see dedup.go
+	rwoMu      sync.Mutex // the rwo holder, see access.go
+
+	trashMu     sync.Mutex
+	trashDirs   map[uint64]string // inodes of /.trash and its date dirs
+	trashLoaded time.Time
+
+	usage usageTable
+
+	orphans orphanTable
+
+	capacity capacityState
+
+	Shard int32 // of the volume, 0 for the namespace of an unsharded volume
+	shard shardState
 }
 
 //AllNameSpace ...
@@ -95,9 +123,9 @@ func initNameSpace(rs *raft.RaftServer, nameSpace *nameSpace, UUID string) int32
 	}
 
 	tmpInodeInfo := mp.InodeInfo{
-		AccessTime: time.Now().Unix(),
-		ModifiTime: time.Now().Unix(),
+		Generation: newGeneration(),
 	}
+	stampTimes(&tmpInodeInfo, time.Now())
 
 	err := nameSpace.InodeDBSet(0, &tmpInodeInfo)
 	if err != nil {
@@ -117,6 +145,7 @@ func CreateNameSpace(rs *raft.RaftServer, peers []proto.Peer, nodeID uint64, dir
 
 	nameSpace := nameSpace{}
 	nameSpace.VolID = UUID
+	_, nameSpace.Shard = utils.ParseShardVolID(UUID)
 	nameSpace.RaftGroupID = raftGroupID
 	nameSpace.RaftGroup, nameSpace.RaftStorage, err = createRaftGroup(rs, peers, nodeID, dir, UUID, nameSpace.RaftGroupID)
 	if err != nil {
@@ -131,7 +160,8 @@ func CreateNameSpace(rs *raft.RaftServer, peers []proto.Peer, nodeID uint64, dir
 	AllNameSpace[UUID] = &nameSpace
 	gMutex.Unlock()
 
-	if !IsLoad {
+	if !IsLoad && nameSpace.Shard == 0 {
+		// a new shard gets its namespace by a split
 		go initNameSpace(rs, &nameSpace, UUID)
 	}
 	return errno
@@ -155,18 +185,28 @@ func DeleteNameSpace(rs *raft.RaftServer, UUID string) int32 {
 
 	defer catchPanic()
 
-	ret, nameSpace := GetNameSpace(UUID)
-	if ret != 0 {
-		return 0
-	}
-	rs.RemoveRaft(nameSpace.RaftGroupID)
+	// with the shards of the volume
+	for _, id := range ShardsOf(UUID) {
+		ret, nameSpace := GetNameSpace(id)
+		if ret != 0 {
+			continue
+		}
+		rs.RemoveRaft(nameSpace.RaftGroupID)
 
-	gMutex.Lock()
-	delete(AllNameSpace, UUID)
-	gMutex.Unlock()
+		gMutex.Lock()
+		delete(AllNameSpace, id)
+		gMutex.Unlock()
+	}
 	return 0
 }
 
+//NameSpaceCount the namespaces loaded on this metanode
+func NameSpaceCount() int {
+	gMutex.RLock()
+	defer gMutex.RUnlock()
+	return len(AllNameSpace)
+}
+
 //GetNameSpace ...
 func GetNameSpace(UUID string) (int32, *nameSpace) {
 
@@ -182,35 +222,35 @@ func GetNameSpace(UUID string) (int32, *nameSpace) {
 	return -1, nil
 }
 
+//GetNameSpaceLeader : GetNameSpace for the ops served by the raft leader only, followers answer utils.NotLeader.
+//So does the leader of a volume that migrated away, the client looks up the leader again.
+func GetNameSpaceLeader(UUID string) (int32, *nameSpace) {
+	ret, ns := GetNameSpace(UUID)
+	if ret != 0 {
+		return ret, nil
+	}
+	if !ns.RaftGroup.IsLeader(ns.RaftGroupID) {
+		return utils.NotLeader, nil
+	}
+	if ns.MovedTo() != "" {
+		return utils.NotLeader, nil
+	}
+	return 0, ns
+}
+
 //GetFSInfo ...
 func (ns *nameSpace) GetFSInfo(volID string) mp.GetFSInfoAck {
 
 	defer catchPanic()
 
 	ack := mp.GetFSInfoAck{}
-	var totalSpace uint64
-	var freeSpace uint64
-
-	ns.RaftGroup.BlockGroupLocker.RLock()
-
-	bgmap, _ := ns.BlockGroupDBGetAll()
-
-	var blockGroup mp.BlockGroup
-
-	for _, v := range *bgmap {
-
-		err := pbproto.Unmarshal(v, &blockGroup)
-		if err != nil {
-			continue
-		}
-		totalSpace = totalSpace + BlockGroupSize
-		freeSpace = freeSpace + uint64(blockGroup.FreeSize)
-	}
-
-	ns.RaftGroup.BlockGroupLocker.RUnlock()
+	totalSpace, freeSpace := ns.space()
 
 	ack.TotalSpace = totalSpace
 	ack.FreeSpace = freeSpace
+	limits := ns.capacityLimits()
+	ack.SoftLimit = limits.Soft
+	ack.HardLimit = limits.Hard
 	ack.Ret = 0
 
 	return ack
@@ -222,6 +262,10 @@ func (ns *nameSpace) ExpandNameSpace(blockGroups []*mp.BlockGroup) int32 {
 	defer catchPanic()
 
 	for _, v := range blockGroups {
+		if ok, _ := ns.BlockGroupDBGet(v.BlockGroupID); ok {
+			// a repair sends them all, the space of those in use stays
+			continue
+		}
 		v.FreeSize = BlockGroupSize
 		err := ns.BlockGroupDBSet(v.BlockGroupID, v)
 		if err != nil {
@@ -277,32 +321,186 @@ func GetVolList() (int32, []*vp.VolIDs) {
 }
 
 //CreateDirDirect ...
-func (ns *nameSpace) CreateDirDirect(pinode uint64, name string) (int32, uint64) {
+func (ns *nameSpace) CreateDirDirect(pinode uint64, name string, uid uint32, gid uint32, mode uint32) (int32, uint64, *mp.InodeInfo) {
 
 	defer catchPanic()
 
 	/*update inode info*/
 	inodeID, err := ns.AllocateInodeID()
 	if err != nil {
-		return 2, 0
+		return 2, 0, nil
 	}
+	now := time.Now()
 	tmpInodeInfo := mp.InodeInfo{
-		AccessTime: time.Now().Unix(),
-		ModifiTime: time.Now().Unix(),
+		Uid:        uid,
+		Gid:        gid,
+		Mode:       inodeMode(false, mode),
+		Policy:     ns.inheritedPolicy(pinode),
+		Generation: newGeneration(),
+	}
+	stampTimes(&tmpInodeInfo, now)
+
+	defer ns.lockInodes(pinode)()
+	ops := append([]*kvp.Kv{
+		setInodeOp(inodeID, &tmpInodeInfo),
+		setDentryOp(strconv.FormatUint(pinode, 10)+"-"+name, false, inodeID),
+	}, ns.touchDirOps(now, pinode)...)
+	t := ns.beginUsage()
+	t.entry(pinode, &mp.Dirent{Inode: inodeID}, 1)
+	err = ns.RaftGroup.Batch(ns.RaftGroupID, append(ops, t.ops()...))
+	t.release()
+	if err != nil {
+		logger.Error("CreateDirDirect vol:%v pinode:%v name:%v err:%v", ns.VolID, pinode, name, err)
+		return 1, 0, nil
 	}
 
-	err = ns.InodeDBSet(inodeID, &tmpInodeInfo)
-	if err != nil {
-		return 1, 0
+	ns.notify(&mp.ChangeEvent{Op: ChangeCreate, PInode: pinode, Name: name, Inode: inodeID, Dir: true})
+	return 0, inodeID, &tmpInodeInfo
+}
+
+//WriteInline stores the whole content of a small file in its inode
+func (ns *nameSpace) WriteInline(pinode uint64, name string, data []byte) int32 {
+
+	defer catchPanic()
+
+	if len(data) > InlineMaxSize {
+		return 1
 	}
 
-	err = ns.DentryDBSet(strconv.FormatUint(pinode, 10)+"-"+name, false, inodeID)
+	ok, dirent := ns.DentryDBGet(strconv.FormatUint(pinode, 10) + "-" + name)
+	if !ok {
+		return 2 /*ENOENT*/
+	}
+	defer ns.lockInodes(dirent.Inode)()
+	ok, inodeInfo := ns.InodeDBGet(dirent.Inode)
+	if !ok {
+		return 2 /*ENOENT*/
+	}
+	if len(inodeInfo.Chunks) > 0 {
+		// already promoted to chunks
+		return 1
+	}
+
+	delta := int64(len(data)) - inodeInfo.FileSize
+	inodeInfo.InlineData = data
+	inodeInfo.FileSize = int64(len(data))
+	stampMtime(inodeInfo, time.Now())
+	t := ns.beginUsage()
+	t.add(pinode, delta, 0, 0)
+	err := ns.RaftGroup.Batch(ns.RaftGroupID, append(t.ops(), setInodeOp(dirent.Inode, inodeInfo)))
+	t.release()
 	if err != nil {
-		ns.InodeDBDelete(inodeID)
-		return 1, 0
+		logger.Error("WriteInline vol:%v inode:%v err:%v", ns.VolID, dirent.Inode, err)
+		return 1
 	}
+	ns.notify(&mp.ChangeEvent{Op: ChangeWrite, PInode: pinode, Name: name, Inode: dirent.Inode})
+	return 0
+}
 
-	return 0, inodeID
+//SetAccessTimes of the files in names of the dir pinode in a single raft entry, an
+//access time only moves forward. The names gone meanwhile are skipped.
+func (ns *nameSpace) SetAccessTimes(pinode uint64, names []string, times []int64) int32 {
+
+	defer catchPanic()
+
+	if len(names) != len(times) || len(names) > BatchMaxEntries {
+		return 22 /*EINVAL*/
+	}
+
+	inodes := make([]uint64, len(names))
+	for i, name := range names {
+		if ok, dirent := ns.DentryDBGet(strconv.FormatUint(pinode, 10) + "-" + name); ok && dirent.InodeType {
+			inodes[i] = dirent.Inode
+		}
+	}
+	defer ns.lockInodes(inodes...)()
+
+	var ops []*kvp.Kv
+	for i := range names {
+		if inodes[i] == 0 {
+			continue
+		}
+		ok, inodeInfo := ns.InodeDBGet(inodes[i])
+		if !ok || inodeInfo.AccessTime >= times[i] {
+			continue
+		}
+		inodeInfo.AccessTime, inodeInfo.AccessTimeNsec = times[i], 0
+		ops = append(ops, setInodeOp(inodes[i], inodeInfo))
+	}
+	if len(ops) == 0 {
+		return 0
+	}
+	if err := ns.RaftGroup.Batch(ns.RaftGroupID, ops); err != nil {
+		logger.Error("SetAccessTimes vol:%v pinode:%v names:%v err:%v", ns.VolID, pinode, len(ops), err)
+		return 1
+	}
+	return 0
+}
+
+//SetOwner of the entry name of the dir pinode, the uid and the gid only when set
+func (ns *nameSpace) SetOwner(pinode uint64, name string, uid uint32, gid uint32, setUID bool, setGID bool) int32 {
+
+	defer catchPanic()
+
+	ok, dirent := ns.DentryDBGet(strconv.FormatUint(pinode, 10) + "-" + name)
+	if !ok {
+		return 2 /*ENOENT*/
+	}
+	defer ns.lockInodes(dirent.Inode)()
+	ok, inodeInfo := ns.InodeDBGet(dirent.Inode)
+	if !ok {
+		return 2 /*ENOENT*/
+	}
+	if setUID {
+		inodeInfo.Uid = uid
+	}
+	if setGID {
+		inodeInfo.Gid = gid
+	}
+	stampCtime(inodeInfo, time.Now())
+	if err := ns.InodeDBSet(dirent.Inode, inodeInfo); err != nil {
+		return 1
+	}
+	return 0
+}
+
+// modeType the type bits of st_mode of a file or a dir
+func modeType(file bool) uint32 {
+	if file {
+		return syscall.S_IFREG
+	}
+	return syscall.S_IFDIR
+}
+
+// inodeMode the st_mode kept in InodeInfo.Mode of a new file or dir created with
+// mode: with the type a chmod 0 is not taken for no mode. 0 keeps the default.
+func inodeMode(file bool, mode uint32) uint32 {
+	if mode == 0 {
+		return 0
+	}
+	return modeType(file) | mode&07777
+}
+
+//SetMode of the entry name of the dir pinode, mode the permission bits
+func (ns *nameSpace) SetMode(pinode uint64, name string, mode uint32) int32 {
+
+	defer catchPanic()
+
+	ok, dirent := ns.DentryDBGet(strconv.FormatUint(pinode, 10) + "-" + name)
+	if !ok {
+		return 2 /*ENOENT*/
+	}
+	defer ns.lockInodes(dirent.Inode)()
+	ok, inodeInfo := ns.InodeDBGet(dirent.Inode)
+	if !ok {
+		return 2 /*ENOENT*/
+	}
+	inodeInfo.Mode = modeType(dirent.InodeType) | mode&07777
+	stampCtime(inodeInfo, time.Now())
+	if err := ns.InodeDBSet(dirent.Inode, inodeInfo); err != nil {
+		return 1
+	}
+	return 0
 }
 
 //GetInodeInfoDirect ...
@@ -315,7 +513,7 @@ func (ns *nameSpace) GetInodeInfoDirect(pinode uint64, name string) (int32, *mp.
 
 	ok, dirent := ns.DentryDBGet(strconv.FormatUint(pinode, 10) + "-" + name)
 	if !ok {
-		return -1, nil, 0
+		return 2 /*ENOENT*/, nil, 0
 	}
 
 	if ok, pInodeInfo = ns.InodeDBGet(dirent.Inode); !ok {
@@ -339,108 +537,320 @@ func (ns *nameSpace) StatDirect(pinode uint64, name string) (bool, uint64, int32
 	return dirent.InodeType, dirent.Inode, 0
 }
 
+//Generation the generation of inode, 0 when it is not in the namespace
+func (ns *nameSpace) Generation(inode uint64) uint64 {
+	if ok, inodeInfo := ns.InodeDBGet(inode); ok {
+		return inodeInfo.Generation
+	}
+	return 0
+}
+
 //ListDirect ...
 func (ns *nameSpace) ListDirect(pinode uint64) ([]*mp.DirentN, int32) {
+	dirents, _, ret := ns.ListDirectPage(pinode, "", 0)
+	return dirents, ret
+}
 
-	//defer catchPanic()
+//ListDirectPage lists up to limit entries named after marker in name order,
+//next is the marker of the following page, empty when the dir is done.
+//limit 0 returns the whole dir.
+func (ns *nameSpace) ListDirectPage(pinode uint64, marker string, limit int) (dirents []*mp.DirentN, next string, ret int32) {
 
-	var tmpDirents []*mp.DirentN
+	//defer catchPanic()
 
 	pinodePrefix := strconv.FormatUint(pinode, 10) + "-"
 
-	allMap, _ := ns.RaftGroup.DentryGetAll(ns.RaftGroupID)
-
-	ns.RaftGroup.DentryLocker.RLock()
-	for k, v := range *allMap {
-
-		idex := strings.Index(k, "-")
-		runes := []rune(k)
-
-		if string(runes[0:idex+1]) == pinodePrefix {
-
-			name := string(runes[idex+1:])
+	more, _ := ns.RaftGroup.DentryRange(ns.RaftGroupID, pinodePrefix, marker, limit, func(name string, v []byte) {
+		dirent := mp.Dirent{}
+		pbproto.Unmarshal(v, &dirent)
+		dirents = append(dirents, &mp.DirentN{Name: name, Inode: dirent.Inode, InodeType: dirent.InodeType})
+	})
+	if more && len(dirents) > 0 {
+		next = dirents[len(dirents)-1].Name
+	}
+	return dirents, next, 0
+}
 
-			dirent := mp.Dirent{}
-			pbproto.Unmarshal(v, &dirent)
+//ListWithAttrs ListDirectPage with the inode info of each entry, a readdirplus in
+//one call. infos[i] is the info of dirents[i], nil when its inode is gone.
+func (ns *nameSpace) ListWithAttrs(pinode uint64, marker string, limit int) (dirents []*mp.DirentN, infos []*mp.InodeInfo, next string, ret int32) {
 
-			direntN := mp.DirentN{Name: name, Inode: dirent.Inode, InodeType: dirent.InodeType}
-			tmpDirents = append(tmpDirents, &direntN)
+	defer catchPanic()
 
+	dirents, next, ret = ns.ListDirectPage(pinode, marker, limit)
+	if ret != 0 {
+		return nil, nil, "", ret
+	}
+	infos = make([]*mp.InodeInfo, len(dirents))
+	for i, v := range dirents {
+		if ok, info := ns.InodeDBGet(v.Inode); ok {
+			// the chunks stay on the metanode, Attr needs none of them
+			info.Chunks = nil
+			infos[i] = info
 		}
 	}
-	ns.RaftGroup.DentryLocker.RUnlock()
-
-	return tmpDirents, 0
+	return dirents, infos, next, 0
 }
 
-//DeleteDirDirect ...
+//DeleteDirDirect removes an empty dir, ENOTEMPTY otherwise. The entries of a dir kept
+//by another shard are looked up there.
 func (ns *nameSpace) DeleteDirDirect(pinode uint64, name string) int32 {
 
 	defer catchPanic()
 
-	ok, dirent := ns.DentryDBGet(strconv.FormatUint(pinode, 10) + "-" + name)
+	dentryKey := strconv.FormatUint(pinode, 10) + "-" + name
+	ok, dirent := ns.DentryDBGet(dentryKey)
 	if !ok {
+		return 2 /*ENOENT*/
+	}
+	if dirent.InodeType {
+		return 20 /*ENOTDIR*/
+	}
+	// with the trash on the dir goes there, the files of an rm -r restored later
+	// come back in it
+	var dateInode uint64
+	if ns.keepsTrash(pinode) {
+		if ret, inode := ns.trashDateDir(); ret == 0 {
+			dateInode = inode
+		}
+	}
+	defer ns.lockInodes(pinode, dirent.Inode)()
+	if ret := ns.dirEmpty(dirent.Inode); ret != 0 {
+		return ret
+	}
+	ops := []*kvp.Kv{{Opt: raftopt.OPT_DEL_INODE, K: strconv.FormatUint(dirent.Inode, 10)}}
+	if dateInode != 0 {
+		ops = []*kvp.Kv{trashOp(dateInode, pinode, name, dirent)}
+	}
+	ops = append(ops, &kvp.Kv{Opt: raftopt.OPT_DEL_DENTRY, K: dentryKey})
+	ops = append(ops, ns.touchDirOps(time.Now(), pinode)...)
+	t := ns.beginUsage()
+	if dateInode != 0 {
+		t.entry(pinode, dirent, -1)
+		t.entry(dateInode, dirent, 1)
+	} else {
+		t.rmdir(pinode, dirent.Inode)
+	}
+	err := ns.RaftGroup.Batch(ns.RaftGroupID, append(ops, t.ops()...))
+	t.release()
+	if err != nil {
+		logger.Error("DeleteDirDirect vol:%v %v err:%v", ns.VolID, dentryKey, err)
 		return 1
 	}
-	ns.InodeDBDelete(dirent.Inode)
-	ns.DentryDBDelete(strconv.FormatUint(pinode, 10) + "-" + name)
 
+	ns.notify(&mp.ChangeEvent{Op: ChangeRemove, PInode: pinode, Name: name, Inode: dirent.Inode, Dir: true})
 	return 0
 }
 
-//RenameDirect ...
-func (ns *nameSpace) RenameDirect(oldpinode uint64, oldName string, newpinode uint64, newName string) int32 {
+// reclaimPrefix dentries of files replaced by a rename of an older metanode, left to
+// the client to reclaim; loadOrphans turns them into orphans
+const reclaimPrefix = "reclaim-"
+
+func setDentryOp(dentryKey string, inodeType bool, inode uint64) *kvp.Kv {
+	val, _ := pbproto.Marshal(&mp.Dirent{InodeType: inodeType, Inode: inode})
+	return &kvp.Kv{Opt: raftopt.OPT_SET_DENTRY, K: dentryKey, V: val}
+}
+
+func setInodeOp(inode uint64, info *mp.InodeInfo) *kvp.Kv {
+	val, _ := pbproto.Marshal(info)
+	return &kvp.Kv{Opt: raftopt.OPT_SET_INODE, K: strconv.FormatUint(inode, 10), V: val}
+}
+
+//RenameDirect moves the dentry, an existing target is replaced in the same raft entry
+//unless noReplace. A replaced file goes to the trash when it is on, else under its
+//orphan dentry, reclaimed once no client has it open.
+func (ns *nameSpace) RenameDirect(oldpinode uint64, oldName string, newpinode uint64, newName string, noReplace bool) int32 {
 
 	defer catchPanic()
 
+	if !ns.owns(newpinode) {
+		// the dirs are in different shards, the caller copies
+		return 18 /*EXDEV*/
+	}
+
 	oldDentryKey := strconv.FormatUint(oldpinode, 10) + "-" + oldName
 	newDentryKey := strconv.FormatUint(newpinode, 10) + "-" + newName
 
 	ok, dirent := ns.DentryDBGet(oldDentryKey)
 	if !ok {
-		return 1
+		return 2 /*ENOENT*/
+	}
+	// the inode is set whole for its ctime, the dirs for theirs, the target deleted
+	locked := []uint64{oldpinode, newpinode, dirent.Inode}
+	var trashInode uint64
+	if ok, target := ns.DentryDBGet(newDentryKey); ok {
+		locked = append(locked, target.Inode)
+		if target.InodeType && !noReplace && ns.keepsTrash(newpinode) {
+			if ret, inode := ns.trashDateDir(); ret == 0 {
+				trashInode = inode
+			}
+		}
+	}
+	defer ns.lockInodes(locked...)()
+	if ok, d := ns.DentryDBGet(oldDentryKey); !ok || d.Inode != dirent.Inode {
+		// renamed or removed meanwhile
+		return 2 /*ENOENT*/
 	}
 
-	err := ns.DentryDBSet(newDentryKey, dirent.InodeType, dirent.Inode)
+	ops := []*kvp.Kv{
+		setDentryOp(newDentryKey, dirent.InodeType, dirent.Inode),
+		{Opt: raftopt.OPT_DEL_DENTRY, K: oldDentryKey},
+	}
+	now := time.Now()
+	if ok, info := ns.InodeDBGet(dirent.Inode); ok {
+		stampCtime(info, now)
+		ops = append(ops, setInodeOp(dirent.Inode, info))
+	}
+	ops = append(ops, ns.touchDirOps(now, oldpinode, newpinode)...)
+	var replaced uint64
+	ok, target := ns.DentryDBGet(newDentryKey)
+	if ok {
+		if target.Inode == dirent.Inode {
+			return 0
+		}
+		if noReplace {
+			return 17 /*EEXIST*/
+		}
+		if !containsInode(locked, target.Inode) {
+			return 11 /*EAGAIN*/
+		}
+		replaced = target.Inode
+		if !target.InodeType {
+			if dirent.InodeType {
+				return 21 /*EISDIR*/
+			}
+			if ret := ns.dirEmpty(target.Inode); ret != 0 {
+				return ret
+			}
+			ops = append(ops, &kvp.Kv{Opt: raftopt.OPT_DEL_INODE, K: strconv.FormatUint(target.Inode, 10)})
+		} else {
+			if !dirent.InodeType {
+				return 20 /*ENOTDIR*/
+			}
+			if trashInode != 0 {
+				ops = append(ops, trashOp(trashInode, newpinode, newName, target))
+			} else {
+				ops = append(ops, orphanOp(target.Inode))
+			}
+		}
+	}
+
+	t := ns.beginUsage()
+	if replaced != 0 {
+		if target.InodeType {
+			t.entry(newpinode, target, -1)
+			if trashInode != 0 {
+				t.entry(trashInode, target, 1)
+			}
+		} else {
+			t.rmdir(newpinode, target.Inode)
+		}
+	}
+	t.entry(oldpinode, dirent, -1)
+	t.entry(newpinode, dirent, 1)
+	err := ns.RaftGroup.Batch(ns.RaftGroupID, append(ops, t.ops()...))
+	t.release()
 	if err != nil {
+		logger.Error("Rename vol:%v %v to %v err:%v", ns.VolID, oldDentryKey, newDentryKey, err)
 		return 1
 	}
-	err = ns.DentryDBDelete(oldDentryKey)
+	if replaced != 0 && target.InodeType && trashInode == 0 {
+		ns.orphaned([]uint64{target.Inode})
+	}
+	if replaced != 0 {
+		ns.notify(&mp.ChangeEvent{Op: ChangeRemove, PInode: newpinode, Name: newName, Inode: replaced, Dir: !dirent.InodeType})
+	}
+	ns.notify(&mp.ChangeEvent{Op: ChangeRename, PInode: oldpinode, Name: oldName, Inode: dirent.Inode, NewPInode: newpinode, NewName: newName, Dir: !dirent.InodeType})
+	return 0
+}
+
+//ReclaimInode drops a file replaced by a rename once the client deleted its chunks, for
+//the clients of the reclaim dentries
+func (ns *nameSpace) ReclaimInode(inode uint64) int32 {
+
+	defer catchPanic()
+
+	reclaimKey := reclaimPrefix + strconv.FormatUint(inode, 10)
+	if ok, _ := ns.DentryDBGet(reclaimKey); !ok {
+		return 2 /*ENOENT*/
+	}
+	ok, pInodeInfo := ns.InodeDBGet(inode)
+	var chunks []*mp.ChunkInfo
+	if ok {
+		chunks = pInodeInfo.Chunks
+	}
+	ns.refMu.Lock()
+	ops, shared := ns.unrefChunks(chunks)
+	ops = append(ops,
+		&kvp.Kv{Opt: raftopt.OPT_DEL_DENTRY, K: reclaimKey},
+		&kvp.Kv{Opt: raftopt.OPT_DEL_INODE, K: strconv.FormatUint(inode, 10)},
+	)
+	err := ns.RaftGroup.Batch(ns.RaftGroupID, ops)
+	ns.refMu.Unlock()
 	if err != nil {
-		ns.DentryDBDelete(newDentryKey)
+		logger.Error("ReclaimInode vol:%v inode:%v err:%v", ns.VolID, inode, err)
 		return 1
 	}
+	ns.releaseChunks(chunks, shared)
 	return 0
 }
 
+//ChunksWithBG resolves the block groups of chunks, those of a missing block group are left out
+func (ns *nameSpace) ChunksWithBG(chunkInfos []*mp.ChunkInfo) []*mp.ChunkInfoWithBG {
+	var out []*mp.ChunkInfoWithBG
+	for _, v := range chunkInfos {
+		ok, blockGroup := ns.BlockGroupDBGet(v.BlockGroupID)
+		if !ok {
+			continue
+		}
+		out = append(out, &mp.ChunkInfoWithBG{
+			ChunkID:    v.ChunkID,
+			ChunkSize:  v.ChunkSize,
+			Status:     v.Status,
+			BlockGroup: blockGroup,
+			Shared:     ns.chunkRefs(v.ChunkID) > 1,
+		})
+	}
+	return out
+}
+
 //CreateFileDirect ...
-func (ns *nameSpace) CreateFileDirect(pinode uint64, name string) (int32, uint64) {
+func (ns *nameSpace) CreateFileDirect(pinode uint64, name string, uid uint32, gid uint32, mode uint32) (int32, uint64, *mp.InodeInfo) {
 
 	defer catchPanic()
 
 	/*update inode info*/
 	inodeID, err := ns.AllocateInodeID()
 	if err != nil {
-		return 1, 0
+		return 1, 0, nil
 	}
+	now := time.Now()
 	tmpInodeInfo := mp.InodeInfo{
-		AccessTime: time.Now().Unix(),
-		ModifiTime: time.Now().Unix(),
-	}
-
-	err = ns.InodeDBSet(inodeID, &tmpInodeInfo)
-	if err != nil {
-		return 1, 0
+		Uid:        uid,
+		Gid:        gid,
+		Mode:       inodeMode(true, mode),
+		Policy:     ns.inheritedPolicy(pinode),
+		Generation: newGeneration(),
 	}
+	stampTimes(&tmpInodeInfo, now)
 
 	tmpKey := strconv.FormatUint(pinode, 10) + "-" + name
-	err = ns.DentryDBSet(tmpKey, true, inodeID)
+	defer ns.lockInodes(pinode)()
+	ops := append([]*kvp.Kv{
+		setInodeOp(inodeID, &tmpInodeInfo),
+		setDentryOp(tmpKey, true, inodeID),
+	}, ns.touchDirOps(now, pinode)...)
+	t := ns.beginUsage()
+	t.add(pinode, 0, 1, 0)
+	err = ns.RaftGroup.Batch(ns.RaftGroupID, append(ops, t.ops()...))
+	t.release()
 	if err != nil {
-		ns.InodeDBDelete(inodeID)
-		return 1, 0
+		logger.Error("CreateFileDirect vol:%v %v err:%v", ns.VolID, tmpKey, err)
+		return 1, 0, nil
 	}
 
-	return 0, inodeID
+	ns.notify(&mp.ChangeEvent{Op: ChangeCreate, PInode: pinode, Name: name, Inode: inodeID})
+	return 0, inodeID, &tmpInodeInfo
 }
 
 //DeleteFileDirect ...
@@ -448,22 +858,35 @@ func (ns *nameSpace) DeleteFileDirect(pinode uint64, name string) int32 {
 
 	defer catchPanic()
 
-	ok, dirent := ns.DentryDBGet(strconv.FormatUint(pinode, 10) + "-" + name)
+	dentryKey := strconv.FormatUint(pinode, 10) + "-" + name
+	ok, dirent := ns.DentryDBGet(dentryKey)
 	if !ok {
 		return 1
 	}
+	defer ns.lockInodes(pinode, dirent.Inode)()
 	ok, pInodeInfo := ns.InodeDBGet(dirent.Inode)
 	if !ok {
 		return 1
 	}
 
-	for _, v := range pInodeInfo.Chunks {
-		ns.ReleaseBlockGroup(v.BlockGroupID, v.ChunkSize)
+	ns.refMu.Lock()
+	ops, shared := ns.unrefChunks(pInodeInfo.Chunks)
+	ops = append(ops,
+		&kvp.Kv{Opt: raftopt.OPT_DEL_INODE, K: strconv.FormatUint(dirent.Inode, 10)},
+		&kvp.Kv{Opt: raftopt.OPT_DEL_DENTRY, K: dentryKey})
+	ops = append(ops, ns.touchDirOps(time.Now(), pinode)...)
+	t := ns.beginUsage()
+	t.add(pinode, -pInodeInfo.FileSize, -1, 0)
+	err := ns.RaftGroup.Batch(ns.RaftGroupID, append(ops, t.ops()...))
+	t.release()
+	ns.refMu.Unlock()
+	if err != nil {
+		logger.Error("DeleteFileDirect vol:%v inode:%v err:%v", ns.VolID, dirent.Inode, err)
+		return 1
 	}
+	ns.releaseChunks(pInodeInfo.Chunks, shared)
 
-	ns.InodeDBDelete(dirent.Inode)
-	ns.DentryDBDelete(strconv.FormatUint(pinode, 10) + "-" + name)
-
+	ns.notify(&mp.ChangeEvent{Op: ChangeRemove, PInode: pinode, Name: name, Inode: dirent.Inode})
 	return 0
 }
 
@@ -483,8 +906,9 @@ func (ns *nameSpace) GetFileChunksDirect(pinode uint64, name string) (int32, []*
 	return 0, pInodeInfo.Chunks, dirent.Inode
 }
 
-//AllocateChunk ...
-func (ns *nameSpace) AllocateChunk(pinode uint64, name string) (int32, *mp.ChunkInfo) {
+//AllocateChunk a chunk for the file, in a block group by its policy, and the copies
+//of it to write, 0 for all
+func (ns *nameSpace) AllocateChunk(pinode uint64, name string, detached bool) (int32, *mp.ChunkInfo, int32) {
 
 	defer catchPanic()
 
@@ -497,20 +921,29 @@ func (ns *nameSpace) AllocateChunk(pinode uint64, name string) (int32, *mp.Chunk
 	ok, dirent := ns.DentryDBGet(key)
 	if !ok {
 		ret = 2 /*ENOENT*/
-		return ret, nil
+		return ret, nil, 0
 	}
+	// the stripes of a writer allocate and sync chunks of the file at once
+	defer ns.lockInodes(dirent.Inode)()
 
 	ok, inodeInfo := ns.InodeDBGet(dirent.Inode)
 	if !ok {
 		ret = 2 /*ENOENT*/
-		return ret, nil
+		return ret, nil, 0
+	}
+
+	if ns.checkCapacity() == capacityHard {
+		return 28 /*ENOSPC*/, nil, 0
 	}
 
+	// a policy that no longer parses is ignored, not failing the writes
+	policy, _ := parsePolicy(inodeInfo.Policy)
+
 	var chunkInfo = mp.ChunkInfo{}
-	ret, _, blockGroup := ns.ChooseBlockGroup()
+	ret, _, blockGroup := ns.ChooseBlockGroup(policy.tier)
 
 	if ret != 0 {
-		return 28 /*ENOSPC*/, nil
+		return 28 /*ENOSPC*/, nil, 0
 	}
 	chunkInfo.BlockGroupID = blockGroup.BlockGroupID
 	chunkInfo.ChunkSize = 0
@@ -518,13 +951,20 @@ func (ns *nameSpace) AllocateChunk(pinode uint64, name string) (int32, *mp.Chunk
 	var err error
 	chunkInfo.ChunkID, err = ns.AllocateChunkID()
 	if err != nil {
-		return 1, nil
+		return 1, nil, 0
+	}
+
+	if detached {
+		// an O_APPEND write, linked by CommitAppend once the data is written
+		return 0, &chunkInfo, policy.replicas
 	}
 
 	inodeInfo.Chunks = append(inodeInfo.Chunks, &chunkInfo)
-	ns.InodeDBSet(dirent.Inode, inodeInfo)
+	if err := ns.InodeDBSet(dirent.Inode, inodeInfo); err != nil {
+		return 1, nil, 0
+	}
 
-	return 0, &chunkInfo
+	return 0, &chunkInfo, policy.replicas
 
 }
 
@@ -542,6 +982,7 @@ func (ns *nameSpace) SyncChunk(pinode uint64, name string, chunkinfo *mp.ChunkIn
 		ret = 2 /*ENOENT*/
 		return ret
 	}
+	defer ns.lockInodes(dirent.Inode)()
 
 	ok, inodeInfo := ns.InodeDBGet(dirent.Inode)
 	if !ok {
@@ -549,53 +990,86 @@ func (ns *nameSpace) SyncChunk(pinode uint64, name string, chunkinfo *mp.ChunkIn
 		return ret
 	}
 
-	inodeInfo.ModifiTime = time.Now().Unix()
+	stampMtime(inodeInfo, time.Now())
+	oldSize := inodeInfo.FileSize
+
+	if len(inodeInfo.InlineData) > 0 {
+		// the file grew out of its inline data, the client rewrote it into chunks
+		inodeInfo.FileSize -= int64(len(inodeInfo.InlineData))
+		inodeInfo.InlineData = nil
+	}
 
-	var lastChunkID uint64
 	var blockGroupUsed int32
-	if len(inodeInfo.Chunks) > 0 {
-		//for appned write
-		lastChunkID = inodeInfo.Chunks[len(inodeInfo.Chunks)-1].ChunkID
-		if lastChunkID == chunkinfo.ChunkID {
-			inodeInfo.FileSize = inodeInfo.FileSize + int64(chunkinfo.ChunkSize) - int64(inodeInfo.Chunks[len(inodeInfo.Chunks)-1].ChunkSize)
-			blockGroupUsed = chunkinfo.ChunkSize - inodeInfo.Chunks[len(inodeInfo.Chunks)-1].ChunkSize
-			inodeInfo.Chunks[len(inodeInfo.Chunks)-1] = chunkinfo
-		} else {
-			inodeInfo.Chunks = append(inodeInfo.Chunks, chunkinfo)
-			inodeInfo.FileSize += int64(chunkinfo.ChunkSize)
-			blockGroupUsed = chunkinfo.ChunkSize
-		}
+	// for append write the chunk is usually the last one, a striped writer
+	// may still be syncing earlier chunks after allocating the next ones
+	idx := len(inodeInfo.Chunks) - 1
+	for idx >= 0 && inodeInfo.Chunks[idx].ChunkID != chunkinfo.ChunkID {
+		idx--
+	}
+	if idx >= 0 {
+		inodeInfo.FileSize = inodeInfo.FileSize + int64(chunkinfo.ChunkSize) - int64(inodeInfo.Chunks[idx].ChunkSize)
+		blockGroupUsed = chunkinfo.ChunkSize - inodeInfo.Chunks[idx].ChunkSize
+		inodeInfo.Chunks[idx] = chunkinfo
 	} else {
 		inodeInfo.Chunks = append(inodeInfo.Chunks, chunkinfo)
 		inodeInfo.FileSize += int64(chunkinfo.ChunkSize)
 		blockGroupUsed = chunkinfo.ChunkSize
 	}
 
-	err := ns.InodeDBSet(dirent.Inode, inodeInfo)
+	t := ns.beginUsage()
+	t.add(pinode, inodeInfo.FileSize-oldSize, 0, 0)
+	err := ns.RaftGroup.Batch(ns.RaftGroupID, append(t.ops(), setInodeOp(dirent.Inode, inodeInfo)))
+	t.release()
 	if err != nil {
-
+		logger.Error("SyncChunk vol:%v inode:%v err:%v", ns.VolID, dirent.Inode, err)
 		return 1
 	}
 
-	ns.Lock()
-
-	var pTmpBlockGroup *mp.BlockGroup
-	if ok, pTmpBlockGroup = ns.BlockGroupDBGet(chunkinfo.BlockGroupID); !ok {
-		ns.Unlock()
-		return 2
+	if ret := ns.chargeBlockGroup(chunkinfo.BlockGroupID, -int64(blockGroupUsed)); ret != 0 {
+		return ret
 	}
+	ns.notify(&mp.ChangeEvent{Op: ChangeWrite, PInode: pinode, Name: name, Inode: dirent.Inode})
+	return 0
 
-	pTmpBlockGroup.FreeSize = pTmpBlockGroup.FreeSize - int64(blockGroupUsed)
+}
 
-	err = ns.BlockGroupDBSet(chunkinfo.BlockGroupID, pTmpBlockGroup)
-	if err != nil {
-		ns.Unlock()
-		return 1
+//CommitAppend : links a written detached chunk at the end of the file and returns the
+//offset it landed at, concurrent appenders each get their own contiguous range
+func (ns *nameSpace) CommitAppend(pinode uint64, name string, chunkinfo *mp.ChunkInfo) (int32, int64) {
+
+	defer catchPanic()
+
+	ok, dirent := ns.DentryDBGet(strconv.FormatUint(pinode, 10) + "-" + name)
+	if !ok {
+		return 2 /*ENOENT*/, 0
+	}
+	// the appenders get their offsets one after the other
+	defer ns.lockInodes(dirent.Inode)()
+	ok, inodeInfo := ns.InodeDBGet(dirent.Inode)
+	if !ok {
+		return 2 /*ENOENT*/, 0
+	}
+	if len(inodeInfo.InlineData) > 0 {
+		// the client promotes inline data before appending
+		return 1, 0
 	}
 
-	ns.Unlock()
-	return 0
+	offset := inodeInfo.FileSize
+	inodeInfo.Chunks = append(inodeInfo.Chunks, chunkinfo)
+	inodeInfo.FileSize += int64(chunkinfo.ChunkSize)
+	stampMtime(inodeInfo, time.Now())
+	t := ns.beginUsage()
+	t.add(pinode, int64(chunkinfo.ChunkSize), 0, 0)
+	err := ns.RaftGroup.Batch(ns.RaftGroupID, append(t.ops(), setInodeOp(dirent.Inode, inodeInfo)))
+	t.release()
+	if err != nil {
+		logger.Error("CommitAppend vol:%v inode:%v err:%v", ns.VolID, dirent.Inode, err)
+		return 1, 0
+	}
+	ns.chargeBlockGroup(chunkinfo.BlockGroupID, -int64(chunkinfo.ChunkSize))
 
+	ns.notify(&mp.ChangeEvent{Op: ChangeWrite, PInode: pinode, Name: name, Inode: dirent.Inode})
+	return 0, offset
 }
 
 //BlockGroupVp2Mp ...
@@ -610,6 +1084,7 @@ func (ns *nameSpace) BlockGroupVp2Mp(in *vp.BlockGroup) *mp.BlockGroup {
 	mpBlockGroup.BlockGroupID = in.BlockGroupID
 	mpBlockGroup.FreeSize = in.FreeSize
 	mpBlockGroup.Status = in.Status
+	mpBlockGroup.Media = in.Media
 
 	for i := range in.BlockInfos {
 		var pVpBlockInfo *vp.BlockInfo
@@ -630,8 +1105,8 @@ func (ns *nameSpace) BlockGroupVp2Mp(in *vp.BlockGroup) *mp.BlockGroup {
 
 }
 
-//ChooseBlockGroup ...
-func (ns *nameSpace) ChooseBlockGroup() (int32, uint32, *mp.BlockGroup) {
+//ChooseBlockGroup a block group with space for a chunk, on media when one is there
+func (ns *nameSpace) ChooseBlockGroup(media string) (int32, uint32, *mp.BlockGroup) {
 
 	defer catchPanic()
 
@@ -642,6 +1117,11 @@ func (ns *nameSpace) ChooseBlockGroup() (int32, uint32, *mp.BlockGroup) {
 
 	bgmap, _ := ns.BlockGroupDBGetAll()
 
+	if media != "" && !ns.hasMedia(bgmap, media) {
+		logger.Debug("vol:%v no block group with space on %v, any taken", ns.VolID, media)
+		media = ""
+	}
+
 	for _, v := range *bgmap {
 
 		err := pbproto.Unmarshal(v, &blockGroup)
@@ -649,7 +1129,7 @@ func (ns *nameSpace) ChooseBlockGroup() (int32, uint32, *mp.BlockGroup) {
 			continue
 		}
 
-		if blockGroup.Status == 2 {
+		if blockGroup.Status == 2 || (media != "" && blockGroup.Media != media) {
 			continue
 		}
 
@@ -673,6 +1153,12 @@ func (ns *nameSpace) ChooseBlockGroup() (int32, uint32, *mp.BlockGroup) {
 
 //ReleaseBlockGroup ...
 func (ns *nameSpace) ReleaseBlockGroup(blockGroupID uint32, chunSize int32) {
+	ns.chargeBlockGroup(blockGroupID, int64(chunSize))
+}
+
+//ChargeBlockGroup adds delta to the free size of the block group and returns it,
+//the first shard of a volume keeps the free sizes of all the shards
+func (ns *nameSpace) ChargeBlockGroup(blockGroupID uint32, delta int64) (int32, *mp.BlockGroup) {
 
 	ns.Lock()
 	defer ns.Unlock()
@@ -680,11 +1166,11 @@ func (ns *nameSpace) ReleaseBlockGroup(blockGroupID uint32, chunSize int32) {
 
 	ok, blockGroup := ns.BlockGroupDBGet(blockGroupID)
 	if !ok {
-		return
+		return 2 /*ENOENT*/, nil
 	}
 
 	var status int32
-	blockGroup.FreeSize = blockGroup.FreeSize + int64(chunSize)
+	blockGroup.FreeSize = blockGroup.FreeSize + delta
 	if blockGroup.FreeSize > BlockGroupSize {
 		blockGroup.FreeSize = BlockGroupSize
 	}
@@ -705,8 +1191,10 @@ func (ns *nameSpace) ReleaseBlockGroup(blockGroupID uint32, chunSize int32) {
 
 	}
 
-	ns.BlockGroupDBSet(blockGroupID, blockGroup)
-
+	if err := ns.BlockGroupDBSet(blockGroupID, blockGroup); err != nil {
+		return 1, nil
+	}
+	return 0, blockGroup
 }
 
 //UpdateChunkInfo ...
@@ -714,27 +1202,173 @@ func (ns *nameSpace) UpdateChunkInfo(in *mp.UpdateChunkInfoReq) int32 {
 
 	defer catchPanic()
 
+	defer ns.lockInodes(in.Inode)()
 	ok, inodeinfo := ns.InodeDBGet(in.Inode)
 	if !ok {
 		return 0
 	}
 	for i, v := range inodeinfo.Chunks {
 		if v.ChunkID == in.ChunkID {
+			if int(in.Position) >= len(v.Status) {
+				return 22 /*EINVAL*/
+			}
 			inodeinfo.Chunks[i].Status[in.Position] = in.Status
 			break
 		}
 	}
 
-	ns.InodeDBSet(in.Inode, inodeinfo)
+	if err := ns.InodeDBSet(in.Inode, inodeinfo); err != nil {
+		return 1
+	}
+
+	return 0
+}
+
+//MoveBlock points the block at position of a block group to the datanode ip:port,
+//the copies not there yet are then failed with FailBlock and repaired there
+func (ns *nameSpace) MoveBlock(blockGroupID uint32, position int32, ip int32, port int32) int32 {
+
+	ns.Lock()
+	defer ns.Unlock()
+	defer catchPanic()
 
+	ok, bg := ns.BlockGroupDBGet(blockGroupID)
+	if !ok {
+		return 2 // ENOENT
+	}
+	if int(position) >= len(bg.BlockInfos) {
+		return 22 // EINVAL
+	}
+	bg.BlockInfos[position].DataNodeIP = ip
+	bg.BlockInfos[position].DataNodePort = port
+	if err := ns.BlockGroupDBSet(blockGroupID, bg); err != nil {
+		return utils.NotLeader
+	}
+	logger.Debug("MoveBlock vol:%v blockgroup:%v position:%v to %v:%v", ns.VolID, blockGroupID, position, ip, port)
 	return 0
 }
 
+//FailBlock marks the copies of the chunks on a failed block bad, so readers skip
+//them, and returns the chunks for the repair of the block. A ChunkID limits it to that
+//chunk; ListOnly lists the chunks and fails none; the Copied chunks still of the size
+//they were copied at are neither failed nor returned.
+func (ns *nameSpace) FailBlock(in *mp.FailBlockReq) (int32, []*mp.FailedChunk) {
+
+	defer catchPanic()
+
+	blockGroupID, chunkID := in.BlockGroupID, in.ChunkID
+	copied := make(map[uint64]int32)
+	for _, c := range in.Copied {
+		copied[c.ChunkID] = c.ChunkSize
+	}
+
+	var inodes []uint64
+	err := ns.RaftGroup.InodeForEach(ns.RaftGroupID, func(k string, v []byte) {
+		inodeInfo := mp.InodeInfo{}
+		if pbproto.Unmarshal(v, &inodeInfo) != nil {
+			return
+		}
+		for _, c := range inodeInfo.Chunks {
+			if c.BlockGroupID == blockGroupID && (chunkID == 0 || c.ChunkID == chunkID) {
+				if inode, err := strconv.ParseUint(k, 10, 64); err == nil {
+					inodes = append(inodes, inode)
+				}
+				return
+			}
+		}
+	})
+	if err != nil {
+		return utils.NotLeader, nil
+	}
+
+	var failed []*mp.FailedChunk
+	for _, inode := range inodes {
+		failed = append(failed, ns.failChunks(inode, in, copied)...)
+	}
+	logger.Debug("FailBlock vol:%v blockgroup:%v position:%v chunks:%v list:%v", ns.VolID, blockGroupID, in.Position, len(failed), in.ListOnly)
+	return 0, failed
+}
+
+// failChunks marks the copies at position of the chunks of the inode in the block group bad
+func (ns *nameSpace) failChunks(inode uint64, in *mp.FailBlockReq, copied map[uint64]int32) []*mp.FailedChunk {
+	defer ns.lockInodes(inode)()
+	ok, inodeInfo := ns.InodeDBGet(inode)
+	if !ok {
+		return nil
+	}
+	position := in.Position
+	var failed []*mp.FailedChunk
+	changed := false
+	for _, c := range inodeInfo.Chunks {
+		if c.BlockGroupID != in.BlockGroupID || int(position) >= len(c.Status) || (in.ChunkID != 0 && c.ChunkID != in.ChunkID) {
+			continue
+		}
+		if size, ok := copied[c.ChunkID]; ok && size == c.ChunkSize {
+			continue
+		}
+		failed = append(failed, &mp.FailedChunk{Inode: inode, ChunkID: c.ChunkID, ChunkSize: c.ChunkSize})
+		if in.ListOnly {
+			continue
+		}
+		if c.Status[position] == 0 {
+			c.Status[position] = 2
+			changed = true
+		}
+	}
+	if changed {
+		ns.InodeDBSet(inode, inodeInfo)
+	}
+	return failed
+}
+
+//ListChunkRefs the chunks referenced by the inodes of the namespace, those in the
+//trash and unlinked while open included, by block group. volmgr collects the others.
+func (ns *nameSpace) ListChunkRefs() (int32, []*mp.BlockGroupChunks) {
+
+	defer catchPanic()
+
+	groups := make(map[uint32]*mp.BlockGroupChunks)
+	err := ns.RaftGroup.InodeForEach(ns.RaftGroupID, func(k string, v []byte) {
+		inodeInfo := mp.InodeInfo{}
+		if pbproto.Unmarshal(v, &inodeInfo) != nil {
+			return
+		}
+		for _, c := range inodeInfo.Chunks {
+			g, ok := groups[c.BlockGroupID]
+			if !ok {
+				g = &mp.BlockGroupChunks{BlockGroupID: c.BlockGroupID}
+				groups[c.BlockGroupID] = g
+			}
+			g.ChunkIDs = append(g.ChunkIDs, c.ChunkID)
+		}
+	})
+	if err != nil {
+		return utils.NotLeader, nil
+	}
+	out := make([]*mp.BlockGroupChunks, 0, len(groups))
+	for _, g := range groups {
+		out = append(out, g)
+	}
+	return 0, out
+}
+
+// newGeneration the generation of a new inode. The ids are not unique over the life of
+// a volume, a namespace restored from an older dump or a recreated volume hands them out
+// again, (inode, generation) is.
+func newGeneration() uint64 {
+	return uint64(time.Now().UnixNano())
+}
+
 //AllocateInodeID ...
 func (ns *nameSpace) AllocateInodeID() (uint64, error) {
 	return ns.RaftGroup.InodeIDGET(ns.RaftGroupID)
 }
 
+//AllocateInodeIDs allocates n consecutive inode ids, returns the first one
+func (ns *nameSpace) AllocateInodeIDs(n int) (uint64, error) {
+	return ns.RaftGroup.InodeIDsGET(ns.RaftGroupID, uint64(n))
+}
+
 //AllocateChunkID ...
 func (ns *nameSpace) AllocateChunkID() (uint64, error) {
 	return ns.RaftGroup.ChunkIDGET(ns.RaftGroupID)
@@ -799,6 +1433,7 @@ func (ns *nameSpace) InodeDBDelete(inode uint64) error {
 
 //DentryDBGet ...
 func (ns *nameSpace) DentryDBGet(dentryKey string) (bool, *mp.Dirent) {
+	dentryKey = orphanDentryKey(dentryKey)
 	value, err := ns.RaftGroup.DentryGet(ns.RaftGroupID, dentryKey)
 	if err != nil {
 		value, err = ns.RaftGroup.DentryGet(ns.RaftGroupID, dentryKey)
@@ -879,8 +1514,11 @@ func (ns *nameSpace) BlockGroupDBGet(k uint32) (bool, *mp.BlockGroup) {
 
 //BlockGroupDBSet ...
 func (ns *nameSpace) BlockGroupDBSet(k uint32, v *mp.BlockGroup) error {
+	var old mp.BlockGroup
+	oldVal, err := ns.RaftGroup.BGGet(ns.RaftGroupID, strconv.Itoa(int(k)))
+	existed := err == nil && pbproto.Unmarshal(oldVal, &old) == nil
 	val, _ := pbproto.Marshal(v)
-	err := ns.RaftGroup.BGSet(ns.RaftGroupID, strconv.Itoa(int(k)), val)
+	err = ns.RaftGroup.BGSet(ns.RaftGroupID, strconv.Itoa(int(k)), val)
 	if err != nil {
 		err := ns.RaftGroup.BGSet(ns.RaftGroupID, strconv.Itoa(int(k)), val)
 		if err != nil {
@@ -888,6 +1526,7 @@ func (ns *nameSpace) BlockGroupDBSet(k uint32, v *mp.BlockGroup) error {
 			return err
 		}
 	}
+	ns.spaceSet(existed, int64(old.FreeSize), int64(v.FreeSize))
 	return nil
 }
 
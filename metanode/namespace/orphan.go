@@ -0,0 +1,390 @@
+package namespace
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	"github.com/ipdcode/containerfs/metanode/raftopt"
+	kvp "github.com/ipdcode/containerfs/proto/kvp"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A file unlinked while clients have it open loses its entry but keeps its inode and
+// chunks under an orphan dentry, the clients go on reading and writing it by its
+// orphan name. It is reclaimed once the last of them closes it, or stops reporting
+// its opens for SessionTTL: it died with its session.
+
+// orphanPrefix dentries of the files unlinked while open
+const orphanPrefix = "orphan-"
+
+// orphanName the name the clients use for an orphan they have open, no entry can
+// have it. DentryDBGet resolves <pinode>-/orphan/<inode> to the orphan dentry.
+const orphanName = "/orphan/"
+
+// OrphanCheckInterval ...
+var OrphanCheckInterval = 30 * time.Second
+
+// orphanTable the inodes the clients have open and the orphans of the namespace,
+// kept in memory on the leader only like the sessions: the clients report their
+// opens to a new leader, which waits SessionTTL before reclaiming anything
+type orphanTable struct {
+	sync.Mutex
+	opens   map[string]*openReport // by client
+	inodes  map[uint64]bool
+	leading time.Time // when the orphans were loaded, zero while not leading
+
+	reclaimMu sync.Mutex
+}
+
+type openReport struct {
+	inodes map[uint64]bool
+	seen   time.Time
+}
+
+func (t *orphanTable) init() {
+	if t.opens == nil {
+		t.opens = make(map[string]*openReport)
+		t.inodes = make(map[uint64]bool)
+	}
+}
+
+// held whether a client reported inode open within SessionTTL, must be called with
+// t locked. The clients past it are dropped.
+func (t *orphanTable) held(inode uint64) bool {
+	deadline := time.Now().Add(-SessionTTL.Get())
+	for id, r := range t.opens {
+		if r.seen.Before(deadline) {
+			delete(t.opens, id)
+			continue
+		}
+		if r.inodes[inode] {
+			return true
+		}
+	}
+	return false
+}
+
+func orphanKey(inode uint64) string {
+	return orphanPrefix + strconv.FormatUint(inode, 10)
+}
+
+// orphanDentryKey the orphan dentry for the dentry key of an orphan name, dentryKey
+// for the others
+func orphanDentryKey(dentryKey string) string {
+	if i := strings.Index(dentryKey, "-"+orphanName); i >= 0 {
+		return orphanPrefix + dentryKey[i+1+len(orphanName):]
+	}
+	return dentryKey
+}
+
+//ReportOpens the inodes clientID has open, they replace those of its last report.
+//add adds them to it, the client opened them.
+func (ns *nameSpace) ReportOpens(clientID string, inodes []uint64, add bool) int32 {
+	if clientID == "" {
+		return 22 /*EINVAL*/
+	}
+	t := &ns.orphans
+	t.Lock()
+	defer t.Unlock()
+	t.init()
+	r, ok := t.opens[clientID]
+	if !add || !ok {
+		r = &openReport{inodes: make(map[uint64]bool, len(inodes))}
+		t.opens[clientID] = r
+	}
+	r.seen = time.Now()
+	for _, inode := range inodes {
+		r.inodes[inode] = true
+	}
+	return 0
+}
+
+// dropOpens forgets the opens of a client whose session is closed
+func (ns *nameSpace) dropOpens(clientID string) {
+	t := &ns.orphans
+	t.Lock()
+	defer t.Unlock()
+	t.init()
+	delete(t.opens, clientID)
+}
+
+//OrphanFile unlinks the file name of pinode when a client has it open, clientID
+//when the caller has: the inode and its chunks stay until the last one closes it.
+//orphaned is false when none has it open, the caller deletes the file.
+func (ns *nameSpace) OrphanFile(pinode uint64, name string, clientID string) (int32, bool) {
+
+	defer catchPanic()
+
+	ret, _, held := ns.orphanFile(pinode, name, clientID, false)
+	return ret, held
+}
+
+// removeFile unlinks the file name of pinode and deletes it from the metanode, as
+// the last close of an orphan would: one a client has open stays until it closes it.
+// Chunks the datanodes could not delete are left to ExpireOrphans.
+func (ns *nameSpace) removeFile(pinode uint64, name string) int32 {
+	ret, inode, held := ns.orphanFile(pinode, name, "", true)
+	if ret != 0 || held {
+		return ret
+	}
+	if ns.reclaimOrphan(inode) == 1 {
+		logger.Error("remove file vol:%v inode:%v: chunks left to the orphan sweep", ns.VolID, inode)
+	}
+	return 0
+}
+
+// orphanOp the orphan dentry of a file a batch unlinks with other ops, see orphaned
+func orphanOp(inode uint64) *kvp.Kv {
+	return setDentryOp(orphanKey(inode), true, inode)
+}
+
+// orphaned the files a batch applied put under their orphan dentry: those no client
+// has open are reclaimed in the background, the others when their last close
+func (ns *nameSpace) orphaned(inodes []uint64) {
+	t := &ns.orphans
+	t.Lock()
+	t.init()
+	ready := !t.leading.IsZero() && time.Since(t.leading) >= SessionTTL.Get()
+	var free []uint64
+	for _, inode := range inodes {
+		t.inodes[inode] = true
+		if ready && !t.held(inode) {
+			free = append(free, inode)
+		}
+	}
+	t.Unlock()
+	if len(free) > 0 {
+		go func() {
+			for _, inode := range free {
+				ns.reclaimOrphan(inode)
+			}
+		}()
+	}
+}
+
+// orphanFile moves the file name of pinode under its orphan dentry when a client has
+// it open, or always. Returns its inode and whether a client may have it open.
+func (ns *nameSpace) orphanFile(pinode uint64, name string, clientID string, always bool) (int32, uint64, bool) {
+	dentryKey := strconv.FormatUint(pinode, 10) + "-" + name
+	ok, dirent := ns.DentryDBGet(dentryKey)
+	if !ok {
+		return 2 /*ENOENT*/, 0, false
+	}
+	if !dirent.InodeType {
+		return 21 /*EISDIR*/, 0, false
+	}
+
+	t := &ns.orphans
+	t.Lock()
+	t.init()
+	if clientID != "" {
+		r, ok := t.opens[clientID]
+		if !ok {
+			r = &openReport{inodes: make(map[uint64]bool), seen: time.Now()}
+			t.opens[clientID] = r
+		}
+		r.inodes[dirent.Inode] = true
+	}
+	held := t.held(dirent.Inode)
+	if always {
+		// a new leader does not know the opens yet, ExpireOrphans reclaims it
+		held = held || t.leading.IsZero() || time.Since(t.leading) < SessionTTL.Get()
+	}
+	t.Unlock()
+	if !held && !always {
+		return 0, 0, false
+	}
+
+	defer ns.lockInodes(pinode, dirent.Inode)()
+	now := time.Now()
+	ops := []*kvp.Kv{
+		{Opt: raftopt.OPT_DEL_DENTRY, K: dentryKey},
+		setDentryOp(orphanKey(dirent.Inode), true, dirent.Inode),
+	}
+	if ok, info := ns.InodeDBGet(dirent.Inode); ok {
+		stampCtime(info, now)
+		ops = append(ops, setInodeOp(dirent.Inode, info))
+	}
+	ops = append(ops, ns.touchDirOps(now, pinode)...)
+	u := ns.beginUsage()
+	u.entry(pinode, dirent, -1)
+	err := ns.RaftGroup.Batch(ns.RaftGroupID, append(ops, u.ops()...))
+	u.release()
+	if err != nil {
+		logger.Error("OrphanFile vol:%v %v err:%v", ns.VolID, dentryKey, err)
+		return 1, 0, false
+	}
+	t.Lock()
+	t.inodes[dirent.Inode] = true
+	t.Unlock()
+
+	ns.notify(&mp.ChangeEvent{Op: ChangeRemove, PInode: pinode, Name: name, Inode: dirent.Inode})
+	logger.Debug("OrphanFile vol:%v %v inode:%v", ns.VolID, dentryKey, dirent.Inode)
+	return 0, dirent.Inode, held
+}
+
+//CloseOrphan clientID closed the orphan inode, it is reclaimed when no other client
+//has it open
+func (ns *nameSpace) CloseOrphan(inode uint64, clientID string) int32 {
+
+	defer catchPanic()
+
+	t := &ns.orphans
+	t.Lock()
+	t.init()
+	if r, ok := t.opens[clientID]; ok {
+		delete(r.inodes, inode)
+	}
+	// a new leader leaves it to ExpireOrphans until the clients reported their opens
+	held := t.held(inode) || t.leading.IsZero() || time.Since(t.leading) < SessionTTL.Get()
+	t.Unlock()
+	if held {
+		return 0
+	}
+	return ns.reclaimOrphan(inode)
+}
+
+// reclaimOrphan deletes the chunks of the orphan inode from the datanodes, then the inode
+func (ns *nameSpace) reclaimOrphan(inode uint64) int32 {
+	t := &ns.orphans
+	t.reclaimMu.Lock()
+	defer t.reclaimMu.Unlock()
+	// a clone of the inode waits, the chunks it would share are deleted here
+	ns.refMu.Lock()
+	defer ns.refMu.Unlock()
+
+	key := orphanKey(inode)
+	if ok, _ := ns.DentryDBGet(key); !ok {
+		t.Lock()
+		delete(t.inodes, inode)
+		t.Unlock()
+		return 2 /*ENOENT*/
+	}
+	ok, inodeInfo := ns.InodeDBGet(inode)
+	var chunks []*mp.ChunkInfo
+	if ok {
+		chunks = inodeInfo.Chunks
+		if !ns.deleteChunks(chunks) {
+			return 1
+		}
+	}
+	ops, shared := ns.unrefChunks(chunks)
+	ops = append(ops,
+		&kvp.Kv{Opt: raftopt.OPT_DEL_DENTRY, K: key},
+		&kvp.Kv{Opt: raftopt.OPT_DEL_INODE, K: strconv.FormatUint(inode, 10)},
+	)
+	if err := ns.RaftGroup.Batch(ns.RaftGroupID, ops); err != nil {
+		logger.Error("reclaim orphan vol:%v inode:%v err:%v", ns.VolID, inode, err)
+		return 1
+	}
+	ns.releaseChunks(chunks, shared)
+	t.Lock()
+	delete(t.inodes, inode)
+	t.Unlock()
+	logger.Debug("reclaimed orphan vol:%v inode:%v", ns.VolID, inode)
+	return 0
+}
+
+// loadOrphans the orphan dentries of the namespace, on a new leader. The reclaim
+// dentries the clients were left to reclaim, a rename or a batch unlink of an older
+// metanode, become orphans: the ones the clients never reclaimed are swept with them.
+func (ns *nameSpace) loadOrphans() {
+	allMap, err := ns.RaftGroup.DentryGetAll(ns.RaftGroupID)
+	if err != nil {
+		return
+	}
+	var inodes []uint64
+	var ops []*kvp.Kv
+	ns.RaftGroup.DentryLocker.RLock()
+	for k := range *allMap {
+		prefix := orphanPrefix
+		if strings.HasPrefix(k, reclaimPrefix) {
+			prefix = reclaimPrefix
+		} else if !strings.HasPrefix(k, orphanPrefix) {
+			continue
+		}
+		inode, err := strconv.ParseUint(k[len(prefix):], 10, 64)
+		if err != nil {
+			continue
+		}
+		if prefix == reclaimPrefix {
+			ops = append(ops, &kvp.Kv{Opt: raftopt.OPT_DEL_DENTRY, K: k}, orphanOp(inode))
+		}
+		inodes = append(inodes, inode)
+	}
+	ns.RaftGroup.DentryLocker.RUnlock()
+	if len(ops) > 0 {
+		if err := ns.RaftGroup.Batch(ns.RaftGroupID, ops); err != nil {
+			logger.Error("vol:%v reclaim dentries to orphans err:%v", ns.VolID, err)
+			return
+		}
+		logger.Debug("vol:%v %v reclaim dentries left by the clients swept as orphans", ns.VolID, len(ops)/2)
+	}
+
+	t := &ns.orphans
+	t.Lock()
+	defer t.Unlock()
+	t.init()
+	for _, inode := range inodes {
+		t.inodes[inode] = true
+	}
+}
+
+//ExpireOrphans reclaims the orphans no client has open any more. A new leader
+//loads them first and waits SessionTTL for the clients to report their opens.
+func (ns *nameSpace) ExpireOrphans() {
+	t := &ns.orphans
+	t.Lock()
+	t.init()
+	if t.leading.IsZero() {
+		t.leading = time.Now()
+		t.Unlock()
+		ns.loadOrphans()
+		return
+	}
+	if time.Since(t.leading) < SessionTTL.Get() {
+		t.Unlock()
+		return
+	}
+	var free []uint64
+	for inode := range t.inodes {
+		if !t.held(inode) {
+			free = append(free, inode)
+		}
+	}
+	t.Unlock()
+
+	for _, inode := range free {
+		ns.reclaimOrphan(inode)
+	}
+}
+
+// forgetOrphans drops the table when the metanode is no longer the leader
+func (ns *nameSpace) forgetOrphans() {
+	t := &ns.orphans
+	t.Lock()
+	defer t.Unlock()
+	t.opens, t.inodes = nil, nil
+	t.leading = time.Time{}
+}
+
+//RunOrphanSweep reclaims the orphans of the volumes this metanode leads, it never returns
+func RunOrphanSweep() {
+	for range time.Tick(OrphanCheckInterval) {
+		gMutex.RLock()
+		var all []*nameSpace
+		for _, v := range AllNameSpace {
+			all = append(all, v)
+		}
+		gMutex.RUnlock()
+		for _, v := range all {
+			if v.RaftGroup.IsLeader(v.RaftGroupID) {
+				v.ExpireOrphans()
+			} else {
+				v.forgetOrphans()
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package namespace
+
+import (
+	"fmt"
+	pbproto "github.com/golang/protobuf/proto"
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A file or dir may carry a storage policy for the data written to it, as
+// replicas=2,tier=ssd. replicas writes that many copies of each new chunk, 1 to 3,
+// the blocks of the group left out are marked not kept. tier places the new chunks
+// in the block groups on that media, any when the volume has none with space.
+// New entries of a dir take its policy, the data already written keeps its placement.
+
+// policy keys
+const (
+	policyReplicas = "replicas"
+	policyTier     = "tier"
+	policyEC       = "ec"
+)
+
+type storagePolicy struct {
+	replicas int32 // 0 all the blocks of the group
+	tier     string
+}
+
+// parsePolicy key=value,... ; EINVAL for a bad one, ENOTSUP for erasure coding,
+// the datanodes only keep replicas
+func parsePolicy(s string) (storagePolicy, int32) {
+	var p storagePolicy
+	s = strings.TrimSpace(s)
+	if s == "" || s == "none" {
+		return p, 0
+	}
+	for _, kv := range strings.Split(s, ",") {
+		f := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(f) != 2 {
+			return storagePolicy{}, 22 /*EINVAL*/
+		}
+		switch f[0] {
+		case policyReplicas:
+			n, err := strconv.Atoi(f[1])
+			if err != nil || n < 1 || n > 3 {
+				return storagePolicy{}, 22 /*EINVAL*/
+			}
+			p.replicas = int32(n)
+		case policyTier:
+			if f[1] != "ssd" && f[1] != "hdd" {
+				return storagePolicy{}, 22 /*EINVAL*/
+			}
+			p.tier = f[1]
+		case policyEC:
+			return storagePolicy{}, 95 /*ENOTSUP*/
+		default:
+			return storagePolicy{}, 22 /*EINVAL*/
+		}
+	}
+	return p, 0
+}
+
+// String the policy in its canonical form, empty for none
+func (p storagePolicy) String() string {
+	var kvs []string
+	if p.replicas != 0 {
+		kvs = append(kvs, fmt.Sprintf("%s=%d", policyReplicas, p.replicas))
+	}
+	if p.tier != "" {
+		kvs = append(kvs, policyTier+"="+p.tier)
+	}
+	return strings.Join(kvs, ",")
+}
+
+// hasMedia whether a block group of bgmap on media has space for a chunk
+func (ns *nameSpace) hasMedia(bgmap *map[string][]byte, media string) bool {
+	var blockGroup mp.BlockGroup
+	for _, v := range *bgmap {
+		if pbproto.Unmarshal(v, &blockGroup) != nil {
+			continue
+		}
+		if blockGroup.Status != 2 && blockGroup.Media == media {
+			return true
+		}
+	}
+	return false
+}
+
+// inheritedPolicy the policy of the dir pinode, for its new entries
+func (ns *nameSpace) inheritedPolicy(pinode uint64) string {
+	ok, inodeInfo := ns.InodeDBGet(pinode)
+	if !ok {
+		return ""
+	}
+	return inodeInfo.Policy
+}
+
+// policyInode the inode of name of pinode, of the root for 0 and an empty name
+func (ns *nameSpace) policyInode(pinode uint64, name string) (int32, uint64) {
+	if pinode == 0 && name == "" {
+		return 0, 0
+	}
+	ok, dirent := ns.DentryDBGet(strconv.FormatUint(pinode, 10) + "-" + name)
+	if !ok {
+		return 2 /*ENOENT*/, 0
+	}
+	return 0, dirent.Inode
+}
+
+// SetPolicy the storage policy of the file or dir name of pinode, empty or none drops it.
+// The entries already in a dir keep theirs.
+func (ns *nameSpace) SetPolicy(pinode uint64, name string, policy string) int32 {
+
+	defer catchPanic()
+
+	p, ret := parsePolicy(policy)
+	if ret != 0 {
+		return ret
+	}
+	ret, inode := ns.policyInode(pinode, name)
+	if ret != 0 {
+		return ret
+	}
+	defer ns.lockInodes(inode)()
+	ok, inodeInfo := ns.InodeDBGet(inode)
+	if !ok {
+		return 2 /*ENOENT*/
+	}
+	inodeInfo.Policy = p.String()
+	stampCtime(inodeInfo, time.Now())
+	if err := ns.InodeDBSet(inode, inodeInfo); err != nil {
+		return 1
+	}
+	logger.Debug("SetPolicy vol:%v inode:%v policy:%v", ns.VolID, inode, inodeInfo.Policy)
+	return 0
+}
+
+// GetPolicy the storage policy of the file or dir name of pinode
+func (ns *nameSpace) GetPolicy(pinode uint64, name string) (int32, string) {
+
+	defer catchPanic()
+
+	ret, inode := ns.policyInode(pinode, name)
+	if ret != 0 {
+		return ret, ""
+	}
+	ok, inodeInfo := ns.InodeDBGet(inode)
+	if !ok {
+		return 2 /*ENOENT*/, ""
+	}
+	return 0, inodeInfo.Policy
+}
@@ -0,0 +1,126 @@
+package namespace
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"github.com/ipdcode/containerfs/utils"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SessionTTL how long the session of a client lives without a heartbeat, its
+// leases are taken away with it
+var SessionTTL = utils.NewDuration(60 * time.Second)
+
+// sessionTable the clients mounting a volume, kept in memory on the leader only
+// like the leases: after a leader change the clients open their sessions again
+type sessionTable struct {
+	sync.Mutex
+	clients map[string]*mp.SessionInfo
+}
+
+func (t *sessionTable) init() {
+	if t.clients == nil {
+		t.clients = make(map[string]*mp.SessionInfo)
+	}
+}
+
+// expireSessions drops the sessions past SessionTTL with their leases, must be
+// called with ns.sessions locked
+func (ns *nameSpace) expireSessions() {
+	deadline := time.Now().Add(-SessionTTL.Get()).Unix()
+	for id, s := range ns.sessions.clients {
+		if s.LastSeen >= deadline {
+			continue
+		}
+		logger.Error("vol:%v session of %v on %v expired, dropping its leases", ns.VolID, id, s.Host)
+		delete(ns.sessions.clients, id)
+		ns.leases.drop(id)
+	}
+}
+
+//OpenSession registers a client mounting the volume, again after a leader change
+//or an expiry. A client evicted or fenced off gets utils.SessionRevoked.
+func (ns *nameSpace) OpenSession(s *mp.SessionInfo) int32 {
+	if s == nil || s.ClientID == "" {
+		return 22 /*EINVAL*/
+	}
+	if !ns.Admits(s.ClientID) {
+		return utils.SessionRevoked
+	}
+	if ret := ns.checkAccess(s); ret != 0 {
+		return ret
+	}
+	t := &ns.sessions
+	t.Lock()
+	defer t.Unlock()
+	t.init()
+	ns.expireSessions()
+	now := time.Now().Unix()
+	if old, ok := t.clients[s.ClientID]; ok {
+		s.Started = old.Started
+	} else {
+		s.Started = now
+		logger.Info("vol:%v session of %v on %v:%v opened", ns.VolID, s.ClientID, s.Host, s.MountPoint)
+	}
+	s.LastSeen = now
+	t.clients[s.ClientID] = s
+	return 0
+}
+
+//SessionHeartbeat keeps the session of the client, ret 2 when it has none: it
+//expired or the leader changed, the client opens it again
+func (ns *nameSpace) SessionHeartbeat(clientID string, opens int64) int32 {
+	if !ns.Admits(clientID) {
+		return utils.SessionRevoked
+	}
+	t := &ns.sessions
+	t.Lock()
+	defer t.Unlock()
+	t.init()
+	ns.expireSessions()
+	s, ok := t.clients[clientID]
+	if !ok {
+		return 2 /*ENOENT*/
+	}
+	s.LastSeen = time.Now().Unix()
+	s.Opens = opens
+	return 0
+}
+
+//CloseSession ends the session of the client and takes its leases away, revoke
+//evicts it, see Fence
+func (ns *nameSpace) CloseSession(clientID string, revoke bool) int32 {
+	if revoke {
+		return ns.Fence(clientID, true)
+	}
+	ns.dropRWOHolder(clientID)
+	t := &ns.sessions
+	t.Lock()
+	defer t.Unlock()
+	t.init()
+	if _, ok := t.clients[clientID]; !ok {
+		return 2 /*ENOENT*/
+	}
+	delete(t.clients, clientID)
+	ns.leases.drop(clientID)
+	ns.dropOpens(clientID)
+	return 0
+}
+
+//ListSessions the live sessions by client id
+func (ns *nameSpace) ListSessions() []*mp.SessionInfo {
+	t := &ns.sessions
+	t.Lock()
+	defer t.Unlock()
+	t.init()
+	ns.expireSessions()
+	sessions := make([]*mp.SessionInfo, 0, len(t.clients))
+	for _, s := range t.clients {
+		c := *s
+		sessions = append(sessions, &c)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ClientID < sessions[j].ClientID })
+	return sessions
+}
@@ -0,0 +1,264 @@
+package namespace
+
+import (
+	pbproto "github.com/golang/protobuf/proto"
+	"github.com/ipdcode/containerfs/logger"
+	"github.com/ipdcode/containerfs/metanode/raftopt"
+	kvp "github.com/ipdcode/containerfs/proto/kvp"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"github.com/ipdcode/containerfs/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// shardsKey the dentry holding the utils.ShardMap of a sharded volume, each shard
+// keeps its own copy, it checks the inodes of the ops against it
+const shardsKey = "shards"
+
+// The metanode reaches the leaders of the other shards of a volume through these,
+// set at its start
+
+//ShardDirEmpty asks the shard id owning the dir inode whether it is empty:
+//0 when it is, 39 (ENOTEMPTY) when not
+var ShardDirEmpty func(id string, inode uint64) int32
+
+//ShardChargeBlockGroup ChargeBlockGroup on the first shard of the volume volID
+var ShardChargeBlockGroup func(volID string, blockGroupID uint32, delta int64) (int32, *mp.BlockGroup)
+
+// shardState of the namespace of a shard
+type shardState struct {
+	ops uint64 // ops served as leader, to find the hot shards
+
+	mu  sync.Mutex
+	raw string
+	m   utils.ShardMap
+}
+
+//Shards the shard map of the volume, empty when it is not sharded
+func (ns *nameSpace) Shards() utils.ShardMap {
+	v, err := ns.RaftGroup.DentryGet(ns.RaftGroupID, shardsKey)
+	if err != nil {
+		return utils.ShardMap{}
+	}
+	ns.shard.mu.Lock()
+	defer ns.shard.mu.Unlock()
+	if string(v) != ns.shard.raw {
+		m, err := utils.ParseShardMap(string(v))
+		if err != nil {
+			logger.Error("vol:%v bad shard map %q: %v", ns.VolID, v, err)
+			return utils.ShardMap{}
+		}
+		ns.shard.raw, ns.shard.m = string(v), m
+	}
+	return ns.shard.m
+}
+
+// owns whether the dentries of the dir inode are in this shard
+func (ns *nameSpace) owns(inode uint64) bool {
+	m := ns.Shards()
+	if len(m.Starts) == 0 {
+		return ns.Shard == 0
+	}
+	return m.Shard(inode) == ns.Shard
+}
+
+// dirEmpty 0 when the dir inode has no entries, 39 (ENOTEMPTY) when it has, asking
+// the shard owning it when that is another one
+func (ns *nameSpace) dirEmpty(inode uint64) int32 {
+	if ns.owns(inode) {
+		if entries, _, _ := ns.ListDirectPage(inode, "", 1); len(entries) > 0 {
+			return 39 /*ENOTEMPTY*/
+		}
+		return 0
+	}
+	if ShardDirEmpty == nil {
+		return 18 /*EXDEV*/
+	}
+	volID, _ := utils.ParseShardVolID(ns.VolID)
+	return ShardDirEmpty(utils.ShardVolID(volID, ns.Shards().Shard(inode)), inode)
+}
+
+// chargeBlockGroup adds delta to the free size of a block group. The shards share
+// the block groups, the first one keeps their free sizes, the others keep the copy
+// it returns to choose from.
+func (ns *nameSpace) chargeBlockGroup(blockGroupID uint32, delta int64) int32 {
+	if ns.Shard == 0 {
+		ret, _ := ns.ChargeBlockGroup(blockGroupID, delta)
+		return ret
+	}
+	if ShardChargeBlockGroup == nil {
+		return 1
+	}
+	volID, _ := utils.ParseShardVolID(ns.VolID)
+	ret, bg := ShardChargeBlockGroup(volID, blockGroupID, delta)
+	if ret != 0 {
+		logger.Error("vol:%v charge block group:%v by %v ret:%v", ns.VolID, blockGroupID, delta, ret)
+		return ret
+	}
+	// the space only: the blocks of the local copy are moved by MoveBlock, a charge
+	// answered before a move must not put them back
+	ns.Lock()
+	defer ns.Unlock()
+	if ok, local := ns.BlockGroupDBGet(blockGroupID); ok {
+		local.FreeSize = bg.FreeSize
+		local.Status = bg.Status
+		bg = local
+	}
+	if err := ns.BlockGroupDBSet(blockGroupID, bg); err != nil {
+		return 1
+	}
+	return 0
+}
+
+//GetShardLeader : GetNameSpaceLeader for the ops on the dir inode, a shard not owning
+//it answers utils.WrongShard
+func GetShardLeader(UUID string, inode uint64) (int32, *nameSpace) {
+	ret, ns := GetNameSpaceLeader(UUID)
+	if ret != 0 {
+		return ret, nil
+	}
+	if !ns.owns(inode) {
+		return utils.WrongShard, nil
+	}
+	atomic.AddUint64(&ns.shard.ops, 1)
+	return 0, ns
+}
+
+//GetShardWriter : GetNameSpaceWriter for the ops changing the dir inode
+func GetShardWriter(UUID string, inode uint64) (int32, *nameSpace) {
+	ret, ns := GetNameSpaceWriter(UUID)
+	if ret != 0 {
+		return ret, nil
+	}
+	if !ns.owns(inode) {
+		return utils.WrongShard, nil
+	}
+	atomic.AddUint64(&ns.shard.ops, 1)
+	return 0, ns
+}
+
+//ShardsOf the ids of the namespaces of the shards of a volume loaded here, the volume first
+func ShardsOf(UUID string) []string {
+	gMutex.RLock()
+	defer gMutex.RUnlock()
+	var ids []string
+	for id := range AllNameSpace {
+		if vol, shard := utils.ParseShardVolID(id); vol == UUID && shard != 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return append([]string{UUID}, ids...)
+}
+
+//SetShards stores the shard map of the volume and drops the dentries and inodes
+//of the dirs the shard does not own, a split copies all of them to the new shard.
+//fresh is the new shard, it drops its copies of the files waiting to be reclaimed.
+func (ns *nameSpace) SetShards(m utils.ShardMap, fresh bool) int32 {
+
+	defer catchPanic()
+
+	if err := ns.RaftGroup.DentrySet(ns.RaftGroupID, shardsKey, []byte(m.String())); err != nil {
+		logger.Error("SetShards vol:%v err:%v", ns.VolID, err)
+		return 1
+	}
+
+	allMap, err := ns.RaftGroup.DentryGetAll(ns.RaftGroupID)
+	if err != nil {
+		return utils.NotLeader
+	}
+	var ops []*kvp.Kv
+	ns.RaftGroup.DentryLocker.RLock()
+	for k, v := range *allMap {
+		i := strings.Index(k, "-")
+		if i < 0 {
+			continue
+		}
+		if strings.HasPrefix(k, reclaimPrefix) || strings.HasPrefix(k, orphanPrefix) {
+			// the files a rename replaced or unlinked while open before the split are
+			// reclaimed by the old shard
+			if fresh {
+				ops = append(ops, &kvp.Kv{Opt: raftopt.OPT_DEL_DENTRY, K: k},
+					&kvp.Kv{Opt: raftopt.OPT_DEL_INODE, K: k[i+1:]})
+			}
+			continue
+		}
+		pinode, err := strconv.ParseUint(k[:i], 10, 64)
+		if err != nil || m.Shard(pinode) == ns.Shard {
+			continue
+		}
+		ops = append(ops, &kvp.Kv{Opt: raftopt.OPT_DEL_DENTRY, K: k})
+		dirent := mp.Dirent{}
+		if pbproto.Unmarshal(v, &dirent) == nil {
+			ops = append(ops, &kvp.Kv{Opt: raftopt.OPT_DEL_INODE, K: strconv.FormatUint(dirent.Inode, 10)})
+		}
+	}
+	ns.RaftGroup.DentryLocker.RUnlock()
+
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > restoreBatchLen {
+			n = restoreBatchLen
+		}
+		if err := ns.RaftGroup.Batch(ns.RaftGroupID, ops[:n]); err != nil {
+			logger.Error("SetShards vol:%v drop moved entries err:%v", ns.VolID, err)
+			return 1
+		}
+		ops = ops[n:]
+	}
+
+	ns.dropUsage()
+	logger.Info("SetShards vol:%v map:%v", ns.VolID, m)
+	return 0
+}
+
+//ShardInfo the ops served and where to split the shard: the upper half of its dirs
+//in the range of the median one. ret 22 when its dirs cannot be split.
+func (ns *nameSpace) ShardInfo() (ret int32, ops uint64, dirs uint64, start uint64, end uint64) {
+
+	defer catchPanic()
+
+	ops = atomic.LoadUint64(&ns.shard.ops)
+	m := ns.Shards()
+	allMap, err := ns.RaftGroup.DentryGetAll(ns.RaftGroupID)
+	if err != nil {
+		return utils.NotLeader, ops, 0, 0, 0
+	}
+	seen := make(map[uint64]bool)
+	var pinodes []uint64
+	ns.RaftGroup.DentryLocker.RLock()
+	for k := range *allMap {
+		i := strings.Index(k, "-")
+		if i < 0 {
+			continue
+		}
+		pinode, err := strconv.ParseUint(k[:i], 10, 64)
+		if err != nil || seen[pinode] || m.Shard(pinode) != ns.Shard {
+			continue
+		}
+		seen[pinode] = true
+		pinodes = append(pinodes, pinode)
+	}
+	ns.RaftGroup.DentryLocker.RUnlock()
+	dirs = uint64(len(pinodes))
+	if len(pinodes) < 2 {
+		return 22 /*EINVAL*/, ops, dirs, 0, 0
+	}
+	sort.Slice(pinodes, func(i, j int) bool { return pinodes[i] < pinodes[j] })
+
+	// the dirs are distinct, the shard keeps the lower ones
+	start = pinodes[len(pinodes)/2]
+	_, end = m.Range(start)
+	// the inodes the shard allocates next stay with it
+	_, last := ns.RaftGroup.IDs()
+	if last >= start && last < end {
+		end = last + 1
+	}
+	if start >= end {
+		return 22 /*EINVAL*/, ops, dirs, 0, 0
+	}
+	return 0, ops, dirs, start, end
+}
@@ -0,0 +1,89 @@
+package namespace
+
+import (
+	kvp "github.com/ipdcode/containerfs/proto/kvp"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"strconv"
+	"time"
+)
+
+// The times of an inode are kept as unix seconds plus the nanoseconds within the
+// second, the seconds alone for the inodes written before.
+
+// stampMtime the modification time of info, a change of the content is one of
+// the inode too
+func stampMtime(info *mp.InodeInfo, t time.Time) {
+	info.ModifiTime, info.ModifiTimeNsec = t.Unix(), int32(t.Nanosecond())
+	stampCtime(info, t)
+}
+
+// stampCtime the change time of info, for a change of its metadata: owner, times,
+// xattrs, rename
+func stampCtime(info *mp.InodeInfo, t time.Time) {
+	info.ChangeTime, info.ChangeTimeNsec = t.Unix(), int32(t.Nanosecond())
+}
+
+// stampTimes all the times of a new inode
+func stampTimes(info *mp.InodeInfo, t time.Time) {
+	stampAtime(info, t)
+	stampMtime(info, t)
+}
+
+// stampAtime the access time of info
+func stampAtime(info *mp.InodeInfo, t time.Time) {
+	info.AccessTime, info.AccessTimeNsec = t.Unix(), int32(t.Nanosecond())
+}
+
+// touchDirOps the ops stamping the mtime and the ctime of the dirs, an entry was added
+// to or removed from them, for the raft entry making that change. The caller holds
+// the locks of the dirs until that entry is committed, see lockInodes. A dir gone or
+// kept by another shard is skipped.
+func (ns *nameSpace) touchDirOps(t time.Time, dirs ...uint64) []*kvp.Kv {
+	var ops []*kvp.Kv
+	for i, dir := range dirs {
+		if i > 0 && dir == dirs[i-1] {
+			continue
+		}
+		ok, info := ns.InodeDBGet(dir)
+		if !ok {
+			continue
+		}
+		stampMtime(info, t)
+		ops = append(ops, setInodeOp(dir, info))
+	}
+	return ops
+}
+
+//SetTimes of the entry name of the dir pinode, utimensat: atime and mtime in unix
+//nanoseconds, each only when set
+func (ns *nameSpace) SetTimes(pinode uint64, name string, atime int64, mtime int64, setAtime bool, setMtime bool) int32 {
+
+	defer catchPanic()
+
+	ok, dirent := ns.DentryDBGet(strconv.FormatUint(pinode, 10) + "-" + name)
+	if !ok {
+		return 2 /*ENOENT*/
+	}
+	defer ns.lockInodes(dirent.Inode)()
+	ok, inodeInfo := ns.InodeDBGet(dirent.Inode)
+	if !ok {
+		return 2 /*ENOENT*/
+	}
+	if setAtime {
+		inodeInfo.AccessTime, inodeInfo.AccessTimeNsec = splitNano(atime)
+	}
+	if setMtime {
+		inodeInfo.ModifiTime, inodeInfo.ModifiTimeNsec = splitNano(mtime)
+	}
+	stampCtime(inodeInfo, time.Now())
+	if err := ns.InodeDBSet(dirent.Inode, inodeInfo); err != nil {
+		return 1
+	}
+	return 0
+}
+
+// splitNano unix nanoseconds into seconds and the nanoseconds within the second
+func splitNano(t int64) (int64, int32) {
+	u := time.Unix(0, t)
+	return u.Unix(), int32(u.Nanosecond())
+}
@@ -0,0 +1,387 @@
+package namespace
+
+import (
+	"fmt"
+	"github.com/ipdcode/containerfs/logger"
+	"github.com/ipdcode/containerfs/metanode/raftopt"
+	dp "github.com/ipdcode/containerfs/proto/dp"
+	kvp "github.com/ipdcode/containerfs/proto/kvp"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"github.com/ipdcode/containerfs/utils"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TrashRetention how long unlinked files, removed dirs and the files replaced by a
+// rename stay in /.trash/<date>/ before their blocks are freed, 0 disables the trash.
+// Each shard of a sharded volume keeps a trash of its own, under the 0-.trash
+// dentry of its namespace: the one of the first shard is /.trash, the others are
+// reached by restoretrash and purgetrash only.
+var TrashRetention utils.Duration
+
+// TrashCheckInterval ...
+var TrashCheckInterval = 10 * time.Minute
+
+const (
+	trashDir        = ".trash"
+	trashDateLayout = "2006-01-02"
+)
+
+// trashName names the trashed entry so it can be restored to where it was
+func trashName(pinode uint64, inode uint64, name string) string {
+	return fmt.Sprintf("%d-%d-%s", pinode, inode, name)
+}
+
+func parseTrashName(s string) (uint64, string, bool) {
+	f := strings.SplitN(s, "-", 3)
+	if len(f) != 3 {
+		return 0, "", false
+	}
+	pinode, err := strconv.ParseUint(f[0], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return pinode, f[2], true
+}
+
+// trashInode the /.trash dir, created when create is set
+func (ns *nameSpace) trashInode(create bool) (uint64, bool) {
+	if ok, dirent := ns.DentryDBGet("0-" + trashDir); ok {
+		return dirent.Inode, true
+	}
+	if !create {
+		return 0, false
+	}
+	ret, inode, _ := ns.CreateDirDirect(0, trashDir, 0, 0, 0)
+	return inode, ret == 0
+}
+
+// inTrash true for the trash dir and its date dirs, deleting there frees the file
+func (ns *nameSpace) inTrash(pinode uint64) bool {
+	ns.trashMu.Lock()
+	defer ns.trashMu.Unlock()
+
+	// dirs may have been made by another leader, reload now and then
+	if ns.trashDirs == nil || time.Since(ns.trashLoaded) > time.Minute {
+		ns.trashDirs = make(map[uint64]string)
+		ns.trashLoaded = time.Now()
+		if trash, ok := ns.trashInode(false); ok {
+			ns.trashDirs[trash] = ""
+			dirents, _, _ := ns.ListDirectPage(trash, "", 0)
+			for _, v := range dirents {
+				ns.trashDirs[v.Inode] = v.Name
+			}
+		}
+	}
+	_, ok := ns.trashDirs[pinode]
+	return ok
+}
+
+// keepsTrash whether the entries removed from the dir pinode go to the trash: it is
+// on and they are not in it already. Over the hard limit the deletes free the space
+// at once.
+func (ns *nameSpace) keepsTrash(pinode uint64) bool {
+	return TrashRetention.Get() > 0 && !ns.inTrash(pinode) && ns.checkCapacity() != capacityHard
+}
+
+// trashDateDir the dir of the trash for the entries removed today, created if need be
+func (ns *nameSpace) trashDateDir() (int32, uint64) {
+	trash, ok := ns.trashInode(true)
+	if !ok {
+		return 1, 0
+	}
+	date := time.Now().Format(trashDateLayout)
+	if ok, d := ns.DentryDBGet(strconv.FormatUint(trash, 10) + "-" + date); ok {
+		return 0, d.Inode
+	}
+	ret, inode, _ := ns.CreateDirDirect(trash, date, 0, 0, 0)
+	if ret != 0 {
+		return ret, 0
+	}
+	ns.trashMu.Lock()
+	if ns.trashDirs != nil {
+		ns.trashDirs[inode] = date
+	}
+	ns.trashMu.Unlock()
+	return 0, inode
+}
+
+// trashOp puts the entry name of pinode in the trash dir dateInode
+func trashOp(dateInode uint64, pinode uint64, name string, dirent *mp.Dirent) *kvp.Kv {
+	return setDentryOp(strconv.FormatUint(dateInode, 10)+"-"+trashName(pinode, dirent.Inode, name), dirent.InodeType, dirent.Inode)
+}
+
+//TrashFile moves an unlinked file or a removed dir tree to /.trash/<date>/, false when
+//the trash is off or the entry is already in it, then the client deletes it for good
+func (ns *nameSpace) TrashFile(pinode uint64, name string) (int32, bool) {
+
+	defer catchPanic()
+
+	if !ns.keepsTrash(pinode) {
+		return 0, false
+	}
+
+	dentryKey := strconv.FormatUint(pinode, 10) + "-" + name
+	ok, dirent := ns.DentryDBGet(dentryKey)
+	if !ok {
+		return 2 /*ENOENT*/, false
+	}
+	ret, dateInode := ns.trashDateDir()
+	if ret != 0 {
+		return ret, false
+	}
+
+	defer ns.lockInodes(pinode)()
+	ops := []*kvp.Kv{
+		trashOp(dateInode, pinode, name, dirent),
+		{Opt: raftopt.OPT_DEL_DENTRY, K: dentryKey},
+	}
+	ops = append(ops, ns.touchDirOps(time.Now(), pinode)...)
+	t := ns.beginUsage()
+	t.entry(pinode, dirent, -1)
+	t.entry(dateInode, dirent, 1)
+	err := ns.RaftGroup.Batch(ns.RaftGroupID, append(ops, t.ops()...))
+	t.release()
+	if err != nil {
+		logger.Error("TrashFile vol:%v %v err:%v", ns.VolID, dentryKey, err)
+		return 1, false
+	}
+	ns.notify(&mp.ChangeEvent{Op: ChangeRemove, PInode: pinode, Name: name, Inode: dirent.Inode, Dir: !dirent.InodeType})
+	return 0, true
+}
+
+//RestoreTrash puts a trashed entry back where it was removed from, the dirs it was in
+//first when they are in the trash too
+func (ns *nameSpace) RestoreTrash(date string, entry string) int32 {
+	return ns.restoreTrash(date, entry, 0)
+}
+
+func (ns *nameSpace) restoreTrash(date string, entry string, depth int) int32 {
+
+	defer catchPanic()
+
+	if depth > usageMaxDepth {
+		return 40 /*ELOOP*/
+	}
+	pinode, name, ok := parseTrashName(entry)
+	if !ok {
+		return 1
+	}
+	trash, ok := ns.trashInode(false)
+	if !ok {
+		return 2 /*ENOENT*/
+	}
+	if pdate, pentry, ok := ns.trashedDir(trash, pinode); ok {
+		if ret := ns.restoreTrash(pdate, pentry, depth+1); ret != 0 && ret != 17 /*EEXIST*/ {
+			return ret
+		}
+	}
+	ok, dateDirent := ns.DentryDBGet(strconv.FormatUint(trash, 10) + "-" + date)
+	if !ok {
+		return 2 /*ENOENT*/
+	}
+	trashKey := strconv.FormatUint(dateDirent.Inode, 10) + "-" + entry
+	ok, dirent := ns.DentryDBGet(trashKey)
+	if !ok {
+		return 2 /*ENOENT*/
+	}
+	if pinode != 0 {
+		if ok, _ := ns.InodeDBGet(pinode); !ok {
+			// the dir it was in is gone too
+			return 2 /*ENOENT*/
+		}
+	}
+	dentryKey := strconv.FormatUint(pinode, 10) + "-" + name
+	if ok, _ := ns.DentryDBGet(dentryKey); ok {
+		return 17 /*EEXIST*/
+	}
+
+	ops := []*kvp.Kv{
+		setDentryOp(dentryKey, dirent.InodeType, dirent.Inode),
+		{Opt: raftopt.OPT_DEL_DENTRY, K: trashKey},
+	}
+	t := ns.beginUsage()
+	t.entry(dateDirent.Inode, dirent, -1)
+	t.entry(pinode, dirent, 1)
+	err := ns.RaftGroup.Batch(ns.RaftGroupID, append(ops, t.ops()...))
+	t.release()
+	if err != nil {
+		logger.Error("RestoreTrash vol:%v %v err:%v", ns.VolID, trashKey, err)
+		return 1
+	}
+	ns.notify(&mp.ChangeEvent{Op: ChangeCreate, PInode: pinode, Name: name, Inode: dirent.Inode, Dir: !dirent.InodeType})
+	return 0
+}
+
+// trashedDir the date and the entry of the dir inode in the trash, of an rm -r
+// having removed the dir after the files in it
+func (ns *nameSpace) trashedDir(trash uint64, inode uint64) (string, string, bool) {
+	if inode == 0 {
+		return "", "", false
+	}
+	dates, _, _ := ns.ListDirectPage(trash, "", 0)
+	for _, d := range dates {
+		entries, _, _ := ns.ListDirectPage(d.Inode, "", 0)
+		for _, e := range entries {
+			if e.Inode == inode && !e.InodeType {
+				return d.Name, e.Name, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+//PurgeTrash frees the files trashed on date, all of the trash when date is empty
+func (ns *nameSpace) PurgeTrash(date string) int32 {
+	return ns.purgeTrash(func(d string) bool {
+		return date == "" || d == date
+	})
+}
+
+//ExpireTrash frees the files trashed longer than TrashRetention ago
+func (ns *nameSpace) ExpireTrash() int32 {
+	if TrashRetention.Get() <= 0 {
+		return 0
+	}
+	return ns.purgeTrash(func(d string) bool {
+		t, err := time.ParseInLocation(trashDateLayout, d, time.Local)
+		return err == nil && time.Since(t.AddDate(0, 0, 1)) > TrashRetention.Get()
+	})
+}
+
+func (ns *nameSpace) purgeTrash(match func(date string) bool) int32 {
+
+	defer catchPanic()
+
+	trash, ok := ns.trashInode(false)
+	if !ok {
+		return 0
+	}
+	dates, _, _ := ns.ListDirectPage(trash, "", 0)
+	var ret int32
+	var children map[uint64][]*mp.DirentN
+	for _, d := range dates {
+		if d.InodeType || !match(d.Name) {
+			continue
+		}
+		entries, _, _ := ns.ListDirectPage(d.Inode, "", 0)
+		failed := false
+		for _, e := range entries {
+			if !e.InodeType && children == nil {
+				// the dir trees trashed whole by DeleteTree go from the leaves up
+				var err error
+				if children, err = ns.dirTree(); err != nil {
+					return 1
+				}
+			}
+			r := int32(0)
+			if !e.InodeType {
+				r = ns.deleteDir(e.Inode, children, 0)
+			}
+			if r == 0 {
+				r = ns.purgeTrashEntry(d.Inode, e)
+			}
+			if r != 0 {
+				failed = true
+				ret = r
+			}
+		}
+		if !failed {
+			ns.DeleteDirDirect(trash, d.Name)
+		}
+	}
+	return ret
+}
+
+// purgeTrashEntry deletes the chunks of a trashed file from the datanodes, then the file,
+// through removeFile: a client may still have it open. An empty dir goes at once.
+func (ns *nameSpace) purgeTrashEntry(dirInode uint64, e *mp.DirentN) int32 {
+	if e.InodeType {
+		return ns.removeFile(dirInode, e.Name)
+	}
+	ns.refMu.Lock()
+	defer ns.refMu.Unlock()
+	ok, inodeInfo := ns.InodeDBGet(e.Inode)
+	var chunks []*mp.ChunkInfo
+	if ok {
+		chunks = inodeInfo.Chunks
+		if !ns.deleteChunks(chunks) {
+			return 1
+		}
+	}
+	ops, shared := ns.unrefChunks(chunks)
+	ops = append(ops,
+		&kvp.Kv{Opt: raftopt.OPT_DEL_DENTRY, K: strconv.FormatUint(dirInode, 10) + "-" + e.Name},
+		&kvp.Kv{Opt: raftopt.OPT_DEL_INODE, K: strconv.FormatUint(e.Inode, 10)},
+	)
+	t := ns.beginUsage()
+	t.rmdir(dirInode, e.Inode)
+	err := ns.RaftGroup.Batch(ns.RaftGroupID, append(ops, t.ops()...))
+	t.release()
+	if err != nil {
+		logger.Error("purge trash vol:%v %v err:%v", ns.VolID, e.Name, err)
+		return 1
+	}
+	ns.releaseChunks(chunks, shared)
+	return 0
+}
+
+// deleteChunks deletes the chunks from all their datanodes, false if one could not be reached.
+// The chunks other files share stay.
+func (ns *nameSpace) deleteChunks(chunks []*mp.ChunkInfo) bool {
+	for _, c := range chunks {
+		if ns.chunkRefs(c.ChunkID) > 1 {
+			continue
+		}
+		ok, blockGroup := ns.BlockGroupDBGet(c.BlockGroupID)
+		if !ok {
+			continue
+		}
+		for _, b := range blockGroup.BlockInfos {
+			addr := utils.InetNtoa(b.DataNodeIP).String() + ":" + strconv.Itoa(int(b.DataNodePort))
+			conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Second))
+			if err != nil {
+				logger.Error("delete chunk %v, dial datanode %v failed:%v", c.ChunkID, addr, err)
+				return false
+			}
+			dc := dp.NewDataNodeClient(conn)
+			ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+			_, err = dc.DeleteChunk(ctx, &dp.DeleteChunkReq{
+				ChunkID:      c.ChunkID,
+				BlockID:      b.BlockID,
+				VolID:        ns.VolID,
+				BlockGroupID: c.BlockGroupID,
+				Background:   true,
+			})
+			conn.Close()
+			if err != nil {
+				logger.Error("delete chunk %v on %v failed:%v", c.ChunkID, addr, err)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+//RunTrashExpiry expires the trash of the volumes this metanode leads, it never returns
+func RunTrashExpiry() {
+	for range time.Tick(TrashCheckInterval) {
+		if TrashRetention.Get() <= 0 {
+			continue
+		}
+		gMutex.RLock()
+		var all []*nameSpace
+		for _, v := range AllNameSpace {
+			all = append(all, v)
+		}
+		gMutex.RUnlock()
+		for _, v := range all {
+			if v.RaftGroup.IsLeader(v.RaftGroupID) {
+				v.ExpireTrash()
+			}
+		}
+	}
+}
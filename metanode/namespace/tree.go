@@ -0,0 +1,238 @@
+package namespace
+
+import (
+	pbproto "github.com/golang/protobuf/proto"
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dirTree the entries of each dir, from one pass over the dentries
+func (ns *nameSpace) dirTree() (map[uint64][]*mp.DirentN, error) {
+	allMap, err := ns.RaftGroup.DentryGetAll(ns.RaftGroupID)
+	if err != nil {
+		return nil, err
+	}
+	children := make(map[uint64][]*mp.DirentN)
+	ns.RaftGroup.DentryLocker.RLock()
+	defer ns.RaftGroup.DentryLocker.RUnlock()
+	for k, v := range *allMap {
+		i := strings.IndexByte(k, '-')
+		if i < 0 {
+			continue
+		}
+		pinode, err := strconv.ParseUint(k[:i], 10, 64)
+		if err != nil {
+			continue
+		}
+		dirent := mp.Dirent{}
+		if pbproto.Unmarshal(v, &dirent) != nil {
+			continue
+		}
+		children[pinode] = append(children[pinode], &mp.DirentN{Name: k[i+1:], Inode: dirent.Inode, InodeType: dirent.InodeType})
+	}
+	return children, nil
+}
+
+// subtree the dirs of the tree of dir, dir included, false when one is in
+// another shard
+func (ns *nameSpace) subtree(dir uint64, children map[uint64][]*mp.DirentN) (map[uint64]bool, bool) {
+	dirs := map[uint64]bool{dir: true}
+	todo := []uint64{dir}
+	for len(todo) > 0 {
+		d := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if !ns.owns(d) {
+			return nil, false
+		}
+		for _, e := range children[d] {
+			if !e.InodeType && !dirs[e.Inode] {
+				dirs[e.Inode] = true
+				todo = append(todo, e.Inode)
+			}
+		}
+	}
+	return dirs, true
+}
+
+//CopyTree copies the file or the dir tree srcName of srcPInode to dstName of
+//dstPInode, which must not exist. The files share the chunks of the sources, see
+//CloneFile, no data moves. The whole tree must be in this shard, EXDEV otherwise.
+//A failure leaves the part copied so far. Returns the files and dirs copied.
+func (ns *nameSpace) CopyTree(srcPInode uint64, srcName string, dstPInode uint64, dstName string, uid uint32, gid uint32) (int32, uint64, uint64) {
+
+	defer catchPanic()
+
+	if !ns.owns(srcPInode) || !ns.owns(dstPInode) {
+		return 18 /*EXDEV*/, 0, 0
+	}
+	ok, src := ns.DentryDBGet(strconv.FormatUint(srcPInode, 10) + "-" + srcName)
+	if !ok {
+		return 2 /*ENOENT*/, 0, 0
+	}
+	if ok, _ := ns.DentryDBGet(strconv.FormatUint(dstPInode, 10) + "-" + dstName); ok {
+		return 17 /*EEXIST*/, 0, 0
+	}
+	if src.InodeType {
+		ret, _, _ := ns.CloneFile(srcPInode, srcName, dstPInode, dstName, uid, gid)
+		if ret != 0 {
+			return ret, 0, 0
+		}
+		return 0, 1, 0
+	}
+
+	children, err := ns.dirTree()
+	if err != nil {
+		return 1, 0, 0
+	}
+	dirs, ok := ns.subtree(src.Inode, children)
+	if !ok {
+		return 18 /*EXDEV*/, 0, 0
+	}
+	if dirs[dstPInode] {
+		// into itself
+		return 22 /*EINVAL*/, 0, 0
+	}
+	var files, ndirs uint64
+	ret := ns.copyDir(src.Inode, dstPInode, dstName, uid, gid, children, &files, &ndirs)
+	return ret, files, ndirs
+}
+
+func (ns *nameSpace) copyDir(src uint64, dstPInode uint64, dstName string, uid uint32, gid uint32, children map[uint64][]*mp.DirentN, files *uint64, dirs *uint64) int32 {
+	var mode uint32
+	if ok, info := ns.InodeDBGet(src); ok {
+		mode = info.Mode & 07777
+	}
+	ret, dst, _ := ns.CreateDirDirect(dstPInode, dstName, uid, gid, mode)
+	if ret != 0 {
+		return ret
+	}
+	if !ns.owns(dst) {
+		return 18 /*EXDEV*/
+	}
+	*dirs++
+	for _, e := range children[src] {
+		if !e.InodeType {
+			if ret := ns.copyDir(e.Inode, dst, e.Name, uid, gid, children, files, dirs); ret != 0 {
+				return ret
+			}
+			continue
+		}
+		if ret, _, _ := ns.CloneFile(src, e.Name, dst, e.Name, uid, gid); ret != 0 {
+			return ret
+		}
+		*files++
+	}
+	return 0
+}
+
+//MoveTree renames the file or the dir tree srcName of srcPInode to dstName of
+//dstPInode, which must not exist, and not into itself. Only the entry moves,
+//whatever the size of the tree. A dir tree must be in this shard, EXDEV otherwise.
+func (ns *nameSpace) MoveTree(srcPInode uint64, srcName string, dstPInode uint64, dstName string) int32 {
+
+	defer catchPanic()
+
+	if !ns.owns(dstPInode) {
+		return 18 /*EXDEV*/
+	}
+	ok, src := ns.DentryDBGet(strconv.FormatUint(srcPInode, 10) + "-" + srcName)
+	if !ok {
+		return 2 /*ENOENT*/
+	}
+	if ok, _ := ns.DentryDBGet(strconv.FormatUint(dstPInode, 10) + "-" + dstName); ok {
+		return 17 /*EEXIST*/
+	}
+	if !src.InodeType {
+		children, err := ns.dirTree()
+		if err != nil {
+			return 1
+		}
+		dirs, ok := ns.subtree(src.Inode, children)
+		if !ok {
+			// could not tell it is not moved into itself
+			return 18 /*EXDEV*/
+		}
+		if dirs[dstPInode] {
+			return 22 /*EINVAL*/
+		}
+	}
+	return ns.RenameDirect(srcPInode, srcName, dstPInode, dstName, false)
+}
+
+//DeleteTree removes the file or the dir tree name of pinode, rm -r. With a trash the
+//tree goes there whole, else the chunks of its files are deleted from the datanodes
+//then the entries, from the leaves up. Returns the files and dirs removed, a failure
+//leaves the part not reached yet.
+func (ns *nameSpace) DeleteTree(pinode uint64, name string) (int32, uint64, uint64) {
+
+	defer catchPanic()
+
+	ok, dirent := ns.DentryDBGet(strconv.FormatUint(pinode, 10) + "-" + name)
+	if !ok {
+		return 2 /*ENOENT*/, 0, 0
+	}
+	top := &mp.DirentN{Name: name, Inode: dirent.Inode, InodeType: dirent.InodeType}
+	var files, dirs uint64
+	var children map[uint64][]*mp.DirentN
+	if dirent.InodeType {
+		files = 1
+	} else {
+		var err error
+		if children, err = ns.dirTree(); err != nil {
+			return 1, 0, 0
+		}
+		tree, ok := ns.subtree(dirent.Inode, children)
+		if !ok {
+			// a part of it is in another shard
+			return 18 /*EXDEV*/, 0, 0
+		}
+		dirs = uint64(len(tree))
+		for d := range tree {
+			for _, e := range children[d] {
+				if e.InodeType {
+					files++
+				}
+			}
+		}
+	}
+
+	if ret, trashed := ns.TrashFile(pinode, name); ret != 0 || trashed {
+		return ret, files, dirs
+	}
+	if !dirent.InodeType {
+		if ret := ns.deleteDir(dirent.Inode, children, 0); ret != 0 {
+			return ret, 0, 0
+		}
+	}
+	if ret := ns.purgeTrashEntry(pinode, top); ret != 0 {
+		return ret, 0, 0
+	}
+	unlock := ns.lockInodes(pinode)
+	if err := ns.RaftGroup.Batch(ns.RaftGroupID, ns.touchDirOps(time.Now(), pinode)); err != nil {
+		logger.Error("DeleteTree vol:%v touch dir %v err:%v", ns.VolID, pinode, err)
+	}
+	unlock()
+	ns.notify(&mp.ChangeEvent{Op: ChangeRemove, PInode: pinode, Name: name, Inode: dirent.Inode, Dir: !dirent.InodeType})
+	return 0, files, dirs
+}
+
+// deleteDir the entries of dir, the dirs below first
+func (ns *nameSpace) deleteDir(dir uint64, children map[uint64][]*mp.DirentN, depth int) int32 {
+	if depth > usageMaxDepth {
+		return 40 /*ELOOP*/
+	}
+	for _, e := range children[dir] {
+		if !e.InodeType {
+			if ret := ns.deleteDir(e.Inode, children, depth+1); ret != 0 {
+				return ret
+			}
+		}
+		if ret := ns.purgeTrashEntry(dir, e); ret != 0 {
+			return ret
+		}
+	}
+	return 0
+}
@@ -0,0 +1,97 @@
+package namespace
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"strconv"
+	"time"
+)
+
+//Truncate the file name of pinode to size and links the chunks of tail after it, in
+//one raft entry. The files are written by appending, the datanodes append to the
+//chunk files: size is within the inline data or at the end of one of the chunks,
+//EINVAL otherwise. The client writes the part of a chunk it keeps past that and the
+//zeros of a longer file to the detached chunks of tail, an inline file goes to
+//chunks from size 0. from is the size the client cut, EAGAIN when the file is not
+//that long now. The chunks past size are dropped, the client deletes their data.
+func (ns *nameSpace) Truncate(pinode uint64, name string, size int64, from int64, tail []*mp.ChunkInfo) int32 {
+
+	defer catchPanic()
+
+	if size < 0 {
+		return 22 /*EINVAL*/
+	}
+	ok, dirent := ns.DentryDBGet(strconv.FormatUint(pinode, 10) + "-" + name)
+	if !ok {
+		return 2 /*ENOENT*/
+	}
+	if !dirent.InodeType {
+		return 21 /*EISDIR*/
+	}
+	defer ns.lockInodes(dirent.Inode)()
+	ok, inodeInfo := ns.InodeDBGet(dirent.Inode)
+	if !ok {
+		return 2 /*ENOENT*/
+	}
+
+	cur := int64(len(inodeInfo.InlineData))
+	if len(inodeInfo.Chunks) > 0 {
+		cur = 0
+		for _, c := range inodeInfo.Chunks {
+			cur += int64(c.ChunkSize)
+		}
+	}
+	if cur != from {
+		return 11 /*EAGAIN*/
+	}
+
+	var dropped []*mp.ChunkInfo
+	if len(inodeInfo.Chunks) == 0 {
+		if size > int64(len(inodeInfo.InlineData)) || len(tail) > 0 && size != 0 {
+			return 22 /*EINVAL*/
+		}
+		inodeInfo.InlineData = inodeInfo.InlineData[:size]
+		if len(tail) > 0 {
+			inodeInfo.InlineData = nil
+		}
+	} else {
+		var keep int
+		var end int64
+		for keep < len(inodeInfo.Chunks) && end < size {
+			end += int64(inodeInfo.Chunks[keep].ChunkSize)
+			keep++
+		}
+		if end != size {
+			return 22 /*EINVAL*/
+		}
+		dropped = append([]*mp.ChunkInfo(nil), inodeInfo.Chunks[keep:]...)
+		inodeInfo.Chunks = inodeInfo.Chunks[:keep]
+	}
+	newSize := size
+	for _, c := range tail {
+		inodeInfo.Chunks = append(inodeInfo.Chunks, c)
+		newSize += int64(c.ChunkSize)
+	}
+	delta := newSize - inodeInfo.FileSize
+	inodeInfo.FileSize = newSize
+	stampMtime(inodeInfo, time.Now())
+
+	ns.refMu.Lock()
+	ops, shared := ns.unrefChunks(dropped)
+	ops = append(ops, setInodeOp(dirent.Inode, inodeInfo))
+	t := ns.beginUsage()
+	t.add(pinode, delta, 0, 0)
+	err := ns.RaftGroup.Batch(ns.RaftGroupID, append(ops, t.ops()...))
+	t.release()
+	ns.refMu.Unlock()
+	if err != nil {
+		logger.Error("Truncate vol:%v inode:%v size:%v err:%v", ns.VolID, dirent.Inode, size, err)
+		return 1
+	}
+	ns.releaseChunks(dropped, shared)
+	for _, c := range tail {
+		ns.chargeBlockGroup(c.BlockGroupID, -int64(c.ChunkSize))
+	}
+	ns.notify(&mp.ChangeEvent{Op: ChangeWrite, PInode: pinode, Name: name, Inode: dirent.Inode})
+	return 0
+}
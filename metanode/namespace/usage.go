@@ -0,0 +1,312 @@
+package namespace
+
+import (
+	pbproto "github.com/golang/protobuf/proto"
+	"github.com/ipdcode/containerfs/logger"
+	"github.com/ipdcode/containerfs/metanode/raftopt"
+	kvp "github.com/ipdcode/containerfs/proto/kvp"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Each dir keeps the bytes, files and dirs of its whole subtree in its usage-
+// dentry, in the raft state: a new leader has them as they were. Every change adds
+// its delta up the parent chain in its own raft entry, so a du of a huge tree is a
+// lookup. A namespace from before the counters, or whose shard was split, has them
+// built once from one pass over the dentries.
+
+// usagePrefix the usage- dentries, mp.UsageRecord by dir inode
+const usagePrefix = "usage-"
+
+// usageBuiltKey the dentry set once the usage- dentries are built
+const usageBuiltKey = "usagebuilt"
+
+// usageMaxDepth guards the parent walk against a loop
+const usageMaxDepth = 4096
+
+type usageTable struct {
+	sync.Mutex // serializes the changes of the records
+	built      bool
+	gen        uint64 // leader changes when built was read
+	loading    bool
+}
+
+func usageKey(dir uint64) string {
+	return usagePrefix + strconv.FormatUint(dir, 10)
+}
+
+// usageBuilt whether the records are there, usage must be locked
+func (ns *nameSpace) usageBuilt() bool {
+	if gen := ns.RaftGroup.LeaderChanges(); !ns.usage.built || ns.usage.gen != gen {
+		_, err := ns.RaftGroup.DentryGet(ns.RaftGroupID, usageBuiltKey)
+		ns.usage.built, ns.usage.gen = err == nil, gen
+	}
+	return ns.usage.built
+}
+
+func (ns *nameSpace) usageRecord(dir uint64) (*mp.UsageRecord, bool) {
+	v, err := ns.RaftGroup.DentryGet(ns.RaftGroupID, usageKey(dir))
+	if err != nil {
+		return nil, false
+	}
+	u := &mp.UsageRecord{}
+	if err := pbproto.Unmarshal(v, u); err != nil {
+		logger.Error("vol:%v bad usage of dir %v: %v", ns.VolID, dir, err)
+		return nil, false
+	}
+	return u, true
+}
+
+//Usage the bytes, files and dirs below dir
+func (ns *nameSpace) Usage(dir uint64) (int32, int64, int64, int64) {
+
+	defer catchPanic()
+
+	ns.usage.Lock()
+	if !ns.usageBuilt() {
+		ret := ns.buildUsage()
+		ns.usage.loading = false
+		if ret != 0 {
+			ns.usage.Unlock()
+			return ret, 0, 0, 0
+		}
+	}
+	ns.usage.Unlock()
+	u, ok := ns.usageRecord(dir)
+	if !ok {
+		return 2 /*ENOENT*/, 0, 0, 0
+	}
+	return 0, u.Bytes, u.Files, u.Dirs
+}
+
+// buildUsage sets the records from one pass over the dentries, usage must be locked
+func (ns *nameSpace) buildUsage() int32 {
+	allMap, err := ns.RaftGroup.DentryGetAll(ns.RaftGroupID)
+	if err != nil {
+		return 1
+	}
+	dirs := map[uint64]*mp.UsageRecord{0: {}}
+	files := make(map[uint64]uint64) // inode -> pinode
+	var stale []string
+	ns.RaftGroup.DentryLocker.RLock()
+	for k, v := range *allMap {
+		if strings.HasPrefix(k, usagePrefix) {
+			stale = append(stale, k)
+			continue
+		}
+		i := strings.IndexByte(k, '-')
+		if i < 0 {
+			continue
+		}
+		pinode, err := strconv.ParseUint(k[:i], 10, 64)
+		if err != nil {
+			// reclaim records are not in the tree
+			continue
+		}
+		dirent := mp.Dirent{}
+		if pbproto.Unmarshal(v, &dirent) != nil {
+			continue
+		}
+		if dirent.InodeType {
+			files[dirent.Inode] = pinode
+		} else if u, ok := dirs[dirent.Inode]; ok {
+			u.Parent = pinode
+		} else {
+			dirs[dirent.Inode] = &mp.UsageRecord{Parent: pinode}
+		}
+	}
+	ns.RaftGroup.DentryLocker.RUnlock()
+
+	t := &usageTx{ns: ns, recs: dirs, all: true}
+	for d, u := range dirs {
+		if d != 0 {
+			if p, ok := dirs[u.Parent]; ok {
+				p.Subdirs++
+			}
+			t.add(u.Parent, 0, 0, 1)
+		}
+	}
+	for inode, pinode := range files {
+		var size int64
+		if ok, inodeInfo := ns.InodeDBGet(inode); ok {
+			size = inodeInfo.FileSize
+		}
+		t.add(pinode, size, 1, 0)
+	}
+
+	var ops []*kvp.Kv
+	for _, k := range stale {
+		ops = append(ops, &kvp.Kv{Opt: raftopt.OPT_DEL_DENTRY, K: k})
+	}
+	ops = append(ops, t.ops()...)
+	ops = append(ops, &kvp.Kv{Opt: raftopt.OPT_SET_DENTRY, K: usageBuiltKey, V: []byte{1}})
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > restoreBatchLen {
+			n = restoreBatchLen
+		}
+		if err := ns.RaftGroup.Batch(ns.RaftGroupID, ops[:n]); err != nil {
+			logger.Error("vol:%v build usage err:%v", ns.VolID, err)
+			return 1
+		}
+		ops = ops[n:]
+	}
+	ns.usage.built = true
+	logger.Info("vol:%v usage built, %v dirs %v files", ns.VolID, len(dirs), len(files))
+	return 0
+}
+
+// dropUsage has the records built again, after the entries of the namespace were
+// changed other than one by one
+func (ns *nameSpace) dropUsage() {
+	ns.usage.Lock()
+	defer ns.usage.Unlock()
+	if err := ns.RaftGroup.DentryDel(ns.RaftGroupID, usageBuiltKey); err != nil {
+		logger.Error("vol:%v drop usage err:%v", ns.VolID, err)
+	}
+	ns.usage.built = false
+}
+
+// usageTx the records a change sets, their ops go in the raft entry of the change
+type usageTx struct {
+	ns   *nameSpace
+	recs map[uint64]*mp.UsageRecord // nil for a record deleted, the map nil while not built
+	all  bool                       // recs are all of them, of a build
+}
+
+// beginUsage the usageTx of a change, taken before the change is submitted and
+// released after: a build does not run in between, it would count the change and
+// the change its delta again. While the records are not built the usageTx sets
+// nothing, their build sees the change.
+func (ns *nameSpace) beginUsage() *usageTx {
+	ns.usage.Lock()
+	t := &usageTx{ns: ns}
+	if ns.usageBuilt() {
+		t.recs = make(map[uint64]*mp.UsageRecord)
+	}
+	return t
+}
+
+// release unlocks usage
+func (t *usageTx) release() {
+	t.ns.usage.Unlock()
+}
+
+func (t *usageTx) get(dir uint64) (*mp.UsageRecord, bool) {
+	if u, ok := t.recs[dir]; ok {
+		return u, u != nil
+	}
+	if t.all || t.recs == nil {
+		return nil, false
+	}
+	u, ok := t.ns.usageRecord(dir)
+	if ok {
+		t.recs[dir] = u
+	}
+	return u, ok
+}
+
+// add adds to dir and all the dirs above it
+func (t *usageTx) add(dir uint64, bytes int64, files int64, dirs int64) {
+	for i := 0; i < usageMaxDepth; i++ {
+		u, ok := t.get(dir)
+		if !ok {
+			return
+		}
+		u.Bytes += bytes
+		u.Files += files
+		u.Dirs += dirs
+		if dir == 0 {
+			return
+		}
+		dir = u.Parent
+	}
+}
+
+func (t *usageTx) ops() []*kvp.Kv {
+	ops := make([]*kvp.Kv, 0, len(t.recs))
+	for dir, u := range t.recs {
+		if u == nil {
+			ops = append(ops, &kvp.Kv{Opt: raftopt.OPT_DEL_DENTRY, K: usageKey(dir)})
+			continue
+		}
+		val, _ := pbproto.Marshal(u)
+		ops = append(ops, &kvp.Kv{Opt: raftopt.OPT_SET_DENTRY, K: usageKey(dir), V: val})
+	}
+	return ops
+}
+
+// entry adds (sign 1) or takes away (sign -1) a whole entry of pinode, a dir brings
+// its subtree along. A file counts the size its inode has now.
+func (t *usageTx) entry(pinode uint64, dirent *mp.Dirent, sign int64) {
+	if t.recs == nil {
+		return
+	}
+	if dirent.InodeType {
+		var size int64
+		if ok, inodeInfo := t.ns.InodeDBGet(dirent.Inode); ok {
+			size = inodeInfo.FileSize
+		}
+		t.add(pinode, sign*size, sign, 0)
+		return
+	}
+	if p, ok := t.get(pinode); ok {
+		p.Subdirs += sign
+	}
+	u, ok := t.get(dirent.Inode)
+	if !ok {
+		u = &mp.UsageRecord{}
+		t.recs[dirent.Inode] = u
+	}
+	if sign > 0 {
+		u.Parent = pinode
+	}
+	t.add(pinode, sign*u.Bytes, sign*u.Files, sign*(u.Dirs+1))
+}
+
+// rmdir drops a removed dir
+func (t *usageTx) rmdir(pinode uint64, inode uint64) {
+	if t.recs == nil {
+		return
+	}
+	t.entry(pinode, &mp.Dirent{Inode: inode}, -1)
+	t.recs[inode] = nil
+}
+
+// subdirCount the dirs right in dir, false while the records are not built; their
+// build is started then, a dir Attr does not wait for a walk of the namespace
+func (ns *nameSpace) subdirCount(dir uint64) (int64, bool) {
+	ns.usage.Lock()
+	if !ns.usageBuilt() {
+		if !ns.usage.loading {
+			ns.usage.loading = true
+			go ns.Usage(0)
+		}
+		ns.usage.Unlock()
+		return 0, false
+	}
+	ns.usage.Unlock()
+	u, ok := ns.usageRecord(dir)
+	if !ok {
+		return 0, false
+	}
+	return u.Subdirs, true
+}
+
+//GetDirAttr the inode of the dir and the dirs right in it, -1 while they are not known
+func (ns *nameSpace) GetDirAttr(inode uint64) (int32, *mp.InodeInfo, int64) {
+
+	defer catchPanic()
+
+	ok, inodeInfo := ns.InodeDBGet(inode)
+	if !ok {
+		return 2 /*ENOENT*/, nil, 0
+	}
+	n, known := ns.subdirCount(inode)
+	if !known {
+		n = -1
+	}
+	return 0, inodeInfo, n
+}
@@ -0,0 +1,112 @@
+package raftopt
+
+import (
+	"errors"
+	"sort"
+)
+
+// The entries of a dir are the "pinode-name" keys of dentryData, a map: a page of
+// a dir would scan all the keys of the namespace. dentryIndex keeps the names of
+// each pinode sorted, set along with dentryData under DentryLocker, so a page
+// seeks to its marker.
+
+// dentryIndex the sorted names by "pinode-" prefix
+type dentryIndex map[string][]string
+
+// dentryParent the "pinode-" prefix and the name of an entry key, false for the
+// keys that are not entries
+func dentryParent(key string) (string, string, bool) {
+	for i := 0; i < len(key); i++ {
+		if key[i] == '-' {
+			return key[:i+1], key[i+1:], i > 0
+		}
+		if key[i] < '0' || key[i] > '9' {
+			return "", "", false
+		}
+	}
+	return "", "", false
+}
+
+func (x dentryIndex) add(key string) {
+	prefix, name, ok := dentryParent(key)
+	if !ok {
+		return
+	}
+	names := x[prefix]
+	i := sort.SearchStrings(names, name)
+	if i < len(names) && names[i] == name {
+		return
+	}
+	names = append(names, "")
+	copy(names[i+1:], names[i:])
+	names[i] = name
+	x[prefix] = names
+}
+
+func (x dentryIndex) del(key string) {
+	prefix, name, ok := dentryParent(key)
+	if !ok {
+		return
+	}
+	names := x[prefix]
+	i := sort.SearchStrings(names, name)
+	if i == len(names) || names[i] != name {
+		return
+	}
+	if len(names) == 1 {
+		delete(x, prefix)
+		return
+	}
+	x[prefix] = append(names[:i], names[i+1:]...)
+}
+
+// setDentry sets an entry and its index, DentryLocker must be held
+func (ms *KvStateMachine) setDentry(key string, value []byte) {
+	if _, ok := ms.dentryData[key]; !ok {
+		ms.dentryIndex.add(key)
+	}
+	ms.dentryData[key] = value
+}
+
+// delDentry deletes an entry and its index, DentryLocker must be held
+func (ms *KvStateMachine) delDentry(key string) {
+	if _, ok := ms.dentryData[key]; ok {
+		ms.dentryIndex.del(key)
+		delete(ms.dentryData, key)
+	}
+}
+
+// indexDentries builds the index of dentryData again, DentryLocker must be held
+func (ms *KvStateMachine) indexDentries() {
+	ms.dentryIndex = make(dentryIndex)
+	for k := range ms.dentryData {
+		if prefix, name, ok := dentryParent(k); ok {
+			ms.dentryIndex[prefix] = append(ms.dentryIndex[prefix], name)
+		}
+	}
+	for _, names := range ms.dentryIndex {
+		sort.Strings(names)
+	}
+}
+
+//DentryRange calls fn with up to limit entries of the prefix "pinode-" named after
+//marker, in name order, limit 0 for all of them. more is whether entries are left.
+func (ms *KvStateMachine) DentryRange(raftGroupID uint64, prefix string, marker string, limit int, fn func(name string, value []byte)) (more bool, err error) {
+	if !ms.raft.IsLeader(raftGroupID) {
+		return false, errors.New("not leader")
+	}
+	ms.DentryLocker.RLock()
+	defer ms.DentryLocker.RUnlock()
+	names := ms.dentryIndex[prefix]
+	i := 0
+	if marker != "" {
+		i = sort.Search(len(names), func(j int) bool { return names[j] > marker })
+	}
+	for n := 0; i < len(names); i, n = i+1, n+1 {
+		if limit > 0 && n == limit {
+			return true, nil
+		}
+		fn(names[i], ms.dentryData[prefix+names[i]])
+	}
+	return false, nil
+}
@@ -0,0 +1,133 @@
+package raftopt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	pbproto "github.com/golang/protobuf/proto"
+	kvp "github.com/ipdcode/containerfs/proto/kvp"
+)
+
+// JournalLen applied entries kept in memory for incremental dumps
+var JournalLen = 100000
+
+// ErrJournalTrimmed the entries since the asked index are no longer all kept,
+// after a restart, a leader change or JournalLen entries; take a full dump
+var ErrJournalTrimmed = errors.New("journal trimmed")
+
+type journalEntry struct {
+	index uint64
+	kv    *kvp.Kv
+}
+
+// record keeps an applied entry for the incremental dumps, id allocations are left
+// out as the dumps carry the current ids
+func (ms *KvStateMachine) record(index uint64, kv *kvp.Kv) {
+	if kv.Opt == OPT_ALLOCATE_INODEID || kv.Opt == OPT_ALLOCATE_CHUNKID || kv.Opt == OPT_RAISE_IDS {
+		return
+	}
+	ms.journalLocker.Lock()
+	ms.journal = append(ms.journal, journalEntry{index: index, kv: kv})
+	if n := len(ms.journal) - JournalLen; n > 0 {
+		ms.journalStart = ms.journal[n-1].index
+		ms.journal = append(ms.journal[:0:0], ms.journal[n:]...)
+	}
+	ms.journalLocker.Unlock()
+}
+
+// resetJournal the state was replaced, the journal only covers what follows index
+func (ms *KvStateMachine) resetJournal(index uint64) {
+	ms.journalLocker.Lock()
+	ms.journal = nil
+	ms.journalStart = index
+	ms.journalLocker.Unlock()
+}
+
+//Dump : with since 0 every dentry, inode and block group as set ops, taken at one
+//applied index; otherwise the ops applied after since, in order. Also returns the
+//applied index the dump is at, to be the since of the next one. Replaying an op
+//already in the base is harmless, they all set or delete a key.
+func (ms *KvStateMachine) Dump(raftGroupID uint64, since uint64) (uint64, []*kvp.Kv, error) {
+	if !ms.raft.IsLeader(raftGroupID) {
+		return 0, nil, errors.New("not leader")
+	}
+	if since != 0 {
+		ms.journalLocker.Lock()
+		defer ms.journalLocker.Unlock()
+		if since < ms.journalStart {
+			return 0, nil, ErrJournalTrimmed
+		}
+		applied := since
+		var kvs []*kvp.Kv
+		for _, e := range ms.journal {
+			if e.index > since {
+				kvs = append(kvs, e.kv)
+				applied = e.index
+			}
+		}
+		return applied, kvs, nil
+	}
+
+	ms.DentryLocker.RLock()
+	ms.inodeLocker.RLock()
+	ms.BlockGroupLocker.RLock()
+	defer ms.DentryLocker.RUnlock()
+	defer ms.inodeLocker.RUnlock()
+	defer ms.BlockGroupLocker.RUnlock()
+
+	ms.journalLocker.Lock()
+	applied := ms.applied
+	if len(ms.journal) > 0 && ms.journal[len(ms.journal)-1].index > applied {
+		applied = ms.journal[len(ms.journal)-1].index
+	}
+	ms.journalLocker.Unlock()
+
+	// the values are never modified in place, the kvs can share them
+	kvs := make([]*kvp.Kv, 0, len(ms.blockGroupData)+len(ms.inodeData)+len(ms.dentryData))
+	for k, v := range ms.blockGroupData {
+		kvs = append(kvs, &kvp.Kv{Opt: OPT_SET_BG, K: k, V: v})
+	}
+	for k, v := range ms.inodeData {
+		kvs = append(kvs, &kvp.Kv{Opt: OPT_SET_INODE, K: k, V: v})
+	}
+	for k, v := range ms.dentryData {
+		kvs = append(kvs, &kvp.Kv{Opt: OPT_SET_DENTRY, K: k, V: v})
+	}
+	return applied, kvs, nil
+}
+
+//IDs : the last chunk and inode ids allocated
+func (ms *KvStateMachine) IDs() (uint64, uint64) {
+	return atomic.LoadUint64(&ms.chunkID), atomic.LoadUint64(&ms.inodeID)
+}
+
+//RaiseIDs : makes the next ids allocated pass chunkID and inodeID, for a restored namespace
+func (ms *KvStateMachine) RaiseIDs(raftGroupID uint64, chunkID uint64, inodeID uint64) error {
+	if !ms.raft.IsLeader(raftGroupID) {
+		return errors.New("not leader")
+	}
+	v := make([]byte, 16)
+	binary.BigEndian.PutUint64(v, chunkID)
+	binary.BigEndian.PutUint64(v[8:], inodeID)
+	data, err := pbproto.Marshal(&kvp.Kv{Opt: OPT_RAISE_IDS, V: v})
+	if err != nil {
+		return err
+	}
+	resp := ms.raft.Submit(raftGroupID, data)
+	if _, err = resp.Response(); err != nil {
+		return fmt.Errorf("RaiseIDs error[%v]", err)
+	}
+	return nil
+}
+
+// raiseID sets *id to v when it is below
+func raiseID(id *uint64, v uint64) {
+	for {
+		cur := atomic.LoadUint64(id)
+		if cur >= v || atomic.CompareAndSwapUint64(id, cur, v) {
+			return
+		}
+	}
+}
@@ -34,6 +34,10 @@ const (
 	OPT_SET_BG = 7
 	// OPT_DEL_BG ...
 	OPT_DEL_BG = 8
+	// OPT_BATCH dentry and inode ops applied together
+	OPT_BATCH = 9
+	// OPT_RAISE_IDS restore moves the id allocators past the dumped ids
+	OPT_RAISE_IDS = 10
 )
 
 //KvStateMachine ...
@@ -44,6 +48,7 @@ type KvStateMachine struct {
 
 	DentryLocker sync.RWMutex
 	dentryData   map[string][]byte
+	dentryIndex  dentryIndex
 
 	inodeLocker sync.RWMutex
 	inodeData   map[string][]byte
@@ -54,6 +59,14 @@ type KvStateMachine struct {
 	chunkID uint64
 
 	inodeID uint64
+
+	leaderLocker   sync.Mutex
+	leaderWatchers map[chan uint64]bool
+	leaderChanges  uint64
+
+	journalLocker sync.Mutex
+	journal       []journalEntry
+	journalStart  uint64 // the journal has every entry after it
 }
 
 func newKvStatemachine(id uint64, raft *raft.RaftServer) *KvStateMachine {
@@ -61,8 +74,10 @@ func newKvStatemachine(id uint64, raft *raft.RaftServer) *KvStateMachine {
 		id:             id,
 		raft:           raft,
 		dentryData:     make(map[string][]byte),
+		dentryIndex:    make(dentryIndex),
 		inodeData:      make(map[string][]byte),
 		blockGroupData: make(map[string][]byte),
+		leaderWatchers: make(map[chan uint64]bool),
 	}
 }
 
@@ -75,18 +90,23 @@ func (ms *KvStateMachine) Apply(data []byte, index uint64) (interface{}, error)
 		return nil, err
 	}
 
+	var result interface{}
 	switch kv.Opt {
-	case OPT_ALLOCATE_INODEID: // allockInodeID
-		atomic.AddUint64(&ms.inodeID, 1)
+	case OPT_ALLOCATE_INODEID: // allockInodeID, V the count of a range
+		n := uint64(1)
+		if len(kv.V) == 8 {
+			n = binary.BigEndian.Uint64(kv.V)
+		}
+		result = atomic.AddUint64(&ms.inodeID, n)
 	case OPT_ALLOCATE_CHUNKID: // allockChunkID
 		atomic.AddUint64(&ms.chunkID, 1)
 	case OPT_SET_DENTRY: // set dentryData
 		ms.DentryLocker.Lock()
-		ms.dentryData[kv.K] = kv.V
+		ms.setDentry(kv.K, kv.V)
 		ms.DentryLocker.Unlock()
 	case OPT_DEL_DENTRY: // del dentryData
 		ms.DentryLocker.Lock()
-		delete(ms.dentryData, kv.K)
+		ms.delDentry(kv.K)
 		ms.DentryLocker.Unlock()
 	case OPT_SET_INODE: // set inodeData
 		ms.inodeLocker.Lock()
@@ -100,11 +120,38 @@ func (ms *KvStateMachine) Apply(data []byte, index uint64) (interface{}, error)
 		ms.BlockGroupLocker.Lock()
 		ms.blockGroupData[kv.K] = kv.V
 		ms.BlockGroupLocker.Unlock()
+	case OPT_RAISE_IDS: // restored namespace
+		if len(kv.V) == 16 {
+			raiseID(&ms.chunkID, binary.BigEndian.Uint64(kv.V))
+			raiseID(&ms.inodeID, binary.BigEndian.Uint64(kv.V[8:]))
+		}
+	case OPT_BATCH: // dentry and inode ops of one transaction
+		ms.DentryLocker.Lock()
+		ms.inodeLocker.Lock()
+		ms.BlockGroupLocker.Lock()
+		for _, op := range kv.Batch {
+			switch op.Opt {
+			case OPT_SET_DENTRY:
+				ms.setDentry(op.K, op.V)
+			case OPT_DEL_DENTRY:
+				ms.delDentry(op.K)
+			case OPT_SET_INODE:
+				ms.inodeData[op.K] = op.V
+			case OPT_DEL_INODE:
+				delete(ms.inodeData, op.K)
+			case OPT_SET_BG:
+				ms.blockGroupData[op.K] = op.V
+			}
+		}
+		ms.BlockGroupLocker.Unlock()
+		ms.inodeLocker.Unlock()
+		ms.DentryLocker.Unlock()
 
 	}
 
+	ms.record(index, kv)
 	ms.applied = index
-	return nil, nil
+	return result, nil
 }
 
 //ApplyMemberChange ...
@@ -200,6 +247,7 @@ func (ms *KvStateMachine) ApplySnapshot(peers []proto.Peer, iter proto.SnapItera
 		ms.DentryLocker.Unlock()
 		return err
 	}
+	ms.indexDentries()
 	ms.DentryLocker.Unlock()
 
 	ms.inodeLocker.Lock()
@@ -220,6 +268,7 @@ func (ms *KvStateMachine) ApplySnapshot(peers []proto.Peer, iter proto.SnapItera
 
 	ms.chunkID = binary.BigEndian.Uint64(bigdata[16+dentryLen+8+inodeLen+8+bgLen : 16+dentryLen+8+inodeLen+8+bgLen+8])
 	ms.inodeID = binary.BigEndian.Uint64(bigdata[16+dentryLen+8+inodeLen+8+bgLen+8:])
+	ms.resetJournal(ms.applied)
 
 	return nil
 }
@@ -253,6 +302,11 @@ func (ms *KvStateMachine) DentryGetAll(raftGroupID uint64) (*map[string][]byte,
 	return &ms.dentryData, nil
 }
 
+//IsLeader ...
+func (ms *KvStateMachine) IsLeader(raftGroupID uint64) bool {
+	return ms.raft.IsLeader(raftGroupID)
+}
+
 //DentrySet ...
 func (ms *KvStateMachine) DentrySet(raftGroupID uint64, key string, value []byte) error {
 	if !ms.raft.IsLeader(raftGroupID) {
@@ -297,6 +351,27 @@ func (ms *KvStateMachine) DentryDel(raftGroupID uint64, key string) error {
 
 }
 
+//Batch submits dentry, inode and block group set ops as one raft entry, all of them are applied or none
+func (ms *KvStateMachine) Batch(raftGroupID uint64, ops []*kvp.Kv) error {
+	if !ms.raft.IsLeader(raftGroupID) {
+		return errors.New("not leader")
+	}
+	var data []byte
+	var err error
+
+	kv := &kvp.Kv{Opt: OPT_BATCH, Batch: ops}
+
+	if data, err = pbproto.Marshal(kv); err != nil {
+		return err
+	}
+	resp := ms.raft.Submit(raftGroupID, data)
+	_, err = resp.Response()
+	if err != nil {
+		return fmt.Errorf("Batch error[%v]", err)
+	}
+	return nil
+}
+
 //InodeGet ...
 func (ms *KvStateMachine) InodeGet(raftGroupID uint64, key string) ([]byte, error) {
 	if !ms.raft.IsLeader(raftGroupID) {
@@ -312,6 +387,19 @@ func (ms *KvStateMachine) InodeGet(raftGroupID uint64, key string) ([]byte, erro
 
 }
 
+//InodeForEach : calls fn with each inode while holding the inode read lock, fn must not write
+func (ms *KvStateMachine) InodeForEach(raftGroupID uint64, fn func(key string, value []byte)) error {
+	if !ms.raft.IsLeader(raftGroupID) {
+		return errors.New("not leader")
+	}
+	ms.inodeLocker.RLock()
+	defer ms.inodeLocker.RUnlock()
+	for k, v := range ms.inodeData {
+		fn(k, v)
+	}
+	return nil
+}
+
 //InodeSet ...
 func (ms *KvStateMachine) InodeSet(raftGroupID uint64, key string, value []byte) error {
 	if !ms.raft.IsLeader(raftGroupID) {
@@ -454,6 +542,33 @@ func (ms *KvStateMachine) InodeIDGET(raftGroupID uint64) (uint64, error) {
 	return ms.inodeID, nil
 }
 
+//InodeIDsGET allocates n inode ids in one raft entry, returns the first one
+func (ms *KvStateMachine) InodeIDsGET(raftGroupID uint64, n uint64) (uint64, error) {
+	if !ms.raft.IsLeader(raftGroupID) {
+		return 0, errors.New("not leader")
+	}
+	if n == 0 {
+		return 0, errors.New("no ids to allocate")
+	}
+
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, n)
+	data, err := pbproto.Marshal(&kvp.Kv{Opt: OPT_ALLOCATE_INODEID, V: v})
+	if err != nil {
+		return 0, err
+	}
+	resp := ms.raft.Submit(raftGroupID, data)
+	last, err := resp.Response()
+	if err != nil {
+		return 0, fmt.Errorf("Put error[%v]", err)
+	}
+	id, ok := last.(uint64)
+	if !ok {
+		return 0, errors.New("no ids allocated")
+	}
+	return id - n + 1, nil
+}
+
 //AddNode ...
 func (ms *KvStateMachine) AddNode(peer proto.Peer) error {
 	resp := ms.raft.ChangeMember(1, proto.ConfAddNode, peer, nil)
@@ -478,8 +593,38 @@ func (ms *KvStateMachine) setApplied(index uint64) {
 	ms.applied = index
 }
 
-//HandleLeaderChange ...
+//HandleLeaderChange : pushes the new leader to the watchers
 func (ms *KvStateMachine) HandleLeaderChange(leader uint64) {
+	atomic.AddUint64(&ms.leaderChanges, 1)
+	ms.leaderLocker.Lock()
+	defer ms.leaderLocker.Unlock()
+	for ch := range ms.leaderWatchers {
+		// only the latest leader matters to a slow watcher
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- leader
+	}
+}
+
+//LeaderChanges : counts the leader changes seen, state kept only by the leader is stale once it moved
+func (ms *KvStateMachine) LeaderChanges() uint64 {
+	return atomic.LoadUint64(&ms.leaderChanges)
+}
+
+//WatchLeader : the channel gets the node id of each new leader, call cancel when done
+func (ms *KvStateMachine) WatchLeader() (<-chan uint64, func()) {
+	ch := make(chan uint64, 1)
+	ms.leaderLocker.Lock()
+	ms.leaderWatchers[ch] = true
+	ms.leaderLocker.Unlock()
+	cancel := func() {
+		ms.leaderLocker.Lock()
+		delete(ms.leaderWatchers, ch)
+		ms.leaderLocker.Unlock()
+	}
+	return ch, cancel
 }
 
 type kvSnapshot struct {
@@ -175,6 +175,7 @@ func LoadKvSnapShoot(ms *KvStateMachine, path string) (uint64, error) {
 		ms.DentryLocker.Unlock()
 		return 0, err
 	}
+	ms.indexDentries()
 	ms.DentryLocker.Unlock()
 
 	ms.inodeLocker.Lock()
@@ -195,6 +196,7 @@ func LoadKvSnapShoot(ms *KvStateMachine, path string) (uint64, error) {
 
 	ms.chunkID = binary.BigEndian.Uint64(bigdata[16+dentryLen+8+inodeLen+8+bgLen : 16+dentryLen+8+inodeLen+8+bgLen+8])
 	ms.inodeID = binary.BigEndian.Uint64(bigdata[16+dentryLen+8+inodeLen+8+bgLen+8:])
+	ms.resetJournal(ms.applied)
 
 	return ms.applied, nil
 }
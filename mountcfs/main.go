@@ -0,0 +1,194 @@
+// mount.cfs is the mount(8) helper of ContainerFS, installed as /sbin/mount.cfs so
+// volumes mount from /etc/fstab, autofs maps and systemd mount units:
+//
+//	cfs://192.168.100.100:10001/623be31a406d9df9803080ff42085ac7 /mnt/vol cfs _netdev,metanode=192.168.100.101:9903+192.168.100.102:9913,allow_other 0 0
+//
+// mount(8) runs it as mount.cfs spec dir [-sfnv] [-o options]. The spec is
+// cfs://volmgr/uuid[/subpath], the options are the keys of cfs-fuseclient.ini
+// (a bare key is key=1) and the usual ro, allow_other, noatime..., with the
+// metanode addresses joined by +. It starts cfs-fuseclient in the background and
+// returns once the volume is mounted.
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// exit codes of mount(8)
+const (
+	exitUsage   = 1
+	exitFailure = 32
+)
+
+// the default port of the volmgr
+const volmgrPort = "10001"
+
+// the generic options of mount(8), not for the fuseclient
+var ignored = map[string]bool{
+	"defaults": true, "auto": true, "noauto": true, "user": true, "nouser": true, "users": true,
+	"owner": true, "group": true, "_netdev": true, "nofail": true, "rw": true, "dev": true,
+	"nodev": true, "suid": true, "nosuid": true, "exec": true, "noexec": true, "async": true,
+}
+
+// mount what to start the fuseclient with
+type mount struct {
+	uuid       string
+	volmgr     string
+	subpath    string
+	dir        string
+	config     string
+	fuseclient string
+	env        []string
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %v cfs://volmgr/uuid[/subpath] dir [-sfnv] [-o options]\n", filepath.Base(os.Args[0]))
+	os.Exit(exitUsage)
+}
+
+// parseSpec the volmgr, uuid and subpath of cfs://volmgr/uuid[/subpath], the
+// scheme may be left out
+func parseSpec(spec string, m *mount) error {
+	s := strings.TrimPrefix(spec, "cfs://")
+	parts := strings.SplitN(s, "/", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("wrong device %v, use cfs://volmgr/uuid[/subpath]", spec)
+	}
+	m.volmgr = parts[0]
+	if !strings.Contains(m.volmgr, ":") {
+		m.volmgr += ":" + volmgrPort
+	}
+	m.uuid = parts[1]
+	if len(parts) == 3 && parts[2] != "" {
+		m.subpath = "/" + strings.TrimSuffix(parts[2], "/")
+	}
+	return nil
+}
+
+// setKey passes key to the fuseclient in its environment, see utils.ConfigEnv
+func (m *mount) setKey(key, val string) {
+	m.env = append(m.env, "CFS_"+strings.ToUpper(strings.Replace(key, "-", "_", -1))+"="+val)
+}
+
+// parseOptions the -o options
+func parseOptions(opts string, m *mount) {
+	for _, opt := range strings.Split(opts, ",") {
+		key, val := opt, "1"
+		if i := strings.Index(opt, "="); i >= 0 {
+			key, val = opt[:i], opt[i+1:]
+		}
+		switch {
+		case key == "" || ignored[key] || strings.HasPrefix(key, "x-") || key == "comment":
+		case key == "ro":
+			m.setKey("read_only", "1")
+		case key == "sync":
+			m.setKey("sync_mode", "always")
+		case key == "allow_other":
+			m.setKey("allow", "other")
+		case key == "allow_root":
+			m.setKey("allow", "root")
+		case key == "noatime" || key == "relatime":
+			m.setKey("atime", key)
+		case key == "strictatime":
+			m.setKey("atime", "strict")
+		case key == "metanode":
+			m.setKey("metanode", strings.Replace(val, "+", ",", -1))
+		case key == "config":
+			m.config = val
+		case key == "fuseclient":
+			m.fuseclient = val
+		default:
+			m.setKey(key, val)
+		}
+	}
+}
+
+// fuseclientPath cfs-fuseclient next to this helper, else in the PATH
+func fuseclientPath() string {
+	if exe, err := os.Executable(); err == nil {
+		p := filepath.Join(filepath.Dir(exe), "cfs-fuseclient")
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	if p, err := exec.LookPath("cfs-fuseclient"); err == nil {
+		return p
+	}
+	return "/usr/local/bin/cfs-fuseclient"
+}
+
+func main() {
+	var m mount
+	var args []string
+	var fake, verbose bool
+	for i := 1; i < len(os.Args); i++ {
+		a := os.Args[i]
+		if !strings.HasPrefix(a, "-") || len(a) == 1 {
+			args = append(args, a)
+			continue
+		}
+		for j := 1; j < len(a); j++ {
+			switch a[j] {
+			case 's', 'n':
+				// sloppy options are all taken, there is no mtab to skip
+			case 'f':
+				fake = true
+			case 'v':
+				verbose = true
+			case 'o', 't', 'N':
+				val := a[j+1:]
+				if val == "" {
+					if i++; i >= len(os.Args) {
+						usage()
+					}
+					val = os.Args[i]
+				}
+				if a[j] == 'o' {
+					parseOptions(val, &m)
+				}
+				j = len(a)
+			default:
+				usage()
+			}
+		}
+	}
+	if len(args) != 2 {
+		usage()
+	}
+	if err := parseSpec(args[0], &m); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+	m.dir = args[1]
+	if m.fuseclient == "" {
+		m.fuseclient = fuseclientPath()
+	}
+
+	cmdArgs := []string{"-uuid", m.uuid, "-volmgr", m.volmgr, "-mountpoint", m.dir, "-d"}
+	if m.subpath != "" {
+		cmdArgs = append(cmdArgs, "-subpath", m.subpath)
+	}
+	if m.config != "" {
+		cmdArgs = append(cmdArgs, "-config", m.config)
+	}
+	if verbose || fake {
+		fmt.Println(strings.Join(m.env, " "), m.fuseclient, strings.Join(cmdArgs, " "))
+	}
+	if fake {
+		return
+	}
+	cmd := exec.Command(m.fuseclient, cmdArgs...)
+	cmd.Env = append(os.Environ(), m.env...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mount.cfs: %v: %v\n%s", args[0], err, out)
+		os.Exit(exitFailure)
+	}
+	if verbose {
+		fmt.Printf("%s", out)
+	}
+}
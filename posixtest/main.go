@@ -0,0 +1,199 @@
+// Command posixtest runs pjdfstest and fsx against a mounted volume and compares
+// the failures with those of known_failures, to track the POSIX conformance of the
+// fuseclient: it exits 1 on a failure not listed, and names the listed ones that
+// pass now so the list shrinks as the gaps get fixed.
+//
+// With -mnt it tests that mount, else it starts a testcluster (see its environment),
+// creates a volume and mounts it with default_permissions. pjdfstest needs root.
+//
+//	cfs-posixtest -pjdfstest ~/pjdfstest -fsx /usr/bin/fsx
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/ipdcode/containerfs/testcluster"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	mnt       = flag.String("mnt", "", "mounted volume to test, empty starts a testcluster")
+	pjdfstest = flag.String("pjdfstest", "", "dir of a built pjdfstest, empty skips it")
+	fsx       = flag.String("fsx", "", "fsx binary, empty skips it")
+	fsxOps    = flag.Int("fsxops", 10000, "operations of the fsx run")
+	known     = flag.String("known", "known_failures", "file of the known failures")
+	update    = flag.Bool("update", false, "write the failures of this run to the known file")
+)
+
+// the prove summary line of a test file that failed
+var proveFailed = regexp.MustCompile(`^(\S+\.t)\s+\(Wstat:`)
+
+// loadKnown the entries of a known failures file: test files relative to the tests
+// dir of pjdfstest, a dir ending with / for all of its tests, or fsx
+func loadKnown(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries := make(map[string]bool)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			entries[line] = true
+		}
+	}
+	return entries, sc.Err()
+}
+
+// isKnown whether the failure of test is listed, itself or its dir
+func isKnown(entries map[string]bool, test string) (string, bool) {
+	if entries[test] {
+		return test, true
+	}
+	if dir := filepath.Dir(test) + "/"; entries[dir] {
+		return dir, true
+	}
+	return "", false
+}
+
+// runPjdfstest the test files that failed, relative to the tests dir
+func runPjdfstest(dir string) ([]string, error) {
+	tests := filepath.Join(*pjdfstest, "tests")
+	cmd := exec.Command("prove", "-r", tests)
+	cmd.Dir = dir
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return nil, err
+	}
+	os.Stdout.Write(out.Bytes())
+	var failed []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if m := proveFailed.FindStringSubmatch(line); m != nil {
+			if rel, err := filepath.Rel(tests, m[1]); err == nil {
+				failed = append(failed, rel)
+			}
+		}
+	}
+	return failed, nil
+}
+
+// runFsx whether fsx went through its operations on a file of dir
+func runFsx(dir string) bool {
+	// no mmap: the direct IO files of the mount do not support it
+	cmd := exec.Command(*fsx, "-N", fmt.Sprint(*fsxOps), "-R", "-W", filepath.Join(dir, "fsx.data"))
+	cmd.Dir = dir
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd.Run() == nil
+}
+
+func main() {
+	flag.Parse()
+	os.Exit(run())
+}
+
+// run the tests, the exit code: 1 on new failures, 2 when they could not run
+func run() int {
+	root := *mnt
+	if root == "" {
+		if err := testcluster.Available(); err != nil {
+			fmt.Println("no cluster:", err)
+			return 2
+		}
+		c, err := testcluster.Start(testcluster.Options{})
+		defer func() {
+			if c != nil {
+				c.Stop()
+			}
+		}()
+		if err != nil {
+			fmt.Println("start cluster:", err)
+			return 2
+		}
+		uuid, err := c.CreateVol("posixtest", 10)
+		if err == nil {
+			root, err = c.Mount(uuid, "allow = other", "default_permissions = 1")
+		}
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+	}
+	dir, err := ioutil.TempDir(root, "posixtest-")
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	defer os.RemoveAll(dir)
+
+	var failed []string
+	if *pjdfstest != "" {
+		f, err := runPjdfstest(dir)
+		if err != nil {
+			fmt.Println("pjdfstest:", err)
+			return 2
+		}
+		failed = append(failed, f...)
+	}
+	if *fsx != "" && !runFsx(dir) {
+		failed = append(failed, "fsx")
+	}
+
+	if *update {
+		sort.Strings(failed)
+		if err := ioutil.WriteFile(*known, []byte(strings.Join(failed, "\n")+"\n"), 0644); err != nil {
+			fmt.Println(err)
+			return 2
+		}
+		fmt.Printf("%v failures written to %v\n", len(failed), *known)
+		return 0
+	}
+	entries, err := loadKnown(*known)
+	if err != nil {
+		fmt.Println("known failures:", err)
+		return 2
+	}
+	used := make(map[string]bool)
+	var unknown []string
+	for _, test := range failed {
+		if e, ok := isKnown(entries, test); ok {
+			used[e] = true
+			continue
+		}
+		unknown = append(unknown, test)
+	}
+	var fixed []string
+	for e := range entries {
+		ran := (e == "fsx" && *fsx != "") || (e != "fsx" && *pjdfstest != "")
+		if ran && !used[e] {
+			fixed = append(fixed, e)
+		}
+	}
+	sort.Strings(fixed)
+	for _, e := range fixed {
+		fmt.Printf("passes now, remove it from %v: %v\n", *known, e)
+	}
+	for _, test := range unknown {
+		fmt.Printf("FAIL %v\n", test)
+	}
+	fmt.Printf("%v failures, %v known, %v new\n", len(failed), len(failed)-len(unknown), len(unknown))
+	if len(unknown) > 0 {
+		return 1
+	}
+	return 0
+}
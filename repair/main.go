@@ -6,7 +6,10 @@ import (
 	"errors"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/ipdcode/containerfs/datanode/archive"
+	"github.com/ipdcode/containerfs/datanode/store"
 	"github.com/ipdcode/containerfs/logger"
+	dp "github.com/ipdcode/containerfs/proto/dp"
 	mp "github.com/ipdcode/containerfs/proto/mp"
 	rp "github.com/ipdcode/containerfs/proto/rp"
 	"github.com/ipdcode/containerfs/utils"
@@ -73,23 +76,27 @@ func getNeedRepairChunks() {
 	var inode uint64
 	var chkid uint64
 	var position int
-	rpr, err := VolMgrDB.Query("select volid,blkgrpid,blkid,blkport,chkid, position,inode  from repair where blkip=? and status=2 limit 10", RepairServerAddr.host)
+	var rstatus int
+	rpr, err := VolMgrDB.Query("select volid,blkgrpid,blkid,blkport,chkid, position,inode,status  from repair where blkip=? and status in (2,3) limit 10", RepairServerAddr.host)
 	if err != nil {
 		logger.Error("Get from blk table for need repair blkds in this node error:%s", err)
 	}
 	defer rpr.Close()
 	for rpr.Next() {
-		err = rpr.Scan(&volid, &blkgrpid, &blkid, &blkport, &chkid, &position, &inode)
+		err = rpr.Scan(&volid, &blkgrpid, &blkid, &blkport, &chkid, &position, &inode, &rstatus)
 		if err != nil {
 			logger.Error("Scan db for get need repair chunks error:%v", err)
 			continue
 		}
 		Wg.Add(1)
-		go repairchk(volid, blkgrpid, blkid, blkport, chkid, position, inode)
+		go repairchk(volid, blkgrpid, blkid, blkport, chkid, position, inode, rstatus == 3)
 	}
 }
 
-func repairchk(volid string, blkgrpid uint32, blkid uint32, blkport int, chkid uint64, position int, inode uint64) {
+// repairchk copies the chunk to the blk on this node from another blk of its group.
+// A move (repair status 3) copies it ahead of the switch of the blk to this node: the
+// blk itself, still on its old node, may be the source and the metadata is left alone.
+func repairchk(volid string, blkgrpid uint32, blkid uint32, blkport int, chkid uint64, position int, inode uint64, move bool) {
 	logger.Debug("=== Begin repair blkgrp:%v - blk:%v - chk:%v", blkgrpid, blkid, chkid)
 
 	//if disk bad(I/O error)
@@ -110,8 +117,14 @@ func repairchk(volid string, blkgrpid uint32, blkid uint32, blkport int, chkid u
 			return
 		}
 	}
-	if status == 2 {
-		logger.Debug("The blk:%v bad chunk:%v on disk:%v-%v I/O error, so not repair util the disk recover", blkid, chkid, RepairServerAddr.host, blkport)
+	if p, s, ok := dataDirOf(RepairServerAddr.host, blkport, blkid); ok {
+		path = p
+		if status == 0 {
+			status = s
+		}
+	}
+	if status != 0 {
+		logger.Debug("The blk:%v bad chunk:%v on disk:%v-%v statu:%v, so not repair util the disk recover", blkid, chkid, RepairServerAddr.host, blkport, status)
 		Wg.Add(-1)
 		return
 	}
@@ -135,7 +148,7 @@ func repairchk(volid string, blkgrpid uint32, blkid uint32, blkport int, chkid u
 		s := strings.Split(blks, ",")
 		for _, v := range s[:len(s)-1] {
 			srcblkid, _ := strconv.Atoi(v)
-			if uint32(srcblkid) != blkid {
+			if uint32(srcblkid) != blkid || move {
 				var srcip string
 				var srcport int
 				var disabled int
@@ -161,7 +174,7 @@ func repairchk(volid string, blkgrpid uint32, blkid uint32, blkport int, chkid u
 					Wg.Add(-1)
 					return
 				}
-				ret := beginRepairchunk(volid, srcip, srcport, uint32(srcblkid), path, blkid, chkid, position, inode)
+				ret := beginRepairchunk(volid, srcip, srcport, uint32(srcblkid), path, blkid, chkid, position, inode, move)
 				if ret != 0 {
 					continue
 				} else {
@@ -185,7 +198,35 @@ func repairchk(volid string, blkgrpid uint32, blkid uint32, blkport int, chkid u
 	}
 }
 
-func beginRepairchunk(volid string, srcip string, srcport int, srcblkid uint32, path string, blkid uint32, chkid uint64, position int, inode uint64) (ret int) {
+// dataDirOf the data dir of a datanode holding the blk and its statu, for a blk
+// on none of them the first healthy dir. False for datanodes with one data dir.
+func dataDirOf(ip string, port int, blkid uint32) (string, int, bool) {
+	rows, err := VolMgrDB.Query("SELECT path,statu FROM datadirs WHERE ip=? and port=?", ip, port)
+	if err != nil {
+		logger.Error("Get datadirs of %v:%v error:%v", ip, port, err)
+		return "", 0, false
+	}
+	defer rows.Close()
+	var first string
+	found := false
+	for rows.Next() {
+		var path string
+		var statu int
+		if err := rows.Scan(&path, &statu); err != nil {
+			continue
+		}
+		if ok, _ := utils.LocalPathExists(path + "/block-" + strconv.FormatUint(uint64(blkid), 10)); ok {
+			return path, statu, true
+		}
+		if !found && statu == 0 {
+			first = path
+			found = true
+		}
+	}
+	return first, 0, found
+}
+
+func beginRepairchunk(volid string, srcip string, srcport int, srcblkid uint32, path string, blkid uint32, chkid uint64, position int, inode uint64, move bool) (ret int) {
 	logger.Debug("Begin repair chunkfile path:%v-%v from srcip:%v-srcport:%v-srcblk:%v", path, chkid, srcip, srcport, srcblkid)
 	srcAddr := srcip + ":" + strconv.Itoa(RepairServerAddr.port)
 	conn, err := grpc.Dial(srcAddr, grpc.WithInsecure())
@@ -220,6 +261,9 @@ func beginRepairchunk(volid string, srcip string, srcport int, srcblkid uint32,
 		return -1
 	}
 	defer f.Close()
+	// the datanode write checksums no longer describe the rewritten chunk, the
+	// repair records its own once written
+	os.Remove(store.ChecksumFile(dfile))
 	w := bufio.NewWriter(f)
 
 	ack, err := stream.Recv()
@@ -230,6 +274,18 @@ func beginRepairchunk(volid string, srcip string, srcport int, srcblkid uint32,
 	if err != nil || n != 64*1024*1024 {
 		return -1
 	}
+	if err := w.Flush(); err != nil {
+		return -1
+	}
+	if err := store.RecordChecksums(dfile, 0, ack.Databuf); err != nil {
+		logger.Error("Record checksums of repaired chunk:%v error:%v", dfile, err)
+		return -1
+	}
+
+	if move {
+		logger.Debug("Copied chunkfile:%v-%v-%v from srcblk:%v for a move", path, blkid, chkid, srcblkid)
+		return 0
+	}
 
 	//update meta for the repair complete blk
 	conn, err = DialMeta(volid)
@@ -255,6 +311,28 @@ func beginRepairchunk(volid string, srcip string, srcport int, srcblkid uint32,
 	return 0
 }
 
+// recallChunk has the datanode bring an archived chunk back from the bucket: its
+// first read does, the chunk is then on the disk for GetSrcData
+func recallChunk(ip string, port int, blkid uint32, chkid uint64) error {
+	addr := ip + ":" + strconv.Itoa(port)
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Second))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	stream, err := dp.NewDataNodeClient(conn).StreamReadChunk(ctx, &dp.StreamReadChunkReq{ChunkID: chkid, BlockID: blkid, Offset: 0, Readsize: 1, Background: true})
+	if err != nil {
+		return err
+	}
+	if _, err := stream.Recv(); err != nil {
+		return fmt.Errorf("recall chunk:%v of blk:%v on %v: %v", chkid, blkid, addr, err)
+	}
+	logger.Debug("Recalled archived chunk:%v of blk:%v on %v for repair", chkid, blkid, addr)
+	return nil
+}
+
 // GetSrcData Repair bad chunk get data from good backup chunk
 func (s *RepairServer) GetSrcData(in *rp.GetSrcDataReq, stream rp.Repair_GetSrcDataServer) error {
 	var ack rp.GetSrcDataAck
@@ -278,8 +356,18 @@ func (s *RepairServer) GetSrcData(in *rp.GetSrcDataReq, stream rp.Repair_GetSrcD
 			return err
 		}
 	}
+	if p, _, ok := dataDirOf(srcip, int(srcport), srcid); ok {
+		srcmp = p
+	}
 	srcchkpath := srcmp + "/block-" + strconv.FormatInt(int64(srcid), 10) + "/chunk-" + strconv.FormatInt(int64(chkid), 10)
 	fi, err := os.Stat(srcchkpath)
+	if os.IsNotExist(err) {
+		if _, serr := os.Stat(srcchkpath + archive.StubSuffix); serr == nil {
+			if err = recallChunk(srcip, int(srcport), srcid, chkid); err == nil {
+				fi, err = os.Stat(srcchkpath)
+			}
+		}
+	}
 	if err != nil {
 		logger.Error("Read SrcChkPath:%v error:%v", srcchkpath, err)
 		return err
@@ -383,6 +471,7 @@ func init() {
 		fmt.Println("NewConfig err")
 		os.Exit(1)
 	}
+	utils.ConfigEnv(c)
 	port, _ := c.Int("port")
 	RepairServerAddr.port = port
 	RepairServerAddr.log = c.String("log")
@@ -0,0 +1,101 @@
+// Command snapshotter is a containerd proxy snapshotter keeping the rootfs layers
+// of the containers in a ContainerFS volume. The volume is mounted by a fuseclient
+// on every node; containerd reaches this process over a unix socket:
+//
+//	[proxy_plugins]
+//	  [proxy_plugins.containerfs]
+//	    type = "snapshot"
+//	    address = "/run/cfs-snapshotter.sock"
+//
+// and runs the containers with --snapshotter containerfs. The snapshots of a node
+// are in a dir of its own, named by node (the hostname by default).
+//
+// The layers need symlinks; the snapshotter refuses to start on a mount that has
+// none.
+package main
+
+import (
+	"fmt"
+	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
+	"github.com/containerd/containerd/contrib/snapshotservice"
+	cfs "github.com/ipdcode/containerfs/fs"
+	"github.com/ipdcode/containerfs/logger"
+	"github.com/ipdcode/containerfs/utils"
+	"github.com/lxmgo/config"
+	"google.golang.org/grpc"
+	"net"
+	"os"
+)
+
+func main() {
+
+	if len(os.Args) < 2 {
+		fmt.Println("cfs-snapshotter [ini]")
+		os.Exit(1)
+	}
+	c, err := config.NewConfig(os.Args[1])
+	if err != nil {
+		fmt.Println("NewConfig err")
+		os.Exit(1)
+	}
+	utils.ConfigEnv(c)
+
+	logger.SetConsole(true)
+	logger.SetRollingFile(c.String("log"), "snapshotter.log", 10, 100, logger.MB) //each 100M rolling
+	switch level := c.String("loglevel"); level {
+	case "error":
+		logger.SetLevel(logger.ERROR)
+	case "debug":
+		logger.SetLevel(logger.DEBUG)
+	case "info":
+		logger.SetLevel(logger.INFO)
+	default:
+		logger.SetLevel(logger.ERROR)
+	}
+
+	cfs.VolMgrAddr = c.String("volmgr")
+	cfs.MetaNodePeers = c.Strings("metanode")
+	if len(cfs.MetaNodePeers) == 0 {
+		fmt.Println("no metanode")
+		os.Exit(1)
+	}
+	uuid := c.String("uuid")
+	leader, err := cfs.GetLeader(uuid)
+	if err != nil {
+		fmt.Printf("volume %v: no metanode leader: %v\n", uuid, err)
+		os.Exit(1)
+	}
+	cfs.MetaNodeAddr = leader
+	go cfs.WatchLeader(uuid)
+
+	dir := c.String("dir")
+	if dir == "" {
+		dir = "containerd"
+	}
+	node := c.String("node")
+	if node == "" {
+		node, _ = os.Hostname()
+	}
+	sn, err := newSnapshotter(uuid, c.String("mountpoint"), c.String("subpath"), dir, node)
+	if err != nil {
+		fmt.Printf("snapshot dir on %v: %v\n", c.String("mountpoint"), err)
+		os.Exit(1)
+	}
+
+	address := c.String("address")
+	if address == "" {
+		address = "/run/cfs-snapshotter.sock"
+	}
+	os.Remove(address)
+	lis, err := net.Listen("unix", address)
+	if err != nil {
+		logger.Error("failed to listen: %v", err)
+		os.Exit(1)
+	}
+	rpc := grpc.NewServer()
+	snapshotsapi.RegisterSnapshotsServer(rpc, snapshotservice.FromSnapshotter(sn))
+	if err := rpc.Serve(lis); err != nil {
+		logger.Error("failed to serve: %v", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/filters"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	cfs "github.com/ipdcode/containerfs/fs"
+	"github.com/ipdcode/containerfs/logger"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// snapshot the record of a snapshot, a json file in the meta dir named by the
+// hash of its key
+type snapshot struct {
+	ID string // its dir under snapshots
+	snapshots.Info
+}
+
+// snapshotter keeps the snapshots in a dir of a volume, a dir per node: the keys
+// are those of the containerd of the node, another node has the same ones for other
+// snapshots. A snapshot is a whole tree: Prepare copies the tree of the parent with
+// copytree, the files share the chunks of the parent so it costs the metadata only.
+// The rootfs is then a bind mount of the tree, no overlay.
+type snapshotter struct {
+	uuid  string
+	root  string // the dir on the mount
+	vroot string // the same dir in the volume
+
+	mu sync.Mutex
+}
+
+func newSnapshotter(uuid string, mountpoint string, subpath string, dir string, node string) (*snapshotter, error) {
+	if node == "" || strings.ContainsAny(node, "/") || node == "." || node == ".." {
+		return nil, fmt.Errorf("bad node name %q", node)
+	}
+	s := &snapshotter{
+		uuid:  uuid,
+		root:  filepath.Join(mountpoint, dir, node),
+		vroot: strings.Trim(path.Join(subpath, dir, node), "/"),
+	}
+	for _, d := range []string{s.root, filepath.Join(s.root, "meta"), filepath.Join(s.root, "snapshots")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.checkSymlink(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// checkSymlink the layers are full of symlinks, a mount that cannot make them fails
+// here rather than on the first image pulled
+func (s *snapshotter) checkSymlink() error {
+	p := filepath.Join(s.root, ".symlink-check")
+	os.Remove(p)
+	if err := os.Symlink("target", p); err != nil {
+		return fmt.Errorf("mount %v cannot keep the symlinks of the layers: %v", s.root, err)
+	}
+	os.Remove(p)
+	return nil
+}
+
+func (s *snapshotter) metaFile(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.root, "meta", hex.EncodeToString(sum[:])+".json")
+}
+
+func (s *snapshotter) dir(id string) string {
+	return filepath.Join(s.root, "snapshots", id, "fs")
+}
+
+func (s *snapshotter) get(key string) (*snapshot, error) {
+	b, err := ioutil.ReadFile(s.metaFile(key))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("snapshot %v: %w", key, errdefs.ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sn := &snapshot{}
+	if err := json.Unmarshal(b, sn); err != nil {
+		return nil, fmt.Errorf("snapshot %v: %v", key, err)
+	}
+	return sn, nil
+}
+
+// put writes the record, a file written whole then renamed so the other nodes never
+// read half of it
+func (s *snapshotter) put(sn *snapshot) error {
+	b, err := json.Marshal(sn)
+	if err != nil {
+		return err
+	}
+	f := s.metaFile(sn.Name)
+	tmp := f + ".tmp"
+	os.Remove(tmp)
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f)
+}
+
+func (s *snapshotter) all() ([]*snapshot, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(s.root, "meta"))
+	if err != nil {
+		return nil, err
+	}
+	var res []*snapshot
+	for _, fi := range fis {
+		if !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(s.root, "meta", fi.Name()))
+		if err != nil {
+			continue
+		}
+		sn := &snapshot{}
+		if json.Unmarshal(b, sn) == nil {
+			res = append(res, sn)
+		}
+	}
+	return res, nil
+}
+
+func (s *snapshotter) Stat(ctx context.Context, key string) (snapshots.Info, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sn, err := s.get(key)
+	if err != nil {
+		return snapshots.Info{}, err
+	}
+	return sn.Info, nil
+}
+
+// Update the labels, the only field that may change
+func (s *snapshotter) Update(ctx context.Context, info snapshots.Info, fieldpaths ...string) (snapshots.Info, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sn, err := s.get(info.Name)
+	if err != nil {
+		return snapshots.Info{}, err
+	}
+	if len(fieldpaths) == 0 {
+		fieldpaths = []string{"labels"}
+	}
+	for _, p := range fieldpaths {
+		switch {
+		case p == "labels":
+			sn.Labels = info.Labels
+		case strings.HasPrefix(p, "labels."):
+			k := strings.TrimPrefix(p, "labels.")
+			if sn.Labels == nil {
+				sn.Labels = make(map[string]string)
+			}
+			if v, ok := info.Labels[k]; ok {
+				sn.Labels[k] = v
+			} else {
+				delete(sn.Labels, k)
+			}
+		default:
+			return snapshots.Info{}, fmt.Errorf("cannot update %v of snapshot %v: %w", p, info.Name, errdefs.ErrInvalidArgument)
+		}
+	}
+	sn.Updated = time.Now().UTC()
+	if err := s.put(sn); err != nil {
+		return snapshots.Info{}, err
+	}
+	return sn.Info, nil
+}
+
+// Usage of the tree of the snapshot, the chunks shared with the parent included
+func (s *snapshotter) Usage(ctx context.Context, key string) (snapshots.Usage, error) {
+	s.mu.Lock()
+	sn, err := s.get(key)
+	s.mu.Unlock()
+	if err != nil {
+		return snapshots.Usage{}, err
+	}
+	ret, du := cfs.DirUsage(s.uuid, path.Join(s.vroot, "snapshots", sn.ID, "fs"))
+	if ret != 0 || du == nil {
+		return snapshots.Usage{}, fmt.Errorf("usage of snapshot %v ret:%v", key, ret)
+	}
+	return snapshots.Usage{Inodes: du.Files + du.Dirs, Size: du.Bytes}, nil
+}
+
+func (s *snapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sn, err := s.get(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.mounts(sn), nil
+}
+
+func (s *snapshotter) mounts(sn *snapshot) []mount.Mount {
+	opts := []string{"rbind", "rw"}
+	if sn.Kind != snapshots.KindActive {
+		opts = []string{"rbind", "ro"}
+	}
+	return []mount.Mount{{Type: "bind", Source: s.dir(sn.ID), Options: opts}}
+}
+
+func (s *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	return s.create(snapshots.KindActive, key, parent, opts)
+}
+
+func (s *snapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	return s.create(snapshots.KindView, key, parent, opts)
+}
+
+func (s *snapshotter) create(kind snapshots.Kind, key string, parent string, opts []snapshots.Opt) ([]mount.Mount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.get(key); err == nil {
+		return nil, fmt.Errorf("snapshot %v: %w", key, errdefs.ErrAlreadyExists)
+	}
+	now := time.Now().UTC()
+	sn := &snapshot{ID: newID(), Info: snapshots.Info{Kind: kind, Name: key, Parent: parent, Created: now, Updated: now}}
+	for _, o := range opts {
+		if err := o(&sn.Info); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(s.dir(sn.ID)), 0755); err != nil {
+		return nil, err
+	}
+	if parent == "" {
+		if err := os.Mkdir(s.dir(sn.ID), 0755); err != nil {
+			return nil, err
+		}
+	} else {
+		p, err := s.get(parent)
+		if err != nil {
+			return nil, err
+		}
+		if p.Kind != snapshots.KindCommitted {
+			return nil, fmt.Errorf("parent %v is not committed: %w", parent, errdefs.ErrInvalidArgument)
+		}
+		if err := s.clone(p.ID, sn.ID); err != nil {
+			os.RemoveAll(filepath.Dir(s.dir(sn.ID)))
+			return nil, err
+		}
+	}
+	if err := s.put(sn); err != nil {
+		os.RemoveAll(filepath.Dir(s.dir(sn.ID)))
+		return nil, err
+	}
+	return s.mounts(sn), nil
+}
+
+// clone the tree of snapshot from to snapshot to on the metanode, through the
+// mount when copytree cannot (the trees are in different shards)
+func (s *snapshotter) clone(from string, to string) error {
+	src := path.Join(s.vroot, "snapshots", from, "fs")
+	dst := path.Join(s.vroot, "snapshots", to, "fs")
+	ret, files, dirs := cfs.CopyTree(s.uuid, src, dst)
+	if ret == 0 {
+		logger.Debug("snapshot %v from %v: files %v dirs %v", to, from, files, dirs)
+		return nil
+	}
+	if ret != 18 /*EXDEV*/ {
+		return fmt.Errorf("copytree %v to %v ret:%v", src, dst, ret)
+	}
+	os.RemoveAll(s.dir(to))
+	return copyTree(s.dir(from), s.dir(to))
+}
+
+func copyTree(src string, dst string) error {
+	return filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, p)
+		target := filepath.Join(dst, rel)
+		if fi.IsDir() {
+			return os.Mkdir(target, 0755)
+		}
+		if !fi.Mode().IsRegular() {
+			return fmt.Errorf("copy %v: cannot copy a %v", p, fi.Mode().Type())
+		}
+		r, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		w, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, r)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	})
+}
+
+// Commit makes the active snapshot key the committed snapshot name, its tree stays
+func (s *snapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sn, err := s.get(key)
+	if err != nil {
+		return err
+	}
+	if sn.Kind != snapshots.KindActive {
+		return fmt.Errorf("snapshot %v is not active: %w", key, errdefs.ErrFailedPrecondition)
+	}
+	if _, err := s.get(name); err == nil {
+		return fmt.Errorf("snapshot %v: %w", name, errdefs.ErrAlreadyExists)
+	}
+	sn.Kind = snapshots.KindCommitted
+	sn.Name = name
+	sn.Updated = time.Now().UTC()
+	for _, o := range opts {
+		if err := o(&sn.Info); err != nil {
+			return err
+		}
+	}
+	if err := s.put(sn); err != nil {
+		return err
+	}
+	return os.Remove(s.metaFile(key))
+}
+
+// Remove a snapshot no other one is made from
+func (s *snapshotter) Remove(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sn, err := s.get(key)
+	if err != nil {
+		return err
+	}
+	all, err := s.all()
+	if err != nil {
+		return err
+	}
+	for _, c := range all {
+		if c.Parent == key {
+			return fmt.Errorf("snapshot %v has children: %w", key, errdefs.ErrFailedPrecondition)
+		}
+	}
+	if err := os.Remove(s.metaFile(key)); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(filepath.Dir(s.dir(sn.ID))); err != nil {
+		logger.Error("remove snapshot %v dir %v err:%v", key, sn.ID, err)
+	}
+	return nil
+}
+
+func (s *snapshotter) Walk(ctx context.Context, fn snapshots.WalkFunc, fs ...string) error {
+	filter, err := filters.ParseAll(fs...)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	all, err := s.all()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, sn := range all {
+		if !filter.Match(adapt(sn.Info)) {
+			continue
+		}
+		if err := fn(ctx, sn.Info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adapt the fields of info for the filters
+func adapt(info snapshots.Info) filters.Adaptor {
+	return filters.AdapterFunc(func(fieldpath []string) (string, bool) {
+		if len(fieldpath) == 0 {
+			return "", false
+		}
+		switch fieldpath[0] {
+		case "kind":
+			return info.Kind.String(), true
+		case "name":
+			return info.Name, len(info.Name) > 0
+		case "parent":
+			return info.Parent, len(info.Parent) > 0
+		case "labels":
+			if len(fieldpath) < 2 {
+				return "", false
+			}
+			v, ok := info.Labels[strings.Join(fieldpath[1:], ".")]
+			return v, ok
+		}
+		return "", false
+	})
+}
+
+func (s *snapshotter) Close() error {
+	return nil
+}
+
+func newID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102") + "-" + hex.EncodeToString(b)
+}
@@ -0,0 +1,446 @@
+// cfs-sync copies a tree between a local filesystem and a volume through libcfs,
+// no mount needed, for the initial loading of a volume and its backups.
+//
+//	cfs-sync cfs-sync.ini [-threads 8] [-checksum] [-verify] /data/set cfs:/sets/set
+//	cfs-sync cfs-sync.ini cfs:/sets /backup/sets
+//
+// The files are copied by -threads workers. A file already at the destination with
+// the size of the source is skipped, a shorter one is taken as an interrupted copy
+// and only its tail is copied, so a run killed halfway is resumed by running it
+// again. -checksum compares the part already there with the source before trusting
+// it, -verify reads both copies back after a transfer.
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/ipdcode/containerfs/libcfs"
+	"github.com/ipdcode/containerfs/logger"
+	"github.com/ipdcode/containerfs/utils"
+	"github.com/lxmgo/config"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// volPrefix of the paths in the volume
+const volPrefix = "cfs:"
+
+var threads = flag.Int("threads", 8, "files copied at once")
+var checksum = flag.Bool("checksum", false, "compare the part of a file already copied with the source before resuming or skipping it")
+var verify = flag.Bool("verify", false, "compare the checksums of the source and the copy after each transfer")
+
+// entry a file or dir of a tree
+type entry struct {
+	name  string
+	dir   bool
+	size  int64
+	mtime time.Time
+}
+
+// reader an open file of a tree
+type reader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// tree one side of a sync, the paths are slash separated and relative to its root
+type tree interface {
+	ReadDir(rel string) ([]entry, error)
+	Stat(rel string) (entry, error)
+	Mkdir(rel string) error
+	Open(rel string) (reader, error)
+	// Append opens the file for writing at size, 0 starts it over
+	Append(rel string, size int64) (io.WriteCloser, error)
+	// Done the file was copied from src
+	Done(rel string, src entry)
+}
+
+// localTree a dir of the local filesystem
+type localTree struct {
+	root string
+}
+
+func (t *localTree) path(rel string) string {
+	return filepath.Join(t.root, filepath.FromSlash(rel))
+}
+
+func (t *localTree) ReadDir(rel string) ([]entry, error) {
+	des, err := os.ReadDir(t.path(rel))
+	if err != nil {
+		return nil, err
+	}
+	var res []entry
+	for _, de := range des {
+		fi, err := de.Info()
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			// links, devices and the like have no place in a volume
+			logger.Info("skip %v: not a regular file", path.Join(rel, de.Name()))
+			continue
+		}
+		res = append(res, entry{name: de.Name(), dir: fi.IsDir(), size: fi.Size(), mtime: fi.ModTime()})
+	}
+	return res, nil
+}
+
+func (t *localTree) Stat(rel string) (entry, error) {
+	fi, err := os.Stat(t.path(rel))
+	if err != nil {
+		return entry{}, err
+	}
+	return entry{name: fi.Name(), dir: fi.IsDir(), size: fi.Size(), mtime: fi.ModTime()}, nil
+}
+
+func (t *localTree) Mkdir(rel string) error {
+	err := os.Mkdir(t.path(rel), 0755)
+	if errors.Is(err, iofs.ErrExist) {
+		return nil
+	}
+	return err
+}
+
+func (t *localTree) Open(rel string) (reader, error) {
+	return os.Open(t.path(rel))
+}
+
+func (t *localTree) Append(rel string, size int64) (io.WriteCloser, error) {
+	if size == 0 {
+		return os.OpenFile(t.path(rel), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	}
+	f, err := os.OpenFile(t.path(rel), os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (t *localTree) Done(rel string, src entry) {
+	os.Chtimes(t.path(rel), time.Now(), src.mtime)
+}
+
+// volTree a dir of the volume
+type volTree struct {
+	fs   *libcfs.FS
+	root string
+}
+
+func (t *volTree) path(rel string) string {
+	p := strings.Trim(path.Join(t.root, rel), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+func (t *volTree) ReadDir(rel string) ([]entry, error) {
+	des, err := t.fs.ReadDir(t.path(rel))
+	if err != nil {
+		return nil, err
+	}
+	res := make([]entry, 0, len(des))
+	for _, de := range des {
+		fi, err := de.Info()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, entry{name: de.Name(), dir: fi.IsDir(), size: fi.Size(), mtime: fi.ModTime()})
+	}
+	return res, nil
+}
+
+func (t *volTree) Stat(rel string) (entry, error) {
+	fi, err := t.fs.Stat(t.path(rel))
+	if err != nil {
+		return entry{}, err
+	}
+	return entry{name: fi.Name(), dir: fi.IsDir(), size: fi.Size(), mtime: fi.ModTime()}, nil
+}
+
+func (t *volTree) Mkdir(rel string) error {
+	err := t.fs.Mkdir(t.path(rel))
+	if errors.Is(err, iofs.ErrExist) {
+		return nil
+	}
+	return err
+}
+
+func (t *volTree) Open(rel string) (reader, error) {
+	return t.fs.OpenFile(t.path(rel), os.O_RDONLY, 0)
+}
+
+func (t *volTree) Append(rel string, size int64) (io.WriteCloser, error) {
+	if size > 0 {
+		return t.fs.OpenFile(t.path(rel), os.O_WRONLY|os.O_APPEND, 0)
+	}
+	// the files of a volume cannot be truncated
+	if err := t.fs.Remove(t.path(rel)); err != nil && !errors.Is(err, iofs.ErrNotExist) {
+		return nil, err
+	}
+	return t.fs.Create(t.path(rel))
+}
+
+func (t *volTree) Done(rel string, src entry) {}
+
+// stats of a run
+type stats struct {
+	Files   int64 // copied
+	Resumed int64 // of Files, only the tail
+	Skipped int64 // already there
+	Bytes   int64
+	Failed  int64
+}
+
+func (s *stats) String() string {
+	return fmt.Sprintf("copied %v (resumed %v) skipped %v failed %v, %vMB",
+		atomic.LoadInt64(&s.Files), atomic.LoadInt64(&s.Resumed), atomic.LoadInt64(&s.Skipped),
+		atomic.LoadInt64(&s.Failed), atomic.LoadInt64(&s.Bytes)>>20)
+}
+
+type job struct {
+	rel string
+	src entry
+}
+
+type syncer struct {
+	src, dst tree
+	jobs     chan job
+	st       stats
+}
+
+// walk creates the dirs of rel at the destination and queues its files
+func (s *syncer) walk(rel string) error {
+	if err := s.dst.Mkdir(rel); err != nil {
+		return err
+	}
+	entries, err := s.src.ReadDir(rel)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		erel := path.Join(rel, e.name)
+		if e.dir {
+			if err := s.walk(erel); err != nil {
+				logger.Error("sync dir %v err:%v", erel, err)
+				atomic.AddInt64(&s.st.Failed, 1)
+			}
+			continue
+		}
+		s.jobs <- job{rel: erel, src: e}
+	}
+	return nil
+}
+
+func (s *syncer) worker(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for j := range s.jobs {
+		if err := s.copy(j.rel, j.src); err != nil {
+			logger.Error("sync %v err:%v", j.rel, err)
+			fmt.Fprintf(os.Stderr, "%v: %v\n", j.rel, err)
+			atomic.AddInt64(&s.st.Failed, 1)
+		}
+	}
+}
+
+// copy the file rel, from where an earlier run left it
+func (s *syncer) copy(rel string, src entry) error {
+	var have int64
+	if d, err := s.dst.Stat(rel); err == nil {
+		if d.dir {
+			return fmt.Errorf("a dir at the destination")
+		}
+		if d.size <= src.size {
+			have = d.size
+		}
+		if have > 0 && *checksum {
+			same, err := s.same(rel, have)
+			if err != nil {
+				return err
+			}
+			if !same {
+				have = 0
+			}
+		}
+		if have == src.size && d.size == src.size {
+			atomic.AddInt64(&s.st.Skipped, 1)
+			return nil
+		}
+	} else if !errors.Is(err, iofs.ErrNotExist) {
+		return err
+	}
+
+	r, err := s.src.Open(rel)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := s.dst.Append(rel, have)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 1<<20)
+	n, err := io.CopyBuffer(w, io.NewSectionReader(r, have, src.size-have), buf)
+	atomic.AddInt64(&s.st.Bytes, n)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if *verify {
+		same, err := s.same(rel, src.size)
+		if err != nil {
+			return err
+		}
+		if !same {
+			return fmt.Errorf("the copy differs from the source")
+		}
+	}
+	s.dst.Done(rel, src)
+	atomic.AddInt64(&s.st.Files, 1)
+	if have > 0 {
+		atomic.AddInt64(&s.st.Resumed, 1)
+	}
+	return nil
+}
+
+// same whether the first size bytes of rel are the same on both sides
+func (s *syncer) same(rel string, size int64) (bool, error) {
+	a, err := digest(s.src, rel, size)
+	if err != nil {
+		return false, err
+	}
+	b, err := digest(s.dst, rel, size)
+	if err != nil {
+		return false, err
+	}
+	return a == b, nil
+}
+
+func digest(t tree, rel string, size int64) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	r, err := t.Open(rel)
+	if err != nil {
+		return sum, err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.CopyBuffer(h, io.NewSectionReader(r, 0, size), make([]byte, 1<<20)); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+func usage() {
+	fmt.Println("cfs-sync [ini] [-threads n] [-checksum] [-verify] [src] [dst], one of them cfs:/path in the volume")
+	os.Exit(1)
+}
+
+func main() {
+
+	if len(os.Args) < 2 {
+		usage()
+	}
+	c, err := config.NewConfig(os.Args[1])
+	if err != nil {
+		fmt.Println("NewConfig err")
+		os.Exit(1)
+	}
+	utils.ConfigEnv(c)
+	flag.CommandLine.Parse(os.Args[2:])
+	if flag.NArg() != 2 || *threads < 1 {
+		usage()
+	}
+
+	logger.SetConsole(false)
+	logger.SetRollingFile(c.String("logger::log"), "sync.log", 10, 100, logger.MB) //each 100M rolling
+	switch level := c.String("logger::loglevel"); level {
+	case "error":
+		logger.SetLevel(logger.ERROR)
+	case "debug":
+		logger.SetLevel(logger.DEBUG)
+	case "info":
+		logger.SetLevel(logger.INFO)
+	default:
+		logger.SetLevel(logger.ERROR)
+	}
+
+	srcArg, dstArg := flag.Arg(0), flag.Arg(1)
+	if strings.HasPrefix(srcArg, volPrefix) == strings.HasPrefix(dstArg, volPrefix) {
+		fmt.Println("one of src and dst must be in the volume (cfs:/path), and one local; copytree of cfs-cli copies within a volume")
+		os.Exit(1)
+	}
+
+	uuid := c.String("volume::uuid")
+	vol, err := libcfs.Open(uuid, libcfs.Config{
+		VolMgr:    c.String("volume::volmgr"),
+		MetaNodes: c.Strings("volume::metanode"),
+		ReadOnly:  strings.HasPrefix(srcArg, volPrefix),
+	})
+	if err != nil {
+		fmt.Printf("open volume %v err:%v\n", uuid, err)
+		os.Exit(1)
+	}
+	side := func(arg string) tree {
+		if strings.HasPrefix(arg, volPrefix) {
+			return &volTree{fs: vol, root: strings.TrimPrefix(arg, volPrefix)}
+		}
+		return &localTree{root: arg}
+	}
+	s := &syncer{src: side(srcArg), dst: side(dstArg), jobs: make(chan job, *threads*4)}
+
+	root, err := s.src.Stat("")
+	if err == nil && !root.dir {
+		err = errors.New("not a dir")
+	}
+	if err != nil {
+		fmt.Printf("%v: %v\n", srcArg, err)
+		os.Exit(1)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < *threads; i++ {
+		wg.Add(1)
+		go s.worker(&wg)
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fmt.Println(&s.st)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err = s.walk("")
+	close(s.jobs)
+	wg.Wait()
+	close(done)
+	fmt.Println(&s.st)
+	if err != nil {
+		fmt.Printf("%v: %v\n", srcArg, err)
+		os.Exit(1)
+	}
+	if atomic.LoadInt64(&s.st.Failed) > 0 {
+		os.Exit(1)
+	}
+}
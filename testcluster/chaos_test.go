@@ -0,0 +1,70 @@
+package testcluster
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+// the faults of the chaos run, on the datanodes and the client alike
+const chaosFaults = "WriteChunk:drop:0.05,StreamReadChunk:corrupt:0.01,*:delay=200ms:0.02"
+
+// chaosData the content of file i, the same every run with seed
+func chaosData(seed int64, i int, size int) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(seed + int64(i))).Read(b)
+	return b
+}
+
+// TestChaos writes files with the rpcs failing on purpose and reads them back:
+// the retries, failovers and repairs must hide every fault
+func TestChaos(t *testing.T) {
+	if testing.Short() {
+		t.Skip("a chaos run takes minutes")
+	}
+	if err := Available(); err != nil {
+		t.Skip(err)
+	}
+	const seed, files, size = 42, 20, 3 << 20
+	c, err := Start(Options{Faults: chaosFaults, FaultSeed: seed})
+	defer c.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuid, err := c.CreateVol("chaos", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnt, err := c.Mount(uuid, "faults = "+chaosFaults, fmt.Sprintf("fault_seed = %v", seed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < files; i++ {
+		name := filepath.Join(mnt, fmt.Sprintf("chaos-%d", i))
+		if err := ioutil.WriteFile(name, chaosData(seed, i, size), 0644); err != nil {
+			t.Errorf("write %v: %v", name, err)
+		}
+	}
+	if err := c.Umount(mnt); err != nil {
+		t.Fatal(err)
+	}
+	// a mount of its own, the reads go to the datanodes and not the page cache
+	mnt, err = c.Mount(uuid, "faults = "+chaosFaults, fmt.Sprintf("fault_seed = %v", seed+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < files; i++ {
+		name := filepath.Join(mnt, fmt.Sprintf("chaos-%d", i))
+		got, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Errorf("read %v: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(got, chaosData(seed, i, size)) {
+			t.Errorf("read %v: %v bytes differ from those written", name, len(got))
+		}
+	}
+}
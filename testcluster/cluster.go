@@ -0,0 +1,390 @@
+// Package testcluster runs a ContainerFS cluster on the local host for the end to
+// end tests: the metanodes, a volmgr and the datanodes as subprocesses under a temp
+// dir, volumes created through the fs package and mounted with the fuseclient.
+//
+// The volmgr needs a MySQL server, given by CFS_TEST_MYSQL_HOST, CFS_TEST_MYSQL_USER
+// and CFS_TEST_MYSQL_PASSWD, each cluster gets a database of its own. The binaries
+// are built from the tree unless CFS_TEST_BIN names a dir holding them. The
+// metanodes take the fixed ports 99x1 to 99x3, so one cluster runs at a time.
+//
+//	func TestRename(t *testing.T) {
+//		if err := testcluster.Available(); err != nil {
+//			t.Skip(err)
+//		}
+//		c, err := testcluster.Start(testcluster.Options{})
+//		if err != nil {
+//			t.Fatal(err)
+//		}
+//		defer c.Stop()
+//		uuid, err := c.CreateVol("rename", 10)
+//		...
+//		mnt, err := c.Mount(uuid)
+//		...
+//		c.KillMetaNode(0) // the others elect a leader, the mount goes on
+//	}
+package testcluster
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	_ "github.com/go-sql-driver/mysql"
+	cfs "github.com/ipdcode/containerfs/fs"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// the binaries a cluster runs, by the dir of their main package
+var binaries = []string{"metanode", "volmgr", "datanode", "fuseclient"}
+
+// Options of a cluster, the zero value is three metanodes and three datanodes
+type Options struct {
+	MetaNodes int // 1 to 10, default 3
+	DataNodes int // default 3, a volume needs 3
+	BinDir    string
+	MySQLHost string
+	MySQLUser string
+	MySQLPass string
+	LogLevel  string // of all the daemons, default error
+	Keep      bool   // leave the temp dir for a look at the logs
+	Timeout   time.Duration
+	Faults    string // the rpcs the datanodes fail on purpose, see utils.SetFaults
+	FaultSeed int64
+}
+
+// Cluster a running cluster
+type Cluster struct {
+	Dir       string
+	VolMgr    *Process
+	MetaNodes []*Process
+	DataNodes []*Process
+	Mounts    []*Process
+
+	opts Options
+	db   string
+}
+
+// Available why no cluster can run here, nil when one can
+func Available() error {
+	if os.Getenv("CFS_TEST_MYSQL_HOST") == "" {
+		return errors.New("no CFS_TEST_MYSQL_HOST")
+	}
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		return fmt.Errorf("no fuse: %v", err)
+	}
+	if _, err := exec.LookPath("fusermount"); err != nil {
+		return fmt.Errorf("no fusermount: %v", err)
+	}
+	return nil
+}
+
+// Start a cluster, its volmgr knowing all the datanodes. Stop it when done, also
+// when Start fails.
+func Start(opts Options) (*Cluster, error) {
+	if opts.MetaNodes == 0 {
+		opts.MetaNodes = 3
+	}
+	if opts.MetaNodes > 10 {
+		return nil, errors.New("at most 10 metanodes")
+	}
+	if opts.DataNodes == 0 {
+		opts.DataNodes = 3
+	}
+	if opts.MySQLHost == "" {
+		opts.MySQLHost = os.Getenv("CFS_TEST_MYSQL_HOST")
+		opts.MySQLUser = os.Getenv("CFS_TEST_MYSQL_USER")
+		opts.MySQLPass = os.Getenv("CFS_TEST_MYSQL_PASSWD")
+	}
+	if opts.LogLevel == "" {
+		opts.LogLevel = "error"
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Minute
+	}
+	dir, err := ioutil.TempDir("", "cfs-testcluster-")
+	if err != nil {
+		return nil, err
+	}
+	c := &Cluster{Dir: dir, opts: opts}
+
+	if c.opts.BinDir == "" {
+		c.opts.BinDir = os.Getenv("CFS_TEST_BIN")
+	}
+	if c.opts.BinDir == "" {
+		c.opts.BinDir = filepath.Join(dir, "bin")
+		if err := build(c.opts.BinDir); err != nil {
+			return c, err
+		}
+	}
+	if err := c.createDB(); err != nil {
+		return c, err
+	}
+
+	port, err := freePort()
+	if err != nil {
+		return c, err
+	}
+	c.VolMgr = &Process{Name: "volmgr", Addr: "127.0.0.1:" + strconv.Itoa(port)}
+	ini := filepath.Join(dir, "volmgr.ini")
+	err = writeFile(ini, "host = 127.0.0.1\nport = %v\nlog = %v\nloglevel = %v\n\n[mysql]\nhost = %v\nuser = %v\npasswd = %v\ndb = %v\n",
+		port, filepath.Join(dir, "volmgr"), opts.LogLevel, opts.MySQLHost, opts.MySQLUser, opts.MySQLPass, c.db)
+	if err != nil {
+		return c, err
+	}
+	c.VolMgr.args = []string{c.bin("volmgr"), ini}
+	c.VolMgr.log = filepath.Join(dir, "volmgr.out")
+	if err := c.VolMgr.Start(opts.Timeout); err != nil {
+		return c, err
+	}
+
+	var peers, ips []string
+	for i := 0; i < opts.MetaNodes; i++ {
+		peers = append(peers, strconv.Itoa(i+1))
+		ips = append(ips, "127.0.0.1")
+	}
+	for i := 0; i < opts.MetaNodes; i++ {
+		d := filepath.Join(dir, fmt.Sprintf("metanode%d", i))
+		ini := d + ".ini"
+		err := writeFile(ini, "[metanode]\nhost = 127.0.0.1\nnodeid = %v\npeers = %v\nips = %v\nwaldir = %v\nlog = %v\nloglevel = %v\ndebug_addr = none\n\n[volmgr]\nhost = %v\n",
+			i+1, strings.Join(peers, ","), strings.Join(ips, ","), filepath.Join(d, "data"), filepath.Join(d, "logs"), opts.LogLevel, c.VolMgr.Addr)
+		if err != nil {
+			return c, err
+		}
+		c.MetaNodes = append(c.MetaNodes, &Process{
+			Name: fmt.Sprintf("metanode%d", i),
+			Addr: fmt.Sprintf("127.0.0.1:99%d3", i),
+			args: []string{c.bin("metanode"), ini},
+			log:  d + ".out",
+		})
+	}
+	// the metanodes wait for their peers to elect a leader, start them all first
+	for _, p := range c.MetaNodes {
+		if err := p.start(); err != nil {
+			return c, err
+		}
+	}
+	for _, p := range c.MetaNodes {
+		if err := p.wait(opts.Timeout); err != nil {
+			return c, err
+		}
+	}
+
+	for i := 0; i < opts.DataNodes; i++ {
+		port, err := freePort()
+		if err != nil {
+			return c, err
+		}
+		d := filepath.Join(dir, fmt.Sprintf("datanode%d", i))
+		os.MkdirAll(filepath.Join(d, "data"), 0755)
+		p := &Process{
+			Name: fmt.Sprintf("datanode%d", i),
+			Addr: "127.0.0.1:" + strconv.Itoa(port),
+			args: []string{c.bin("datanode"), "-host", "127.0.0.1", "-port", strconv.Itoa(port), "-datapath", filepath.Join(d, "data") + "/",
+				"-volmgr", c.VolMgr.Addr, "-logpath", filepath.Join(d, "logs") + "/", "-loglevel", opts.LogLevel, "-media", "hdd",
+				"-faults", opts.Faults, "-faultseed", strconv.FormatInt(opts.FaultSeed, 10)},
+			log: d + ".out",
+		}
+		c.DataNodes = append(c.DataNodes, p)
+		if err := p.Start(opts.Timeout); err != nil {
+			return c, err
+		}
+	}
+
+	cfs.VolMgrAddr = c.VolMgr.Addr
+	cfs.MetaNodePeers = nil
+	for _, p := range c.MetaNodes {
+		cfs.MetaNodePeers = append(cfs.MetaNodePeers, p.Addr)
+	}
+	cfs.MetaNodeAddr = cfs.MetaNodePeers[0]
+	deadline := time.Now().Add(opts.Timeout)
+	for {
+		ret, nodes := cfs.GetDataNodes()
+		if ret == 0 && len(nodes) >= opts.DataNodes {
+			break
+		}
+		if time.Now().After(deadline) {
+			return c, fmt.Errorf("%v of %v datanodes registered with the volmgr", len(nodes), opts.DataNodes)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return c, nil
+}
+
+// Stop the mounts and the daemons, drop the database and remove the temp dir
+// unless Keep, nothing on a nil cluster
+func (c *Cluster) Stop() {
+	if c == nil {
+		return
+	}
+	for _, p := range c.Mounts {
+		p.Stop()
+		exec.Command("fusermount", "-u", "-z", p.Addr).Run()
+	}
+	for _, p := range c.DataNodes {
+		p.Stop()
+	}
+	for _, p := range c.MetaNodes {
+		p.Stop()
+	}
+	if c.VolMgr != nil {
+		c.VolMgr.Stop()
+	}
+	if c.db != "" {
+		if db, err := c.openDB(""); err == nil {
+			db.Exec("DROP DATABASE IF EXISTS " + c.db)
+			db.Close()
+		}
+	}
+	if !c.opts.Keep {
+		os.RemoveAll(c.Dir)
+	}
+}
+
+// CreateVol a volume of gb GB and its namespace, its uuid
+func (c *Cluster) CreateVol(name string, gb int) (string, error) {
+	ret, uuid := cfs.NewVol(name, strconv.Itoa(gb), "")
+	if ret != 0 {
+		return "", fmt.Errorf("create volume %v ret:%v", name, ret)
+	}
+	return uuid, nil
+}
+
+// Mount volume uuid with the fuseclient, the keys of extra added to its config,
+// the mountpoint
+func (c *Cluster) Mount(uuid string, extra ...string) (string, error) {
+	i := len(c.Mounts)
+	mnt := filepath.Join(c.Dir, fmt.Sprintf("mnt%d", i))
+	if err := os.MkdirAll(mnt, 0755); err != nil {
+		return "", err
+	}
+	var metas []string
+	for _, p := range c.MetaNodes {
+		metas = append(metas, p.Addr)
+	}
+	ini := filepath.Join(c.Dir, fmt.Sprintf("fuseclient%d.ini", i))
+	err := writeFile(ini, "volmgr = %v\nmetanode = %v\nuuid = %v\nmountpoint = %v\nlog = %v\nloglevel = %v\n%v\n",
+		c.VolMgr.Addr, strings.Join(metas, ","), uuid, mnt, filepath.Join(c.Dir, fmt.Sprintf("fuseclient%d", i)), c.opts.LogLevel, strings.Join(extra, "\n"))
+	if err != nil {
+		return "", err
+	}
+	p := &Process{Name: fmt.Sprintf("fuseclient%d", i), Addr: mnt, args: []string{c.bin("fuseclient"), ini}, log: filepath.Join(c.Dir, fmt.Sprintf("fuseclient%d.out", i))}
+	c.Mounts = append(c.Mounts, p)
+	if err := p.start(); err != nil {
+		return "", err
+	}
+	deadline := time.Now().Add(c.opts.Timeout)
+	for !mounted(mnt) {
+		if p.exited() || time.Now().After(deadline) {
+			return "", fmt.Errorf("volume %v not mounted on %v, see %v", uuid, mnt, p.log)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return mnt, nil
+}
+
+// Umount the mount at mnt, the fuseclient flushes and exits
+func (c *Cluster) Umount(mnt string) error {
+	for _, p := range c.Mounts {
+		if p.Addr == mnt {
+			return p.Stop()
+		}
+	}
+	return fmt.Errorf("%v is not a mount of the cluster", mnt)
+}
+
+// KillMetaNode kills metanode i, as a crash
+func (c *Cluster) KillMetaNode(i int) error {
+	return c.MetaNodes[i].Kill()
+}
+
+// StartMetaNode starts metanode i again, with its wal
+func (c *Cluster) StartMetaNode(i int) error {
+	return c.MetaNodes[i].Start(c.opts.Timeout)
+}
+
+// KillDataNode kills datanode i, as a crash
+func (c *Cluster) KillDataNode(i int) error {
+	return c.DataNodes[i].Kill()
+}
+
+// StartDataNode starts datanode i again, with its chunks
+func (c *Cluster) StartDataNode(i int) error {
+	return c.DataNodes[i].Start(c.opts.Timeout)
+}
+
+func (c *Cluster) bin(name string) string {
+	return filepath.Join(c.opts.BinDir, "cfs-"+name)
+}
+
+func (c *Cluster) openDB(db string) (*sql.DB, error) {
+	return sql.Open("mysql", c.opts.MySQLUser+":"+c.opts.MySQLPass+"@tcp("+c.opts.MySQLHost+")/"+db+"?charset=utf8&multiStatements=true")
+}
+
+// createDB the database of the volmgr, with the tables of cfs-volmgr.sql
+func (c *Cluster) createDB() error {
+	_, file, _, _ := runtime.Caller(0)
+	schema, err := ioutil.ReadFile(filepath.Join(filepath.Dir(file), "..", "volmgr", "cfs-volmgr.sql"))
+	if err != nil {
+		return err
+	}
+	db, err := c.openDB("")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	name := fmt.Sprintf("cfstest_%d_%d", os.Getpid(), time.Now().Unix())
+	if _, err := db.Exec("CREATE DATABASE " + name); err != nil {
+		return fmt.Errorf("create database %v: %v", name, err)
+	}
+	c.db = name
+	tdb, err := c.openDB(name)
+	if err != nil {
+		return err
+	}
+	defer tdb.Close()
+	if _, err := tdb.Exec(string(schema)); err != nil {
+		return fmt.Errorf("load cfs-volmgr.sql: %v", err)
+	}
+	return nil
+}
+
+// build the binaries into dir
+func build(dir string) error {
+	for _, b := range binaries {
+		out, err := exec.Command("go", "build", "-o", filepath.Join(dir, "cfs-"+b), "github.com/ipdcode/containerfs/"+b).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("build %v: %v\n%s", b, err, out)
+		}
+	}
+	return nil
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// mounted whether a filesystem is mounted on dir
+func mounted(dir string) bool {
+	var st, pst syscall.Stat_t
+	if syscall.Stat(dir, &st) != nil || syscall.Stat(filepath.Dir(dir), &pst) != nil {
+		return false
+	}
+	return st.Dev != pst.Dev
+}
+
+func writeFile(path string, format string, args ...interface{}) error {
+	return ioutil.WriteFile(path, []byte(fmt.Sprintf(format, args...)), 0644)
+}
@@ -0,0 +1,170 @@
+package testcluster
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mountVol a cluster with volume name mounted, its uuid and mountpoint. Skips the
+// test where no cluster can run. Stop the cluster when done.
+func mountVol(t *testing.T, name string) (*Cluster, string, string) {
+	if err := Available(); err != nil {
+		t.Skip(err)
+	}
+	c, err := Start(Options{})
+	if err != nil {
+		c.Stop()
+		t.Fatal(err)
+	}
+	uuid, err := c.CreateVol(name, 10)
+	if err != nil {
+		c.Stop()
+		t.Fatal(err)
+	}
+	mnt, err := c.Mount(uuid)
+	if err != nil {
+		c.Stop()
+		t.Fatal(err)
+	}
+	return c, uuid, mnt
+}
+
+// checkFile fails t unless name holds want
+func checkFile(t *testing.T, name string, want []byte) {
+	got, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Errorf("read %v: %v", name, err)
+		return
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("read %v: %v bytes, want the %v written", name, len(got), len(want))
+	}
+}
+
+// TestWriteRead files of a few sizes around the chunk and buffer boundaries, read
+// back through the mount and through a mount of its own
+func TestWriteRead(t *testing.T) {
+	c, uuid, mnt := mountVol(t, "writeread")
+	defer c.Stop()
+
+	sizes := []int{0, 1, 4095, 512 << 10, 3<<20 + 17, 65 << 20}
+	dir := filepath.Join(mnt, "a", "b")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i, size := range sizes {
+		name := filepath.Join(dir, fmt.Sprintf("f%d", i))
+		if err := ioutil.WriteFile(name, chaosData(1, i, size), 0644); err != nil {
+			t.Fatalf("write %v: %v", name, err)
+		}
+		checkFile(t, name, chaosData(1, i, size))
+	}
+	if err := c.Umount(mnt); err != nil {
+		t.Fatal(err)
+	}
+	// a mount of its own, the reads go to the datanodes and not the page cache
+	mnt, err := c.Mount(uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(mnt, "a", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(sizes) {
+		t.Errorf("%v entries, want %v", len(entries), len(sizes))
+	}
+	for i, size := range sizes {
+		checkFile(t, filepath.Join(mnt, "a", "b", fmt.Sprintf("f%d", i)), chaosData(1, i, size))
+	}
+}
+
+// TestRename files and dirs renamed within and across dirs, over an existing file
+func TestRename(t *testing.T) {
+	c, _, mnt := mountVol(t, "rename")
+	defer c.Stop()
+
+	for _, d := range []string{"src", "dst"} {
+		if err := os.Mkdir(filepath.Join(mnt, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b := chaosData(2, 0, 1<<20), chaosData(2, 1, 1<<20)
+	if err := ioutil.WriteFile(filepath.Join(mnt, "src", "a"), a, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(mnt, "dst", "b"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Rename(filepath.Join(mnt, "src", "a"), filepath.Join(mnt, "src", "a2")); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(mnt, "src", "a2"), a)
+	if err := os.Rename(filepath.Join(mnt, "src", "a2"), filepath.Join(mnt, "dst", "b")); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(mnt, "dst", "b"), a)
+	if _, err := os.Stat(filepath.Join(mnt, "src", "a2")); !os.IsNotExist(err) {
+		t.Errorf("src/a2 still there after its rename: %v", err)
+	}
+
+	if err := os.Rename(filepath.Join(mnt, "dst"), filepath.Join(mnt, "src", "dst")); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(mnt, "src", "dst", "b"), a)
+}
+
+// TestMetaNodeFailover the metanodes killed in turn in the middle of the writes,
+// the leader among them: the mount goes on with the new leader and loses none of
+// the files
+func TestMetaNodeFailover(t *testing.T) {
+	c, _, mnt := mountVol(t, "metafailover")
+	defer c.Stop()
+
+	const files = 10
+	for i := 0; i < files; i++ {
+		if i == files/2 {
+			for m := range c.MetaNodes {
+				if err := c.KillMetaNode(m); err != nil {
+					t.Fatal(err)
+				}
+				// one down at a time, the others keep the quorum
+				time.Sleep(5 * time.Second)
+				if err := c.StartMetaNode(m); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		name := filepath.Join(mnt, fmt.Sprintf("f%d", i))
+		if err := ioutil.WriteFile(name, chaosData(3, i, 1<<20), 0644); err != nil {
+			t.Errorf("write %v: %v", name, err)
+		}
+	}
+	for i := 0; i < files; i++ {
+		checkFile(t, filepath.Join(mnt, fmt.Sprintf("f%d", i)), chaosData(3, i, 1<<20))
+	}
+}
+
+// TestDataNodeFailover a datanode killed, the files written before are read from
+// the other replicas
+func TestDataNodeFailover(t *testing.T) {
+	c, _, mnt := mountVol(t, "datafailover")
+	defer c.Stop()
+
+	name := filepath.Join(mnt, "f")
+	data := chaosData(4, 0, 8<<20)
+	if err := ioutil.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.KillDataNode(0); err != nil {
+		t.Fatal(err)
+	}
+	defer c.StartDataNode(0)
+	checkFile(t, name, data)
+}
@@ -0,0 +1,110 @@
+package testcluster
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// Process a daemon of the cluster, Addr is where it serves, the mountpoint of a
+// fuseclient
+type Process struct {
+	Name string
+	Addr string
+
+	args []string
+	log  string // its stdout and stderr
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+// Start the process and wait for its port
+func (p *Process) Start(timeout time.Duration) error {
+	if err := p.start(); err != nil {
+		return err
+	}
+	return p.wait(timeout)
+}
+
+func (p *Process) start() error {
+	if p.cmd != nil && !p.exited() {
+		return fmt.Errorf("%v is running", p.Name)
+	}
+	out, err := os.OpenFile(p.log, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(p.args[0], p.args[1:]...)
+	cmd.Stdout, cmd.Stderr = out, out
+	if err := cmd.Start(); err != nil {
+		out.Close()
+		return fmt.Errorf("start %v: %v", p.Name, err)
+	}
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		out.Close()
+		close(done)
+	}()
+	p.cmd, p.done = cmd, done
+	return nil
+}
+
+// wait for the port of the process to take connections
+func (p *Process) wait(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if p.exited() {
+			return fmt.Errorf("%v exited, see %v", p.Name, p.log)
+		}
+		if conn, err := net.DialTimeout("tcp", p.Addr, time.Second); err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%v not serving %v after %v, see %v", p.Name, p.Addr, timeout, p.log)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (p *Process) exited() bool {
+	if p.done == nil {
+		return true
+	}
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop the process with SIGTERM, SIGKILL when it is still running after 10s
+func (p *Process) Stop() error {
+	if p.exited() {
+		return nil
+	}
+	p.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-p.done:
+		return nil
+	case <-time.After(10 * time.Second):
+	}
+	return p.Kill()
+}
+
+// Kill the process with SIGKILL
+func (p *Process) Kill() error {
+	if p.exited() {
+		return nil
+	}
+	if err := p.cmd.Process.Kill(); err != nil {
+		return err
+	}
+	<-p.done
+	return nil
+}
@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// AuditRecord one data-plane request picked by the Auditor
+type AuditRecord struct {
+	Op           string
+	VolID        string
+	BlockGroupID uint32
+	BlockID      uint32
+	ChunkID      uint64
+	Offset       int64
+	Size         int64
+	Client       string
+	Latency      time.Duration
+	Ret          int32
+}
+
+// Auditor logs a random sample of requests, Rate is the fraction kept (0 off, 1 all)
+type Auditor struct {
+	sync.Mutex
+	rate float64
+	rnd  *rand.Rand
+	w    io.Writer
+}
+
+// NewAuditor ...
+func NewAuditor(w io.Writer, rate float64) *Auditor {
+	a := &Auditor{
+		rnd: rand.New(rand.NewSource(time.Now().UnixNano())),
+		w:   w,
+	}
+	a.SetRate(rate)
+	return a
+}
+
+// SetRate ...
+func (a *Auditor) SetRate(rate float64) {
+	if rate < 0 {
+		rate = 0
+	}
+	if rate > 1 {
+		rate = 1
+	}
+	a.Lock()
+	a.rate = rate
+	a.Unlock()
+}
+
+// Sample decides at the start of a request whether it is audited,
+// so unsampled requests pay nothing for collecting the record
+func (a *Auditor) Sample() bool {
+	if a == nil {
+		return false
+	}
+	a.Lock()
+	defer a.Unlock()
+	if a.rate <= 0 || a.w == nil {
+		return false
+	}
+	return a.rate >= 1 || a.rnd.Float64() < a.rate
+}
+
+// Log writes one record per line
+func (a *Auditor) Log(r *AuditRecord) {
+	line := fmt.Sprintf("%s op=%s vol=%s bg=%d block=%d chunk=%d offset=%d size=%d client=%s latency_us=%d ret=%d\n",
+		time.Now().Format("2006-01-02 15:04:05.000"), r.Op, r.VolID, r.BlockGroupID, r.BlockID, r.ChunkID,
+		r.Offset, r.Size, r.Client, int64(r.Latency/time.Microsecond), r.Ret)
+	a.Lock()
+	io.WriteString(a.w, line)
+	a.Unlock()
+}
@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"github.com/golang/snappy"
+	"google.golang.org/grpc/encoding"
+	_ "google.golang.org/grpc/encoding/gzip" // registers "gzip"
+	"io"
+)
+
+// grpc compressors a client may ask for per connection, the server answers
+// with the compressor of the request so importing utils is all a server needs
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Name() string { return "snappy" }
+
+func (snappyCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return snappy.NewBufferedWriter(w), nil
+}
+
+func (snappyCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	return snappy.NewReader(r), nil
+}
+
+func init() {
+	encoding.RegisterCompressor(snappyCompressor{})
+}
+
+// ValidCompressor reports whether name is "" (no compression) or a registered grpc compressor
+func ValidCompressor(name string) bool {
+	return name == "" || encoding.GetCompressor(name) != nil
+}
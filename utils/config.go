@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"flag"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix of the environment variables overriding the config keys
+const EnvPrefix = "CFS_"
+
+// envName the variable overriding the flag name: CFS_ and the name in upper case,
+// a - as _
+func envName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// ConfigEnv sets the keys given in the environment on the config c, over the
+// values of the file: CFS_VOLMGR for volmgr, CFS_METANODE__HOST for
+// metanode::host, the values written as in the file. Returns the keys set.
+func ConfigEnv(c interface {
+	Set(key, val string) error
+}) []string {
+	var keys []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, EnvPrefix) {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			continue
+		}
+		key := strings.ToLower(kv[len(EnvPrefix):i])
+		if j := strings.Index(key, "__"); j > 0 {
+			key = key[:j] + "::" + key[j+2:]
+		}
+		if c.Set(key, kv[i+1:]) == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// FlagEnv sets the flags of fs not given on the command line from the
+// environment, CFS_AUDITRATE for -auditrate. Call it after fs.Parse.
+func FlagEnv(fs *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || err != nil {
+			return
+		}
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			err = fs.Set(f.Name, v)
+		}
+	})
+	return err
+}
+
+// MapConfig the config of a daemon started without a config file, set from the
+// environment and the flags. Lists are comma separated.
+type MapConfig map[string]string
+
+// Set ...
+func (m MapConfig) Set(key, val string) error {
+	m[key] = val
+	return nil
+}
+
+// String ...
+func (m MapConfig) String(key string) string {
+	return m[key]
+}
+
+// Strings ...
+func (m MapConfig) Strings(key string) []string {
+	if m[key] == "" {
+		return nil
+	}
+	return strings.Split(m[key], ",")
+}
+
+// Int ...
+func (m MapConfig) Int(key string) (int, error) {
+	return strconv.Atoi(m[key])
+}
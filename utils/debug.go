@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	// the profiles under /debug/pprof/
+	_ "net/http/pprof"
+	"runtime"
+	"sync/atomic"
+)
+
+var openConns int64
+
+type countedListener struct {
+	net.Listener
+}
+
+type countedConn struct {
+	net.Conn
+	closed int32
+}
+
+func (l countedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&openConns, 1)
+	return &countedConn{Conn: c}, nil
+}
+
+func (c *countedConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(&openConns, -1)
+	}
+	return c.Conn.Close()
+}
+
+// CountConns counts the connections accepted by l while they are open, they are
+// in the open_conns of the debug stats
+func CountConns(l net.Listener) net.Listener {
+	return countedListener{l}
+}
+
+// DebugStats the runtime stats of the process, and the ones of extra
+func DebugStats(extra func() map[string]int64) map[string]int64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	stats := map[string]int64{
+		"goroutines":     int64(runtime.NumGoroutine()),
+		"heap_alloc":     int64(m.HeapAlloc),
+		"heap_inuse":     int64(m.HeapInuse),
+		"heap_objects":   int64(m.HeapObjects),
+		"sys":            int64(m.Sys),
+		"num_gc":         int64(m.NumGC),
+		"gc_pause_total": int64(m.PauseTotalNs),
+		"open_conns":     atomic.LoadInt64(&openConns),
+	}
+	if n := FaultsInjected(); n > 0 {
+		stats["faults_injected"] = n
+	}
+	if extra != nil {
+		for k, v := range extra() {
+			stats[k] = v
+		}
+	}
+	return stats
+}
+
+// ServeDebug serves net/http/pprof under /debug/pprof/ and DebugStats as json
+// under /debug/stats on addr, in the background. Bind it to a trusted address:
+// the profiles show the memory of the process.
+func ServeDebug(addr string, extra func() map[string]int64) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	http.HandleFunc("/debug/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(DebugStats(extra))
+	})
+	go http.Serve(l, nil)
+	return nil
+}
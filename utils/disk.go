@@ -2,7 +2,6 @@ package utils
 
 import (
 	"fmt"
-	"syscall"
 )
 
 // DiskStatus disk status
@@ -12,19 +11,6 @@ type DiskStatus struct {
 	Free uint64 `json:"free"`
 }
 
-// DiskUsage ...
-func DiskUsage(path string) (disk DiskStatus) {
-	fs := syscall.Statfs_t{}
-	err := syscall.Statfs(path, &fs)
-	if err != nil {
-		return
-	}
-	disk.All = fs.Blocks * uint64(fs.Bsize)
-	disk.Free = fs.Bfree * uint64(fs.Bsize)
-	disk.Used = disk.All - disk.Free
-	return
-}
-
 // const var
 const (
 	B  = 1
@@ -0,0 +1,276 @@
+package utils
+
+import (
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Fault injection, for testing the retries, failovers and repairs: the rpcs
+// matching a rule are dropped, delayed or have their data corrupted with its
+// probability. Off unless SetFaults was given rules, the daemons take them from
+// their faults key or flag. A rule is method:action:probability, the method the
+// name of the rpc or * for all of them, the action drop, delay=<duration> or
+// corrupt, which flips a byte of the Databuf of a copy of the request or the
+// reply, the caller's buffer is left alone for its retry. With the same seed the
+// n-th call of a method meets the same faults, however the calls of the other
+// methods interleave with it.
+
+// FaultRule one rule of the fault injection
+type FaultRule struct {
+	Method string
+	Action string // drop, delay or corrupt
+	Delay  time.Duration
+	Prob   float64
+}
+
+type faultSet struct {
+	mu    sync.Mutex
+	rules []FaultRule
+	seed  uint64
+	calls map[string]uint64 // the calls of each method so far
+}
+
+var faults atomic.Value // *faultSet, nil when off
+
+var faultsInjected int64
+
+// ParseFaults the rules of a faults value, comma separated
+func ParseFaults(spec string) ([]FaultRule, error) {
+	var rules []FaultRule
+	for _, e := range strings.Split(spec, ",") {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		f := strings.Split(e, ":")
+		if len(f) != 3 || f[0] == "" {
+			return nil, fmt.Errorf("wrong fault %v, use method:action:probability", e)
+		}
+		r := FaultRule{Method: f[0], Action: f[1]}
+		if strings.HasPrefix(f[1], "delay=") {
+			d, err := time.ParseDuration(f[1][len("delay="):])
+			if err != nil {
+				return nil, fmt.Errorf("wrong fault %v: %v", e, err)
+			}
+			r.Action, r.Delay = "delay", d
+		}
+		if r.Action != "drop" && r.Action != "delay" && r.Action != "corrupt" {
+			return nil, fmt.Errorf("wrong fault %v, the action is drop, delay=<duration> or corrupt", e)
+		}
+		p, err := strconv.ParseFloat(f[2], 64)
+		if err != nil || p < 0 || p > 1 {
+			return nil, fmt.Errorf("wrong fault %v, the probability is from 0 to 1", e)
+		}
+		r.Prob = p
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// SetFaults turns the fault injection on with the rules of spec, off when empty.
+// seed 0 takes the time.
+func SetFaults(spec string, seed int64) error {
+	rules, err := ParseFaults(spec)
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		faults.Store((*faultSet)(nil))
+		return nil
+	}
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	faults.Store(&faultSet{rules: rules, seed: uint64(seed), calls: make(map[string]uint64)})
+	return nil
+}
+
+// FaultsInjected the faults injected so far
+func FaultsInjected() int64 {
+	return atomic.LoadInt64(&faultsInjected)
+}
+
+// pick the action to take on a call of the rpc fullMethod, nil for none
+func pickFault(fullMethod string) *FaultRule {
+	fs, _ := faults.Load().(*faultSet)
+	if fs == nil {
+		return nil
+	}
+	method := fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+	fs.mu.Lock()
+	n := fs.calls[method]
+	fs.calls[method] = n + 1
+	fs.mu.Unlock()
+	h := fnv.New64a()
+	h.Write([]byte(method))
+	x := fs.seed ^ h.Sum64() ^ n*0x9e3779b97f4a7c15
+	for i := range fs.rules {
+		r := &fs.rules[i]
+		if r.Method != "*" && r.Method != method {
+			continue
+		}
+		x = splitMix64(x)
+		if float64(x>>11)/(1<<53) < r.Prob {
+			atomic.AddInt64(&faultsInjected, 1)
+			return r
+		}
+	}
+	return nil
+}
+
+// splitMix64 the next of a sequence of pseudo random numbers, each one a function
+// of the previous only
+func splitMix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// corrupted a copy of msg with a byte of its data flipped, msg itself when it
+// has no data
+func corrupted(msg interface{}) interface{} {
+	pm, ok := msg.(proto.Message)
+	if !ok {
+		return msg
+	}
+	if m, ok := pm.(interface {
+		GetDatabuf() []byte
+	}); !ok || len(m.GetDatabuf()) == 0 {
+		return msg
+	}
+	c := proto.Clone(pm)
+	b := c.(interface {
+		GetDatabuf() []byte
+	}).GetDatabuf()
+	b[len(b)/2] ^= 0xff
+	return c
+}
+
+// corruptInPlace flips a byte of the data of msg, of a message just received
+// that no one else holds
+func corruptInPlace(msg interface{}) {
+	if m, ok := msg.(interface {
+		GetDatabuf() []byte
+	}); ok {
+		if b := m.GetDatabuf(); len(b) > 0 {
+			b[len(b)/2] ^= 0xff
+		}
+	}
+}
+
+func errInjected(method string) error {
+	return status.Errorf(codes.Unavailable, "fault injected in %v", method)
+}
+
+// FaultDialOptions the interceptors of the fault injection for a client conn,
+// none when it is off
+func FaultDialOptions() []grpc.DialOption {
+	if fs, _ := faults.Load().(*faultSet); fs == nil {
+		return nil
+	}
+	return []grpc.DialOption{
+		grpc.WithUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			if r := pickFault(method); r != nil {
+				switch r.Action {
+				case "drop":
+					return errInjected(method)
+				case "delay":
+					time.Sleep(r.Delay)
+				case "corrupt":
+					req = corrupted(req)
+				}
+			}
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}),
+		grpc.WithStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			r := pickFault(method)
+			if r != nil && r.Action == "drop" {
+				return nil, errInjected(method)
+			}
+			if r != nil && r.Action == "delay" {
+				time.Sleep(r.Delay)
+			}
+			s, err := streamer(ctx, desc, cc, method, opts...)
+			if err != nil || r == nil || r.Action != "corrupt" {
+				return s, err
+			}
+			return &corruptClientStream{ClientStream: s}, nil
+		}),
+	}
+}
+
+// corruptClientStream corrupts the first message received with data
+type corruptClientStream struct {
+	grpc.ClientStream
+	done bool
+}
+
+func (s *corruptClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == nil && !s.done {
+		corruptInPlace(m)
+		s.done = true
+	}
+	return err
+}
+
+// FaultServerOptions the interceptors of the fault injection for a server,
+// none when it is off
+func FaultServerOptions() []grpc.ServerOption {
+	if fs, _ := faults.Load().(*faultSet); fs == nil {
+		return nil
+	}
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			r := pickFault(info.FullMethod)
+			if r != nil && r.Action == "drop" {
+				return nil, errInjected(info.FullMethod)
+			}
+			if r != nil && r.Action == "delay" {
+				time.Sleep(r.Delay)
+			}
+			reply, err := handler(ctx, req)
+			if err == nil && r != nil && r.Action == "corrupt" {
+				reply = corrupted(reply)
+			}
+			return reply, err
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			r := pickFault(info.FullMethod)
+			if r != nil && r.Action == "drop" {
+				return errInjected(info.FullMethod)
+			}
+			if r != nil && r.Action == "delay" {
+				time.Sleep(r.Delay)
+			}
+			if r != nil && r.Action == "corrupt" {
+				ss = &corruptServerStream{ServerStream: ss}
+			}
+			return handler(srv, ss)
+		}),
+	}
+}
+
+// corruptServerStream corrupts the first message sent with data
+type corruptServerStream struct {
+	grpc.ServerStream
+	done bool
+}
+
+func (s *corruptServerStream) SendMsg(m interface{}) error {
+	if !s.done {
+		m = corrupted(m)
+		s.done = true
+	}
+	return s.ServerStream.SendMsg(m)
+}
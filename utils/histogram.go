@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// LatencyBuckets upper bounds of each latency bucket in microseconds,
+// one more bucket after the last bound collects everything slower
+var LatencyBuckets = []int64{
+	100, 250, 500,
+	1000, 2500, 5000,
+	10000, 25000, 50000,
+	100000, 250000, 500000,
+	1000000, 2500000, 5000000,
+}
+
+// Histogram latency histogram using LatencyBuckets
+type Histogram struct {
+	sync.Mutex
+	Counts []uint64
+}
+
+// NewHistogram ...
+func NewHistogram() *Histogram {
+	return &Histogram{Counts: make([]uint64, len(LatencyBuckets)+1)}
+}
+
+// Observe ...
+func (h *Histogram) Observe(d time.Duration) {
+	us := int64(d / time.Microsecond)
+	i := 0
+	for i < len(LatencyBuckets) && us > LatencyBuckets[i] {
+		i++
+	}
+	h.Lock()
+	h.Counts[i]++
+	h.Unlock()
+}
+
+// ObserveSince is meant to be deferred : defer h.ObserveSince(time.Now())
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start))
+}
+
+// Drain returns the counts recorded so far and resets the histogram
+func (h *Histogram) Drain() []uint64 {
+	h.Lock()
+	counts := h.Counts
+	h.Counts = make([]uint64, len(LatencyBuckets)+1)
+	h.Unlock()
+	return counts
+}
+
+// Merge adds counts reported by another histogram
+func (h *Histogram) Merge(counts []uint64) {
+	h.Lock()
+	for i := 0; i < len(counts) && i < len(h.Counts); i++ {
+		h.Counts[i] += counts[i]
+	}
+	h.Unlock()
+}
+
+// Total ...
+func (h *Histogram) Total() uint64 {
+	h.Lock()
+	defer h.Unlock()
+	var total uint64
+	for _, v := range h.Counts {
+		total += v
+	}
+	return total
+}
+
+// Quantile returns the upper bound (microseconds) of the bucket holding quantile q,
+// the overflow bucket reports twice the last bound
+func (h *Histogram) Quantile(q float64) int64 {
+	h.Lock()
+	defer h.Unlock()
+	var total uint64
+	for _, v := range h.Counts {
+		total += v
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(total) + 0.5)
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for i, v := range h.Counts {
+		seen += v
+		if seen >= rank {
+			if i < len(LatencyBuckets) {
+				return LatencyBuckets[i]
+			}
+			break
+		}
+	}
+	return 2 * LatencyBuckets[len(LatencyBuckets)-1]
+}
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// OverflowID the id a mount sees for an owner its IDMap does not map, like the
+// kernel for user namespaces
+const OverflowID = 65534
+
+// IDMap translates the uids or the gids of the processes of a mount to the ones
+// stored in the volume, in ranges like /proc/self/uid_map: inside:outside:count.
+// The empty map is the identity.
+type IDMap struct {
+	Inside  []uint32
+	Outside []uint32
+	Count   []uint32
+}
+
+// ParseIDMap "inside:outside:count,..."
+func ParseIDMap(s string) (IDMap, error) {
+	m := IDMap{}
+	if s == "" {
+		return m, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ":")
+		if len(fields) != 3 {
+			return IDMap{}, fmt.Errorf("bad id range %q, use inside:outside:count", part)
+		}
+		var n [3]uint32
+		for i, f := range fields {
+			v, err := strconv.ParseUint(f, 10, 32)
+			if err != nil {
+				return IDMap{}, fmt.Errorf("bad id range %q: %v", part, err)
+			}
+			n[i] = uint32(v)
+		}
+		if n[2] == 0 {
+			return IDMap{}, fmt.Errorf("empty id range %q", part)
+		}
+		if uint64(n[0])+uint64(n[2]) > 1<<32 || uint64(n[1])+uint64(n[2]) > 1<<32 {
+			return IDMap{}, fmt.Errorf("id range %q goes past the 32 bit ids", part)
+		}
+		for i := range m.Count {
+			if overlap(m.Inside[i], m.Count[i], n[0], n[2]) || overlap(m.Outside[i], m.Count[i], n[1], n[2]) {
+				return IDMap{}, fmt.Errorf("id range %q overlaps another one", part)
+			}
+		}
+		m.Inside = append(m.Inside, n[0])
+		m.Outside = append(m.Outside, n[1])
+		m.Count = append(m.Count, n[2])
+	}
+	return m, nil
+}
+
+// overlap whether the ranges of ids a and b have an id in common
+func overlap(a, aCount, b, bCount uint32) bool {
+	return uint64(a) < uint64(b)+uint64(bCount) && uint64(b) < uint64(a)+uint64(aCount)
+}
+
+// ToVolume the id stored for the id of the mount, false when it is not mapped
+func (m IDMap) ToVolume(id uint32) (uint32, bool) {
+	if len(m.Count) == 0 {
+		return id, true
+	}
+	for i := range m.Count {
+		if id >= m.Inside[i] && uint64(id) < uint64(m.Inside[i])+uint64(m.Count[i]) {
+			return m.Outside[i] + (id - m.Inside[i]), true
+		}
+	}
+	return 0, false
+}
+
+// FromVolume the id the mount sees for a stored id, OverflowID when it is not mapped
+func (m IDMap) FromVolume(id uint32) uint32 {
+	if len(m.Count) == 0 {
+		return id
+	}
+	for i := range m.Count {
+		if id >= m.Outside[i] && uint64(id) < uint64(m.Outside[i])+uint64(m.Count[i]) {
+			return m.Inside[i] + (id - m.Outside[i])
+		}
+	}
+	return OverflowID
+}
@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// LocalSocketDir the dir of the unix sockets of the datanodes, the clients on
+// their host read the chunk files directly through them
+var LocalSocketDir = "/var/run/containerfs"
+
+// DataNodeSocket the unix socket of the datanode serving port
+func DataNodeSocket(port int32) string {
+	return fmt.Sprintf("%v/datanode-%v.sock", LocalSocketDir, port)
+}
+
+var localIPs map[int32]bool
+var localIPsOnce sync.Once
+
+// IsLocalIP tells whether ip, as in the block infos, is an address of this host
+func IsLocalIP(ip int32) bool {
+	localIPsOnce.Do(func() {
+		localIPs = make(map[int32]bool)
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil {
+				localIPs[InetAton(n.IP.To4())] = true
+			}
+		}
+	})
+	return localIPs[ip]
+}
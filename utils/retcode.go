@@ -0,0 +1,29 @@
+package utils
+
+// NotLeader : Ret of a metanode op sent to a raft follower, the client should look up the leader again and retry
+const NotLeader int32 = 3
+
+// ReadOnly : Ret of a metanode op changing a volume frozen for the cutover of a migration (EROFS),
+// the client should wait and retry, the volume may come back on other metanodes
+const ReadOnly int32 = 30
+
+// WrongShard : Ret of a metanode op sent to a shard of a volume that does not own the inode,
+// the client should fetch the shard map of the volume again and retry
+const WrongShard int32 = 4
+
+// SessionRevoked : Ret of a session op of a client evicted from the volume, or of any client
+// while the volume is fenced. The client must drop its leases and cached state, it may not
+// open a session again under its id.
+const SessionRevoked int32 = 5
+
+// Unavailable : Ret of a metanode op a soft mount gave up on once its grace period passed
+// without a leader answering (EAGAIN), the op was not applied
+const Unavailable int32 = 11
+
+// LeaseHeld : Ret of AcquireLease when the holders of a conflicting lease did not give it
+// back within the revoke wait (EAGAIN), the lease was not granted, the client may try again
+const LeaseHeld int32 = 11
+
+// ClientIDMetadata : the grpc metadata key the clients send their session id under, the
+// metanodes refuse the ops of the evicted ones with codes.PermissionDenied
+const ClientIDMetadata = "cfs-client-id"
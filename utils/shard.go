@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A volume grown too large for one raft group is split into shards, each one a
+// namespace in its own raft group. The dentries of a dir live in the shard owning
+// the inode of the dir, the inode of an entry lives with its dentry.
+
+// ShardInodeBits each shard allocates its new inodes from shard<<ShardInodeBits
+const ShardInodeBits = 40
+
+// ShardChunkBits each shard allocates its chunk ids from shard<<ShardChunkBits,
+// the chunks of all the shards share the blocks of the volume
+const ShardChunkBits = 48
+
+// ShardVolID the id the namespace of a shard is registered under on the metanodes
+func ShardVolID(volID string, shard int32) string {
+	if shard == 0 {
+		return volID
+	}
+	return volID + "." + strconv.Itoa(int(shard))
+}
+
+// ParseShardVolID the volume and the shard of a ShardVolID
+func ParseShardVolID(id string) (string, int32) {
+	i := strings.LastIndex(id, ".")
+	if i < 0 {
+		return id, 0
+	}
+	n, err := strconv.Atoi(id[i+1:])
+	if err != nil {
+		return id, 0
+	}
+	return id[:i], int32(n)
+}
+
+// ShardRaftGroupID the raft group of a shard, volmgr numbers the volumes from 1 up
+func ShardRaftGroupID(raftGroupID uint64, shard int32) uint64 {
+	return raftGroupID | uint64(shard)<<32
+}
+
+// ShardMap maps inode ranges to shards, range i is [Starts[i], Starts[i+1]).
+// The empty map is an unsharded volume.
+type ShardMap struct {
+	Starts []uint64
+	Shards []int32
+}
+
+// Shard the shard owning inode
+func (m ShardMap) Shard(inode uint64) int32 {
+	i := sort.Search(len(m.Starts), func(i int) bool { return m.Starts[i] > inode }) - 1
+	if i < 0 {
+		return 0
+	}
+	return m.Shards[i]
+}
+
+// Range the range around inode owned by the same shard
+func (m ShardMap) Range(inode uint64) (uint64, uint64) {
+	i := sort.Search(len(m.Starts), func(i int) bool { return m.Starts[i] > inode }) - 1
+	var start, end uint64 = 0, ^uint64(0)
+	if i >= 0 {
+		start = m.Starts[i]
+	}
+	if i+1 < len(m.Starts) {
+		end = m.Starts[i+1]
+	}
+	return start, end
+}
+
+// Count the number of shards
+func (m ShardMap) Count() int32 {
+	var n int32 = 1
+	for _, s := range m.Shards {
+		if s+1 > n {
+			n = s + 1
+		}
+	}
+	return n
+}
+
+// Assign returns the map with [start, end) owned by shard
+func (m ShardMap) Assign(start uint64, end uint64, shard int32) ShardMap {
+	if len(m.Starts) == 0 {
+		m = ShardMap{Starts: []uint64{0}, Shards: []int32{0}}
+	}
+	out := ShardMap{}
+	for i, s := range m.Starts {
+		if s < start {
+			out.Starts = append(out.Starts, s)
+			out.Shards = append(out.Shards, m.Shards[i])
+		}
+	}
+	out.Starts = append(out.Starts, start)
+	out.Shards = append(out.Shards, shard)
+	if end != ^uint64(0) {
+		// the owner of end goes on after the range
+		out.Starts = append(out.Starts, end)
+		out.Shards = append(out.Shards, m.Shard(end))
+		for i, s := range m.Starts {
+			if s > end {
+				out.Starts = append(out.Starts, s)
+				out.Shards = append(out.Shards, m.Shards[i])
+			}
+		}
+	}
+	return out.merged()
+}
+
+func (m ShardMap) merged() ShardMap {
+	out := ShardMap{}
+	for i, s := range m.Starts {
+		if n := len(out.Shards); n > 0 && out.Shards[n-1] == m.Shards[i] {
+			continue
+		}
+		out.Starts = append(out.Starts, s)
+		out.Shards = append(out.Shards, m.Shards[i])
+	}
+	return out
+}
+
+// String the map as stored by the metanodes, start:shard,...
+func (m ShardMap) String() string {
+	var parts []string
+	for i, s := range m.Starts {
+		parts = append(parts, fmt.Sprintf("%d:%d", s, m.Shards[i]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseShardMap ...
+func ParseShardMap(s string) (ShardMap, error) {
+	m := ShardMap{}
+	if s == "" {
+		return m, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(part, ":", 2)
+		if len(kv) != 2 {
+			return ShardMap{}, fmt.Errorf("bad shard range %q", part)
+		}
+		start, err := strconv.ParseUint(kv[0], 10, 64)
+		if err != nil {
+			return ShardMap{}, err
+		}
+		shard, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return ShardMap{}, err
+		}
+		if n := len(m.Starts); n > 0 && m.Starts[n-1] >= start {
+			return ShardMap{}, fmt.Errorf("shard ranges out of order at %q", part)
+		}
+		m.Starts = append(m.Starts, start)
+		m.Shards = append(m.Shards, int32(shard))
+	}
+	return m, nil
+}
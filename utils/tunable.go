@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// The tunables are set again by a config reload while the running ops read them,
+// so they are set and read atomically.
+
+// Duration a time.Duration tunable
+type Duration struct {
+	v int64
+}
+
+// NewDuration a Duration of d
+func NewDuration(d time.Duration) Duration {
+	return Duration{v: int64(d)}
+}
+
+// Get the duration
+func (t *Duration) Get() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.v))
+}
+
+// Set the duration
+func (t *Duration) Set(d time.Duration) {
+	atomic.StoreInt64(&t.v, int64(d))
+}
+
+// Int an int tunable
+type Int struct {
+	v int64
+}
+
+// NewInt an Int of n
+func NewInt(n int) Int {
+	return Int{v: int64(n)}
+}
+
+// Get the int
+func (t *Int) Get() int {
+	return int(atomic.LoadInt64(&t.v))
+}
+
+// Set the int
+func (t *Int) Set(n int) {
+	atomic.StoreInt64(&t.v, int64(n))
+}
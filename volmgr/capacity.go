@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	vp "github.com/ipdcode/containerfs/proto/vp"
+	"github.com/ipdcode/containerfs/utils"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"time"
+)
+
+// SetVolCapacityLimits : the soft and hard capacity limits of a volume, in percent of
+// its space used, 0 for none. Past the soft limit the metanode and the clients warn,
+// past the hard one writes fail with ENOSPC while deletes and truncates still free space.
+// Kept in the volumes table and in the namespaces of the volume on the metanodes.
+func (s *VolMgrServer) SetVolCapacityLimits(ctx context.Context, in *vp.SetVolCapacityLimitsReq) (*vp.SetVolCapacityLimitsAck, error) {
+	ack := vp.SetVolCapacityLimitsAck{}
+	volid := in.UUID
+
+	if in.Soft < 0 || in.Soft > 100 || in.Hard < 0 || in.Hard > 100 || (in.Soft > 0 && in.Hard > 0 && in.Soft > in.Hard) {
+		ack.Ret = 22 // EINVAL
+		return &ack, nil
+	}
+	var metadomain string
+	var shards int32
+	if err := VolMgrDB.QueryRow("SELECT metadomain,shards FROM volumes WHERE uuid=?", volid).Scan(&metadomain, &shards); err != nil {
+		ack.Ret = 2 // no such volume
+		return &ack, nil
+	}
+	_, err := VolMgrDB.Exec("UPDATE volumes SET softlimit=?, hardlimit=? WHERE uuid=?", in.Soft, in.Hard, volid)
+	if err != nil {
+		logger.Error("Set volume:%v capacity limits error:%v", volid, err)
+		ack.Ret = -1
+		return &ack, nil
+	}
+
+	for shard := int32(0); shard < shards; shard++ {
+		req := &mp.SetCapacityLimitsReq{VolID: utils.ShardVolID(volid, shard), Soft: in.Soft, Hard: in.Hard}
+		if err := setCapacityLimits(metadomain, req); err != nil {
+			logger.Error("Set capacity limits of volume:%v on the metanodes error:%v", req.VolID, err)
+			ack.Ret = -1
+			return &ack, nil
+		}
+	}
+
+	logger.Debug("== Volume:%v softlimit:%v hardlimit:%v", volid, in.Soft, in.Hard)
+	ack.Ret = 0
+	return &ack, nil
+}
+
+// setCapacityLimits asks the metanode leader of the namespace, metadomain may be a follower
+func setCapacityLimits(metadomain string, req *mp.SetCapacityLimitsReq) error {
+	return callMetaLeader(metadomain, req.VolID, func(ctx context.Context, mc mp.MetaNodeClient) (int32, error) {
+		ack, err := mc.SetCapacityLimits(ctx, req)
+		if err != nil {
+			return 0, err
+		}
+		return ack.Ret, nil
+	})
+}
+
+// callMetaLeader calls the metanode leader of the namespace volID, metadomain may be
+// a follower: call answering utils.NotLeader is sent to the leader
+func callMetaLeader(metadomain string, volID string, call func(ctx context.Context, mc mp.MetaNodeClient) (int32, error)) error {
+	addr := metadomain
+	for try := 0; try < 2; try++ {
+		conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Millisecond*300), grpc.FailOnNonTempDialError(true))
+		if err != nil {
+			return err
+		}
+		mc := mp.NewMetaNodeClient(conn)
+		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+		ret, err := call(ctx, mc)
+		if err == nil && ret == utils.NotLeader {
+			ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+			if leader, lerr := mc.GetMetaLeader(ctx, &mp.GetMetaLeaderReq{VolID: volID}); lerr == nil && leader.Ret == 0 {
+				conn.Close()
+				addr = leader.Leader
+				continue
+			}
+		}
+		conn.Close()
+		if err != nil {
+			return err
+		}
+		if ret != 0 {
+			return fmt.Errorf("ret %v", ret)
+		}
+		return nil
+	}
+	return fmt.Errorf("no metanode leader for volume %v", volID)
+}
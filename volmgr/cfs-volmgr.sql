@@ -30,6 +30,8 @@ CREATE TABLE `blk` (
   `disabled` tinyint(2) DEFAULT NULL,
   `createdTime` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
   `volid` varchar(32) DEFAULT NULL,
+  `heat` bigint(32) NOT NULL DEFAULT 0,
+  `lastaccess` TIMESTAMP NULL DEFAULT NULL,
   PRIMARY KEY (`blkid`)
 ) ENGINE=InnoDB AUTO_INCREMENT=2369 DEFAULT CHARSET=utf8;
 /*!40101 SET character_set_client = @saved_cs_client */;
@@ -67,12 +69,33 @@ CREATE TABLE `disks` (
   `used` bigint(32) DEFAULT NULL,
   `free` bigint(32) DEFAULT NULL,
   `statu` tinyint(2) DEFAULT NULL,
+  `labels` varchar(255) DEFAULT '',
   `createdTime` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
   PRIMARY KEY (`ip`,`port`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
 
+--
+-- Table structure for table `datadirs`
+--
+
+DROP TABLE IF EXISTS `datadirs`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `datadirs` (
+  `ip` varchar(32) NOT NULL,
+  `port` int(16) NOT NULL,
+  `path` varchar(255) NOT NULL,
+  `total` bigint(32) NOT NULL,
+  `used` bigint(32) DEFAULT NULL,
+  `free` bigint(32) DEFAULT NULL,
+  `statu` tinyint(2) DEFAULT NULL,
+  PRIMARY KEY (`ip`,`port`,`path`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+
 --
 -- Table structure for table `repair`
 --
@@ -97,6 +120,31 @@ CREATE TABLE `repair` (
 /*!40101 SET character_set_client = @saved_cs_client */;
 
 
+--
+-- Table structure for table `blkmoves`
+--
+
+DROP TABLE IF EXISTS `blkmoves`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `blkmoves` (
+  `id` bigint(32) NOT NULL AUTO_INCREMENT,
+  `volid` varchar(32) NOT NULL,
+  `blkgrpid` bigint(32) NOT NULL,
+  `blkid` bigint(32) NOT NULL,
+  `oldip` varchar(32) NOT NULL,
+  `oldport` int(16) NOT NULL,
+  `newip` varchar(32) NOT NULL DEFAULT '',
+  `newport` int(16) NOT NULL DEFAULT 0,
+  `chkid` bigint(32) NOT NULL,
+  `chksize` int(32) NOT NULL DEFAULT 0,
+  `switched` tinyint(8) NOT NULL DEFAULT 0,
+  `createdTime` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+
 --
 -- Table structure for table `volumes`
 --
@@ -110,6 +158,15 @@ CREATE TABLE `volumes` (
   `name` varchar(32) NOT NULL,
   `size` bigint(32) NOT NULL,
   `metadomain` varchar(32) NOT NULL,
+  `status` tinyint(2) NOT NULL DEFAULT 0,
+  `replica` tinyint(2) NOT NULL DEFAULT 0,
+  `writequorum` tinyint(2) NOT NULL DEFAULT 0,
+  `storageclass` varchar(8) NOT NULL DEFAULT '',
+  `accessmode` varchar(8) NOT NULL DEFAULT '',
+  `softlimit` tinyint(3) NOT NULL DEFAULT 0,
+  `hardlimit` tinyint(3) NOT NULL DEFAULT 0,
+  `shards` int(11) NOT NULL DEFAULT 1,
+  `deletedTime` TIMESTAMP NULL DEFAULT NULL,
   `createdTime` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
   PRIMARY KEY (`raftgroupid`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"github.com/ipdcode/containerfs/utils"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"html/template"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxEvents the recent events kept for the dashboard
+const maxEvents = 200
+
+// events what changed in the cluster lately, newest last
+var events struct {
+	sync.Mutex
+	list []clusterEvent
+}
+
+type clusterEvent struct {
+	Time time.Time `json:"time"`
+	Msg  string    `json:"msg"`
+}
+
+// recordEvent keeps a cluster event for the dashboard, the callers log it as well
+func recordEvent(format string, args ...interface{}) {
+	events.Lock()
+	defer events.Unlock()
+	events.list = append(events.list, clusterEvent{Time: time.Now(), Msg: fmt.Sprintf(format, args...)})
+	if len(events.list) > maxEvents {
+		events.list = events.list[len(events.list)-maxEvents:]
+	}
+}
+
+// the states of a datanode in the disks table
+var diskStatus = map[int]string{0: "ok", 1: "unreachable", 2: "offline", 3: "read-only"}
+
+type dashDataDir struct {
+	Path   string `json:"path"`
+	Total  int64  `json:"total_gb"`
+	Used   int64  `json:"used_gb"`
+	Status string `json:"status"`
+}
+
+type dashDataNode struct {
+	Addr     string         `json:"addr"`
+	Labels   string         `json:"labels"`
+	Status   string         `json:"status"`
+	Total    int64          `json:"total_gb"`
+	Used     int64          `json:"used_gb"`
+	Free     int64          `json:"free_gb"`
+	UsedPct  int64          `json:"used_pct"`
+	Blocks   int64          `json:"blocks"`
+	DataDirs []*dashDataDir `json:"datadirs"`
+}
+
+type dashVolume struct {
+	UUID         string `json:"uuid"`
+	Name         string `json:"name"`
+	Status       string `json:"status"`
+	MetaDomain   string `json:"metadomain"`
+	Shards       int32  `json:"shards"`
+	StorageClass string `json:"storageclass"`
+	Quota        int64  `json:"quota_gb"`
+	Total        uint64 `json:"total_gb"`
+	Used         uint64 `json:"used_gb"`
+	UsedPct      int64  `json:"used_pct"` // -1 when its metanodes did not answer
+	BlockGroups  int64  `json:"blockgroups"`
+	Repairing    int64  `json:"under_replicated_blocks"`
+}
+
+type dashStatus struct {
+	Time      time.Time       `json:"time"`
+	DataNodes []*dashDataNode `json:"datanodes"`
+	Volumes   []*dashVolume   `json:"volumes"`
+	Repairing int64           `json:"under_replicated_blocks"`
+	Events    []clusterEvent  `json:"events"`
+}
+
+// serveDashboard serves the state of the cluster at addr for the operators, as a
+// page at / and as json at /api/status
+func serveDashboard(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {
+		st, err := clusterStatus()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		st, err := clusterStatus()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := dashboardPage.Execute(w, st); err != nil {
+			logger.Error("dashboard render error:%v", err)
+		}
+	})
+	go http.Serve(l, mux)
+	return nil
+}
+
+// clusterStatus the datanodes, the volumes and the recent events
+func clusterStatus() (*dashStatus, error) {
+	st := &dashStatus{Time: time.Now()}
+	nodes, err := dashDataNodes()
+	if err != nil {
+		return nil, err
+	}
+	st.DataNodes = nodes
+	vols, err := dashVolumes()
+	if err != nil {
+		return nil, err
+	}
+	st.Volumes = vols
+	for _, v := range vols {
+		st.Repairing += v.Repairing
+	}
+	events.Lock()
+	for i := len(events.list) - 1; i >= 0; i-- {
+		st.Events = append(st.Events, events.list[i])
+	}
+	events.Unlock()
+	return st, nil
+}
+
+func dashDataNodes() ([]*dashDataNode, error) {
+	rows, err := VolMgrDB.Query("SELECT ip,port,total,used,free,statu,labels FROM disks")
+	if err != nil {
+		return nil, err
+	}
+	byAddr := make(map[string]*dashDataNode)
+	var nodes []*dashDataNode
+	for rows.Next() {
+		var ip, labels sql.NullString
+		var port int
+		var total, used, free, statu sql.NullInt64
+		if err := rows.Scan(&ip, &port, &total, &used, &free, &statu, &labels); err != nil {
+			continue
+		}
+		n := &dashDataNode{
+			Addr:   ip.String + ":" + strconv.Itoa(port),
+			Labels: labels.String,
+			Status: diskStatus[int(statu.Int64)],
+			Total:  total.Int64,
+			Used:   used.Int64,
+			Free:   free.Int64,
+		}
+		if n.Total > 0 {
+			n.UsedPct = n.Used * 100 / n.Total
+		}
+		byAddr[n.Addr] = n
+		nodes = append(nodes, n)
+	}
+	rows.Close()
+
+	rows, err = VolMgrDB.Query("SELECT hostip,hostport,COUNT(*) FROM blk WHERE volid IS NOT NULL GROUP BY hostip,hostport")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var ip string
+		var port int
+		var n int64
+		if rows.Scan(&ip, &port, &n) != nil {
+			continue
+		}
+		if node, ok := byAddr[ip+":"+strconv.Itoa(port)]; ok {
+			node.Blocks = n
+		}
+	}
+	rows.Close()
+
+	rows, err = VolMgrDB.Query("SELECT ip,port,path,total,used,statu FROM datadirs")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var ip string
+		var port int
+		var used, statu sql.NullInt64
+		d := &dashDataDir{}
+		if rows.Scan(&ip, &port, &d.Path, &d.Total, &used, &statu) != nil {
+			continue
+		}
+		d.Used = used.Int64
+		d.Status = diskStatus[int(statu.Int64)]
+		if node, ok := byAddr[ip+":"+strconv.Itoa(port)]; ok {
+			node.DataDirs = append(node.DataDirs, d)
+		}
+	}
+	rows.Close()
+
+	// the topology: by labels, rack=r1,zone=a, then by address
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Labels != nodes[j].Labels {
+			return nodes[i].Labels < nodes[j].Labels
+		}
+		return nodes[i].Addr < nodes[j].Addr
+	})
+	return nodes, nil
+}
+
+func dashVolumes() ([]*dashVolume, error) {
+	rows, err := VolMgrDB.Query("SELECT uuid,name,size,metadomain,status,shards,storageclass FROM volumes ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	var vols []*dashVolume
+	byUUID := make(map[string]*dashVolume)
+	for rows.Next() {
+		v := &dashVolume{}
+		var status int
+		if rows.Scan(&v.UUID, &v.Name, &v.Quota, &v.MetaDomain, &status, &v.Shards, &v.StorageClass) != nil {
+			continue
+		}
+		v.Status = "ok"
+		if status != 0 {
+			v.Status = "pending purge"
+		}
+		vols = append(vols, v)
+		byUUID[v.UUID] = v
+	}
+	rows.Close()
+
+	rows, err = VolMgrDB.Query("SELECT volume_uuid,COUNT(*) FROM blkgrp GROUP BY volume_uuid")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var uuid string
+		var n int64
+		if rows.Scan(&uuid, &n) == nil && byUUID[uuid] != nil {
+			byUUID[uuid].BlockGroups = n
+		}
+	}
+	rows.Close()
+
+	// the blocks with chunks waiting for repair have a copy short
+	rows, err = VolMgrDB.Query("SELECT volid,COUNT(DISTINCT blkid) FROM repair GROUP BY volid")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var uuid string
+		var n int64
+		if rows.Scan(&uuid, &n) == nil && byUUID[uuid] != nil {
+			byUUID[uuid].Repairing = n
+		}
+	}
+	rows.Close()
+
+	var wg sync.WaitGroup
+	for _, v := range vols {
+		v.UsedPct = -1
+		if v.Status != "ok" {
+			continue
+		}
+		wg.Add(1)
+		go func(v *dashVolume) {
+			defer wg.Done()
+			info, err := volSpace(v.MetaDomain, v.UUID)
+			if err != nil {
+				logger.Debug("dashboard: space of volume:%v error:%v", v.UUID, err)
+				return
+			}
+			const gb = 1024 * 1024 * 1024
+			v.Total = info.TotalSpace / gb
+			v.Used = (info.TotalSpace - info.FreeSpace) / gb
+			if info.TotalSpace > 0 {
+				v.UsedPct = int64((info.TotalSpace - info.FreeSpace) * 100 / info.TotalSpace)
+			}
+		}(v)
+	}
+	wg.Wait()
+	return vols, nil
+}
+
+// volSpace asks the metanode leader of the volume, metadomain may be a follower
+func volSpace(metadomain string, volid string) (*mp.GetFSInfoAck, error) {
+	addr := metadomain
+	for try := 0; try < 2; try++ {
+		conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Millisecond*300), grpc.FailOnNonTempDialError(true))
+		if err != nil {
+			return nil, err
+		}
+		mc := mp.NewMetaNodeClient(conn)
+		ctx, _ := context.WithTimeout(context.Background(), 2*time.Second)
+		ack, err := mc.GetFSInfo(ctx, &mp.GetFSInfoReq{VolID: volid})
+		if err == nil && ack.Ret == utils.NotLeader {
+			ctx, _ := context.WithTimeout(context.Background(), 2*time.Second)
+			if leader, lerr := mc.GetMetaLeader(ctx, &mp.GetMetaLeaderReq{VolID: volid}); lerr == nil && leader.Ret == 0 {
+				conn.Close()
+				addr = leader.Leader
+				continue
+			}
+		}
+		conn.Close()
+		if err != nil {
+			return nil, err
+		}
+		if ack.Ret != 0 {
+			return nil, fmt.Errorf("ret %v", ack.Ret)
+		}
+		return ack, nil
+	}
+	return nil, fmt.Errorf("no metanode leader for volume %v", volid)
+}
+
+var dashboardPage = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta http-equiv="refresh" content="30">
+<title>ContainerFS</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; margin: 20px; }
+table { border-collapse: collapse; margin-bottom: 24px; }
+th, td { border: 1px solid #ccc; padding: 3px 8px; text-align: left; }
+th { background: #eee; }
+.ok { color: #070; } .bad { color: #b00; font-weight: bold; }
+.bar { background: #ddd; width: 100px; height: 10px; display: inline-block; }
+.bar span { background: #48c; height: 10px; display: block; }
+</style></head><body>
+<h2>ContainerFS cluster</h2>
+<p>{{.Time.Format "2006-01-02 15:04:05"}} &middot; {{len .DataNodes}} datanodes &middot; {{len .Volumes}} volumes &middot;
+under-replicated blocks: <span class="{{if .Repairing}}bad{{else}}ok{{end}}">{{.Repairing}}</span> &middot; <a href="/api/status">json</a></p>
+
+<h3>Datanodes</h3>
+<table><tr><th>labels</th><th>address</th><th>status</th><th>used</th><th>used / total GB</th><th>blocks</th><th>data dirs</th></tr>
+{{range .DataNodes}}<tr><td>{{.Labels}}</td><td>{{.Addr}}</td>
+<td class="{{if eq .Status "ok"}}ok{{else}}bad{{end}}">{{.Status}}</td>
+<td><div class="bar"><span style="width:{{.UsedPct}}px"></span></div> {{.UsedPct}}%</td>
+<td>{{.Used}} / {{.Total}}</td><td>{{.Blocks}}</td>
+<td>{{range .DataDirs}}{{.Path}} <span class="{{if eq .Status "ok"}}ok{{else}}bad{{end}}">{{.Status}}</span> {{.Used}}/{{.Total}}<br>{{end}}</td></tr>
+{{end}}</table>
+
+<h3>Volumes</h3>
+<table><tr><th>name</th><th>uuid</th><th>status</th><th>metanodes</th><th>shards</th><th>class</th><th>used</th><th>used / total GB</th><th>quota GB</th><th>block groups</th><th>under-replicated blocks</th></tr>
+{{range .Volumes}}<tr><td>{{.Name}}</td><td>{{.UUID}}</td>
+<td class="{{if eq .Status "ok"}}ok{{else}}bad{{end}}">{{.Status}}</td><td>{{.MetaDomain}}</td><td>{{.Shards}}</td><td>{{.StorageClass}}</td>
+<td>{{if ge .UsedPct 0}}<div class="bar"><span style="width:{{.UsedPct}}px"></span></div> {{.UsedPct}}%{{else}}?{{end}}</td>
+<td>{{.Used}} / {{.Total}}</td><td>{{.Quota}}</td><td>{{.BlockGroups}}</td>
+<td class="{{if .Repairing}}bad{{else}}ok{{end}}">{{.Repairing}}</td></tr>
+{{end}}</table>
+
+<h3>Recent events</h3>
+<table><tr><th>time</th><th>event</th></tr>
+{{range .Events}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Msg}}</td></tr>
+{{else}}<tr><td colspan="2">none since volmgr started</td></tr>{{end}}
+</table>
+</body></html>
+`))
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ipdcode/containerfs/logger"
+	vp "github.com/ipdcode/containerfs/proto/vp"
+	"golang.org/x/net/context"
+	"sync"
+)
+
+// ensureMu two EnsureVol of the same name would both create it
+var ensureMu sync.Mutex
+
+// EnsureVol : the volume named VolName in service with the settings of the request,
+// created or changed to match, for the provisioning tools keeping their volumes as
+// declared. Calling it again changes nothing. The volumes pending purge do not count,
+// a name two volumes in service share is refused with EEXIST. The space is grown but
+// never shrunk, EINVAL. A volume created or grown leaves its namespace to the caller
+// like CreateVol and ExpendVol do, the capacity limits of a volume created are set
+// when it is ensured again.
+func (s *VolMgrServer) EnsureVol(ctx context.Context, in *vp.EnsureVolReq) (*vp.EnsureVolAck, error) {
+	ack := vp.EnsureVolAck{}
+	mode := in.AccessMode
+	if mode == "RWX" {
+		mode = accessRWX
+	}
+	if in.VolName == "" || in.SpaceQuota <= 0 || !validClass(in.StorageClass) || !validAccessMode(in.AccessMode) ||
+		in.WriteQuorum < 0 || in.WriteQuorum > 3 || in.SoftLimit < 0 || in.SoftLimit > 100 || in.HardLimit < 0 || in.HardLimit > 100 ||
+		(in.SoftLimit > 0 && in.HardLimit > 0 && in.SoftLimit > in.HardLimit) {
+		ack.Ret = 22 // EINVAL
+		return &ack, nil
+	}
+
+	ensureMu.Lock()
+	defer ensureMu.Unlock()
+
+	type volRow struct {
+		uuid        string
+		raftgroupid uint64
+		size        int32
+		writequorum int32
+		class       string
+		mode        string
+		soft, hard  int32
+	}
+	rows, err := VolMgrDB.Query("SELECT uuid,raftgroupid,size,writequorum,storageclass,accessmode,softlimit,hardlimit FROM volumes WHERE name=? AND status=0", in.VolName)
+	if err != nil {
+		logger.Error("Ensure volume:%v get volumes error:%v", in.VolName, err)
+		ack.Ret = -1
+		return &ack, nil
+	}
+	var vols []volRow
+	for rows.Next() {
+		var v volRow
+		if err := rows.Scan(&v.uuid, &v.raftgroupid, &v.size, &v.writequorum, &v.class, &v.mode, &v.soft, &v.hard); err != nil {
+			logger.Error("Ensure volume:%v scan volumes error:%v", in.VolName, err)
+			continue
+		}
+		vols = append(vols, v)
+	}
+	rows.Close()
+
+	if len(vols) > 1 {
+		logger.Error("Ensure volume:%v, %v volumes in service have the name", in.VolName, len(vols))
+		ack.Ret = 17 // EEXIST
+		return &ack, nil
+	}
+
+	var cur volRow
+	if len(vols) == 0 {
+		ack.Changes = append(ack.Changes, fmt.Sprintf("create with %vGB", in.SpaceQuota))
+		if in.DryRun {
+			return &ack, nil
+		}
+		cack, err := s.CreateVol(ctx, &vp.CreateVolReq{VolName: in.VolName, SpaceQuota: in.SpaceQuota, MetaDomain: in.MetaDomain, StorageClass: in.StorageClass})
+		if err != nil || cack.Ret != 0 {
+			logger.Error("Ensure volume:%v create ret:%v error:%v", in.VolName, cack.Ret, err)
+			ack.Ret = cack.Ret
+			if ack.Ret == 0 {
+				ack.Ret = -1
+			}
+			return &ack, nil
+		}
+		ack.Created = true
+		// the settings of a new volume, set below when others are wanted
+		cur = volRow{uuid: cack.UUID, raftgroupid: cack.RaftGroupID, size: in.SpaceQuota, class: in.StorageClass, mode: accessRWX}
+	} else {
+		cur = vols[0]
+	}
+	ack.UUID, ack.RaftGroupID = cur.uuid, cur.raftgroupid
+
+	var ret int32
+	switch {
+	case in.SpaceQuota < cur.size:
+		ack.Changes = append(ack.Changes, fmt.Sprintf("shrink from %vGB to %vGB, refused", cur.size, in.SpaceQuota))
+		ack.Ret = 22 // EINVAL
+		return &ack, nil
+	case in.SpaceQuota > cur.size:
+		ack.Changes = append(ack.Changes, fmt.Sprintf("grow from %vGB to %vGB", cur.size, in.SpaceQuota))
+		if !in.DryRun {
+			eack, err := s.ExpendVol(ctx, &vp.ExpendVolReq{VolID: cur.uuid, ExpendQuota: in.SpaceQuota - cur.size})
+			if err != nil || eack.Ret != 0 {
+				logger.Error("Ensure volume:%v grow ret:%v error:%v", cur.uuid, eack.Ret, err)
+				ack.Ret = -1
+				return &ack, nil
+			}
+			ack.BlockGroups = eack.BlockGroups
+		}
+	}
+	if in.StorageClass != cur.class {
+		ack.Changes = append(ack.Changes, fmt.Sprintf("storage class %q to %q", cur.class, in.StorageClass))
+		if !in.DryRun {
+			a, _ := s.SetVolStorageClass(ctx, &vp.SetVolStorageClassReq{UUID: cur.uuid, StorageClass: in.StorageClass})
+			ret = a.Ret
+		}
+	}
+	if ret == 0 && in.WriteQuorum != cur.writequorum {
+		ack.Changes = append(ack.Changes, fmt.Sprintf("write quorum %v to %v", cur.writequorum, in.WriteQuorum))
+		if !in.DryRun {
+			a, _ := s.SetVolWriteQuorum(ctx, &vp.SetVolWriteQuorumReq{UUID: cur.uuid, WriteQuorum: in.WriteQuorum})
+			ret = a.Ret
+		}
+	}
+	if ret == 0 && mode != cur.mode {
+		ack.Changes = append(ack.Changes, fmt.Sprintf("access mode %q to %q", cur.mode, mode))
+		if !in.DryRun {
+			a, _ := s.SetVolAccessMode(ctx, &vp.SetVolAccessModeReq{UUID: cur.uuid, AccessMode: mode})
+			ret = a.Ret
+		}
+	}
+	// the limits are kept in the namespace too, which a volume just created does not
+	// have yet: the caller ensures it again once it created it
+	if ret == 0 && !ack.Created && (in.SoftLimit != cur.soft || in.HardLimit != cur.hard) {
+		ack.Changes = append(ack.Changes, fmt.Sprintf("capacity limits %v/%v to %v/%v", cur.soft, cur.hard, in.SoftLimit, in.HardLimit))
+		if !in.DryRun {
+			a, _ := s.SetVolCapacityLimits(ctx, &vp.SetVolCapacityLimitsReq{UUID: cur.uuid, Soft: in.SoftLimit, Hard: in.HardLimit})
+			ret = a.Ret
+		}
+	} else if ret == 0 && !ack.Created && !in.DryRun && (in.SoftLimit != 0 || in.HardLimit != 0) {
+		// set in the table but maybe not in the namespace, a call failed half way or the
+		// namespace was created again: set there again, no change
+		a, _ := s.SetVolCapacityLimits(ctx, &vp.SetVolCapacityLimitsReq{UUID: cur.uuid, Soft: in.SoftLimit, Hard: in.HardLimit})
+		ret = a.Ret
+	}
+	if ret != 0 {
+		// EBUSY from the access mode: the mounts do not fit it
+		logger.Error("Ensure volume:%v %v ret:%v", cur.uuid, ack.Changes, ret)
+		ack.Ret = ret
+		return &ack, nil
+	}
+	if len(ack.Changes) > 0 && !in.DryRun {
+		logger.Debug("== Volume:%v (%v) ensured: %v", in.VolName, cur.uuid, ack.Changes)
+	}
+	return &ack, nil
+}
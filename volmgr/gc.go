@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ipdcode/containerfs/logger"
+	dp "github.com/ipdcode/containerfs/proto/dp"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	"github.com/ipdcode/containerfs/utils"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// block gc, see gcVol
+var (
+	GCInterval utils.Duration                      // between passes, 0 stops the gc
+	GCGrace    = utils.NewDuration(24 * time.Hour) // a chunk no file references is collected once this old
+	gcDialWait = time.Second                       // dialing a datanode or a metanode
+	gcCallWait = 60 * time.Second                  // listing the chunks of a block or a namespace
+)
+
+// gcLoop runs a gc pass every GCInterval
+func gcLoop() {
+	for {
+		interval := GCInterval.Get()
+		if interval <= 0 {
+			time.Sleep(time.Minute)
+			continue
+		}
+		time.Sleep(interval)
+		if GCInterval.Get() > 0 {
+			gcPass()
+		}
+	}
+}
+
+// gcPass checks the blocks of each volume in service against its metanodes
+func gcPass() {
+	rows, err := VolMgrDB.Query("SELECT uuid,metadomain,shards FROM volumes WHERE status=0")
+	if err != nil {
+		logger.Error("gc: get volumes error:%v", err)
+		return
+	}
+	type vol struct {
+		uuid       string
+		metadomain string
+		shards     int32
+	}
+	var vols []vol
+	for rows.Next() {
+		var v vol
+		if err := rows.Scan(&v.uuid, &v.metadomain, &v.shards); err != nil {
+			continue
+		}
+		vols = append(vols, v)
+	}
+	rows.Close()
+
+	for _, v := range vols {
+		gcVol(v.uuid, v.metadomain, v.shards)
+	}
+}
+
+// gcBlk a block of a volume and the chunks its datanode holds
+type gcBlk struct {
+	blkid    uint32
+	blkgrpid uint32
+	addr     string
+	chunks   []*dp.ChunkFile
+}
+
+// gcVol lists the chunks on the datanodes holding the blocks of the volume, then
+// the chunks its files reference on the metanodes. A chunk no file references and
+// older than GCGrace is deleted: a client crashed between writing it and linking it,
+// or a delete did not reach all the datanodes. A deleted chunk a file still references
+// is restored, the datanodes keep them for their -gcdelay. The datanodes are listed
+// first so a chunk written after is not taken for a leak, and one deleted after is
+// not restored. A volume whose metanodes cannot all be asked is left alone, as are
+// the blocks being repaired or moved.
+func gcVol(volid string, metadomain string, shards int32) {
+	groups := make(map[string]uint32)
+	rows, err := VolMgrDB.Query("SELECT blkgrpid,blks FROM blkgrp WHERE volume_uuid=?", volid)
+	if err != nil {
+		logger.Error("gc: get blkgroups of volume:%v error:%v", volid, err)
+		return
+	}
+	for rows.Next() {
+		var blkgrpid uint32
+		var blks string
+		if rows.Scan(&blkgrpid, &blks) != nil {
+			continue
+		}
+		for _, id := range strings.Split(blks, ",") {
+			groups[id] = blkgrpid
+		}
+	}
+	rows.Close()
+
+	rows, err = VolMgrDB.Query(`SELECT b.blkid,b.hostip,b.hostport FROM blk b WHERE b.volid=? AND b.disabled=0
+		AND NOT EXISTS (SELECT 1 FROM repair r WHERE r.blkid=b.blkid)
+		AND NOT EXISTS (SELECT 1 FROM blkmoves m WHERE m.blkid=b.blkid)`, volid)
+	if err != nil {
+		logger.Error("gc: get blks of volume:%v error:%v", volid, err)
+		return
+	}
+	var blks []*gcBlk
+	for rows.Next() {
+		var blkid uint32
+		var ip string
+		var port int
+		if rows.Scan(&blkid, &ip, &port) != nil {
+			continue
+		}
+		blkgrpid, ok := groups[strconv.FormatUint(uint64(blkid), 10)]
+		if !ok {
+			continue
+		}
+		blks = append(blks, &gcBlk{blkid: blkid, blkgrpid: blkgrpid, addr: ip + ":" + strconv.Itoa(port)})
+	}
+	rows.Close()
+
+	var listed []*gcBlk
+	for _, b := range blks {
+		chunks, err := listChunks(b.addr, b.blkid)
+		if err != nil {
+			logger.Error("gc: list chunks of blk:%v on %v error:%v", b.blkid, b.addr, err)
+			continue
+		}
+		b.chunks = chunks
+		listed = append(listed, b)
+	}
+
+	refs := make(map[uint32]map[uint64]bool)
+	for shard := int32(0); shard < shards; shard++ {
+		groups, err := listChunkRefs(metadomain, utils.ShardVolID(volid, shard))
+		if err != nil {
+			logger.Error("gc: list chunk refs of volume:%v shard:%v error:%v, volume skipped", volid, shard, err)
+			return
+		}
+		for _, g := range groups {
+			m, ok := refs[g.BlockGroupID]
+			if !ok {
+				m = make(map[uint64]bool, len(g.ChunkIDs))
+				refs[g.BlockGroupID] = m
+			}
+			for _, id := range g.ChunkIDs {
+				m[id] = true
+			}
+		}
+	}
+
+	var collected, restored int
+	for _, b := range listed {
+		for _, c := range b.chunks {
+			referenced := refs[b.blkgrpid][c.ChunkID]
+			switch {
+			case c.Deleted && referenced:
+				if err := restoreChunk(b.addr, &dp.RestoreChunkReq{BlockID: b.blkid, ChunkID: c.ChunkID}); err != nil {
+					logger.Error("gc: restore chunk:%v of blk:%v on %v error:%v", c.ChunkID, b.blkid, b.addr, err)
+					continue
+				}
+				logger.Error("gc: chunk:%v of blk:%v of volume:%v on %v deleted while referenced, restored", c.ChunkID, b.blkid, volid, b.addr)
+				restored++
+			case !c.Deleted && !referenced && time.Since(time.Unix(c.ModTime, 0)) > GCGrace.Get():
+				err := deleteOldChunk(b.addr, &dp.DeleteChunkReq{ChunkID: c.ChunkID, BlockID: b.blkid, VolID: volid, BlockGroupID: b.blkgrpid, Background: true})
+				if err != nil {
+					logger.Error("gc: delete chunk:%v of blk:%v on %v error:%v", c.ChunkID, b.blkid, b.addr, err)
+					continue
+				}
+				collected++
+			}
+		}
+	}
+	if collected > 0 || restored > 0 {
+		logger.Info("gc: volume:%v %v leaked chunks collected, %v restored", volid, collected, restored)
+		recordEvent("gc: volume %s %d leaked chunks collected, %d restored", volid, collected, restored)
+	}
+}
+
+func listChunks(addr string, blkid uint32) ([]*dp.ChunkFile, error) {
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(gcDialWait))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	ctx, _ := context.WithTimeout(context.Background(), gcCallWait)
+	ack, err := dp.NewDataNodeClient(conn).ListChunks(ctx, &dp.ListChunksReq{BlockID: blkid})
+	if err != nil {
+		return nil, err
+	}
+	if ack.Ret != 0 {
+		return nil, fmt.Errorf("ret %v", ack.Ret)
+	}
+	return ack.Chunks, nil
+}
+
+func restoreChunk(addr string, req *dp.RestoreChunkReq) error {
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(gcDialWait))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	ack, err := dp.NewDataNodeClient(conn).RestoreChunk(ctx, req)
+	if err != nil {
+		return err
+	}
+	if ack.Ret != 0 {
+		return fmt.Errorf("ret %v", ack.Ret)
+	}
+	return nil
+}
+
+// listChunkRefs asks the metanode leader of the namespace, metadomain may be a follower
+func listChunkRefs(metadomain string, volid string) ([]*mp.BlockGroupChunks, error) {
+	addr := metadomain
+	for try := 0; try < 2; try++ {
+		conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(gcDialWait), grpc.FailOnNonTempDialError(true))
+		if err != nil {
+			return nil, err
+		}
+		mc := mp.NewMetaNodeClient(conn)
+		ctx, _ := context.WithTimeout(context.Background(), gcCallWait)
+		ack, err := mc.ListChunkRefs(ctx, &mp.ListChunkRefsReq{VolID: volid})
+		if err == nil && ack.Ret == utils.NotLeader {
+			ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+			if leader, lerr := mc.GetMetaLeader(ctx, &mp.GetMetaLeaderReq{VolID: volid}); lerr == nil && leader.Ret == 0 {
+				conn.Close()
+				addr = leader.Leader
+				continue
+			}
+		}
+		conn.Close()
+		if err != nil {
+			return nil, err
+		}
+		if ack.Ret != 0 {
+			return nil, fmt.Errorf("ret %v", ack.Ret)
+		}
+		return ack.Groups, nil
+	}
+	return nil, fmt.Errorf("no metanode leader for volume %v", volid)
+}
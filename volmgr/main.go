@@ -6,26 +6,32 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/ipdcode/containerfs/logger"
 	dp "github.com/ipdcode/containerfs/proto/dp"
+	mp "github.com/ipdcode/containerfs/proto/mp"
 	vp "github.com/ipdcode/containerfs/proto/vp"
 	"github.com/ipdcode/containerfs/utils"
+	"github.com/ipdcode/containerfs/volmgr/placement"
 	"github.com/lxmgo/config"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
 	"net"
 	"os"
+	"os/signal"
 	"runtime"
 	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 type addr struct {
-	host string
-	port int
-	log  string
+	host      string
+	port      int
+	log       string
+	debug     string // pprof and stats
+	dashboard string // the cluster dashboard
 }
 
 // VolMgrServerAddr ...
@@ -55,6 +61,9 @@ var err string
 // VolMgrServer ...
 type VolMgrServer struct{}
 
+// PurgeRetention : how long a deleted volume stays pending purge
+var PurgeRetention utils.Duration
+
 // VolMgrDB ...
 var VolMgrDB *sql.DB
 
@@ -73,7 +82,7 @@ func (s *VolMgrServer) DatanodeRegistry(ctx context.Context, in *vp.DatanodeRegi
 	dnMount := in.MountPoint
 	dnCapacity := in.Capacity
 
-	disk, err := VolMgrDB.Prepare("INSERT INTO disks(ip,port,mount,total,statu) VALUES(?, ?, ?, ?, ?)")
+	disk, err := VolMgrDB.Prepare("INSERT INTO disks(ip,port,mount,total,statu,labels) VALUES(?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		logger.Error("DataNode(%v:%v) Registry insert into disks table prepare err:%v", ip, dnPort, err)
 		ack.Ret = -1
@@ -81,14 +90,14 @@ func (s *VolMgrServer) DatanodeRegistry(ctx context.Context, in *vp.DatanodeRegi
 	}
 	defer disk.Close()
 
-	_, err = disk.Exec(ip, dnPort, dnMount, dnCapacity, 0)
+	_, err = disk.Exec(ip, dnPort, dnMount, dnCapacity, 0, in.Labels)
 	if err != nil {
 		logger.Error("DataNode(%v:%v) Registry insert into disks table exec err:%v", ip, dnPort, err)
 		ack.Ret = -1
 		return &ack, err
 	}
 
-	logger.Debug("The disk(%s:%s) mount:%s have registry success", ip, dnPort, dnMount)
+	logger.Debug("The disk(%s:%d) mount:%s have registry success", ip, dnPort, dnMount)
 	ack.Ret = 0 //success
 	return &ack, nil
 }
@@ -104,25 +113,136 @@ func (s *VolMgrServer) DatanodeHeartbeat(ctx context.Context, in *vp.DatanodeHea
 	ip := ipnr.String()
 
 	logger.Debug("The disks(%s:%d) heartbeat info(used:%d -- free:%d -- statu:%d)", ip, port, used, free, statu)
-	disk, err := VolMgrDB.Prepare("UPDATE disks SET used=?,free=? WHERE ip=? and port=?")
+	disk, err := VolMgrDB.Prepare("UPDATE disks SET used=?,free=?,labels=? WHERE ip=? and port=?")
 	checkErr(err)
 	defer disk.Close()
-	_, err = disk.Exec(used, free, ip, port)
+	_, err = disk.Exec(used, free, in.Labels, ip, port)
 	if err != nil {
 		logger.Error("The disk(%s:%d) heartbeat update to db error:%s", ip, port, err)
 		return &ack, nil
 	}
 
-	checkandupdatediskstatu(ip, int(port), int(statu))
+	// a datanode sending its data dirs has them re-replicated one by one
+	checkandupdatediskstatu(ip, int(port), int(statu), len(in.Disks) == 0)
+	for _, d := range in.Disks {
+		updateDataDir(ip, int(port), d)
+	}
+	recordAccess(ip, port, in.Access)
 	return &ack, nil
 }
 
+// ReportCorruptChunk : a datanode scrubber found a chunk not matching its checksums, repair it from the other blks
+func (s *VolMgrServer) ReportCorruptChunk(ctx context.Context, in *vp.ReportCorruptChunkReq) (*vp.ReportCorruptChunkAck, error) {
+	ack := vp.ReportCorruptChunkAck{}
+	ip := utils.InetNtoa(in.Ip).String()
+	logger.Error("The disk(%s:%d) blk:%d chunk:%d is corrupt", ip, in.Port, in.BlockID, in.ChunkID)
+	recordEvent("datanode %s:%d blk %d chunk %d corrupt", ip, in.Port, in.BlockID, in.ChunkID)
+	if failBlk(ip, int(in.Port), int64(in.BlockID), in.ChunkID) != 0 {
+		ack.Ret = 1
+	}
+	return &ack, nil
+}
+
+// updateDataDir keeps the accounting of one data directory of a datanode, a directory
+// failing on a node that is still ok gets its blocks re-replicated alone
+func updateDataDir(ip string, port int, d *vp.DiskStat) {
+	dbstatu := 0
+	err := VolMgrDB.QueryRow("SELECT statu FROM datadirs WHERE ip=? and port=? and path=?", ip, port, d.Path).Scan(&dbstatu)
+	if err != nil && err != sql.ErrNoRows {
+		logger.Error("Get datadir(%s:%d %s) error:%v", ip, port, d.Path, err)
+		return
+	}
+	_, err = VolMgrDB.Exec("INSERT INTO datadirs(ip,port,path,total,used,free,statu) VALUES(?,?,?,?,?,?,?) ON DUPLICATE KEY UPDATE total=VALUES(total),used=VALUES(used),free=VALUES(free),statu=VALUES(statu)",
+		ip, port, d.Path, d.Total, d.Used, d.Free, d.Status)
+	if err != nil {
+		logger.Error("The datadir(%s:%d %s) heartbeat update to db error:%v", ip, port, d.Path, err)
+		return
+	}
+	if dbstatu == 0 && d.Status != 0 && len(d.Blocks) > 0 {
+		logger.Error("The datadir(%s:%d %s) failed with statu:%d, re-replicate its %d blks", ip, port, d.Path, d.Status, len(d.Blocks))
+		recordEvent("datanode %s:%d data dir %s %s, %d blks to re-replicate", ip, port, d.Path, diskStatus[int(d.Status)], len(d.Blocks))
+		blkids := make([]int64, len(d.Blocks))
+		for i, b := range d.Blocks {
+			blkids[i] = int64(b)
+		}
+		go failBlks(ip, port, blkids)
+	}
+}
+
+// Placement : the policy choosing the disks of each block group
+var Placement placement.Policy
+
+// selectDisks : candidates are the disks with more than 10G free, the placement policy picks n of them
+func selectDisks(n int) ([]*placement.Disk, error) {
+	return selectDisksWith(Placement, n)
+}
+
+func selectDisksWith(policy placement.Policy, n int) ([]*placement.Disk, error) {
+	rows, err := VolMgrDB.Query("SELECT ip,port,total,free,labels FROM disks WHERE free > 10")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	candidates := []*placement.Disk{}
+	for rows.Next() {
+		var labels sql.NullString
+		disk := placement.Disk{}
+		err := rows.Scan(&disk.IP, &disk.Port, &disk.Total, &disk.Free, &labels)
+		if err != nil {
+			return nil, err
+		}
+		disk.Labels = placement.ParseLabels(labels.String)
+		candidates = append(candidates, &disk)
+	}
+
+	disks, err := policy.Select(candidates, n)
+	if err != nil {
+		return nil, fmt.Errorf("placement policy %v: %v", policy.Name(), err)
+	}
+	return disks, nil
+}
+
+// loadPlacement : placement = random | capacity | anti-affinity | name of a policy from placement_plugin,
+// placement_labels restricts the candidates to disks carrying those labels
+func loadPlacement(c config.ConfigInterface) {
+	if path := c.String("placement_plugin"); path != "" {
+		p, err := placement.LoadPlugin(path)
+		if err != nil {
+			fmt.Printf("load placement plugin %v err:%v\n", path, err)
+			os.Exit(1)
+		}
+		logger.Debug("placement plugin %v loaded, policy:%v", path, p.Name())
+	}
+	if key := c.String("placement_key"); key != "" {
+		placement.Register(placement.AntiAffinity{Key: key})
+	}
+
+	name := c.String("placement")
+	if name == "" {
+		name = "random"
+	}
+	p, ok := placement.Get(name)
+	if !ok {
+		fmt.Printf("unknown placement policy %v, have %v\n", name, placement.Names())
+		os.Exit(1)
+	}
+	if labels := c.String("placement_labels"); labels != "" {
+		p = placement.LabelConstraint{Labels: placement.ParseLabels(labels), Next: p}
+	}
+	Placement = p
+}
+
 // CreateVol : Creat a Volume for Users
 func (s *VolMgrServer) CreateVol(ctx context.Context, in *vp.CreateVolReq) (*vp.CreateVolAck, error) {
 	ack := vp.CreateVolAck{}
 	volname := in.VolName
 	volsize := in.SpaceQuota
 	metadomain := in.MetaDomain
+	if !validClass(in.StorageClass) {
+		ack.Ret = 22 // EINVAL
+		return &ack, nil
+	}
 	voluuid, err := utils.GenUUID()
 	if err != nil {
 		logger.Error("Create volume uuid err:%v", err)
@@ -141,14 +261,14 @@ func (s *VolMgrServer) CreateVol(ctx context.Context, in *vp.CreateVolReq) (*vp.
 	}
 
 	// insert the volume info to volumes tables
-	vol, err := VolMgrDB.Prepare("INSERT INTO volumes(uuid, name, size,metadomain) VALUES(?, ?, ?, ?)")
+	vol, err := VolMgrDB.Prepare("INSERT INTO volumes(uuid, name, size,metadomain,storageclass) VALUES(?, ?, ?, ?, ?)")
 	if err != nil {
 		logger.Error("Create volume(%s -- %s) insert volumes table error:%s", volname, voluuid, err)
 		ack.Ret = 1 // db error
 		return &ack, err
 	}
 	defer vol.Close()
-	r, err := vol.Exec(voluuid, volname, volsize, metadomain)
+	r, err := vol.Exec(voluuid, volname, volsize, metadomain, in.StorageClass)
 	if err != nil {
 		ack.Ret = 1
 		return &ack, err
@@ -161,24 +281,18 @@ func (s *VolMgrServer) CreateVol(ctx context.Context, in *vp.CreateVolReq) (*vp.
 
 	//allocate block group for the volume
 	for i := int32(0); i < blkgrpnum; i++ {
-		rows, err := VolMgrDB.Query("select ip,port from (select * from disks WHERE free > 10 order by rand())t  group by ip order BY rand() limit 3 for update")
+		disks, err := selectClassDisks(3, in.StorageClass)
 		if err != nil {
 			logger.Error("Create volume(%s -- %s) select blk for the %dth blkgroup error:%s", volname, voluuid, i, err)
+			cleanRS(voluuid)
 			ack.Ret = 1
 			return &ack, err
 		}
-		defer rows.Close()
 
-		var ip string
-		var port int
 		var count int
 		var blks string
-		for rows.Next() {
-			err := rows.Scan(&ip, &port)
-			if err != nil {
-				ack.Ret = 1
-				return &ack, err
-			}
+		for _, disk := range disks {
+			ip, port := disk.IP, disk.Port
 
 			blk, err := VolMgrDB.Prepare("insert into blk(hostip, hostport, disabled, volid) values(?, ?, 0, ?)")
 			if err != nil {
@@ -213,13 +327,14 @@ func (s *VolMgrServer) CreateVol(ctx context.Context, in *vp.CreateVolReq) (*vp.
 		blkgrp.Exec(blks, voluuid)
 
 		if count != 3 {
-			logger.Error("Create The volume(%s -- %s) one blkgroup not equal 3 blk(%s), so create volume failed!", volname, voluuid, count)
+			logger.Error("Create The volume(%s -- %s) one blkgroup not equal 3 blk(%d), so create volume failed!", volname, voluuid, count)
 			cleanRS(voluuid)
 			ack.Ret = 1
 			return &ack, err
 		}
 	}
 
+	recordEvent("volume %s (%s) created", volname, voluuid)
 	ack.Ret = 0 //success
 	ack.UUID = voluuid
 	ack.RaftGroupID = uint64(raftgroupid)
@@ -242,29 +357,28 @@ func (s *VolMgrServer) ExpendVol(ctx context.Context, in *vp.ExpendVolReq) (*vp.
 		blkgrpnum = volsize/BlkSize + 1
 	}
 
+	var class string
+	VolMgrDB.QueryRow("SELECT storageclass FROM volumes WHERE uuid=?", voluuid).Scan(&class)
+
 	pBlockGroups := []*vp.BlockGroup{}
 	//allocate block group for the volume
 	for i := int32(0); i < blkgrpnum; i++ {
-		rows, err := VolMgrDB.Query("select ip,port from (select * from disks WHERE free > 10 order by rand())t  group by ip order BY rand() limit 3 for update")
+		disks, err := selectClassDisks(3, class)
 		if err != nil {
 			logger.Error("Expend volume:%v select blk for the %dth blkgroup error:%s", voluuid, i, err)
+			cleanBlk("", pBlockGroups)
 			ack.Ret = 1
 			return &ack, err
 		}
-		defer rows.Close()
 
-		var ip string
-		var port int
 		var count int
 		var blks string
+		var media []string
 		pBlockInfos := []*vp.BlockInfo{}
-		for rows.Next() {
+		for _, disk := range disks {
 			tmpBlockInfo := vp.BlockInfo{}
-			err := rows.Scan(&ip, &port)
-			if err != nil {
-				ack.Ret = 1
-				return &ack, err
-			}
+			ip, port := disk.IP, disk.Port
+			media = append(media, disk.Labels["media"])
 
 			blk, err := VolMgrDB.Prepare("insert into blk(hostip, hostport, disabled, volid) values(?, ?, 0, ?)")
 			if err != nil {
@@ -297,7 +411,7 @@ func (s *VolMgrServer) ExpendVol(ctx context.Context, in *vp.ExpendVolReq) (*vp.
 		logger.Debug("The Expend volume:%v size:%v one blkgroup have blks:%s", voluuid, volsize, blks)
 
 		if count != 3 {
-			logger.Error("Expend The volume:%v size:%v one blkgroup not equal 3 blk(%s), so create volume failed!", voluuid, volsize, count)
+			logger.Error("Expend The volume:%v size:%v one blkgroup not equal 3 blk(%d), so create volume failed!", voluuid, volsize, count)
 			ack.Ret = 1
 			cleanBlk(blks, pBlockGroups)
 			return &ack, err
@@ -326,6 +440,7 @@ func (s *VolMgrServer) ExpendVol(ctx context.Context, in *vp.ExpendVolReq) (*vp.
 		tmpBlockGroup := vp.BlockGroup{}
 		tmpBlockGroup.BlockGroupID = uint32(blkgrpid)
 		tmpBlockGroup.BlockInfos = pBlockInfos
+		tmpBlockGroup.Media = groupMedia(media)
 		pBlockGroups = append(pBlockGroups, &tmpBlockGroup)
 	}
 
@@ -437,22 +552,280 @@ func cleanRS(volid string) int {
 	return 0
 }
 
-//DeleteVol : Delete a Volume for User
+//DeleteVol : Delete a Volume for User, the volume is kept pending purge for PurgeRetention and can be restored
 func (s *VolMgrServer) DeleteVol(ctx context.Context, in *vp.DeleteVolReq) (*vp.DeleteVolAck, error) {
 	ack := vp.DeleteVolAck{}
 	volid := in.UUID
 
-	if ret := cleanRS(volid); ret != 0 {
-		logger.Debug("== Delete db tables data failed for volume:%v", volid)
-		ack.Ret = -1
-	} else {
-		logger.Debug("== Delete db tables data success for volume:%v", volid)
+	// Purge : the client has already deleted the namespace on the metanodes
+	if in.Purge {
+		if ret := cleanRS(volid); ret != 0 {
+			logger.Debug("== Delete db tables data failed for volume:%v", volid)
+			ack.Ret = -1
+		} else {
+			logger.Debug("== Delete db tables data success for volume:%v", volid)
+			ack.Ret = 0
+		}
+		return &ack, nil
+	}
+
+	if PurgeRetention.Get() == 0 {
+		var metadomain string
+		err := VolMgrDB.QueryRow("SELECT metadomain FROM volumes WHERE uuid = ?", volid).Scan(&metadomain)
+		if err != nil {
+			logger.Error("Delete volume:%v get metadomain error:%v", volid, err)
+			ack.Ret = -1
+			return &ack, nil
+		}
+		if ret := purgeVol(volid, metadomain); ret != 0 {
+			ack.Ret = -1
+			return &ack, nil
+		}
 		ack.Ret = 0
+		return &ack, nil
+	}
+
+	vol, err := VolMgrDB.Prepare("UPDATE volumes SET status=1,deletedTime=NOW() WHERE uuid=? AND status=0")
+	if err != nil {
+		logger.Error("Delete volume:%v prepare volumes table error:%v", volid, err)
+		ack.Ret = -1
+		return &ack, nil
+	}
+	defer vol.Close()
+	r, err := vol.Exec(volid)
+	if err != nil {
+		logger.Error("Delete volume:%v exec volumes table error:%v", volid, err)
+		ack.Ret = -1
+		return &ack, nil
+	}
+	if n, _ := r.RowsAffected(); n == 0 {
+		ack.Ret = 2 // no such volume or already pending purge
+		return &ack, nil
+	}
+
+	logger.Debug("== Volume:%v is pending purge for %v", volid, PurgeRetention.Get())
+	recordEvent("volume %s deleted, pending purge for %v", volid, PurgeRetention.Get())
+	ack.Ret = 0
+	return &ack, nil
+}
+
+// RestoreVol : bring back a volume pending purge
+func (s *VolMgrServer) RestoreVol(ctx context.Context, in *vp.RestoreVolReq) (*vp.RestoreVolAck, error) {
+	ack := vp.RestoreVolAck{}
+	volid := in.UUID
+
+	vol, err := VolMgrDB.Prepare("UPDATE volumes SET status=0,deletedTime=NULL WHERE uuid=? AND status=1")
+	if err != nil {
+		logger.Error("Restore volume:%v prepare volumes table error:%v", volid, err)
+		ack.Ret = -1
+		return &ack, nil
+	}
+	defer vol.Close()
+	r, err := vol.Exec(volid)
+	if err != nil {
+		logger.Error("Restore volume:%v exec volumes table error:%v", volid, err)
+		ack.Ret = -1
+		return &ack, nil
+	}
+	if n, _ := r.RowsAffected(); n == 0 {
+		ack.Ret = 2 // not pending purge
+		return &ack, nil
+	}
+
+	logger.Debug("== Volume:%v restored", volid)
+	recordEvent("volume %s restored", volid)
+	ack.Ret = 0
+	return &ack, nil
+}
+
+// MoveVol : the namespace of the volume migrated to the metanode group of metadomain
+func (s *VolMgrServer) MoveVol(ctx context.Context, in *vp.MoveVolReq) (*vp.MoveVolAck, error) {
+	ack := vp.MoveVolAck{}
+	volid := in.UUID
+
+	r, err := VolMgrDB.Exec("UPDATE volumes SET metadomain=? WHERE uuid=?", in.MetaDomain, volid)
+	if err != nil {
+		logger.Error("Move volume:%v to metadomain:%v error:%v", volid, in.MetaDomain, err)
+		ack.Ret = -1
+		return &ack, nil
+	}
+	if n, _ := r.RowsAffected(); n == 0 {
+		var exists int
+		if err := VolMgrDB.QueryRow("SELECT COUNT(*) FROM volumes WHERE uuid=?", volid).Scan(&exists); err != nil || exists == 0 {
+			ack.Ret = 2 // no such volume
+			return &ack, nil
+		}
+	}
+
+	logger.Debug("== Volume:%v moved to metadomain:%v", volid, in.MetaDomain)
+	ack.Ret = 0
+	return &ack, nil
+}
+
+// AddVolShard : numbers a new metadata shard of a volume
+func (s *VolMgrServer) AddVolShard(ctx context.Context, in *vp.AddVolShardReq) (*vp.AddVolShardAck, error) {
+	ack := vp.AddVolShardAck{}
+	volid := in.UUID
+
+	tx, err := VolMgrDB.Begin()
+	if err != nil {
+		logger.Error("Add shard to volume:%v error:%v", volid, err)
+		ack.Ret = -1
+		return &ack, nil
+	}
+	defer tx.Rollback()
+	var shards int32
+	var raftgroupid uint64
+	err = tx.QueryRow("SELECT shards,raftgroupid FROM volumes WHERE uuid=? FOR UPDATE", volid).Scan(&shards, &raftgroupid)
+	if err == sql.ErrNoRows {
+		ack.Ret = 2 // no such volume
+		return &ack, nil
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE volumes SET shards=? WHERE uuid=?", shards+1, volid)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		logger.Error("Add shard to volume:%v error:%v", volid, err)
+		ack.Ret = -1
+		return &ack, nil
 	}
 
+	logger.Debug("== Volume:%v added shard:%v", volid, shards)
+	ack.Ret = 0
+	ack.Shard = shards
+	ack.RaftGroupID = utils.ShardRaftGroupID(raftgroupid, shards)
 	return &ack, nil
 }
 
+// SetVolReplica : mark a volume as the target of geo-replication, or promote it back
+func (s *VolMgrServer) SetVolReplica(ctx context.Context, in *vp.SetVolReplicaReq) (*vp.SetVolReplicaAck, error) {
+	ack := vp.SetVolReplicaAck{}
+	volid := in.UUID
+
+	var metadomain string
+	var shards int32
+	if err := VolMgrDB.QueryRow("SELECT metadomain,shards FROM volumes WHERE uuid=?", volid).Scan(&metadomain, &shards); err != nil {
+		ack.Ret = 2 // no such volume
+		return &ack, nil
+	}
+	replica := 0
+	if in.Replica {
+		replica = 1
+	}
+	if _, err := VolMgrDB.Exec("UPDATE volumes SET replica=? WHERE uuid=?", replica, volid); err != nil {
+		logger.Error("Set volume:%v replica:%v error:%v", volid, in.Replica, err)
+		ack.Ret = -1
+		return &ack, nil
+	}
+
+	// the metanodes refuse the writes of the clients other than the replication agent
+	for shard := int32(0); shard < shards; shard++ {
+		req := &mp.SetReplicaReq{VolID: utils.ShardVolID(volid, shard), Replica: in.Replica}
+		err := callMetaLeader(metadomain, req.VolID, func(ctx context.Context, mc mp.MetaNodeClient) (int32, error) {
+			a, err := mc.SetReplica(ctx, req)
+			if err != nil {
+				return 0, err
+			}
+			return a.Ret, nil
+		})
+		if err != nil {
+			logger.Error("Set replica of volume:%v on the metanodes error:%v", req.VolID, err)
+			ack.Ret = -1
+			return &ack, nil
+		}
+	}
+
+	logger.Debug("== Volume:%v replica:%v", volid, in.Replica)
+	ack.Ret = 0
+	return &ack, nil
+}
+
+// SetVolWriteQuorum : the replicas a write of the volume waits for, see vp.VolInfo
+func (s *VolMgrServer) SetVolWriteQuorum(ctx context.Context, in *vp.SetVolWriteQuorumReq) (*vp.SetVolWriteQuorumAck, error) {
+	ack := vp.SetVolWriteQuorumAck{}
+	volid := in.UUID
+
+	if in.WriteQuorum < 0 || in.WriteQuorum > 3 {
+		ack.Ret = 22 // EINVAL
+		return &ack, nil
+	}
+	r, err := VolMgrDB.Exec("UPDATE volumes SET writequorum=? WHERE uuid=?", in.WriteQuorum, volid)
+	if err != nil {
+		logger.Error("Set volume:%v writequorum:%v error:%v", volid, in.WriteQuorum, err)
+		ack.Ret = -1
+		return &ack, nil
+	}
+	if n, _ := r.RowsAffected(); n == 0 {
+		var exists int
+		if err := VolMgrDB.QueryRow("SELECT COUNT(*) FROM volumes WHERE uuid=?", volid).Scan(&exists); err != nil || exists == 0 {
+			ack.Ret = 2 // no such volume
+			return &ack, nil
+		}
+	}
+
+	logger.Debug("== Volume:%v writequorum:%v", volid, in.WriteQuorum)
+	ack.Ret = 0
+	return &ack, nil
+}
+
+// purgeVol : drop the namespace on the metanodes, then the blkgrp/blk/volumes rows
+func purgeVol(volid string, metadomain string) int {
+	conn, err := grpc.Dial(metadomain, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Millisecond*300), grpc.FailOnNonTempDialError(true))
+	if err != nil {
+		logger.Error("Purge volume:%v dial to metanode:%v err:%v", volid, metadomain, err)
+		return -1
+	}
+	defer conn.Close()
+	mc := mp.NewMetaNodeClient(conn)
+	pmDeleteNameSpaceReq := &mp.DeleteNameSpaceReq{
+		VolID: volid,
+		Type:  0,
+	}
+	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	pmDeleteNameSpaceAck, err := mc.DeleteNameSpace(ctx, pmDeleteNameSpaceReq)
+	if err != nil || pmDeleteNameSpaceAck.Ret != 0 {
+		logger.Error("Purge volume:%v DeleteNameSpace err:%v", volid, err)
+		return -1
+	}
+
+	ret := cleanRS(volid)
+	if ret == 0 {
+		recordEvent("volume %s purged", volid)
+	}
+	return ret
+}
+
+// purgeExpiredVols : purge the volumes pending purge for longer than PurgeRetention
+func purgeExpiredVols() {
+	var volid string
+	var metadomain string
+	vols, err := VolMgrDB.Query("SELECT uuid,metadomain FROM volumes WHERE status=1 AND deletedTime < DATE_SUB(NOW(), INTERVAL ? SECOND)", int64(PurgeRetention.Get()/time.Second))
+	if err != nil {
+		logger.Error("Get pending purge volumes error:%v", err)
+		return
+	}
+	defer vols.Close()
+	expired := make(map[string]string)
+	for vols.Next() {
+		err = vols.Scan(&volid, &metadomain)
+		if err != nil {
+			logger.Error("Scan pending purge volumes error:%v", err)
+			continue
+		}
+		expired[volid] = metadomain
+	}
+	for volid, metadomain := range expired {
+		if ret := purgeVol(volid, metadomain); ret != 0 {
+			logger.Error("Purge volume:%v failed, retry next round", volid)
+			continue
+		}
+		logger.Debug("== Volume:%v purged", volid)
+	}
+}
+
 //UpdateChunkInfo : Meta send need repair chunk, if the chunk have repair complete, ack to Meta
 func (s *VolMgrServer) UpdateChunkInfo(ctx context.Context, in *vp.UpdateChunkInfoReq) (*vp.UpdateChunkInfoAck, error) {
 	ack := vp.UpdateChunkInfoAck{}
@@ -493,7 +866,16 @@ func (s *VolMgrServer) GetVolInfo(ctx context.Context, in *vp.GetVolInfoReq) (*v
 	var name string
 	var size int32
 	var metadomain string
-	vols, err := VolMgrDB.Query("SELECT name,size,metadomain FROM volumes WHERE uuid = ?", voluuid)
+	var status int32
+	var replica int32
+	var writequorum int32
+	var storageclass string
+	var accessmode string
+	var softlimit int32
+	var hardlimit int32
+	var raftgroupid uint64
+	var deletedTime sql.NullInt64
+	vols, err := VolMgrDB.Query("SELECT name,size,metadomain,status,replica,writequorum,storageclass,accessmode,softlimit,hardlimit,raftgroupid,UNIX_TIMESTAMP(deletedTime) FROM volumes WHERE uuid = ?", voluuid)
 	if err != nil {
 		logger.Error("Get volume(%s) from db error:%s", voluuid, err)
 		ack.Ret = 1
@@ -501,7 +883,7 @@ func (s *VolMgrServer) GetVolInfo(ctx context.Context, in *vp.GetVolInfoReq) (*v
 	}
 	defer vols.Close()
 	for vols.Next() {
-		err = vols.Scan(&name, &size, &metadomain)
+		err = vols.Scan(&name, &size, &metadomain, &status, &replica, &writequorum, &storageclass, &accessmode, &softlimit, &hardlimit, &raftgroupid, &deletedTime)
 		if err != nil {
 			ack.Ret = 1
 			return &ack, err
@@ -510,6 +892,17 @@ func (s *VolMgrServer) GetVolInfo(ctx context.Context, in *vp.GetVolInfoReq) (*v
 		volInfo.VolName = name
 		volInfo.SpaceQuota = size
 		volInfo.MetaDomain = metadomain
+		volInfo.Status = status
+		volInfo.Replica = replica != 0
+		volInfo.WriteQuorum = writequorum
+		volInfo.StorageClass = storageclass
+		volInfo.AccessMode = accessmode
+		volInfo.SoftLimit = softlimit
+		volInfo.HardLimit = hardlimit
+		volInfo.RaftGroupID = raftgroupid
+		if deletedTime.Valid {
+			volInfo.PurgeTime = deletedTime.Int64 + int64(PurgeRetention.Get()/time.Second)
+		}
 	}
 
 	var blkgrpid int
@@ -521,6 +914,10 @@ func (s *VolMgrServer) GetVolInfo(ctx context.Context, in *vp.GetVolInfoReq) (*v
 		return &ack, err
 	}
 	defer blkgrp.Close()
+	diskmedia, _, err := diskMedia()
+	if err != nil {
+		logger.Error("Get disks media for volume(%s) error:%s", voluuid, err)
+	}
 	pBlockGroups := []*vp.BlockGroup{}
 	for blkgrp.Next() {
 		err := blkgrp.Scan(&blkgrpid, &blks)
@@ -531,6 +928,7 @@ func (s *VolMgrServer) GetVolInfo(ctx context.Context, in *vp.GetVolInfoReq) (*v
 		logger.Debug("Get blks:%s in blkgroup:%d for volume(%s)", blks, blkgrpid, voluuid)
 		blkids := strings.Split(blks, ",")
 
+		var media []string
 		pBlockInfos := []*vp.BlockInfo{}
 		for _, ele := range blkids {
 			if ele == "," {
@@ -559,11 +957,13 @@ func (s *VolMgrServer) GetVolInfo(ctx context.Context, in *vp.GetVolInfoReq) (*v
 				tmpBlockInfo.DataNodeIP = ipint
 				tmpBlockInfo.DataNodePort = int32(hostport)
 				pBlockInfos = append(pBlockInfos, &tmpBlockInfo)
+				media = append(media, diskmedia[fmt.Sprintf("%s:%d", hostip, hostport)])
 			}
 		}
 		tmpBlockGroup := vp.BlockGroup{}
 		tmpBlockGroup.BlockGroupID = uint32(blkgrpid)
 		tmpBlockGroup.BlockInfos = pBlockInfos
+		tmpBlockGroup.Media = groupMedia(media)
 		pBlockGroups = append(pBlockGroups, &tmpBlockGroup)
 	}
 	volInfo.BlockGroups = pBlockGroups
@@ -576,7 +976,7 @@ func (s *VolMgrServer) GetVolInfo(ctx context.Context, in *vp.GetVolInfoReq) (*v
 func (s *VolMgrServer) GetVolList(ctx context.Context, in *vp.GetVolListReq) (*vp.GetVolListAck, error) {
 	ack := vp.GetVolListAck{}
 
-	vols, err := VolMgrDB.Query("SELECT raftgroupid,uuid FROM volumes")
+	vols, err := VolMgrDB.Query("SELECT raftgroupid,uuid,shards FROM volumes")
 	if err != nil {
 		logger.Error("Get volumes from db error:%v", err)
 		ack.Ret = 1
@@ -586,10 +986,11 @@ func (s *VolMgrServer) GetVolList(ctx context.Context, in *vp.GetVolListReq) (*v
 
 	var name string
 	var raftgrpid uint64
+	var shards int32
 	pVolIDs := []*vp.VolIDs{}
 
 	for vols.Next() {
-		err = vols.Scan(&raftgrpid, &name)
+		err = vols.Scan(&raftgrpid, &name, &shards)
 		if err != nil {
 			ack.Ret = 1
 			return &ack, err
@@ -597,6 +998,7 @@ func (s *VolMgrServer) GetVolList(ctx context.Context, in *vp.GetVolListReq) (*v
 		tmpVolIDs := vp.VolIDs{}
 		tmpVolIDs.UUID = name
 		tmpVolIDs.RaftGroupID = raftgrpid
+		tmpVolIDs.Shards = shards
 		pVolIDs = append(pVolIDs, &tmpVolIDs)
 	}
 	ack.Ret = 0
@@ -604,7 +1006,126 @@ func (s *VolMgrServer) GetVolList(ctx context.Context, in *vp.GetVolListReq) (*v
 	return &ack, nil
 }
 
-func checkandupdatediskstatu(ip string, port int, statu int) {
+// latencyWindow : client latency samples are kept for the last latencyWindow minutes
+const latencyWindow = 5
+
+type latencySlot struct {
+	minute int64
+	hists  map[string]*utils.Histogram
+}
+
+type volLatency struct {
+	sync.Mutex
+	slots [latencyWindow]latencySlot
+}
+
+var volLatencies = make(map[string]*volLatency)
+var volLatencyMutex sync.RWMutex
+
+func (v *volLatency) merge(op string, counts []uint64) {
+	minute := time.Now().Unix() / 60
+	v.Lock()
+	defer v.Unlock()
+	slot := &v.slots[minute%latencyWindow]
+	if slot.minute != minute {
+		slot.minute = minute
+		slot.hists = make(map[string]*utils.Histogram)
+	}
+	h, ok := slot.hists[op]
+	if !ok {
+		h = utils.NewHistogram()
+		slot.hists[op] = h
+	}
+	h.Merge(counts)
+}
+
+// window sums up the slots of the last latencyWindow minutes for op
+func (v *volLatency) window(op string) *utils.Histogram {
+	minute := time.Now().Unix() / 60
+	sum := utils.NewHistogram()
+	v.Lock()
+	defer v.Unlock()
+	for _, slot := range v.slots {
+		if minute-slot.minute >= latencyWindow {
+			continue
+		}
+		if h, ok := slot.hists[op]; ok {
+			sum.Merge(h.Counts)
+		}
+	}
+	return sum
+}
+
+// ClientHeartbeat : clients push their op latency histograms, aggregated per volume
+func (s *VolMgrServer) ClientHeartbeat(ctx context.Context, in *vp.ClientHeartbeatReq) (*vp.ClientHeartbeatAck, error) {
+	ack := vp.ClientHeartbeatAck{}
+
+	volLatencyMutex.Lock()
+	v, ok := volLatencies[in.VolID]
+	if !ok {
+		v = &volLatency{}
+		volLatencies[in.VolID] = v
+	}
+	volLatencyMutex.Unlock()
+
+	for _, h := range in.Histograms {
+		v.merge(h.Op, h.Counts)
+	}
+	refreshMount(in)
+	logger.Debug("Client(%s) heartbeat for volume(%s)", in.Host, in.VolID)
+	ack.Ret = 0
+	return &ack, nil
+}
+
+// GetVolLatency : p50/p99 read and write latency of a volume over the last latencyWindow minutes
+func (s *VolMgrServer) GetVolLatency(ctx context.Context, in *vp.GetVolLatencyReq) (*vp.GetVolLatencyAck, error) {
+	ack := vp.GetVolLatencyAck{}
+
+	volLatencyMutex.RLock()
+	v, ok := volLatencies[in.UUID]
+	volLatencyMutex.RUnlock()
+	if !ok {
+		ack.Ret = 2 // no client reported for this volume
+		return &ack, nil
+	}
+
+	read := v.window("read")
+	write := v.window("write")
+	ack.ReadP50 = read.Quantile(0.50)
+	ack.ReadP99 = read.Quantile(0.99)
+	ack.ReadOps = read.Total()
+	ack.WriteP50 = write.Quantile(0.50)
+	ack.WriteP99 = write.Quantile(0.99)
+	ack.WriteOps = write.Total()
+	ack.Ret = 0
+	return &ack, nil
+}
+
+// GetDataNodes : the datanodes with their labels, the clients order the replicas they read by them
+func (s *VolMgrServer) GetDataNodes(ctx context.Context, in *vp.GetDataNodesReq) (*vp.GetDataNodesAck, error) {
+	ack := vp.GetDataNodesAck{}
+	rows, err := VolMgrDB.Query("SELECT DISTINCT ip,port,labels FROM disks")
+	if err != nil {
+		logger.Error("Get datanodes from disks table error:%v", err)
+		ack.Ret = -1
+		return &ack, nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ip string
+		var port int32
+		var labels sql.NullString
+		if err := rows.Scan(&ip, &port, &labels); err != nil {
+			logger.Error("Scan db for datanodes error:%v", err)
+			continue
+		}
+		ack.DataNodes = append(ack.DataNodes, &vp.DataNodeTopo{Ip: utils.InetAton(net.ParseIP(ip)), Port: port, Labels: labels.String})
+	}
+	ack.Ret = 0
+	return &ack, nil
+}
+
+func checkandupdatediskstatu(ip string, port int, statu int, failBlocks bool) {
 	var dbstatu int
 	disks, err := VolMgrDB.Query("SELECT statu FROM disks where ip=? and port=?", ip, port)
 	if err != nil {
@@ -620,13 +1141,184 @@ func checkandupdatediskstatu(ip string, port int, statu int) {
 		}
 	}
 
-	if dbstatu == 0 && statu == 2 {
-		updateDataNodeStatu(ip, port, 2)
-	} else if dbstatu == 2 && statu == 0 {
-		updateDataNodeStatu(ip, port, 0)
-	} else {
+	// 1 (unreachable) is left to detectdatanode
+	if statu == dbstatu || dbstatu == 1 {
 		return
 	}
+	updateDataNodeStatu(ip, port, statu)
+	if failBlocks && dbstatu == 0 && (statu == 2 || statu == 3) {
+		// 2 offline, 3 read-only: the disk is failing, re-replicate its blocks
+		go failDisk(ip, port)
+	}
+}
+
+// failDisk re-replicates all the blocks of a failed datanode disk
+func failDisk(ip string, port int) {
+	var blkids []int64
+	rows, err := VolMgrDB.Query("SELECT blkid FROM blk WHERE hostip=? and hostport=? and volid IS NOT NULL", ip, port)
+	if err != nil {
+		logger.Error("Get blks of failed disk(%s:%d) error:%v", ip, port, err)
+		return
+	}
+	for rows.Next() {
+		var blkid int64
+		if err := rows.Scan(&blkid); err != nil {
+			logger.Error("Scan blks of failed disk(%s:%d) error:%v", ip, port, err)
+			continue
+		}
+		blkids = append(blkids, blkid)
+	}
+	rows.Close()
+	failBlks(ip, port, blkids)
+}
+
+// failBlks moves the blocks of a failed disk or data dir to healthy disks of other
+// hosts: the metanodes mark their copies bad and point the block groups there, and
+// the repair daemons copy the chunks back from the other blocks of each group. A
+// block no disk takes is left queued where it is, repaired once the disk is replaced.
+func failBlks(ip string, port int, blkids []int64) {
+	_, disks, err := diskMedia()
+	if err != nil {
+		logger.Error("Get disks for the blks of failed disk(%s:%d) error:%v", ip, port, err)
+	}
+	for _, blkid := range blkids {
+		if err := moveFailedBlk(ip, port, blkid, disks); err != nil {
+			logger.Error("Move failed blk:%v off %s:%d error:%v, repaired once the disk is back", blkid, ip, port, err)
+			failBlk(ip, port, blkid, 0)
+		}
+	}
+}
+
+// moveFailedBlk moves the blk on the failed disk ip:port to one of disks, its chunks
+// are queued for repair there
+func moveFailedBlk(ip string, port int, blkid int64, disks []*placement.Disk) error {
+	var volid sql.NullString
+	if err := VolMgrDB.QueryRow("SELECT volid FROM blk WHERE blkid=? and hostip=? and hostport=?", blkid, ip, port).Scan(&volid); err != nil || !volid.Valid {
+		return nil
+	}
+	var metadomain string
+	if err := VolMgrDB.QueryRow("SELECT metadomain FROM volumes WHERE uuid=?", volid.String).Scan(&metadomain); err != nil {
+		return err
+	}
+	blkgrpid, position, ok := blkGroupOf(volid.String, blkid)
+	if !ok {
+		return nil
+	}
+	to, err := blkTarget(volid.String, blkgrpid, disks, placement.WeightedCapacity{})
+	if err != nil {
+		return err
+	}
+	chunks, err := failBlock(metadomain, &mp.FailBlockReq{
+		VolID:        volid.String,
+		BlockGroupID: blkgrpid,
+		Position:     position,
+		MoveToIP:     utils.InetAton(net.ParseIP(to[0].IP)),
+		MoveToPort:   int32(to[0].Port),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := VolMgrDB.Exec("UPDATE blk SET hostip=?, hostport=? WHERE blkid=?", to[0].IP, to[0].Port, blkid); err != nil {
+		return err
+	}
+	for _, c := range chunks {
+		_, err := VolMgrDB.Exec("insert into repair(volid,blkgrpid,blkid,blkip,blkport,chkid,status,position,inode) values(?, ?, ?, ?, ?, ?, ?, ?,?)",
+			volid.String, blkgrpid, blkid, to[0].IP, to[0].Port, c.ChunkID, 2, position, c.Inode)
+		if err != nil {
+			logger.Error("insert failed volid:%v - blk:%v - chunk:%v to repair table error:%v", volid.String, blkid, c.ChunkID, err)
+		}
+	}
+	logger.Debug("The failed blk:%v of volume:%v moved from %s:%d to %v, %v chunks queued for repair", blkid, volid.String, ip, port, to[0].Addr(), len(chunks))
+	recordEvent("failed blk %d of volume %s moved from %s:%d to %s", blkid, volid.String, ip, port, to[0].Addr())
+	return nil
+}
+
+// failBlk marks the copies on blk bad in the metanode and queues them for repair,
+// only chunkID when it is not 0
+func failBlk(ip string, port int, blkid int64, chunkID uint64) int {
+	var volid sql.NullString
+	if err := VolMgrDB.QueryRow("SELECT volid FROM blk WHERE blkid=? and hostip=? and hostport=?", blkid, ip, port).Scan(&volid); err != nil || !volid.Valid {
+		return 0
+	}
+	var metadomain string
+	if err := VolMgrDB.QueryRow("SELECT metadomain FROM volumes WHERE uuid=?", volid.String).Scan(&metadomain); err != nil {
+		logger.Error("Get metadomain of volume:%v for failed blk:%v error:%v", volid.String, blkid, err)
+		return -1
+	}
+	blkgrpid, position, ok := blkGroupOf(volid.String, blkid)
+	if !ok {
+		return 0
+	}
+	chunks, err := failBlock(metadomain, &mp.FailBlockReq{VolID: volid.String, BlockGroupID: blkgrpid, Position: position, ChunkID: chunkID})
+	if err != nil {
+		logger.Error("FailBlock volume:%v blkgrp:%v blk:%v error:%v", volid.String, blkgrpid, blkid, err)
+		return -1
+	}
+	for _, c := range chunks {
+		_, err := VolMgrDB.Exec("insert into repair(volid,blkgrpid,blkid,blkip,blkport,chkid,status,position,inode) values(?, ?, ?, ?, ?, ?, ?, ?,?)",
+			volid.String, blkgrpid, blkid, ip, port, c.ChunkID, 2, position, c.Inode)
+		if err != nil {
+			logger.Error("insert failed volid:%v - blk:%v - chunk:%v to repair table error:%v", volid.String, blkid, c.ChunkID, err)
+		}
+	}
+	logger.Debug("The failed blk:%v of volume:%v on %s:%d queued %v chunks for repair", blkid, volid.String, ip, port, len(chunks))
+	return 0
+}
+
+// blkGroupOf the block group of a blk and the position of the blk in it
+func blkGroupOf(volid string, blkid int64) (uint32, int32, bool) {
+	rows, err := VolMgrDB.Query("SELECT blkgrpid,blks FROM blkgrp WHERE volume_uuid = ?", volid)
+	if err != nil {
+		logger.Error("Get blkgroups for volume(%s) error:%s", volid, err)
+		return 0, 0, false
+	}
+	defer rows.Close()
+	id := strconv.FormatInt(blkid, 10)
+	for rows.Next() {
+		var blkgrpid uint32
+		var blks string
+		if err := rows.Scan(&blkgrpid, &blks); err != nil {
+			continue
+		}
+		for i, v := range strings.Split(blks, ",") {
+			if v == id {
+				return blkgrpid, int32(i), true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// failBlock asks the metanode leader of the volume, metadomain may be a follower
+func failBlock(metadomain string, req *mp.FailBlockReq) ([]*mp.FailedChunk, error) {
+	volid := req.VolID
+	addr := metadomain
+	for try := 0; try < 2; try++ {
+		conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Millisecond*300), grpc.FailOnNonTempDialError(true))
+		if err != nil {
+			return nil, err
+		}
+		mc := mp.NewMetaNodeClient(conn)
+		ctx, _ := context.WithTimeout(context.Background(), 60*time.Second)
+		ack, err := mc.FailBlock(ctx, req)
+		if err == nil && ack.Ret == utils.NotLeader {
+			ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+			if leader, lerr := mc.GetMetaLeader(ctx, &mp.GetMetaLeaderReq{VolID: volid}); lerr == nil && leader.Ret == 0 {
+				conn.Close()
+				addr = leader.Leader
+				continue
+			}
+		}
+		conn.Close()
+		if err != nil {
+			return nil, err
+		}
+		if ack.Ret != 0 {
+			return nil, fmt.Errorf("ret %v", ack.Ret)
+		}
+		return ack.Chunks, nil
+	}
+	return nil, fmt.Errorf("no metanode leader for volume %v", volid)
 }
 
 func detectdatanode(ip string, port int, statu int) {
@@ -671,7 +1363,8 @@ func updateDataNodeStatu(ip string, port int, statu int) {
 		logger.Error("The disk(%s:%d) update statu:%v to db error:%s", ip, port, statu, err)
 		return
 	}
-	if statu == 1 || statu == 2 {
+	recordEvent("datanode %s:%d %s", ip, port, diskStatus[statu])
+	if statu == 1 || statu == 2 || statu == 3 {
 		logger.Debug("The disk(%s:%d) bad statu:%d, so make it all blks is disabled, and update metadata for allocated blks", ip, port, statu)
 		blk, err := VolMgrDB.Prepare("UPDATE blk SET disabled=1 WHERE hostip=? and hostport=?")
 		checkErr(err)
@@ -682,13 +1375,13 @@ func updateDataNodeStatu(ip string, port int, statu int) {
 		}
 
 	} else if statu == 0 {
-		logger.Debug("The disk(%s:%d) recovy,so update from 1 to 0, make it all blks is able", ip, port, statu)
+		logger.Debug("The disk(%s:%d) recovy,so update from %d to 0, make it all blks is able", ip, port, statu)
 		blk, err := VolMgrDB.Prepare("UPDATE blk SET disabled=0 WHERE hostip=? and hostport=?")
 		checkErr(err)
 		defer blk.Close()
 		_, err = blk.Exec(ip, port)
 		if err != nil {
-			logger.Error("The disk(%s:%d) recovy , but update blk table able error:%s", ip, port, statu, err)
+			logger.Error("The disk(%s:%d) recovy from %d, but update blk table able error:%v", ip, port, statu, err)
 		}
 
 	}
@@ -727,7 +1420,7 @@ func StartVolMgrService() {
 	vp.RegisterVolMgrServer(s, &VolMgrServer{})
 	// Register reflection service on gRPC server.
 	reflection.Register(s)
-	if err := s.Serve(lis); err != nil {
+	if err := s.Serve(utils.CountConns(lis)); err != nil {
 		panic("Failed to serve")
 	}
 }
@@ -748,6 +1441,29 @@ func (s *MdcServer) FetchMeters(ctx context.Context, in *vp.MdcRequest) (*vp.Met
 	meter.Type = "gague"
 
 	ack.Meters = append(ack.Meters, &meter)
+
+	volLatencyMutex.RLock()
+	for volid, v := range volLatencies {
+		for _, op := range []string{"read", "write"} {
+			h := v.window(op)
+			if h.Total() == 0 {
+				continue
+			}
+			for _, q := range []float64{0.50, 0.99} {
+				m := vp.Meter{}
+				m.Name = fmt.Sprintf("Volume %s Latency P%d", op, int(q*100))
+				m.Unit = "us"
+				m.Volume = float32(h.Quantile(q))
+				m.Resource = "volume#" + volid
+				m.IP = VolMgrServerAddr.host
+				m.Timestamp = ""
+				m.Type = "gague"
+				ack.Meters = append(ack.Meters, &m)
+			}
+		}
+	}
+	volLatencyMutex.RUnlock()
+
 	return &ack, nil
 }
 
@@ -773,10 +1489,13 @@ func init() {
 		fmt.Println("NewConfig err")
 		os.Exit(1)
 	}
+	utils.ConfigEnv(c)
 	port, _ := c.Int("port")
 	VolMgrServerAddr.port = port
 	VolMgrServerAddr.log = c.String("log")
 	VolMgrServerAddr.host = c.String("host")
+	VolMgrServerAddr.debug = c.String("debug_addr")
+	VolMgrServerAddr.dashboard = c.String("dashboard_addr")
 	os.MkdirAll(VolMgrServerAddr.log, 0777)
 
 	mysqlConf.dbhost = c.String("mysql::host")
@@ -786,6 +1505,24 @@ func init() {
 
 	logger.SetConsole(true)
 	logger.SetRollingFile(VolMgrServerAddr.log, "volmgr.log", 10, 100, logger.MB) //each 100M rolling
+	if err := logger.Configure(c.String("logformat"), c.String("logoutput"), c.String("logmodules"), "cfs-volmgr"); err != nil {
+		fmt.Println("log config err:", err)
+		os.Exit(1)
+	}
+	loadTunables(c)
+
+	loadPlacement(c)
+
+	VolMgrDB, err = sql.Open("mysql", mysqlConf.dbusername+":"+mysqlConf.dbpassword+"@tcp("+mysqlConf.dbhost+")/"+mysqlConf.dbname+"?charset=utf8")
+	checkErr(err)
+	err = VolMgrDB.Ping()
+	checkErr(err)
+
+}
+
+// loadTunables reads the keys that take effect on a running volmgr, at start and
+// again on SIGHUP
+func loadTunables(c config.ConfigInterface) {
 	switch level := c.String("loglevel"); level {
 	case "error":
 		logger.SetLevel(logger.ERROR)
@@ -796,13 +1533,48 @@ func init() {
 	default:
 		logger.SetLevel(logger.ERROR)
 	}
+	if levels, err := logger.ParseModuleLevels(c.String("logmodules")); err != nil {
+		logger.Error("config: %v, keep the levels of the modules", err)
+	} else {
+		logger.SetModuleLevels(levels)
+	}
+	retention, err := c.Int("purge_retention")
+	if err != nil {
+		retention = 24
+	}
+	PurgeRetention.Set(time.Duration(retention) * time.Hour)
 
-	VolMgrDB, err = sql.Open("mysql", mysqlConf.dbusername+":"+mysqlConf.dbpassword+"@tcp("+mysqlConf.dbhost+")/"+mysqlConf.dbname+"?charset=utf8")
-	checkErr(err)
-	err = VolMgrDB.Ping()
-	checkErr(err)
+	secs, _ := c.Int("tier_interval_secs")
+	TierInterval.Set(time.Duration(secs) * time.Second)
+	if hours, err := c.Int("tier_cold_hours"); err == nil && hours > 0 {
+		TierColdAge.Set(time.Duration(hours) * time.Hour)
+	}
+	if ops, err := c.Int64("tier_hot_ops"); err == nil && ops > 0 {
+		TierHotOps.Set(int(ops))
+	}
+	if n, err := c.Int("tier_moves"); err == nil && n > 0 {
+		TierMoves.Set(n)
+	}
 
+	secs, _ = c.Int("gc_interval_secs")
+	GCInterval.Set(time.Duration(secs) * time.Second)
+	if hours, err := c.Int("gc_grace_hours"); err == nil && hours > 0 {
+		GCGrace.Set(time.Duration(hours) * time.Hour)
+	}
+}
+
+// reloadConfig applies the tunables from the config file and the environment
+func reloadConfig(path string) {
+	c, err := config.NewConfig(path)
+	if err != nil {
+		logger.Error("reload config %v err:%v", path, err)
+		return
+	}
+	utils.ConfigEnv(c)
+	loadTunables(c)
+	logger.Info("config %v reloaded", path)
 }
+
 func main() {
 
 	//for multi-cpu scheduling
@@ -820,12 +1592,37 @@ func main() {
 	go func() {
 		for range ticker.C {
 			detectDataNodes()
+			purgeExpiredVols()
 		}
 	}()
 	Wg.Wait()
 	defer VolMgrDB.Close()
 	go StartVolMgrService()
 	go StarMdcService()
+	go tierLoop()
+	go gcLoop()
+
+	// SIGHUP re-reads the tunables without a restart
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadConfig(os.Args[1])
+		}
+	}()
+	if VolMgrServerAddr.debug != "" {
+		err := utils.ServeDebug(VolMgrServerAddr.debug, func() map[string]int64 {
+			return map[string]int64{"db_conns": int64(VolMgrDB.Stats().OpenConnections)}
+		})
+		if err != nil {
+			logger.Error("listen on debug addr %v err:%v", VolMgrServerAddr.debug, err)
+		}
+	}
+	if VolMgrServerAddr.dashboard != "" {
+		if err := serveDashboard(VolMgrServerAddr.dashboard); err != nil {
+			logger.Error("listen on dashboard addr %v err:%v", VolMgrServerAddr.dashboard, err)
+		}
+	}
 
 	loop := make(chan int)
 	<-loop
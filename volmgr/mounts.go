@@ -0,0 +1,219 @@
+package main
+
+import (
+	"github.com/ipdcode/containerfs/logger"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	vp "github.com/ipdcode/containerfs/proto/vp"
+	"github.com/ipdcode/containerfs/utils"
+	"golang.org/x/net/context"
+	"sync"
+	"time"
+)
+
+// access modes of a volume, checked when a client registers its mount
+const (
+	accessRWX = ""    // any mounts
+	accessRWO = "RWO" // one host mounts it read-write, any read-only
+	accessROX = "ROX" // read-only mounts only
+)
+
+func validAccessMode(mode string) bool {
+	switch mode {
+	case accessRWX, "RWX", accessRWO, accessROX:
+		return true
+	}
+	return false
+}
+
+// mountTTL a mount not heartbeated for it is dropped, a crashed client frees the
+// volume after it
+var mountTTL = 60 * time.Second
+
+type mountEntry struct {
+	host       string
+	mountPoint string
+	readOnly   bool
+	seen       time.Time
+}
+
+// the mounts registered per volume and client, in memory: after a restart they are
+// rebuilt from the heartbeats of the clients
+var mounts = make(map[string]map[string]*mountEntry)
+var mountsMutex sync.Mutex
+
+// mountsSince until mountTTL after it the registry may miss live mounts
+var mountsSince = time.Now()
+
+func volAccessMode(volid string) (string, int32) {
+	var mode string
+	err := VolMgrDB.QueryRow("SELECT accessmode FROM volumes WHERE uuid=?", volid).Scan(&mode)
+	if err != nil {
+		return "", 2 // no such volume
+	}
+	if mode == "RWX" {
+		mode = accessRWX
+	}
+	return mode, 0
+}
+
+// expireMounts drops the mounts of volid gone silent, mountsMutex held
+func expireMounts(volid string) map[string]*mountEntry {
+	vm := mounts[volid]
+	for id, m := range vm {
+		if time.Since(m.seen) > mountTTL {
+			logger.Info("mount %v:%v of volume:%v expired", m.host, m.mountPoint, volid)
+			delete(vm, id)
+		}
+	}
+	return vm
+}
+
+// writer the read-write mount of another host than host, nil when none
+func writer(vm map[string]*mountEntry, host string) *mountEntry {
+	for _, m := range vm {
+		if !m.readOnly && m.host != host {
+			return m
+		}
+	}
+	return nil
+}
+
+// RegisterMount : a client registers its mount of a volume, refused when the access
+// mode of the volume does not allow it
+func (s *VolMgrServer) RegisterMount(ctx context.Context, in *vp.RegisterMountReq) (*vp.RegisterMountAck, error) {
+	ack := vp.RegisterMountAck{}
+
+	mode, ret := volAccessMode(in.VolID)
+	if ret != 0 {
+		ack.Ret = ret
+		return &ack, nil
+	}
+	if mode == accessROX && !in.ReadOnly {
+		ack.Ret = 30 // EROFS
+		return &ack, nil
+	}
+
+	mountsMutex.Lock()
+	defer mountsMutex.Unlock()
+	vm := expireMounts(in.VolID)
+	if mode == accessRWO && !in.ReadOnly {
+		if m := writer(vm, in.Host); m != nil {
+			ack.Ret = 16 // EBUSY
+			ack.Holder = m.host + ":" + m.mountPoint
+			return &ack, nil
+		}
+		if time.Since(mountsSince) < mountTTL {
+			// the writer may not have heartbeated since the restart
+			ack.Ret = 11 // EAGAIN
+			return &ack, nil
+		}
+	}
+	if vm == nil {
+		vm = make(map[string]*mountEntry)
+		mounts[in.VolID] = vm
+	}
+	vm[in.ClientID] = &mountEntry{host: in.Host, mountPoint: in.MountPoint, readOnly: in.ReadOnly, seen: time.Now()}
+	logger.Debug("== Volume:%v mounted by %v:%v readonly:%v", in.VolID, in.Host, in.MountPoint, in.ReadOnly)
+	ack.Ret = 0
+	return &ack, nil
+}
+
+// UnregisterMount : a client unmounted the volume
+func (s *VolMgrServer) UnregisterMount(ctx context.Context, in *vp.UnregisterMountReq) (*vp.UnregisterMountAck, error) {
+	ack := vp.UnregisterMountAck{}
+
+	mountsMutex.Lock()
+	if vm, ok := mounts[in.VolID]; ok {
+		delete(vm, in.ClientID)
+		if len(vm) == 0 {
+			delete(mounts, in.VolID)
+		}
+	}
+	mountsMutex.Unlock()
+	ack.Ret = 0
+	return &ack, nil
+}
+
+// refreshMount the heartbeat of a registered mount, registering it again when the
+// volmgr restarted since
+func refreshMount(in *vp.ClientHeartbeatReq) {
+	if in.ClientID == "" {
+		return
+	}
+	mountsMutex.Lock()
+	defer mountsMutex.Unlock()
+	vm := mounts[in.VolID]
+	if vm == nil {
+		vm = make(map[string]*mountEntry)
+		mounts[in.VolID] = vm
+	}
+	m, ok := vm[in.ClientID]
+	if !ok {
+		m = &mountEntry{host: in.Host, mountPoint: in.MountPoint, readOnly: in.ReadOnly}
+		vm[in.ClientID] = m
+	}
+	m.seen = time.Now()
+}
+
+// SetVolAccessMode : the access mode of a volume, RWO, ROX or RWX. Refused with
+// EBUSY when the mounts registered do not fit it, they must unmount first
+func (s *VolMgrServer) SetVolAccessMode(ctx context.Context, in *vp.SetVolAccessModeReq) (*vp.SetVolAccessModeAck, error) {
+	ack := vp.SetVolAccessModeAck{}
+	volid := in.UUID
+
+	if !validAccessMode(in.AccessMode) {
+		ack.Ret = 22 // EINVAL
+		return &ack, nil
+	}
+	mode := in.AccessMode
+	if mode == "RWX" {
+		mode = accessRWX
+	}
+
+	mountsMutex.Lock()
+	defer mountsMutex.Unlock()
+	writers := make(map[string]bool)
+	for _, m := range expireMounts(volid) {
+		if !m.readOnly {
+			writers[m.host] = true
+		}
+	}
+	if (mode == accessROX && len(writers) > 0) || (mode == accessRWO && len(writers) > 1) {
+		ack.Ret = 16 // EBUSY
+		return &ack, nil
+	}
+
+	var metadomain string
+	var shards int32
+	if err := VolMgrDB.QueryRow("SELECT metadomain,shards FROM volumes WHERE uuid=?", volid).Scan(&metadomain, &shards); err != nil {
+		ack.Ret = 2 // no such volume
+		return &ack, nil
+	}
+	_, err := VolMgrDB.Exec("UPDATE volumes SET accessmode=? WHERE uuid=?", mode, volid)
+	if err != nil {
+		logger.Error("Set volume:%v accessmode:%v error:%v", volid, mode, err)
+		ack.Ret = -1
+		return &ack, nil
+	}
+
+	// the metanodes enforce it on the sessions and the writes of all the clients
+	for shard := int32(0); shard < shards; shard++ {
+		req := &mp.SetAccessModeReq{VolID: utils.ShardVolID(volid, shard), AccessMode: in.AccessMode}
+		err := callMetaLeader(metadomain, req.VolID, func(ctx context.Context, mc mp.MetaNodeClient) (int32, error) {
+			a, err := mc.SetAccessMode(ctx, req)
+			if err != nil {
+				return 0, err
+			}
+			return a.Ret, nil
+		})
+		if err != nil {
+			logger.Error("Set access mode of volume:%v on the metanodes error:%v", req.VolID, err)
+			ack.Ret = -1
+			return &ack, nil
+		}
+	}
+
+	logger.Debug("== Volume:%v accessmode:%v", volid, mode)
+	ack.Ret = 0
+	return &ack, nil
+}
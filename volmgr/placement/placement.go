@@ -0,0 +1,244 @@
+package placement
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"plugin"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Disk candidate disk for a block, one row of the disks table
+type Disk struct {
+	IP     string
+	Port   int
+	Total  int64 // GB
+	Free   int64 // GB
+	Labels map[string]string
+}
+
+// Addr ...
+func (d *Disk) Addr() string {
+	return fmt.Sprintf("%s:%d", d.IP, d.Port)
+}
+
+// Policy chooses n disks out of the candidates for one block group
+type Policy interface {
+	Name() string
+	Select(disks []*Disk, n int) ([]*Disk, error)
+}
+
+// ErrNotEnoughDisks the candidates can not satisfy the policy
+var ErrNotEnoughDisks = errors.New("not enough disks for the placement policy")
+
+var (
+	policiesMu sync.RWMutex
+	policies   = make(map[string]Policy)
+)
+
+// Register makes a policy available by name, registering a name twice replaces the old one
+func Register(p Policy) {
+	policiesMu.Lock()
+	policies[p.Name()] = p
+	policiesMu.Unlock()
+}
+
+// Get ...
+func Get(name string) (Policy, bool) {
+	policiesMu.RLock()
+	defer policiesMu.RUnlock()
+	p, ok := policies[name]
+	return p, ok
+}
+
+// Names registered policy names
+func Names() []string {
+	policiesMu.RLock()
+	defer policiesMu.RUnlock()
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadPlugin loads a custom policy from a go plugin (go build -buildmode=plugin),
+// the plugin must export a variable named Policy implementing the Policy interface
+func LoadPlugin(path string) (Policy, error) {
+	pl, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sym, err := pl.Lookup("Policy")
+	if err != nil {
+		return nil, err
+	}
+	var p Policy
+	switch v := sym.(type) {
+	case *Policy:
+		p = *v
+	case Policy:
+		p = v
+	default:
+		return nil, fmt.Errorf("plugin %s: Policy symbol is %T, not a placement.Policy", path, sym)
+	}
+	Register(p)
+	return p, nil
+}
+
+// ParseLabels parses "k1=v1,k2=v2"
+func ParseLabels(s string) map[string]string {
+	labels := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			labels[kv] = ""
+			continue
+		}
+		labels[strings.TrimSpace(kv[:i])] = strings.TrimSpace(kv[i+1:])
+	}
+	return labels
+}
+
+var rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+var rndMu sync.Mutex
+
+func shuffle(disks []*Disk) []*Disk {
+	out := make([]*Disk, len(disks))
+	copy(out, disks)
+	rndMu.Lock()
+	for i := len(out) - 1; i > 0; i-- {
+		j := rnd.Intn(i + 1)
+		out[i], out[j] = out[j], out[i]
+	}
+	rndMu.Unlock()
+	return out
+}
+
+// domain of a disk for anti-affinity, the ip when the disk has no such label
+func domain(d *Disk, key string) string {
+	if key != "" {
+		if v, ok := d.Labels[key]; ok {
+			return v
+		}
+	}
+	return d.IP
+}
+
+// pickSpread takes disks in order, at most one per failure domain
+func pickSpread(ordered []*Disk, n int, key string) ([]*Disk, error) {
+	used := make(map[string]bool)
+	out := make([]*Disk, 0, n)
+	for _, d := range ordered {
+		dom := domain(d, key)
+		if used[dom] {
+			continue
+		}
+		used[dom] = true
+		out = append(out, d)
+		if len(out) == n {
+			return out, nil
+		}
+	}
+	return nil, ErrNotEnoughDisks
+}
+
+// Random random disks on distinct hosts, the original volmgr behaviour
+type Random struct{}
+
+// Name ...
+func (Random) Name() string { return "random" }
+
+// Select ...
+func (Random) Select(disks []*Disk, n int) ([]*Disk, error) {
+	return pickSpread(shuffle(disks), n, "")
+}
+
+// WeightedCapacity distinct hosts, disks with more free space are more likely to be chosen
+type WeightedCapacity struct{}
+
+// Name ...
+func (WeightedCapacity) Name() string { return "capacity" }
+
+// Select ...
+func (WeightedCapacity) Select(disks []*Disk, n int) ([]*Disk, error) {
+	// weighted random order: sort by -log(u)/weight (exponential keys)
+	type keyed struct {
+		d   *Disk
+		key float64
+	}
+	ks := make([]keyed, 0, len(disks))
+	rndMu.Lock()
+	for _, d := range disks {
+		w := float64(d.Free)
+		if w <= 0 {
+			continue
+		}
+		ks = append(ks, keyed{d, rnd.ExpFloat64() / w})
+	}
+	rndMu.Unlock()
+	sort.Slice(ks, func(i, j int) bool { return ks[i].key < ks[j].key })
+	ordered := make([]*Disk, len(ks))
+	for i := range ks {
+		ordered[i] = ks[i].d
+	}
+	return pickSpread(ordered, n, "")
+}
+
+// AntiAffinity spreads the copies over distinct values of a label (rack, zone ...)
+type AntiAffinity struct {
+	Key string
+}
+
+// Name ...
+func (AntiAffinity) Name() string { return "anti-affinity" }
+
+// Select ...
+func (a AntiAffinity) Select(disks []*Disk, n int) ([]*Disk, error) {
+	return pickSpread(shuffle(disks), n, a.Key)
+}
+
+// LabelConstraint keeps only the disks carrying all the labels, then lets Next choose
+type LabelConstraint struct {
+	Labels map[string]string
+	Next   Policy
+}
+
+// Name ...
+func (c LabelConstraint) Name() string { return "label" }
+
+// Select ...
+func (c LabelConstraint) Select(disks []*Disk, n int) ([]*Disk, error) {
+	matched := make([]*Disk, 0, len(disks))
+	for _, d := range disks {
+		ok := true
+		for k, v := range c.Labels {
+			if dv, has := d.Labels[k]; !has || dv != v {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			matched = append(matched, d)
+		}
+	}
+	next := c.Next
+	if next == nil {
+		next = Random{}
+	}
+	return next.Select(matched, n)
+}
+
+func init() {
+	Register(Random{})
+	Register(WeightedCapacity{})
+	Register(AntiAffinity{Key: "rack"})
+}
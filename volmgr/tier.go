@@ -0,0 +1,467 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/ipdcode/containerfs/logger"
+	dp "github.com/ipdcode/containerfs/proto/dp"
+	mp "github.com/ipdcode/containerfs/proto/mp"
+	vp "github.com/ipdcode/containerfs/proto/vp"
+	"github.com/ipdcode/containerfs/utils"
+	"github.com/ipdcode/containerfs/volmgr/placement"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// storage classes of a volume, the media of its blocks by the media label of the datanodes
+const (
+	classAny  = ""
+	classSSD  = "ssd"
+	classHDD  = "hdd"
+	classAuto = "auto" // new blocks on ssd, moved to hdd once cold and back once hot
+)
+
+func validClass(class string) bool {
+	switch class {
+	case classAny, classSSD, classHDD, classAuto:
+		return true
+	}
+	return false
+}
+
+// tiering, see tierPass
+var (
+	TierInterval utils.Duration                          // between passes, 0 stops tiering
+	TierColdAge  = utils.NewDuration(7 * 24 * time.Hour) // auto volumes: a block not accessed for it goes to hdd
+	TierHotOps   = utils.NewInt(1000)                    // auto volumes: a block with that heat goes to ssd
+	TierMoves    = utils.NewInt(4)                       // blocks moved per pass
+)
+
+// selectClassDisks : selectDisks on the disks of the media of class, auto takes any
+// disk when there are not enough ssd
+func selectClassDisks(n int, class string) ([]*placement.Disk, error) {
+	if class == classAny {
+		return selectDisks(n)
+	}
+	media := class
+	if class == classAuto {
+		media = classSSD
+	}
+	disks, err := selectDisksWith(placement.LabelConstraint{Labels: map[string]string{"media": media}, Next: Placement}, n)
+	if err != nil && class == classAuto {
+		return selectDisks(n)
+	}
+	return disks, err
+}
+
+// SetVolStorageClass : the media of the blocks of a volume, the blocks on another
+// media are moved by the tiering passes
+func (s *VolMgrServer) SetVolStorageClass(ctx context.Context, in *vp.SetVolStorageClassReq) (*vp.SetVolStorageClassAck, error) {
+	ack := vp.SetVolStorageClassAck{}
+	volid := in.UUID
+
+	if !validClass(in.StorageClass) {
+		ack.Ret = 22 // EINVAL
+		return &ack, nil
+	}
+	r, err := VolMgrDB.Exec("UPDATE volumes SET storageclass=? WHERE uuid=?", in.StorageClass, volid)
+	if err != nil {
+		logger.Error("Set volume:%v storageclass:%v error:%v", volid, in.StorageClass, err)
+		ack.Ret = -1
+		return &ack, nil
+	}
+	if n, _ := r.RowsAffected(); n == 0 {
+		var exists int
+		if err := VolMgrDB.QueryRow("SELECT COUNT(*) FROM volumes WHERE uuid=?", volid).Scan(&exists); err != nil || exists == 0 {
+			ack.Ret = 2 // no such volume
+			return &ack, nil
+		}
+	}
+
+	logger.Debug("== Volume:%v storageclass:%v", volid, in.StorageClass)
+	ack.Ret = 0
+	return &ack, nil
+}
+
+// recordAccess : the heat of a block is its chunk ops, halved each tiering pass
+func recordAccess(ip string, port int32, access []*vp.BlockAccess) {
+	for _, a := range access {
+		_, err := VolMgrDB.Exec("UPDATE blk SET heat=heat+?, lastaccess=FROM_UNIXTIME(?) WHERE blkid=? and hostip=? and hostport=?",
+			a.Ops, a.Last, a.BlockID, ip, port)
+		if err != nil {
+			logger.Error("update access of blk:%v on %v:%v error:%v", a.BlockID, ip, port, err)
+			return
+		}
+	}
+}
+
+// tierLoop runs a tiering pass every TierInterval
+func tierLoop() {
+	for {
+		interval := TierInterval.Get()
+		if interval <= 0 {
+			time.Sleep(time.Minute)
+			continue
+		}
+		time.Sleep(interval)
+		if TierInterval.Get() > 0 {
+			tierPass()
+			switchMoves()
+			cleanMoves()
+		}
+	}
+}
+
+// tierBlk a block of a volume with a storage class
+type tierBlk struct {
+	blkid int64
+	ip    string
+	port  int
+	volid string
+	heat  int64
+	last  time.Time
+	want  string // media it should be on
+}
+
+// wantMedia the media a block of a volume of class belongs on, empty where it is
+func wantMedia(class string, heat int64, last time.Time) string {
+	switch class {
+	case classSSD, classHDD:
+		return class
+	case classAuto:
+		if heat >= int64(TierHotOps.Get()) {
+			return classSSD
+		}
+		if time.Since(last) > TierColdAge.Get() {
+			return classHDD
+		}
+	}
+	return ""
+}
+
+// groupMedia the media label the disks of the blocks of a block group share, empty
+// when they differ: the metanode places the files with a tier policy by it
+func groupMedia(media []string) string {
+	if len(media) == 0 {
+		return ""
+	}
+	for _, m := range media[1:] {
+		if m != media[0] {
+			return ""
+		}
+	}
+	return media[0]
+}
+
+// diskMedia the media label of each datanode, by ip:port
+func diskMedia() (map[string]string, []*placement.Disk, error) {
+	rows, err := VolMgrDB.Query("SELECT ip,port,total,free,labels FROM disks WHERE statu=0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	media := make(map[string]string)
+	var disks []*placement.Disk
+	for rows.Next() {
+		var labels sql.NullString
+		d := &placement.Disk{}
+		if err := rows.Scan(&d.IP, &d.Port, &d.Total, &d.Free, &labels); err != nil {
+			return nil, nil, err
+		}
+		d.Labels = placement.ParseLabels(labels.String)
+		media[d.Addr()] = d.Labels["media"]
+		disks = append(disks, d)
+	}
+	return media, disks, nil
+}
+
+// tierPass moves up to TierMoves blocks to the media their volume wants, the hottest
+// promotions and the coldest demotions first. The repair daemon of the new datanode
+// copies the chunks of the block there first (repair status 3, the metadata is left
+// alone), switchMoves then points the block group at it, failing only the chunks
+// written since their copy, and cleanMoves deletes the old copies after.
+func tierPass() {
+	if _, err := VolMgrDB.Exec("UPDATE blk SET heat = heat DIV 2 WHERE heat > 0"); err != nil {
+		logger.Error("tiering: cool blks error:%v", err)
+		return
+	}
+	media, disks, err := diskMedia()
+	if err != nil {
+		logger.Error("tiering: get disks error:%v", err)
+		return
+	}
+
+	rows, err := VolMgrDB.Query(`SELECT b.blkid,b.hostip,b.hostport,b.volid,v.storageclass,b.heat,
+		UNIX_TIMESTAMP(COALESCE(b.lastaccess,b.createdTime)) FROM blk b JOIN volumes v ON b.volid=v.uuid
+		WHERE v.storageclass != '' AND v.status=0
+		AND NOT EXISTS (SELECT 1 FROM repair r WHERE r.blkid=b.blkid)
+		AND NOT EXISTS (SELECT 1 FROM blkmoves m WHERE m.blkid=b.blkid)`)
+	if err != nil {
+		logger.Error("tiering: get blks error:%v", err)
+		return
+	}
+	var moves []*tierBlk
+	for rows.Next() {
+		var class string
+		var last int64
+		b := &tierBlk{}
+		if err := rows.Scan(&b.blkid, &b.ip, &b.port, &b.volid, &class, &b.heat, &last); err != nil {
+			continue
+		}
+		b.last = time.Unix(last, 0)
+		b.want = wantMedia(class, b.heat, b.last)
+		cur := media[b.ip+":"+strconv.Itoa(b.port)]
+		if b.want != "" && cur != "" && cur != b.want {
+			moves = append(moves, b)
+		}
+	}
+	rows.Close()
+
+	sort.Slice(moves, func(i, j int) bool {
+		if moves[i].want != moves[j].want {
+			return moves[i].want == classSSD
+		}
+		if moves[i].want == classSSD {
+			return moves[i].heat > moves[j].heat
+		}
+		return moves[i].last.Before(moves[j].last)
+	})
+	for i, b := range moves {
+		if i == TierMoves.Get() {
+			break
+		}
+		if err := moveBlk(b, disks); err != nil {
+			logger.Error("tiering: move blk:%v of volume:%v to %v error:%v", b.blkid, b.volid, b.want, err)
+		}
+	}
+}
+
+// moveBlk moves b to a disk of the media it wants, on a host holding no other block of its group
+func moveBlk(b *tierBlk, disks []*placement.Disk) error {
+	blkgrpid, position, ok := blkGroupOf(b.volid, b.blkid)
+	if !ok {
+		return fmt.Errorf("no block group")
+	}
+	to, err := blkTarget(b.volid, blkgrpid, disks, placement.LabelConstraint{Labels: map[string]string{"media": b.want}, Next: placement.WeightedCapacity{}})
+	if err != nil {
+		return err
+	}
+
+	var metadomain string
+	if err := VolMgrDB.QueryRow("SELECT metadomain FROM volumes WHERE uuid=?", b.volid).Scan(&metadomain); err != nil {
+		return err
+	}
+	chunks, err := failBlock(metadomain, &mp.FailBlockReq{
+		VolID:        b.volid,
+		BlockGroupID: blkgrpid,
+		Position:     position,
+		ListOnly:     true,
+	})
+	if err != nil {
+		return err
+	}
+	if len(chunks) == 0 {
+		// nothing to copy, a move row still marks the block for switchMoves
+		chunks = []*mp.FailedChunk{{}}
+	}
+	for _, c := range chunks {
+		if c.ChunkID != 0 {
+			_, err := VolMgrDB.Exec("insert into repair(volid,blkgrpid,blkid,blkip,blkport,chkid,status,position,inode) values(?, ?, ?, ?, ?, ?, ?, ?,?)",
+				b.volid, blkgrpid, b.blkid, to[0].IP, to[0].Port, c.ChunkID, 3, position, c.Inode)
+			if err != nil {
+				logger.Error("insert moving volid:%v - blk:%v - chunk:%v to repair table error:%v", b.volid, b.blkid, c.ChunkID, err)
+			}
+		}
+		_, err = VolMgrDB.Exec("insert into blkmoves(volid,blkgrpid,blkid,oldip,oldport,newip,newport,chkid,chksize) values(?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			b.volid, blkgrpid, b.blkid, b.ip, b.port, to[0].IP, to[0].Port, c.ChunkID, c.ChunkSize)
+		if err != nil {
+			logger.Error("insert moving volid:%v - blk:%v - chunk:%v to blkmoves table error:%v", b.volid, b.blkid, c.ChunkID, err)
+		}
+	}
+	logger.Debug("tiering: blk:%v of volume:%v moving from %v:%v to %v (%v), %v chunks to copy",
+		b.blkid, b.volid, b.ip, b.port, to[0].Addr(), b.want, len(chunks))
+	return nil
+}
+
+// blkTarget picks with p a disk for a block of the group blkgrpid of volid to move
+// to, on a host holding no other block of the group
+func blkTarget(volid string, blkgrpid uint32, disks []*placement.Disk, p placement.Policy) ([]*placement.Disk, error) {
+	var blks string
+	if err := VolMgrDB.QueryRow("SELECT blks FROM blkgrp WHERE blkgrpid=?", blkgrpid).Scan(&blks); err != nil {
+		return nil, err
+	}
+	taken := make(map[string]bool)
+	rows, err := VolMgrDB.Query("SELECT hostip FROM blk WHERE volid=? and FIND_IN_SET(blkid, ?)", volid, blks)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var ip string
+		if rows.Scan(&ip) == nil {
+			taken[ip] = true
+		}
+	}
+	rows.Close()
+
+	var candidates []*placement.Disk
+	for _, d := range disks {
+		if !taken[d.IP] && d.Free > 10 {
+			candidates = append(candidates, d)
+		}
+	}
+	return p.Select(candidates, 1)
+}
+
+// switchMoves points the blocks whose chunks are all copied to their new datanode,
+// the chunks written since their copy are failed there and repaired
+func switchMoves() {
+	rows, err := VolMgrDB.Query(`SELECT m.volid,m.blkgrpid,m.blkid,m.oldip,m.oldport,m.newip,m.newport,m.chkid,m.chksize FROM blkmoves m
+		WHERE m.switched=0 AND NOT EXISTS (SELECT 1 FROM repair r WHERE r.blkid=m.blkid)`)
+	if err != nil {
+		logger.Error("tiering: get moving blks error:%v", err)
+		return
+	}
+	type move struct {
+		volid    string
+		blkgrpid uint32
+		oldip    string
+		oldport  int
+		newip    string
+		newport  int
+		copied   []*mp.FailedChunk
+	}
+	moves := make(map[int64]*move)
+	for rows.Next() {
+		var blkid int64
+		var chkid uint64
+		var chksize int32
+		m := &move{}
+		if err := rows.Scan(&m.volid, &m.blkgrpid, &blkid, &m.oldip, &m.oldport, &m.newip, &m.newport, &chkid, &chksize); err != nil {
+			continue
+		}
+		if moves[blkid] == nil {
+			moves[blkid] = m
+		}
+		if chkid != 0 {
+			moves[blkid].copied = append(moves[blkid].copied, &mp.FailedChunk{ChunkID: chkid, ChunkSize: chksize})
+		}
+	}
+	rows.Close()
+
+	for blkid, m := range moves {
+		_, position, ok := blkGroupOf(m.volid, blkid)
+		if !ok {
+			logger.Error("tiering: moving blk:%v of volume:%v has no block group", blkid, m.volid)
+			continue
+		}
+		var metadomain string
+		if err := VolMgrDB.QueryRow("SELECT metadomain FROM volumes WHERE uuid=?", m.volid).Scan(&metadomain); err != nil {
+			logger.Error("tiering: get metadomain of volume:%v error:%v", m.volid, err)
+			continue
+		}
+		chunks, err := failBlock(metadomain, &mp.FailBlockReq{
+			VolID:        m.volid,
+			BlockGroupID: m.blkgrpid,
+			Position:     position,
+			MoveToIP:     utils.InetAton(net.ParseIP(m.newip)),
+			MoveToPort:   int32(m.newport),
+			Copied:       m.copied,
+		})
+		if err != nil {
+			logger.Error("tiering: switch blk:%v of volume:%v to %v:%v error:%v", blkid, m.volid, m.newip, m.newport, err)
+			continue
+		}
+		if _, err := VolMgrDB.Exec("UPDATE blk SET hostip=?, hostport=?, heat=0 WHERE blkid=?", m.newip, m.newport, blkid); err != nil {
+			logger.Error("tiering: update blk:%v to %v:%v error:%v", blkid, m.newip, m.newport, err)
+			continue
+		}
+		had := make(map[uint64]bool)
+		for _, c := range m.copied {
+			had[c.ChunkID] = true
+		}
+		for _, c := range chunks {
+			_, err := VolMgrDB.Exec("insert into repair(volid,blkgrpid,blkid,blkip,blkport,chkid,status,position,inode) values(?, ?, ?, ?, ?, ?, ?, ?,?)",
+				m.volid, m.blkgrpid, blkid, m.newip, m.newport, c.ChunkID, 2, position, c.Inode)
+			if err != nil {
+				logger.Error("insert moved volid:%v - blk:%v - chunk:%v to repair table error:%v", m.volid, blkid, c.ChunkID, err)
+			}
+			if had[c.ChunkID] {
+				continue
+			}
+			had[c.ChunkID] = true
+			_, err = VolMgrDB.Exec("insert into blkmoves(volid,blkgrpid,blkid,oldip,oldport,newip,newport,chkid,switched) values(?, ?, ?, ?, ?, ?, ?, ?, 1)",
+				m.volid, m.blkgrpid, blkid, m.oldip, m.oldport, m.newip, m.newport, c.ChunkID)
+			if err != nil {
+				logger.Error("insert moved volid:%v - blk:%v - chunk:%v to blkmoves table error:%v", m.volid, blkid, c.ChunkID, err)
+			}
+		}
+		VolMgrDB.Exec("UPDATE blkmoves SET switched=1 WHERE blkid=?", blkid)
+		logger.Debug("tiering: blk:%v of volume:%v moved from %v:%v to %v:%v, %v chunks written since the copy to repair",
+			blkid, m.volid, m.oldip, m.oldport, m.newip, m.newport, len(chunks))
+		recordEvent("tiering: blk %d of volume %s moved from %s:%d to %s:%d", blkid, m.volid, m.oldip, m.oldport, m.newip, m.newport)
+	}
+}
+
+// cleanMoves deletes the old copies of the chunks of moved blocks once repaired on the new disk
+func cleanMoves() {
+	rows, err := VolMgrDB.Query(`SELECT m.id,m.volid,m.blkgrpid,m.blkid,m.oldip,m.oldport,m.chkid,b.hostip,b.hostport FROM blkmoves m
+		JOIN blk b ON m.blkid=b.blkid WHERE m.switched=1 AND NOT EXISTS (SELECT 1 FROM repair r WHERE r.blkid=m.blkid and r.chkid=m.chkid)`)
+	if err != nil {
+		logger.Error("tiering: get moved blks error:%v", err)
+		return
+	}
+	type move struct {
+		id       int64
+		volid    string
+		blkgrpid uint32
+		blkid    uint32
+		oldAddr  string
+		chkid    uint64
+		back     bool
+	}
+	var moves []move
+	for rows.Next() {
+		var m move
+		var oldip, ip string
+		var oldport, port int
+		if err := rows.Scan(&m.id, &m.volid, &m.blkgrpid, &m.blkid, &oldip, &oldport, &m.chkid, &ip, &port); err != nil {
+			continue
+		}
+		m.oldAddr = oldip + ":" + strconv.Itoa(oldport)
+		// moved back there since, the copy is the live one again
+		m.back = oldip == ip && oldport == port
+		moves = append(moves, m)
+	}
+	rows.Close()
+
+	for _, m := range moves {
+		if !m.back && m.chkid != 0 {
+			if err := deleteOldChunk(m.oldAddr, &dp.DeleteChunkReq{ChunkID: m.chkid, BlockID: m.blkid, VolID: m.volid, BlockGroupID: m.blkgrpid, Background: true, KeepArchive: true}); err != nil {
+				logger.Error("tiering: delete old chunk:%v of blk:%v on %v error:%v", m.chkid, m.blkid, m.oldAddr, err)
+				continue
+			}
+		}
+		VolMgrDB.Exec("DELETE FROM blkmoves WHERE id=?", m.id)
+	}
+}
+
+func deleteOldChunk(addr string, req *dp.DeleteChunkReq) error {
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(time.Second))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	ack, err := dp.NewDataNodeClient(conn).DeleteChunk(ctx, req)
+	if err != nil {
+		return err
+	}
+	if ack.Ret != 0 {
+		return fmt.Errorf("ret %v", ack.Ret)
+	}
+	return nil
+}